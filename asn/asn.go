@@ -0,0 +1,143 @@
+// Package asn maps IP addresses to their autonomous systems, so whole
+// networks such as bulletproof hosters can be blocked, or corporate egress
+// exempted, by AS number. Tables are read from the ip2asn TSV files
+// published at https://iptoasn.com, in the public domain.
+package asn
+
+import (
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/netip"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/headswim/whoen/ipaddr"
+)
+
+// Table maps address ranges to AS numbers
+type Table struct {
+	ranges []asRange // Sorted by start, not overlapping
+}
+
+// asRange is a range of addresses announced by one autonomous system
+type asRange struct {
+	start, end netip.Addr
+	number     uint32
+}
+
+// Load reads a table from an ip2asn TSV file such as ip2asn-combined.tsv,
+// gzip compressed if its name ends in .gz
+func Load(path string) (*Table, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var r io.Reader = f
+	if strings.HasSuffix(path, ".gz") {
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %w", path, err)
+		}
+		defer gz.Close()
+		r = gz
+	}
+
+	table, err := Parse(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	return table, nil
+}
+
+// Parse reads a table in the ip2asn TSV format: range start, range end, AS
+// number, country and description, separated by tabs. Ranges with AS number
+// 0, which are not routed, are left out.
+func Parse(r io.Reader) (*Table, error) {
+	table := &Table{}
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		fields := strings.Split(text, "\t")
+		if len(fields) < 3 {
+			return nil, fmt.Errorf("line %d: expected range start, range end and AS number", line)
+		}
+		start, err := ipaddr.Parse(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: invalid range start %q", line, fields[0])
+		}
+		end, err := ipaddr.Parse(fields[1])
+		if err != nil || end.Less(start) || end.Is4() != start.Is4() {
+			return nil, fmt.Errorf("line %d: invalid range end %q", line, fields[1])
+		}
+		number, err := strconv.ParseUint(strings.TrimSpace(fields[2]), 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: invalid AS number %q", line, fields[2])
+		}
+		if number == 0 {
+			continue
+		}
+
+		table.ranges = append(table.ranges, asRange{start: start, end: end, number: uint32(number)})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	sort.Slice(table.ranges, func(i, j int) bool {
+		return table.ranges[i].start.Less(table.ranges[j].start)
+	})
+	return table, nil
+}
+
+// Len returns the number of ranges in the table
+func (t *Table) Len() int {
+	return len(t.ranges)
+}
+
+// Lookup returns the autonomous system of an IP as "AS<number>", or an empty
+// string if the IP is invalid or not in the table. It has the signature of
+// middleware.Options.ASNLookup.
+func (t *Table) Lookup(ip string) string {
+	addr, err := ipaddr.Parse(ip)
+	if err != nil {
+		return ""
+	}
+
+	// The last range starting at or before the address is the only candidate
+	i := sort.Search(len(t.ranges), func(i int) bool {
+		return addr.Less(t.ranges[i].start)
+	})
+	if i == 0 {
+		return ""
+	}
+	r := t.ranges[i-1]
+	if r.end.Less(addr) {
+		return ""
+	}
+	return "AS" + strconv.FormatUint(uint64(r.number), 10)
+}
+
+// Normalize returns an AS number in the form Lookup returns, accepting
+// "AS13335", "as13335" and "13335"
+func Normalize(value string) (string, error) {
+	value = strings.TrimSpace(value)
+	digits := value
+	if len(value) > 2 && strings.EqualFold(value[:2], "AS") {
+		digits = value[2:]
+	}
+	number, err := strconv.ParseUint(digits, 10, 32)
+	if err != nil || number == 0 {
+		return "", fmt.Errorf("invalid AS number %q", value)
+	}
+	return "AS" + strconv.FormatUint(number, 10), nil
+}
@@ -0,0 +1,103 @@
+// Package audit records operator actions and the middleware's own block
+// decisions in an append-only log
+package audit
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Actions recorded in the audit log
+const (
+	ActionBlock           = "block"
+	ActionUnblock         = "unblock"
+	ActionWhitelistAdd    = "whitelist_add"
+	ActionWhitelistRemove = "whitelist_remove"
+	ActionExpire          = "expire"
+	ActionExtend          = "extend"  // A block was extended because the IP kept probing
+	ActionCleanup         = "cleanup" // A cleanup run lifted expired blocks
+	ActionImport          = "import"  // Blocks were imported from a blocklist
+	ActionMigrate         = "migrate" // Blocks were copied to or from another storage backend
+)
+
+// ActorWhoen is the actor of the decisions the middleware makes on its own
+const ActorWhoen = "whoen"
+
+// State is the state of an IP before or after an action
+type State struct {
+	Blocked      bool      `json:"blocked"`
+	IsPermanent  bool      `json:"is_permanent,omitempty"`
+	BlockedUntil time.Time `json:"blocked_until,omitempty"`
+	Whitelisted  bool      `json:"whitelisted"`
+}
+
+// Entry is a single record in the audit log
+type Entry struct {
+	Time     time.Time `json:"time"`
+	Actor    string    `json:"actor"`
+	Action   string    `json:"action"`
+	IP       string    `json:"ip,omitempty"`
+	Reason   string    `json:"reason,omitempty"`
+	Path     string    `json:"path,omitempty"`    // Request that triggered a detection
+	Pattern  string    `json:"pattern,omitempty"` // Pattern that triggered a detection
+	Count    int       `json:"count,omitempty"`   // Malicious requests of a detection, or IPs a cleanup or import covered
+	Expires  time.Time `json:"expires,omitempty"` // When a temporary action lapses
+	Previous *State    `json:"previous,omitempty"`
+	Current  *State    `json:"current,omitempty"`
+}
+
+// Logger writes audit entries
+type Logger interface {
+	Log(entry Entry) error
+}
+
+// FileLogger appends audit entries to a JSON Lines file
+type FileLogger struct {
+	path  string
+	mutex sync.Mutex
+}
+
+// NewFileLogger creates a FileLogger. The file is created on the first entry.
+func NewFileLogger(path string) *FileLogger {
+	return &FileLogger{path: path}
+}
+
+// Log appends an entry to the audit file
+func (l *FileLogger) Log(entry Entry) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if entry.Time.IsZero() {
+		entry.Time = time.Now()
+	}
+
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(l.path), 0755); err != nil {
+		return fmt.Errorf("failed to create audit log directory: %w", err)
+	}
+
+	f, err := os.OpenFile(l.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open audit log %s: %w", l.path, err)
+	}
+	defer f.Close()
+
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		return fmt.Errorf("failed to write audit log %s: %w", l.path, err)
+	}
+	return nil
+}
+
+// Discard drops all audit entries
+type Discard struct{}
+
+// Log ignores the entry
+func (Discard) Log(entry Entry) error { return nil }
@@ -0,0 +1,35 @@
+package blocker
+
+import (
+	"fmt"
+	"net/netip"
+	"strings"
+	"time"
+
+	"github.com/headswim/whoen/ipaddr"
+)
+
+// checkIP returns ErrInvalidIP unless ip is an IP address or CIDR range
+// with nothing around it, so it can go into firewall commands and scripts
+func checkIP(ip string) error {
+	if _, err := ipaddr.ParsePrefix(ip); err != nil || strings.TrimSpace(ip) != ip || strings.Contains(ip, "%") {
+		return fmt.Errorf("%w: %q", ErrInvalidIP, ip)
+	}
+	return nil
+}
+
+// BlockAddr blocks an address. IPv4-mapped IPv6 addresses are blocked as the
+// IPv4 address they map.
+func (s *Service) BlockAddr(addr netip.Addr, blockType BlockType, duration time.Duration) (*BlockResult, error) {
+	return s.Block(ipaddr.Canonical(addr).String(), blockType, duration)
+}
+
+// UnblockAddr unblocks an address
+func (s *Service) UnblockAddr(addr netip.Addr) error {
+	return s.Unblock(ipaddr.Canonical(addr).String())
+}
+
+// IsBlockedAddr checks if an address is blocked
+func (s *Service) IsBlockedAddr(addr netip.Addr) (bool, error) {
+	return s.IsBlocked(ipaddr.Canonical(addr).String())
+}
@@ -0,0 +1,73 @@
+package blocker
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// TestCheckIP checks that only IP addresses and CIDR ranges are accepted
+func TestCheckIP(t *testing.T) {
+	for _, ip := range []string{"192.0.2.1", "2001:db8::1", "10.0.0.0/8", "2001:db8::/32"} {
+		if err := checkIP(ip); err != nil {
+			t.Errorf("checkIP(%q) = %v, want nil", ip, err)
+		}
+	}
+	for _, ip := range []string{
+		"",
+		"not an ip",
+		"192.0.2.1'; Start-Process calc; '",
+		"192.0.2.1’; Start-Process calc; ’",
+		" 192.0.2.1",
+		"192.0.2.1\r\n",
+		"fe80::1%eth0",
+		"192.0.2.1/33",
+	} {
+		if err := checkIP(ip); !errors.Is(err, ErrInvalidIP) {
+			t.Errorf("checkIP(%q) = %v, want ErrInvalidIP", ip, err)
+		}
+	}
+}
+
+// TestBlockRejectsInvalidIPs checks that Block and BlockBatch reject values
+// that are not IPs before tracking or enforcing anything
+func TestBlockRejectsInvalidIPs(t *testing.T) {
+	s := NewServiceWithOptions("linux", Options{})
+	const bad = "192.0.2.1'; Start-Process calc; '"
+
+	if _, err := s.Block(bad, Ban, 0); !errors.Is(err, ErrInvalidIP) {
+		t.Errorf("Block = %v, want ErrInvalidIP", err)
+	}
+	if err := s.BlockBatch([]string{"192.0.2.2", bad}, Timeout, time.Hour); !errors.Is(err, ErrInvalidIP) {
+		t.Errorf("BlockBatch = %v, want ErrInvalidIP", err)
+	}
+	if s.Len() != 0 {
+		t.Errorf("%d IPs tracked after rejected blocks, want none", s.Len())
+	}
+
+	if err := s.RestoreBlocks(map[string]time.Time{"192.0.2.3": {}, bad: {}}); err != nil {
+		t.Fatalf("RestoreBlocks failed: %v", err)
+	}
+	if blocked, _ := s.IsBlocked("192.0.2.3"); !blocked || s.Len() != 1 {
+		t.Errorf("RestoreBlocks tracks %d IPs, want only the valid one", s.Len())
+	}
+}
+
+// TestPSQuote checks that every quote PowerShell ends a single-quoted string
+// at is escaped
+func TestPSQuote(t *testing.T) {
+	tests := map[string]string{
+		"192.0.2.1":  "'192.0.2.1'",
+		"a'b":        "'a''b'",
+		"a‘b":        "'a‘‘b'",
+		"a’b":        "'a’’b'",
+		"a‚b":        "'a‚‚b'",
+		"a‛b":        "'a‛‛b'",
+		"whoen-in-x": "'whoen-in-x'",
+	}
+	for value, want := range tests {
+		if got := psQuote(value); got != want {
+			t.Errorf("psQuote(%q) = %q, want %q", value, got, want)
+		}
+	}
+}
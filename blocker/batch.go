@@ -0,0 +1,325 @@
+package blocker
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/headswim/whoen/ipaddr"
+)
+
+// BlockBatch blocks many IPs alike, see Block. The new blocks are applied to
+// the OS firewall together: with one iptables-restore run on Linux, one
+// pfctl table load on macOS and one PowerShell run on the NetSecurity
+// backend. firewalld and netsh rules are still added one at a time.
+func (s *Service) BlockBatch(ips []string, blockType BlockType, duration time.Duration) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	// Zero time for permanent blocks
+	expiration := time.Time{}
+	if blockType == Timeout {
+		expiration = time.Now().Add(duration)
+	}
+
+	// Only IPs and ranges reach the firewall, the batch is rejected otherwise
+	normalized := make([]string, len(ips))
+	for i, ip := range ips {
+		normalized[i] = ipaddr.Normalize(ip)
+		if err := checkIP(normalized[i]); err != nil {
+			return err
+		}
+	}
+
+	// Permanent and longer blocks stay as they are; the firewall only changes
+	// for new blocks, and for rules that carry their own timeout
+	changes := make(map[string]time.Time, len(ips))
+	for _, ip := range normalized {
+		delete(s.pending, ip)
+		current, exists := s.blockedIPs[ip]
+		if exists && (current.IsZero() || (blockType == Timeout && expiration.Before(current))) {
+			continue
+		}
+		if exists && s.enforced(current) == s.enforced(expiration) && !s.timedRules() {
+			s.blockedIPs[ip] = expiration
+			continue
+		}
+		changes[ip] = expiration
+	}
+	return s.applyBatch(changes)
+}
+
+// UnblockBatch unblocks many IPs, removing their firewall rules together
+// where the backend allows, see BlockBatch
+func (s *Service) UnblockBatch(ips []string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	tracked := make([]string, 0, len(ips))
+	for _, ip := range ips {
+		ip = ipaddr.Normalize(ip)
+		delete(s.pending, ip)
+		if _, exists := s.blockedIPs[ip]; exists {
+			tracked = append(tracked, ip)
+		}
+	}
+	return s.liftBatch(s.forget(tracked))
+}
+
+// applyBatch applies blocks by IP and expiration time to the OS firewall and
+// tracks them. Without a batch form on the backend the blocks are applied
+// one by one, tracking each that succeeded. Blocks that failed are queued for
+// retry, and the first failure is returned. Blocks kept out of the firewall
+// are only tracked, removing the rule an earlier block of the IP had. The
+// caller must hold the lock.
+func (s *Service) applyBatch(blocks map[string]time.Time) error {
+	var first error
+	for ip, expiration := range blocks {
+		if s.enforced(expiration) {
+			continue
+		}
+		if current, exists := s.blockedIPs[ip]; exists && s.enforced(current) {
+			if err := s.unblockOS(ip); err != nil && first == nil {
+				first = fmt.Errorf("failed to remove the firewall rule of %s: %w", ip, err)
+			}
+		}
+		s.blockedIPs[ip] = expiration
+		delete(blocks, ip)
+	}
+	if len(blocks) == 0 {
+		return first
+	}
+
+	if s.batchable() {
+		ips := make([]string, 0, len(blocks))
+		for ip := range blocks {
+			ips = append(ips, ip)
+		}
+		sort.Strings(ips)
+		if err := s.blockOSBatch(ips); err != nil {
+			for ip, expiration := range blocks {
+				s.queue(ip, false, expiration, err)
+			}
+			return err
+		}
+		for ip, expiration := range blocks {
+			s.blockedIPs[ip] = expiration
+		}
+		return first
+	}
+
+	for ip, expiration := range blocks {
+		if err := s.blockOS(ip, expiration); err != nil {
+			s.queue(ip, false, expiration, err)
+			if first == nil {
+				first = fmt.Errorf("failed to block IP %s: %w", ip, err)
+			}
+			continue
+		}
+		s.blockedIPs[ip] = expiration
+	}
+	return first
+}
+
+// liftBatch removes the firewall rules of tracked IPs and stops tracking
+// them, see applyBatch. The caller must hold the lock.
+func (s *Service) liftBatch(ips []string) error {
+	if len(ips) == 0 {
+		return nil
+	}
+
+	if s.batchable() {
+		if err := s.unblockOSBatch(ips); err != nil {
+			for _, ip := range ips {
+				s.queue(ip, true, time.Time{}, err)
+			}
+			return err
+		}
+		for _, ip := range ips {
+			delete(s.blockedIPs, ip)
+		}
+		return nil
+	}
+
+	var first error
+	for _, ip := range ips {
+		if err := s.unblockOS(ip); err != nil {
+			s.queue(ip, true, time.Time{}, err)
+			if first == nil {
+				first = err
+			}
+			continue
+		}
+		delete(s.blockedIPs, ip)
+	}
+	return first
+}
+
+// batchable reports whether the backend changes many rules in one go. The
+// caller must hold the lock.
+func (s *Service) batchable() bool {
+	if !s.options.Enforce {
+		return false
+	}
+	switch s.systemType {
+	case "linux":
+		return s.options.Backend != BackendFirewalld
+	case "darwin":
+		return true
+	case "windows":
+		return s.options.Backend == BackendNetFirewall
+	}
+	return false
+}
+
+// blockOSBatch blocks IPs with a single firewall change on a batchable backend
+func (s *Service) blockOSBatch(ips []string) error {
+	return s.blockError(ips, false, s.retry(func() error {
+		switch s.systemType {
+		case "linux":
+			return blockIPsLinux(s.privilege, ips, s.options.BlockOutbound)
+		case "darwin":
+			return blockIPsDarwin(s.privilege, ips, s.options.EnablePF)
+		default:
+			return blockIPsNetFirewall(ips, s.options.BlockOutbound)
+		}
+	}))
+}
+
+// unblockOSBatch unblocks IPs with a single firewall change on a batchable backend
+func (s *Service) unblockOSBatch(ips []string) error {
+	return s.blockError(ips, true, s.retry(func() error {
+		switch s.systemType {
+		case "linux":
+			return unblockIPsLinux(s.privilege, ips)
+		case "darwin":
+			return unblockIPsDarwin(s.privilege, ips)
+		default:
+			return unblockIPsNetFirewall(ips)
+		}
+	}))
+}
+
+// blockIPsLinux blocks IPs on Linux with one iptables-restore run appending
+// to whoen's chain, and outgoing connections to them when outbound is set.
+// IPs that already have their rules are left out, like blockIPLinux does.
+func blockIPsLinux(p privilege, ips []string, outbound bool) error {
+	if err := ensureChain(p, outbound); err != nil {
+		return err
+	}
+	inbound, err := iptablesDropped(p, IptablesChain, "s")
+	if err != nil {
+		return fmt.Errorf("failed to read iptables rules: %w", err)
+	}
+	outgoing, err := iptablesDropped(p, IptablesChain, "d")
+	if err != nil {
+		return fmt.Errorf("failed to read iptables rules: %w", err)
+	}
+
+	var rules []string
+	for _, ip := range ips {
+		if !inbound[ip] {
+			rules = append(rules, "-A "+IptablesChain+" -s "+ip+" -j DROP")
+		}
+		if outbound && !outgoing[ip] {
+			rules = append(rules, "-A "+IptablesChain+" -d "+ip+" -j DROP")
+		}
+	}
+	if err := iptablesRestore(p, rules); err != nil {
+		return fmt.Errorf("failed to block %d IPs with iptables-restore: %w", len(ips), err)
+	}
+	return nil
+}
+
+// unblockIPsLinux unblocks IPs on Linux with one iptables-restore run,
+// including rules left in INPUT and OUTPUT by versions without whoen's own
+// chain. Only rules that exist are deleted, since a missing one fails the
+// whole run.
+func unblockIPsLinux(p privilege, ips []string) error {
+	var rules []string
+	for _, chain := range []struct{ name, direction string }{
+		{IptablesChain, "s"}, {IptablesChain, "d"}, {"INPUT", "s"}, {"OUTPUT", "d"},
+	} {
+		dropped, err := iptablesDropped(p, chain.name, chain.direction)
+		if err != nil {
+			return fmt.Errorf("failed to read iptables rules: %w", err)
+		}
+		for _, ip := range ips {
+			if dropped[ip] {
+				rules = append(rules, "-D "+chain.name+" -"+chain.direction+" "+ip+" -j DROP")
+			}
+		}
+	}
+	if err := iptablesRestore(p, rules); err != nil {
+		return fmt.Errorf("failed to unblock %d IPs with iptables-restore: %w", len(ips), err)
+	}
+	return nil
+}
+
+// iptablesRestore applies rule changes to the filter table in one
+// iptables-restore run, leaving the other rules alone
+func iptablesRestore(p privilege, rules []string) error {
+	if len(rules) == 0 {
+		return nil
+	}
+
+	cmd := p.command("iptables-restore", "--noflush")
+	cmd.Stdin = strings.NewReader("*filter\n" + strings.Join(rules, "\n") + "\nCOMMIT\n")
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%w (output: %s)", err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// blockIPsDarwin blocks IPs on macOS by loading them into the pf blocklist
+// table from a file, see blockIPDarwin
+func blockIPsDarwin(p privilege, ips []string, enablePF bool) error {
+	if _, err := ensureBlocklistTable(p); err != nil {
+		return err
+	}
+	if err := pfTableFile(p, "add", ips); err != nil {
+		return fmt.Errorf("failed to add %d IPs to blocklist with pfctl: %w", len(ips), err)
+	}
+	return loadBlocklistRule(p, enablePF)
+}
+
+// unblockIPsDarwin unblocks IPs on macOS by deleting them from the pf
+// blocklist table from a file, see unblockIPDarwin
+func unblockIPsDarwin(p privilege, ips []string) error {
+	if err := pfTableFile(p, "delete", ips); err != nil {
+		return fmt.Errorf("failed to unblock %d IPs with pfctl: %w", len(ips), err)
+	}
+	return nil
+}
+
+// pfTableFile runs a pfctl table command, add or delete, on the addresses
+// listed in a temporary file
+func pfTableFile(p privilege, command string, ips []string) error {
+	file, err := os.CreateTemp("", "whoen-pf-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+
+	_, err = file.WriteString(strings.Join(ips, "\n") + "\n")
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	output, err := p.command("pfctl", pfTable("-T", command, "-f", file.Name())...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%w (output: %s)", err, strings.TrimSpace(string(output)))
+	}
+
+	// Clear the global table of versions without whoen's own anchor as well
+	if command == "delete" {
+		p.command("pfctl", "-t", pfTableName, "-T", command, "-f", file.Name()).Run()
+	}
+	return nil
+}
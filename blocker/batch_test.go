@@ -0,0 +1,107 @@
+package blocker
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// TestBlockBatch checks that BlockBatch tracks new blocks, keeps permanent
+// and longer ones, and that UnblockBatch ignores IPs it does not track
+func TestBlockBatch(t *testing.T) {
+	s := NewServiceWithOptions("linux", Options{})
+
+	if _, err := s.Block("192.0.2.3", Ban, 0); err != nil {
+		t.Fatalf("Block failed: %v", err)
+	}
+	if err := s.BlockBatch([]string{"192.0.2.1", "192.0.2.2"}, Timeout, time.Hour); err != nil {
+		t.Fatalf("BlockBatch failed: %v", err)
+	}
+	long, _ := s.Expiration("192.0.2.1")
+	if err := s.BlockBatch([]string{"192.0.2.1", "192.0.2.3", "192.0.2.4"}, Timeout, time.Minute); err != nil {
+		t.Fatalf("BlockBatch failed: %v", err)
+	}
+	if expiration, _ := s.Expiration("192.0.2.1"); !expiration.Equal(long) {
+		t.Errorf("shorter batch changed the block to %v, want %v", expiration, long)
+	}
+	if expiration, _ := s.Expiration("192.0.2.3"); !expiration.IsZero() {
+		t.Errorf("batch turned a ban into a block until %v", expiration)
+	}
+	if s.Len() != 4 {
+		t.Errorf("%d IPs tracked, want 4", s.Len())
+	}
+
+	if err := s.UnblockBatch([]string{"192.0.2.1", "192.0.2.3", "192.0.2.99"}); err != nil {
+		t.Fatalf("UnblockBatch failed: %v", err)
+	}
+	for ip, want := range map[string]bool{"192.0.2.1": false, "192.0.2.2": true, "192.0.2.3": false, "192.0.2.4": true} {
+		if blocked, _ := s.IsBlocked(ip); blocked != want {
+			t.Errorf("IsBlocked(%s) = %v, want %v", ip, blocked, want)
+		}
+	}
+}
+
+// TestBlockBatchFirewall checks that batches reach iptables in one
+// iptables-restore run each, and that a failed run is queued for every IP
+// and retried by CleanupExpired
+func TestBlockBatchFirewall(t *testing.T) {
+	s, fw := newFakeFirewall(t, Options{})
+	ips := []string{"192.0.2.1", "192.0.2.2", "192.0.2.3"}
+
+	if err := s.BlockBatch(ips, Ban, 0); err != nil {
+		t.Fatalf("BlockBatch failed: %v", err)
+	}
+	if restores := count(fw.Commands(), "iptables-restore"); restores != 1 {
+		t.Errorf("BlockBatch ran iptables-restore %d times, want once", restores)
+	}
+	for _, ip := range ips {
+		if !fw.Dropped(ip) {
+			t.Errorf("%s not dropped by the firewall", ip)
+		}
+	}
+
+	// IPs that already have their rules, such as ones left from an earlier
+	// run, are left out
+	fw.Add("-A WHOEN -s 192.0.2.4 -j DROP")
+	if err := s.BlockBatch([]string{"192.0.2.4", "192.0.2.5"}, Ban, 0); err != nil {
+		t.Fatalf("BlockBatch failed: %v", err)
+	}
+	if rules := len(fw.Rules()); rules != 6 { // 5 drops and the jump from INPUT
+		t.Errorf("firewall has %d rules, want 6: %q", rules, fw.Rules())
+	}
+
+	fw.Fail("iptables-restore: line 2 failed")
+	err := s.BlockBatch([]string{"192.0.2.6", "192.0.2.7"}, Timeout, time.Hour)
+	var blockErr *BlockError
+	if !errors.As(err, &blockErr) || len(blockErr.IPs) != 2 || blockErr.Unblock {
+		t.Fatalf("BlockBatch with a failing firewall: %v, want a BlockError for both IPs", err)
+	}
+	if blocked, _ := s.IsBlocked("192.0.2.6"); blocked {
+		t.Error("IP tracked although its block failed")
+	}
+	if pending := s.Pending(); len(pending) != 2 || pending[0].Unblock || pending[0].Attempts != 1 {
+		t.Errorf("pending changes %+v, want both blocks queued once", pending)
+	}
+	if err := s.UnblockBatch(ips); err == nil {
+		t.Error("UnblockBatch with a failing firewall succeeded")
+	}
+	if blocked, _ := s.IsBlocked("192.0.2.1"); !blocked {
+		t.Error("IP no longer tracked although lifting its block failed")
+	}
+	if pending := s.Pending(); len(pending) != 5 || !pending[0].Unblock {
+		t.Errorf("pending changes %+v, want the unblocks queued as well", pending)
+	}
+
+	fw.Fail("")
+	if err := s.CleanupExpired(); err != nil {
+		t.Fatalf("CleanupExpired failed: %v", err)
+	}
+	if pending := s.Pending(); len(pending) != 0 {
+		t.Errorf("pending changes %+v after a successful retry, want none", pending)
+	}
+	for ip, want := range map[string]bool{"192.0.2.1": false, "192.0.2.3": false, "192.0.2.5": true, "192.0.2.6": true} {
+		if blocked, _ := s.IsBlocked(ip); blocked != want || fw.Dropped(ip) != want {
+			t.Errorf("%s tracked %v, dropped %v, want %v", ip, blocked, fw.Dropped(ip), want)
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package blocker
 
 import (
+	"net/netip"
 	"time"
 )
 
@@ -36,3 +37,121 @@ type Blocker interface {
 	// CleanupExpired removes expired blocks
 	CleanupExpired() error
 }
+
+// AddrBlocker is implemented by blockers that take parsed addresses as well
+// as strings
+type AddrBlocker interface {
+	// BlockAddr blocks an address, see Blocker.Block
+	BlockAddr(addr netip.Addr, blockType BlockType, duration time.Duration) (*BlockResult, error)
+
+	// UnblockAddr unblocks an address
+	UnblockAddr(addr netip.Addr) error
+
+	// IsBlockedAddr checks if an address is blocked
+	IsBlockedAddr(addr netip.Addr) (bool, error)
+}
+
+// Sizer is implemented by blockers that track blocks in memory
+type Sizer interface {
+	// Len returns the number of IPs the blocker is tracking
+	Len() int
+}
+
+// Lister is implemented by blockers that can list the blocks they enforce
+type Lister interface {
+	// Blocks returns the enforced IPs and their expiration times (zero for permanent blocks)
+	Blocks() map[string]time.Time
+}
+
+// Restorer is implemented by blockers that can apply many blocks at once
+type Restorer interface {
+	// RestoreBlocks applies blocks by IP and expiration time (zero for permanent blocks)
+	RestoreBlocks(ips map[string]time.Time) error
+}
+
+// BatchBlocker is implemented by blockers that can block and unblock many
+// IPs with a single firewall change, see BlockBatch and UnblockBatch
+type BatchBlocker interface {
+	// BlockBatch blocks IPs alike, see Blocker.Block
+	BlockBatch(ips []string, blockType BlockType, duration time.Duration) error
+
+	// UnblockBatch unblocks IPs
+	UnblockBatch(ips []string) error
+}
+
+// BlockBatch blocks IPs in one batch when b is a BatchBlocker, and one at a
+// time otherwise
+func BlockBatch(b Blocker, ips []string, blockType BlockType, duration time.Duration) error {
+	if batcher, ok := b.(BatchBlocker); ok {
+		return batcher.BlockBatch(ips, blockType, duration)
+	}
+	for _, ip := range ips {
+		if _, err := b.Block(ip, blockType, duration); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// UnblockBatch unblocks IPs in one batch when b is a BatchBlocker, and one
+// at a time otherwise
+func UnblockBatch(b Blocker, ips []string) error {
+	if batcher, ok := b.(BatchBlocker); ok {
+		return batcher.UnblockBatch(ips)
+	}
+	for _, ip := range ips {
+		if err := b.Unblock(ip); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RulePruner is implemented by blockers that can find the firewall rules they
+// created and remove those of IPs they no longer block
+type RulePruner interface {
+	// PruneRules removes stale rules and returns the number of IPs affected
+	PruneRules() (int, error)
+}
+
+// Reconciler is implemented by blockers that can read the rules present in
+// the OS firewall and bring them in line with a set of blocks
+type Reconciler interface {
+	// Reconcile applies missing rules and removes orphaned ones, see Service.Reconcile
+	Reconcile(blocks map[string]time.Time) (ReconcileResult, error)
+}
+
+// RetryQueue is implemented by blockers that queue failed firewall changes
+// and retry them at every cleanup
+type RetryQueue interface {
+	// Pending returns the queued changes
+	Pending() []PendingOp
+}
+
+// Flusher is implemented by blockers that can remove all the firewall rules
+// they created
+type Flusher interface {
+	// FlushAll removes whoen's rules, and only those, and forgets the blocks
+	FlushAll() error
+}
+
+// CapabilityChecker is implemented by blockers that can check whether they
+// are able to change the OS firewall
+type CapabilityChecker interface {
+	// CheckCapabilities returns a *CapabilityError if firewall commands fail
+	CheckCapabilities() error
+}
+
+// SelfTester is implemented by blockers that can try out a firewall change
+// without affecting traffic
+type SelfTester interface {
+	// SelfTest adds and removes a harmless rule and returns what failed
+	SelfTest() error
+}
+
+// RuleVerifier is implemented by blockers that can check the OS firewall
+// still enforces their blocks
+type RuleVerifier interface {
+	// VerifyRules re-applies missing rules and returns the IPs they were missing for
+	VerifyRules() ([]string, error)
+}
@@ -0,0 +1,138 @@
+package blocker
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// IptablesChain is the iptables chain whoen keeps its rules in. INPUT, and
+// OUTPUT with outbound blocking, jump to it first, so whoen's rules stay out
+// of the main chains and FlushAll can remove them without touching others.
+const IptablesChain = "WHOEN"
+
+// PFAnchor is the pf anchor whoen keeps its rule and blocklist table in. The
+// main ruleset evaluates it once pf.conf has an anchor "whoen" line.
+const PFAnchor = "whoen"
+
+// pfTableName is the name of the pf table holding the blocked IPs. Versions
+// without whoen's own anchor kept it in the main ruleset.
+const pfTableName = "blocklist"
+
+// iptablesRule matches a DROP rule by source or destination address or range
+// in iptables -S output
+var iptablesRule = regexp.MustCompile(`^-A (\S+) -([sd]) ([0-9a-fA-F.:]+)(/[0-9]+)? -j DROP$`)
+
+// iptables runs an iptables command, returning its output with any error
+func iptables(p privilege, args ...string) error {
+	output, err := p.command("iptables", args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%w (output: %s)", err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// chainExists checks if whoen's iptables chain exists
+func chainExists(p privilege) bool {
+	return p.command("iptables", "-n", "-L", IptablesChain).Run() == nil
+}
+
+// chainJumps checks if a main chain jumps to whoen's chain
+func chainJumps(p privilege, parent string) bool {
+	return p.command("iptables", "-C", parent, "-j", IptablesChain).Run() == nil
+}
+
+// ensureChain creates whoen's iptables chain and the jumps to it from INPUT,
+// and from OUTPUT when outbound is set, where they are missing
+func ensureChain(p privilege, outbound bool) error {
+	if !chainExists(p) {
+		if err := iptables(p, "-N", IptablesChain); err != nil {
+			return fmt.Errorf("failed to create iptables chain %s: %w", IptablesChain, err)
+		}
+	}
+
+	parents := []string{"INPUT"}
+	if outbound {
+		parents = append(parents, "OUTPUT")
+	}
+	for _, parent := range parents {
+		if chainJumps(p, parent) {
+			continue
+		}
+		if err := iptables(p, "-I", parent, "1", "-j", IptablesChain); err != nil {
+			return fmt.Errorf("failed to jump from %s to iptables chain %s: %w", parent, IptablesChain, err)
+		}
+	}
+	return nil
+}
+
+// flushChain removes whoen's iptables chain, its rules and the jumps to it
+func flushChain(p privilege) error {
+	for _, parent := range []string{"INPUT", "OUTPUT"} {
+		for chainJumps(p, parent) {
+			if err := iptables(p, "-D", parent, "-j", IptablesChain); err != nil {
+				return fmt.Errorf("failed to remove jump from %s to iptables chain %s: %w", parent, IptablesChain, err)
+			}
+		}
+	}
+
+	if !chainExists(p) {
+		return nil
+	}
+	if err := iptables(p, "-F", IptablesChain); err != nil {
+		return fmt.Errorf("failed to flush iptables chain %s: %w", IptablesChain, err)
+	}
+	if err := iptables(p, "-X", IptablesChain); err != nil {
+		return fmt.Errorf("failed to delete iptables chain %s: %w", IptablesChain, err)
+	}
+	return nil
+}
+
+// iptablesDropped reads the IPs and ranges an iptables chain drops by
+// source (direction "s") or destination (direction "d"). A chain that does
+// not exist drops nothing.
+func iptablesDropped(p privilege, chain, direction string) (map[string]bool, error) {
+	dropped := make(map[string]bool)
+	if chain == IptablesChain && !chainExists(p) {
+		return dropped, nil
+	}
+
+	output, err := p.command("iptables", "-S", chain).CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("%w (output: %s)", err, strings.TrimSpace(string(output)))
+	}
+	for _, line := range strings.Split(string(output), "\n") {
+		match := iptablesRule.FindStringSubmatch(strings.TrimSpace(line))
+		if match == nil || match[1] != chain || match[2] != direction {
+			continue
+		}
+		// Single addresses are listed with /32 or /128
+		if match[4] == "/32" || match[4] == "/128" {
+			dropped[match[3]] = true
+		} else {
+			dropped[match[3]+match[4]] = true
+		}
+	}
+	return dropped, nil
+}
+
+// pfTable returns pfctl arguments that act on the blocklist table in whoen's
+// anchor, followed by args
+func pfTable(args ...string) []string {
+	return append([]string{"-a", PFAnchor, "-t", pfTableName}, args...)
+}
+
+// flushAnchor removes the rules and the blocklist table in whoen's pf anchor,
+// along with the global blocklist table and the blocklist anchor's rules left
+// by versions without it
+func flushAnchor(p privilege) error {
+	output, err := p.command("pfctl", "-a", PFAnchor, "-F", "all").CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("failed to flush pf anchor %s: %w (output: %s)", PFAnchor, err, strings.TrimSpace(string(output)))
+	}
+
+	// The legacy table and anchor are usually gone, so failures are ignored
+	p.command("pfctl", "-a", pfTableName, "-F", "rules").Run()
+	p.command("pfctl", "-t", pfTableName, "-T", "kill").Run()
+	return nil
+}
@@ -0,0 +1,69 @@
+package blocker
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrUnsupportedSystem is returned, wrapped, for firewall changes on a system
+// type other than linux, darwin and windows
+var ErrUnsupportedSystem = errors.New("unsupported system type")
+
+// ErrFirewallUnavailable is matched by the errors of CheckCapabilities and
+// SelfTest when the firewall commands cannot be run, e.g. for missing
+// privileges or a missing iptables binary
+var ErrFirewallUnavailable = errors.New("firewall unavailable")
+
+// ErrInvalidIP is returned, wrapped with the value, for IPs that are neither
+// an IP address nor a CIDR range. They are rejected before any firewall
+// command or script sees them.
+var ErrInvalidIP = errors.New("invalid IP address")
+
+// BlockError reports a firewall change that failed for an IP or a batch of
+// IPs. Its message is that of Err, which already names the IPs and the
+// firewall command.
+type BlockError struct {
+	IP      string   // The IP, empty for a batch
+	IPs     []string // The IPs of a batch
+	Backend string   // BackendIptables, BackendFirewalld, BackendNetsh, BackendNetFirewall or "pf"
+	Unblock bool     // The change lifted a block rather than applying it
+	Err     error
+}
+
+// Error returns the message of the underlying error
+func (e *BlockError) Error() string {
+	return e.Err.Error()
+}
+
+// Unwrap returns the underlying error
+func (e *BlockError) Unwrap() error {
+	return e.Err
+}
+
+// unsupportedSystem returns ErrUnsupportedSystem for a system type
+func unsupportedSystem(systemType string) error {
+	return fmt.Errorf("%w: %s", ErrUnsupportedSystem, systemType)
+}
+
+// blockError wraps the error of a firewall change for ips in a *BlockError,
+// or returns nil if err is nil. The caller must hold the lock.
+func (s *Service) blockError(ips []string, unblock bool, err error) error {
+	if err == nil {
+		return nil
+	}
+	var target *BlockError
+	if errors.As(err, &target) {
+		return err
+	}
+
+	e := &BlockError{Backend: s.options.Backend, Unblock: unblock, Err: err}
+	if s.systemType == "darwin" {
+		e.Backend = "pf"
+	}
+	if len(ips) == 1 {
+		e.IP = ips[0]
+	} else {
+		e.IPs = ips
+	}
+	return e
+}
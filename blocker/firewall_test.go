@@ -0,0 +1,151 @@
+package blocker
+
+import (
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// fakeIptables is a privilege wrapper that runs iptables and iptables-restore
+// against a file of rules instead of the kernel. Every command is logged, and
+// while the fail file is not empty the commands that start with the content
+// of the failon file fail with the content of the fail file.
+const fakeIptables = `#!/bin/sh
+dir=$(dirname "$0")
+echo "$*" >> "$dir/commands"
+if [ -s "$dir/fail" ]; then
+	case "$*" in "$(cat "$dir/failon")"*) cat "$dir/fail"; exit 1 ;; esac
+fi
+cmd=$1; shift
+if [ "$cmd" = iptables-restore ]; then
+	while read -r line; do
+		case "$line" in
+		"-A "*) echo "$line" >> "$dir/rules" ;;
+		"-D "*) grep -vxF -- "-A ${line#-D }" "$dir/rules" > "$dir/rules.new"; mv "$dir/rules.new" "$dir/rules" ;;
+		esac
+	done
+	exit 0
+fi
+op=$1; shift
+case "$op" in
+-C) grep -qxF -- "-A $*" "$dir/rules" ;;
+-A) echo "-A $*" >> "$dir/rules" ;;
+-D) grep -vxF -- "-A $*" "$dir/rules" > "$dir/rules.new"; mv "$dir/rules.new" "$dir/rules" ;;
+-I) chain=$1; shift 2; echo "-A $chain $*" >> "$dir/rules" ;;
+-S) grep -- "^-A $1 " "$dir/rules" || true ;;
+esac
+`
+
+// fakeFirewall is the state of a fakeIptables wrapper
+type fakeFirewall struct {
+	t   *testing.T
+	dir string
+}
+
+// newFakeFirewall returns an enforcing Linux service whose firewall commands
+// run through a fakeIptables wrapper, and the wrapper's state
+func newFakeFirewall(t *testing.T, options Options) (*Service, *fakeFirewall) {
+	t.Helper()
+	f := &fakeFirewall{t: t, dir: t.TempDir()}
+	wrapper := filepath.Join(f.dir, "fw")
+	if err := os.WriteFile(wrapper, []byte(fakeIptables), 0o755); err != nil {
+		t.Fatalf("failed to write the firewall wrapper: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(f.dir, "rules"), nil, 0o644); err != nil {
+		t.Fatalf("failed to write the rules: %v", err)
+	}
+
+	options.Enforce = true
+	options.Privilege = wrapper
+	options.Logger = log.New(io.Discard, "", 0)
+	return NewServiceWithOptions("linux", options), f
+}
+
+// lines returns the non-empty lines of one of the wrapper's files
+func (f *fakeFirewall) lines(name string) []string {
+	f.t.Helper()
+	data, err := os.ReadFile(filepath.Join(f.dir, name))
+	if err != nil && !os.IsNotExist(err) {
+		f.t.Fatalf("failed to read %s: %v", name, err)
+	}
+	var lines []string
+	for _, line := range strings.Split(string(data), "\n") {
+		if line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+// Rules returns the rules in the fake firewall
+func (f *fakeFirewall) Rules() []string {
+	return f.lines("rules")
+}
+
+// Dropped reports whether the fake firewall drops traffic from ip
+func (f *fakeFirewall) Dropped(ip string) bool {
+	return f.Has("-A " + IptablesChain + " -s " + ip + " -j DROP")
+}
+
+// Has reports whether the fake firewall has a rule
+func (f *fakeFirewall) Has(rule string) bool {
+	for _, r := range f.Rules() {
+		if r == rule {
+			return true
+		}
+	}
+	return false
+}
+
+// Add puts rules in the fake firewall behind the service's back
+func (f *fakeFirewall) Add(rules ...string) {
+	f.t.Helper()
+	file, err := os.OpenFile(filepath.Join(f.dir, "rules"), os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		f.t.Fatalf("failed to open the rules: %v", err)
+	}
+	defer file.Close()
+	for _, rule := range rules {
+		if _, err := file.WriteString(rule + "\n"); err != nil {
+			f.t.Fatalf("failed to add a rule: %v", err)
+		}
+	}
+}
+
+// Commands returns the commands the wrapper ran, and forgets them
+func (f *fakeFirewall) Commands() []string {
+	commands := f.lines("commands")
+	os.Remove(filepath.Join(f.dir, "commands"))
+	return commands
+}
+
+// count returns how many of commands run program
+func count(commands []string, program string) int {
+	n := 0
+	for _, command := range commands {
+		if command == program || strings.HasPrefix(command, program+" ") {
+			n++
+		}
+	}
+	return n
+}
+
+// Fail makes every command fail with output until Fail("") is called
+func (f *fakeFirewall) Fail(output string) {
+	f.FailOn("", output)
+}
+
+// FailOn makes the commands that start with prefix fail with output until
+// Fail("") is called
+func (f *fakeFirewall) FailOn(prefix, output string) {
+	f.t.Helper()
+	if err := os.WriteFile(filepath.Join(f.dir, "failon"), []byte(prefix), 0o644); err != nil {
+		f.t.Fatalf("failed to write the failure: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(f.dir, "fail"), []byte(output), 0o644); err != nil {
+		f.t.Fatalf("failed to write the failure: %v", err)
+	}
+}
@@ -0,0 +1,102 @@
+package blocker
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Linux firewall backends
+const (
+	BackendIptables  = "iptables"  // Raw iptables rules, the default
+	BackendFirewalld = "firewalld" // firewall-cmd rich rules, for hosts managed by firewalld
+	BackendAuto      = "auto"      // firewalld when it is running, iptables otherwise
+)
+
+// firewalldRunning checks if firewalld is running on the host
+func firewalldRunning(p privilege) bool {
+	return p.command("firewall-cmd", "--state").Run() == nil
+}
+
+// firewalldRule returns the rich rule that drops traffic from an IP
+func firewalldRule(ip string) string {
+	family := "ipv4"
+	if strings.Contains(ip, ":") {
+		family = "ipv6"
+	}
+	return fmt.Sprintf(`rule family="%s" source address="%s" drop`, family, ip)
+}
+
+// firewalldQuery checks if the rich rule of an IP exists, in the permanent
+// configuration if permanent is set and in the runtime configuration otherwise
+func firewalldQuery(p privilege, rule string, permanent bool) bool {
+	args := []string{"--query-rich-rule=" + rule}
+	if permanent {
+		args = append(args, "--permanent")
+	}
+	return p.command("firewall-cmd", args...).Run() == nil
+}
+
+// firewalld runs firewall-cmd with the given arguments
+func firewalld(p privilege, args ...string) error {
+	cmd := p.command("firewall-cmd", args...)
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%w (output: %s)", err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// blockIPFirewalld blocks an IP with a firewalld rich rule. Temporary blocks
+// are runtime rules that firewalld removes itself after duration; permanent
+// blocks are also written to the permanent configuration so they survive a
+// firewalld reload. Blocking an IP again replaces its timed rule, so the
+// timeout follows the new expiration.
+func blockIPFirewalld(p privilege, ip string, duration time.Duration) error {
+	rule := firewalldRule(ip)
+
+	// Drop the current runtime rule so the new timeout applies
+	if firewalldQuery(p, rule, false) {
+		if err := firewalld(p, "--remove-rich-rule="+rule); err != nil {
+			return fmt.Errorf("failed to replace firewalld rule for IP %s: %w", ip, err)
+		}
+	}
+
+	if duration > 0 {
+		seconds := int(duration.Seconds()) + 1
+		if err := firewalld(p, "--add-rich-rule="+rule, "--timeout="+strconv.Itoa(seconds)+"s"); err != nil {
+			return fmt.Errorf("failed to block IP %s with firewalld: %w", ip, err)
+		}
+		return nil
+	}
+
+	if err := firewalld(p, "--add-rich-rule="+rule); err != nil {
+		return fmt.Errorf("failed to block IP %s with firewalld: %w", ip, err)
+	}
+	if !firewalldQuery(p, rule, true) {
+		if err := firewalld(p, "--permanent", "--add-rich-rule="+rule); err != nil {
+			return fmt.Errorf("failed to block IP %s permanently with firewalld: %w", ip, err)
+		}
+	}
+	return nil
+}
+
+// unblockIPFirewalld removes the rich rule of an IP from the runtime and
+// permanent configuration. Rules whose timeout already ran out are gone, so
+// missing rules are not an error.
+func unblockIPFirewalld(p privilege, ip string) error {
+	rule := firewalldRule(ip)
+
+	if firewalldQuery(p, rule, false) {
+		if err := firewalld(p, "--remove-rich-rule="+rule); err != nil {
+			return fmt.Errorf("failed to unblock IP %s with firewalld: %w", ip, err)
+		}
+	}
+	if firewalldQuery(p, rule, true) {
+		if err := firewalld(p, "--permanent", "--remove-rich-rule="+rule); err != nil {
+			return fmt.Errorf("failed to remove permanent firewalld rule for IP %s: %w", ip, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,123 @@
+package blocker
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// Windows firewall backends
+const (
+	BackendNetsh       = "netsh"       // One netsh rule per IP and direction, the default on Windows
+	BackendNetFirewall = "netfirewall" // NetSecurity PowerShell cmdlets, applied in batches
+)
+
+// netFirewallGroup is the rule group whoen's NetSecurity rules belong to, so
+// they can be enumerated without relying on rule names
+const netFirewallGroup = "whoen"
+
+// Rule name prefixes of the NetSecurity backend, followed by the IP
+const (
+	netFirewallIn  = "whoen-in-"
+	netFirewallOut = "whoen-out-"
+)
+
+// netFirewallAvailable checks if the NetSecurity cmdlets can be used
+func netFirewallAvailable() bool {
+	_, err := runPowerShell("Get-Command New-NetFirewallRule | Out-Null")
+	return err == nil
+}
+
+// runPowerShell runs a script with Windows PowerShell. The script is passed on
+// standard input, so large batches are not limited by the command line length.
+func runPowerShell(script string) ([]byte, error) {
+	cmd := exec.Command("powershell", "-NoProfile", "-NonInteractive", "-Command", "-")
+	cmd.Stdin = strings.NewReader("$ErrorActionPreference = 'Stop'\n" + script)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	output, err := cmd.Output()
+	if err != nil {
+		return output, fmt.Errorf("%w (output: %s)", err, strings.TrimSpace(stderr.String()))
+	}
+	return output, nil
+}
+
+// psQuotes doubles the characters PowerShell ends single-quoted strings at,
+// the typographic single quotes included
+var psQuotes = strings.NewReplacer("'", "''", "\u2018", "\u2018\u2018", "\u2019", "\u2019\u2019", "\u201a", "\u201a\u201a", "\u201b", "\u201b\u201b")
+
+// psQuote quotes a value as a PowerShell string literal
+func psQuote(value string) string {
+	return "'" + psQuotes.Replace(value) + "'"
+}
+
+// blockIPsNetFirewall blocks IPs on Windows with one PowerShell run, and
+// outgoing connections to them when outbound is set. Existing rules are
+// looked up once for the whole batch and not added again.
+func blockIPsNetFirewall(ips []string, outbound bool) error {
+	if len(ips) == 0 {
+		return nil
+	}
+
+	var script strings.Builder
+	fmt.Fprintf(&script, "$existing = @{}\n")
+	fmt.Fprintf(&script, "Get-NetFirewallRule -Group %s -ErrorAction SilentlyContinue | ForEach-Object { $existing[$_.Name] = $true }\n", psQuote(netFirewallGroup))
+	fmt.Fprintf(&script, "function Add-Block($name, $ip, $direction) {\n")
+	fmt.Fprintf(&script, "  if (-not $existing[$name]) {\n")
+	fmt.Fprintf(&script, "    New-NetFirewallRule -Name $name -DisplayName $name -Group %s -Direction $direction -Action Block -RemoteAddress $ip -Profile Any | Out-Null\n", psQuote(netFirewallGroup))
+	fmt.Fprintf(&script, "  }\n}\n")
+	for _, ip := range ips {
+		fmt.Fprintf(&script, "Add-Block %s %s Inbound\n", psQuote(netFirewallIn+ip), psQuote(ip))
+		if outbound {
+			fmt.Fprintf(&script, "Add-Block %s %s Outbound\n", psQuote(netFirewallOut+ip), psQuote(ip))
+		}
+	}
+
+	if _, err := runPowerShell(script.String()); err != nil {
+		return fmt.Errorf("failed to block %d IPs with NetSecurity firewall rules: %w", len(ips), err)
+	}
+	return nil
+}
+
+// unblockIPsNetFirewall removes the rules of IPs on Windows with one
+// PowerShell run. Rules that do not exist are not an error.
+func unblockIPsNetFirewall(ips []string) error {
+	if len(ips) == 0 {
+		return nil
+	}
+
+	names := make([]string, 0, 2*len(ips))
+	for _, ip := range ips {
+		names = append(names, psQuote(netFirewallIn+ip), psQuote(netFirewallOut+ip))
+	}
+	script := fmt.Sprintf("Remove-NetFirewallRule -Name %s -ErrorAction SilentlyContinue\n", strings.Join(names, ","))
+
+	if _, err := runPowerShell(script); err != nil {
+		return fmt.Errorf("failed to remove NetSecurity firewall rules of %d IPs: %w", len(ips), err)
+	}
+	return nil
+}
+
+// netFirewallIPs enumerates the IPs that have a whoen rule in the firewall
+func netFirewallIPs() ([]string, error) {
+	script := fmt.Sprintf("Get-NetFirewallRule -Group %s -ErrorAction SilentlyContinue | ForEach-Object { $_.Name }\n", psQuote(netFirewallGroup))
+	output, err := runPowerShell(script)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list NetSecurity firewall rules: %w", err)
+	}
+
+	seen := make(map[string]bool)
+	var ips []string
+	for _, name := range strings.Fields(string(output)) {
+		ip, ok := strings.CutPrefix(name, netFirewallIn)
+		if !ok {
+			ip, ok = strings.CutPrefix(name, netFirewallOut)
+		}
+		if ok && ip != "" && !seen[ip] {
+			seen[ip] = true
+			ips = append(ips, ip)
+		}
+	}
+	return ips, nil
+}
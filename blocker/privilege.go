@@ -0,0 +1,154 @@
+package blocker
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// Privilege escalation strategies for firewall commands on Linux and macOS.
+// Any other value is used as a custom wrapper command line, such as
+// "/usr/local/bin/fw-helper --", that runs the firewall command it is given.
+const (
+	PrivilegeAuto = "auto" // No escalation when running as root, sudo otherwise; the default
+	PrivilegeNone = "none" // Run commands directly, as root or with CAP_NET_ADMIN as an ambient capability
+	PrivilegeSudo = "sudo" // sudo -n, which fails instead of prompting for a password
+	PrivilegeDoas = "doas" // doas -n, which fails instead of prompting for a password
+)
+
+// privilege is the command prefix that runs firewall commands with privileges
+type privilege []string
+
+// newPrivilege returns the command prefix of a privilege escalation strategy
+func newPrivilege(strategy string) privilege {
+	switch strings.TrimSpace(strategy) {
+	case "", PrivilegeAuto:
+		if os.Geteuid() == 0 {
+			return nil
+		}
+		return privilege{"sudo", "-n"}
+	case PrivilegeNone:
+		return nil
+	case PrivilegeSudo:
+		return privilege{"sudo", "-n"}
+	case PrivilegeDoas:
+		return privilege{"doas", "-n"}
+	default:
+		return privilege(strings.Fields(strategy))
+	}
+}
+
+// command builds a command that runs name with privileges
+func (p privilege) command(name string, args ...string) *exec.Cmd {
+	full := p.args(name, args...)
+	return exec.Command(full[0], full[1:]...)
+}
+
+// args returns the full command line that runs name with privileges
+func (p privilege) args(name string, args ...string) []string {
+	full := make([]string, 0, len(p)+1+len(args))
+	full = append(full, p...)
+	full = append(full, name)
+	return append(full, args...)
+}
+
+// String returns the strategy as used on the command line
+func (p privilege) String() string {
+	if len(p) == 0 {
+		return "none"
+	}
+	return strings.Join(p, " ")
+}
+
+// CapabilityError reports that the blocker cannot change the OS firewall,
+// with a hint on how to fix it
+type CapabilityError struct {
+	Command string // The check that failed, as run
+	Output  string // What the check printed
+	Err     error
+	Hint    string
+}
+
+// Error returns the failed check, its output and the hint
+func (e *CapabilityError) Error() string {
+	message := fmt.Sprintf("firewall commands do not work: %s failed: %v", e.Command, e.Err)
+	if e.Output != "" {
+		message += " (output: " + e.Output + ")"
+	}
+	if e.Hint != "" {
+		message += "; " + e.Hint
+	}
+	return message
+}
+
+// Unwrap returns the error of the failed check
+func (e *CapabilityError) Unwrap() error {
+	return e.Err
+}
+
+// Is reports whether target is ErrFirewallUnavailable, which every
+// CapabilityError is
+func (e *CapabilityError) Is(target error) bool {
+	return target == ErrFirewallUnavailable
+}
+
+// CheckCapabilities runs a harmless read-only firewall command the way blocks
+// are applied, and returns a *CapabilityError if it fails. It returns nil
+// when OS enforcement is disabled.
+func (s *Service) CheckCapabilities() error {
+	if !s.options.Enforce {
+		return nil
+	}
+
+	var cmd *exec.Cmd
+	switch s.systemType {
+	case "linux":
+		if s.options.Backend == BackendFirewalld {
+			cmd = s.privilege.command("firewall-cmd", "--state")
+		} else {
+			cmd = s.privilege.command("iptables", "-n", "-L", "INPUT")
+		}
+	case "darwin":
+		cmd = s.privilege.command("pfctl", "-s", "info")
+	case "windows":
+		// Only administrators can list sessions, and change firewall rules
+		cmd = exec.Command("net", "session")
+	default:
+		return &CapabilityError{Command: "none", Err: unsupportedSystem(s.systemType)}
+	}
+
+	output, err := cmd.CombinedOutput()
+	if err == nil {
+		return nil
+	}
+	capabilityErr := &CapabilityError{
+		Command: strings.Join(cmd.Args, " "),
+		Output:  strings.TrimSpace(string(output)),
+		Err:     err,
+	}
+	capabilityErr.Hint = s.capabilityHint(cmd.Args[0], capabilityErr.Output, err)
+	return capabilityErr
+}
+
+// capabilityHint suggests a fix for a failed capability check
+func (s *Service) capabilityHint(program, output string, err error) string {
+	lower := strings.ToLower(output)
+	switch {
+	case errors.Is(err, exec.ErrNotFound), errors.Is(err, fs.ErrNotExist):
+		return fmt.Sprintf("%s is not installed or not in PATH", program)
+	case strings.Contains(lower, "command not found"):
+		return "the firewall command is not installed or not in the PATH of the privilege escalation command"
+	case s.systemType == "windows":
+		return "run the application as Administrator"
+	case strings.Contains(lower, "password is required"), strings.Contains(lower, "terminal is required"),
+		strings.Contains(lower, "authorization required"), strings.Contains(lower, "authentication required"):
+		return fmt.Sprintf("allow %s to run the firewall commands without a password, or run as root with the privilege escalation set to %q",
+			program, PrivilegeNone)
+	case strings.Contains(lower, "permission denied"), strings.Contains(lower, "not permitted"), strings.Contains(lower, "must be root"):
+		return fmt.Sprintf("run as root, give the process CAP_NET_ADMIN as an ambient capability (AmbientCapabilities= in systemd), or choose a privilege escalation strategy (currently %s)", s.privilege)
+	}
+	return ""
+}
@@ -0,0 +1,173 @@
+package blocker
+
+import (
+	"fmt"
+	"os/exec"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/headswim/whoen/ipaddr"
+)
+
+// ReconcileResult reports how Reconcile changed the OS firewall
+type ReconcileResult struct {
+	Added   []string // IPs whose missing rules were applied
+	Removed []string // IPs whose orphaned rules were removed
+}
+
+// Reconcile makes the OS firewall enforce exactly the given blocks, by IP and
+// expiration time (zero for permanent blocks), usually the active blocks in
+// storage. It reads the rules present in the firewall, applies the missing
+// ones and removes whoen's rules for IPs not in blocks, or whose blocks are
+// kept out of the firewall, and then tracks the blocks. Expired blocks are
+// left out. firewalld rich rules look the same
+// whoever added them, so with firewalld only the rules of tracked IPs count
+// as orphaned.
+func (s *Service) Reconcile(blocks map[string]time.Time) (ReconcileResult, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	var result ReconcileResult
+	now := time.Now()
+	desired := make(map[string]time.Time, len(blocks))
+	for ip, expiration := range blocks {
+		ip = ipaddr.Normalize(ip)
+		if err := checkIP(ip); err != nil {
+			s.logger.Printf("Not reconciling block: %v", err)
+			continue
+		}
+		if expiration.IsZero() || now.Before(expiration) {
+			desired[ip] = expiration
+		}
+	}
+
+	// Without enforcement there are no rules to reconcile
+	if !s.options.Enforce {
+		s.blockedIPs = desired
+		return result, nil
+	}
+	if !supportedSystem(s.systemType) {
+		return result, unsupportedSystem(s.systemType)
+	}
+
+	// Reconciling supersedes the queued changes
+	s.pending = nil
+
+	present, err := s.ruleIPs()
+	if err != nil {
+		return result, fmt.Errorf("failed to read firewall rules: %w", err)
+	}
+	if s.systemType == "linux" && s.options.Backend == BackendFirewalld {
+		for ip := range present {
+			if _, tracked := s.blockedIPs[ip]; !tracked {
+				if _, ok := desired[ip]; !ok {
+					delete(present, ip)
+				}
+			}
+		}
+	}
+
+	// Rules present for IPs that should not be blocked in the firewall are
+	// orphaned, and incomplete ones are applied again below
+	for ip := range present {
+		if expiration, ok := desired[ip]; !ok || !s.enforced(expiration) {
+			result.Removed = append(result.Removed, ip)
+		}
+	}
+	sort.Strings(result.Removed)
+	if err := s.liftBatch(result.Removed); err != nil {
+		return ReconcileResult{}, fmt.Errorf("failed to remove %d orphaned firewall rules: %w", len(result.Removed), err)
+	}
+
+	// Track the blocks whose rules are in place and apply the others
+	missing := make(map[string]time.Time)
+	for ip, expiration := range desired {
+		if present[ip] || !s.enforced(expiration) {
+			s.blockedIPs[ip] = expiration
+		} else {
+			missing[ip] = expiration
+			result.Added = append(result.Added, ip)
+		}
+	}
+	for ip := range s.blockedIPs {
+		if _, ok := desired[ip]; !ok {
+			delete(s.blockedIPs, ip)
+		}
+	}
+	sort.Strings(result.Added)
+	if err := s.applyBatch(missing); err != nil {
+		return result, fmt.Errorf("failed to apply %d missing firewall rules: %w", len(missing), err)
+	}
+	return result, nil
+}
+
+// ruleIPs reads the IPs that have whoen's rules in the OS firewall, see
+// enforcedIPs, mapped to false when some of their rules are missing. whoen's
+// iptables chain and pf table are read whole, even when nothing refers to
+// them any more, and the jumps and anchor rule are put back. The caller must
+// hold the lock.
+func (s *Service) ruleIPs() (map[string]bool, error) {
+	p := s.privilege
+	switch {
+	case s.systemType == "linux" && s.options.Backend != BackendFirewalld:
+		if err := ensureChain(p, s.options.BlockOutbound); err != nil {
+			return nil, err
+		}
+		present, err := iptablesDropped(p, IptablesChain, "s")
+		if err != nil {
+			return nil, err
+		}
+		outgoing, err := iptablesDropped(p, IptablesChain, "d")
+		if err != nil {
+			return nil, err
+		}
+		// IPs missing one of their rules are listed as incomplete
+		for ip := range present {
+			if s.options.BlockOutbound && !outgoing[ip] {
+				present[ip] = false
+			}
+		}
+		for ip := range outgoing {
+			if _, ok := present[ip]; !ok {
+				present[ip] = false
+			}
+		}
+		return present, nil
+
+	case s.systemType == "darwin":
+		output, err := ensureBlocklistTable(p)
+		if err != nil {
+			return nil, err
+		}
+		if err := loadBlocklistRule(p, s.options.EnablePF); err != nil {
+			return nil, err
+		}
+		present := make(map[string]bool)
+		for _, line := range strings.Split(output, "\n") {
+			if ip := strings.TrimSpace(line); ip != "" {
+				present[ip] = true
+			}
+		}
+		return present, nil
+	}
+	return s.enforcedIPs()
+}
+
+// netshIPs enumerates the IPs that have a whoen inbound rule in Windows
+// Firewall. The rule names are read from any line of the output, since the
+// labels netsh prints depend on the system language.
+func netshIPs() (map[string]bool, error) {
+	output, err := exec.Command("netsh", "advfirewall", "firewall", "show", "rule", "name=all").CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list Windows Firewall rules: %w (output: %s)", err, strings.TrimSpace(string(output)))
+	}
+
+	ips := make(map[string]bool)
+	for _, field := range strings.Fields(string(output)) {
+		if ip, ok := strings.CutPrefix(field, "BlockIP_In_"); ok && ip != "" {
+			ips[ip] = true
+		}
+	}
+	return ips, nil
+}
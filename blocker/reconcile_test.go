@@ -0,0 +1,101 @@
+package blocker
+
+import (
+	"errors"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+// TestReconcile checks that Reconcile applies missing and incomplete rules,
+// removes orphaned ones and tracks exactly the active blocks
+func TestReconcile(t *testing.T) {
+	s, fw := newFakeFirewall(t, Options{BlockOutbound: true})
+	fw.Add(
+		"-A WHOEN -s 192.0.2.1 -j DROP", "-A WHOEN -d 192.0.2.1 -j DROP", // Complete
+		"-A WHOEN -s 192.0.2.2 -j DROP", "-A WHOEN -d 192.0.2.2 -j DROP", // Orphaned
+		"-A WHOEN -s 192.0.2.3 -j DROP", // Missing its outgoing rule
+		"-A INPUT -s 192.0.2.9 -j DROP", // Not in whoen's chain
+	)
+	if _, err := s.Block("192.0.2.6", Ban, 0); err != nil {
+		t.Fatalf("Block failed: %v", err)
+	}
+
+	result, err := s.Reconcile(map[string]time.Time{
+		"192.0.2.1": {},
+		"192.0.2.3": {},
+		"192.0.2.4": time.Now().Add(time.Hour),
+		"192.0.2.5": time.Now().Add(-time.Minute), // Expired
+		"not an ip": {},
+	})
+	if err != nil {
+		t.Fatalf("Reconcile failed: %v", err)
+	}
+	if want := []string{"192.0.2.3", "192.0.2.4"}; !reflect.DeepEqual(result.Added, want) {
+		t.Errorf("Added = %q, want %q", result.Added, want)
+	}
+	if want := []string{"192.0.2.2", "192.0.2.6"}; !reflect.DeepEqual(result.Removed, want) {
+		t.Errorf("Removed = %q, want %q", result.Removed, want)
+	}
+
+	for _, rule := range []string{
+		"-A WHOEN -s 192.0.2.1 -j DROP", "-A WHOEN -d 192.0.2.3 -j DROP",
+		"-A WHOEN -s 192.0.2.4 -j DROP", "-A WHOEN -d 192.0.2.4 -j DROP",
+		"-A INPUT -s 192.0.2.9 -j DROP", "-A INPUT -j WHOEN", "-A OUTPUT -j WHOEN",
+	} {
+		if !fw.Has(rule) {
+			t.Errorf("rule %q missing after Reconcile", rule)
+		}
+	}
+	for _, ip := range []string{"192.0.2.2", "192.0.2.5", "192.0.2.6"} {
+		if fw.Dropped(ip) {
+			t.Errorf("%s still dropped after Reconcile", ip)
+		}
+	}
+	if want := []string{"192.0.2.1", "192.0.2.3", "192.0.2.4"}; !reflect.DeepEqual(sortedKeys(s.Blocks()), want) {
+		t.Errorf("tracked %q, want %q", sortedKeys(s.Blocks()), want)
+	}
+}
+
+// TestReconcileErrors checks that Reconcile reports firewalls it cannot read
+// and leaves the blocks it tracks alone then, and that without enforcement it
+// only replaces the tracked blocks
+func TestReconcileErrors(t *testing.T) {
+	s, fw := newFakeFirewall(t, Options{})
+	if _, err := s.Block("192.0.2.1", Ban, 0); err != nil {
+		t.Fatalf("Block failed: %v", err)
+	}
+	fw.Fail("iptables: Permission denied (you must be root)")
+	if _, err := s.Reconcile(map[string]time.Time{"192.0.2.2": {}}); err == nil {
+		t.Error("Reconcile with a failing firewall succeeded")
+	}
+	if want := []string{"192.0.2.1"}; !reflect.DeepEqual(sortedKeys(s.Blocks()), want) {
+		t.Errorf("tracked %q after a failed Reconcile, want %q", sortedKeys(s.Blocks()), want)
+	}
+
+	unsupported := NewServiceWithOptions("plan9", Options{Enforce: true})
+	if _, err := unsupported.Reconcile(nil); !errors.Is(err, ErrUnsupportedSystem) {
+		t.Errorf("Reconcile on plan9: %v, want ErrUnsupportedSystem", err)
+	}
+
+	tracking := NewServiceWithOptions("linux", Options{})
+	tracking.Block("192.0.2.1", Ban, 0)
+	result, err := tracking.Reconcile(map[string]time.Time{"192.0.2.2": {}})
+	if err != nil || len(result.Added) != 0 || len(result.Removed) != 0 {
+		t.Errorf("Reconcile without enforcement = %+v, %v, want no changes", result, err)
+	}
+	if want := []string{"192.0.2.2"}; !reflect.DeepEqual(sortedKeys(tracking.Blocks()), want) {
+		t.Errorf("tracked %q, want %q", sortedKeys(tracking.Blocks()), want)
+	}
+}
+
+// sortedKeys returns the IPs of blocks in order
+func sortedKeys(blocks map[string]time.Time) []string {
+	ips := make([]string, 0, len(blocks))
+	for ip := range blocks {
+		ips = append(ips, ip)
+	}
+	sort.Strings(ips)
+	return ips
+}
@@ -0,0 +1,119 @@
+package blocker
+
+import (
+	"sort"
+	"strings"
+	"time"
+)
+
+// transientErrors are parts of firewall command output that mark a failure
+// worth trying again, because another process holds the firewall for a moment
+var transientErrors = []string{
+	"xtables lock",                     // iptables: another iptables run holds the lock
+	"Resource temporarily unavailable", // iptables: lock wait interrupted
+	"Device busy",                      // pfctl: pf is being reloaded
+	"Resource busy",                    // pfctl
+	"try again",
+}
+
+// PendingOp is a firewall change that failed and waits in the retry queue
+type PendingOp struct {
+	IP         string
+	Unblock    bool      // Lifts the IP's block when set, applies it otherwise
+	Expiration time.Time // When the block ends, zero for permanent blocks
+	Attempts   int       // Times the change failed, each with its immediate retries
+	Err        error     // The last failure
+}
+
+// transient reports whether a firewall command failed for a passing reason,
+// such as lock contention
+func transient(err error) bool {
+	message := err.Error()
+	for _, part := range transientErrors {
+		if strings.Contains(message, part) {
+			return true
+		}
+	}
+	return false
+}
+
+// retry runs a firewall change and, while it fails with a transient error,
+// tries it again up to Options.Retries times, waiting Options.RetryBackoff
+// and then twice as long each time. The caller must hold the lock, so other
+// changes wait for the retries.
+func (s *Service) retry(change func() error) error {
+	backoff := s.options.RetryBackoff
+	err := change()
+	for attempt := 0; err != nil && attempt < s.options.Retries && transient(err); attempt++ {
+		time.Sleep(backoff)
+		backoff *= 2
+		err = change()
+	}
+	return err
+}
+
+// queue adds a failed change for an IP to the retry queue, replacing the
+// IP's earlier change. The caller must hold the lock.
+func (s *Service) queue(ip string, unblock bool, expiration time.Time, err error) {
+	if s.pending == nil {
+		s.pending = make(map[string]PendingOp)
+	}
+	op := s.pending[ip]
+	if op.Unblock != unblock {
+		op.Attempts = 0
+	}
+	s.pending[ip] = PendingOp{IP: ip, Unblock: unblock, Expiration: expiration, Attempts: op.Attempts + 1, Err: err}
+}
+
+// Pending returns the failed firewall changes waiting to be retried, by IP
+func (s *Service) Pending() []PendingOp {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	ops := make([]PendingOp, 0, len(s.pending))
+	for _, op := range s.pending {
+		ops = append(ops, op)
+	}
+	sort.Slice(ops, func(i, j int) bool { return ops[i].IP < ops[j].IP })
+	return ops
+}
+
+// retryPending tries the queued firewall changes again. Blocks that expired
+// in the meantime are dropped. The caller must hold the lock.
+func (s *Service) retryPending() {
+	if len(s.pending) == 0 {
+		return
+	}
+
+	now := time.Now()
+	retried := 0
+	for ip, op := range s.pending {
+		if !op.Unblock && !op.Expiration.IsZero() && now.After(op.Expiration) {
+			delete(s.pending, ip)
+			continue
+		}
+
+		var err error
+		if op.Unblock {
+			err = s.unblockOS(ip)
+		} else {
+			err = s.blockOS(ip, op.Expiration)
+		}
+		if err != nil {
+			s.queue(ip, op.Unblock, op.Expiration, err)
+			continue
+		}
+
+		if op.Unblock {
+			delete(s.blockedIPs, ip)
+		} else {
+			s.blockedIPs[ip] = op.Expiration
+		}
+		delete(s.pending, ip)
+		retried++
+	}
+
+	if retried > 0 || len(s.pending) > 0 {
+		s.logger.Printf("Retried failed firewall changes: %d succeeded, %d still failing", retried, len(s.pending))
+	}
+}
@@ -0,0 +1,112 @@
+package blocker
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// lockHeld is the output of iptables when another run holds its lock
+const lockHeld = "Another app is currently holding the xtables lock. Perhaps you want to use the -w option?"
+
+// TestRetry checks that only transient failures are retried, with a backoff
+// that doubles, and at most Options.Retries times
+func TestRetry(t *testing.T) {
+	s := NewServiceWithOptions("linux", Options{Retries: 3, RetryBackoff: 2 * time.Millisecond})
+
+	tests := []struct {
+		name  string
+		fails int // Times the change fails before it succeeds
+		err   error
+		calls int
+		ok    bool
+	}{
+		{"success", 0, nil, 1, true},
+		{"transient", 2, errors.New(lockHeld), 3, true},
+		{"busy pf device", 1, errors.New("pfctl: DIOCADDRULE: Device busy"), 2, true},
+		{"persistent", 0, errors.New(lockHeld), 4, false},
+		{"not transient", 0, errors.New("iptables: Permission denied (you must be root)"), 1, false},
+	}
+	for _, test := range tests {
+		calls := 0
+		start := time.Now()
+		err := s.retry(func() error {
+			calls++
+			if test.err != nil && (test.fails == 0 || calls <= test.fails) {
+				return test.err
+			}
+			return nil
+		})
+		if (err == nil) != test.ok || calls != test.calls {
+			t.Errorf("%s: retry = %v after %d calls, want success %v after %d", test.name, err, calls, test.ok, test.calls)
+		}
+		if test.name == "persistent" && time.Since(start) < 14*time.Millisecond {
+			t.Errorf("%s: retries took %v, want at least 2+4+8ms of backoff", test.name, time.Since(start))
+		}
+	}
+}
+
+// TestRetryQueue checks that firewall changes that keep failing are queued,
+// counted and retried by CleanupExpired, that later changes replace them and
+// that blocks which expired in the queue are dropped
+func TestRetryQueue(t *testing.T) {
+	s, fw := newFakeFirewall(t, Options{Retries: 2, RetryBackoff: time.Millisecond})
+
+	fw.Fail(lockHeld)
+	var blockErr *BlockError
+	if _, err := s.Block("192.0.2.1", Ban, 0); !errors.As(err, &blockErr) || blockErr.IP != "192.0.2.1" {
+		t.Fatalf("Block with the lock held: %v, want a BlockError", err)
+	}
+	if runs := count(fw.Commands(), "iptables -N"); runs != 3 {
+		t.Errorf("failing command ran %d times, want 3 with 2 retries", runs)
+	}
+	s.Block("192.0.2.2", Timeout, 20*time.Millisecond)
+	if blocked, _ := s.IsBlocked("192.0.2.1"); blocked {
+		t.Error("IP tracked although its block failed")
+	}
+
+	time.Sleep(30 * time.Millisecond)
+	if err := s.CleanupExpired(); err != nil {
+		t.Fatalf("CleanupExpired failed: %v", err)
+	}
+	pending := s.Pending()
+	if len(pending) != 1 || pending[0].IP != "192.0.2.1" || pending[0].Attempts != 2 || pending[0].Unblock {
+		t.Fatalf("pending changes %+v, want the ban of 192.0.2.1 after 2 attempts", pending)
+	}
+	if pending[0].Err == nil {
+		t.Error("pending change without its error")
+	}
+
+	fw.Fail("")
+	if err := s.CleanupExpired(); err != nil {
+		t.Fatalf("CleanupExpired failed: %v", err)
+	}
+	if pending := s.Pending(); len(pending) != 0 {
+		t.Errorf("pending changes %+v after a successful retry, want none", pending)
+	}
+	if blocked, _ := s.IsBlocked("192.0.2.1"); !blocked || !fw.Dropped("192.0.2.1") {
+		t.Error("retried block not applied")
+	}
+
+	// A failed unblock is queued as well, and a later block of the IP
+	// supersedes it
+	fw.FailOn("iptables -D", lockHeld)
+	if err := s.Unblock("192.0.2.1"); err == nil {
+		t.Fatal("Unblock with the lock held succeeded")
+	}
+	if pending := s.Pending(); len(pending) != 1 || !pending[0].Unblock || pending[0].Attempts != 1 {
+		t.Errorf("pending changes %+v, want the unblock after one attempt", pending)
+	}
+	if blocked, _ := s.IsBlocked("192.0.2.1"); !blocked {
+		t.Error("IP no longer tracked although its unblock failed")
+	}
+	fw.Fail("")
+	s.BlockBatch([]string{"192.0.2.1"}, Ban, 0)
+	if pending := s.Pending(); len(pending) != 0 {
+		t.Errorf("pending changes %+v after a new block, want none", pending)
+	}
+	s.CleanupExpired()
+	if !fw.Dropped("192.0.2.1") {
+		t.Error("queued unblock ran after a new block of the IP")
+	}
+}
@@ -0,0 +1,86 @@
+package blocker
+
+import (
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// selfTestIP is the address self-test rules match, from TEST-NET-1 (RFC 5737),
+// which never carries real traffic
+const selfTestIP = "192.0.2.1"
+
+// selfTestName names the chain, table or rule self-tests create
+const selfTestName = "whoen-selftest"
+
+// SelfTest adds a rule for a documentation address in a dedicated chain,
+// table or disabled rule and removes it again, exercising the same commands
+// and privileges as real blocks without affecting traffic. It returns a
+// *CapabilityError for the step that failed, or nil when OS enforcement is
+// disabled.
+func (s *Service) SelfTest() error {
+	if !s.options.Enforce {
+		return nil
+	}
+
+	var steps [][]string
+	p := s.privilege
+	switch s.systemType {
+	case "linux":
+		if s.options.Backend == BackendFirewalld {
+			// A timed runtime rule, so a failed removal cleans itself up
+			rule := firewalldRule(selfTestIP)
+			steps = [][]string{
+				p.args("firewall-cmd", "--add-rich-rule="+rule, "--timeout=60s"),
+				p.args("firewall-cmd", "--remove-rich-rule="+rule),
+			}
+		} else {
+			// A chain no other chain jumps to, so its rule never matches traffic
+			chain := strings.ToUpper(selfTestName)
+			steps = [][]string{
+				p.args("iptables", "-N", chain),
+				p.args("iptables", "-A", chain, "-s", selfTestIP, "-j", "DROP"),
+				p.args("iptables", "-D", chain, "-s", selfTestIP, "-j", "DROP"),
+				p.args("iptables", "-X", chain),
+			}
+			// Drop a chain left behind by an interrupted self-test
+			if p.command("iptables", "-n", "-L", chain).Run() == nil {
+				p.command("iptables", "-F", chain).Run()
+				p.command("iptables", "-X", chain).Run()
+			}
+		}
+	case "darwin":
+		// A table no pf rule refers to
+		steps = [][]string{
+			p.args("pfctl", "-t", selfTestName, "-T", "add", selfTestIP),
+			p.args("pfctl", "-t", selfTestName, "-T", "kill"),
+		}
+	case "windows":
+		if s.options.Backend == BackendNetFirewall {
+			script := fmt.Sprintf("New-NetFirewallRule -Name %[1]s -DisplayName %[1]s -Enabled False -Direction Inbound -Action Block -RemoteAddress %[2]s | Out-Null\n"+
+				"Remove-NetFirewallRule -Name %[1]s\n", psQuote(selfTestName), psQuote(selfTestIP))
+			if _, err := runPowerShell(script); err != nil {
+				return &CapabilityError{Command: "New-NetFirewallRule " + selfTestName, Err: err}
+			}
+			return nil
+		}
+		// A disabled rule
+		steps = [][]string{
+			{"netsh", "advfirewall", "firewall", "add", "rule", "name=" + selfTestName, "dir=in", "action=block",
+				"remoteip=" + selfTestIP, "enable=no"},
+			{"netsh", "advfirewall", "firewall", "delete", "rule", "name=" + selfTestName},
+		}
+	default:
+		return unsupportedSystem(s.systemType)
+	}
+
+	for _, step := range steps {
+		output, err := exec.Command(step[0], step[1:]...).CombinedOutput()
+		if err != nil {
+			capabilityErr := &CapabilityError{Command: strings.Join(step, " "), Output: strings.TrimSpace(string(output)), Err: err}
+			capabilityErr.Hint = s.capabilityHint(step[0], capabilityErr.Output, err)
+			return capabilityErr
+		}
+	}
+	return nil
+}
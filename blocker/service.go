@@ -2,10 +2,14 @@ package blocker
 
 import (
 	"fmt"
+	"log"
+	"os"
 	"os/exec"
 	"strings"
 	"sync"
 	"time"
+
+	"github.com/headswim/whoen/ipaddr"
 )
 
 // Service implements the Blocker interface
@@ -13,6 +17,63 @@ type Service struct {
 	blockedIPs map[string]time.Time // IP -> expiration time (zero for permanent)
 	mutex      sync.RWMutex
 	systemType string // "linux", "darwin" (mac), or "windows"
+	options    Options
+	privilege  privilege            // Command prefix that runs firewall commands with privileges
+	pending    map[string]PendingOp // Failed firewall changes, retried at the next cleanup
+	logger     *log.Logger
+}
+
+// Options gates the blocker's risky behaviors
+type Options struct {
+	// Enforce applies blocks to the OS firewall. Without it blocks are only
+	// tracked in memory and requests are rejected by the middleware alone.
+	Enforce bool
+
+	// SkipTimeouts keeps timeouts out of the OS firewall, so they are only
+	// enforced by the middleware and short blocks do not churn firewall
+	// rules. SkipBans does the same for permanent blocks. Both only matter
+	// with Enforce.
+	SkipTimeouts bool
+	SkipBans     bool
+
+	// BlockOutbound also drops outgoing connections to blocked IPs
+	// (iptables OUTPUT chain, netsh dir=out rules)
+	BlockOutbound bool
+
+	// EnablePF runs pfctl -e on macOS so the blocklist table takes effect.
+	// Without it the table is only enforced if pf is already enabled.
+	EnablePF bool
+
+	// Backend selects the firewall: BackendIptables (the default on Linux)
+	// or BackendFirewalld on Linux, BackendNetsh (the default on Windows) or
+	// BackendNetFirewall on Windows, or BackendAuto to pick firewalld or
+	// NetSecurity when available. firewalld only filters incoming traffic,
+	// so BlockOutbound has no effect with it.
+	Backend string
+
+	// Privilege selects how firewall commands on Linux and macOS gain root:
+	// PrivilegeAuto (the default when empty), PrivilegeNone, PrivilegeSudo,
+	// PrivilegeDoas or a custom wrapper command line
+	Privilege string
+
+	// Retries is how often a firewall change that failed with a transient
+	// error, such as iptables lock contention or a busy pf device, is tried
+	// again right away. The first retry waits RetryBackoff, and each further
+	// one twice as long. Changes that still fail are queued and retried at
+	// every CleanupExpired, see Pending.
+	Retries      int
+	RetryBackoff time.Duration
+
+	// Logger receives the blocker's messages, such as the number of blocks
+	// restored. Defaults to standard output; a logger writing to io.Discard
+	// silences it.
+	Logger *log.Logger
+}
+
+// LegacyOptions returns the options matching the blocker's original behavior:
+// OS enforcement, outbound blocking and pf enablement all turned on
+func LegacyOptions() Options {
+	return Options{Enforce: true, BlockOutbound: true, EnablePF: true}
 }
 
 // NewService creates a new Service instance
@@ -20,23 +81,71 @@ func NewService() *Service {
 	return &Service{
 		blockedIPs: make(map[string]time.Time),
 		systemType: "linux", // Default to linux
+		options:    LegacyOptions(),
+		privilege:  newPrivilege(PrivilegeAuto),
+		logger:     newLogger(nil),
 	}
 }
 
 // NewServiceWithSystemType creates a new Service instance with a specific system type
 func NewServiceWithSystemType(systemType string) *Service {
+	return NewServiceWithOptions(systemType, LegacyOptions())
+}
+
+// NewServiceWithOptions creates a new Service instance with a specific system
+// type and explicit feature flags for its risky behaviors
+func NewServiceWithOptions(systemType string, options Options) *Service {
 	// Normalize system type
 	normalizedType := strings.ToLower(systemType)
 	if normalizedType == "mac" {
 		normalizedType = "darwin"
 	}
 
+	// Pick the firewall backend once, up front
+	options.Backend = strings.ToLower(options.Backend)
+	if options.Backend == BackendAuto {
+		options.Backend = defaultBackend(normalizedType)
+		if normalizedType == "linux" && options.Enforce && firewalldRunning(newPrivilege(options.Privilege)) {
+			options.Backend = BackendFirewalld
+		}
+		if normalizedType == "windows" && options.Enforce && netFirewallAvailable() {
+			options.Backend = BackendNetFirewall
+		}
+	}
+	if options.Backend == "" {
+		options.Backend = defaultBackend(normalizedType)
+	}
+
 	return &Service{
 		blockedIPs: make(map[string]time.Time),
 		systemType: normalizedType,
+		options:    options,
+		privilege:  newPrivilege(options.Privilege),
+		logger:     newLogger(options.Logger),
 	}
 }
 
+// newLogger returns logger, or one writing to standard output if it is nil
+func newLogger(logger *log.Logger) *log.Logger {
+	if logger == nil {
+		return log.New(os.Stdout, "", 0)
+	}
+	return logger
+}
+
+// defaultBackend returns the firewall backend used on a system type when none is chosen
+func defaultBackend(systemType string) string {
+	if systemType == "windows" {
+		return BackendNetsh
+	}
+	return BackendIptables
+}
+
+// Options returns the feature flags the blocker was created with
+func (s *Service) Options() Options {
+	return s.options
+}
+
 // SetSystemType sets the system type for the blocker
 func (s *Service) SetSystemType(systemType string) {
 	s.mutex.Lock()
@@ -52,6 +161,7 @@ func (s *Service) SetSystemType(systemType string) {
 
 // Block blocks an IP
 func (s *Service) Block(ip string, blockType BlockType, duration time.Duration) (*BlockResult, error) {
+	ip = ipaddr.Normalize(ip)
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
 
@@ -61,64 +171,86 @@ func (s *Service) Block(ip string, blockType BlockType, duration time.Duration)
 		Duration:  duration,
 	}
 
+	// Only IPs and ranges reach the firewall
+	if err := checkIP(ip); err != nil {
+		result.Error = err
+		return result, err
+	}
+
+	// This block supersedes any queued change for the IP
+	delete(s.pending, ip)
+
 	// Check if IP is already blocked
-	if expiration, exists := s.blockedIPs[ip]; exists {
+	if current, exists := s.blockedIPs[ip]; exists {
 		// If it's a permanent block, or the existing block is longer, do nothing
-		if expiration.IsZero() || (blockType == Timeout && time.Now().Add(duration).Before(expiration)) {
+		if current.IsZero() || (blockType == Timeout && time.Now().Add(duration).Before(current)) {
 			return result, nil
 		}
+
+		// The firewall rule is already in place, only the expiration changes,
+		// except for firewalld rules that expire on their own and for blocks
+		// that move in or out of the firewall with their type
+		expiration := time.Time{}
+		if blockType == Timeout {
+			expiration = time.Now().Add(duration)
+		}
+		switch {
+		case s.enforced(expiration) && (!s.enforced(current) || s.timedRules()):
+			if err := s.blockOS(ip, expiration); err != nil {
+				s.queue(ip, false, expiration, err)
+				result.Error = err
+				return result, err
+			}
+		case s.enforced(current) && !s.enforced(expiration):
+			if err := s.unblockOS(ip); err != nil {
+				result.Error = err
+			}
+		}
+		s.blockedIPs[ip] = expiration
+		return result, result.Error
 	}
 
-	// Block the IP at the OS level
-	var err error
-	if s.systemType == "linux" {
-		err = blockIPLinux(ip)
-	} else if s.systemType == "darwin" {
-		err = blockIPDarwin(ip)
-	} else if s.systemType == "windows" {
-		err = blockIPWindows(ip)
-	} else {
-		err = fmt.Errorf("unsupported system type: %s", s.systemType)
+	// Zero time for permanent blocks
+	expiration := time.Time{}
+	if blockType == Timeout {
+		expiration = time.Now().Add(duration)
 	}
 
-	if err != nil {
+	// Block the IP at the OS level, queueing the block for retry if that fails
+	if err := s.blockOS(ip, expiration); err != nil {
+		s.queue(ip, false, expiration, err)
 		result.Error = err
 		return result, err
 	}
 
 	// Update the blocked IPs map
-	if blockType == Ban {
-		s.blockedIPs[ip] = time.Time{} // Zero time for permanent blocks
-	} else {
-		s.blockedIPs[ip] = time.Now().Add(duration)
-	}
+	s.blockedIPs[ip] = expiration
 
 	return result, nil
 }
 
 // Unblock unblocks an IP
 func (s *Service) Unblock(ip string) error {
+	ip = ipaddr.Normalize(ip)
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
 
-	// Check if IP is blocked
-	if _, exists := s.blockedIPs[ip]; !exists {
+	// This unblock supersedes any queued change for the IP
+	delete(s.pending, ip)
+
+	// Check if IP is blocked, and whether the block is in the OS firewall
+	expiration, exists := s.blockedIPs[ip]
+	if !exists {
 		return nil
 	}
-
-	// Unblock the IP at the OS level
-	var err error
-	if s.systemType == "linux" {
-		err = unblockIPLinux(ip)
-	} else if s.systemType == "darwin" {
-		err = unblockIPDarwin(ip)
-	} else if s.systemType == "windows" {
-		err = unblockIPWindows(ip)
-	} else {
-		err = fmt.Errorf("unsupported system type: %s", s.systemType)
+	if !s.enforced(expiration) {
+		delete(s.blockedIPs, ip)
+		return nil
 	}
 
-	if err != nil {
+	// Unblock the IP at the OS level, queueing the unblock for retry if that fails
+	if err := s.unblockOS(ip); err != nil {
+		s.queue(ip, true, time.Time{}, err)
 		return err
 	}
 
@@ -130,6 +262,7 @@ func (s *Service) Unblock(ip string) error {
 
 // IsBlocked checks if an IP is blocked
 func (s *Service) IsBlocked(ip string) (bool, error) {
+	ip = ipaddr.Normalize(ip)
 	s.mutex.RLock()
 	defer s.mutex.RUnlock()
 
@@ -138,14 +271,33 @@ func (s *Service) IsBlocked(ip string) (bool, error) {
 		return false, nil
 	}
 
-	// If it's a permanent block, or the block hasn't expired yet
-	if expiration.IsZero() || time.Now().Before(expiration) {
-		return true, nil
-	}
+	// If it's a permanent block, or the block hasn't expired yet.
+	// Expired blocks stay tracked until CleanupExpired removes their firewall rules.
+	return expiration.IsZero() || time.Now().Before(expiration), nil
+}
 
-	// Block has expired, remove it
-	delete(s.blockedIPs, ip)
-	return false, nil
+// Expiration returns when the block of an IP expires (zero for permanent
+// blocks) and whether the IP is tracked at all
+func (s *Service) Expiration(ip string) (time.Time, bool) {
+	ip = ipaddr.Normalize(ip)
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	expiration, exists := s.blockedIPs[ip]
+	return expiration, exists
+}
+
+// Blocks returns a copy of the IPs the service enforces and their expiration
+// times (zero for permanent blocks)
+func (s *Service) Blocks() map[string]time.Time {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	blocks := make(map[string]time.Time, len(s.blockedIPs))
+	for ip, expiration := range s.blockedIPs {
+		blocks[ip] = expiration
+	}
+	return blocks
 }
 
 // CleanupExpired removes expired blocks
@@ -153,194 +305,426 @@ func (s *Service) CleanupExpired() error {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
 
+	// Skip unsupported system types
+	if s.options.Enforce && !supportedSystem(s.systemType) {
+		return nil
+	}
+
+	// Retry the firewall changes that failed before
+	s.retryPending()
+
+	// Lift the expired blocks together where the backend allows
 	now := time.Now()
+	var expired []string
 	for ip, expiration := range s.blockedIPs {
 		if !expiration.IsZero() && now.After(expiration) {
-			// Unblock the IP at the OS level
-			var err error
-			if s.systemType == "linux" {
-				err = unblockIPLinux(ip)
-			} else if s.systemType == "darwin" {
-				err = unblockIPDarwin(ip)
-			} else if s.systemType == "windows" {
-				err = unblockIPWindows(ip)
-			} else {
-				continue // Skip unsupported system types
-			}
-
-			if err != nil {
-				return err
-			}
-
-			// Remove from the blocked IPs map
-			delete(s.blockedIPs, ip)
+			expired = append(expired, ip)
 		}
 	}
+	return s.liftBatch(s.forget(expired))
+}
 
-	return nil
+// Len returns the number of IPs the service is tracking
+func (s *Service) Len() int {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	return len(s.blockedIPs)
 }
 
 // RestoreBlocks restores blocks from a list of IPs and expiration times
-// This can be called from the main application to restore blocks after a restart
+// This can be called from the main application to restore blocks after a restart.
+// The blocks are applied together where the backend allows, see BlockBatch.
 func (s *Service) RestoreBlocks(ips map[string]time.Time) error {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
 
 	now := time.Now()
-	restored := 0
 	skipped := 0
-
+	blocks := make(map[string]time.Time, len(ips))
 	for ip, expiration := range ips {
 		// Skip expired blocks
 		if !expiration.IsZero() && now.After(expiration) {
 			skipped++
 			continue
 		}
+		ip = ipaddr.Normalize(ip)
+		if err := checkIP(ip); err != nil {
+			s.logger.Printf("Not restoring block: %v", err)
+			continue
+		}
+		blocks[ip] = expiration
+	}
+
+	if err := s.applyBatch(blocks); err != nil {
+		return fmt.Errorf("failed to restore blocks: %w", err)
+	}
+
+	s.logger.Printf("Restored %d IP blocks, skipped %d expired blocks", len(blocks), skipped)
+	return nil
+}
+
+// enforced reports whether a block that lasts until expiration (zero for
+// permanent blocks) belongs in the OS firewall, see Options.SkipTimeouts
+func (s *Service) enforced(expiration time.Time) bool {
+	if !s.options.Enforce {
+		return false
+	}
+	if expiration.IsZero() {
+		return !s.options.SkipBans
+	}
+	return !s.options.SkipTimeouts
+}
 
-		// Apply the block at OS level
-		var err error
-		if s.systemType == "linux" {
-			err = blockIPLinux(ip)
-		} else if s.systemType == "darwin" {
-			err = blockIPDarwin(ip)
-		} else if s.systemType == "windows" {
-			err = blockIPWindows(ip)
-		} else {
-			return fmt.Errorf("unsupported system type: %s", s.systemType)
+// forget stops tracking the blocks of IPs that are kept out of the OS
+// firewall, and returns the other IPs, whose rules still have to be removed.
+// The caller must hold the lock.
+func (s *Service) forget(ips []string) []string {
+	enforced := ips[:0:0]
+	for _, ip := range ips {
+		if s.enforced(s.blockedIPs[ip]) {
+			enforced = append(enforced, ip)
+			continue
 		}
+		delete(s.blockedIPs, ip)
+	}
+	return enforced
+}
 
-		if err != nil {
-			return fmt.Errorf("failed to restore block for IP %s: %v", ip, err)
+// blockOS applies a block that lasts until expiration (zero for permanent
+// blocks) to the OS firewall, or does nothing when OS enforcement is disabled
+// or the block is kept out of the firewall
+func (s *Service) blockOS(ip string, expiration time.Time) error {
+	if !s.enforced(expiration) {
+		return nil
+	}
+
+	return s.blockError([]string{ip}, false, s.retry(func() error {
+		switch s.systemType {
+		case "linux":
+			if s.options.Backend == BackendFirewalld {
+				duration := time.Duration(0)
+				if !expiration.IsZero() {
+					duration = time.Until(expiration)
+				}
+				return blockIPFirewalld(s.privilege, ip, duration)
+			}
+			return blockIPLinux(s.privilege, ip, s.options.BlockOutbound)
+		case "darwin":
+			return blockIPDarwin(s.privilege, ip, s.options.EnablePF)
+		case "windows":
+			if s.options.Backend == BackendNetFirewall {
+				return blockIPsNetFirewall([]string{ip}, s.options.BlockOutbound)
+			}
+			return blockIPWindows(ip, s.options.BlockOutbound)
+		default:
+			return unsupportedSystem(s.systemType)
 		}
+	}))
+}
 
-		// Update the blocked IPs map
-		s.blockedIPs[ip] = expiration
-		restored++
+// unblockOS removes a block from the OS firewall, or does nothing when OS
+// enforcement is disabled
+func (s *Service) unblockOS(ip string) error {
+	if !s.options.Enforce {
+		return nil
 	}
 
-	fmt.Printf("Restored %d IP blocks, skipped %d expired blocks\n", restored, skipped)
-	return nil
+	return s.blockError([]string{ip}, true, s.retry(func() error {
+		switch s.systemType {
+		case "linux":
+			if s.options.Backend == BackendFirewalld {
+				return unblockIPFirewalld(s.privilege, ip)
+			}
+			return unblockIPLinux(s.privilege, ip)
+		case "darwin":
+			return unblockIPDarwin(s.privilege, ip)
+		case "windows":
+			if s.options.Backend == BackendNetFirewall {
+				return unblockIPsNetFirewall([]string{ip})
+			}
+			return unblockIPWindows(ip)
+		default:
+			return unsupportedSystem(s.systemType)
+		}
+	}))
 }
 
-// blockIPLinux blocks an IP on Linux using iptables
-func blockIPLinux(ip string) error {
-	// Use -I INPUT 1 to insert at the beginning of the chain for highest priority
-	cmd := exec.Command("sudo", "iptables", "-I", "INPUT", "1", "-s", ip, "-j", "DROP")
-	output, err := cmd.CombinedOutput()
+// timedRules reports whether the OS firewall rules carry their own timeout,
+// so changing the expiration of a block means replacing its rule
+func (s *Service) timedRules() bool {
+	return s.options.Enforce && s.systemType == "linux" && s.options.Backend == BackendFirewalld
+}
+
+// netFirewall reports whether blocks are enforced with the NetSecurity cmdlets
+func (s *Service) netFirewall() bool {
+	return s.options.Enforce && s.systemType == "windows" && s.options.Backend == BackendNetFirewall
+}
+
+// PruneRules removes the firewall rules whoen left behind for IPs the service
+// does not block, such as IPs unblocked while the application was down. Only
+// the NetSecurity backend can enumerate its rules; with the other backends
+// it does nothing. It returns the number of IPs whose rules were removed.
+func (s *Service) PruneRules() (int, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if !s.netFirewall() {
+		return 0, nil
+	}
+
+	ips, err := netFirewallIPs()
 	if err != nil {
-		return fmt.Errorf("failed to block IP %s with iptables: %v (output: %s)", ip, err, string(output))
+		return 0, err
 	}
+	var stale []string
+	for _, ip := range ips {
+		if expiration, ok := s.blockedIPs[ip]; !ok || !s.enforced(expiration) {
+			stale = append(stale, ip)
+		}
+	}
+	if err := unblockIPsNetFirewall(stale); err != nil {
+		return 0, err
+	}
+	return len(stale), nil
+}
 
-	// Also block outgoing connections to this IP for complete isolation
-	outCmd := exec.Command("sudo", "iptables", "-I", "OUTPUT", "1", "-d", ip, "-j", "DROP")
-	outOutput, outErr := outCmd.CombinedOutput()
-	if outErr != nil {
-		return fmt.Errorf("failed to block outgoing connections to IP %s with iptables: %v (output: %s)", ip, outErr, string(outOutput))
+// FlushAll removes all of whoen's firewall rules and stops tracking blocks,
+// leaving other rules alone: whoen's iptables chain and the jumps to it, and
+// its pf anchor, are removed whole. firewalld and netsh rules cannot be told
+// apart from others, so only those of the tracked IPs are removed. Storage is
+// not changed, so the middleware keeps rejecting blocked IPs.
+func (s *Service) FlushAll() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.options.Enforce {
+		if err := s.flushOS(); err != nil {
+			return err
+		}
 	}
+	s.blockedIPs = make(map[string]time.Time)
+	s.pending = nil
 	return nil
 }
 
-// unblockIPLinux unblocks an IP on Linux using iptables
-func unblockIPLinux(ip string) error {
-	// Remove both INPUT and OUTPUT rules
-	inCmd := exec.Command("sudo", "iptables", "-D", "INPUT", "-s", ip, "-j", "DROP")
-	inOutput, inErr := inCmd.CombinedOutput()
+// flushOS removes whoen's firewall rules, see FlushAll. The caller must hold
+// the lock.
+func (s *Service) flushOS() error {
+	tracked := make([]string, 0, len(s.blockedIPs))
+	for ip := range s.blockedIPs {
+		tracked = append(tracked, ip)
+	}
 
-	outCmd := exec.Command("sudo", "iptables", "-D", "OUTPUT", "-d", ip, "-j", "DROP")
-	outOutput, outErr := outCmd.CombinedOutput()
+	switch s.systemType {
+	case "linux":
+		if s.options.Backend != BackendFirewalld {
+			// Rules left in INPUT and OUTPUT by older versions go first
+			if err := unblockIPsLinux(s.privilege, tracked); err != nil {
+				return err
+			}
+			return flushChain(s.privilege)
+		}
+	case "darwin":
+		return flushAnchor(s.privilege)
+	case "windows":
+		if s.options.Backend == BackendNetFirewall {
+			script := fmt.Sprintf("Remove-NetFirewallRule -Group %s -ErrorAction SilentlyContinue\n", psQuote(netFirewallGroup))
+			if _, err := runPowerShell(script); err != nil {
+				return fmt.Errorf("failed to remove NetSecurity firewall rules: %w", err)
+			}
+			return nil
+		}
+	default:
+		return unsupportedSystem(s.systemType)
+	}
 
-	// Return an error if either command failed
-	if inErr != nil {
-		return fmt.Errorf("failed to unblock IP %s with iptables (INPUT): %v (output: %s)", ip, inErr, string(inOutput))
+	// firewalld and netsh rules are removed one IP at a time
+	for _, ip := range tracked {
+		if err := s.unblockOS(ip); err != nil {
+			return err
+		}
 	}
-	if outErr != nil {
-		return fmt.Errorf("failed to unblock IP %s with iptables (OUTPUT): %v (output: %s)", ip, outErr, string(outOutput))
+	return nil
+}
+
+// supportedSystem reports whether the blocker can enforce blocks on a system type
+func supportedSystem(systemType string) bool {
+	return systemType == "linux" || systemType == "darwin" || systemType == "windows"
+}
+
+// blockIPLinux blocks an IP on Linux with a rule in whoen's iptables chain,
+// and outgoing connections to it when outbound is set. Rules that already
+// exist are not added again, so blocking the same IP twice is harmless.
+func blockIPLinux(p privilege, ip string, outbound bool) error {
+	if err := ensureChain(p, outbound); err != nil {
+		return err
+	}
+
+	if p.command("iptables", "-C", IptablesChain, "-s", ip, "-j", "DROP").Run() != nil {
+		if err := iptables(p, "-A", IptablesChain, "-s", ip, "-j", "DROP"); err != nil {
+			return fmt.Errorf("failed to block IP %s with iptables: %w", ip, err)
+		}
+	}
+
+	// Also block outgoing connections to this IP for complete isolation
+	if outbound && p.command("iptables", "-C", IptablesChain, "-d", ip, "-j", "DROP").Run() != nil {
+		if err := iptables(p, "-A", IptablesChain, "-d", ip, "-j", "DROP"); err != nil {
+			return fmt.Errorf("failed to block outgoing connections to IP %s with iptables: %w", ip, err)
+		}
 	}
 	return nil
 }
 
-// blockIPDarwin blocks an IP on macOS using pfctl
-func blockIPDarwin(ip string) error {
+// unblockIPLinux unblocks an IP on Linux using iptables. Only rules that
+// exist are deleted: the outgoing rule only exists when outbound blocking was
+// enabled at the time the IP was blocked, and rules in INPUT and OUTPUT are
+// left over from versions without whoen's own chain.
+func unblockIPLinux(p privilege, ip string) error {
+	rules := [][]string{
+		{IptablesChain, "-s", ip, "-j", "DROP"},
+		{IptablesChain, "-d", ip, "-j", "DROP"},
+		{"INPUT", "-s", ip, "-j", "DROP"},
+		{"OUTPUT", "-d", ip, "-j", "DROP"},
+	}
+	for _, rule := range rules {
+		if p.command("iptables", append([]string{"-C"}, rule...)...).Run() != nil {
+			continue
+		}
+		if err := iptables(p, append([]string{"-D"}, rule...)...); err != nil {
+			return fmt.Errorf("failed to unblock IP %s with iptables (%s): %w", ip, rule[0], err)
+		}
+	}
+	return nil
+}
+
+// blockIPDarwin blocks an IP on macOS using pfctl, enabling pf first when
+// enablePF is set
+func blockIPDarwin(p privilege, ip string, enablePF bool) error {
+	output, err := ensureBlocklistTable(p)
+	if err != nil {
+		return err
+	}
+
+	if !tableContains(output, ip) {
+		// Add the IP to the blocklist table
+		addCmd := p.command("pfctl", pfTable("-T", "add", ip)...)
+		addOutput, addErr := addCmd.CombinedOutput()
+		if addErr != nil {
+			return fmt.Errorf("failed to add IP %s to blocklist with pfctl: %w (output: %s)", ip, addErr, string(addOutput))
+		}
+	}
+
+	return loadBlocklistRule(p, enablePF)
+}
+
+// ensureBlocklistTable creates the pf blocklist table if it doesn't exist and
+// returns its contents
+func ensureBlocklistTable(p privilege) (string, error) {
 	// Check if the rule already exists
-	checkCmd := exec.Command("sudo", "pfctl", "-t", "blocklist", "-T", "show")
+	checkCmd := p.command("pfctl", pfTable("-T", "show")...)
 	output, err := checkCmd.CombinedOutput()
 	if err != nil {
 		// If the table doesn't exist, create it
-		createCmd := exec.Command("sudo", "pfctl", "-t", "blocklist", "-T", "create")
+		createCmd := p.command("pfctl", pfTable("-T", "create")...)
 		createOutput, createErr := createCmd.CombinedOutput()
 		if createErr != nil {
-			return fmt.Errorf("failed to create blocklist table with pfctl: %v (output: %s)", createErr, string(createOutput))
+			return "", fmt.Errorf("failed to create blocklist table with pfctl: %w (output: %s)", createErr, string(createOutput))
 		}
 	}
+	return string(output), nil
+}
 
-	if !strings.Contains(string(output), ip) {
-		// Add the IP to the blocklist table
-		addCmd := exec.Command("sudo", "pfctl", "-t", "blocklist", "-T", "add", ip)
-		addOutput, addErr := addCmd.CombinedOutput()
-		if addErr != nil {
-			return fmt.Errorf("failed to add IP %s to blocklist with pfctl: %v (output: %s)", ip, addErr, string(addOutput))
-		}
+// loadBlocklistRule makes sure pf enforces the blocklist table, enabling pf
+// first when enablePF is set
+func loadBlocklistRule(p privilege, enablePF bool) error {
+	// Make sure pf is enabled, if allowed to turn it on
+	var enableOutput []byte
+	var enableErr error
+	if enablePF {
+		enableCmd := p.command("pfctl", "-e")
+		enableOutput, enableErr = enableCmd.CombinedOutput()
 	}
 
-	// Make sure pf is enabled
-	enableCmd := exec.Command("sudo", "pfctl", "-e")
-	enableOutput, enableErr := enableCmd.CombinedOutput()
-
-	// Ensure the blocklist table is referenced in the pf rules
+	// Ensure the blocklist table is referenced in the pf rules of whoen's anchor
 	// This adds a rule to block all traffic to/from the IPs in the blocklist table
-	ruleCmd := exec.Command("sudo", "sh", "-c",
-		`echo "block drop in quick from <blocklist> to any" | sudo pfctl -f - -a blocklist`)
+	ruleCmd := p.command("pfctl", "-f", "-", "-a", PFAnchor)
+	ruleCmd.Stdin = strings.NewReader("block drop in quick from <blocklist> to any\n")
 	ruleOutput, ruleErr := ruleCmd.CombinedOutput()
 
 	if enableErr != nil {
-		return fmt.Errorf("failed to enable pf: %v (output: %s)", enableErr, string(enableOutput))
+		return fmt.Errorf("failed to enable pf: %w (output: %s)", enableErr, string(enableOutput))
 	}
 	if ruleErr != nil {
-		return fmt.Errorf("failed to add blocklist rule with pfctl: %v (output: %s)", ruleErr, string(ruleOutput))
+		return fmt.Errorf("failed to add blocklist rule with pfctl: %w (output: %s)", ruleErr, string(ruleOutput))
 	}
 	return nil
 }
 
-// unblockIPDarwin unblocks an IP on macOS using pfctl
-func unblockIPDarwin(ip string) error {
-	cmd := exec.Command("sudo", "pfctl", "-t", "blocklist", "-T", "delete", ip)
+// tableContains checks if pfctl table output lists an IP
+func tableContains(output, ip string) bool {
+	for _, line := range strings.Split(output, "\n") {
+		if strings.TrimSpace(line) == ip {
+			return true
+		}
+	}
+	return false
+}
+
+// unblockIPDarwin unblocks an IP on macOS using pfctl. The IP is also
+// deleted from the global blocklist table of versions without whoen's own
+// anchor, where that table still exists.
+func unblockIPDarwin(p privilege, ip string) error {
+	cmd := p.command("pfctl", pfTable("-T", "delete", ip)...)
 	output, err := cmd.CombinedOutput()
 	if err != nil {
-		return fmt.Errorf("failed to unblock IP %s with pfctl: %v (output: %s)", ip, err, string(output))
+		return fmt.Errorf("failed to unblock IP %s with pfctl: %w (output: %s)", ip, err, string(output))
 	}
+	p.command("pfctl", "-t", pfTableName, "-T", "delete", ip).Run()
 	return nil
 }
 
-// blockIPWindows blocks an IP on Windows using netsh
-func blockIPWindows(ip string) error {
+// blockIPWindows blocks an IP on Windows using netsh, and outgoing connections
+// to it when outbound is set. Rules that already exist are not added again, so
+// blocking the same IP twice is harmless.
+func blockIPWindows(ip string, outbound bool) error {
 	// Block inbound connections
-	inCmd := exec.Command("netsh", "advfirewall", "firewall", "add", "rule",
-		"name=BlockIP_In_"+ip,
-		"dir=in",
-		"action=block",
-		"remoteip="+ip,
-		"enable=yes",
-		"profile=any")
-	inOutput, inErr := inCmd.CombinedOutput()
-	if inErr != nil {
-		return fmt.Errorf("failed to block inbound connections from IP %s with netsh: %v (output: %s)", ip, inErr, string(inOutput))
+	if !netshRuleExists("BlockIP_In_" + ip) {
+		inCmd := exec.Command("netsh", "advfirewall", "firewall", "add", "rule",
+			"name=BlockIP_In_"+ip,
+			"dir=in",
+			"action=block",
+			"remoteip="+ip,
+			"enable=yes",
+			"profile=any")
+		inOutput, inErr := inCmd.CombinedOutput()
+		if inErr != nil {
+			return fmt.Errorf("failed to block inbound connections from IP %s with netsh: %w (output: %s)", ip, inErr, string(inOutput))
+		}
 	}
 
 	// Block outbound connections
-	outCmd := exec.Command("netsh", "advfirewall", "firewall", "add", "rule",
-		"name=BlockIP_Out_"+ip,
-		"dir=out",
-		"action=block",
-		"remoteip="+ip,
-		"enable=yes",
-		"profile=any")
-	outOutput, outErr := outCmd.CombinedOutput()
-	if outErr != nil {
-		return fmt.Errorf("failed to block outbound connections to IP %s with netsh: %v (output: %s)", ip, outErr, string(outOutput))
+	if outbound && !netshRuleExists("BlockIP_Out_"+ip) {
+		outCmd := exec.Command("netsh", "advfirewall", "firewall", "add", "rule",
+			"name=BlockIP_Out_"+ip,
+			"dir=out",
+			"action=block",
+			"remoteip="+ip,
+			"enable=yes",
+			"profile=any")
+		outOutput, outErr := outCmd.CombinedOutput()
+		if outErr != nil {
+			return fmt.Errorf("failed to block outbound connections to IP %s with netsh: %w (output: %s)", ip, outErr, string(outOutput))
+		}
 	}
 	return nil
 }
 
+// netshRuleExists checks if a Windows Firewall rule with the given name exists
+func netshRuleExists(name string) bool {
+	return exec.Command("netsh", "advfirewall", "firewall", "show", "rule", "name="+name).Run() == nil
+}
+
 // unblockIPWindows unblocks an IP on Windows using netsh
 func unblockIPWindows(ip string) error {
 	// Remove inbound rule
@@ -348,17 +732,22 @@ func unblockIPWindows(ip string) error {
 		"name=BlockIP_In_"+ip)
 	inOutput, inErr := inCmd.CombinedOutput()
 
-	// Remove outbound rule
-	outCmd := exec.Command("netsh", "advfirewall", "firewall", "delete", "rule",
-		"name=BlockIP_Out_"+ip)
-	outOutput, outErr := outCmd.CombinedOutput()
+	// Remove outbound rule, which only exists when outbound blocking was
+	// enabled at the time the IP was blocked
+	var outOutput []byte
+	var outErr error
+	if netshRuleExists("BlockIP_Out_" + ip) {
+		outCmd := exec.Command("netsh", "advfirewall", "firewall", "delete", "rule",
+			"name=BlockIP_Out_"+ip)
+		outOutput, outErr = outCmd.CombinedOutput()
+	}
 
 	// Return an error if either command failed
 	if inErr != nil {
-		return fmt.Errorf("failed to unblock inbound connections from IP %s with netsh: %v (output: %s)", ip, inErr, string(inOutput))
+		return fmt.Errorf("failed to unblock inbound connections from IP %s with netsh: %w (output: %s)", ip, inErr, string(inOutput))
 	}
 	if outErr != nil {
-		return fmt.Errorf("failed to unblock outbound connections to IP %s with netsh: %v (output: %s)", ip, outErr, string(outOutput))
+		return fmt.Errorf("failed to unblock outbound connections to IP %s with netsh: %w (output: %s)", ip, outErr, string(outOutput))
 	}
 	return nil
 }
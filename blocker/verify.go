@@ -0,0 +1,112 @@
+package blocker
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// VerifyRules checks that the OS firewall still enforces every block the
+// service tracks, since another tool or an administrator may have flushed
+// whoen's rules, and re-applies the missing ones. It returns the IPs whose
+// rules were missing. It does nothing when OS enforcement is disabled.
+func (s *Service) VerifyRules() ([]string, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if !s.options.Enforce || len(s.blockedIPs) == 0 {
+		return nil, nil
+	}
+
+	present, err := s.enforcedIPs()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read firewall rules: %w", err)
+	}
+
+	// Re-apply the rules of the tracked blocks that have not expired
+	now := time.Now()
+	var missing, failed []string
+	for ip, expiration := range s.blockedIPs {
+		if present[ip] || !s.enforced(expiration) || (!expiration.IsZero() && now.After(expiration)) {
+			continue
+		}
+		missing = append(missing, ip)
+		if err := s.blockOS(ip, expiration); err != nil {
+			failed = append(failed, ip)
+		}
+	}
+
+	sort.Strings(missing)
+	if len(failed) > 0 {
+		return missing, fmt.Errorf("failed to re-apply firewall rules for %d IPs: %s", len(failed), strings.Join(failed, ", "))
+	}
+	return missing, nil
+}
+
+// firewalldSource matches the source address of a rich rule
+var firewalldSource = regexp.MustCompile(`source address="([^"]+)"`)
+
+// enforcedIPs reads which IPs the OS firewall currently blocks with whoen's
+// rules. An IP counts as enforced when its incoming traffic is dropped. The
+// caller must hold the lock.
+func (s *Service) enforcedIPs() (map[string]bool, error) {
+	present := make(map[string]bool)
+	p := s.privilege
+
+	switch s.systemType {
+	case "linux":
+		if s.options.Backend == BackendFirewalld {
+			output, err := p.command("firewall-cmd", "--list-rich-rules").CombinedOutput()
+			if err != nil {
+				return nil, fmt.Errorf("%w (output: %s)", err, strings.TrimSpace(string(output)))
+			}
+			for _, line := range strings.Split(string(output), "\n") {
+				if match := firewalldSource.FindStringSubmatch(line); match != nil && strings.HasSuffix(strings.TrimSpace(line), " drop") {
+					present[match[1]] = true
+				}
+			}
+			return present, nil
+		}
+
+		// Without the jump from INPUT, the chain blocks nothing
+		if !chainJumps(p, "INPUT") {
+			return present, nil
+		}
+		return iptablesDropped(p, IptablesChain, "s")
+
+	case "darwin":
+		// Without the anchor rule, the table blocks nothing
+		rules, err := p.command("pfctl", "-a", PFAnchor, "-s", "rules").CombinedOutput()
+		if err != nil || !strings.Contains(string(rules), "<"+pfTableName+">") {
+			return present, nil
+		}
+		output, err := p.command("pfctl", pfTable("-T", "show")...).CombinedOutput()
+		if err != nil {
+			// The table is gone
+			return present, nil
+		}
+		for _, line := range strings.Split(string(output), "\n") {
+			if ip := strings.TrimSpace(line); ip != "" {
+				present[ip] = true
+			}
+		}
+		return present, nil
+
+	case "windows":
+		if s.options.Backend == BackendNetFirewall {
+			ips, err := netFirewallIPs()
+			if err != nil {
+				return nil, err
+			}
+			for _, ip := range ips {
+				present[ip] = true
+			}
+			return present, nil
+		}
+		return netshIPs()
+	}
+
+	return nil, unsupportedSystem(s.systemType)
+}
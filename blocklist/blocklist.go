@@ -0,0 +1,88 @@
+// Package blocklist exports the current blocks to, and imports blocks from,
+// common blocklist formats such as plain IP lists, CSV and web server deny files.
+package blocklist
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/headswim/whoen/ipaddr"
+	"github.com/headswim/whoen/storage"
+)
+
+// Format is a blocklist file format
+type Format string
+
+const (
+	// FormatText is one IP or CIDR per line. On import, text after the first
+	// field and comments starting with '#' or ';' are ignored, which also
+	// covers feeds like Spamhaus DROP ("1.10.16.0/20 ; SBL256894").
+	FormatText Format = "text"
+	// FormatCSV is a CSV file with a header row and at least an "ip" column
+	FormatCSV Format = "csv"
+	// FormatNginx is a list of nginx "deny <ip>;" directives
+	FormatNginx Format = "nginx"
+	// FormatApache is an Apache 2.4 "Require not ip" block. On import Apache 2.2
+	// "Deny from" lines are accepted as well.
+	FormatApache Format = "apache"
+	// FormatFail2ban is the output of "fail2ban-client status <jail>". Import
+	// only; blocks are tagged "fail2ban:<jail>".
+	FormatFail2ban Format = "fail2ban"
+	// FormatCrowdSec is a list or stream of CrowdSec decisions as JSON, from
+	// the local API or "cscli decisions list -o json". Import only; blocks
+	// are tagged "crowdsec" and deleted stream decisions lift them again.
+	FormatCrowdSec Format = "crowdsec"
+)
+
+// ParseFormat returns the Format for a name such as "csv" or "nginx"
+func ParseFormat(name string) (Format, error) {
+	switch format := Format(strings.ToLower(name)); format {
+	case FormatText, FormatCSV, FormatNginx, FormatApache, FormatFail2ban, FormatCrowdSec:
+		return format, nil
+	case "txt", "plain":
+		return FormatText, nil
+	default:
+		return "", fmt.Errorf("unknown blocklist format: %s", name)
+	}
+}
+
+// Entry is a single blocklist entry read from a file
+type Entry struct {
+	IP           string    // IP address or CIDR range
+	BlockedUntil time.Time // Zero when the file does not carry an expiry
+	IsPermanent  bool      // Only set by formats that carry it (CSV)
+	Source       string    // Only set by formats that carry it (CSV, fail2ban, CrowdSec)
+	Remove       bool      // Lift the block instead, only set by CrowdSec decision streams
+}
+
+// normalizeAddress validates an IP address or CIDR range and returns its canonical form
+func normalizeAddress(value string) (string, bool) {
+	value = strings.TrimSpace(value)
+	if addr, err := ipaddr.Parse(value); err == nil {
+		return addr.String(), true
+	}
+	if strings.Contains(value, "/") {
+		if prefix, err := ipaddr.ParsePrefix(value); err == nil {
+			return prefix.String(), true
+		}
+	}
+	return "", false
+}
+
+// activeBlocks returns the blocks in storage that have not expired
+func activeBlocks(store storage.Storage) ([]storage.BlockStatus, error) {
+	blockedIPs, err := store.GetBlockedIPs()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	active := make([]storage.BlockStatus, 0, len(blockedIPs))
+	for _, status := range blockedIPs {
+		if status.IsPermanent || now.Before(status.BlockedUntil) {
+			active = append(active, status)
+		}
+	}
+	return active, nil
+}
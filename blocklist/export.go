@@ -0,0 +1,92 @@
+package blocklist
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+
+	"github.com/headswim/whoen/storage"
+)
+
+// csvHeader is the column layout written by CSV exports
+var csvHeader = []string{"ip", "blocked_at", "blocked_until", "is_permanent", "request_count", "timeout_count", "source", "last_request_path"}
+
+// Export writes block records in the given format
+func Export(w io.Writer, blocks []storage.BlockStatus, format Format) error {
+	switch format {
+	case FormatText:
+		for _, status := range blocks {
+			if _, err := fmt.Fprintln(w, status.IP); err != nil {
+				return err
+			}
+		}
+		return nil
+
+	case FormatCSV:
+		writer := csv.NewWriter(w)
+		if err := writer.Write(csvHeader); err != nil {
+			return err
+		}
+		for _, status := range blocks {
+			until := ""
+			if !status.IsPermanent {
+				until = status.BlockedUntil.Format(time.RFC3339)
+			}
+			record := []string{
+				status.IP,
+				status.BlockedAt.Format(time.RFC3339),
+				until,
+				strconv.FormatBool(status.IsPermanent),
+				strconv.Itoa(status.RequestCount),
+				strconv.Itoa(status.TimeoutCount),
+				status.Source,
+				status.LastRequestPath,
+			}
+			if err := writer.Write(record); err != nil {
+				return err
+			}
+		}
+		writer.Flush()
+		return writer.Error()
+
+	case FormatNginx:
+		if _, err := fmt.Fprintln(w, "# Generated by whoen"); err != nil {
+			return err
+		}
+		for _, status := range blocks {
+			if _, err := fmt.Fprintf(w, "deny %s;\n", status.IP); err != nil {
+				return err
+			}
+		}
+		return nil
+
+	case FormatApache:
+		if _, err := fmt.Fprint(w, "# Generated by whoen\n<RequireAll>\n    Require all granted\n"); err != nil {
+			return err
+		}
+		for _, status := range blocks {
+			if _, err := fmt.Fprintf(w, "    Require not ip %s\n", status.IP); err != nil {
+				return err
+			}
+		}
+		_, err := fmt.Fprintln(w, "</RequireAll>")
+		return err
+
+	case FormatFail2ban, FormatCrowdSec:
+		return fmt.Errorf("blocklist format %s can only be imported", format)
+
+	default:
+		return fmt.Errorf("unknown blocklist format: %s", format)
+	}
+}
+
+// ExportStorage writes the active blocks in storage in the given format
+func ExportStorage(w io.Writer, store storage.Storage, format Format) error {
+	blocks, err := activeBlocks(store)
+	if err != nil {
+		return fmt.Errorf("failed to read blocked IPs: %w", err)
+	}
+	return Export(w, blocks, format)
+}
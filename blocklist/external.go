@@ -0,0 +1,202 @@
+package blocklist
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/headswim/whoen/storage"
+)
+
+// parseFail2ban reads the output of "fail2ban-client status <jail>". The
+// banned IPs are on the "Banned IP list:" line and tagged with the jail name.
+func parseFail2ban(r io.Reader) ([]Entry, error) {
+	var entries []Entry
+	jail := ""
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		text := scanner.Text()
+
+		// "Status for the jail: sshd" starts the output of each jail
+		if i := strings.Index(text, "Status for the jail:"); i >= 0 {
+			jail = strings.TrimSpace(text[i+len("Status for the jail:"):])
+			continue
+		}
+
+		i := strings.Index(text, "Banned IP list:")
+		if i < 0 {
+			continue
+		}
+		source := "fail2ban"
+		if jail != "" {
+			source += ":" + jail
+		}
+		for _, address := range strings.Fields(text[i+len("Banned IP list:"):]) {
+			ip, ok := normalizeAddress(address)
+			if !ok {
+				return nil, fmt.Errorf("line %d: invalid IP address or range %q", line, address)
+			}
+			entries = append(entries, Entry{IP: ip, Source: source})
+		}
+	}
+
+	return entries, scanner.Err()
+}
+
+// crowdSecDecision is a decision as returned by the CrowdSec local API
+type crowdSecDecision struct {
+	Type     string `json:"type"`
+	Scope    string `json:"scope"`
+	Value    string `json:"value"`
+	Duration string `json:"duration"`
+	Scenario string `json:"scenario"`
+}
+
+// parseCrowdSec reads CrowdSec decisions: a decision list from the local API
+// (GET /v1/decisions), a decision stream (GET /v1/decisions/stream, whose
+// "deleted" decisions become removals) or alerts from "cscli decisions list
+// -o json". Only ban decisions on IPs and ranges are imported.
+func parseCrowdSec(r io.Reader) ([]Entry, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	data = []byte(strings.TrimSpace(string(data)))
+	if len(data) == 0 || string(data) == "null" {
+		return nil, nil
+	}
+
+	var added, deleted []crowdSecDecision
+	if data[0] == '{' {
+		// Decision stream
+		var stream struct {
+			New     []crowdSecDecision `json:"new"`
+			Deleted []crowdSecDecision `json:"deleted"`
+		}
+		if err := json.Unmarshal(data, &stream); err != nil {
+			return nil, fmt.Errorf("invalid CrowdSec decision stream: %w", err)
+		}
+		added, deleted = stream.New, stream.Deleted
+	} else {
+		// Decision list, or alerts carrying their decisions
+		var items []struct {
+			crowdSecDecision
+			Decisions []crowdSecDecision `json:"decisions"`
+		}
+		if err := json.Unmarshal(data, &items); err != nil {
+			return nil, fmt.Errorf("invalid CrowdSec decisions: %w", err)
+		}
+		for _, item := range items {
+			if item.Decisions != nil {
+				added = append(added, item.Decisions...)
+			} else {
+				added = append(added, item.crowdSecDecision)
+			}
+		}
+	}
+
+	entries, err := crowdSecEntries(added, false)
+	if err != nil {
+		return nil, err
+	}
+	removed, err := crowdSecEntries(deleted, true)
+	if err != nil {
+		return nil, err
+	}
+	return append(entries, removed...), nil
+}
+
+// crowdSecEntries converts the ban decisions on IPs and ranges into entries,
+// marking them for removal when remove is set
+func crowdSecEntries(decisions []crowdSecDecision, remove bool) ([]Entry, error) {
+	now := time.Now()
+	var entries []Entry
+	for _, decision := range decisions {
+		if !strings.EqualFold(decision.Type, "ban") {
+			continue
+		}
+		if scope := strings.ToLower(decision.Scope); scope != "ip" && scope != "range" {
+			continue
+		}
+		ip, ok := normalizeAddress(decision.Value)
+		if !ok {
+			return nil, fmt.Errorf("invalid IP address or range %q in CrowdSec decision", decision.Value)
+		}
+
+		entry := Entry{IP: ip, Source: "crowdsec", Remove: remove}
+		if !remove && decision.Duration != "" {
+			duration, err := time.ParseDuration(decision.Duration)
+			if err != nil {
+				return nil, fmt.Errorf("invalid duration %q in CrowdSec decision for %s: %w", decision.Duration, ip, err)
+			}
+			entry.BlockedUntil = now.Add(duration)
+		}
+		entries = append(entries, entry)
+	}
+
+	return entries, nil
+}
+
+// CrowdSecStream pulls decisions from the stream endpoint of a CrowdSec local
+// API as a bouncer. The first pull fetches all active decisions, later pulls
+// only the decisions added or deleted since the previous one.
+type CrowdSecStream struct {
+	URL    string       // Base URL of the local API, e.g. http://127.0.0.1:8080
+	APIKey string       // Bouncer API key from "cscli bouncers add"
+	Client *http.Client // Defaults to a client with a 10 second timeout
+
+	mutex   sync.Mutex
+	started bool
+}
+
+// Pull fetches the decisions changed since the last pull and merges them into
+// storage like Import. It returns the number of blocks added, extended or lifted.
+func (c *CrowdSecStream) Pull(ctx context.Context, store storage.Storage, options ImportOptions) (int, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	startup := "false"
+	if !c.started {
+		startup = "true"
+	}
+	url := strings.TrimSuffix(c.URL, "/") + "/v1/decisions/stream?startup=" + startup
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("X-Api-Key", c.APIKey)
+
+	client := c.Client
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("failed to pull CrowdSec decisions: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("failed to pull CrowdSec decisions: %s", resp.Status)
+	}
+
+	entries, err := parseCrowdSec(resp.Body)
+	if err != nil {
+		return 0, err
+	}
+	imported, err := ImportEntries(store, entries, options)
+	if err != nil {
+		return imported, err
+	}
+
+	// Only ask for changes once the full set is in storage
+	c.started = true
+	return imported, nil
+}
@@ -0,0 +1,238 @@
+package blocklist
+
+import (
+	"bufio"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/headswim/whoen/storage"
+)
+
+// ImportOptions configures how imported entries are merged into storage
+type ImportOptions struct {
+	// Source tags every imported block, e.g. "spamhaus-drop". Entries that carry
+	// their own source (CSV) keep it when this is empty.
+	Source string
+
+	// Duration blocks imported entries for this long. Zero imports them as
+	// permanent blocks unless the entry carries its own expiry.
+	Duration time.Duration
+
+	// Skip is called for every entry and can exclude it, e.g. whitelisted IPs
+	Skip func(ip string) bool
+}
+
+// Parse reads blocklist entries in the given format. Invalid addresses are
+// reported with their line number.
+func Parse(r io.Reader, format Format) ([]Entry, error) {
+	switch format {
+	case FormatCSV:
+		return parseCSV(r)
+	case FormatFail2ban:
+		return parseFail2ban(r)
+	case FormatCrowdSec:
+		return parseCrowdSec(r)
+	case FormatText, FormatNginx, FormatApache:
+		return parseLines(r, format)
+	default:
+		return nil, fmt.Errorf("unknown blocklist format: %s", format)
+	}
+}
+
+// parseLines reads the line based formats
+func parseLines(r io.Reader, format Format) ([]Entry, error) {
+	var entries []Entry
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		// Strip comments; ';' ends nginx directives so it only starts comments in text lists
+		comments := "#"
+		if format == FormatText {
+			comments = "#;"
+		}
+		text := scanner.Text()
+		if i := strings.IndexAny(text, comments); i >= 0 {
+			text = text[:i]
+		}
+
+		fields := strings.Fields(text)
+		if len(fields) == 0 {
+			continue
+		}
+
+		var addresses []string
+		switch format {
+		case FormatText:
+			addresses = fields[:1]
+		case FormatNginx:
+			if fields[0] != "deny" || len(fields) < 2 {
+				continue
+			}
+			addresses = []string{strings.TrimSuffix(fields[1], ";")}
+		case FormatApache:
+			switch {
+			case len(fields) > 3 && strings.EqualFold(fields[0], "Require") && strings.EqualFold(fields[1], "not") && strings.EqualFold(fields[2], "ip"):
+				addresses = fields[3:]
+			case len(fields) > 2 && strings.EqualFold(fields[0], "Deny") && strings.EqualFold(fields[1], "from"):
+				addresses = fields[2:]
+			default:
+				continue
+			}
+		}
+
+		for _, address := range addresses {
+			ip, ok := normalizeAddress(address)
+			if !ok {
+				return nil, fmt.Errorf("line %d: invalid IP address or range %q", line, address)
+			}
+			entries = append(entries, Entry{IP: ip})
+		}
+	}
+
+	return entries, scanner.Err()
+}
+
+// parseCSV reads a CSV file with a header row
+func parseCSV(r io.Reader) ([]Entry, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+
+	header, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CSV header: %w", err)
+	}
+	columns := make(map[string]int, len(header))
+	for i, name := range header {
+		columns[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	if _, ok := columns["ip"]; !ok {
+		return nil, fmt.Errorf("CSV header has no ip column")
+	}
+
+	field := func(record []string, name string) string {
+		if i, ok := columns[name]; ok && i < len(record) {
+			return strings.TrimSpace(record[i])
+		}
+		return ""
+	}
+
+	var entries []Entry
+	for line := 2; ; line++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+
+		ip, ok := normalizeAddress(field(record, "ip"))
+		if !ok {
+			return nil, fmt.Errorf("line %d: invalid IP address or range %q", line, field(record, "ip"))
+		}
+		entry := Entry{IP: ip, Source: field(record, "source")}
+
+		if value := field(record, "is_permanent"); value != "" {
+			entry.IsPermanent, _ = strconv.ParseBool(value)
+		}
+		if value := field(record, "blocked_until"); value != "" && !entry.IsPermanent {
+			until, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: invalid blocked_until %q: %w", line, value, err)
+			}
+			entry.BlockedUntil = until
+		}
+
+		entries = append(entries, entry)
+	}
+
+	return entries, nil
+}
+
+// Import reads a blocklist and merges it into storage. Existing blocks are
+// only replaced when the imported block is stronger (permanent, or longer).
+// Entries marked for removal lift the block if it came from the same source.
+// It returns the number of blocks added, extended or lifted.
+func Import(store storage.Storage, r io.Reader, format Format, options ImportOptions) (int, error) {
+	entries, err := Parse(r, format)
+	if err != nil {
+		return 0, err
+	}
+	return ImportEntries(store, entries, options)
+}
+
+// ImportEntries merges parsed blocklist entries into storage like Import
+func ImportEntries(store storage.Storage, entries []Entry, options ImportOptions) (int, error) {
+	now := time.Now()
+	imported := 0
+	for _, entry := range entries {
+		if options.Skip != nil && options.Skip(entry.IP) {
+			continue
+		}
+
+		source := options.Source
+		if source == "" {
+			source = entry.Source
+		}
+
+		// Lift blocks the source itself has withdrawn, leaving blocks from
+		// anywhere else alone
+		if entry.Remove {
+			_, existing, err := store.IsIPBlocked(entry.IP)
+			if err != nil {
+				return imported, err
+			}
+			if existing == nil || existing.Source != source {
+				continue
+			}
+			if err := store.UnblockIP(entry.IP); err != nil {
+				return imported, err
+			}
+			imported++
+			continue
+		}
+
+		// Work out the block the entry asks for
+		permanent := entry.IsPermanent
+		until := entry.BlockedUntil
+		if !permanent && until.IsZero() {
+			if options.Duration > 0 {
+				until = now.Add(options.Duration)
+			} else {
+				permanent = true
+			}
+		}
+		if !permanent && !until.After(now) {
+			continue
+		}
+
+		// Merge with the existing record, never weakening an active block
+		blocked, existing, err := store.IsIPBlocked(entry.IP)
+		if err != nil {
+			return imported, err
+		}
+		status := storage.BlockStatus{IP: entry.IP, BlockedAt: now}
+		if existing != nil {
+			if blocked && (existing.IsPermanent || (!permanent && !until.After(existing.BlockedUntil))) {
+				continue
+			}
+			status = *existing
+		}
+		status.IsPermanent = permanent
+		status.BlockedUntil = until
+		if permanent {
+			status.BlockedUntil = time.Time{}
+		}
+		status.Source = source
+
+		if err := storage.PutBlock(store, status); err != nil {
+			return imported, err
+		}
+		imported++
+	}
+
+	return imported, nil
+}
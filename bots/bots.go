@@ -0,0 +1,347 @@
+// Package bots verifies that requests claiming to come from search engine
+// crawlers really do. A crawler such as Googlebot is recognized by its
+// User-Agent and confirmed by reverse DNS followed by a forward lookup, or by
+// the IP ranges its operator publishes, so good crawlers can be exempted from
+// blocking while impostors using their User-Agent are not.
+package bots
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/headswim/whoen/ipaddr"
+)
+
+// DefaultCacheTTL is how long a verification is remembered when a Verifier
+// has no CacheTTL of its own
+const DefaultCacheTTL = 24 * time.Hour
+
+// maxCacheSize bounds the verifications remembered, so impostors rotating
+// addresses cannot grow the cache without limit
+const maxCacheSize = 65536
+
+// maxRangesSize bounds the download of a published range list
+const maxRangesSize = 4 << 20
+
+// Bot is a crawler that can be verified
+type Bot struct {
+	Name      string         // Names the bot in logs, e.g. "Googlebot"
+	Tokens    []string       // User-Agent substrings claiming the bot, matched case-insensitively
+	Domains   []string       // Domains its reverse DNS names end in, verified by forward lookup
+	Ranges    []netip.Prefix // Ranges it crawls from
+	RangesURL string         // Published ranges in the JSON format of Google's googlebot.json
+}
+
+// Known returns the crawlers verified by default: Googlebot, Bingbot and
+// YandexBot by reverse DNS, Applebot by its published ranges
+func Known() []Bot {
+	return []Bot{
+		{
+			Name:    "Googlebot",
+			Tokens:  []string{"googlebot", "google-inspectiontool", "storebot-google", "adsbot-google", "mediapartners-google"},
+			Domains: []string{"googlebot.com", "google.com"},
+		},
+		{
+			Name:    "Bingbot",
+			Tokens:  []string{"bingbot", "adidxbot", "bingpreview", "msnbot"},
+			Domains: []string{"search.msn.com"},
+		},
+		{
+			Name:    "YandexBot",
+			Tokens:  []string{"yandexbot", "yandeximages", "yandexmobilebot"},
+			Domains: []string{"yandex.ru", "yandex.net", "yandex.com"},
+		},
+		{
+			Name:      "Applebot",
+			Tokens:    []string{"applebot"},
+			RangesURL: "https://search.developer.apple.com/applebot.json",
+		},
+	}
+}
+
+// Resolver looks up reverse and forward DNS; *net.Resolver implements it
+type Resolver interface {
+	LookupAddr(ctx context.Context, addr string) ([]string, error)
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+}
+
+// Result is the outcome of verifying a request
+type Result struct {
+	Bot      string // Bot the User-Agent claims to be, empty if none
+	Verified bool   // The IP belongs to the bot
+	Host     string // Reverse DNS name the IP was verified by, if any
+	Cached   bool   // The verification was remembered from an earlier request
+}
+
+// Verifier verifies requests claiming to be one of Bots and remembers the
+// outcome per IP for CacheTTL
+type Verifier struct {
+	Bots     []Bot
+	Resolver Resolver      // Defaults to net.DefaultResolver
+	Client   *http.Client  // Downloads RangesURL, defaults to a client with a 30 second timeout
+	CacheTTL time.Duration // DefaultCacheTTL if zero
+
+	mutex     sync.Mutex
+	cache     map[string]cached
+	published map[string][]netip.Prefix // Ranges downloaded from RangesURL, by bot name
+}
+
+// cached is a remembered verification
+type cached struct {
+	result Result
+	until  time.Time
+}
+
+// NewVerifier returns a verifier for bots
+func NewVerifier(bots []Bot) *Verifier {
+	return &Verifier{Bots: bots}
+}
+
+// Claimed returns the bot a User-Agent claims to be
+func (v *Verifier) Claimed(userAgent string) (Bot, bool) {
+	userAgent = strings.ToLower(userAgent)
+	for _, bot := range v.Bots {
+		for _, token := range bot.Tokens {
+			if token != "" && strings.Contains(userAgent, strings.ToLower(token)) {
+				return bot, true
+			}
+		}
+	}
+	return Bot{}, false
+}
+
+// Verify reports whether a request from ip with userAgent comes from the bot
+// the User-Agent claims to be. An IP is verified if it lies in the bot's
+// ranges, or if one of its reverse DNS names ends in one of the bot's domains
+// and resolves back to it. Outcomes are remembered for CacheTTL, except when
+// DNS fails for reasons other than a missing name, so a resolver outage does
+// not turn crawlers away for a day.
+func (v *Verifier) Verify(ctx context.Context, ip, userAgent string) Result {
+	bot, ok := v.Claimed(userAgent)
+	if !ok {
+		return Result{}
+	}
+
+	key := ip + " " + bot.Name
+	v.mutex.Lock()
+	entry, ok := v.cache[key]
+	v.mutex.Unlock()
+	if ok && time.Now().Before(entry.until) {
+		entry.result.Cached = true
+		return entry.result
+	}
+
+	result, err := v.verify(ctx, ip, bot)
+	if err == nil {
+		v.remember(key, result)
+	}
+	return result
+}
+
+// verify checks an IP against a bot's ranges and domains
+func (v *Verifier) verify(ctx context.Context, ip string, bot Bot) (Result, error) {
+	result := Result{Bot: bot.Name}
+	addr, err := ipaddr.Parse(ip)
+	if err != nil {
+		return result, nil
+	}
+
+	// Ranges first, they need no lookups
+	v.mutex.Lock()
+	ranges := append(append([]netip.Prefix(nil), bot.Ranges...), v.published[bot.Name]...)
+	v.mutex.Unlock()
+	for _, prefix := range ranges {
+		if prefix.Contains(addr) {
+			result.Verified = true
+			return result, nil
+		}
+	}
+	if len(bot.Domains) == 0 {
+		return result, nil
+	}
+
+	resolver := v.Resolver
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	names, err := resolver.LookupAddr(ctx, addr.String())
+	if err != nil {
+		return result, lookupError(err)
+	}
+	for _, name := range names {
+		name = strings.TrimSuffix(strings.ToLower(name), ".")
+		if !inDomains(name, bot.Domains) {
+			continue
+		}
+
+		// The name must resolve back to the IP, or anyone controlling the
+		// reverse zone of their addresses could claim it
+		addrs, err := resolver.LookupIPAddr(ctx, name)
+		if err != nil {
+			if err := lookupError(err); err != nil {
+				return result, err
+			}
+			continue
+		}
+		for _, resolved := range addrs {
+			if forward, ok := netip.AddrFromSlice(resolved.IP); ok && ipaddr.Canonical(forward) == addr {
+				result.Verified = true
+				result.Host = name
+				return result, nil
+			}
+		}
+	}
+	return result, nil
+}
+
+// inDomains reports whether a host name is one of domains or a subdomain
+func inDomains(name string, domains []string) bool {
+	for _, domain := range domains {
+		domain = strings.Trim(strings.ToLower(domain), ".")
+		if name == domain || strings.HasSuffix(name, "."+domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// lookupError returns nil for DNS errors that settle the verification, such
+// as a name that does not exist, and err for those that may pass
+func lookupError(err error) error {
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+		return nil
+	}
+	return err
+}
+
+// remember stores a verification for CacheTTL, dropping expired entries, or
+// all of them, when the cache is full
+func (v *Verifier) remember(key string, result Result) {
+	ttl := v.CacheTTL
+	if ttl <= 0 {
+		ttl = DefaultCacheTTL
+	}
+
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	if v.cache == nil {
+		v.cache = make(map[string]cached)
+	}
+	if len(v.cache) >= maxCacheSize {
+		v.prune()
+		if len(v.cache) >= maxCacheSize {
+			v.cache = make(map[string]cached)
+		}
+	}
+	v.cache[key] = cached{result: result, until: time.Now().Add(ttl)}
+}
+
+// Prune drops expired verifications
+func (v *Verifier) Prune() {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	v.prune()
+}
+
+// prune drops expired verifications. The caller must hold the lock.
+func (v *Verifier) prune() {
+	now := time.Now()
+	for key, entry := range v.cache {
+		if now.After(entry.until) {
+			delete(v.cache, key)
+		}
+	}
+}
+
+// RefreshRanges downloads the published ranges of the bots with a RangesURL.
+// A bot whose download fails keeps the ranges it had; the others are still
+// refreshed.
+func (v *Verifier) RefreshRanges(ctx context.Context) error {
+	var errs []error
+	for _, bot := range v.Bots {
+		if bot.RangesURL == "" {
+			continue
+		}
+		ranges, err := v.download(ctx, bot)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+
+		v.mutex.Lock()
+		if v.published == nil {
+			v.published = make(map[string][]netip.Prefix)
+		}
+		v.published[bot.Name] = ranges
+		v.mutex.Unlock()
+	}
+	return errors.Join(errs...)
+}
+
+// download fetches and parses the published ranges of a bot
+func (v *Verifier) download(ctx context.Context, bot Bot) ([]netip.Prefix, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, bot.RangesURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	client := v.Client
+	if client == nil {
+		client = &http.Client{Timeout: 30 * time.Second}
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to download ranges of %s: %w", bot.Name, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to download ranges of %s: %s", bot.Name, resp.Status)
+	}
+
+	ranges, err := ParseRanges(io.LimitReader(resp.Body, maxRangesSize))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse ranges of %s: %w", bot.Name, err)
+	}
+	if len(ranges) == 0 {
+		return nil, fmt.Errorf("ranges of %s are empty", bot.Name)
+	}
+	return ranges, nil
+}
+
+// ParseRanges reads a range list in the JSON format Google, Bing and Apple
+// publish their crawler ranges in: {"prefixes": [{"ipv4Prefix": "..."},
+// {"ipv6Prefix": "..."}]}
+func ParseRanges(r io.Reader) ([]netip.Prefix, error) {
+	var list struct {
+		Prefixes []struct {
+			IPv4 string `json:"ipv4Prefix"`
+			IPv6 string `json:"ipv6Prefix"`
+		} `json:"prefixes"`
+	}
+	if err := json.NewDecoder(r).Decode(&list); err != nil {
+		return nil, err
+	}
+
+	ranges := make([]netip.Prefix, 0, len(list.Prefixes))
+	for _, entry := range list.Prefixes {
+		value := entry.IPv4
+		if value == "" {
+			value = entry.IPv6
+		}
+		prefix, err := ipaddr.ParsePrefix(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid prefix %q", value)
+		}
+		ranges = append(ranges, prefix)
+	}
+	return ranges, nil
+}
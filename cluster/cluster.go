@@ -0,0 +1,110 @@
+// Package cluster propagates block and unblock decisions between whoen
+// instances. Any pub/sub system (Redis, NATS, ...) can carry the messages by
+// implementing the two-method Transport interface.
+package cluster
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// Message types
+const (
+	MessageBlock   = "block"
+	MessageUnblock = "unblock"
+)
+
+// Message is a block or unblock decision published by a node
+type Message struct {
+	Type        string    `json:"type"`
+	Node        string    `json:"node"` // ID of the publishing node
+	IP          string    `json:"ip"`
+	Until       time.Time `json:"until,omitempty"` // Expiry of a temporary block
+	IsPermanent bool      `json:"is_permanent,omitempty"`
+	Path        string    `json:"path,omitempty"`
+	Source      string    `json:"source,omitempty"`
+	Reason      string    `json:"reason,omitempty"`   // Why an operator made a manual block
+	Operator    string    `json:"operator,omitempty"` // Who made a manual block
+	Time        time.Time `json:"time"`
+}
+
+// Transport publishes messages to, and receives messages from, the other nodes
+type Transport interface {
+	// Publish sends a message to all nodes, including the publisher
+	Publish(ctx context.Context, msg Message) error
+
+	// Subscribe calls handler for every message until ctx is cancelled or the
+	// subscription fails. It blocks while subscribed.
+	Subscribe(ctx context.Context, handler func(Message)) error
+}
+
+// Encode serializes a message for transports that carry bytes
+func Encode(msg Message) ([]byte, error) {
+	return json.Marshal(msg)
+}
+
+// Decode deserializes a message encoded with Encode
+func Decode(data []byte) (Message, error) {
+	var msg Message
+	if err := json.Unmarshal(data, &msg); err != nil {
+		return msg, fmt.Errorf("invalid cluster message: %w", err)
+	}
+	return msg, nil
+}
+
+// DefaultNodeID returns an ID that is unique per process on a host
+func DefaultNodeID() string {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+	return fmt.Sprintf("%s-%d", host, os.Getpid())
+}
+
+// MemoryBus is an in-process Transport, useful to share decisions between
+// several middleware instances in one process
+type MemoryBus struct {
+	mutex       sync.RWMutex
+	subscribers map[int]func(Message)
+	next        int
+}
+
+// NewMemoryBus creates a MemoryBus
+func NewMemoryBus() *MemoryBus {
+	return &MemoryBus{subscribers: make(map[int]func(Message))}
+}
+
+// Publish delivers a message to every subscriber
+func (b *MemoryBus) Publish(ctx context.Context, msg Message) error {
+	b.mutex.RLock()
+	handlers := make([]func(Message), 0, len(b.subscribers))
+	for _, handler := range b.subscribers {
+		handlers = append(handlers, handler)
+	}
+	b.mutex.RUnlock()
+
+	for _, handler := range handlers {
+		handler(msg)
+	}
+	return nil
+}
+
+// Subscribe registers handler until ctx is cancelled
+func (b *MemoryBus) Subscribe(ctx context.Context, handler func(Message)) error {
+	b.mutex.Lock()
+	id := b.next
+	b.next++
+	b.subscribers[id] = handler
+	b.mutex.Unlock()
+
+	<-ctx.Done()
+
+	b.mutex.Lock()
+	delete(b.subscribers, id)
+	b.mutex.Unlock()
+	return nil
+}
@@ -0,0 +1,147 @@
+// Command whoen-proxy runs whoen as a reverse proxy in front of any HTTP
+// backend, so applications written in other languages get the same detection
+// and OS-level blocking without code changes. Requests that pass whoen are
+// forwarded to the upstream with X-Forwarded-For set to the client's IP.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/headswim/whoen"
+	"github.com/headswim/whoen/config"
+	"github.com/headswim/whoen/middleware"
+)
+
+// shutdownTimeout is how long in-flight requests get to finish on shutdown
+const shutdownTimeout = 15 * time.Second
+
+func main() {
+	flags := flag.NewFlagSet("whoen-proxy", flag.ExitOnError)
+	listen := flags.String("listen", ":8080", "address to accept client connections on")
+	upstream := flags.String("upstream", "", "URL of the backend to forward requests to, e.g. http://127.0.0.1:3000")
+	configFile := flags.String("config", "", "JSON or YAML configuration file; WHOEN_* environment variables are read either way")
+	dir := flags.String("dir", "", "storage directory, overriding the configuration")
+	trustForwarded := flags.Bool("trust-forwarded", false, "take the client IP from X-Forwarded-For and X-Real-IP, for a proxy behind a load balancer")
+	healthPath := flags.String("health-path", "", "path answering the whoen health check, e.g. /.whoen/health; off if empty")
+	adminPath := flags.String("admin-path", "", "path prefix of the signed admin API, e.g. /.whoen/admin/; needs admin_secret, off if empty")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: whoen-proxy -upstream <url> [flags]\n\nFlags:\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(os.Args[1:])
+
+	if *upstream == "" {
+		flags.Usage()
+		os.Exit(2)
+	}
+	target, err := url.Parse(*upstream)
+	if err != nil || target.Scheme == "" || target.Host == "" {
+		fatalf("invalid upstream URL %q", *upstream)
+	}
+
+	cfg, err := loadConfig(*configFile, *dir)
+	if err != nil {
+		fatalf("%v", err)
+	}
+	if *adminPath != "" && cfg.AdminSecret == "" {
+		fatalf("-admin-path needs admin_secret to be configured")
+	}
+
+	m, err := whoen.NewWithConfig(cfg)
+	if err != nil {
+		fatalf("failed to start whoen: %v", err)
+	}
+
+	server := &http.Server{
+		Addr:              *listen,
+		Handler:           newHandler(m.Middleware, target, *trustForwarded, *healthPath, *adminPath),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	// Stop accepting connections on SIGINT or SIGTERM and let in-flight
+	// requests finish
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		server.Shutdown(shutdownCtx)
+	}()
+
+	fmt.Fprintf(os.Stderr, "whoen-proxy: forwarding %s to %s\n", *listen, target)
+	err = server.ListenAndServe()
+	if closeErr := m.Close(); closeErr != nil {
+		fmt.Fprintf(os.Stderr, "whoen-proxy: failed to close whoen: %v\n", closeErr)
+	}
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		fatalf("%v", err)
+	}
+}
+
+// loadConfig reads the configuration from a file if one is given, from the
+// environment otherwise, and moves the storage to dir if it is set
+func loadConfig(file, dir string) (config.Config, error) {
+	var cfg config.Config
+	var err error
+	if file != "" {
+		cfg, err = config.LoadFromFile(file)
+	} else {
+		cfg, err = config.LoadFromEnv()
+	}
+	if err != nil {
+		return cfg, err
+	}
+
+	if dir != "" {
+		cfg = cfg.WithStorageDir(dir)
+		config.ValidateConfig(&cfg)
+	}
+	return cfg, nil
+}
+
+// newHandler returns the handler that runs whoen on every request and
+// forwards the ones it lets through to target
+func newHandler(m *middleware.Middleware, target *url.URL, trustForwarded bool, healthPath, adminPath string) http.Handler {
+	// NewSingleHostReverseProxy appends the client's address to X-Forwarded-For
+	proxy := httputil.NewSingleHostReverseProxy(target)
+	proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+		fmt.Fprintf(os.Stderr, "whoen-proxy: upstream request %s %s failed: %v\n", r.Method, r.URL.Path, err)
+		w.WriteHeader(http.StatusBadGateway)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/", m.HTTP().Handler(proxy))
+	if healthPath != "" {
+		mux.Handle(healthPath, m.HealthHandler())
+	}
+	if adminPath != "" {
+		mux.Handle(adminPath, http.StripPrefix(adminPath, m.AdminHandler()))
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Clients talk to the proxy directly, so headers naming another
+		// client IP are forged unless a trusted load balancer set them
+		if !trustForwarded {
+			r.Header.Del("X-Forwarded-For")
+			r.Header.Del("X-Real-IP")
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+// fatalf prints an error and exits
+func fatalf(format string, args ...any) {
+	fmt.Fprintf(os.Stderr, "whoen-proxy: "+format+"\n", args...)
+	os.Exit(1)
+}
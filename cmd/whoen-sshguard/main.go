@@ -0,0 +1,125 @@
+// Command whoen-sshguard protects SSH the way whoen protects web
+// applications: it follows sshd's log, counts failed logins and scanners per
+// IP and blocks offenders in the firewall, sharing the storage, grace period
+// and timeouts of the whoen configuration it runs with. With -log - it reads
+// log lines from standard input instead, e.g. from journalctl -f.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/headswim/whoen"
+	"github.com/headswim/whoen/config"
+	"github.com/headswim/whoen/sshguard"
+)
+
+// authLogs are the usual locations of sshd's log, tried in order
+var authLogs = []string{"/var/log/auth.log", "/var/log/secure", "/var/log/system.log"}
+
+func main() {
+	flags := flag.NewFlagSet("whoen-sshguard", flag.ExitOnError)
+	logFile := flags.String("log", "", "sshd log file to follow, or - for standard input; defaults to the first of "+fmt.Sprint(authLogs)+" that exists")
+	configFile := flags.String("config", "", "JSON or YAML configuration file; WHOEN_* environment variables are read either way")
+	dir := flags.String("dir", "", "storage directory, overriding the configuration")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: whoen-sshguard [flags]\n\nFlags:\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(os.Args[1:])
+
+	cfg, err := loadConfig(*configFile, *dir)
+	if err != nil {
+		fatalf("%v", err)
+	}
+
+	path := *logFile
+	if path == "" {
+		if path = cfg.SSHAuthLog; path == "" {
+			path = findAuthLog()
+		}
+	}
+	if path == "" {
+		fatalf("no sshd log found, pass one with -log")
+	}
+	if path == "-" {
+		cfg.SSHAuthLog = ""
+	} else {
+		cfg.SSHAuthLog = path
+	}
+
+	m, err := whoen.NewWithConfig(cfg)
+	if err != nil {
+		fatalf("failed to start whoen: %v", err)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if path == "-" {
+		// Read standard input until it ends or a signal arrives
+		fmt.Fprintf(os.Stderr, "whoen-sshguard: reading sshd log lines from standard input\n")
+		done := make(chan error, 1)
+		go func() {
+			done <- sshguard.Scan(os.Stdin, func(event sshguard.Event) {
+				m.Middleware.ReportSSH(event)
+			})
+		}()
+		select {
+		case err = <-done:
+		case <-ctx.Done():
+		}
+	} else {
+		// The middleware follows the log until it is closed
+		fmt.Fprintf(os.Stderr, "whoen-sshguard: following %s\n", path)
+		<-ctx.Done()
+	}
+
+	if closeErr := m.Close(); closeErr != nil {
+		fmt.Fprintf(os.Stderr, "whoen-sshguard: failed to close whoen: %v\n", closeErr)
+	}
+	if err != nil {
+		fatalf("failed to read standard input: %v", err)
+	}
+}
+
+// loadConfig reads the configuration from a file if one is given, from the
+// environment otherwise, and moves the storage to dir if it is set
+func loadConfig(file, dir string) (config.Config, error) {
+	var cfg config.Config
+	var err error
+	if file != "" {
+		cfg, err = config.LoadFromFile(file)
+	} else {
+		cfg, err = config.LoadFromEnv()
+	}
+	if err != nil {
+		return cfg, err
+	}
+
+	if dir != "" {
+		cfg = cfg.WithStorageDir(dir)
+		config.ValidateConfig(&cfg)
+	}
+	return cfg, nil
+}
+
+// findAuthLog returns the first of authLogs that exists, or an empty string
+func findAuthLog() string {
+	for _, path := range authLogs {
+		if _, err := os.Stat(path); err == nil {
+			return path
+		}
+	}
+	return ""
+}
+
+// fatalf prints an error and exits
+func fatalf(format string, args ...any) {
+	fmt.Fprintf(os.Stderr, "whoen-sshguard: "+format+"\n", args...)
+	os.Exit(1)
+}
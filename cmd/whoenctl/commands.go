@@ -0,0 +1,475 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/headswim/whoen/audit"
+	"github.com/headswim/whoen/blocklist"
+	"github.com/headswim/whoen/dryrun"
+	"github.com/headswim/whoen/stats"
+	"github.com/headswim/whoen/storage"
+)
+
+// runList prints the active blocks, or every block record with -all
+func runList(ctl *ctl, args []string) error {
+	flags := flag.NewFlagSet("list", flag.ExitOnError)
+	all := flags.Bool("all", false, "include expired blocks kept as history")
+	flags.Parse(args)
+
+	blockedIPs, err := ctl.storage.GetBlockedIPs()
+	if err != nil {
+		return err
+	}
+	sort.Slice(blockedIPs, func(i, j int) bool {
+		return blockedIPs[i].BlockedAt.Before(blockedIPs[j].BlockedAt)
+	})
+
+	now := time.Now()
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "IP\tBLOCKED AT\tUNTIL\tREQUESTS\tSOURCE\tLAST PATH\tOPERATOR\tREASON")
+	for _, status := range blockedIPs {
+		expired := !status.IsPermanent && now.After(status.BlockedUntil)
+		if expired && !*all {
+			continue
+		}
+
+		until := "permanent"
+		if !status.IsPermanent {
+			until = status.BlockedUntil.Format(time.RFC3339)
+			if expired {
+				until += " (expired)"
+			}
+		}
+		source := status.Source
+		if source == "" {
+			source = "detection"
+		}
+
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%s\t%s\t%s\t%s\n", status.IP, status.BlockedAt.Format(time.RFC3339),
+			until, status.RequestCount, source, status.LastRequestPath, status.Operator, status.Reason)
+	}
+	return w.Flush()
+}
+
+// runBlock blocks an IP in storage
+func runBlock(ctl *ctl, args []string) error {
+	flags := flag.NewFlagSet("block", flag.ExitOnError)
+	duration := flags.Duration("duration", 0, "block duration, permanent if 0")
+	reason := flags.String("reason", "", "reason recorded with the block and in the audit log")
+	flags.Parse(args)
+
+	ip, err := ipArg(flags)
+	if err != nil {
+		return err
+	}
+
+	until := time.Time{}
+	if *duration > 0 {
+		until = time.Now().Add(*duration)
+	}
+
+	// Record the block as a manual one, keeping the counts of an earlier record
+	previous := ctl.state(ip)
+	_, status, err := ctl.storage.IsIPBlocked(ip)
+	if err != nil {
+		return err
+	}
+	record := storage.BlockStatus{IP: ip, BlockedAt: time.Now()}
+	if status != nil {
+		record = *status
+	}
+	record.BlockedUntil = until
+	record.IsPermanent = *duration == 0
+	record.LastRequestPath = ""
+	record.Source = "admin"
+	record.Reason = *reason
+	record.Operator = ctl.actor
+	if err := storage.PutBlock(ctl.storage, record); err != nil {
+		return err
+	}
+
+	if *duration == 0 {
+		fmt.Printf("Blocked %s permanently\n", ip)
+	} else {
+		fmt.Printf("Blocked %s until %s\n", ip, until.Format(time.RFC3339))
+	}
+	return ctl.record(audit.ActionBlock, ip, *reason, previous)
+}
+
+// runUnblock removes the block on an IP and resets its request count
+func runUnblock(ctl *ctl, args []string) error {
+	flags := flag.NewFlagSet("unblock", flag.ExitOnError)
+	reason := flags.String("reason", "", "reason recorded in the audit log")
+	flags.Parse(args)
+
+	ip, err := ipArg(flags)
+	if err != nil {
+		return err
+	}
+
+	previous := ctl.state(ip)
+	if err := ctl.storage.UnblockIP(ip); err != nil {
+		return err
+	}
+	if err := ctl.storage.ResetRequestCount(ip); err != nil {
+		return err
+	}
+
+	fmt.Printf("Unblocked %s\n", ip)
+	return ctl.record(audit.ActionUnblock, ip, *reason, previous)
+}
+
+// runWhitelist adds an IP to the whitelist file, or removes it with -remove
+func runWhitelist(ctl *ctl, args []string) error {
+	flags := flag.NewFlagSet("whitelist", flag.ExitOnError)
+	remove := flags.Bool("remove", false, "remove the IP from the whitelist")
+	reason := flags.String("reason", "", "reason recorded in the audit log")
+	flags.Parse(args)
+
+	ip, err := ipArg(flags)
+	if err != nil {
+		return err
+	}
+
+	previous := ctl.state(ip)
+	if *remove {
+		if err := storage.RemoveFromWhitelistFile(ctl.config.WhitelistFile, ip); err != nil {
+			return err
+		}
+		fmt.Printf("Removed %s from the whitelist\n", ip)
+		return ctl.record(audit.ActionWhitelistRemove, ip, *reason, previous)
+	}
+
+	if err := storage.AddToWhitelistFile(ctl.config.WhitelistFile, ip); err != nil {
+		return err
+	}
+	fmt.Printf("Whitelisted %s\n", ip)
+	return ctl.record(audit.ActionWhitelistAdd, ip, *reason, previous)
+}
+
+// runReview lists the permanent bans older than -age, or expires them all with -expire
+func runReview(ctl *ctl, args []string) error {
+	flags := flag.NewFlagSet("review", flag.ExitOnError)
+	age := flags.Duration("age", 365*24*time.Hour, "minimum age of the permanent bans to review")
+	expire := flags.Bool("expire", false, "lift every listed ban")
+	reason := flags.String("reason", "", "reason recorded in the audit log")
+	flags.Parse(args)
+
+	queue, err := storage.PermanentBansOlderThan(ctl.storage, *age)
+	if err != nil {
+		return err
+	}
+	sort.Slice(queue, func(i, j int) bool {
+		return queue[i].BlockedAt.Before(queue[j].BlockedAt)
+	})
+
+	if !*expire {
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "IP\tBANNED AT\tREQUESTS\tSOURCE\tLAST PATH")
+		for _, status := range queue {
+			fmt.Fprintf(w, "%s\t%s\t%d\t%s\t%s\n", status.IP, status.BlockedAt.Format(time.RFC3339),
+				status.RequestCount, status.Source, status.LastRequestPath)
+		}
+		return w.Flush()
+	}
+
+	expired := 0
+	for _, status := range queue {
+		previous := ctl.state(status.IP)
+		ok, err := storage.ExpireBan(ctl.storage, status.IP)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+		expired++
+		if err := ctl.record(audit.ActionExpire, status.IP, *reason, previous); err != nil {
+			return err
+		}
+	}
+
+	fmt.Printf("Expired %d permanent bans older than %v\n", expired, *age)
+	return nil
+}
+
+// runStats prints the storage location and the number of records in it
+func runStats(ctl *ctl, args []string) error {
+	blockedIPs, err := ctl.storage.GetBlockedIPs()
+	if err != nil {
+		return err
+	}
+	requestCounts, err := ctl.storage.GetAllRequestCounts()
+	if err != nil {
+		return err
+	}
+	whitelist, err := storage.ReadWhitelist(ctl.config.WhitelistFile)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	var permanent, temporary, expired int
+	for _, status := range blockedIPs {
+		switch {
+		case status.IsPermanent:
+			permanent++
+		case now.After(status.BlockedUntil):
+			expired++
+		default:
+			temporary++
+		}
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "Storage directory:\t%s\n", ctl.config.StorageDir)
+	fmt.Fprintf(w, "Permanent blocks:\t%d\n", permanent)
+	fmt.Fprintf(w, "Temporary blocks:\t%d\n", temporary)
+	fmt.Fprintf(w, "Expired (history):\t%d\n", expired)
+	fmt.Fprintf(w, "Request counters:\t%d\n", len(requestCounts))
+	fmt.Fprintf(w, "Whitelisted IPs:\t%d\n", len(whitelist))
+	return w.Flush()
+}
+
+// runReport prints what whoen is being attacked with and by whom
+func runReport(ctl *ctl, args []string) error {
+	flags := flag.NewFlagSet("report", flag.ExitOnError)
+	top := flags.Int("top", stats.DefaultTop, "length of the top lists")
+	flags.Parse(args)
+
+	report, err := stats.Build(ctl.storage, stats.Options{Top: *top})
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "Active blocks:\t%d (%d permanent)\n", report.ActiveBlocks, report.PermanentBans)
+	fmt.Fprintf(w, "Malicious requests:\t%d from %d tracked IPs\n", report.MaliciousRequests, report.TrackedIPs)
+	if report.TimeToBlockSamples > 0 {
+		fmt.Fprintf(w, "Average time to block:\t%v over %d blocks\n", report.AverageTimeToBlock.Round(time.Second), report.TimeToBlockSamples)
+	}
+	var lastDay, lastMonth int
+	for _, bucket := range report.BlocksPerHour {
+		lastDay += bucket.Blocks
+	}
+	for _, bucket := range report.BlocksPerDay {
+		lastMonth += bucket.Blocks
+	}
+	fmt.Fprintf(w, "New blocks:\t%d in the last 24 hours, %d in the last 30 days\n", lastDay, lastMonth)
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	fmt.Println()
+	w = tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "PATH\tIPS")
+	for _, path := range report.TopPaths {
+		fmt.Fprintf(w, "%s\t%d\n", path.Key, path.Count)
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	fmt.Println()
+	w = tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "IP\tREQUESTS\tSCORE\tBLOCKED\tLAST PATH")
+	for _, ip := range report.TopIPs {
+		blocked := "no"
+		if ip.Permanent {
+			blocked = "permanent"
+		} else if ip.Blocked {
+			blocked = "yes"
+		}
+		fmt.Fprintf(w, "%s\t%d\t%d\t%s\t%s\n", ip.IP, ip.Requests, ip.Score, blocked, ip.LastPath)
+	}
+	return w.Flush()
+}
+
+// runDryRun summarizes the dry-run dataset against the traffic that was served
+func runDryRun(ctl *ctl, args []string) error {
+	flags := flag.NewFlagSet("dryrun", flag.ExitOnError)
+	top := flags.Int("top", 20, "number of IPs to list")
+	flags.Parse(args)
+
+	records, err := dryrun.ReadFile(ctl.config.DryRunFile)
+	if err != nil {
+		return err
+	}
+	report := dryrun.Summarize(records)
+	if report.Decisions == 0 && report.WouldReject == 0 {
+		fmt.Printf("No dry-run records in %s\n", ctl.config.DryRunFile)
+		return nil
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "Period:\t%s to %s\n", report.From.Format(time.RFC3339), report.To.Format(time.RFC3339))
+	fmt.Fprintf(w, "Would-be blocks:\t%d (%d permanent) of %d IPs\n", report.Decisions, report.PermanentBans, report.IPs)
+	fmt.Fprintf(w, "Served requests a block would have rejected:\t%d\n", report.WouldReject)
+	fmt.Fprintf(w, "  to malicious paths:\t%d\n", report.WouldRejectMalicious)
+	fmt.Fprintf(w, "  to other paths:\t%d from %d IPs\n", report.WouldRejectOther, report.IPsWithOtherTraffic)
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	fmt.Println()
+	w = tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "IP\tBLOCKS\tBLOCKED FOR\tREJECTED\tOTHER\tOTHER PATHS")
+	for i, ip := range report.ByIP {
+		if i == *top {
+			break
+		}
+		blockedFor := ip.BlockedFor.String()
+		if ip.Permanent {
+			blockedFor = "permanent"
+		}
+		fmt.Fprintf(w, "%s\t%d\t%s\t%d\t%d\t%s\n", ip.IP, ip.Decisions, blockedFor,
+			ip.WouldReject, ip.WouldRejectOther, strings.Join(ip.OtherPaths, " "))
+	}
+	return w.Flush()
+}
+
+// runImport merges the blocks of a blocklist file, or stdin for "-", into storage
+func runImport(ctl *ctl, args []string) error {
+	flags := flag.NewFlagSet("import", flag.ExitOnError)
+	format := flags.String("format", "text", "format of the input: text, csv, nginx, apache, fail2ban or crowdsec")
+	source := flags.String("source", "", "source recorded on the imported blocks")
+	duration := flags.Duration("duration", 0, "block entries without an expiry for this long, permanently if zero")
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		return fmt.Errorf("expected exactly one file, got %d arguments", flags.NArg())
+	}
+	f, err := blocklist.ParseFormat(*format)
+	if err != nil {
+		return err
+	}
+
+	input := os.Stdin
+	if name := flags.Arg(0); name != "-" {
+		file, err := os.Open(name)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		input = file
+	}
+
+	// Never block whitelisted IPs
+	whitelist, err := storage.ReadWhitelist(ctl.config.WhitelistFile)
+	if err != nil {
+		return err
+	}
+	whitelisted := make(map[string]bool, len(whitelist))
+	for _, ip := range whitelist {
+		whitelisted[ip] = true
+	}
+
+	imported, err := blocklist.Import(ctl.storage, input, f, blocklist.ImportOptions{
+		Source:   *source,
+		Duration: *duration,
+		Skip:     func(ip string) bool { return whitelisted[ip] },
+	})
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Imported %d blocks\n", imported)
+	reason := fmt.Sprintf("%s blocklist %s", *format, flags.Arg(0))
+	if *source != "" {
+		reason += " from " + *source
+	}
+	return ctl.recordCount(audit.ActionImport, reason, imported)
+}
+
+// runCleanup removes expired blocks and stale request counters from storage
+func runCleanup(ctl *ctl, args []string) error {
+	before, err := ctl.storage.GetBlockedIPs()
+	if err != nil {
+		return err
+	}
+	if err := ctl.storage.CleanupExpired(); err != nil {
+		return err
+	}
+	after, err := ctl.storage.GetBlockedIPs()
+	if err != nil {
+		return err
+	}
+
+	removed := len(before) - len(after)
+	fmt.Printf("Removed %d expired blocks\n", removed)
+	if removed == 0 {
+		return nil
+	}
+	return ctl.recordCount(audit.ActionCleanup, "", removed)
+}
+
+// ipArg returns the single IP argument of a subcommand
+func ipArg(flags *flag.FlagSet) (string, error) {
+	if flags.NArg() != 1 {
+		return "", fmt.Errorf("expected exactly one IP, got %d arguments", flags.NArg())
+	}
+	return flags.Arg(0), nil
+}
+
+// state captures the current state of an IP for the audit log
+func (c *ctl) state(ip string) *audit.State {
+	state := &audit.State{}
+
+	if whitelist, err := storage.ReadWhitelist(c.config.WhitelistFile); err == nil {
+		for _, entry := range whitelist {
+			if entry == ip {
+				state.Whitelisted = true
+				break
+			}
+		}
+	}
+
+	if blocked, status, err := c.storage.IsIPBlocked(ip); err == nil && blocked && status != nil {
+		state.Blocked = true
+		state.IsPermanent = status.IsPermanent
+		if !status.IsPermanent {
+			state.BlockedUntil = status.BlockedUntil
+		}
+	}
+	return state
+}
+
+// record writes an audit entry for a completed action
+func (c *ctl) record(action, ip, reason string, previous *audit.State) error {
+	entry := audit.Entry{
+		Time:     time.Now(),
+		Actor:    c.actor,
+		Action:   action,
+		IP:       ip,
+		Reason:   reason,
+		Previous: previous,
+		Current:  c.state(ip),
+	}
+
+	if err := c.audit.Log(entry); err != nil {
+		return fmt.Errorf("%s of IP %s succeeded but could not be audited: %w", action, ip, err)
+	}
+	return nil
+}
+
+// recordCount writes an audit entry for a completed action on count IPs
+func (c *ctl) recordCount(action, reason string, count int) error {
+	entry := audit.Entry{
+		Time:   time.Now(),
+		Actor:  c.actor,
+		Action: action,
+		Reason: reason,
+		Count:  count,
+	}
+
+	if err := c.audit.Log(entry); err != nil {
+		return fmt.Errorf("%s of %d IPs succeeded but could not be audited: %w", action, count, err)
+	}
+	return nil
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+
+	"github.com/headswim/whoen/matcher"
+)
+
+// runLintPatterns lints the patterns an application would run with: its
+// Patterns or the built-in ones, its patterns file and allow patterns, and
+// any patterns files given. It fails when there are warnings, so it can
+// guard pattern changes in CI.
+func runLintPatterns(ctl *ctl, args []string) error {
+	flags := flag.NewFlagSet("lint-patterns", flag.ExitOnError)
+	configFile := flags.String("config", "", "configuration file with the application's patterns")
+	flags.Parse(args)
+
+	cfg, err := appConfig(*configFile)
+	if err != nil {
+		return err
+	}
+
+	// Build the rule set the way the middleware does
+	service := matcher.NewService()
+	if len(cfg.Patterns) > 0 {
+		service.ReplacePatterns(cfg.Patterns)
+	}
+	if cfg.PatternsFile != "" {
+		patterns, err := matcher.ReadPatternsFile(cfg.PatternsFile)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		service.AddPatterns(patterns...)
+	}
+	for _, path := range flags.Args() {
+		patterns, err := matcher.ReadPatternsFile(path)
+		if err != nil {
+			return err
+		}
+		service.AddPatterns(patterns...)
+	}
+	service.SetAllowPatterns(cfg.AllowPatterns)
+
+	warnings := service.Lint()
+	for _, warning := range warnings {
+		fmt.Println(warning)
+	}
+	if len(warnings) > 0 {
+		return fmt.Errorf("%d pattern warnings", len(warnings))
+	}
+	return nil
+}
@@ -0,0 +1,134 @@
+// Command whoenctl manages the blocks and whitelist of a whoen installation
+// from the command line. It works on the same storage files as the
+// middleware; a running middleware enforces the changes at its next sync.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"os/user"
+
+	"github.com/headswim/whoen/audit"
+	"github.com/headswim/whoen/config"
+	"github.com/headswim/whoen/storage"
+)
+
+// command is a whoenctl subcommand
+type command struct {
+	name    string
+	usage   string
+	summary string
+	run     func(ctl *ctl, args []string) error
+}
+
+// commands lists the subcommands in the order they are shown in the usage
+var commands = []command{
+	{"list", "list [-all]", "List blocked IPs", runList},
+	{"block", "block [-duration d] [-reason r] <ip>", "Block an IP, permanently without -duration", runBlock},
+	{"unblock", "unblock [-reason r] <ip>", "Unblock an IP and reset its request count", runUnblock},
+	{"whitelist", "whitelist [-remove] [-reason r] <ip>", "Add an IP to the whitelist, or remove it", runWhitelist},
+	{"review", "review [-age d] [-expire] [-reason r]", "List old permanent bans, or lift them with -expire", runReview},
+	{"stats", "stats", "Show storage location and counts", runStats},
+	{"report", "report [-top n]", "Report top attacked paths and offenders, and blocks over time", runReport},
+	{"import", "import -format f [-source s] [-duration d] <file|->", "Import blocks from a blocklist, fail2ban or CrowdSec", runImport},
+	{"dryrun", "dryrun [-top n]", "Report the blocks a dry run would have made", runDryRun},
+	{"cleanup", "cleanup", "Remove expired blocks and stale request counters", runCleanup},
+	{"restore", "restore [-config file]", "Apply the active blocks to the OS firewall, e.g. at boot", runRestore},
+	{"reconcile", "reconcile [-config file]", "Apply missing firewall rules and remove orphaned ones", runReconcile},
+	{"systemd-unit", "systemd-unit [-config file]", "Print a systemd unit that restores blocks at boot", runSystemdUnit},
+	{"lint-patterns", "lint-patterns [-config file] [file...]", "Report duplicate, shadowed and conflicting patterns", runLintPatterns},
+	{"migrate", "migrate [-reverse] [-prefix p] <url|file>", "Copy blocks and counters to Valkey, memcached or JSON, or back", runMigrate},
+}
+
+// ctl holds what the subcommands work on
+type ctl struct {
+	config  config.Config
+	storage storage.Storage
+	audit   audit.Logger
+	actor   string
+}
+
+func main() {
+	flags := flag.NewFlagSet("whoenctl", flag.ExitOnError)
+	dir := flags.String("dir", config.DefaultStorageDir(), "storage directory of the whoen installation")
+	actor := flags.String("actor", defaultActor(), "name recorded in the audit log")
+	flags.Usage = func() { usage(flags) }
+	flags.Parse(os.Args[1:])
+
+	if flags.NArg() == 0 {
+		usage(flags)
+		os.Exit(2)
+	}
+
+	name, args := flags.Arg(0), flags.Args()[1:]
+	for _, cmd := range commands {
+		if cmd.name != name {
+			continue
+		}
+
+		ctl, err := newCtl(*dir, *actor)
+		if err != nil {
+			fatalf("%v", err)
+		}
+		err = cmd.run(ctl, args)
+		if closeErr := ctl.storage.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			fatalf("%s: %v", name, err)
+		}
+		return
+	}
+
+	fmt.Fprintf(os.Stderr, "whoenctl: unknown command %q\n\n", name)
+	usage(flags)
+	os.Exit(2)
+}
+
+// newCtl opens the storage of the installation in dir
+func newCtl(dir, actor string) (*ctl, error) {
+	cfg := config.DefaultConfig().WithStorageDir(dir)
+	config.ValidateConfig(&cfg)
+
+	store, err := storage.NewJSONStorageWithOptions(cfg.BlockedIPsFile, storage.JSONOptions{
+		HistoryRetention:   cfg.HistoryRetention,
+		HistoryPolicy:      cfg.HistoryPolicy,
+		ArchiveFile:        cfg.HistoryArchiveFile,
+		MaxRequestCounters: cfg.MaxTrackedIPs,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open storage in %s: %w", dir, err)
+	}
+
+	return &ctl{
+		config:  cfg,
+		storage: store,
+		audit:   audit.NewFileLogger(cfg.AuditLogFile),
+		actor:   actor,
+	}, nil
+}
+
+// defaultActor returns "cli:" followed by the name of the current user
+func defaultActor() string {
+	if u, err := user.Current(); err == nil {
+		return "cli:" + u.Username
+	}
+	return "cli"
+}
+
+// usage prints the global flags and the subcommands
+func usage(flags *flag.FlagSet) {
+	fmt.Fprintf(os.Stderr, "Usage: whoenctl [flags] <command> [args]\n\nCommands:\n")
+	for _, cmd := range commands {
+		fmt.Fprintf(os.Stderr, "  %-40s %s\n", cmd.usage, cmd.summary)
+	}
+	fmt.Fprintf(os.Stderr, "\nFlags:\n")
+	flags.PrintDefaults()
+}
+
+// fatalf prints an error and exits
+func fatalf(format string, args ...any) {
+	fmt.Fprintf(os.Stderr, "whoenctl: "+format+"\n", args...)
+	os.Exit(1)
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/headswim/whoen/audit"
+	"github.com/headswim/whoen/kv"
+	"github.com/headswim/whoen/storage"
+)
+
+// runMigrate copies the blocks and request counters of the installation to
+// another storage backend, or from it with -reverse
+func runMigrate(ctl *ctl, args []string) error {
+	flags := flag.NewFlagSet("migrate", flag.ExitOnError)
+	reverse := flags.Bool("reverse", false, "copy from the target into the installation's JSON storage instead")
+	prefix := flags.String("prefix", storage.DefaultKVPrefix, "key prefix on Valkey and memcached")
+	counterTTL := flags.Duration("counter-ttl", storage.DefaultCounterTTL, "how long request counters are kept on Valkey and memcached")
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		return fmt.Errorf("expected exactly one target, got %d arguments", flags.NArg())
+	}
+	target := flags.Arg(0)
+
+	other, err := openTarget(ctl, target, storage.KVOptions{
+		Prefix:           *prefix,
+		CounterTTL:       *counterTTL,
+		HistoryRetention: ctl.config.HistoryRetention,
+	})
+	if err != nil {
+		return err
+	}
+	defer other.Close()
+
+	src, dst, direction := ctl.storage, other, "to"
+	if *reverse {
+		src, dst, direction = other, ctl.storage, "from"
+	}
+	result, err := storage.Migrate(src, dst)
+	if err != nil {
+		return fmt.Errorf("migrated %d blocks and %d request counters before failing: %w", result.Blocks, result.Counters, err)
+	}
+
+	fmt.Printf("Migrated %d blocks and %d request counters %s %s\n", result.Blocks, result.Counters, direction, redact(target))
+	return ctl.recordCount(audit.ActionMigrate, direction+" "+redact(target), result.Blocks)
+}
+
+// openTarget opens the storage a migration copies to or from: a Valkey or
+// Redis server given as valkey://[user:password@]host:port[/db] (or redis://),
+// a memcached server given as memcached://host:port, or a JSON blocked IPs
+// file given as a path
+func openTarget(ctl *ctl, target string, options storage.KVOptions) (storage.Storage, error) {
+	scheme, _, found := strings.Cut(target, "://")
+	if !found {
+		path := strings.TrimPrefix(target, "json:")
+		store, err := storage.NewJSONStorageWithOptions(path, storage.JSONOptions{
+			HistoryRetention:   ctl.config.HistoryRetention,
+			HistoryPolicy:      ctl.config.HistoryPolicy,
+			MaxRequestCounters: ctl.config.MaxTrackedIPs,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to open JSON storage %s: %w", path, err)
+		}
+		return store, nil
+	}
+
+	u, err := url.Parse(target)
+	if err != nil {
+		return nil, fmt.Errorf("invalid target: %w", err)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("target %s has no host", redact(target))
+	}
+
+	var store kv.Store
+	switch scheme {
+	case "valkey", "redis":
+		opts := kv.Options{Username: u.User.Username()}
+		opts.Password, _ = u.User.Password()
+		// A user without a password is the password, like redis-cli's URLs
+		if opts.Password == "" && opts.Username != "" {
+			opts.Password, opts.Username = opts.Username, ""
+		}
+		if opts.Password == "" {
+			opts.Password = os.Getenv("VALKEY_PASSWORD")
+		}
+		if db := strings.Trim(u.Path, "/"); db != "" {
+			if opts.DB, err = strconv.Atoi(db); err != nil {
+				return nil, fmt.Errorf("invalid database %q in target", db)
+			}
+		}
+		store = kv.NewValkey(u.Host, opts)
+	case "memcached":
+		store = kv.NewMemcached(u.Host, kv.Options{})
+	default:
+		return nil, fmt.Errorf("unsupported target scheme %q, use valkey://, redis://, memcached:// or a JSON file path", scheme)
+	}
+
+	// Fail early on an unreachable server rather than halfway through
+	kvStorage := storage.NewKVStorage(store, options)
+	if _, _, err := store.Get(options.Prefix + "ping"); err != nil {
+		kvStorage.Close()
+		return nil, fmt.Errorf("failed to reach %s: %w", redact(target), err)
+	}
+	return kvStorage, nil
+}
+
+// redact removes the password from a target URL, for output and the audit log
+func redact(target string) string {
+	u, err := url.Parse(target)
+	if err != nil || u.User == nil {
+		return target
+	}
+	return u.Redacted()
+}
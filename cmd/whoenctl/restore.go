@@ -0,0 +1,157 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/headswim/whoen/blocker"
+	"github.com/headswim/whoen/config"
+	"github.com/headswim/whoen/middleware"
+)
+
+// runRestore applies the active blocks in storage to the OS firewall, e.g.
+// at boot before the application starts, since iptables rules and pf tables
+// do not survive a reboot
+func runRestore(ctl *ctl, args []string) error {
+	flags := flag.NewFlagSet("restore", flag.ExitOnError)
+	configFile := flags.String("config", "", "configuration file with the application's firewall settings")
+	flags.Parse(args)
+
+	cfg, err := appConfig(*configFile)
+	if err != nil {
+		return err
+	}
+	if !cfg.EnforceFirewall {
+		return fmt.Errorf("firewall enforcement is disabled in the configuration")
+	}
+
+	blocks, err := storedBlocks(ctl)
+	if err != nil {
+		return err
+	}
+
+	// The blocker skips expired blocks and reports the counts
+	svc := blocker.NewServiceWithOptions(systemType(cfg), middleware.BlockerOptions(cfg))
+	return svc.RestoreBlocks(blocks)
+}
+
+// runReconcile reads whoen's rules in the OS firewall and brings them in line
+// with the active blocks in storage, applying missing rules and removing
+// orphaned ones
+func runReconcile(ctl *ctl, args []string) error {
+	flags := flag.NewFlagSet("reconcile", flag.ExitOnError)
+	configFile := flags.String("config", "", "configuration file with the application's firewall settings")
+	flags.Parse(args)
+
+	cfg, err := appConfig(*configFile)
+	if err != nil {
+		return err
+	}
+	if !cfg.EnforceFirewall {
+		return fmt.Errorf("firewall enforcement is disabled in the configuration")
+	}
+
+	blocks, err := storedBlocks(ctl)
+	if err != nil {
+		return err
+	}
+
+	// Expired blocks are left out, so their rules count as orphaned
+	svc := blocker.NewServiceWithOptions(systemType(cfg), middleware.BlockerOptions(cfg))
+	result, err := svc.Reconcile(blocks)
+	for _, ip := range result.Added {
+		fmt.Printf("applied\t%s\n", ip)
+	}
+	for _, ip := range result.Removed {
+		fmt.Printf("removed\t%s\n", ip)
+	}
+	return err
+}
+
+// storedBlocks returns the blocks in storage by IP and expiration time, zero
+// for permanent blocks
+func storedBlocks(ctl *ctl) (map[string]time.Time, error) {
+	blockedIPs, err := ctl.storage.GetBlockedIPs()
+	if err != nil {
+		return nil, err
+	}
+	blocks := make(map[string]time.Time, len(blockedIPs))
+	for _, status := range blockedIPs {
+		if status.IsPermanent {
+			blocks[status.IP] = time.Time{}
+		} else {
+			blocks[status.IP] = status.BlockedUntil
+		}
+	}
+	return blocks, nil
+}
+
+// runSystemdUnit prints a systemd unit that runs whoenctl restore at boot,
+// before the network comes up
+func runSystemdUnit(ctl *ctl, args []string) error {
+	flags := flag.NewFlagSet("systemd-unit", flag.ExitOnError)
+	configFile := flags.String("config", "", "configuration file passed on to whoenctl restore")
+	flags.Parse(args)
+
+	executable, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("failed to find the whoenctl executable: %w", err)
+	}
+
+	command := []string{executable, "-dir", ctl.config.StorageDir, "restore"}
+	if *configFile != "" {
+		path, err := filepath.Abs(*configFile)
+		if err != nil {
+			return err
+		}
+		command = append(command, "-config", path)
+	}
+
+	fmt.Printf(`[Unit]
+Description=Restore whoen firewall blocks
+Documentation=https://github.com/headswim/whoen
+DefaultDependencies=no
+After=local-fs.target firewalld.service
+Wants=network-pre.target
+Before=network-pre.target
+
+[Service]
+Type=oneshot
+ExecStart=%s
+RemainAfterExit=yes
+
+[Install]
+WantedBy=multi-user.target
+`, strings.Join(command, " "))
+	return nil
+}
+
+// appConfig returns the application's configuration, such as its firewall
+// settings and patterns: a configuration file if given, and WHOEN_*
+// environment variables
+func appConfig(path string) (config.Config, error) {
+	if path != "" {
+		return config.LoadFromFile(path)
+	}
+	return config.LoadFromEnv()
+}
+
+// systemType returns the configured system type, or the running one
+func systemType(cfg config.Config) string {
+	if cfg.SystemType != "" {
+		return cfg.SystemType
+	}
+	switch runtime.GOOS {
+	case "darwin":
+		return "mac"
+	case "windows":
+		return "windows"
+	default:
+		return "linux"
+	}
+}
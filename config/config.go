@@ -2,6 +2,7 @@ package config
 
 import (
 	"path/filepath"
+	"strings"
 	"time"
 )
 
@@ -17,25 +18,413 @@ type Config struct {
 	CleanupEnabled  bool          `json:"cleanup_enabled"`
 	CleanupInterval time.Duration `json:"cleanup_interval"`
 	StorageDir      string        `json:"storage_dir"`
+	AuditLogFile    string        `json:"audit_log_file"`  // Append-only log of operator actions and block decisions
+	WhitelistFile   string        `json:"whitelist_file"`  // IPs whitelisted at runtime, one per line
+	PatternsFile    string        `json:"patterns_file"`   // Extra malicious path patterns, one per line
+	HotReload       bool          `json:"hot_reload"`      // Reload the patterns and whitelist files when they change
+	MaxTrackedIPs   int           `json:"max_tracked_ips"` // Cap on IPs with a request counter, 0 for no limit
+	MaxBlockedIPs   int           `json:"max_blocked_ips"` // Cap on active blocks, the soonest to expire are lifted beyond it, 0 for no limit
+	NodeID          string        `json:"node_id"`         // Identifies this instance in cluster sync, defaults to host-pid
+
+	// ScoreThreshold switches blocking from request counts to severity scores:
+	// each malicious request adds its pattern's weight to the IP's score and the
+	// IP is blocked once the score reaches the threshold. Zero uses GracePeriod.
+	ScoreThreshold int `json:"score_threshold"`
+
+	// BlockExtension extends a temporary block by this amount every time the
+	// blocked IP requests a malicious path while still blocked. Zero disables it.
+	BlockExtension time.Duration `json:"block_extension"`
+
+	// MaxTimeouts makes the next block of an IP that has already been timed
+	// out this many times a permanent ban, so repeat offenders stop coming
+	// back. Zero keeps timing them out.
+	MaxTimeouts int `json:"max_timeouts"`
+
+	// MaxTimeoutDuration caps timeouts grown by TimeoutIncrease, which would
+	// otherwise grow without bound. Zero leaves them uncapped, up to the
+	// longest duration time.Duration can hold.
+	MaxTimeoutDuration time.Duration `json:"max_timeout_duration"`
+
+	// ProbationPeriod puts an IP on probation for this long once a timeout
+	// expires, instead of letting it start over. On probation the IP is
+	// blocked again after more than ProbationGracePeriod malicious requests,
+	// for ProbationMultiplier times the timeout it would otherwise get. Zero
+	// disables probation.
+	ProbationPeriod      time.Duration `json:"probation_period"`
+	ProbationGracePeriod int           `json:"probation_grace_period"`
+	ProbationMultiplier  int           `json:"probation_multiplier"`
+
+	// RedemptionRequests and RedemptionQuiet let an IP work off the malicious
+	// requests on its record, so counts don't pile up into a block over
+	// weeks: its request count drops by one for every RedemptionRequests
+	// legitimate requests it sends and for every RedemptionQuiet it goes
+	// without a malicious request, its score by their average weight. Quiet
+	// time is checked on cleanup. Zero disables either.
+	RedemptionRequests int           `json:"redemption_requests"`
+	RedemptionQuiet    time.Duration `json:"redemption_quiet"`
+
+	// DeceiveEnabled serves fake responses from Decoys for malicious paths
+	// instead of a 403, while still counting and blocking the IP
+	DeceiveEnabled bool             `json:"deceive_enabled"`
+	Decoys         map[string]Decoy `json:"decoys"`
+
+	// InspectQuery also checks query parameters against the SQL injection and
+	// path traversal signatures in matcher.Signatures. InspectBodyLimit checks
+	// that many bytes at the start of textual POST, PUT and PATCH bodies as
+	// well, along with the query; zero leaves bodies alone.
+	InspectQuery     bool `json:"inspect_query"`
+	InspectBodyLimit int  `json:"inspect_body_limit"`
+
+	// ChallengeEnabled challenges an IP that reaches the grace period or score
+	// threshold before blocking it, sparing the other clients behind a shared
+	// NAT address. Requests from a challenged IP get the page in
+	// ChallengeTemplate (a built-in JavaScript proof of work if empty) until
+	// the client solves it, and the IP is blocked if it reaches the threshold
+	// again while challenged. Challenges and solved challenges last
+	// ChallengeDuration. ChallengeSecret signs the cookies of solved
+	// challenges; use the same one on every instance.
+	ChallengeEnabled    bool          `json:"challenge_enabled"`
+	ChallengeTemplate   string        `json:"challenge_template"`
+	ChallengeDuration   time.Duration `json:"challenge_duration"`
+	ChallengeSecret     string        `json:"challenge_secret"`
+	ChallengeDifficulty int           `json:"challenge_difficulty"` // Leading zero hex digits of the proof of work
+
+	// AppealEnabled lets clients blocked by detection ask for their block to
+	// be lifted, for legitimate users caught behind a shared address such as
+	// a carrier-grade NAT. The block page offers a form; with
+	// Options.AppealSender the client is sent a signed link, e.g. by email,
+	// and opening it lifts the block and whitelists the IP for
+	// AppealWhitelist. Without a sender the client must solve a challenge,
+	// and the appeal only lifts the block. Each IP is granted one appeal per
+	// AppealCooldown, kept in storage. Links are valid for AppealTokenTTL,
+	// work once and are signed with AppealSecret; use the same one on every
+	// instance. Clients blocked in the OS firewall cannot reach the form, see
+	// FirewallTimeouts.
+	AppealEnabled   bool          `json:"appeal_enabled"`
+	AppealSecret    string        `json:"appeal_secret"`
+	AppealTokenTTL  time.Duration `json:"appeal_token_ttl"`
+	AppealWhitelist time.Duration `json:"appeal_whitelist"`
+	AppealCooldown  time.Duration `json:"appeal_cooldown"`
+
+	// BlockPageTemplate is an html/template file for the page blocked browsers
+	// get, instead of the built-in one
+	BlockPageTemplate string `json:"block_page_template"`
+
+	// AttackThreshold is the number of blocks within AttackWindow at which the
+	// middleware reports that it is under attack, through the attack events
+	// and a degraded status from its pressure endpoint. Zero disables it.
+	AttackThreshold int           `json:"attack_threshold"`
+	AttackWindow    time.Duration `json:"attack_window"`
+
+	// AdminSecret signs requests to the admin API served by AdminHandler,
+	// which is disabled without it. Requests signed more than AdminMaxSkew
+	// ago or ahead are rejected, as are replays within that window.
+	// IdempotencyKeyTTL is how long the response to a request with an
+	// Idempotency-Key is kept for retries.
+	AdminSecret       string        `json:"admin_secret"`
+	AdminMaxSkew      time.Duration `json:"admin_max_skew"`
+	IdempotencyKeyTTL time.Duration `json:"idempotency_key_ttl"`
+
+	// AdminUIUser and AdminUIPassword protect the web dashboard served by
+	// AdminUIHandler with basic auth. AdminUIToken lets scripts and proxies
+	// in with an "Authorization: Bearer" header instead, and is accepted as
+	// the basic auth password too. The dashboard is disabled without either.
+	AdminUIUser     string `json:"admin_ui_user"`
+	AdminUIPassword string `json:"admin_ui_password"`
+	AdminUIToken    string `json:"admin_ui_token"`
+
+	// LogFile is rotated once it reaches LogMaxSize megabytes and, with
+	// LogRotateEvery set, at the start of every period of that length, e.g.
+	// 24h rotates at midnight UTC. LogMaxBackups rotated files are kept, none
+	// older than LogMaxAge, and LogCompress gzips them. Zero disables each limit.
+	LogMaxSize     int           `json:"log_max_size"`
+	LogRotateEvery time.Duration `json:"log_rotate_every"`
+	LogMaxBackups  int           `json:"log_max_backups"`
+	LogMaxAge      time.Duration `json:"log_max_age"`
+	LogCompress    bool          `json:"log_compress"`
+
+	// HistoryRetention keeps an IP's offense history after its block expires
+	// until it has been quiet this long; HistoryPolicy ("archive" or "drop")
+	// decides what happens afterwards. Zero removes expired blocks right away.
+	HistoryRetention   time.Duration `json:"history_retention"`
+	HistoryPolicy      string        `json:"history_policy"`
+	HistoryArchiveFile string        `json:"history_archive_file"`
+
+	// PermanentBanReviewAge surfaces permanent bans older than this for review
+	// at every cleanup, since address space gets reassigned over the years.
+	// Zero disables the review.
+	PermanentBanReviewAge time.Duration `json:"permanent_ban_review_age"`
+
+	// EdgeSyncInterval is how often blocklist changes are sent to the edge
+	// provider set in the middleware options; EdgeFullSyncInterval is how often
+	// the provider's full list is reconciled instead
+	EdgeSyncInterval     time.Duration `json:"edge_sync_interval"`
+	EdgeFullSyncInterval time.Duration `json:"edge_full_sync_interval"`
+
+	// AbuseIPDBKey and GreyNoiseKey turn on the threat intelligence providers
+	// of package intel, which look up the reputation of every new block and
+	// store it with the block. With IntelReport, blocks made for malicious
+	// requests are also reported to AbuseIPDB, with the path as evidence.
+	AbuseIPDBKey string `json:"abuseipdb_key"`
+	GreyNoiseKey string `json:"greynoise_key"`
+	IntelReport  bool   `json:"intel_report"`
+
+	// Feeds subscribes to external blocklists, each a feed name of package
+	// feeds (firehol_level1, et_block, et_compromised) or the URL of a plain
+	// IP list. Every FeedRefreshInterval the feeds are downloaded and their
+	// entries blocked for FeedTTL, and blocks of entries that dropped out of a
+	// feed are lifted. Whitelisted IPs and private ranges are skipped.
+	Feeds               []string      `json:"feeds"`
+	FeedRefreshInterval time.Duration `json:"feed_refresh_interval"`
+	FeedTTL             time.Duration `json:"feed_ttl"`
+
+	// BlockASNs rejects every request from the autonomous systems listed,
+	// such as bulletproof hosters, and ExemptASNs lets every request from
+	// those listed through unchecked, like the whitelist, such as corporate
+	// egress. AS numbers are written "AS13335" or "13335". Both are checked
+	// after the whitelist and before the per-IP pipeline, and need
+	// ASNDatabase, an ip2asn TSV file from iptoasn.com, or Options.ASNLookup.
+	ASNDatabase string   `json:"asn_database"`
+	BlockASNs   []string `json:"block_asns"`
+	ExemptASNs  []string `json:"exempt_asns"`
+
+	// ExemptVerifiedBots lets requests from search engine crawlers such as
+	// Googlebot and Bingbot through unchecked, like the whitelist, once their
+	// IP is verified by reverse and forward DNS or the crawler's published
+	// ranges. Requests that only claim to be a crawler in their User-Agent
+	// are checked as usual. VerifiedBotCacheTTL is how long a verification
+	// is remembered per IP.
+	ExemptVerifiedBots  bool          `json:"exempt_verified_bots"`
+	VerifiedBotCacheTTL time.Duration `json:"verified_bot_cache_ttl"`
+
+	// DeferBudget is the time a request must have left before its context
+	// deadline for storage updates and firewall changes to run inline. With
+	// less time left they run in the background and the request is decided
+	// from cached state, so whoen never causes a request timeout.
+	DeferBudget time.Duration `json:"defer_budget"`
+
+	// PersistMode decides when storage changes reach disk: "batched" saves
+	// FlushInterval after the first unsaved change (and right away for block
+	// changes with SyncOnBlock), "immediate" writes every change, "interval"
+	// saves every PersistInterval, "on-shutdown" saves only when the
+	// middleware is closed and "memory" never saves
+	PersistMode     string        `json:"persist_mode"`
+	PersistInterval time.Duration `json:"persist_interval"`
+	FlushInterval   time.Duration `json:"flush_interval"`
+	SyncOnBlock     bool          `json:"sync_on_block"`
+
+	// DryRun evaluates requests without rejecting them or changing the
+	// firewall. Blocks whoen would have made, and the served requests they
+	// would have rejected, are recorded in DryRunFile for review.
+	DryRun     bool   `json:"dry_run"`
+	DryRunFile string `json:"dry_run_file"`
+
+	// Ramp turns enforcement on gradually: each stage switches a share of
+	// client IPs to log-only, soft-block or os-block mode at a set time after
+	// RampStart (the middleware's start time if zero). No stages means full
+	// enforcement. DryRun takes precedence over the ramp.
+	Ramp      []RampStage `json:"ramp"`
+	RampStart time.Time   `json:"ramp_start"`
+
+	// PolicyWindows vary enforcement by time: while a window is open, its
+	// overrides replace the grace period, score threshold, timeout duration
+	// or permanent bans. When windows overlap, the first open one applies. A
+	// lockdown takes precedence over every window.
+	PolicyWindows []PolicyWindow `json:"policy_windows"`
+
+	// Patterns and Whitelist give the instance its own malicious path
+	// patterns and whitelisted IPs and ranges, replacing the package-level
+	// matcher.Patterns and matcher.Whitelist every instance follows by
+	// default, e.g. to run a different policy per virtual host. The patterns
+	// and whitelist files still add to them.
+	Patterns  []string `json:"patterns"`
+	Whitelist []string `json:"whitelist"`
+
+	// WhitelistPrivateNetworks adds matcher.PrivateNetworks, the private
+	// (RFC 1918 and IPv6 unique local), link-local and loopback ranges, to
+	// the whitelist, so health checkers and service meshes scraping /metrics
+	// or /debug/pprof never get the host blocked from its own
+	// infrastructure. Only enable it where client IPs are extracted
+	// correctly behind proxies, or every proxied request looks internal.
+	WhitelistPrivateNetworks bool `json:"whitelist_private_networks"`
+
+	// AllowPatterns lists path prefixes the application legitimately serves,
+	// such as /admin for its logged-in users, so the built-in patterns don't
+	// block real traffic. A path matching one is not malicious unless a longer
+	// malicious pattern matches it too. Query and body signatures still apply.
+	AllowPatterns []string `json:"allow_patterns"`
+
+	// KnownRouteWeight and UnknownRouteWeight scale the score of a pattern
+	// match, in percent, by whether the application serves the path, once its
+	// routes are registered with Middleware.RegisterRoutes. A hit on a path
+	// the application serves is likelier a false positive and never blocks
+	// instantly; a hit on a path nothing serves is a probe. Scores only
+	// decide blocking with ScoreThreshold.
+	KnownRouteWeight   int `json:"known_route_weight"`
+	UnknownRouteWeight int `json:"unknown_route_weight"`
+
+	// RequestRules count repeated requests toward blocking by method, path and
+	// response status, e.g. POSTs to a login form or a burst of 404s, see
+	// RequestRule
+	RequestRules []RequestRule `json:"request_rules"`
+
+	// ScannerDetection counts the 404, 401 and 403 responses of each IP. An
+	// IP that gets more than ScannerThreshold of them within ScannerWindow is
+	// treated as a scanner enumerating paths, and each further one counts as
+	// a malicious request. ScannerStatuses replaces the status codes counted.
+	ScannerDetection bool          `json:"scanner_detection"`
+	ScannerThreshold int           `json:"scanner_threshold"`
+	ScannerWindow    time.Duration `json:"scanner_window"`
+	ScannerStatuses  []int         `json:"scanner_statuses"`
+
+	// Feature flags for risky behaviors. EnforceFirewall applies blocks to the
+	// OS firewall; without it blocked IPs are only rejected by the middleware.
+	// BlockOutbound also drops outgoing connections to blocked IPs, EnablePF
+	// turns on pf on macOS if it is off, and SubnetEscalation blocks a whole
+	// subnet once enough of its IPs are blocked, see SubnetThreshold. Only
+	// EnforceFirewall is on by default.
+	EnforceFirewall  bool `json:"enforce_firewall"`
+	BlockOutbound    bool `json:"block_outbound"`
+	EnablePF         bool `json:"enable_pf"`
+	SubnetEscalation bool `json:"subnet_escalation"`
+
+	// With EnforceFirewall, FirewallTimeouts and FirewallBans choose which
+	// blocks go to the OS firewall. Both are on by default. Blocks kept out
+	// of it are only rejected by the middleware, so turning FirewallTimeouts
+	// off spares the firewall the churn of many short-lived rules while
+	// permanent bans still go to the kernel.
+	FirewallTimeouts bool `json:"firewall_timeouts"`
+	FirewallBans     bool `json:"firewall_bans"`
+
+	// With SubnetEscalation, SubnetThreshold IPs of the same subnet blocked
+	// within SubnetWindow get the subnet blocked as one aggregated block. The
+	// subnet is the /SubnetPrefixIPv4 or /SubnetPrefixIPv6 range around the
+	// IPs; aggregation never goes wider than /16 for IPv4 or /32 for IPv6.
+	SubnetThreshold  int           `json:"subnet_threshold"`
+	SubnetWindow     time.Duration `json:"subnet_window"`
+	SubnetPrefixIPv4 int           `json:"subnet_prefix_ipv4"`
+	SubnetPrefixIPv6 int           `json:"subnet_prefix_ipv6"`
+
+	// FirewallBackend selects how blocks reach the OS firewall. On Linux:
+	// "iptables" (the default), or "firewalld" for hosts whose firewall is
+	// managed by firewalld, which wipes raw iptables rules on reload. On
+	// Windows: "netsh" (the default), or "netfirewall" for NetSecurity
+	// PowerShell rules applied in batches. "auto" uses firewalld when it is
+	// running and NetSecurity when it is available.
+	FirewallBackend string `json:"firewall_backend"`
+
+	// FirewallPrivilege selects how firewall commands on Linux and macOS gain
+	// root: "auto" (the default) runs them directly as root and through sudo
+	// otherwise, "none" always runs them directly (as root or with
+	// CAP_NET_ADMIN as an ambient capability), "sudo" and "doas" never prompt
+	// for a password, and any other value is a wrapper command line that runs
+	// the firewall command appended to it
+	FirewallPrivilege string `json:"firewall_privilege"`
+
+	// RuleCheckInterval is how often whoen verifies that its firewall rules
+	// still exist, re-applying the ones another tool or an administrator
+	// removed. Zero disables the check.
+	RuleCheckInterval time.Duration `json:"rule_check_interval"`
+
+	// FirewallRetries is how often a firewall command that failed with a
+	// transient error, such as iptables lock contention or a busy pf device,
+	// is tried again, waiting FirewallRetryBackoff and then twice as long each
+	// time. Changes that still fail are queued and retried at every cleanup.
+	FirewallRetries      int           `json:"firewall_retries"`
+	FirewallRetryBackoff time.Duration `json:"firewall_retry_backoff"`
+
+	// SSHAuthLog is sshd's log file, e.g. /var/log/auth.log or
+	// /var/log/secure, followed for failed SSH logins and scanners. Each one
+	// counts like a malicious request from its IP with a score of SSHWeight,
+	// so the grace period, score threshold and timeouts apply and the IP is
+	// blocked in the firewall for SSH as for HTTP. Empty turns it off.
+	SSHAuthLog string `json:"ssh_auth_log"`
+	SSHWeight  int    `json:"ssh_weight"`
+
+	// LogSink writes detections, blocks, unblocks and notable events with
+	// structured fields to "syslog" (RFC 5424) or "journald", in addition to
+	// the text log. SyslogAddress is the syslog daemon, "udp://host:514",
+	// "tcp://host:601" or "unix:///path", the local one if empty. Empty
+	// turns the sink off.
+	LogSink       string `json:"log_sink"`
+	SyslogAddress string `json:"syslog_address"`
+
+	// SIEMFormat renders the same events as ArcSight CEF ("cef") or IBM LEEF
+	// ("leef") records. They are appended to SIEMFile, or written to standard
+	// output if it is "-", and become the message text of syslog messages
+	// when LogSink is "syslog". SIEMFile without a format writes CEF.
+	SIEMFormat string `json:"siem_format"`
+	SIEMFile   string `json:"siem_file"`
+
+	// Strict makes NewWithConfig, LoadFromFile and LoadFromEnv fail with the
+	// problems Validate finds, instead of ValidateConfig correcting them
+	Strict bool `json:"strict"`
 }
 
 // DefaultConfig returns a configuration with sensible defaults
 func DefaultConfig() Config {
-	// Use the current directory for storage
+	// Use the platform's state directory for storage, see DefaultStorageDir
 	// Make sure the application has write permissions to this directory
-	storageDir := getDefaultStorageDir()
+	storageDir := DefaultStorageDir()
 
 	return Config{
-		BlockedIPsFile:  filepath.Join(storageDir, "blocked_ips.json"),
-		GracePeriod:     3,                                      // Default to 3 requests before blocking
-		TimeoutEnabled:  true,                                   // Enable timeout
-		TimeoutDuration: 24 * time.Hour,                         // Timeout duration must be set if timeout is enabled
-		TimeoutIncrease: "linear",                               // Timeout increase type (linear / geometric)
-		LogFile:         filepath.Join(storageDir, "whoen.log"), // where the log file is located
-		SystemType:      "",                                     // Auto-detected in whoen.go
-		CleanupEnabled:  true,                                   // Enable cleanup by default
-		CleanupInterval: 1 * time.Hour,                          // Run cleanup every hour
-		StorageDir:      storageDir,                             // Store the directory for future reference
+		BlockedIPsFile:       filepath.Join(storageDir, "blocked_ips.json"),
+		GracePeriod:          3,                                          // Default to 3 requests before blocking
+		TimeoutEnabled:       true,                                       // Enable timeout
+		TimeoutDuration:      24 * time.Hour,                             // Timeout duration must be set if timeout is enabled
+		TimeoutIncrease:      "linear",                                   // Timeout increase type (linear / geometric)
+		LogFile:              filepath.Join(storageDir, "whoen.log"),     // where the log file is located
+		LogMaxSize:           100,                                        // Rotate the log file at 100 MB
+		LogMaxBackups:        7,                                          // Keep the last seven rotated log files
+		LogMaxAge:            30 * 24 * time.Hour,                        // Remove rotated log files after 30 days
+		LogCompress:          true,                                       // Gzip rotated log files
+		SystemType:           "",                                         // Auto-detected in whoen.go
+		CleanupEnabled:       true,                                       // Enable cleanup by default
+		CleanupInterval:      1 * time.Hour,                              // Run cleanup every hour
+		StorageDir:           storageDir,                                 // Store the directory for future reference
+		AuditLogFile:         filepath.Join(storageDir, "audit.jsonl"),   // where operator actions are recorded
+		WhitelistFile:        filepath.Join(storageDir, "whitelist.txt"), // where runtime whitelist changes are kept
+		HotReload:            true,                                       // Pick up changes to the patterns and whitelist files
+		HistoryPolicy:        "archive",                                  // Archive history once retention passes
+		MaxTrackedIPs:        100000,                                     // Evict the least recently seen counters beyond this
+		MaxBlockedIPs:        50000,                                      // Keep firewall rule sets at a manageable size
+		EdgeSyncInterval:     time.Minute,                                // Send edge changes every minute
+		EdgeFullSyncInterval: time.Hour,                                  // Reconcile the full edge list every hour
+		FeedRefreshInterval:  time.Hour,                                  // Download subscribed feeds every hour
+		FeedTTL:              24 * time.Hour,                             // Keep feed blocks a day past the last refresh listing them
+		VerifiedBotCacheTTL:  24 * time.Hour,                             // Verify each crawler IP once a day
+		DeferBudget:          100 * time.Millisecond,                     // Defer work for requests with less time left
+		PersistMode:          "batched",                                  // Collect changes and save them shortly after
+		FlushInterval:        time.Second,                                // Save at most once a second in the "batched" persist mode
+		SyncOnBlock:          true,                                       // Save block changes right away in the "batched" persist mode
+		PersistInterval:      5 * time.Minute,                            // Save interval for the "interval" persist mode
+		EnforceFirewall:      true,                                       // Apply blocks to the OS firewall
+		FirewallTimeouts:     true,                                       // Apply timeouts to the OS firewall with EnforceFirewall
+		FirewallBans:         true,                                       // Apply permanent bans to the OS firewall with EnforceFirewall
+		ProbationMultiplier:  2,                                          // Double the timeout of IPs blocked again on probation
+		KnownRouteWeight:     50,                                         // Halve the score of pattern hits on served routes
+		UnknownRouteWeight:   150,                                        // Raise the score of pattern hits on unknown paths by half
+		ScannerThreshold:     20,                                         // Allow 20 not found or denied responses per IP
+		ScannerWindow:        time.Minute,                                // Count scanner responses over a minute
+		ScannerStatuses:      DefaultScannerStatuses(),                   // Count 404, 401 and 403 responses
+		SubnetThreshold:      5,                                          // Block a subnet once five of its IPs are blocked
+		SubnetWindow:         time.Hour,                                  // Count blocks of the last hour towards SubnetThreshold
+		SubnetPrefixIPv4:     24,                                         // Aggregate IPv4 blocks by /24
+		SubnetPrefixIPv6:     64,                                         // Aggregate IPv6 blocks by /64
+		DryRunFile:           filepath.Join(storageDir, "dry_run.jsonl"), // where dry-run decisions are recorded
+		ChallengeDuration:    time.Hour,                                  // Challenge IPs for an hour and trust solved challenges as long
+		ChallengeDifficulty:  4,                                          // About 65,000 hashes, a second or two in a browser
+		AppealTokenTTL:       time.Hour,                                  // Appeal forms and links can be used for an hour
+		AppealWhitelist:      24 * time.Hour,                             // Whitelist IPs granted an appeal for a day
+		AppealCooldown:       7 * 24 * time.Hour,                         // Grant each IP one appeal a week
+		AttackWindow:         time.Minute,                                // Measure the block rate over the last minute
+		FirewallPrivilege:    "auto",                                     // Use sudo for firewall commands unless running as root
+		RuleCheckInterval:    5 * time.Minute,                            // Look for removed firewall rules every five minutes
+		FirewallRetries:      3,                                          // Try firewall commands up to four times on lock contention
+		FirewallRetryBackoff: 100 * time.Millisecond,                     // Wait 100ms, 200ms and 400ms between the tries
+		SSHWeight:            3,                                          // Score failed SSH logins like probes of /wp-login.php
+		AdminMaxSkew:         5 * time.Minute,                            // Accept admin API requests signed up to five minutes off
+		IdempotencyKeyTTL:    24 * time.Hour,                             // Answer retried admin API requests for a day
 	}
 }
 
@@ -59,6 +448,225 @@ func ValidateConfig(cfg *Config) {
 		cfg.TimeoutIncrease = "linear" // Default to linear
 	}
 
+	if cfg.MaxTrackedIPs < 0 {
+		cfg.MaxTrackedIPs = 0
+	}
+
+	if cfg.LogMaxSize < 0 {
+		cfg.LogMaxSize = 0
+	}
+
+	if cfg.LogRotateEvery < 0 {
+		cfg.LogRotateEvery = 0
+	}
+
+	if cfg.LogMaxBackups < 0 {
+		cfg.LogMaxBackups = 0
+	}
+
+	if cfg.LogMaxAge < 0 {
+		cfg.LogMaxAge = 0
+	}
+
+	if cfg.MaxBlockedIPs < 0 {
+		cfg.MaxBlockedIPs = 0
+	}
+
+	// Keep subnet aggregation within its widest allowed prefixes
+	if cfg.SubnetThreshold < 2 {
+		cfg.SubnetThreshold = 5
+	}
+	if cfg.SubnetWindow <= 0 {
+		cfg.SubnetWindow = time.Hour
+	}
+	if cfg.SubnetPrefixIPv4 == 0 {
+		cfg.SubnetPrefixIPv4 = 24
+	}
+	cfg.SubnetPrefixIPv4 = min(max(cfg.SubnetPrefixIPv4, 16), 31)
+	if cfg.SubnetPrefixIPv6 == 0 {
+		cfg.SubnetPrefixIPv6 = 64
+	}
+	cfg.SubnetPrefixIPv6 = min(max(cfg.SubnetPrefixIPv6, 32), 127)
+
+	if cfg.ScoreThreshold < 0 {
+		cfg.ScoreThreshold = 0
+	}
+
+	if cfg.BlockExtension < 0 {
+		cfg.BlockExtension = 0
+	}
+
+	if cfg.MaxTimeouts < 0 {
+		cfg.MaxTimeouts = 0
+	}
+
+	if cfg.MaxTimeoutDuration < 0 {
+		cfg.MaxTimeoutDuration = 0
+	}
+
+	if cfg.ProbationPeriod < 0 {
+		cfg.ProbationPeriod = 0
+	}
+
+	if cfg.ProbationGracePeriod < 0 {
+		cfg.ProbationGracePeriod = 0
+	}
+
+	if cfg.ProbationMultiplier <= 0 {
+		cfg.ProbationMultiplier = 2
+	}
+
+	if cfg.RedemptionRequests < 0 {
+		cfg.RedemptionRequests = 0
+	}
+
+	if cfg.RedemptionQuiet < 0 {
+		cfg.RedemptionQuiet = 0
+	}
+
+	if cfg.InspectBodyLimit < 0 {
+		cfg.InspectBodyLimit = 0
+	}
+
+	if cfg.ChallengeDuration <= 0 {
+		cfg.ChallengeDuration = time.Hour
+	}
+
+	if cfg.AppealTokenTTL <= 0 {
+		cfg.AppealTokenTTL = time.Hour
+	}
+
+	if cfg.AppealWhitelist <= 0 {
+		cfg.AppealWhitelist = 24 * time.Hour
+	}
+
+	if cfg.AppealCooldown <= 0 {
+		cfg.AppealCooldown = 7 * 24 * time.Hour
+	}
+
+	// Fall back to the system's default for unknown firewall backends
+	cfg.FirewallBackend = strings.ToLower(cfg.FirewallBackend)
+	switch cfg.FirewallBackend {
+	case "", "iptables", "firewalld", "netsh", "netfirewall", "auto":
+	default:
+		cfg.FirewallBackend = ""
+	}
+
+	cfg.FirewallPrivilege = strings.TrimSpace(cfg.FirewallPrivilege)
+	if cfg.FirewallPrivilege == "" {
+		cfg.FirewallPrivilege = "auto"
+	}
+
+	if cfg.RuleCheckInterval < 0 {
+		cfg.RuleCheckInterval = 0
+	}
+
+	if cfg.FirewallRetries < 0 {
+		cfg.FirewallRetries = 0
+	}
+	if cfg.FirewallRetryBackoff <= 0 {
+		cfg.FirewallRetryBackoff = 100 * time.Millisecond
+	}
+
+	if cfg.SSHWeight <= 0 {
+		cfg.SSHWeight = 3
+	}
+
+	cfg.LogSink = strings.ToLower(strings.TrimSpace(cfg.LogSink))
+	switch cfg.LogSink {
+	case "", "syslog", "journald":
+	default:
+		cfg.LogSink = ""
+	}
+
+	cfg.SIEMFormat = strings.ToLower(strings.TrimSpace(cfg.SIEMFormat))
+	switch cfg.SIEMFormat {
+	case "", "cef", "leef":
+	default:
+		cfg.SIEMFormat = ""
+	}
+	if cfg.SIEMFile != "" && cfg.SIEMFormat == "" {
+		cfg.SIEMFormat = "cef"
+	}
+
+	if cfg.AttackThreshold < 0 {
+		cfg.AttackThreshold = 0
+	}
+	if cfg.AttackWindow <= 0 {
+		cfg.AttackWindow = time.Minute
+	}
+	if cfg.AttackWindow < time.Second {
+		cfg.AttackWindow = time.Second
+	}
+
+	if cfg.AdminMaxSkew <= 0 {
+		cfg.AdminMaxSkew = 5 * time.Minute
+	}
+	if cfg.IdempotencyKeyTTL <= 0 {
+		cfg.IdempotencyKeyTTL = 24 * time.Hour
+	}
+
+	// Keep the proof of work solvable in a browser
+	if cfg.ChallengeDifficulty <= 0 {
+		cfg.ChallengeDifficulty = 4
+	}
+	if cfg.ChallengeDifficulty > 6 {
+		cfg.ChallengeDifficulty = 6
+	}
+
+	if cfg.DeceiveEnabled && cfg.Decoys == nil {
+		cfg.Decoys = DefaultDecoys()
+	}
+
+	if cfg.HistoryRetention < 0 {
+		cfg.HistoryRetention = 0
+	}
+
+	if cfg.HistoryPolicy != "archive" && cfg.HistoryPolicy != "drop" {
+		cfg.HistoryPolicy = "archive"
+	}
+
+	if cfg.PermanentBanReviewAge < 0 {
+		cfg.PermanentBanReviewAge = 0
+	}
+
+	if cfg.EdgeSyncInterval <= 0 {
+		cfg.EdgeSyncInterval = time.Minute
+	}
+
+	if cfg.EdgeFullSyncInterval <= 0 {
+		cfg.EdgeFullSyncInterval = time.Hour
+	}
+
+	if cfg.FeedRefreshInterval <= 0 {
+		cfg.FeedRefreshInterval = time.Hour
+	}
+
+	if cfg.FeedTTL <= 0 {
+		cfg.FeedTTL = 24 * time.Hour
+	}
+
+	if cfg.VerifiedBotCacheTTL <= 0 {
+		cfg.VerifiedBotCacheTTL = 24 * time.Hour
+	}
+
+	if cfg.DeferBudget <= 0 {
+		cfg.DeferBudget = 100 * time.Millisecond
+	}
+
+	if cfg.PersistMode != "batched" && cfg.PersistMode != "immediate" && cfg.PersistMode != "interval" &&
+		cfg.PersistMode != "on-shutdown" && cfg.PersistMode != "memory" {
+		cfg.PersistMode = "batched"
+	}
+
+	if cfg.FlushInterval <= 0 {
+		cfg.FlushInterval = time.Second
+	}
+
+	if cfg.PersistInterval <= 0 {
+		cfg.PersistInterval = 5 * time.Minute
+	}
+
 	if cfg.CleanupInterval <= 0 {
 		cfg.CleanupInterval = 1 * time.Hour
 	}
@@ -67,13 +675,31 @@ func ValidateConfig(cfg *Config) {
 	if cfg.StorageDir == "" {
 		cfg.StorageDir = "."
 	}
-}
 
-// getDefaultStorageDir returns the default directory for storing Whoen data
-func getDefaultStorageDir() string {
-	// Use the current directory as the default storage location
-	// This is the most reliable option and requires no special permissions
-	return "."
+	cfg.Ramp = validateRamp(cfg.Ramp)
+	cfg.PolicyWindows = validatePolicyWindows(cfg.PolicyWindows)
+	cfg.RequestRules = validateRequestRules(cfg.RequestRules)
+
+	if cfg.KnownRouteWeight <= 0 {
+		cfg.KnownRouteWeight = 50
+	}
+	if cfg.UnknownRouteWeight <= 0 {
+		cfg.UnknownRouteWeight = 150
+	}
+
+	if cfg.ScannerThreshold <= 0 {
+		cfg.ScannerThreshold = 20
+	}
+	if cfg.ScannerWindow <= 0 {
+		cfg.ScannerWindow = time.Minute
+	}
+	if len(cfg.ScannerStatuses) == 0 {
+		cfg.ScannerStatuses = DefaultScannerStatuses()
+	}
+
+	if cfg.DryRunFile == "" {
+		cfg.DryRunFile = filepath.Join(cfg.StorageDir, "dry_run.jsonl")
+	}
 }
 
 // WithStorageDir sets a custom storage directory and updates file paths
@@ -81,5 +707,20 @@ func (c Config) WithStorageDir(dir string) Config {
 	c.StorageDir = dir
 	c.BlockedIPsFile = filepath.Join(dir, filepath.Base(c.BlockedIPsFile))
 	c.LogFile = filepath.Join(dir, filepath.Base(c.LogFile))
+	if c.AuditLogFile != "" {
+		c.AuditLogFile = filepath.Join(dir, filepath.Base(c.AuditLogFile))
+	}
+	if c.PatternsFile != "" {
+		c.PatternsFile = filepath.Join(dir, filepath.Base(c.PatternsFile))
+	}
+	if c.WhitelistFile != "" {
+		c.WhitelistFile = filepath.Join(dir, filepath.Base(c.WhitelistFile))
+	}
+	if c.DryRunFile != "" {
+		c.DryRunFile = filepath.Join(dir, filepath.Base(c.DryRunFile))
+	}
+	if c.HistoryArchiveFile != "" {
+		c.HistoryArchiveFile = filepath.Join(dir, filepath.Base(c.HistoryArchiveFile))
+	}
 	return c
 }
@@ -0,0 +1,184 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// EnvPrefix prefixes the environment variables read by LoadFromEnv. The rest
+// of each name is the field's json key in upper case, e.g. WHOEN_GRACE_PERIOD.
+const EnvPrefix = "WHOEN_"
+
+// durationType is the type of the Config fields that accept duration strings
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// LoadFromFile returns the default configuration overridden by a JSON or YAML
+// file and then by WHOEN_* environment variables. The format is picked from the
+// extension (.json, .yaml or .yml). Keys are the Config json tags, and
+// durations can be written as strings like "1h30m".
+func LoadFromFile(path string) (Config, error) {
+	cfg := DefaultConfig()
+
+	// Read the file
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return cfg, fmt.Errorf("failed to read config file: %w", err)
+	}
+
+	// Decode it into generic values according to its format
+	values := make(map[string]interface{})
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		err = json.Unmarshal(data, &values)
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &values)
+	default:
+		return cfg, fmt.Errorf("unsupported config file format: %s", path)
+	}
+	if err != nil {
+		return cfg, fmt.Errorf("failed to parse config file %s: %w", path, err)
+	}
+
+	if err := apply(&cfg, values); err != nil {
+		return cfg, fmt.Errorf("invalid config file %s: %w", path, err)
+	}
+
+	// Environment variables take precedence over the file
+	if err := applyEnv(&cfg); err != nil {
+		return cfg, err
+	}
+
+	if cfg.Strict {
+		if err := cfg.Validate(); err != nil {
+			return cfg, err
+		}
+	}
+	ValidateConfig(&cfg)
+	return cfg, nil
+}
+
+// LoadFromEnv returns the default configuration overridden by WHOEN_*
+// environment variables
+func LoadFromEnv() (Config, error) {
+	cfg := DefaultConfig()
+	if err := applyEnv(&cfg); err != nil {
+		return cfg, err
+	}
+
+	if cfg.Strict {
+		if err := cfg.Validate(); err != nil {
+			return cfg, err
+		}
+	}
+	ValidateConfig(&cfg)
+	return cfg, nil
+}
+
+// applyEnv overrides configuration fields with the WHOEN_* environment
+// variables that are set
+func applyEnv(cfg *Config) error {
+	// Apply WHOEN_STORAGE_DIR first so explicit file paths override it
+	keys := []string{"storage_dir"}
+	for key := range configFields() {
+		if key != "storage_dir" {
+			keys = append(keys, key)
+		}
+	}
+
+	for _, key := range keys {
+		name := EnvPrefix + strings.ToUpper(key)
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			continue
+		}
+		if err := apply(cfg, map[string]interface{}{key: value}); err != nil {
+			return fmt.Errorf("invalid environment variable %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// apply sets configuration fields from values keyed by json tag. A storage_dir
+// value moves the storage files along with it, like WithStorageDir, unless
+// their paths are set as well.
+func apply(cfg *Config, values map[string]interface{}) error {
+	fields := configFields()
+
+	// Reject keys that do not match a field, they are most likely typos
+	for key := range values {
+		if _, ok := fields[key]; !ok {
+			return fmt.Errorf("unknown key %q", key)
+		}
+	}
+
+	// Move the storage files first so explicit paths override them
+	if dir, ok := values["storage_dir"]; ok {
+		s, ok := dir.(string)
+		if !ok {
+			return fmt.Errorf("storage_dir: expected a string")
+		}
+		*cfg = cfg.WithStorageDir(s)
+	}
+
+	target := reflect.ValueOf(cfg).Elem()
+	for key, value := range values {
+		if err := setField(target.Field(fields[key]), value); err != nil {
+			return fmt.Errorf("%s: %w", key, err)
+		}
+	}
+	return nil
+}
+
+// setField sets a configuration field from a decoded file value or an
+// environment variable string
+func setField(field reflect.Value, value interface{}) error {
+	// Durations accept strings like "1h30m"
+	if field.Type() == durationType {
+		if s, ok := value.(string); ok {
+			d, err := time.ParseDuration(s)
+			if err != nil {
+				return err
+			}
+			field.SetInt(int64(d))
+			return nil
+		}
+	}
+
+	// Environment variables are always strings, parse them as JSON values
+	// except for string fields
+	if s, ok := value.(string); ok && field.Kind() != reflect.String {
+		var decoded interface{}
+		if err := json.Unmarshal([]byte(s), &decoded); err != nil {
+			return fmt.Errorf("invalid value %q", s)
+		}
+		value = decoded
+	}
+
+	// Round-trip everything else through JSON so numbers, booleans and maps
+	// decode the same way as in a JSON config file
+	data, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, field.Addr().Interface())
+}
+
+// configFields maps the json tag of each Config field to its index
+func configFields() map[string]int {
+	t := reflect.TypeOf(Config{})
+	fields := make(map[string]int, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		tag := strings.Split(t.Field(i).Tag.Get("json"), ",")[0]
+		if tag != "" && tag != "-" {
+			fields[tag] = i
+		}
+	}
+	return fields
+}
@@ -0,0 +1,80 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+)
+
+// StorageDirEnv names the environment variable that overrides the default storage directory
+const StorageDirEnv = "WHOEN_STORAGE_DIR"
+
+// DefaultStorageDir returns the directory whoen stores its data in when none is
+// configured. In order of preference:
+//   - the directory named by the WHOEN_STORAGE_DIR environment variable,
+//   - the current directory, if it already holds blocked_ips.json from an
+//     earlier version that stored everything there,
+//   - the platform's conventional location (see platformStorageDir),
+//   - the current directory.
+func DefaultStorageDir() string {
+	if dir := os.Getenv(StorageDirEnv); dir != "" {
+		return dir
+	}
+
+	// Keep using the current directory for existing installations
+	if _, err := os.Stat("blocked_ips.json"); err == nil {
+		return "."
+	}
+
+	if dir := platformStorageDir(); dir != "" {
+		return dir
+	}
+
+	return "."
+}
+
+// platformStorageDir returns the conventional state directory for the current
+// platform, or an empty string if it cannot be determined:
+//   - Windows: %ProgramData%\whoen, or %LOCALAPPDATA%\whoen without ProgramData
+//   - macOS: /Library/Application Support/whoen as root, otherwise
+//     ~/Library/Application Support/whoen
+//   - Linux and others: $XDG_STATE_HOME/whoen if set, /var/lib/whoen as root,
+//     otherwise ~/.local/state/whoen
+//
+// System-wide locations are preferred for root and on Windows because blocking
+// at the firewall already requires administrator rights.
+func platformStorageDir() string {
+	switch runtime.GOOS {
+	case "windows":
+		if dir := os.Getenv("ProgramData"); dir != "" {
+			return filepath.Join(dir, "whoen")
+		}
+		if dir := os.Getenv("LOCALAPPDATA"); dir != "" {
+			return filepath.Join(dir, "whoen")
+		}
+		return ""
+
+	case "darwin":
+		if os.Geteuid() == 0 {
+			return "/Library/Application Support/whoen"
+		}
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return ""
+		}
+		return filepath.Join(home, "Library", "Application Support", "whoen")
+
+	default:
+		if dir := os.Getenv("XDG_STATE_HOME"); dir != "" {
+			return filepath.Join(dir, "whoen")
+		}
+		if os.Geteuid() == 0 {
+			return "/var/lib/whoen"
+		}
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return ""
+		}
+		return filepath.Join(home, ".local", "state", "whoen")
+	}
+}
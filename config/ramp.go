@@ -0,0 +1,76 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// Enforcement modes of a ramp stage
+const (
+	RampLogOnly   = "log-only"   // Record would-be blocks like dry-run mode, reject nothing
+	RampSoftBlock = "soft-block" // Reject blocked IPs in the middleware, leave the firewall alone
+	RampOSBlock   = "os-block"   // Reject blocked IPs and block them at the OS firewall
+)
+
+// RampStage is one step of a gradual enforcement ramp. The stage starts After
+// the ramp start and applies its Mode to Percent of client IPs; the others
+// keep the previous stage's mode. Zero Percent means all IPs.
+type RampStage struct {
+	Mode    string        `json:"mode"`
+	After   time.Duration `json:"after"`
+	Percent int           `json:"percent"`
+}
+
+// UnmarshalJSON decodes a stage, accepting duration strings like "72h" for After
+func (s *RampStage) UnmarshalJSON(data []byte) error {
+	var raw struct {
+		Mode    string          `json:"mode"`
+		After   json.RawMessage `json:"after"`
+		Percent int             `json:"percent"`
+	}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	s.Mode = raw.Mode
+	s.Percent = raw.Percent
+	s.After = 0
+
+	if len(raw.After) == 0 || string(raw.After) == "null" {
+		return nil
+	}
+	var text string
+	if err := json.Unmarshal(raw.After, &text); err == nil {
+		after, err := time.ParseDuration(text)
+		if err != nil {
+			return fmt.Errorf("invalid ramp stage after: %w", err)
+		}
+		s.After = after
+		return nil
+	}
+	return json.Unmarshal(raw.After, (*int64)(&s.After))
+}
+
+// validateRamp drops ramp stages with an unknown mode, clamps percentages and
+// orders the stages by start
+func validateRamp(stages []RampStage) []RampStage {
+	valid := make([]RampStage, 0, len(stages))
+	for _, stage := range stages {
+		if stage.Mode != RampLogOnly && stage.Mode != RampSoftBlock && stage.Mode != RampOSBlock {
+			continue
+		}
+		if stage.After < 0 {
+			stage.After = 0
+		}
+		if stage.Percent <= 0 || stage.Percent > 100 {
+			stage.Percent = 100
+		}
+		valid = append(valid, stage)
+	}
+
+	sort.SliceStable(valid, func(i, j int) bool {
+		return valid[i].After < valid[j].After
+	})
+	return valid
+}
@@ -0,0 +1,158 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RequestRule counts repeated requests of one kind toward blocking, for abuse
+// no single request gives away, such as password guessing with POSTs to a
+// login form or a crawler working through a wordlist into a burst of 404s.
+// Once an IP has made Threshold matching requests within Window, each further
+// one counts as a malicious request, like a request to a pattern path.
+type RequestRule struct {
+	Name   string `json:"name"`   // Reported as the matched pattern, described from the rule if empty
+	Method string `json:"method"` // HTTP method, any if empty
+	Path   string `json:"path"`   // Exact path, or a prefix when it ends in "*"; any if empty
+
+	// Status lists the response status codes that match, any if empty. A
+	// code below 10 matches its whole class, e.g. 4 for 4xx. Rules with
+	// status codes are checked once the application has responded.
+	Status []int `json:"status"`
+
+	Threshold int           `json:"threshold"` // Matching requests allowed within Window
+	Window    time.Duration `json:"window"`    // One minute if zero
+	Weight    int           `json:"weight"`    // Score of each counted request, 1 if zero
+}
+
+// UnmarshalJSON decodes a rule, accepting a duration string like "10m" for
+// Window
+func (rule *RequestRule) UnmarshalJSON(data []byte) error {
+	type plain RequestRule
+	var raw struct {
+		plain
+		Window json.RawMessage `json:"window"`
+	}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	*rule = RequestRule(raw.plain)
+	rule.Window = 0
+
+	if len(raw.Window) == 0 || string(raw.Window) == "null" {
+		return nil
+	}
+	var text string
+	if err := json.Unmarshal(raw.Window, &text); err == nil {
+		window, err := time.ParseDuration(text)
+		if err != nil {
+			return fmt.Errorf("invalid request rule window: %w", err)
+		}
+		rule.Window = window
+		return nil
+	}
+	return json.Unmarshal(raw.Window, (*int64)(&rule.Window))
+}
+
+// MatchesRequest reports whether a request matches the rule's method and path
+func (rule *RequestRule) MatchesRequest(method, path string) bool {
+	if rule.Method != "" && !strings.EqualFold(rule.Method, method) {
+		return false
+	}
+	if prefix, ok := strings.CutSuffix(rule.Path, "*"); ok {
+		return strings.HasPrefix(strings.ToLower(path), strings.ToLower(prefix))
+	}
+	return rule.Path == "" || strings.EqualFold(rule.Path, path)
+}
+
+// MatchesStatus reports whether a response status matches the rule
+func (rule *RequestRule) MatchesStatus(status int) bool {
+	if len(rule.Status) == 0 {
+		return true
+	}
+	for _, code := range rule.Status {
+		if code == status || (code < 10 && status/100 == code) {
+			return true
+		}
+	}
+	return false
+}
+
+// describe names a rule by what it matches, e.g. "POST /wp-login.php" or
+// "404 responses"
+func (rule *RequestRule) describe() string {
+	var parts []string
+	if rule.Method != "" {
+		parts = append(parts, rule.Method)
+	}
+	if rule.Path != "" {
+		parts = append(parts, rule.Path)
+	}
+	if len(rule.Status) > 0 {
+		codes := make([]string, len(rule.Status))
+		for i, code := range rule.Status {
+			codes[i] = strconv.Itoa(code)
+			if code < 10 {
+				codes[i] += "xx"
+			}
+		}
+		parts = append(parts, strings.Join(codes, "/")+" responses")
+	}
+	return strings.Join(parts, " ")
+}
+
+// Validate checks that the rule does not match every request and fills in
+// its defaults
+func (rule *RequestRule) Validate() error {
+	rule.Method = strings.ToUpper(strings.TrimSpace(rule.Method))
+	if rule.Method == "" && rule.Path == "" && len(rule.Status) == 0 {
+		return fmt.Errorf("request rule %q matches every request, it needs a method, path or status", rule.Name)
+	}
+	if rule.Threshold < 0 {
+		rule.Threshold = 0
+	}
+	if rule.Window <= 0 {
+		rule.Window = time.Minute
+	}
+	if rule.Weight <= 0 {
+		rule.Weight = 1
+	}
+	if rule.Name == "" {
+		rule.Name = rule.describe()
+	}
+	return nil
+}
+
+// validateRequestRules drops the rules that fail validation
+func validateRequestRules(rules []RequestRule) []RequestRule {
+	valid := make([]RequestRule, 0, len(rules))
+	for _, rule := range rules {
+		if rule.Validate() == nil {
+			valid = append(valid, rule)
+		}
+	}
+	return valid
+}
+
+// DefaultScannerStatuses returns the response statuses ScannerDetection
+// counts by default: paths that do not exist and ones the client may not see
+func DefaultScannerStatuses() []int {
+	return []int{404, 401, 403}
+}
+
+// ScannerRule returns the request rule ScannerDetection applies
+func (c Config) ScannerRule() RequestRule {
+	statuses := c.ScannerStatuses
+	if len(statuses) == 0 {
+		statuses = DefaultScannerStatuses()
+	}
+	return RequestRule{
+		Name:      "scanner",
+		Status:    statuses,
+		Threshold: c.ScannerThreshold,
+		Window:    c.ScannerWindow,
+	}
+}
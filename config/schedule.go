@@ -0,0 +1,168 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// PolicyWindow overrides enforcement settings while it is open, e.g. a
+// stricter grace period at night or no permanent bans during a pentest. A
+// window either recurs, open every day from Start to End on the listed Days,
+// or is a one-off, open from From to Until.
+type PolicyWindow struct {
+	Name string `json:"name"`
+
+	// Start and End are clock times like "22:00". A window whose End is not
+	// after its Start runs past midnight and belongs to the day it starts on.
+	// Days lists the days it opens on ("mon" to "sun"), every day if empty.
+	// Timezone is an IANA name like "Europe/Berlin", local time if empty.
+	Start    string   `json:"start"`
+	End      string   `json:"end"`
+	Days     []string `json:"days"`
+	Timezone string   `json:"timezone"`
+
+	From  time.Time `json:"from"`
+	Until time.Time `json:"until"`
+
+	// Overrides, the normal setting applies where they are unset
+	GracePeriod     *int          `json:"grace_period"`      // Replaces GracePeriod
+	ScoreThreshold  *int          `json:"score_threshold"`   // Replaces ScoreThreshold, zero goes back to the grace period
+	TimeoutDuration time.Duration `json:"timeout_duration"`  // Replaces TimeoutDuration as the base of timeouts
+	NoPermanentBans bool          `json:"no_permanent_bans"` // Times IPs out instead of banning them permanently
+
+	start, end int // Start and End in minutes after midnight
+	days       [7]bool
+	location   *time.Location
+}
+
+// weekdays maps the day names of PolicyWindow.Days to weekdays
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+// UnmarshalJSON decodes a window, accepting a duration string like "48h" for
+// TimeoutDuration
+func (w *PolicyWindow) UnmarshalJSON(data []byte) error {
+	type plain PolicyWindow
+	var raw struct {
+		plain
+		TimeoutDuration json.RawMessage `json:"timeout_duration"`
+	}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	*w = PolicyWindow(raw.plain)
+	w.TimeoutDuration = 0
+
+	if len(raw.TimeoutDuration) == 0 || string(raw.TimeoutDuration) == "null" {
+		return nil
+	}
+	var text string
+	if err := json.Unmarshal(raw.TimeoutDuration, &text); err == nil {
+		duration, err := time.ParseDuration(text)
+		if err != nil {
+			return fmt.Errorf("invalid policy window timeout_duration: %w", err)
+		}
+		w.TimeoutDuration = duration
+		return nil
+	}
+	return json.Unmarshal(raw.TimeoutDuration, (*int64)(&w.TimeoutDuration))
+}
+
+// Validate checks the window and prepares it for Open
+func (w *PolicyWindow) Validate() error {
+	if w.Start == "" && w.End == "" {
+		if w.From.IsZero() || !w.Until.After(w.From) {
+			return fmt.Errorf("policy window %q needs start and end, or from and a later until", w.Name)
+		}
+		return nil
+	}
+
+	var err error
+	if w.start, err = parseClock(w.Start); err != nil {
+		return fmt.Errorf("policy window %q: invalid start: %w", w.Name, err)
+	}
+	if w.end, err = parseClock(w.End); err != nil {
+		return fmt.Errorf("policy window %q: invalid end: %w", w.Name, err)
+	}
+
+	w.days = [7]bool{}
+	for _, name := range w.Days {
+		// Full names like "Monday" work as well
+		key := strings.ToLower(strings.TrimSpace(name))
+		if len(key) > 3 {
+			key = key[:3]
+		}
+		day, ok := weekdays[key]
+		if !ok {
+			return fmt.Errorf("policy window %q: invalid day %q", w.Name, name)
+		}
+		w.days[day] = true
+	}
+	if len(w.Days) == 0 {
+		w.days = [7]bool{true, true, true, true, true, true, true}
+	}
+
+	w.location = time.Local
+	if w.Timezone != "" {
+		if w.location, err = time.LoadLocation(w.Timezone); err != nil {
+			return fmt.Errorf("policy window %q: %w", w.Name, err)
+		}
+	}
+	return nil
+}
+
+// Open reports whether the window is open at t. The window must have been
+// validated, as ValidateConfig does.
+func (w *PolicyWindow) Open(t time.Time) bool {
+	if w.Start == "" && w.End == "" {
+		return !t.Before(w.From) && t.Before(w.Until)
+	}
+	if w.location == nil {
+		return false
+	}
+
+	t = t.In(w.location)
+	minute := t.Hour()*60 + t.Minute()
+	if w.start < w.end {
+		return w.days[t.Weekday()] && minute >= w.start && minute < w.end
+	}
+
+	// Past midnight, the window belongs to the previous day
+	if minute >= w.start {
+		return w.days[t.Weekday()]
+	}
+	return minute < w.end && w.days[t.AddDate(0, 0, -1).Weekday()]
+}
+
+// parseClock parses a clock time like "06:30" into minutes after midnight
+func parseClock(value string) (int, error) {
+	clock, err := time.Parse("15:04", strings.TrimSpace(value))
+	if err != nil {
+		return 0, fmt.Errorf("expected a clock time like 22:00, got %q", value)
+	}
+	return clock.Hour()*60 + clock.Minute(), nil
+}
+
+// validatePolicyWindows prepares the windows for Open and clamps their
+// overrides. Invalid windows are kept, so the middleware can report them, but
+// never open.
+func validatePolicyWindows(windows []PolicyWindow) []PolicyWindow {
+	for i := range windows {
+		window := &windows[i]
+		window.Validate()
+		if window.GracePeriod != nil && *window.GracePeriod < 0 {
+			window.GracePeriod = nil
+		}
+		if window.ScoreThreshold != nil && *window.ScoreThreshold < 0 {
+			window.ScoreThreshold = nil
+		}
+		if window.TimeoutDuration < 0 {
+			window.TimeoutDuration = 0
+		}
+	}
+	return windows
+}
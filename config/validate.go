@@ -0,0 +1,234 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/headswim/whoen/asn"
+	"github.com/headswim/whoen/feeds"
+	"github.com/headswim/whoen/ipaddr"
+)
+
+// ValidationError lists the problems Validate found in a configuration
+type ValidationError struct {
+	Problems []string
+}
+
+// Error describes the problems, one per line when there are several
+func (e *ValidationError) Error() string {
+	if len(e.Problems) == 1 {
+		return "invalid configuration: " + e.Problems[0]
+	}
+	return fmt.Sprintf("invalid configuration, %d problems:\n  - %s", len(e.Problems), strings.Join(e.Problems, "\n  - "))
+}
+
+// Validate reports the problems ValidateConfig would silently correct, such
+// as unknown names, negative limits and contradicting settings, and a storage
+// directory whoen cannot write to. Fields are named by their keys in
+// configuration files. Empty and zero fields that ValidateConfig gives a
+// default are not problems. It returns nil or a *ValidationError, and
+// creates the storage directory if it is missing.
+func (cfg Config) Validate() error {
+	var problems []string
+	report := func(format string, args ...any) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	// Names outside a fixed set
+	oneOf := func(key, value string, allowed ...string) {
+		for _, name := range allowed {
+			if value == name {
+				return
+			}
+		}
+		report("%s: unknown value %q, expected one of %s", key, value, strings.Join(allowed, ", "))
+	}
+	if cfg.TimeoutIncrease != "" {
+		oneOf("timeout_increase", cfg.TimeoutIncrease, "linear", "geometric")
+	}
+	if cfg.HistoryPolicy != "" {
+		oneOf("history_policy", cfg.HistoryPolicy, "archive", "drop")
+	}
+	if cfg.PersistMode != "" {
+		oneOf("persist_mode", cfg.PersistMode, "batched", "immediate", "interval", "on-shutdown", "memory")
+	}
+	if cfg.FirewallBackend != "" {
+		oneOf("firewall_backend", strings.ToLower(cfg.FirewallBackend), "auto", "iptables", "firewalld", "netsh", "netfirewall")
+	}
+	if cfg.LogSink != "" {
+		oneOf("log_sink", strings.ToLower(strings.TrimSpace(cfg.LogSink)), "syslog", "journald")
+	}
+	if cfg.SIEMFormat != "" {
+		oneOf("siem_format", strings.ToLower(strings.TrimSpace(cfg.SIEMFormat)), "cef", "leef")
+	}
+
+	// Counts and durations that cannot be negative
+	count := func(key string, value int) {
+		if value < 0 {
+			report("%s: must not be negative, got %d", key, value)
+		}
+	}
+	duration := func(key string, value time.Duration) {
+		if value < 0 {
+			report("%s: must not be negative, got %v", key, value)
+		}
+	}
+	count("grace_period", cfg.GracePeriod)
+	count("max_tracked_ips", cfg.MaxTrackedIPs)
+	count("max_blocked_ips", cfg.MaxBlockedIPs)
+	count("score_threshold", cfg.ScoreThreshold)
+	count("max_timeouts", cfg.MaxTimeouts)
+	count("probation_grace_period", cfg.ProbationGracePeriod)
+	count("redemption_requests", cfg.RedemptionRequests)
+	count("inspect_body_limit", cfg.InspectBodyLimit)
+	count("firewall_retries", cfg.FirewallRetries)
+	count("attack_threshold", cfg.AttackThreshold)
+	count("log_max_size", cfg.LogMaxSize)
+	count("log_max_backups", cfg.LogMaxBackups)
+	duration("timeout_duration", cfg.TimeoutDuration)
+	duration("block_extension", cfg.BlockExtension)
+	duration("max_timeout_duration", cfg.MaxTimeoutDuration)
+	duration("probation_period", cfg.ProbationPeriod)
+	duration("redemption_quiet", cfg.RedemptionQuiet)
+	duration("rule_check_interval", cfg.RuleCheckInterval)
+	duration("history_retention", cfg.HistoryRetention)
+	duration("permanent_ban_review_age", cfg.PermanentBanReviewAge)
+	duration("cleanup_interval", cfg.CleanupInterval)
+	duration("challenge_duration", cfg.ChallengeDuration)
+	duration("attack_window", cfg.AttackWindow)
+	duration("feed_refresh_interval", cfg.FeedRefreshInterval)
+	duration("appeal_token_ttl", cfg.AppealTokenTTL)
+	duration("appeal_whitelist", cfg.AppealWhitelist)
+	duration("appeal_cooldown", cfg.AppealCooldown)
+	duration("feed_ttl", cfg.FeedTTL)
+	duration("verified_bot_cache_ttl", cfg.VerifiedBotCacheTTL)
+	duration("log_rotate_every", cfg.LogRotateEvery)
+	duration("log_max_age", cfg.LogMaxAge)
+
+	// Settings that contradict each other
+	if cfg.TimeoutEnabled && cfg.TimeoutDuration == 0 {
+		report("timeout_duration: must be set when timeout_enabled is true, e.g. 24h")
+	}
+	if cfg.TimeoutEnabled && cfg.MaxTimeoutDuration > 0 && cfg.MaxTimeoutDuration < cfg.TimeoutDuration {
+		report("max_timeout_duration: %v is shorter than timeout_duration %v", cfg.MaxTimeoutDuration, cfg.TimeoutDuration)
+	}
+	if cfg.CleanupEnabled && cfg.CleanupInterval == 0 {
+		report("cleanup_interval: must be set when cleanup_enabled is true, e.g. 1h")
+	}
+	if cfg.SIEMFormat != "" && cfg.SIEMFile == "" && !strings.EqualFold(cfg.LogSink, "syslog") {
+		report("siem_format: has no effect without siem_file or log_sink syslog")
+	}
+	if cfg.EnforceFirewall && !cfg.FirewallTimeouts && !cfg.FirewallBans {
+		report("enforce_firewall: has no effect with firewall_timeouts and firewall_bans both false")
+	}
+	if (cfg.AdminUIUser == "") != (cfg.AdminUIPassword == "") {
+		report("admin_ui_user: admin_ui_user and admin_ui_password must be set together")
+	}
+	if len(cfg.Feeds) > 0 && cfg.FeedTTL > 0 && cfg.FeedRefreshInterval > 0 && cfg.FeedTTL <= cfg.FeedRefreshInterval {
+		report("feed_ttl: %v is not longer than feed_refresh_interval %v, so feed blocks lapse between refreshes", cfg.FeedTTL, cfg.FeedRefreshInterval)
+	}
+	if cfg.AppealEnabled && cfg.EnforceFirewall && !cfg.DryRun && cfg.FirewallTimeouts && cfg.FirewallBans {
+		report("appeal_enabled: blocked clients cannot reach the appeal form while enforce_firewall applies every block to the OS firewall; set firewall_timeouts or firewall_bans to false")
+	}
+	if cfg.AttackWindow > 0 && cfg.AttackWindow < time.Second {
+		report("attack_window: must be at least 1s, got %v", cfg.AttackWindow)
+	}
+	if cfg.ChallengeDifficulty > 6 {
+		report("challenge_difficulty: at most 6 is solvable in a browser, got %d", cfg.ChallengeDifficulty)
+	}
+	if cfg.SubnetPrefixIPv4 != 0 && (cfg.SubnetPrefixIPv4 < 16 || cfg.SubnetPrefixIPv4 > 31) {
+		report("subnet_prefix_ipv4: must be between 16 and 31, got %d", cfg.SubnetPrefixIPv4)
+	}
+	if cfg.SubnetPrefixIPv6 != 0 && (cfg.SubnetPrefixIPv6 < 32 || cfg.SubnetPrefixIPv6 > 127) {
+		report("subnet_prefix_ipv6: must be between 32 and 127, got %d", cfg.SubnetPrefixIPv6)
+	}
+
+	// Entries ValidateConfig drops or the matcher ignores
+	for i, stage := range cfg.Ramp {
+		if stage.Mode != RampLogOnly && stage.Mode != RampSoftBlock && stage.Mode != RampOSBlock {
+			report("ramp[%d]: unknown mode %q, expected %s, %s or %s", i, stage.Mode, RampLogOnly, RampSoftBlock, RampOSBlock)
+		}
+		if stage.Percent < 0 || stage.Percent > 100 {
+			report("ramp[%d]: percent must be between 0 and 100, got %d", i, stage.Percent)
+		}
+	}
+	for i, window := range cfg.PolicyWindows {
+		if err := window.Validate(); err != nil {
+			report("policy_windows[%d]: %v", i, err)
+		}
+	}
+	for i, rule := range cfg.RequestRules {
+		if err := rule.Validate(); err != nil {
+			report("request_rules[%d]: %v", i, err)
+		}
+	}
+	for i, spec := range cfg.Feeds {
+		if _, err := feeds.Parse(spec); err != nil {
+			report("feeds[%d]: %v", i, err)
+		}
+	}
+	exempt := make(map[string]bool, len(cfg.ExemptASNs))
+	for i, value := range cfg.ExemptASNs {
+		number, err := asn.Normalize(value)
+		if err != nil {
+			report("exempt_asns[%d]: %v", i, err)
+		}
+		exempt[number] = true
+	}
+	for i, value := range cfg.BlockASNs {
+		number, err := asn.Normalize(value)
+		if err != nil {
+			report("block_asns[%d]: %v", i, err)
+		} else if exempt[number] {
+			report("block_asns[%d]: %s is also in exempt_asns, which wins", i, number)
+		}
+	}
+	for i, entry := range cfg.Whitelist {
+		if _, err := ipaddr.ParsePrefix(entry); err != nil {
+			report("whitelist[%d]: %q is neither an IP address nor a CIDR range", i, entry)
+		}
+	}
+
+	// Files whoen has to read or write
+	if cfg.PersistMode != "memory" && cfg.StorageDir != "" {
+		if err := checkWritable(cfg.StorageDir); err != nil {
+			report("storage_dir: %v", err)
+		}
+	}
+	if cfg.ASNDatabase != "" {
+		if f, err := os.Open(cfg.ASNDatabase); err != nil {
+			report("asn_database: %v", err)
+		} else {
+			f.Close()
+		}
+	}
+	if cfg.SSHAuthLog != "" {
+		if f, err := os.Open(cfg.SSHAuthLog); err != nil {
+			report("ssh_auth_log: %v", err)
+		} else {
+			f.Close()
+		}
+	}
+
+	if len(problems) == 0 {
+		return nil
+	}
+	return &ValidationError{Problems: problems}
+}
+
+// checkWritable creates a directory if it is missing and checks that files
+// can be created in it
+func checkWritable(dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("cannot create %s: %w", dir, err)
+	}
+	f, err := os.CreateTemp(dir, ".whoen-check-*")
+	if err != nil {
+		return fmt.Errorf("cannot write to %s: %w", dir, err)
+	}
+	f.Close()
+	os.Remove(f.Name())
+	return nil
+}
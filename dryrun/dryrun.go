@@ -0,0 +1,224 @@
+// Package dryrun records the blocks whoen would have made while running in
+// dry-run mode and summarizes them against the traffic that was actually served
+package dryrun
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Record kinds
+const (
+	KindDecision = "decision" // An IP would have been blocked
+	KindRequest  = "request"  // A request was served that a block would have rejected
+)
+
+// maxSamplePaths caps the non-malicious paths kept per IP in a report
+const maxSamplePaths = 5
+
+// Record is a single entry in the dry-run dataset
+type Record struct {
+	Time      time.Time     `json:"time"`
+	Kind      string        `json:"kind"`
+	IP        string        `json:"ip"`
+	Path      string        `json:"path"`
+	Pattern   string        `json:"pattern,omitempty"`   // Pattern that triggered a decision
+	Permanent bool          `json:"permanent,omitempty"` // Whether a decision would have been a permanent ban
+	Until     time.Time     `json:"until,omitempty"`     // When a temporary block would have expired
+	Duration  time.Duration `json:"duration,omitempty"`  // How long a temporary block would have lasted
+	Malicious bool          `json:"malicious,omitempty"` // Whether a served request matched a malicious pattern
+}
+
+// Recorder stores dry-run records
+type Recorder interface {
+	Record(record Record) error
+}
+
+// FileRecorder appends dry-run records to a JSON Lines file
+type FileRecorder struct {
+	path  string
+	mutex sync.Mutex
+}
+
+// NewFileRecorder creates a FileRecorder. The file is created on the first record.
+func NewFileRecorder(path string) *FileRecorder {
+	return &FileRecorder{path: path}
+}
+
+// Record appends a record to the file
+func (r *FileRecorder) Record(record Record) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if record.Time.IsZero() {
+		record.Time = time.Now()
+	}
+
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(r.path), 0755); err != nil {
+		return fmt.Errorf("failed to create dry-run directory: %w", err)
+	}
+
+	f, err := os.OpenFile(r.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open dry-run file %s: %w", r.path, err)
+	}
+	defer f.Close()
+
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		return fmt.Errorf("failed to write dry-run file %s: %w", r.path, err)
+	}
+	return nil
+}
+
+// ReadFile reads all records from a dry-run file. A missing file has no records.
+func ReadFile(path string) ([]Record, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open dry-run file %s: %w", path, err)
+	}
+	defer f.Close()
+
+	var records []Record
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var record Record
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			return nil, fmt.Errorf("invalid record on line %d of %s: %w", line, path, err)
+		}
+		records = append(records, record)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read dry-run file %s: %w", path, err)
+	}
+	return records, nil
+}
+
+// Report compares the blocks whoen would have made with the traffic that was served
+type Report struct {
+	From time.Time `json:"from"` // Time of the first record
+	To   time.Time `json:"to"`   // Time of the last record
+
+	Decisions     int `json:"decisions"`      // Blocks that would have been made
+	PermanentBans int `json:"permanent_bans"` // Decisions that would have been permanent bans
+	IPs           int `json:"ips"`            // Distinct IPs that would have been blocked
+
+	// Requests served that a block would have rejected, split into those to
+	// malicious paths and the rest. Other requests are the false-positive
+	// risk: traffic an enforcing whoen would have turned away.
+	WouldReject          int `json:"would_reject"`
+	WouldRejectMalicious int `json:"would_reject_malicious"`
+	WouldRejectOther     int `json:"would_reject_other"`
+	IPsWithOtherTraffic  int `json:"ips_with_other_traffic"`
+
+	ByIP []IPReport `json:"by_ip"` // Most other traffic first
+}
+
+// IPReport summarizes the dry-run records of one IP
+type IPReport struct {
+	IP                   string        `json:"ip"`
+	Decisions            int           `json:"decisions"`
+	Permanent            bool          `json:"permanent,omitempty"`
+	BlockedFor           time.Duration `json:"blocked_for"` // Total length of its temporary blocks
+	WouldReject          int           `json:"would_reject"`
+	WouldRejectMalicious int           `json:"would_reject_malicious"`
+	WouldRejectOther     int           `json:"would_reject_other"`
+	OtherPaths           []string      `json:"other_paths,omitempty"` // Sample of the non-malicious paths requested
+}
+
+// Summarize builds a report from dry-run records
+func Summarize(records []Record) Report {
+	var report Report
+	byIP := make(map[string]*IPReport)
+
+	for _, record := range records {
+		// Track the covered time range
+		if report.From.IsZero() || record.Time.Before(report.From) {
+			report.From = record.Time
+		}
+		if record.Time.After(report.To) {
+			report.To = record.Time
+		}
+
+		ipReport, ok := byIP[record.IP]
+		if !ok {
+			ipReport = &IPReport{IP: record.IP}
+			byIP[record.IP] = ipReport
+		}
+
+		switch record.Kind {
+		case KindDecision:
+			report.Decisions++
+			ipReport.Decisions++
+			if record.Permanent {
+				report.PermanentBans++
+				ipReport.Permanent = true
+			} else {
+				ipReport.BlockedFor += record.Duration
+			}
+		case KindRequest:
+			report.WouldReject++
+			ipReport.WouldReject++
+			if record.Malicious {
+				report.WouldRejectMalicious++
+				ipReport.WouldRejectMalicious++
+			} else {
+				report.WouldRejectOther++
+				ipReport.WouldRejectOther++
+				if len(ipReport.OtherPaths) < maxSamplePaths && !contains(ipReport.OtherPaths, record.Path) {
+					ipReport.OtherPaths = append(ipReport.OtherPaths, record.Path)
+				}
+			}
+		}
+	}
+
+	// Count the IPs and those that sent more than malicious requests
+	for _, ipReport := range byIP {
+		report.IPs++
+		if ipReport.WouldRejectOther > 0 {
+			report.IPsWithOtherTraffic++
+		}
+		report.ByIP = append(report.ByIP, *ipReport)
+	}
+
+	// Show the IPs with the most collateral traffic first
+	sort.Slice(report.ByIP, func(i, j int) bool {
+		a, b := report.ByIP[i], report.ByIP[j]
+		if a.WouldRejectOther != b.WouldRejectOther {
+			return a.WouldRejectOther > b.WouldRejectOther
+		}
+		if a.WouldReject != b.WouldReject {
+			return a.WouldReject > b.WouldReject
+		}
+		return a.IP < b.IP
+	})
+
+	return report
+}
+
+// contains checks if a slice contains a string
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
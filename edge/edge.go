@@ -0,0 +1,121 @@
+// Package edge mirrors the blocklist to edge services such as CDN firewall
+// lists. Providers only receive the IPs added and removed since the last sync,
+// with a periodic full reconciliation to repair drift, so provider API rate
+// limits are respected while the edge stays fresh.
+package edge
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Provider applies blocklist changes to an edge service
+type Provider interface {
+	// Add blocks IPs at the edge
+	Add(ctx context.Context, ips []string) error
+
+	// Remove lifts the edge block of IPs
+	Remove(ctx context.Context, ips []string) error
+
+	// List returns every IP currently blocked at the edge, for full reconciliation
+	List(ctx context.Context) ([]string, error)
+}
+
+// DefaultFullSyncInterval is how often a Syncer reconciles against the provider's list
+const DefaultFullSyncInterval = time.Hour
+
+// Result describes the changes sent to the provider by a sync
+type Result struct {
+	Added   int  `json:"added"`
+	Removed int  `json:"removed"`
+	Full    bool `json:"full"` // Whether the sync reconciled against the provider's list
+}
+
+// Syncer sends blocklist changes to a Provider
+type Syncer struct {
+	provider         Provider
+	fullSyncInterval time.Duration
+
+	mutex    sync.Mutex
+	known    map[string]bool // IPs believed to be blocked at the edge
+	lastFull time.Time
+}
+
+// NewSyncer creates a Syncer that reconciles against the provider's list every
+// fullSyncInterval, or DefaultFullSyncInterval if it is zero
+func NewSyncer(provider Provider, fullSyncInterval time.Duration) *Syncer {
+	if fullSyncInterval <= 0 {
+		fullSyncInterval = DefaultFullSyncInterval
+	}
+	return &Syncer{
+		provider:         provider,
+		fullSyncInterval: fullSyncInterval,
+	}
+}
+
+// Sync makes the edge block exactly the desired IPs. It only sends the
+// difference to the state after the previous sync, except on the first sync,
+// after a failed sync and once the full sync interval has passed, when it
+// compares against the provider's list instead.
+func (s *Syncer) Sync(ctx context.Context, desired []string) (Result, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	result := Result{}
+	if s.known == nil || time.Since(s.lastFull) >= s.fullSyncInterval {
+		current, err := s.provider.List(ctx)
+		if err != nil {
+			return result, fmt.Errorf("failed to list edge blocks: %w", err)
+		}
+		s.known = toSet(current)
+		s.lastFull = time.Now()
+		result.Full = true
+	}
+
+	want := toSet(desired)
+	add := difference(want, s.known)
+	remove := difference(s.known, want)
+
+	if len(add) > 0 {
+		if err := s.provider.Add(ctx, add); err != nil {
+			// The edge state is unknown now, so reconcile on the next sync
+			s.known = nil
+			return result, fmt.Errorf("failed to add edge blocks: %w", err)
+		}
+		result.Added = len(add)
+	}
+	if len(remove) > 0 {
+		if err := s.provider.Remove(ctx, remove); err != nil {
+			s.known = nil
+			return result, fmt.Errorf("failed to remove edge blocks: %w", err)
+		}
+		result.Removed = len(remove)
+	}
+
+	s.known = want
+	return result, nil
+}
+
+// toSet converts a list of IPs to a set
+func toSet(ips []string) map[string]bool {
+	set := make(map[string]bool, len(ips))
+	for _, ip := range ips {
+		set[ip] = true
+	}
+	return set
+}
+
+// difference returns the sorted IPs in a that are not in b
+func difference(a, b map[string]bool) []string {
+	var diff []string
+	for ip := range a {
+		if !b[ip] {
+			diff = append(diff, ip)
+		}
+	}
+	sort.Strings(diff)
+	return diff
+}
@@ -0,0 +1,52 @@
+// Package events describes notable things that happen inside the middleware,
+// so applications can react to them without parsing log output
+package events
+
+import "time"
+
+// Event types
+const (
+	StorageReadOnly     = "storage_read_only"    // Storage location is read-only, persistence switched to memory only
+	PermanentBanReview  = "permanent_ban_review" // A permanent ban passed the review age and should be reconsidered
+	FileReloaded        = "file_reloaded"        // A patterns or whitelist file was reloaded after a change
+	RampAdvanced        = "ramp_advanced"        // The enforcement ramp moved to its next stage
+	ChallengeIssued     = "challenge_issued"     // An IP over the threshold is challenged before being blocked
+	ChallengePassed     = "challenge_passed"     // A client solved the challenge of its IP
+	AttackStarted       = "attack_started"       // The block rate reached the attack threshold
+	AttackEnded         = "attack_ended"         // The block rate fell below the attack threshold again
+	LockdownStarted     = "lockdown_started"     // A lockdown tightened the policy for all clients
+	LockdownEnded       = "lockdown_ended"       // A lockdown ended and the normal policy is back
+	FirewallUnavailable = "firewall_unavailable" // The firewall commands failed their startup check
+	RequestDetected     = "request_detected"     // A request matched a pattern or payload signature
+	RulesTampered       = "rules_tampered"       // Firewall rules of blocked IPs were removed outside whoen and re-applied
+	PolicyWindowOpened  = "policy_window_opened" // A policy window opened and its overrides apply
+	PolicyWindowClosed  = "policy_window_closed" // A policy window closed and the normal policy is back
+	BlocksEvicted       = "blocks_evicted"       // Blocks were lifted early to stay within the block limit
+	SubnetBlocked       = "subnet_blocked"       // Enough IPs of a subnet were blocked that the whole subnet was
+	AppealRequested     = "appeal_requested"     // A blocked client asked for its block to be lifted and was sent a link
+	AppealGranted       = "appeal_granted"       // An appeal lifted a block and whitelisted the IP for a while
+)
+
+// Event is a single notable occurrence reported by the middleware
+type Event struct {
+	Type    string    `json:"type"`
+	Time    time.Time `json:"time"`
+	IP      string    `json:"ip,omitempty"`
+	Tenant  string    `json:"tenant,omitempty"` // See middleware.Options.Tenant
+	Path    string    `json:"path,omitempty"`
+	Message string    `json:"message,omitempty"`
+	Match   *Match    `json:"match,omitempty"` // What a detected request matched
+}
+
+// Match describes what a detected request matched and where
+type Match struct {
+	Pattern  string `json:"pattern"`
+	Category string `json:"category,omitempty"` // Payload category of query and body matches
+	Location string `json:"location"`           // "path", "query", "body" or "response"
+	Offset   int    `json:"offset"`             // Byte offset of the match in the inspected value
+	Matched  string `json:"matched"`            // Text that matched
+	Excerpt  string `json:"excerpt,omitempty"`  // Matched text with some context around it
+}
+
+// Handler receives events. Handlers are called synchronously and should return quickly.
+type Handler func(Event)
@@ -0,0 +1,222 @@
+// Package feeds subscribes to external threat feeds such as the FireHOL and
+// Emerging Threats blocklists. Each refresh downloads a feed, blocks its
+// entries for the feed's TTL and lifts the blocks of entries that dropped out
+// of it, so storage follows the feed without blocking addresses forever.
+package feeds
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/headswim/whoen/blocklist"
+	"github.com/headswim/whoen/ipaddr"
+	"github.com/headswim/whoen/storage"
+)
+
+// SourcePrefix starts the source of every block a feed makes, followed by
+// the feed's name, e.g. "feed:firehol_level1"
+const SourcePrefix = "feed:"
+
+// DefaultTTL is how long feed blocks last without a refresh when a Feed
+// has no TTL of its own
+const DefaultTTL = 24 * time.Hour
+
+// maxFeedSize bounds the download of a feed
+const maxFeedSize = 32 << 20
+
+// Names of the feeds Preset knows
+const (
+	FireHOLLevel1              = "firehol_level1"
+	EmergingThreatsBlock       = "et_block"
+	EmergingThreatsCompromised = "et_compromised"
+)
+
+// presets are the URLs and formats of the feeds Preset knows
+var presets = map[string]struct {
+	url    string
+	format blocklist.Format
+}{
+	FireHOLLevel1:              {"https://iplists.firehol.org/files/firehol_level1.netset", blocklist.FormatText},
+	EmergingThreatsBlock:       {"https://rules.emergingthreats.net/fwrules/emerging-Block-IPs.txt", blocklist.FormatText},
+	EmergingThreatsCompromised: {"https://rules.emergingthreats.net/blockrules/compromised-ips.txt", blocklist.FormatText},
+}
+
+// Feed is a blocklist downloaded from a URL. Its blocks are tagged with
+// Source and last TTL past the refresh that last listed them.
+type Feed struct {
+	Name   string           // Names the feed in block sources and logs
+	URL    string           // Where the blocklist is downloaded from
+	Format blocklist.Format // FormatText if empty
+	TTL    time.Duration    // DefaultTTL if zero; keep it longer than the refresh interval
+	Client *http.Client     // Defaults to a client with a 30 second timeout
+
+	mutex        sync.Mutex
+	etag         string
+	lastModified string
+	entries      []blocklist.Entry // Entries of the last download, reused while the feed is unchanged
+}
+
+// Result describes the changes a refresh made to storage
+type Result struct {
+	Entries   int  // Entries of the feed that were applied, after skipping
+	Blocked   int  // Blocks added or renewed
+	Lifted    int  // Blocks lifted because their entries dropped out of the feed
+	Unchanged bool // The server reported the feed unchanged since the last download
+}
+
+// Preset returns a feed known by name: FireHOLLevel1, EmergingThreatsBlock
+// or EmergingThreatsCompromised
+func Preset(name string) (*Feed, error) {
+	preset, ok := presets[strings.ToLower(name)]
+	if !ok {
+		return nil, fmt.Errorf("unknown feed %q, expected %s, %s, %s or an http(s) URL", name, FireHOLLevel1, EmergingThreatsBlock, EmergingThreatsCompromised)
+	}
+	return &Feed{Name: strings.ToLower(name), URL: preset.url, Format: preset.format}, nil
+}
+
+// Parse returns the feed named by spec: a preset name, or the URL of a plain
+// IP list, which also names the feed
+func Parse(spec string) (*Feed, error) {
+	spec = strings.TrimSpace(spec)
+	if strings.HasPrefix(spec, "http://") || strings.HasPrefix(spec, "https://") {
+		return &Feed{Name: spec, URL: spec, Format: blocklist.FormatText}, nil
+	}
+	return Preset(spec)
+}
+
+// Source returns the source of the blocks the feed makes
+func (f *Feed) Source() string {
+	return SourcePrefix + f.Name
+}
+
+// Refresh downloads the feed and applies it to storage: every entry is
+// blocked for the feed's TTL, and blocks tagged with the feed's source whose
+// entries are gone are lifted. Blocks from other sources are never weakened
+// or lifted. Entries skip returns true for are left out, as are private,
+// shared, loopback, link-local and multicast ranges, which feeds such as
+// FireHOL level1 list as bogons. A failed download or an empty feed leaves
+// storage alone, so the blocks run out after the TTL at the latest.
+func (f *Feed) Refresh(ctx context.Context, store storage.Storage, skip func(ip string) bool) (Result, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	result := Result{}
+	entries, unchanged, err := f.download(ctx)
+	if err != nil {
+		return result, err
+	}
+	result.Unchanged = unchanged
+
+	// Block the entries that are left after skipping
+	listed := make(map[string]bool, len(entries))
+	kept := make([]blocklist.Entry, 0, len(entries))
+	for _, entry := range entries {
+		if reserved(entry.IP) || (skip != nil && skip(entry.IP)) {
+			continue
+		}
+		listed[entry.IP] = true
+		kept = append(kept, blocklist.Entry{IP: entry.IP})
+	}
+	result.Entries = len(kept)
+
+	ttl := f.TTL
+	if ttl <= 0 {
+		ttl = DefaultTTL
+	}
+	result.Blocked, err = blocklist.ImportEntries(store, kept, blocklist.ImportOptions{Source: f.Source(), Duration: ttl})
+	if err != nil {
+		return result, fmt.Errorf("failed to apply feed %s: %w", f.Name, err)
+	}
+
+	// Lift the blocks of entries that dropped out
+	blockedIPs, err := store.GetBlockedIPs()
+	if err != nil {
+		return result, fmt.Errorf("failed to read blocked IPs for feed %s: %w", f.Name, err)
+	}
+	for _, status := range blockedIPs {
+		if status.Source != f.Source() || listed[status.IP] {
+			continue
+		}
+		if err := store.UnblockIP(status.IP); err != nil {
+			return result, fmt.Errorf("failed to lift %s, which dropped out of feed %s: %w", status.IP, f.Name, err)
+		}
+		result.Lifted++
+	}
+
+	return result, nil
+}
+
+// download fetches and parses the feed, or returns the entries of the last
+// download if the server reports the feed unchanged. The caller must hold
+// the lock.
+func (f *Feed) download(ctx context.Context) ([]blocklist.Entry, bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, f.URL, nil)
+	if err != nil {
+		return nil, false, err
+	}
+	if f.entries != nil {
+		if f.etag != "" {
+			req.Header.Set("If-None-Match", f.etag)
+		}
+		if f.lastModified != "" {
+			req.Header.Set("If-Modified-Since", f.lastModified)
+		}
+	}
+
+	client := f.Client
+	if client == nil {
+		client = &http.Client{Timeout: 30 * time.Second}
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to download feed %s: %w", f.Name, err)
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusNotModified && f.entries != nil:
+		return f.entries, true, nil
+	case resp.StatusCode != http.StatusOK:
+		return nil, false, fmt.Errorf("failed to download feed %s: %s", f.Name, resp.Status)
+	}
+
+	format := f.Format
+	if format == "" {
+		format = blocklist.FormatText
+	}
+	entries, err := blocklist.Parse(io.LimitReader(resp.Body, maxFeedSize), format)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to parse feed %s: %w", f.Name, err)
+	}
+
+	// An empty feed is more likely a broken mirror than a clean internet
+	if len(entries) == 0 {
+		return nil, false, fmt.Errorf("feed %s is empty", f.Name)
+	}
+
+	f.entries = entries
+	f.etag = resp.Header.Get("ETag")
+	f.lastModified = resp.Header.Get("Last-Modified")
+	return entries, false, nil
+}
+
+// sharedAddressSpace is the carrier-grade NAT range, which also carries
+// the client addresses of overlay networks such as Tailscale
+var sharedAddressSpace = netip.MustParsePrefix("100.64.0.0/10")
+
+// reserved reports whether an address or range lies in private, shared,
+// loopback, link-local, multicast or unspecified address space
+func reserved(entry string) bool {
+	prefix, err := ipaddr.ParsePrefix(entry)
+	if err != nil {
+		return true
+	}
+	addr := prefix.Addr()
+	return !addr.IsGlobalUnicast() || addr.IsPrivate() || sharedAddressSpace.Contains(addr)
+}
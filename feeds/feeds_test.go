@@ -0,0 +1,228 @@
+package feeds
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/headswim/whoen/kv"
+	"github.com/headswim/whoen/storage"
+)
+
+// feedServer serves a blocklist with an ETag and counts conditional requests
+type feedServer struct {
+	*httptest.Server
+
+	mutex       sync.Mutex
+	body        string
+	etag        string
+	status      int // Answered instead of the list when set
+	conditional int // Requests that carried If-None-Match
+}
+
+// newFeedServer starts a server for a blocklist, stopped when the test ends
+func newFeedServer(t *testing.T, body string) *feedServer {
+	s := &feedServer{body: body, etag: `"1"`}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+
+		if r.Header.Get("If-None-Match") != "" {
+			s.conditional++
+		}
+		switch {
+		case s.status != 0:
+			w.WriteHeader(s.status)
+		case r.Header.Get("If-None-Match") == s.etag:
+			w.WriteHeader(http.StatusNotModified)
+		default:
+			w.Header().Set("ETag", s.etag)
+			w.Write([]byte(s.body))
+		}
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+// set changes the list served, with a new ETag
+func (s *feedServer) set(body string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.body = body
+	s.etag += "1"
+}
+
+// fail makes the server answer with status, or serve the list again for 0
+func (s *feedServer) fail(status int) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.status = status
+}
+
+// conditionalRequests returns the number of requests that carried If-None-Match
+func (s *feedServer) conditionalRequests() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.conditional
+}
+
+// blocked returns the block of ip in store, or nil
+func blocked(t *testing.T, store storage.Storage, ip string) *storage.BlockStatus {
+	t.Helper()
+	isBlocked, status, err := store.IsIPBlocked(ip)
+	if err != nil {
+		t.Fatalf("IsIPBlocked(%s) failed: %v", ip, err)
+	}
+	if !isBlocked {
+		return nil
+	}
+	return status
+}
+
+// TestRefresh checks that a refresh blocks the feed's entries for its TTL,
+// skips reserved and skipped ones, reuses an unchanged feed and lifts the
+// blocks of entries that dropped out, but never blocks from elsewhere
+func TestRefresh(t *testing.T) {
+	server := newFeedServer(t, strings.Join([]string{
+		"# FireHOL style header",
+		"192.0.2.1",
+		"198.51.100.0/24 ; a range",
+		"10.0.0.0/8",   // Private
+		"100.64.1.1",   // Shared address space
+		"203.0.113.5",  // Blocked by hand already
+		"203.0.113.9",  // Skipped by the caller
+		"203.0.113.10", // Blocked by hand for a while
+		"",
+	}, "\n"))
+	store := storage.NewKVStorage(kv.NewMemory(), storage.KVOptions{})
+	store.BlockIP("203.0.113.5", time.Time{}, true, "/.env")
+	store.BlockIP("203.0.113.10", time.Now().Add(48*time.Hour), false, "/.env")
+
+	feed := &Feed{Name: "test", URL: server.URL, TTL: time.Hour}
+	skip := func(ip string) bool { return ip == "203.0.113.9" }
+	result, err := feed.Refresh(context.Background(), store, skip)
+	if err != nil {
+		t.Fatalf("Refresh failed: %v", err)
+	}
+	if result.Entries != 4 || result.Blocked != 2 || result.Lifted != 0 || result.Unchanged {
+		t.Errorf("Refresh = %+v, want 4 entries of which 2 blocked", result)
+	}
+	status := blocked(t, store, "198.51.100.0/24")
+	if status == nil || status.Source != "feed:test" || time.Until(status.BlockedUntil) > time.Hour || time.Until(status.BlockedUntil) < 59*time.Minute {
+		t.Errorf("range blocked with %+v, want a block from feed:test for an hour", status)
+	}
+	for _, ip := range []string{"10.0.0.0/8", "100.64.1.1", "203.0.113.9"} {
+		if blocked(t, store, ip) != nil {
+			t.Errorf("%s blocked, want it skipped", ip)
+		}
+	}
+	if status := blocked(t, store, "203.0.113.5"); status == nil || !status.IsPermanent || status.Source == "feed:test" {
+		t.Errorf("permanent block changed to %+v", status)
+	}
+
+	// The server reports the feed unchanged, and its entries are renewed
+	result, err = feed.Refresh(context.Background(), store, skip)
+	if err != nil || !result.Unchanged || result.Entries != 4 {
+		t.Errorf("Refresh of an unchanged feed = %+v, %v, want the entries reused", result, err)
+	}
+	if n := server.conditionalRequests(); n != 1 {
+		t.Errorf("%d conditional requests, want 1", n)
+	}
+
+	server.set("198.51.100.0/24\n")
+	result, err = feed.Refresh(context.Background(), store, skip)
+	if err != nil || result.Lifted != 1 || result.Unchanged {
+		t.Errorf("Refresh after entries dropped out = %+v, %v, want 1 lifted", result, err)
+	}
+	if blocked(t, store, "192.0.2.1") != nil {
+		t.Error("block of an entry that dropped out not lifted")
+	}
+	for _, ip := range []string{"198.51.100.0/24", "203.0.113.5", "203.0.113.10"} {
+		if blocked(t, store, ip) == nil {
+			t.Errorf("%s no longer blocked", ip)
+		}
+	}
+}
+
+// failingStorage fails to list the blocked IPs
+type failingStorage struct {
+	*storage.KVStorage
+}
+
+func (s failingStorage) GetBlockedIPs() ([]storage.BlockStatus, error) {
+	return nil, errors.New("storage down")
+}
+
+// TestRefreshErrors checks that failed downloads, empty feeds and invalid
+// entries are reported and leave the blocks in storage alone
+func TestRefreshErrors(t *testing.T) {
+	server := newFeedServer(t, "192.0.2.1\n")
+	store := storage.NewKVStorage(kv.NewMemory(), storage.KVOptions{})
+	feed := &Feed{Name: "test", URL: server.URL}
+	if _, err := feed.Refresh(context.Background(), store, nil); err != nil {
+		t.Fatalf("Refresh failed: %v", err)
+	}
+	if status := blocked(t, store, "192.0.2.1"); status == nil || time.Until(status.BlockedUntil) < DefaultTTL-time.Minute {
+		t.Fatalf("entry blocked with %+v, want a block for DefaultTTL", status)
+	}
+
+	tests := []struct {
+		name   string
+		body   string
+		status int
+		err    string
+	}{
+		{"server error", "", http.StatusInternalServerError, "500"},
+		{"not modified without a download", "", http.StatusNotModified, "304"},
+		{"empty", "# nothing listed today\n", 0, "is empty"},
+		{"invalid entry", "192.0.2.1\n192.0.2.300\n", 0, "line 2"},
+	}
+	for _, test := range tests {
+		server.set(test.body)
+		server.fail(test.status)
+		if test.status == http.StatusNotModified {
+			feed = &Feed{Name: "test", URL: server.URL}
+		}
+		_, err := feed.Refresh(context.Background(), store, nil)
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%s: Refresh = %v, want an error with %q", test.name, err, test.err)
+		}
+		if blocked(t, store, "192.0.2.1") == nil {
+			t.Errorf("%s: block lifted after a failed refresh", test.name)
+		}
+	}
+	server.fail(0)
+
+	server.Close()
+	if _, err := feed.Refresh(context.Background(), store, nil); err == nil {
+		t.Error("Refresh from a server that is down succeeded")
+	}
+
+	server = newFeedServer(t, "192.0.2.1\n")
+	feed = &Feed{Name: "test", URL: server.URL}
+	if _, err := feed.Refresh(context.Background(), failingStorage{store}, nil); err == nil || !strings.Contains(err.Error(), "storage down") {
+		t.Errorf("Refresh with a failing storage = %v, want its error", err)
+	}
+}
+
+// TestParse checks feed specs: preset names in any case and list URLs
+func TestParse(t *testing.T) {
+	feed, err := Parse(" FireHOL_Level1 ")
+	if err != nil || feed.Name != FireHOLLevel1 || !strings.HasPrefix(feed.URL, "https://") || feed.Source() != "feed:firehol_level1" {
+		t.Errorf("Parse of a preset = %+v, %v", feed, err)
+	}
+	feed, err = Parse("https://example.com/list.txt")
+	if err != nil || feed.Name != feed.URL || feed.URL != "https://example.com/list.txt" {
+		t.Errorf("Parse of a URL = %+v, %v", feed, err)
+	}
+	for _, spec := range []string{"", "spamhaus", "ftp://example.com/list.txt"} {
+		if _, err := Parse(spec); err == nil {
+			t.Errorf("Parse(%q) succeeded, want an error", spec)
+		}
+	}
+}
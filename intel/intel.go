@@ -0,0 +1,98 @@
+// Package intel connects whoen to threat intelligence services. Providers
+// look up the reputation of blocked IPs, which is stored with the block, and
+// reporters share blocks back with the service, with the offending request as
+// evidence. Clients for AbuseIPDB and GreyNoise are included.
+package intel
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/headswim/whoen/storage"
+)
+
+// Reputation is a provider's view of an IP
+type Reputation = storage.Reputation
+
+// Provider looks up the reputation of IPs
+type Provider interface {
+	// Name identifies the provider in logs and stored reputations
+	Name() string
+
+	// Lookup returns the provider's view of an IP
+	Lookup(ctx context.Context, ip string) (Reputation, error)
+}
+
+// Reporter is implemented by providers that accept abuse reports
+type Reporter interface {
+	// Report tells the provider about a blocked IP
+	Report(ctx context.Context, report Report) error
+}
+
+// Report describes a block for a provider
+type Report struct {
+	IP      string
+	Path    string    // Request that triggered the block
+	Pattern string    // Pattern the request matched
+	Time    time.Time // When the IP was blocked
+}
+
+// Comment returns the evidence sent with a report
+func (r Report) Comment() string {
+	comment := fmt.Sprintf("Probed %s", r.Path)
+	if r.Pattern != "" && r.Pattern != r.Path {
+		comment += fmt.Sprintf(" (matched %s)", r.Pattern)
+	}
+	return comment + ", blocked by whoen"
+}
+
+// DefaultTimeout bounds each request of the included clients
+const DefaultTimeout = 10 * time.Second
+
+// newHTTPClient returns client, or one with DefaultTimeout if it is nil
+func newHTTPClient(client *http.Client) *http.Client {
+	if client != nil {
+		return client
+	}
+	return &http.Client{Timeout: DefaultTimeout}
+}
+
+// doJSON sends a request and decodes a JSON response into out. Responses
+// with a status in accept are decoded as well as 2xx ones.
+func doJSON(client *http.Client, req *http.Request, out any, accept ...int) error {
+	req.Header.Set("Accept", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return err
+	}
+
+	ok := resp.StatusCode >= 200 && resp.StatusCode < 300
+	for _, status := range accept {
+		ok = ok || resp.StatusCode == status
+	}
+	if !ok {
+		return fmt.Errorf("%s: %s", resp.Status, truncate(string(body), 200))
+	}
+	if err := json.Unmarshal(body, out); err != nil {
+		return fmt.Errorf("invalid response: %w", err)
+	}
+	return nil
+}
+
+// truncate shortens s to at most n bytes
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	return s[:n] + "..."
+}
@@ -0,0 +1,98 @@
+// Package ipaddr parses and normalizes the IP addresses and ranges whoen
+// works with, so the same client always maps to the same key in the blocker,
+// storage and whitelist whichever form its address arrives in
+package ipaddr
+
+import (
+	"net/netip"
+	"strings"
+)
+
+// Parse parses an IP address into its canonical form: IPv4-mapped IPv6
+// addresses such as ::ffff:192.0.2.1 become plain IPv4 addresses, and IPv6
+// zones are dropped
+func Parse(s string) (netip.Addr, error) {
+	addr, err := netip.ParseAddr(strings.TrimSpace(s))
+	if err != nil {
+		return netip.Addr{}, err
+	}
+	return Canonical(addr), nil
+}
+
+// Canonical returns the canonical form of an address, see Parse
+func Canonical(addr netip.Addr) netip.Addr {
+	return addr.Unmap().WithZone("")
+}
+
+// Normalize returns the canonical string form of an IP address, or s
+// unchanged if it is not one. Canonical IPv4 addresses are returned without
+// allocating.
+func Normalize(s string) string {
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return s
+	}
+	if addr.Is4() {
+		// ParseAddr only accepts the canonical dotted decimal form
+		return s
+	}
+	return Canonical(addr).String()
+}
+
+// Check returns the canonical string form of an IP address like Normalize,
+// or an error if s is not one
+func Check(s string) (string, error) {
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return "", err
+	}
+	if addr.Is4() {
+		return s, nil
+	}
+	return Canonical(addr).String(), nil
+}
+
+// ParsePrefix parses a CIDR range such as 10.0.0.0/8, or a single address as
+// a range of one. The range is masked, so 10.1.2.3/8 becomes 10.0.0.0/8, and
+// IPv4-mapped IPv6 ranges become IPv4 ranges.
+func ParsePrefix(s string) (netip.Prefix, error) {
+	s = strings.TrimSpace(s)
+	if !strings.Contains(s, "/") {
+		addr, err := Parse(s)
+		if err != nil {
+			return netip.Prefix{}, err
+		}
+		return Single(addr), nil
+	}
+
+	prefix, err := netip.ParsePrefix(s)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	return CanonicalPrefix(prefix), nil
+}
+
+// CanonicalPrefix returns the masked form of a range, as an IPv4 range if it
+// is an IPv4-mapped IPv6 range of at least /96
+func CanonicalPrefix(prefix netip.Prefix) netip.Prefix {
+	addr, bits := prefix.Addr(), prefix.Bits()
+	if addr.Is4In6() && bits >= 96 {
+		addr, bits = addr.Unmap(), bits-96
+	}
+	return netip.PrefixFrom(addr.WithZone(""), bits).Masked()
+}
+
+// Single returns the range holding only the canonical form of addr
+func Single(addr netip.Addr) netip.Prefix {
+	addr = Canonical(addr)
+	return netip.PrefixFrom(addr, addr.BitLen())
+}
+
+// String formats a range the way whoen stores it: a single address without
+// its prefix length, a wider range in CIDR notation
+func String(prefix netip.Prefix) string {
+	if prefix.IsSingleIP() {
+		return prefix.Addr().String()
+	}
+	return prefix.String()
+}
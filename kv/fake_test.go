@@ -0,0 +1,247 @@
+package kv_test
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/headswim/whoen/kv"
+)
+
+// fakeServer answers a wire protocol on a local port from an in-memory
+// store, and records the commands it was sent
+type fakeServer struct {
+	addr  string
+	store *kv.Memory
+
+	mutex    sync.Mutex
+	commands []string
+}
+
+// record notes a command the server was sent
+func (f *fakeServer) record(command string) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.commands = append(f.commands, command)
+}
+
+// Commands returns the commands the server was sent, oldest first
+func (f *fakeServer) Commands() []string {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return append([]string(nil), f.commands...)
+}
+
+// startFake listens on a local port and serves each connection with serve
+// until the test ends
+func startFake(t *testing.T, serve func(f *fakeServer, r *bufio.Reader, w io.Writer) error) *fakeServer {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	f := &fakeServer{addr: listener.Addr().String(), store: kv.NewMemory()}
+	go func() {
+		for {
+			c, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				r := bufio.NewReader(c)
+				for serve(f, r, c) == nil {
+				}
+			}()
+		}
+	}()
+	return f
+}
+
+// newFakeMemcached starts a server speaking the memcached text protocol.
+// Like memcached, it takes any token as a key, so a key with a space or
+// line break would run into the next command.
+func newFakeMemcached(t *testing.T) *fakeServer {
+	return startFake(t, func(f *fakeServer, r *bufio.Reader, w io.Writer) error {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		f.record(line)
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			_, err := io.WriteString(w, "ERROR\r\n")
+			return err
+		}
+		key := fields[1]
+
+		switch fields[0] {
+		case "get":
+			value, found, _ := f.store.Get(key)
+			if found {
+				fmt.Fprintf(w, "VALUE %s 0 %d\r\n%s\r\n", key, len(value), value)
+			}
+			_, err = io.WriteString(w, "END\r\n")
+		case "set", "add":
+			if len(fields) != 5 {
+				_, err = io.WriteString(w, "CLIENT_ERROR bad command line format\r\n")
+				return err
+			}
+			exptime, _ := strconv.ParseInt(fields[3], 10, 64)
+			size, _ := strconv.Atoi(fields[4])
+			value := make([]byte, size+2)
+			if _, err := io.ReadFull(r, value); err != nil {
+				return err
+			}
+			if _, found, _ := f.store.Get(key); found && fields[0] == "add" {
+				_, err = io.WriteString(w, "NOT_STORED\r\n")
+				return err
+			}
+			f.store.Set(key, value[:size], memcachedTTL(exptime))
+			_, err = io.WriteString(w, "STORED\r\n")
+		case "incr", "decr":
+			value, found, _ := f.store.Get(key)
+			if !found {
+				_, err = io.WriteString(w, "NOT_FOUND\r\n")
+				return err
+			}
+			current, parseErr := strconv.ParseInt(string(value), 10, 64)
+			if parseErr != nil {
+				_, err = io.WriteString(w, "CLIENT_ERROR cannot increment or decrement non-numeric value\r\n")
+				return err
+			}
+			delta, _ := strconv.ParseInt(fields[2], 10, 64)
+			if fields[0] == "decr" {
+				delta = -min(delta, current)
+			}
+			next, _ := f.store.Incr(key, delta)
+			_, err = fmt.Fprintf(w, "%d\r\n", next)
+		case "touch":
+			if _, found, _ := f.store.Get(key); !found {
+				_, err = io.WriteString(w, "NOT_FOUND\r\n")
+				return err
+			}
+			exptime, _ := strconv.ParseInt(fields[2], 10, 64)
+			f.store.Expire(key, memcachedTTL(exptime))
+			_, err = io.WriteString(w, "TOUCHED\r\n")
+		case "delete":
+			if _, found, _ := f.store.Get(key); !found {
+				_, err = io.WriteString(w, "NOT_FOUND\r\n")
+				return err
+			}
+			f.store.Delete(key)
+			_, err = io.WriteString(w, "DELETED\r\n")
+		default:
+			_, err = io.WriteString(w, "ERROR\r\n")
+		}
+		return err
+	})
+}
+
+// memcachedTTL converts a memcached expiry, seconds or a Unix timestamp,
+// to a time to live
+func memcachedTTL(exptime int64) time.Duration {
+	if exptime > 30*24*60*60 {
+		return time.Until(time.Unix(exptime, 0))
+	}
+	return time.Duration(exptime) * time.Second
+}
+
+// newFakeValkey starts a server speaking RESP, requiring AUTH with password
+// when it is set
+func newFakeValkey(t *testing.T, password string) *fakeServer {
+	return startFake(t, func(f *fakeServer, r *bufio.Reader, w io.Writer) error {
+		args, err := readCommand(r)
+		if err != nil {
+			return err
+		}
+		f.record(strings.Join(args, " "))
+		name := strings.ToUpper(args[0])
+
+		switch {
+		case name == "AUTH":
+			if args[len(args)-1] != password {
+				_, err = io.WriteString(w, "-WRONGPASS invalid username-password pair\r\n")
+				return err
+			}
+			_, err = io.WriteString(w, "+OK\r\n")
+		case name == "SELECT":
+			_, err = io.WriteString(w, "+OK\r\n")
+		case name == "GET" && len(args) == 2:
+			value, found, _ := f.store.Get(args[1])
+			if !found {
+				_, err = io.WriteString(w, "$-1\r\n")
+				return err
+			}
+			_, err = fmt.Fprintf(w, "$%d\r\n%s\r\n", len(value), value)
+		case name == "SET" && (len(args) == 3 || len(args) == 5):
+			var ttl time.Duration
+			if len(args) == 5 {
+				millis, _ := strconv.ParseInt(args[4], 10, 64)
+				ttl = time.Duration(millis) * time.Millisecond
+			}
+			f.store.Set(args[1], []byte(args[2]), ttl)
+			_, err = io.WriteString(w, "+OK\r\n")
+		case name == "INCRBY" && len(args) == 3:
+			delta, _ := strconv.ParseInt(args[2], 10, 64)
+			value, incrErr := f.store.Incr(args[1], delta)
+			if incrErr != nil {
+				_, err = io.WriteString(w, "-ERR value is not an integer or out of range\r\n")
+				return err
+			}
+			_, err = fmt.Fprintf(w, ":%d\r\n", value)
+		case (name == "PEXPIRE" && len(args) == 3) || (name == "PERSIST" && len(args) == 2):
+			var ttl time.Duration
+			if name == "PEXPIRE" {
+				millis, _ := strconv.ParseInt(args[2], 10, 64)
+				ttl = time.Duration(millis) * time.Millisecond
+			}
+			f.store.Expire(args[1], ttl)
+			_, err = io.WriteString(w, ":1\r\n")
+		case name == "DEL" && len(args) == 2:
+			f.store.Delete(args[1])
+			_, err = io.WriteString(w, ":1\r\n")
+		default:
+			_, err = fmt.Fprintf(w, "-ERR unknown command '%s'\r\n", args[0])
+		}
+		return err
+	})
+}
+
+// readCommand reads a RESP array of bulk strings
+func readCommand(r *bufio.Reader) ([]string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	count, err := strconv.Atoi(strings.TrimRight(strings.TrimPrefix(line, "*"), "\r\n"))
+	if err != nil || count < 1 {
+		return nil, fmt.Errorf("invalid command %q", line)
+	}
+	args := make([]string, count)
+	for i := range args {
+		if line, err = r.ReadString('\n'); err != nil {
+			return nil, err
+		}
+		size, err := strconv.Atoi(strings.TrimRight(strings.TrimPrefix(line, "$"), "\r\n"))
+		if err != nil {
+			return nil, fmt.Errorf("invalid argument %q", line)
+		}
+		arg := make([]byte, size+2)
+		if _, err := io.ReadFull(r, arg); err != nil {
+			return nil, err
+		}
+		args[i] = string(arg[:size])
+	}
+	return args, nil
+}
@@ -0,0 +1,141 @@
+// Package kv provides the small key-value interface storage.KVStorage is
+// built on, with clients for memcached and Valkey (or Redis) and an in-memory
+// store. The clients speak the wire protocols directly and need no extra
+// dependencies.
+package kv
+
+import (
+	"errors"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// MaxKeyLength is the longest key memcached takes, in bytes
+const MaxKeyLength = 250
+
+// Store is a key-value store. Keys are ASCII strings of at most MaxKeyLength
+// bytes without spaces or control characters; clients that cannot send
+// other keys safely reject them with ErrInvalidKey.
+type Store interface {
+	// Get returns the value of a key, and false if it does not exist
+	Get(key string) ([]byte, bool, error)
+
+	// Set stores a value. A ttl of zero keeps it until it is deleted.
+	Set(key string, value []byte, ttl time.Duration) error
+
+	// Incr adds delta to the integer value of a key, creating the key at zero
+	// if it does not exist, and returns the new value
+	Incr(key string, delta int64) (int64, error)
+
+	// Expire sets the time to live of an existing key, zero to keep it until
+	// it is deleted. Missing keys are ignored.
+	Expire(key string, ttl time.Duration) error
+
+	// Delete removes a key. Missing keys are ignored.
+	Delete(key string) error
+}
+
+// ErrNotInteger is returned by Incr when the key holds a value that is not an integer
+var ErrNotInteger = errors.New("kv: value is not an integer")
+
+// ErrInvalidKey is returned for keys that are empty, longer than
+// MaxKeyLength or hold spaces or control characters
+var ErrInvalidKey = errors.New("kv: invalid key")
+
+// Memory is a Store that keeps its keys in process memory. It suits tests and
+// single instances that want KVStorage semantics without a server.
+type Memory struct {
+	mutex sync.Mutex
+	items map[string]memoryItem
+}
+
+// memoryItem is a value and its expiry, zero for none
+type memoryItem struct {
+	value   []byte
+	expires time.Time
+}
+
+// NewMemory creates an empty in-memory store
+func NewMemory() *Memory {
+	return &Memory{items: make(map[string]memoryItem)}
+}
+
+// item returns the unexpired item of a key. The caller must hold the lock.
+func (m *Memory) item(key string) (memoryItem, bool) {
+	item, ok := m.items[key]
+	if ok && !item.expires.IsZero() && !time.Now().Before(item.expires) {
+		delete(m.items, key)
+		return memoryItem{}, false
+	}
+	return item, ok
+}
+
+// Get returns the value of a key
+func (m *Memory) Get(key string) ([]byte, bool, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	item, ok := m.item(key)
+	if !ok {
+		return nil, false, nil
+	}
+	return append([]byte(nil), item.value...), true, nil
+}
+
+// Set stores a value
+func (m *Memory) Set(key string, value []byte, ttl time.Duration) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.items[key] = memoryItem{value: append([]byte(nil), value...), expires: expiry(ttl)}
+	return nil
+}
+
+// Incr adds delta to the integer value of a key
+func (m *Memory) Incr(key string, delta int64) (int64, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	item, _ := m.item(key)
+	var value int64
+	if item.value != nil {
+		var err error
+		if value, err = strconv.ParseInt(string(item.value), 10, 64); err != nil {
+			return 0, ErrNotInteger
+		}
+	}
+	value += delta
+	item.value = []byte(strconv.FormatInt(value, 10))
+	m.items[key] = item
+	return value, nil
+}
+
+// Expire sets the time to live of an existing key
+func (m *Memory) Expire(key string, ttl time.Duration) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if item, ok := m.item(key); ok {
+		item.expires = expiry(ttl)
+		m.items[key] = item
+	}
+	return nil
+}
+
+// Delete removes a key
+func (m *Memory) Delete(key string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	delete(m.items, key)
+	return nil
+}
+
+// expiry returns when a value with the given time to live expires, zero for none
+func expiry(ttl time.Duration) time.Time {
+	if ttl <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(ttl)
+}
@@ -0,0 +1,163 @@
+package kv_test
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/headswim/whoen/kv"
+)
+
+// testRoundTrip checks the Store contract on a store: values, counters,
+// expiry and deletion
+func testRoundTrip(t *testing.T, store kv.Store) {
+	t.Helper()
+
+	if _, found, err := store.Get("missing"); err != nil || found {
+		t.Errorf("Get of a missing key = %v, %v, want not found", found, err)
+	}
+	if err := store.Set("key", []byte("line one\r\nEND\r\n"), 0); err != nil {
+		t.Fatalf("Set failed: %v", err)
+	}
+	if value, found, err := store.Get("key"); err != nil || !found || string(value) != "line one\r\nEND\r\n" {
+		t.Errorf("Get = %q, %v, %v, want the value set", value, found, err)
+	}
+
+	if value, err := store.Incr("counter", 3); err != nil || value != 3 {
+		t.Errorf("Incr of a new key = %d, %v, want 3", value, err)
+	}
+	if value, err := store.Incr("counter", 2); err != nil || value != 5 {
+		t.Errorf("Incr = %d, %v, want 5", value, err)
+	}
+	if value, err := store.Incr("counter", -4); err != nil || value != 1 {
+		t.Errorf("Incr by -4 = %d, %v, want 1", value, err)
+	}
+	if _, err := store.Incr("key", 1); !errors.Is(err, kv.ErrNotInteger) {
+		t.Errorf("Incr of a text value: %v, want ErrNotInteger", err)
+	}
+
+	if err := store.Set("short", []byte("x"), 10*time.Millisecond); err != nil {
+		t.Fatalf("Set with a TTL failed: %v", err)
+	}
+	if err := store.Expire("counter", time.Hour); err != nil {
+		t.Errorf("Expire failed: %v", err)
+	}
+	if err := store.Expire("missing", time.Hour); err != nil {
+		t.Errorf("Expire of a missing key: %v, want it ignored", err)
+	}
+	time.Sleep(1100 * time.Millisecond)
+	if _, found, _ := store.Get("short"); found {
+		t.Error("value outlived its TTL")
+	}
+	if _, found, _ := store.Get("counter"); !found {
+		t.Error("counter with a TTL of an hour expired")
+	}
+
+	if err := store.Delete("key"); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	if _, found, _ := store.Get("key"); found {
+		t.Error("deleted key still found")
+	}
+	if err := store.Delete("missing"); err != nil {
+		t.Errorf("Delete of a missing key: %v, want it ignored", err)
+	}
+}
+
+// closedAddr returns an address nothing listens on
+func closedAddr(t *testing.T) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	addr := listener.Addr().String()
+	listener.Close()
+	return addr
+}
+
+func TestMemoryRoundTrip(t *testing.T) {
+	testRoundTrip(t, kv.NewMemory())
+}
+
+func TestMemcachedRoundTrip(t *testing.T) {
+	server := newFakeMemcached(t)
+	client := kv.NewMemcached(server.addr, kv.Options{})
+	defer client.Close()
+	testRoundTrip(t, client)
+}
+
+// TestMemcachedRejectsInvalidKeys checks that keys that would end the
+// command line early or exceed memcached's limit never reach the server
+func TestMemcachedRejectsInvalidKeys(t *testing.T) {
+	server := newFakeMemcached(t)
+	client := kv.NewMemcached(server.addr, kv.Options{})
+	defer client.Close()
+
+	keys := []string{"", "a b", "a\r\nflush_all", "a\x00", strings.Repeat("k", kv.MaxKeyLength+1)}
+	for _, key := range keys {
+		if _, _, err := client.Get(key); !errors.Is(err, kv.ErrInvalidKey) {
+			t.Errorf("Get(%q): %v, want ErrInvalidKey", key, err)
+		}
+		if err := client.Set(key, []byte("1"), 0); !errors.Is(err, kv.ErrInvalidKey) {
+			t.Errorf("Set(%q): %v, want ErrInvalidKey", key, err)
+		}
+		if _, err := client.Incr(key, 1); !errors.Is(err, kv.ErrInvalidKey) {
+			t.Errorf("Incr(%q): %v, want ErrInvalidKey", key, err)
+		}
+		if err := client.Expire(key, time.Hour); !errors.Is(err, kv.ErrInvalidKey) {
+			t.Errorf("Expire(%q): %v, want ErrInvalidKey", key, err)
+		}
+		if err := client.Delete(key); !errors.Is(err, kv.ErrInvalidKey) {
+			t.Errorf("Delete(%q): %v, want ErrInvalidKey", key, err)
+		}
+	}
+	if commands := server.Commands(); len(commands) != 0 {
+		t.Errorf("server was sent %q, want nothing", commands)
+	}
+
+	if err := client.Set(strings.Repeat("k", kv.MaxKeyLength), []byte("1"), 0); err != nil {
+		t.Errorf("Set with a key of MaxKeyLength bytes: %v", err)
+	}
+}
+
+func TestMemcachedUnreachable(t *testing.T) {
+	client := kv.NewMemcached(closedAddr(t), kv.Options{Timeout: time.Second})
+	if _, _, err := client.Get("key"); err == nil {
+		t.Error("Get on an unreachable server succeeded")
+	}
+}
+
+func TestValkeyRoundTrip(t *testing.T) {
+	server := newFakeValkey(t, "secret")
+	client := kv.NewValkey(server.addr, kv.Options{Password: "secret", DB: 2})
+	defer client.Close()
+	testRoundTrip(t, client)
+
+	// Arguments are length-prefixed, so a key with a line break stays one key
+	if err := client.Set("a\r\nDEL b", []byte("1"), 0); err != nil {
+		t.Fatalf("Set failed: %v", err)
+	}
+	if value, found, err := client.Get("a\r\nDEL b"); err != nil || !found || string(value) != "1" {
+		t.Errorf("Get = %q, %v, %v, want the value set", value, found, err)
+	}
+	if commands := server.Commands(); commands[0] != "AUTH secret" || commands[1] != "SELECT 2" {
+		t.Errorf("connection set up with %q, want AUTH and SELECT", commands[:2])
+	}
+}
+
+func TestValkeyErrors(t *testing.T) {
+	server := newFakeValkey(t, "secret")
+	client := kv.NewValkey(server.addr, kv.Options{Password: "wrong"})
+	defer client.Close()
+	if _, _, err := client.Get("key"); err == nil || !strings.Contains(err.Error(), "WRONGPASS") {
+		t.Errorf("Get with a wrong password: %v, want WRONGPASS", err)
+	}
+
+	unreachable := kv.NewValkey(closedAddr(t), kv.Options{Timeout: time.Second})
+	if _, _, err := unreachable.Get("key"); err == nil {
+		t.Error("Get on an unreachable server succeeded")
+	}
+}
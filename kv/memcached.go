@@ -0,0 +1,237 @@
+package kv
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// memcachedMaxRelative is the longest expiry memcached takes as a relative
+// time, longer ones must be sent as a Unix timestamp
+const memcachedMaxRelative = 30 * 24 * time.Hour
+
+// Memcached is a Store on a memcached server, using the text protocol
+type Memcached struct {
+	pool *pool
+}
+
+// NewMemcached creates a client for the memcached server at addr
+// (host:port). Connections are dialed on first use.
+func NewMemcached(addr string, options Options) *Memcached {
+	return &Memcached{pool: newPool(addr, options.withDefaults(), nil)}
+}
+
+// Get returns the value of a key
+func (m *Memcached) Get(key string) ([]byte, bool, error) {
+	if err := memcachedKey(key); err != nil {
+		return nil, false, err
+	}
+
+	var value []byte
+	var found bool
+	err := m.pool.do(func(c *conn) error {
+		if _, err := fmt.Fprintf(c, "get %s\r\n", key); err != nil {
+			return err
+		}
+		line, err := readLine(c)
+		if err != nil {
+			return err
+		}
+		if line == "END" {
+			return nil
+		}
+
+		// VALUE <key> <flags> <bytes>
+		fields := strings.Fields(line)
+		if len(fields) != 4 || fields[0] != "VALUE" {
+			return memcachedError(line)
+		}
+		size, err := strconv.Atoi(fields[3])
+		if err != nil {
+			return fmt.Errorf("kv: invalid memcached response %q", line)
+		}
+		value = make([]byte, size+2)
+		if _, err := io.ReadFull(c.reader, value); err != nil {
+			return err
+		}
+		value, found = value[:size], true
+		if line, err = readLine(c); err != nil {
+			return err
+		}
+		if line != "END" {
+			return memcachedError(line)
+		}
+		return nil
+	})
+	return value, found, err
+}
+
+// Set stores a value
+func (m *Memcached) Set(key string, value []byte, ttl time.Duration) error {
+	_, err := m.store("set", key, value, ttl)
+	return err
+}
+
+// Incr adds delta to the integer value of a key. Memcached counters are
+// unsigned, so a negative delta stops at zero.
+func (m *Memcached) Incr(key string, delta int64) (int64, error) {
+	if err := memcachedKey(key); err != nil {
+		return 0, err
+	}
+
+	command, amount := "incr", delta
+	if delta < 0 {
+		command, amount = "decr", -delta
+	}
+
+	for {
+		var value int64
+		var found bool
+		err := m.pool.do(func(c *conn) error {
+			if _, err := fmt.Fprintf(c, "%s %s %d\r\n", command, key, amount); err != nil {
+				return err
+			}
+			line, err := readLine(c)
+			if err != nil {
+				return err
+			}
+			if line == "NOT_FOUND" {
+				return nil
+			}
+			if value, err = strconv.ParseInt(line, 10, 64); err != nil {
+				if strings.HasPrefix(line, "CLIENT_ERROR") {
+					return ErrNotInteger
+				}
+				return memcachedError(line)
+			}
+			found = true
+			return nil
+		})
+		if err != nil || found {
+			return value, err
+		}
+
+		// Create the counter, unless another client just did
+		initial := max(delta, 0)
+		stored, err := m.store("add", key, []byte(strconv.FormatInt(initial, 10)), 0)
+		if err != nil || stored {
+			return initial, err
+		}
+	}
+}
+
+// Expire sets the time to live of an existing key
+func (m *Memcached) Expire(key string, ttl time.Duration) error {
+	if err := memcachedKey(key); err != nil {
+		return err
+	}
+
+	return m.pool.do(func(c *conn) error {
+		if _, err := fmt.Fprintf(c, "touch %s %d\r\n", key, memcachedExpiry(ttl)); err != nil {
+			return err
+		}
+		line, err := readLine(c)
+		if err != nil {
+			return err
+		}
+		if line != "TOUCHED" && line != "NOT_FOUND" {
+			return memcachedError(line)
+		}
+		return nil
+	})
+}
+
+// Delete removes a key
+func (m *Memcached) Delete(key string) error {
+	if err := memcachedKey(key); err != nil {
+		return err
+	}
+
+	return m.pool.do(func(c *conn) error {
+		if _, err := fmt.Fprintf(c, "delete %s\r\n", key); err != nil {
+			return err
+		}
+		line, err := readLine(c)
+		if err != nil {
+			return err
+		}
+		if line != "DELETED" && line != "NOT_FOUND" {
+			return memcachedError(line)
+		}
+		return nil
+	})
+}
+
+// Close closes the idle connections
+func (m *Memcached) Close() error {
+	return m.pool.close()
+}
+
+// store runs a storage command and reports whether the value was stored
+func (m *Memcached) store(command, key string, value []byte, ttl time.Duration) (bool, error) {
+	if err := memcachedKey(key); err != nil {
+		return false, err
+	}
+
+	var stored bool
+	err := m.pool.do(func(c *conn) error {
+		if _, err := fmt.Fprintf(c, "%s %s 0 %d %d\r\n%s\r\n", command, key, memcachedExpiry(ttl), len(value), value); err != nil {
+			return err
+		}
+		line, err := readLine(c)
+		if err != nil {
+			return err
+		}
+		switch line {
+		case "STORED":
+			stored = true
+		case "NOT_STORED":
+		default:
+			return memcachedError(line)
+		}
+		return nil
+	})
+	return stored, err
+}
+
+// memcachedExpiry converts a time to live to memcached's expiry: seconds,
+// rounded up, or a Unix timestamp beyond 30 days
+func memcachedExpiry(ttl time.Duration) int64 {
+	if ttl <= 0 {
+		return 0
+	}
+	if ttl > memcachedMaxRelative {
+		return time.Now().Add(ttl).Unix()
+	}
+	return int64((ttl + time.Second - 1) / time.Second)
+}
+
+// memcachedKey rejects keys memcached does not take, which would otherwise end
+// the command line early or run into another command
+func memcachedKey(key string) error {
+	if key == "" || len(key) > MaxKeyLength {
+		return fmt.Errorf("%w: %d bytes", ErrInvalidKey, len(key))
+	}
+	for i := 0; i < len(key); i++ {
+		if key[i] <= ' ' || key[i] == 0x7f {
+			return fmt.Errorf("%w: %q", ErrInvalidKey, key)
+		}
+	}
+	return nil
+}
+
+// memcachedError turns an unexpected response line into an error
+func memcachedError(line string) error {
+	return fmt.Errorf("kv: memcached: %s", line)
+}
+
+// readLine reads a CRLF terminated line
+func readLine(c *conn) (string, error) {
+	line, err := c.reader.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
@@ -0,0 +1,127 @@
+package kv
+
+import (
+	"bufio"
+	"net"
+	"time"
+)
+
+// Connection defaults of the network clients
+const (
+	DefaultPoolSize = 8
+	DefaultTimeout  = 2 * time.Second
+)
+
+// Options holds the connection settings of the network clients
+type Options struct {
+	// PoolSize is the number of idle connections kept open. Defaults to
+	// DefaultPoolSize.
+	PoolSize int
+
+	// Timeout bounds dialing and each command. Defaults to DefaultTimeout.
+	Timeout time.Duration
+
+	// Password authenticates Valkey connections, with Username if the server
+	// uses ACL users. Ignored by memcached.
+	Username string
+	Password string
+
+	// DB selects the Valkey database. Ignored by memcached.
+	DB int
+}
+
+// withDefaults fills in the unset options
+func (o Options) withDefaults() Options {
+	if o.PoolSize <= 0 {
+		o.PoolSize = DefaultPoolSize
+	}
+	if o.Timeout <= 0 {
+		o.Timeout = DefaultTimeout
+	}
+	return o
+}
+
+// conn is a pooled connection with its buffered reader
+type conn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+// pool hands out connections to one server, dialing new ones when none is
+// idle. A connection that failed a command is closed rather than returned.
+type pool struct {
+	addr    string
+	options Options
+	idle    chan *conn
+	setup   func(*conn) error // Runs on new connections, e.g. to authenticate
+}
+
+// newPool creates a pool of connections to addr
+func newPool(addr string, options Options, setup func(*conn) error) *pool {
+	return &pool{
+		addr:    addr,
+		options: options,
+		idle:    make(chan *conn, options.PoolSize),
+		setup:   setup,
+	}
+}
+
+// do runs a command on a connection with the command timeout applied
+func (p *pool) do(command func(*conn) error) error {
+	c, err := p.get()
+	if err != nil {
+		return err
+	}
+
+	c.SetDeadline(time.Now().Add(p.options.Timeout))
+	if err := command(c); err != nil {
+		c.Close()
+		return err
+	}
+	p.put(c)
+	return nil
+}
+
+// get returns an idle connection, or dials a new one
+func (p *pool) get() (*conn, error) {
+	select {
+	case c := <-p.idle:
+		return c, nil
+	default:
+	}
+
+	netConn, err := net.DialTimeout("tcp", p.addr, p.options.Timeout)
+	if err != nil {
+		return nil, err
+	}
+	c := &conn{Conn: netConn, reader: bufio.NewReader(netConn)}
+	if p.setup != nil {
+		c.SetDeadline(time.Now().Add(p.options.Timeout))
+		if err := p.setup(c); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// put returns a connection to the pool, closing it if the pool is full
+func (p *pool) put(c *conn) {
+	select {
+	case p.idle <- c:
+	default:
+		c.Close()
+	}
+}
+
+// close closes the idle connections
+func (p *pool) close() error {
+	for {
+		select {
+		case c := <-p.idle:
+			c.Close()
+		default:
+			return nil
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package kv_test
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/headswim/whoen/kv"
+	"github.com/headswim/whoen/storage"
+)
+
+// testStorageRoundTrip checks that KVStorage keeps blocks and request counts
+// on a store, including for values that are not IPs or would make keys
+// longer than memcached takes
+func testStorageRoundTrip(t *testing.T, store kv.Store) {
+	t.Helper()
+
+	s := storage.NewKVStorage(store, storage.KVOptions{Prefix: strings.Repeat("p", 200) + ":"})
+	ips := []string{
+		"192.0.2.1",
+		"2001:db8:ffff:ffff:ffff:ffff:ffff:ffff/128", // The key would be too long for memcached
+		"192.0.2.2 x\r\nflush_all",                   // Not an IP, must not reach the command line
+	}
+
+	until := time.Now().Add(time.Hour).Truncate(time.Second)
+	for _, ip := range ips {
+		if err := s.BlockIP(ip, until, false, "/.env"); err != nil {
+			t.Fatalf("BlockIP(%q) failed: %v", ip, err)
+		}
+		blocked, status, err := s.IsIPBlocked(ip)
+		if err != nil || !blocked || status.IP != ip || !status.BlockedUntil.Equal(until) {
+			t.Errorf("IsIPBlocked(%q) = %v, %+v, %v, want the block", ip, blocked, status, err)
+		}
+		if score, err := s.AddScore(ip, "/.env", 3); err != nil || score != 3 {
+			t.Errorf("AddScore(%q) = %d, %v, want 3", ip, score, err)
+		}
+		if count, err := s.GetRequestCount(ip); err != nil || count != 1 {
+			t.Errorf("GetRequestCount(%q) = %d, %v, want 1", ip, count, err)
+		}
+	}
+
+	blocked, err := s.GetBlockedIPs()
+	if err != nil || len(blocked) != len(ips) {
+		t.Errorf("GetBlockedIPs = %d blocks, %v, want %d", len(blocked), err, len(ips))
+	}
+	for _, ip := range ips {
+		if err := s.UnblockIP(ip); err != nil {
+			t.Fatalf("UnblockIP(%q) failed: %v", ip, err)
+		}
+		if blocked, _, err := s.IsIPBlocked(ip); err != nil || blocked {
+			t.Errorf("IsIPBlocked(%q) after UnblockIP = %v, %v", ip, blocked, err)
+		}
+	}
+}
+
+func TestKVStorageOnMemcached(t *testing.T) {
+	server := newFakeMemcached(t)
+	client := kv.NewMemcached(server.addr, kv.Options{})
+	defer client.Close()
+	testStorageRoundTrip(t, client)
+
+	for _, command := range server.Commands() {
+		if strings.Contains(command, "flush_all") {
+			t.Errorf("server was sent %q", command)
+		}
+	}
+}
+
+func TestKVStorageOnValkey(t *testing.T) {
+	server := newFakeValkey(t, "")
+	client := kv.NewValkey(server.addr, kv.Options{})
+	defer client.Close()
+	testStorageRoundTrip(t, client)
+}
+
+func TestKVStorageOnMemory(t *testing.T) {
+	testStorageRoundTrip(t, kv.NewMemory())
+}
@@ -0,0 +1,191 @@
+package kv
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Valkey is a Store on a Valkey or Redis server, using the RESP protocol
+type Valkey struct {
+	pool *pool
+}
+
+// NewValkey creates a client for the Valkey or Redis server at addr
+// (host:port). Connections are dialed on first use and authenticate and
+// select Options.DB when set.
+func NewValkey(addr string, options Options) *Valkey {
+	options = options.withDefaults()
+	setup := func(c *conn) error {
+		if options.Password != "" {
+			args := []string{"AUTH", options.Password}
+			if options.Username != "" {
+				args = []string{"AUTH", options.Username, options.Password}
+			}
+			if _, err := command(c, args...); err != nil {
+				return err
+			}
+		}
+		if options.DB != 0 {
+			if _, err := command(c, "SELECT", strconv.Itoa(options.DB)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return &Valkey{pool: newPool(addr, options, setup)}
+}
+
+// Get returns the value of a key
+func (v *Valkey) Get(key string) ([]byte, bool, error) {
+	reply, err := v.do("GET", key)
+	if err != nil || reply == nil {
+		return nil, false, err
+	}
+	value, ok := reply.([]byte)
+	if !ok {
+		return nil, false, fmt.Errorf("kv: unexpected valkey reply %v", reply)
+	}
+	return value, true, nil
+}
+
+// Set stores a value
+func (v *Valkey) Set(key string, value []byte, ttl time.Duration) error {
+	args := []string{"SET", key, string(value)}
+	if ttl > 0 {
+		args = append(args, "PX", strconv.FormatInt(valkeyMillis(ttl), 10))
+	}
+	_, err := v.do(args...)
+	return err
+}
+
+// Incr adds delta to the integer value of a key
+func (v *Valkey) Incr(key string, delta int64) (int64, error) {
+	reply, err := v.do("INCRBY", key, strconv.FormatInt(delta, 10))
+	if err != nil {
+		if strings.Contains(err.Error(), "not an integer") {
+			return 0, ErrNotInteger
+		}
+		return 0, err
+	}
+	value, ok := reply.(int64)
+	if !ok {
+		return 0, fmt.Errorf("kv: unexpected valkey reply %v", reply)
+	}
+	return value, nil
+}
+
+// Expire sets the time to live of an existing key
+func (v *Valkey) Expire(key string, ttl time.Duration) error {
+	var err error
+	if ttl > 0 {
+		_, err = v.do("PEXPIRE", key, strconv.FormatInt(valkeyMillis(ttl), 10))
+	} else {
+		_, err = v.do("PERSIST", key)
+	}
+	return err
+}
+
+// Delete removes a key
+func (v *Valkey) Delete(key string) error {
+	_, err := v.do("DEL", key)
+	return err
+}
+
+// Close closes the idle connections
+func (v *Valkey) Close() error {
+	return v.pool.close()
+}
+
+// do runs a command on a pooled connection
+func (v *Valkey) do(args ...string) (any, error) {
+	var reply any
+	var replyErr error
+	err := v.pool.do(func(c *conn) error {
+		var err error
+		reply, err = command(c, args...)
+		// Error replies leave the connection usable
+		if _, ok := err.(valkeyError); ok {
+			replyErr = err
+			return nil
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return reply, replyErr
+}
+
+// valkeyError is an error reply from the server
+type valkeyError string
+
+// Error returns the server's message
+func (e valkeyError) Error() string {
+	return "kv: valkey: " + string(e)
+}
+
+// command sends a command and reads its reply
+func command(c *conn, args ...string) (any, error) {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&buf, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	if _, err := c.Write(buf.Bytes()); err != nil {
+		return nil, err
+	}
+	return readReply(c)
+}
+
+// readReply reads a RESP reply: a string, error, integer, bulk string (nil
+// when missing) or array
+func readReply(c *conn) (any, error) {
+	line, err := readLine(c)
+	if err != nil {
+		return nil, err
+	}
+	if line == "" {
+		return nil, fmt.Errorf("kv: empty valkey reply")
+	}
+
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, valkeyError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		size, err := strconv.Atoi(line[1:])
+		if err != nil || size < 0 {
+			return nil, err
+		}
+		value := make([]byte, size+2)
+		if _, err := io.ReadFull(c.reader, value); err != nil {
+			return nil, err
+		}
+		return value[:size], nil
+	case '*':
+		count, err := strconv.Atoi(line[1:])
+		if err != nil || count < 0 {
+			return nil, err
+		}
+		items := make([]any, count)
+		for i := range items {
+			if items[i], err = readReply(c); err != nil {
+				return nil, err
+			}
+		}
+		return items, nil
+	}
+	return nil, fmt.Errorf("kv: invalid valkey reply %q", line)
+}
+
+// valkeyMillis converts a time to live to milliseconds, at least one
+func valkeyMillis(ttl time.Duration) int64 {
+	return max(ttl.Milliseconds(), 1)
+}
@@ -0,0 +1,308 @@
+// Package logfile writes logs to a file that is rotated by size and by age,
+// in the manner of lumberjack: rotated files are renamed with a timestamp,
+// optionally gzip compressed, and removed once there are too many or they
+// are too old, so long-running servers do not fill the disk.
+package logfile
+
+import (
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// backupTimeFormat stamps rotated files, e.g. whoen-2026-10-17T02-50-43.000.log
+const backupTimeFormat = "2006-01-02T15-04-05.000"
+
+// compressSuffix ends the names of compressed rotated files
+const compressSuffix = ".gz"
+
+// Options controls rotation and retention
+type Options struct {
+	MaxSize     int64         // Size in bytes the file is rotated at, 0 for no limit
+	RotateEvery time.Duration // Period the file is rotated at, e.g. 24h at midnight UTC, 0 for none
+	MaxBackups  int           // Rotated files kept, 0 to keep all
+	MaxAge      time.Duration // Age at which rotated files are removed, 0 to keep them
+	Compress    bool          // Gzip rotated files
+}
+
+// Writer is an io.WriteCloser appending to a file and rotating it. It is
+// safe for concurrent use.
+type Writer struct {
+	path    string
+	options Options
+
+	mutex  sync.Mutex
+	file   *os.File
+	size   int64
+	period time.Time // Start of the RotateEvery period the file was written in
+	closed bool
+
+	mill chan struct{} // Wakes the goroutine that compresses and removes rotated files
+	done chan struct{} // Closed when that goroutine has stopped
+}
+
+// Open opens the file at path for appending, creating it and its directory
+// if needed, and cleans up the rotated files in the background
+func Open(path string, options Options) (*Writer, error) {
+	w := &Writer{
+		path:    path,
+		options: options,
+		mill:    make(chan struct{}, 1),
+		done:    make(chan struct{}),
+	}
+	if err := w.open(); err != nil {
+		return nil, err
+	}
+
+	go w.runMill()
+	w.wakeMill()
+	return w, nil
+}
+
+// open opens the log file, keeping its size and the period it was last
+// written in. The caller must hold the lock.
+func (w *Writer) open() error {
+	if err := os.MkdirAll(filepath.Dir(w.path), 0755); err != nil {
+		return fmt.Errorf("failed to create log directory: %w", err)
+	}
+	file, err := os.OpenFile(w.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0640)
+	if err != nil {
+		return fmt.Errorf("failed to open log file %s: %w", w.path, err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("failed to open log file %s: %w", w.path, err)
+	}
+
+	w.file = file
+	w.size = info.Size()
+	w.period = w.periodOf(time.Now())
+	if w.size > 0 {
+		w.period = w.periodOf(info.ModTime())
+	}
+	return nil
+}
+
+// periodOf returns the start of the RotateEvery period of t
+func (w *Writer) periodOf(t time.Time) time.Time {
+	if w.options.RotateEvery <= 0 {
+		return time.Time{}
+	}
+	return t.UTC().Truncate(w.options.RotateEvery)
+}
+
+// Write appends p to the file, rotating it first if p would take it past
+// MaxSize or a new RotateEvery period has begun. A single write larger than
+// MaxSize still goes to one file.
+func (w *Writer) Write(p []byte) (int, error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if w.closed {
+		return 0, os.ErrClosed
+	}
+
+	now := time.Now()
+	full := w.options.MaxSize > 0 && w.size > 0 && w.size+int64(len(p)) > w.options.MaxSize
+	if full || (w.size > 0 && !w.periodOf(now).Equal(w.period)) {
+		if err := w.rotate(now); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := w.file.Write(p)
+	w.size += int64(n)
+	w.period = w.periodOf(now)
+	return n, err
+}
+
+// Rotate starts a new file right away, e.g. on SIGHUP
+func (w *Writer) Rotate() error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if w.closed {
+		return os.ErrClosed
+	}
+	return w.rotate(time.Now())
+}
+
+// rotate renames the file with a timestamp and opens a new one. The caller
+// must hold the lock.
+func (w *Writer) rotate(now time.Time) error {
+	if err := w.file.Close(); err != nil {
+		return fmt.Errorf("failed to close log file %s: %w", w.path, err)
+	}
+	if err := os.Rename(w.path, w.freeBackupName(now)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to rotate log file %s: %w", w.path, err)
+	}
+	if err := w.open(); err != nil {
+		return err
+	}
+	w.wakeMill()
+	return nil
+}
+
+// Close closes the file and waits for the background cleanup to stop
+func (w *Writer) Close() error {
+	w.mutex.Lock()
+	if w.closed {
+		w.mutex.Unlock()
+		return nil
+	}
+	w.closed = true
+	err := w.file.Close()
+	close(w.mill)
+	w.mutex.Unlock()
+
+	<-w.done
+	return err
+}
+
+// backupName returns the name the file is rotated to at a time
+func (w *Writer) backupName(t time.Time) string {
+	dir, prefix, ext := w.nameParts()
+	return filepath.Join(dir, prefix+t.UTC().Format(backupTimeFormat)+ext)
+}
+
+// freeBackupName returns the name the file is rotated to at a time, moved
+// on by a millisecond at a time while a rotated file, compressed or not,
+// already has it, so rotations within the same millisecond keep every file
+func (w *Writer) freeBackupName(t time.Time) string {
+	for {
+		name := w.backupName(t)
+		if !exists(name) && !exists(name+compressSuffix) {
+			return name
+		}
+		t = t.Add(time.Millisecond)
+	}
+}
+
+// exists reports whether a file exists at path
+func exists(path string) bool {
+	_, err := os.Lstat(path)
+	return err == nil
+}
+
+// nameParts splits the path into its directory, the prefix of rotated files
+// and the extension
+func (w *Writer) nameParts() (dir, prefix, ext string) {
+	name := filepath.Base(w.path)
+	ext = filepath.Ext(name)
+	return filepath.Dir(w.path), strings.TrimSuffix(name, ext) + "-", ext
+}
+
+// wakeMill asks the background goroutine to clean up rotated files. The
+// caller must hold the lock, or be Open.
+func (w *Writer) wakeMill() {
+	select {
+	case w.mill <- struct{}{}:
+	default:
+	}
+}
+
+// runMill compresses and removes rotated files whenever it is woken, until
+// Close is called
+func (w *Writer) runMill() {
+	defer close(w.done)
+	for range w.mill {
+		w.cleanup()
+	}
+}
+
+// backup is a rotated file
+type backup struct {
+	path string
+	time time.Time
+}
+
+// cleanup removes the rotated files beyond MaxBackups or older than MaxAge
+// and compresses the others if Compress is set. Errors are ignored; the
+// next rotation tries again.
+func (w *Writer) cleanup() {
+	backups := w.backups()
+	cutoff := time.Now().Add(-w.options.MaxAge)
+	for i, b := range backups {
+		tooMany := w.options.MaxBackups > 0 && i >= w.options.MaxBackups
+		tooOld := w.options.MaxAge > 0 && b.time.Before(cutoff)
+		if tooMany || tooOld {
+			os.Remove(b.path)
+			continue
+		}
+		if w.options.Compress && !strings.HasSuffix(b.path, compressSuffix) {
+			compress(b.path)
+		}
+	}
+}
+
+// backups lists the rotated files, newest first
+func (w *Writer) backups() []backup {
+	dir, prefix, ext := w.nameParts()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil
+	}
+
+	var backups []backup
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		stamp := strings.TrimSuffix(strings.TrimPrefix(name, prefix), compressSuffix)
+		if !strings.HasSuffix(stamp, ext) {
+			continue
+		}
+		t, err := time.Parse(backupTimeFormat, strings.TrimSuffix(stamp, ext))
+		if err != nil {
+			continue
+		}
+		backups = append(backups, backup{path: filepath.Join(dir, name), time: t})
+	}
+	sort.Slice(backups, func(i, j int) bool {
+		return backups[i].time.After(backups[j].time)
+	})
+	return backups
+}
+
+// compress gzips a rotated file and removes the original. A partial
+// compressed file is removed if compression fails.
+func compress(path string) error {
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	info, err := src.Stat()
+	if err != nil {
+		return err
+	}
+	dst, err := os.OpenFile(path+compressSuffix, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, info.Mode())
+	if err != nil {
+		return err
+	}
+
+	gz := gzip.NewWriter(dst)
+	_, err = io.Copy(gz, src)
+	if closeErr := gz.Close(); err == nil {
+		err = closeErr
+	}
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(path + compressSuffix)
+		return err
+	}
+	src.Close()
+	return os.Remove(path)
+}
@@ -0,0 +1,214 @@
+package logfile
+
+import (
+	"compress/gzip"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// write writes text to w, failing the test on errors
+func write(t *testing.T, w *Writer, text string) {
+	t.Helper()
+	if _, err := w.Write([]byte(text)); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+}
+
+// read returns the content of a file, decompressing rotated .gz files
+func read(t *testing.T, path string) string {
+	t.Helper()
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("failed to open %s: %v", path, err)
+	}
+	defer file.Close()
+
+	var r io.Reader = file
+	if strings.HasSuffix(path, compressSuffix) {
+		gz, err := gzip.NewReader(file)
+		if err != nil {
+			t.Fatalf("%s is not gzip compressed: %v", path, err)
+		}
+		r = gz
+	}
+	data, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("failed to read %s: %v", path, err)
+	}
+	return string(data)
+}
+
+// backupContents returns the contents of the rotated files, newest first
+func backupContents(t *testing.T, w *Writer) []string {
+	t.Helper()
+	var contents []string
+	for _, b := range w.backups() {
+		contents = append(contents, read(t, b.path))
+	}
+	return contents
+}
+
+// TestRotateBySize checks that the file is rotated before a write would take
+// it past MaxSize, that oversized writes still go to one file and that
+// rotations in quick succession keep every rotated file
+func TestRotateBySize(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "logs", "whoen.log")
+	w, err := Open(path, Options{MaxSize: 20})
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer w.Close()
+
+	write(t, w, "first line\n")
+	write(t, w, "second\n")
+	write(t, w, "third line\n") // 29 bytes with the others
+	write(t, w, strings.Repeat("x", 30)+"\n")
+	write(t, w, "last\n")
+
+	if got := read(t, path); got != "last\n" {
+		t.Errorf("log file has %q, want the last line", got)
+	}
+	want := []string{strings.Repeat("x", 30) + "\n", "third line\n", "first line\nsecond\n"}
+	if got := backupContents(t, w); strings.Join(got, "|") != strings.Join(want, "|") {
+		t.Errorf("rotated files have %q, want %q", got, want)
+	}
+}
+
+// TestRotateByPeriod checks that the file is rotated when a new RotateEvery
+// period begins, including for a file last written before Open
+func TestRotateByPeriod(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "whoen.log")
+	if err := os.WriteFile(path, []byte("yesterday\n"), 0o640); err != nil {
+		t.Fatalf("failed to write the log: %v", err)
+	}
+	old := time.Now().Add(-25 * time.Hour)
+	if err := os.Chtimes(path, old, old); err != nil {
+		t.Fatalf("failed to age the log: %v", err)
+	}
+
+	w, err := Open(path, Options{RotateEvery: 24 * time.Hour})
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	write(t, w, "today\n")
+	write(t, w, "still today\n")
+	w.Close()
+	if got := backupContents(t, w); len(got) != 1 || got[0] != "yesterday\n" {
+		t.Errorf("rotated files have %q, want yesterday's", got)
+	}
+
+	w, err = Open(path, Options{RotateEvery: 50 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer w.Close()
+	time.Sleep(60 * time.Millisecond)
+	write(t, w, "later\n")
+	if got := read(t, path); got != "later\n" {
+		t.Errorf("log file has %q after the period ended, want only the new line", got)
+	}
+}
+
+// TestRetention checks that rotated files beyond MaxBackups or older than
+// MaxAge are removed, that the others are compressed, and that files that
+// are not rotated logs are left alone
+func TestRetention(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "whoen.log")
+	w := &Writer{path: path}
+	now := time.Now()
+	for _, age := range []time.Duration{time.Hour, 2 * time.Hour, 3 * time.Hour, 4 * time.Hour, 72 * time.Hour} {
+		if err := os.WriteFile(w.backupName(now.Add(-age)), []byte(age.String()), 0o640); err != nil {
+			t.Fatalf("failed to write a rotated file: %v", err)
+		}
+	}
+	others := []string{"other.log", "whoen-notatime.log", "whoen-2026-10-17T02-50-43.000.txt"}
+	for _, name := range others {
+		os.WriteFile(filepath.Join(dir, name), nil, 0o640)
+	}
+
+	w, err := Open(path, Options{MaxBackups: 3, MaxAge: 48 * time.Hour, Compress: true})
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	backups := w.backups()
+	want := []string{"1h0m0s", "2h0m0s", "3h0m0s"}
+	if got := backupContents(t, w); strings.Join(got, "|") != strings.Join(want, "|") {
+		t.Errorf("rotated files have %q, want %q", got, want)
+	}
+	for _, b := range backups {
+		if !strings.HasSuffix(b.path, compressSuffix) {
+			t.Errorf("%s not compressed", b.path)
+		}
+		if exists(strings.TrimSuffix(b.path, compressSuffix)) {
+			t.Errorf("%s kept next to its compressed copy", b.path)
+		}
+	}
+	for _, name := range others {
+		if !exists(filepath.Join(dir, name)) {
+			t.Errorf("%s removed", name)
+		}
+	}
+}
+
+// TestWriterErrors checks writes after Close, an unusable directory, a log
+// directory removed while in use and a failed compression
+func TestWriterErrors(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "logs", "whoen.log")
+	w, err := Open(path, Options{MaxSize: 10})
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+
+	// The directory is created again at the next rotation
+	write(t, w, "before\n")
+	if err := os.RemoveAll(filepath.Dir(path)); err != nil {
+		t.Fatalf("failed to remove the log directory: %v", err)
+	}
+	write(t, w, "after removal\n")
+	if got := read(t, path); got != "after removal\n" {
+		t.Errorf("log file has %q, want the line written after the removal", got)
+	}
+
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Errorf("second Close = %v, want nil", err)
+	}
+	if _, err := w.Write([]byte("x")); !errors.Is(err, os.ErrClosed) {
+		t.Errorf("Write after Close = %v, want os.ErrClosed", err)
+	}
+	if err := w.Rotate(); !errors.Is(err, os.ErrClosed) {
+		t.Errorf("Rotate after Close = %v, want os.ErrClosed", err)
+	}
+
+	notDir := filepath.Join(dir, "file")
+	os.WriteFile(notDir, nil, 0o640)
+	if _, err := Open(filepath.Join(notDir, "whoen.log"), Options{}); err == nil {
+		t.Error("Open under a regular file succeeded")
+	}
+
+	rotated := filepath.Join(dir, "rotated.log")
+	os.WriteFile(rotated, []byte("kept"), 0o640)
+	os.Mkdir(rotated+compressSuffix, 0o755)
+	if err := compress(rotated); err == nil {
+		t.Error("compress onto a directory succeeded")
+	}
+	if got := read(t, rotated); got != "kept" {
+		t.Errorf("rotated file has %q after a failed compression, want it kept", got)
+	}
+	if err := compress(filepath.Join(dir, "missing.log")); err == nil {
+		t.Error("compress of a missing file succeeded")
+	}
+}
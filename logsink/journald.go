@@ -0,0 +1,87 @@
+package logsink
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+)
+
+// JournalSocket is where systemd-journald accepts messages in its native
+// protocol
+const JournalSocket = "/run/systemd/journal/socket"
+
+// Journald writes records to systemd-journald with the record's fields as
+// journal fields prefixed with WHOEN_, e.g. WHOEN_IP, so they can be queried
+// with journalctl WHOEN_EVENT=block
+type Journald struct {
+	tag string
+
+	mutex sync.Mutex
+	conn  *net.UnixConn
+}
+
+// NewJournald connects to journald. Entries carry tag as their
+// SYSLOG_IDENTIFIER, "whoen" if it is empty.
+func NewJournald(tag string) (*Journald, error) {
+	if tag == "" {
+		tag = "whoen"
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: JournalSocket, Net: "unixgram"})
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to journald: %w", err)
+	}
+	return &Journald{tag: tag, conn: conn}, nil
+}
+
+// Write sends a record to journald as a single entry
+func (j *Journald) Write(record Record) error {
+	var b bytes.Buffer
+	writeJournalField(&b, "MESSAGE", record.Text())
+	writeJournalField(&b, "PRIORITY", fmt.Sprint(int(record.Severity)))
+	writeJournalField(&b, "SYSLOG_FACILITY", fmt.Sprint(SyslogFacility))
+	writeJournalField(&b, "SYSLOG_IDENTIFIER", j.tag)
+	for _, field := range record.Fields() {
+		writeJournalField(&b, "WHOEN_"+strings.ToUpper(field[0]), field[1])
+	}
+
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+
+	if j.conn == nil {
+		return fmt.Errorf("journald connection is closed")
+	}
+	if _, err := j.conn.Write(b.Bytes()); err != nil {
+		return fmt.Errorf("failed to write to journald: %w", err)
+	}
+	return nil
+}
+
+// Close closes the connection to journald
+func (j *Journald) Close() error {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+
+	if j.conn == nil {
+		return nil
+	}
+	err := j.conn.Close()
+	j.conn = nil
+	return err
+}
+
+// writeJournalField appends a field in journald's native format. Values with
+// a newline are written with their length, the rest as NAME=value lines.
+func writeJournalField(b *bytes.Buffer, name, value string) {
+	if !strings.Contains(value, "\n") {
+		fmt.Fprintf(b, "%s=%s\n", name, value)
+		return
+	}
+	b.WriteString(name)
+	b.WriteByte('\n')
+	binary.Write(b, binary.LittleEndian, uint64(len(value)))
+	b.WriteString(value)
+	b.WriteByte('\n')
+}
@@ -0,0 +1,201 @@
+// Package logsink writes whoen's security events, such as detections and
+// blocks, to logging systems with structured fields, so SIEM pipelines can
+// ingest them without parsing the middleware's text log. Sinks for syslog
+// (RFC 5424) and systemd-journald are included, and Stream serves the
+// records live as Server-Sent Events.
+package logsink
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Event types of records, besides those of the events package
+const (
+	EventDetect  = "detect"  // A malicious request was counted
+	EventBlock   = "block"   // An IP was blocked
+	EventExtend  = "extend"  // A block was extended because the IP kept probing
+	EventUnblock = "unblock" // A block was lifted
+)
+
+// Severity is the syslog severity of a record
+type Severity int
+
+// Severities used for records, see RFC 5424 section 6.2.1
+const (
+	SeverityWarning Severity = 4 // Blocks
+	SeverityNotice  Severity = 5 // Detections and notable events
+	SeverityInfo    Severity = 6 // Unblocks
+)
+
+// Record is a security event written to a sink
+type Record struct {
+	Time      time.Time
+	Event     string // EventDetect, EventBlock, EventExtend, EventUnblock or an events type
+	Severity  Severity
+	IP        string
+	Path      string    // Request that was detected or triggered a block
+	Pattern   string    // Pattern the request matched
+	Count     int       // Malicious requests from the IP so far
+	Score     int       // Severity score of the IP so far
+	Until     time.Time // Expiration of a temporary block
+	Permanent bool
+	Source    string // Where a block or unblock came from, e.g. "detection" or "admin"
+	Actor     string // Operator or cluster node behind a block or unblock
+	Reason    string
+	Message   string // Description of other events
+	Tenant    string // Tenant of the middleware, see middleware.Options.Tenant
+}
+
+// Fields returns the record's structured fields that are set, in a fixed
+// order, with lower case names
+func (r Record) Fields() [][2]string {
+	fields := [][2]string{{"event", r.Event}}
+	add := func(name, value string) {
+		if value != "" {
+			fields = append(fields, [2]string{name, value})
+		}
+	}
+	add("ip", r.IP)
+	add("path", r.Path)
+	add("pattern", r.Pattern)
+	if r.Count > 0 {
+		add("count", fmt.Sprint(r.Count))
+	}
+	if r.Score > 0 {
+		add("score", fmt.Sprint(r.Score))
+	}
+	if !r.Until.IsZero() {
+		add("until", r.Until.UTC().Format(time.RFC3339))
+	}
+	if r.Permanent {
+		add("permanent", "true")
+	}
+	add("source", r.Source)
+	add("actor", r.Actor)
+	add("reason", r.Reason)
+	add("tenant", r.Tenant)
+	return fields
+}
+
+// Text describes the record in a sentence, for the message of a log entry
+func (r Record) Text() string {
+	var text string
+	switch r.Event {
+	case EventDetect:
+		text = fmt.Sprintf("Malicious request from %s to %s (pattern %s, count %d, score %d)", r.IP, r.Path, r.Pattern, r.Count, r.Score)
+	case EventBlock, EventExtend:
+		verb := "Blocked"
+		if r.Event == EventExtend {
+			verb = "Extended block of"
+		}
+		switch {
+		case r.Permanent:
+			text = fmt.Sprintf("%s %s permanently", verb, r.IP)
+		case !r.Until.IsZero():
+			text = fmt.Sprintf("%s %s until %s", verb, r.IP, r.Until.UTC().Format(time.RFC3339))
+		default:
+			text = fmt.Sprintf("%s %s", verb, r.IP)
+		}
+		if r.Path != "" {
+			text += fmt.Sprintf(" for %s", r.Path)
+		}
+	case EventUnblock:
+		text = fmt.Sprintf("Unblocked %s", r.IP)
+	default:
+		text = strings.ReplaceAll(r.Event, "_", " ")
+		if r.IP != "" {
+			text += " " + r.IP
+		}
+		if r.Message != "" {
+			text += ": " + r.Message
+		}
+		return text
+	}
+	if r.Source != "" {
+		text += fmt.Sprintf(" (%s)", r.Source)
+	}
+	if r.Reason != "" {
+		text += ": " + r.Reason
+	}
+	return text
+}
+
+// Sink writes records to a logging system
+type Sink interface {
+	Write(record Record) error
+	Close() error
+}
+
+// Async writes records to a sink in the background, so a slow logging
+// system does not hold up requests. Records that arrive while the buffer is
+// full are dropped and counted.
+type Async struct {
+	sink    Sink
+	records chan Record
+	done    chan struct{}
+	dropped atomic.Int64
+
+	// mutex keeps Close from closing records while Write sends to it
+	mutex  sync.RWMutex
+	closed bool
+}
+
+// NewAsync creates an Async that buffers up to size records for sink and
+// reports write errors to onError, which may be nil
+func NewAsync(sink Sink, size int, onError func(error)) *Async {
+	a := &Async{
+		sink:    sink,
+		records: make(chan Record, size),
+		done:    make(chan struct{}),
+	}
+	go func() {
+		defer close(a.done)
+		for record := range a.records {
+			if err := sink.Write(record); err != nil && onError != nil {
+				onError(err)
+			}
+		}
+	}()
+	return a
+}
+
+// Write queues a record, dropping it if the buffer is full or the sink is
+// closed
+func (a *Async) Write(record Record) error {
+	a.mutex.RLock()
+	defer a.mutex.RUnlock()
+
+	if a.closed {
+		return nil
+	}
+	select {
+	case a.records <- record:
+	default:
+		a.dropped.Add(1)
+	}
+	return nil
+}
+
+// Dropped returns the number of records dropped because the buffer was full
+func (a *Async) Dropped() int64 {
+	return a.dropped.Load()
+}
+
+// Close writes the queued records and closes the sink
+func (a *Async) Close() error {
+	a.mutex.Lock()
+	if a.closed {
+		a.mutex.Unlock()
+		return nil
+	}
+	a.closed = true
+	close(a.records)
+	a.mutex.Unlock()
+
+	<-a.done
+	return a.sink.Close()
+}
@@ -0,0 +1,241 @@
+package logsink
+
+import (
+	"fmt"
+	"net/netip"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Vendor and product named in CEF and LEEF headers
+const (
+	Vendor  = "headswim"
+	Product = "whoen"
+)
+
+// Formatter renders a record as a single line of text
+type Formatter func(Record) string
+
+// ParseFormat returns the formatter for "cef" or "leef", or nil for
+// anything else
+func ParseFormat(name string) Formatter {
+	switch strings.ToLower(name) {
+	case "cef":
+		return FormatCEF
+	case "leef":
+		return FormatLEEF
+	}
+	return nil
+}
+
+// FormatCEF renders a record in ArcSight's Common Event Format, e.g.
+//
+//	CEF:0|headswim|whoen|v1.4.0|block|IP blocked|7|rt=1760667000000 src=203.0.113.7 act=block ...
+//
+// The event type is the signature ID. IPv6 addresses go in c6a2, since src
+// only holds IPv4 addresses, and the pattern, score, source and whether the
+// block is permanent in the custom fields cs1, cn1, cs2 and cs3. IPs
+// replaced by an obfuscator go in cs4, the tenant in cs5.
+func FormatCEF(r Record) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "CEF:0|%s|%s|%s|%s|%s|%d|", escapeHeader(Vendor), escapeHeader(Product), escapeHeader(productVersion()),
+		escapeHeader(r.Event), escapeHeader(eventName(r.Event)), siemSeverity(r.Severity))
+
+	extension := []string{"rt=" + fmt.Sprint(recordTime(r).UnixMilli())}
+	add := func(key, value string) {
+		if value != "" {
+			extension = append(extension, key+"="+escapeCEF(value))
+		}
+	}
+	switch addr, err := netip.ParseAddr(r.IP); {
+	case obfuscated(r.IP):
+		add("cs4", r.IP)
+		add("cs4Label", "Obfuscated Source")
+	case err == nil && addr.Is6() && !addr.Is4In6():
+		add("c6a2", r.IP)
+		add("c6a2Label", "Source IPv6 Address")
+	default:
+		add("src", r.IP)
+	}
+	add("act", r.Event)
+	add("request", r.Path)
+	if r.Count > 0 {
+		add("cnt", fmt.Sprint(r.Count))
+	}
+	if !r.Until.IsZero() {
+		add("end", fmt.Sprint(r.Until.UnixMilli()))
+	}
+	add("suser", r.Actor)
+	add("reason", r.Reason)
+	if r.Pattern != "" {
+		add("cs1", r.Pattern)
+		add("cs1Label", "Pattern")
+	}
+	if r.Score > 0 {
+		add("cn1", fmt.Sprint(r.Score))
+		add("cn1Label", "Score")
+	}
+	if r.Source != "" {
+		add("cs2", r.Source)
+		add("cs2Label", "Source")
+	}
+	if r.Permanent {
+		add("cs3", "true")
+		add("cs3Label", "Permanent")
+	}
+	if r.Tenant != "" {
+		add("cs5", r.Tenant)
+		add("cs5Label", "Tenant")
+	}
+	add("msg", r.Text())
+
+	b.WriteString(strings.Join(extension, " "))
+	return b.String()
+}
+
+// FormatLEEF renders a record in IBM QRadar's Log Event Extended Format
+// 1.0, with tab separated attributes, e.g.
+//
+//	LEEF:1.0|headswim|whoen|v1.4.0|block|devTime=2025-10-17T02:10:00.000+0000	src=203.0.113.7	sev=7 ...
+//
+// The event type is the event ID and the category. IPs replaced by an
+// obfuscator go in srcHash instead of src.
+func FormatLEEF(r Record) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "LEEF:1.0|%s|%s|%s|%s|", escapeHeader(Vendor), escapeHeader(Product), escapeHeader(productVersion()), escapeHeader(r.Event))
+
+	attributes := []string{
+		"devTime=" + recordTime(r).UTC().Format("2006-01-02T15:04:05.000-0700"),
+		"devTimeFormat=yyyy-MM-dd'T'HH:mm:ss.SSSZ",
+		"cat=" + escapeLEEF(r.Event),
+		"sev=" + fmt.Sprint(siemSeverity(r.Severity)),
+	}
+	add := func(key, value string) {
+		if value != "" {
+			attributes = append(attributes, key+"="+escapeLEEF(value))
+		}
+	}
+	if obfuscated(r.IP) {
+		add("srcHash", r.IP)
+	} else {
+		add("src", r.IP)
+	}
+	add("url", r.Path)
+	add("pattern", r.Pattern)
+	if r.Count > 0 {
+		add("count", fmt.Sprint(r.Count))
+	}
+	if r.Score > 0 {
+		add("score", fmt.Sprint(r.Score))
+	}
+	if !r.Until.IsZero() {
+		add("until", r.Until.UTC().Format(time.RFC3339))
+	}
+	if r.Permanent {
+		add("permanent", "true")
+	}
+	add("source", r.Source)
+	add("usrName", r.Actor)
+	add("reason", r.Reason)
+	add("tenant", r.Tenant)
+	add("msg", r.Text())
+
+	b.WriteString(strings.Join(attributes, "\t"))
+	return b.String()
+}
+
+// obfuscated reports whether the IP of a record is neither an address nor
+// a range, as after an obfuscator replaced it
+func obfuscated(ip string) bool {
+	if ip == "" {
+		return false
+	}
+	if _, err := netip.ParseAddr(ip); err == nil {
+		return false
+	}
+	_, err := netip.ParsePrefix(ip)
+	return err != nil
+}
+
+// eventName returns a short title for an event type, the CEF name field
+func eventName(event string) string {
+	switch event {
+	case EventDetect:
+		return "Malicious request"
+	case EventBlock:
+		return "IP blocked"
+	case EventExtend:
+		return "Block extended"
+	case EventUnblock:
+		return "IP unblocked"
+	}
+	name := strings.ReplaceAll(event, "_", " ")
+	if name == "" {
+		return "-"
+	}
+	return strings.ToUpper(name[:1]) + name[1:]
+}
+
+// siemSeverity maps a syslog severity to the 0 to 10 scale of CEF and LEEF
+func siemSeverity(severity Severity) int {
+	switch severity {
+	case SeverityWarning:
+		return 7
+	case SeverityNotice:
+		return 5
+	case SeverityInfo:
+		return 3
+	}
+	return 5
+}
+
+// recordTime returns the time of a record, now if it has none
+func recordTime(r Record) time.Time {
+	if r.Time.IsZero() {
+		return time.Now()
+	}
+	return r.Time
+}
+
+var (
+	version     string
+	versionOnce sync.Once
+)
+
+// productVersion returns the version of the whoen module built into the
+// binary, "dev" when it is built from a checkout
+func productVersion() string {
+	versionOnce.Do(func() {
+		version = "dev"
+		info, ok := debug.ReadBuildInfo()
+		if !ok {
+			return
+		}
+		modules := append([]*debug.Module{&info.Main}, info.Deps...)
+		for _, module := range modules {
+			if module.Path == "github.com/headswim/whoen" && module.Version != "" && module.Version != "(devel)" {
+				version = module.Version
+				return
+			}
+		}
+	})
+	return version
+}
+
+// escapeHeader escapes the characters CEF and LEEF reserve in header fields
+func escapeHeader(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `|`, `\|`, "\n", " ", "\r", " ").Replace(value)
+}
+
+// escapeCEF escapes the characters CEF reserves in extension values
+func escapeCEF(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `=`, `\=`, "\n", `\n`, "\r", `\r`).Replace(value)
+}
+
+// escapeLEEF keeps tabs and line breaks, which separate attributes and
+// records, out of LEEF attribute values
+func escapeLEEF(value string) string {
+	return strings.NewReplacer("\t", `\t`, "\n", `\n`, "\r", `\r`).Replace(value)
+}
@@ -0,0 +1,223 @@
+package logsink
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// streamKeepAlive is how often an idle stream sends a comment, so proxies
+// and load balancers do not close the connection
+const streamKeepAlive = 15 * time.Second
+
+// Stream is a sink that broadcasts records to live subscribers, such as
+// admin UIs showing attacks as they happen. It serves them as Server-Sent
+// Events. Records are not kept: a subscriber only sees what is written
+// while it is connected, and one that falls more than the buffer behind
+// misses records, which it is told about.
+type Stream struct {
+	buffer      int
+	subscribers atomic.Int32 // Lets Write skip the lock while nobody listens
+
+	mutex  sync.Mutex
+	subs   map[*subscription]struct{}
+	nextID uint64
+	closed bool
+}
+
+// subscription is the queue of one subscriber
+type subscription struct {
+	records chan streamRecord
+	dropped atomic.Int64 // Records dropped since the subscriber last caught up
+}
+
+// streamRecord is a record with its position in the stream
+type streamRecord struct {
+	id     uint64
+	record Record
+}
+
+// NewStream creates a stream that queues up to buffer records per
+// subscriber
+func NewStream(buffer int) *Stream {
+	if buffer < 1 {
+		buffer = 1
+	}
+	return &Stream{buffer: buffer, subs: make(map[*subscription]struct{})}
+}
+
+// Write broadcasts a record to the subscribers without waiting for them
+func (s *Stream) Write(record Record) error {
+	if s.subscribers.Load() == 0 {
+		return nil
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.closed {
+		return nil
+	}
+	s.nextID++
+	for sub := range s.subs {
+		select {
+		case sub.records <- streamRecord{id: s.nextID, record: record}:
+		default:
+			sub.dropped.Add(1)
+		}
+	}
+	return nil
+}
+
+// Close ends every subscription
+func (s *Stream) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	for sub := range s.subs {
+		close(sub.records)
+		delete(s.subs, sub)
+	}
+	s.subscribers.Store(0)
+	return nil
+}
+
+// subscribe adds a subscriber, or returns nil once the stream is closed
+func (s *Stream) subscribe() *subscription {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.closed {
+		return nil
+	}
+	sub := &subscription{records: make(chan streamRecord, s.buffer)}
+	s.subs[sub] = struct{}{}
+	s.subscribers.Add(1)
+	return sub
+}
+
+// unsubscribe removes a subscriber
+func (s *Stream) unsubscribe(sub *subscription) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if _, ok := s.subs[sub]; ok {
+		delete(s.subs, sub)
+		s.subscribers.Add(-1)
+	}
+}
+
+// ServeHTTP streams records as Server-Sent Events until the client goes
+// away or the stream is closed. Each record is an event named after its
+// type, e.g. "block", with the record as JSON in its data. The optional
+// events query parameter lists the types to send, separated by commas.
+// Records a slow client missed are reported in a "dropped" event.
+func (s *Stream) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+
+	var types map[string]bool
+	if value := r.URL.Query().Get("events"); value != "" {
+		types = make(map[string]bool)
+		for _, name := range strings.Split(value, ",") {
+			types[strings.TrimSpace(name)] = true
+		}
+	}
+
+	sub := s.subscribe()
+	if sub == nil {
+		http.Error(w, "stream closed", http.StatusServiceUnavailable)
+		return
+	}
+	defer s.unsubscribe(sub)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("X-Accel-Buffering", "no") // Keep nginx from buffering the stream
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, ": whoen event stream\n\n")
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(streamKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case entry, ok := <-sub.records:
+			if !ok {
+				return
+			}
+			if dropped := sub.dropped.Swap(0); dropped > 0 {
+				fmt.Fprintf(w, "event: dropped\ndata: {\"dropped\":%d}\n\n", dropped)
+			}
+			if types != nil && !types[entry.record.Event] {
+				continue
+			}
+			data, err := json.Marshal(newStreamEvent(entry.record))
+			if err != nil {
+				continue
+			}
+			fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", entry.id, entry.record.Event, data)
+		case <-keepAlive.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+		case <-r.Context().Done():
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+// streamEvent is the JSON form of a record in the stream
+type streamEvent struct {
+	Time      time.Time  `json:"time"`
+	Event     string     `json:"event"`
+	Severity  Severity   `json:"severity"`
+	IP        string     `json:"ip,omitempty"`
+	Path      string     `json:"path,omitempty"`
+	Pattern   string     `json:"pattern,omitempty"`
+	Count     int        `json:"count,omitempty"`
+	Score     int        `json:"score,omitempty"`
+	Until     *time.Time `json:"until,omitempty"`
+	Permanent bool       `json:"permanent,omitempty"`
+	Source    string     `json:"source,omitempty"`
+	Actor     string     `json:"actor,omitempty"`
+	Reason    string     `json:"reason,omitempty"`
+	Message   string     `json:"message,omitempty"`
+	Tenant    string     `json:"tenant,omitempty"`
+	Text      string     `json:"text"` // The record in a sentence, see Record.Text
+}
+
+// newStreamEvent returns the JSON form of a record
+func newStreamEvent(r Record) streamEvent {
+	event := streamEvent{
+		Time:      r.Time,
+		Event:     r.Event,
+		Severity:  r.Severity,
+		IP:        r.IP,
+		Path:      r.Path,
+		Pattern:   r.Pattern,
+		Count:     r.Count,
+		Score:     r.Score,
+		Permanent: r.Permanent,
+		Source:    r.Source,
+		Actor:     r.Actor,
+		Reason:    r.Reason,
+		Message:   r.Message,
+		Tenant:    r.Tenant,
+		Text:      r.Text(),
+	}
+	if !r.Until.IsZero() {
+		until := r.Until
+		event.Until = &until
+	}
+	return event
+}
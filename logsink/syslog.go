@@ -0,0 +1,185 @@
+package logsink
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SyslogFacility is the facility of syslog messages: auth, for security
+// messages
+const SyslogFacility = 4
+
+// StructuredDataID names the RFC 5424 structured data element that carries
+// a record's fields. 32473 is the private enterprise number reserved for
+// documentation and examples.
+const StructuredDataID = "whoen@32473"
+
+// syslogTimeout bounds connecting and writing to a syslog server
+const syslogTimeout = 5 * time.Second
+
+// localSyslogSockets are where syslog daemons listen on Linux, macOS and the
+// BSDs, in the order they are tried
+var localSyslogSockets = []string{"/dev/log", "/var/run/syslog", "/var/run/log"}
+
+// Syslog writes records as RFC 5424 messages, with the record's event as the
+// message ID and its fields as structured data
+type Syslog struct {
+	network  string
+	address  string
+	hostname string
+	tag      string
+	text     Formatter // Renders the message text, Record.Text if nil
+
+	mutex sync.Mutex
+	conn  net.Conn
+}
+
+// NewSyslog connects to a syslog daemon: the local one if address is empty,
+// or one at "udp://host:port", "tcp://host:port" or "unix:///path". Messages
+// carry tag as their app name, "whoen" if it is empty. TCP messages are
+// framed by octet counting, see RFC 6587.
+func NewSyslog(address, tag string) (*Syslog, error) {
+	if tag == "" {
+		tag = "whoen"
+	}
+	hostname, err := os.Hostname()
+	if err != nil || hostname == "" {
+		hostname = "-"
+	}
+	s := &Syslog{hostname: hostname, tag: tag}
+
+	switch {
+	case address == "":
+		for _, path := range localSyslogSockets {
+			if _, err := os.Stat(path); err == nil {
+				s.network, s.address = "unixgram", path
+				break
+			}
+		}
+		if s.address == "" {
+			return nil, fmt.Errorf("no local syslog socket found in %s", strings.Join(localSyslogSockets, ", "))
+		}
+	case strings.HasPrefix(address, "udp://"):
+		s.network, s.address = "udp", strings.TrimPrefix(address, "udp://")
+	case strings.HasPrefix(address, "tcp://"):
+		s.network, s.address = "tcp", strings.TrimPrefix(address, "tcp://")
+	case strings.HasPrefix(address, "unix://"):
+		s.network, s.address = "unixgram", strings.TrimPrefix(address, "unix://")
+	default:
+		return nil, fmt.Errorf("invalid syslog address %q, expected udp://, tcp:// or unix://", address)
+	}
+
+	if err := s.connect(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// SetFormat makes the message text of records the rendering of format
+// instead of a sentence, e.g. FormatCEF for SIEMs that expect CEF over
+// syslog. Call it before the first Write.
+func (s *Syslog) SetFormat(format Formatter) {
+	s.text = format
+}
+
+// connect opens the connection to the syslog daemon. The caller must hold
+// the lock, except in NewSyslog.
+func (s *Syslog) connect() error {
+	conn, err := net.DialTimeout(s.network, s.address, syslogTimeout)
+	if err != nil {
+		return fmt.Errorf("failed to connect to syslog at %s: %w", s.address, err)
+	}
+	s.conn = conn
+	return nil
+}
+
+// Write sends a record to the syslog daemon, reconnecting once if the
+// connection was lost
+func (s *Syslog) Write(record Record) error {
+	message := s.message(record)
+	if s.network == "tcp" {
+		message = fmt.Sprintf("%d %s", len(message), message)
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	var err error
+	for attempt := 0; attempt < 2; attempt++ {
+		if s.conn == nil {
+			if err = s.connect(); err != nil {
+				continue
+			}
+		}
+		s.conn.SetWriteDeadline(time.Now().Add(syslogTimeout))
+		if _, err = s.conn.Write([]byte(message)); err == nil {
+			return nil
+		}
+		s.conn.Close()
+		s.conn = nil
+	}
+	return fmt.Errorf("failed to write to syslog: %w", err)
+}
+
+// message renders a record as an RFC 5424 message
+func (s *Syslog) message(record Record) string {
+	timestamp := record.Time
+	if timestamp.IsZero() {
+		timestamp = time.Now()
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "<%d>1 %s %s %s %d %s [%s", SyslogFacility*8+int(record.Severity),
+		timestamp.UTC().Format("2006-01-02T15:04:05.000000Z07:00"), s.hostname, s.tag, os.Getpid(),
+		syslogName(record.Event), StructuredDataID)
+	for _, field := range record.Fields() {
+		fmt.Fprintf(&b, ` %s="%s"`, field[0], escapeParam(field[1]))
+	}
+	b.WriteString("] ")
+	if s.text != nil {
+		b.WriteString(s.text(record))
+	} else {
+		b.WriteString(record.Text())
+	}
+	return b.String()
+}
+
+// Close closes the connection to the syslog daemon
+func (s *Syslog) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.conn == nil {
+		return nil
+	}
+	err := s.conn.Close()
+	s.conn = nil
+	return err
+}
+
+// syslogName makes a value fit an RFC 5424 header field: printable ASCII
+// without spaces, at most 32 characters, "-" if empty
+func syslogName(value string) string {
+	name := strings.Map(func(r rune) rune {
+		if r < 33 || r > 126 {
+			return '_'
+		}
+		return r
+	}, value)
+	if len(name) > 32 {
+		name = name[:32]
+	}
+	if name == "" {
+		return "-"
+	}
+	return name
+}
+
+// escapeParam escapes the characters RFC 5424 reserves in parameter values
+func escapeParam(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, `]`, `\]`).Replace(value)
+}
@@ -0,0 +1,88 @@
+package logsink
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// Writer writes records as lines of text to an io.Writer, such as a file a
+// SIEM agent collects
+type Writer struct {
+	format Formatter
+
+	mutex sync.Mutex
+	w     io.Writer
+}
+
+// NewWriter creates a Writer that renders records with format
+func NewWriter(w io.Writer, format Formatter) *Writer {
+	return &Writer{w: w, format: format}
+}
+
+// NewFile creates a Writer that appends records rendered with format to the
+// file at path, or to standard output if path is "-"
+func NewFile(path string, format Formatter) (*Writer, error) {
+	if path == "-" {
+		return NewWriter(os.Stdout, format), nil
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create directory of %s: %w", path, err)
+	}
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s: %w", path, err)
+	}
+	return NewWriter(f, format), nil
+}
+
+// Write writes a record as a line
+func (w *Writer) Write(record Record) error {
+	line := w.format(record) + "\n"
+
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	_, err := io.WriteString(w.w, line)
+	return err
+}
+
+// Close closes the underlying writer if it is a file other than standard
+// output
+func (w *Writer) Close() error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if closer, ok := w.w.(io.Closer); ok && w.w != os.Stdout {
+		return closer.Close()
+	}
+	return nil
+}
+
+// Multi writes every record to several sinks
+type Multi []Sink
+
+// Write writes a record to every sink, returning their errors joined
+func (m Multi) Write(record Record) error {
+	var errs []error
+	for _, sink := range m {
+		if err := sink.Write(record); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Close closes every sink, returning their errors joined
+func (m Multi) Close() error {
+	var errs []error
+	for _, sink := range m {
+		if err := sink.Close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,112 @@
+package whoen
+
+import (
+	"time"
+
+	"github.com/headswim/whoen/middleware"
+	"github.com/headswim/whoen/storage"
+)
+
+// Manager is what New returns: the middleware, ready to wrap HTTP, Chi or Gin
+// handlers, plus methods to drive whoen from application code such as an
+// admin dashboard. Its actions go through middleware.Admin, so they reach the
+// firewall, storage and cluster like those of whoenctl, and are recorded in
+// the audit log as made by "application" unless WithActor names someone.
+type Manager struct {
+	*middleware.Middleware
+	actor string
+}
+
+// BlockStatus describes a block, as listed by ListBlocked
+type BlockStatus = storage.BlockStatus
+
+// Stats summarizes what whoen blocks and whitelists, for dashboards
+type Stats struct {
+	Blocked     int              `json:"blocked"`     // Blocks in force
+	Permanent   int              `json:"permanent"`   // Blocks in force that never expire
+	Whitelisted int              `json:"whitelisted"` // Whitelisted IPs and ranges, the defaults included
+	UnderAttack bool             `json:"under_attack"`
+	Middleware  middleware.Stats `json:"middleware"` // Storage location and per-IP state size
+}
+
+// newManager wraps a middleware in a Manager
+func newManager(m *middleware.Middleware) *Manager {
+	return &Manager{Middleware: m, actor: "application"}
+}
+
+// WithActor returns a Manager whose actions are attributed to actor in the
+// audit log, e.g. the dashboard user making them
+func (m *Manager) WithActor(actor string) *Manager {
+	return &Manager{Middleware: m.Middleware, actor: actor}
+}
+
+// BlockIP blocks an IP for the given duration, or permanently if duration is
+// 0, like middleware.Middleware.BlockIP. The block is attributed to operator,
+// or to the WithActor name if operator is empty.
+func (m *Manager) BlockIP(ip string, duration time.Duration, reason, operator string) error {
+	if operator == "" {
+		operator = m.actor
+	}
+	return m.Admin(operator).Block(ip, duration, reason)
+}
+
+// UnblockIP lifts the block on an IP, or on a blocked subnet given in CIDR
+// notation, and resets its request count
+func (m *Manager) UnblockIP(ip string, reason string) error {
+	return m.Admin(m.actor).Unblock(ip, reason)
+}
+
+// ListBlocked returns the blocks in force, oldest first
+func (m *Manager) ListBlocked() ([]BlockStatus, error) {
+	return m.ActiveBlocks()
+}
+
+// Whitelist adds an IP or CIDR range to the whitelist and the whitelist file
+func (m *Manager) Whitelist(ip string, reason string) error {
+	return m.Admin(m.actor).Whitelist(ip, reason)
+}
+
+// WhitelistFor whitelists an IP until the duration has passed
+func (m *Manager) WhitelistFor(ip string, duration time.Duration, reason string) error {
+	return m.Admin(m.actor).WhitelistFor(ip, duration, reason)
+}
+
+// Unwhitelist removes an IP or CIDR range from the whitelist and the whitelist file
+func (m *Manager) Unwhitelist(ip string, reason string) error {
+	return m.Admin(m.actor).Unwhitelist(ip, reason)
+}
+
+// ListWhitelist returns the whitelisted IPs and CIDR ranges, the defaults and
+// temporary entries included
+func (m *Manager) ListWhitelist() ([]string, error) {
+	return m.WhitelistEntries()
+}
+
+// Stats returns the number of blocks and whitelist entries along with the
+// middleware's own statistics
+func (m *Manager) Stats() (Stats, error) {
+	var stats Stats
+	var err error
+	if stats.Middleware, err = m.Middleware.Stats(); err != nil {
+		return stats, err
+	}
+
+	blocks, err := m.ActiveBlocks()
+	if err != nil {
+		return stats, err
+	}
+	stats.Blocked = len(blocks)
+	for _, block := range blocks {
+		if block.IsPermanent {
+			stats.Permanent++
+		}
+	}
+
+	whitelist, err := m.WhitelistEntries()
+	if err != nil {
+		return stats, err
+	}
+	stats.Whitelisted = len(whitelist)
+	stats.UnderAttack = m.UnderAttack()
+	return stats, nil
+}
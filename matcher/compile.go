@@ -0,0 +1,251 @@
+package matcher
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// patternsGeneration is bumped whenever the package-level patterns or weights
+// change through SetPatterns, AddPatterns or SetWeight, so services know to recompile
+var patternsGeneration atomic.Uint64
+
+// defaultsMutex guards the package-level Patterns, Whitelist, Weights and
+// InstantBlock against concurrent changes made through the package functions
+var defaultsMutex sync.RWMutex
+
+// SetPatterns replaces the package-level patterns. Services that have not
+// replaced their own patterns pick up the change on their next match.
+func SetPatterns(patterns []string) {
+	defaultsMutex.Lock()
+	defer defaultsMutex.Unlock()
+
+	Patterns = patterns
+	patternsGeneration.Add(1)
+}
+
+// AddPatterns appends to the package-level patterns. Services that have not
+// replaced their own patterns pick up the change on their next match.
+func AddPatterns(patterns ...string) {
+	defaultsMutex.Lock()
+	defer defaultsMutex.Unlock()
+
+	Patterns = append(Patterns, patterns...)
+	patternsGeneration.Add(1)
+}
+
+// defaultPatterns returns a copy of the package-level patterns
+func defaultPatterns() []string {
+	defaultsMutex.RLock()
+	defer defaultsMutex.RUnlock()
+
+	return append([]string(nil), Patterns...)
+}
+
+// compiledPatterns is the normalized, de-duplicated form of a pattern list,
+// indexed in a trie for matching, along with the allow patterns exempting
+// paths from it
+type compiledPatterns struct {
+	patterns    []string
+	trie        *trie
+	allow       []string
+	allowTrie   *trie
+	weights     map[string]int
+	instant     map[string]bool
+	duplicates  int
+	compileTime time.Duration
+	generation  uint64
+}
+
+// compilePatterns normalizes and de-duplicates a list of patterns
+func compilePatterns(patterns []string) *compiledPatterns {
+	start := time.Now()
+
+	seen := make(map[string]bool, len(patterns))
+	compiled := &compiledPatterns{
+		patterns:   make([]string, 0, len(patterns)),
+		weights:    make(map[string]int, len(Weights)),
+		instant:    make(map[string]bool, len(InstantBlock)),
+		generation: patternsGeneration.Load(),
+	}
+
+	defaultsMutex.RLock()
+	for pattern, weight := range Weights {
+		compiled.weights[normalizePattern(pattern)] = weight
+	}
+	for pattern, instant := range InstantBlock {
+		if instant {
+			compiled.instant[normalizePattern(pattern)] = true
+		}
+	}
+	defaultsMutex.RUnlock()
+
+	for _, pattern := range patterns {
+		normalized := normalizePattern(pattern)
+		if normalized == "" {
+			continue
+		}
+		if seen[normalized] {
+			compiled.duplicates++
+			continue
+		}
+		seen[normalized] = true
+		compiled.patterns = append(compiled.patterns, normalized)
+	}
+	compiled.trie = newTrie(compiled.patterns)
+
+	compiled.compileTime = time.Since(start)
+	return compiled
+}
+
+// withAllow adds allow patterns to the compiled patterns
+func (c *compiledPatterns) withAllow(allow []string) *compiledPatterns {
+	seen := make(map[string]bool, len(allow))
+	for _, pattern := range allow {
+		normalized := normalizePattern(pattern)
+		if normalized != "" && !seen[normalized] {
+			seen[normalized] = true
+			c.allow = append(c.allow, normalized)
+		}
+	}
+	c.allowTrie = newTrie(c.allow)
+	return c
+}
+
+// normalizePattern returns the form patterns are compared and matched in
+func normalizePattern(pattern string) string {
+	return strings.ToLower(strings.TrimSpace(pattern))
+}
+
+// match checks a normalized path against the compiled patterns
+func (c *compiledPatterns) match(normalizedPath string) bool {
+	if len(c.allow) == 0 {
+		return c.trie.walk(normalizedPath, true) >= 0
+	}
+	_, ok := c.find(normalizedPath)
+	return ok
+}
+
+// find returns the longest pattern matching a normalized path, unless an
+// allow pattern at least as long matches it too
+func (c *compiledPatterns) find(normalizedPath string) (string, bool) {
+	index := c.trie.walk(normalizedPath, false)
+	if index < 0 || c.allowed(normalizedPath, len(c.patterns[index])) {
+		return "", false
+	}
+	return c.patterns[index], true
+}
+
+// allowed reports whether an allow pattern of at least length bytes matches
+// a normalized path
+func (c *compiledPatterns) allowed(normalizedPath string, length int) bool {
+	if len(c.allow) == 0 {
+		return false
+	}
+	index := c.allowTrie.walk(normalizedPath, false)
+	return index >= 0 && len(c.allow[index]) >= length
+}
+
+// weight returns the severity score of a compiled pattern
+func (c *compiledPatterns) weight(pattern string) int {
+	if weight, ok := c.weights[pattern]; ok {
+		return weight
+	}
+	return DefaultWeight
+}
+
+// lookup returns the match details of the most specific pattern matching a normalized path
+func (c *compiledPatterns) lookup(normalizedPath string) (Match, bool) {
+	pattern, ok := c.find(normalizedPath)
+	if !ok {
+		return Match{}, false
+	}
+	return Match{
+		Pattern: pattern,
+		Weight:  c.weight(pattern),
+		Instant: c.instant[pattern],
+	}, true
+}
+
+// memoryBytes returns an approximation of the memory held by the compiled patterns
+func (c *compiledPatterns) memoryBytes() int {
+	// Each string header is 16 bytes on 64-bit platforms
+	size := cap(c.patterns) * 16
+	for _, pattern := range c.patterns {
+		size += len(pattern)
+	}
+	size += cap(c.allow) * 16
+	for _, pattern := range c.allow {
+		size += len(pattern)
+	}
+	if c.allowTrie != nil {
+		size += c.allowTrie.memoryBytes()
+	}
+	return size + c.trie.memoryBytes()
+}
+
+// RuleStats describes the cost of a compiled rule set
+type RuleStats struct {
+	Patterns     int           `json:"patterns"`      // Number of compiled patterns
+	Duplicates   int           `json:"duplicates"`    // Patterns dropped as duplicates during compilation
+	MemoryBytes  int           `json:"memory_bytes"`  // Approximate memory held by the compiled patterns
+	CompileTime  time.Duration `json:"compile_time"`  // Time spent compiling the patterns
+	MatchLatency time.Duration `json:"match_latency"` // Average time to evaluate a clean path, measured by benchmarks, zero from Stats
+}
+
+// Budget sets upper limits on the cost of a rule set. Zero values disable a
+// limit. MaxMatchLatency is checked against RuleStats.MatchLatency, which the
+// matcher's benchmarks measure; it is not timed at startup.
+type Budget struct {
+	MaxPatterns     int
+	MaxMemoryBytes  int
+	MaxMatchLatency time.Duration
+}
+
+// DefaultBudget is the budget the middleware checks the rule set against at
+// startup, and the matcher's benchmarks check the match latency against
+var DefaultBudget = Budget{
+	MaxPatterns:     10000,
+	MaxMemoryBytes:  4 << 20,
+	MaxMatchLatency: 50 * time.Microsecond,
+}
+
+// Check returns an error describing the first limit of the budget that is exceeded
+func (s RuleStats) Check(b Budget) error {
+	if b.MaxPatterns > 0 && s.Patterns > b.MaxPatterns {
+		return fmt.Errorf("rule set has %d patterns, budget is %d", s.Patterns, b.MaxPatterns)
+	}
+	if b.MaxMemoryBytes > 0 && s.MemoryBytes > b.MaxMemoryBytes {
+		return fmt.Errorf("rule set uses ~%d bytes, budget is %d", s.MemoryBytes, b.MaxMemoryBytes)
+	}
+	if b.MaxMatchLatency > 0 && s.MatchLatency > b.MaxMatchLatency {
+		return fmt.Errorf("clean path match takes %v, budget is %v", s.MatchLatency, b.MaxMatchLatency)
+	}
+	return nil
+}
+
+// Stats compiles the package-level patterns and reports their cost
+func Stats() RuleStats {
+	return compilePatterns(defaultPatterns()).stats()
+}
+
+// probePaths are typical clean request paths, matched by Warm
+var probePaths = []string{
+	"/",
+	"/index.html",
+	"/static/js/app.3f9a1c.js",
+	"/api/v1/users/12345/orders?page=2",
+	"/blog/2024/05/how-we-scaled-our-infrastructure-to-millions-of-requests",
+}
+
+// stats reports the cost of the compiled patterns
+func (c *compiledPatterns) stats() RuleStats {
+	return RuleStats{
+		Patterns:    len(c.patterns),
+		Duplicates:  c.duplicates,
+		MemoryBytes: c.memoryBytes(),
+		CompileTime: c.compileTime,
+	}
+}
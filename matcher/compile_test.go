@@ -0,0 +1,114 @@
+package matcher
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+// benchmarkSizes are the rule set sizes benchmarked, up to the pattern
+// budget of DefaultBudget
+var benchmarkSizes = []int{100, 1000, DefaultBudget.MaxPatterns}
+
+// feedPatterns returns n distinct patterns shaped like those of threat
+// feeds, sharing prefixes so the trie branches realistically
+func feedPatterns(n int) []string {
+	patterns := make([]string, n)
+	for i := range patterns {
+		patterns[i] = fmt.Sprintf("/%s/feed-%05d/%x.php", []string{"wp-content", "vendor", "cgi-bin", "admin"}[i%4], i, i*7919)
+	}
+	return patterns
+}
+
+// newBenchmarkService creates a service matching n feed patterns on top of
+// nothing else
+func newBenchmarkService(n int) *Service {
+	service := NewService()
+	service.ReplacePatterns(feedPatterns(n))
+	service.Warm()
+	return service
+}
+
+// BenchmarkTrieClean walks clean paths through tries of growing size
+func BenchmarkTrieClean(b *testing.B) {
+	for _, n := range benchmarkSizes {
+		b.Run(fmt.Sprintf("patterns=%d", n), func(b *testing.B) {
+			compiled := compilePatterns(feedPatterns(n))
+			paths := make([]string, len(probePaths))
+			for i, path := range probePaths {
+				paths[i] = strings.ToLower(path)
+			}
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if compiled.match(paths[i%len(paths)]) {
+					b.Fatalf("clean path %q matched", paths[i%len(paths)])
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkServiceClean matches clean paths through the service, including
+// path normalization
+func BenchmarkServiceClean(b *testing.B) {
+	for _, n := range benchmarkSizes {
+		b.Run(fmt.Sprintf("patterns=%d", n), func(b *testing.B) {
+			service := newBenchmarkService(n)
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if service.IsMalicious(probePaths[i%len(probePaths)]) {
+					b.Fatalf("clean path %q matched", probePaths[i%len(probePaths)])
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkServiceMalicious matches paths that hit a pattern, deepest in the
+// largest rule set
+func BenchmarkServiceMalicious(b *testing.B) {
+	for _, n := range benchmarkSizes {
+		b.Run(fmt.Sprintf("patterns=%d", n), func(b *testing.B) {
+			service := newBenchmarkService(n)
+			path := feedPatterns(n)[n-1] + "?cmd=id"
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if !service.IsMalicious(path) {
+					b.Fatalf("malicious path %q did not match", path)
+				}
+			}
+		})
+	}
+}
+
+// TestMatchLatencyBudget benchmarks clean paths against the largest rule
+// set DefaultBudget allows and checks the latency against that budget
+func TestMatchLatencyBudget(t *testing.T) {
+	if testing.Short() {
+		t.Skip("benchmarks the matcher")
+	}
+
+	service := newBenchmarkService(DefaultBudget.MaxPatterns)
+	result := testing.Benchmark(func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			service.IsMalicious(probePaths[i%len(probePaths)])
+		}
+	})
+
+	stats := service.Stats()
+	stats.MatchLatency = time.Duration(result.NsPerOp())
+	t.Logf("%d patterns, ~%d bytes, clean match %v", stats.Patterns, stats.MemoryBytes, stats.MatchLatency)
+
+	// Memory depends on the shape of the patterns and is checked at startup
+	budget := Budget{MaxPatterns: DefaultBudget.MaxPatterns, MaxMatchLatency: DefaultBudget.MaxMatchLatency}
+	if err := stats.Check(budget); err != nil {
+		t.Errorf("rule set exceeds DefaultBudget: %v", err)
+	}
+}
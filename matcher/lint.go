@@ -0,0 +1,158 @@
+package matcher
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// LintKind identifies the kind of problem found in a rule set
+type LintKind string
+
+const (
+	// LintDuplicate is reported when a pattern appears more than once
+	LintDuplicate LintKind = "duplicate"
+	// LintShadowed is reported when a pattern can never match on its own because
+	// a shorter pattern already matches every path it would match
+	LintShadowed LintKind = "shadowed"
+	// LintConflict is reported when an allow pattern prevents a deny pattern
+	// from ever matching, which happens when both are the same prefix
+	LintConflict LintKind = "conflict"
+)
+
+// LintWarning describes a single problem found in a rule set
+type LintWarning struct {
+	Kind    LintKind `json:"kind"`
+	Pattern string   `json:"pattern"`
+	Other   string   `json:"other,omitempty"` // The pattern responsible for the problem, if any
+}
+
+// String returns a human-readable description of the warning
+func (w LintWarning) String() string {
+	switch w.Kind {
+	case LintDuplicate:
+		return fmt.Sprintf("duplicate pattern %q", w.Pattern)
+	case LintShadowed:
+		return fmt.Sprintf("pattern %q is shadowed by %q", w.Pattern, w.Other)
+	case LintConflict:
+		return fmt.Sprintf("deny pattern %q never matches because allow pattern %q allows every path it matches", w.Pattern, w.Other)
+	default:
+		return fmt.Sprintf("%s: %q", w.Kind, w.Pattern)
+	}
+}
+
+// Lint checks deny and allow patterns for duplicates, shadowed prefixes and
+// allow/deny conflicts, with the semantics of Service.SetAllowPatterns: a
+// path matching an allow pattern is only malicious if a longer deny pattern
+// matches it. A shorter allow pattern therefore never hides a deny pattern;
+// only an allow pattern equal to it does.
+func Lint(deny, allow []string) []LintWarning {
+	var warnings []LintWarning
+
+	denyPatterns, denyWarnings := lintList(deny)
+	allowPatterns, allowWarnings := lintList(allow)
+
+	// A deny pattern under a shorter one still decides the paths an allow
+	// pattern between the two would otherwise let through
+	for _, warning := range denyWarnings {
+		if warning.Kind == LintShadowed && allowedBetween(allowPatterns, warning.Other, warning.Pattern) {
+			continue
+		}
+		warnings = append(warnings, warning)
+	}
+	warnings = append(warnings, allowWarnings...)
+
+	allowed := make(map[string]bool, len(allowPatterns))
+	for _, a := range allowPatterns {
+		allowed[a] = true
+	}
+	for _, d := range denyPatterns {
+		if allowed[d] {
+			warnings = append(warnings, LintWarning{Kind: LintConflict, Pattern: d, Other: d})
+		}
+	}
+
+	return warnings
+}
+
+// allowedBetween reports whether an allow pattern starts with the shorter
+// deny pattern and is a prefix of the longer one
+func allowedBetween(allow []string, shorter, longer string) bool {
+	for _, a := range allow {
+		if strings.HasPrefix(a, shorter) && strings.HasPrefix(longer, a) {
+			return true
+		}
+	}
+	return false
+}
+
+// LintPatterns lints the package-level patterns. A shadowed pattern is not
+// reported when its weight or instant-block setting differs from the pattern
+// shadowing it, since the most specific match decides those, nor when both
+// are built-in patterns, which keep specific paths such as /actuator/health
+// for rule sets that remove the broader one.
+func LintPatterns() []LintWarning {
+	return lintPatterns(defaultPatterns(), nil)
+}
+
+// builtinPatterns are the patterns Patterns starts with
+var builtinPatterns = func() map[string]bool {
+	builtin := make(map[string]bool, len(Patterns))
+	for _, pattern := range Patterns {
+		builtin[normalizePattern(pattern)] = true
+	}
+	return builtin
+}()
+
+// lintPatterns lints deny and allow patterns against the package-level
+// weights and instant-block settings
+func lintPatterns(patterns, allow []string) []LintWarning {
+	compiled := compilePatterns(patterns)
+
+	var warnings []LintWarning
+	for _, warning := range Lint(patterns, allow) {
+		if warning.Kind == LintShadowed &&
+			(compiled.weight(warning.Pattern) != compiled.weight(warning.Other) ||
+				compiled.instant[warning.Pattern] != compiled.instant[warning.Other] ||
+				builtinPatterns[warning.Pattern] && builtinPatterns[warning.Other]) {
+			continue
+		}
+		warnings = append(warnings, warning)
+	}
+	return warnings
+}
+
+// lintList normalizes a pattern list and reports duplicates and shadowed prefixes
+func lintList(patterns []string) ([]string, []LintWarning) {
+	var warnings []LintWarning
+
+	seen := make(map[string]bool, len(patterns))
+	unique := make([]string, 0, len(patterns))
+	for _, pattern := range patterns {
+		normalized := strings.ToLower(strings.TrimSpace(pattern))
+		if normalized == "" {
+			continue
+		}
+		if seen[normalized] {
+			warnings = append(warnings, LintWarning{Kind: LintDuplicate, Pattern: pattern})
+			continue
+		}
+		seen[normalized] = true
+		unique = append(unique, normalized)
+	}
+
+	// Once sorted, every pattern sharing a prefix directly follows that prefix,
+	// so a single pass tracking the last unshadowed pattern is enough
+	sorted := append([]string(nil), unique...)
+	sort.Strings(sorted)
+	root := ""
+	for _, pattern := range sorted {
+		if root != "" && strings.HasPrefix(pattern, root) {
+			warnings = append(warnings, LintWarning{Kind: LintShadowed, Pattern: pattern, Other: root})
+			continue
+		}
+		root = pattern
+	}
+
+	return unique, warnings
+}
@@ -0,0 +1,58 @@
+package matcher
+
+import (
+	"reflect"
+	"testing"
+)
+
+// TestLint checks the warnings for deny and allow patterns against the
+// semantics of allow patterns, where a longer deny match wins
+func TestLint(t *testing.T) {
+	tests := []struct {
+		name  string
+		deny  []string
+		allow []string
+		want  []LintWarning
+	}{
+		{"clean", []string{"/wp-login.php", "/.env"}, nil, nil},
+		{"duplicate", []string{"/.env", "/.ENV "}, nil,
+			[]LintWarning{{Kind: LintDuplicate, Pattern: "/.ENV "}}},
+		{"shadowed", []string{"/.git", "/.git/config"}, nil,
+			[]LintWarning{{Kind: LintShadowed, Pattern: "/.git/config", Other: "/.git"}}},
+		{"allow equal to deny", []string{"/admin"}, []string{"/Admin"},
+			[]LintWarning{{Kind: LintConflict, Pattern: "/admin", Other: "/admin"}}},
+		{"shorter allow loses to deny", []string{"/admin/config.php"}, []string{"/admin"}, nil},
+		{"longer allow carves out of deny", []string{"/admin"}, []string{"/admin/login"}, nil},
+		{"deny under allow under deny", []string{"/admin", "/admin/login/reset"}, []string{"/admin/login"}, nil},
+		{"duplicate allow", nil, []string{"/status", "/status"},
+			[]LintWarning{{Kind: LintDuplicate, Pattern: "/status"}}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := Lint(test.deny, test.allow); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("Lint(%q, %q) = %v, want %v", test.deny, test.allow, got, test.want)
+			}
+		})
+	}
+}
+
+// TestLintPatternsBuiltin checks that the built-in patterns lint clean
+func TestLintPatternsBuiltin(t *testing.T) {
+	if warnings := lintPatterns(Patterns, nil); len(warnings) > 0 {
+		t.Errorf("built-in patterns have warnings: %v", warnings)
+	}
+}
+
+// TestServiceLintAllowPatterns checks that a service lints its patterns
+// against its allow patterns
+func TestServiceLintAllowPatterns(t *testing.T) {
+	service := NewService()
+	service.ReplacePatterns([]string{"/wp-login.php", "/internal"})
+	service.SetAllowPatterns([]string{"/internal"})
+
+	want := []LintWarning{{Kind: LintConflict, Pattern: "/internal", Other: "/internal"}}
+	if got := service.Lint(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Lint() = %v, want %v", got, want)
+	}
+}
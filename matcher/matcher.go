@@ -1,5 +1,11 @@
 package matcher
 
+import (
+	"net/http"
+	"net/netip"
+	"time"
+)
+
 // Matcher defines the interface for path matching
 type Matcher interface {
 	// IsMalicious checks if a path is malicious
@@ -8,3 +14,119 @@ type Matcher interface {
 	// IsWhitelisted checks if an IP is in the whitelist
 	IsWhitelisted(ip string) bool
 }
+
+// Scorer is implemented by matchers that weigh their patterns. Paths found
+// malicious by other matchers score DefaultWeight.
+type Scorer interface {
+	// Score returns the severity score of a path, or 0 if it is not malicious
+	Score(path string) int
+
+	// Match returns the most specific pattern matching a path
+	Match(path string) (Match, bool)
+}
+
+// RequestMatcher is implemented by matchers that inspect query parameters or
+// request bodies besides the path
+type RequestMatcher interface {
+	// IsMaliciousRequest checks if a request's path, query parameters or body is malicious
+	IsMaliciousRequest(r *http.Request) bool
+
+	// MatchRequest returns the pattern or payload signature a request matched
+	MatchRequest(r *http.Request) (Match, bool)
+}
+
+// Where in a request a match was found. LocationResponse is used by the
+// middleware's request rules that match on the response status.
+const (
+	LocationPath     = "path"
+	LocationQuery    = "query"
+	LocationBody     = "body"
+	LocationResponse = "response"
+)
+
+// Match describes the pattern a path matched, and where it matched
+type Match struct {
+	Pattern  string // The matching pattern
+	Weight   int    // Severity score of the pattern
+	Instant  bool   // Whether the pattern blocks on the first request
+	Category string // Payload category of a query or body match, empty for paths
+
+	// Location is LocationPath, LocationQuery, LocationBody or
+	// LocationResponse. Offset is the byte offset of the match in the
+	// inspected value: the path as requested, or normalized by NormalizePath
+	// if that changed more than its case, or the decoded and normalized
+	// query or body. Matched is the text that matched and Excerpt the same
+	// text with up to ExcerptContext bytes around it.
+	Location string
+	Offset   int
+	Matched  string
+	Excerpt  string
+}
+
+// ExcerptContext is the number of bytes kept on each side of a match in Match.Excerpt
+const ExcerptContext = 32
+
+// locate fills in where a match was found in the inspected value
+func (m *Match) locate(location, value string, offset, length int) {
+	m.Location = location
+	m.Offset = offset
+	m.Matched = value[offset : offset+length]
+	m.Excerpt = value[max(0, offset-ExcerptContext):min(len(value), offset+length+ExcerptContext)]
+}
+
+// StatsReporter is implemented by matchers that can report the cost of their rule set
+type StatsReporter interface {
+	Stats() RuleStats
+}
+
+// Linter is implemented by matchers that can check their rule set for problems
+type Linter interface {
+	Lint() []LintWarning
+}
+
+// BodyInspector is implemented by matchers that can inspect request bodies
+type BodyInspector interface {
+	// SetBodyLimit sets how many body bytes MatchRequest inspects, 0 for none
+	SetBodyLimit(limit int)
+}
+
+// Warmer is implemented by matchers that can prepare their rule set ahead of the first request
+type Warmer interface {
+	Warm()
+}
+
+// AddrWhitelister is implemented by matchers that can check a parsed address
+// against the whitelist, sparing the request path a string round trip
+type AddrWhitelister interface {
+	IsWhitelistedAddr(addr netip.Addr) bool
+}
+
+// WhitelistManager is implemented by matchers whose whitelist can be changed at runtime
+type WhitelistManager interface {
+	AddWhitelist(ips ...string)
+	RemoveWhitelist(ips ...string)
+}
+
+// PatternManager is implemented by matchers whose patterns can be changed at runtime
+type PatternManager interface {
+	Patterns() []string
+	AddPatterns(patterns ...string)
+	RemovePatterns(patterns ...string)
+	ReplacePatterns(patterns []string)
+}
+
+// AllowManager is implemented by matchers that can exempt the paths the
+// application legitimately serves from the malicious patterns
+type AllowManager interface {
+	AllowPatterns() []string
+	SetAllowPatterns(patterns []string)
+}
+
+// TemporaryWhitelister is implemented by matchers that support whitelist entries that expire
+type TemporaryWhitelister interface {
+	// AddWhitelistFor whitelists IPs until the duration has passed
+	AddWhitelistFor(duration time.Duration, ips ...string)
+
+	// ExpireWhitelist removes the temporary entries that have expired and returns their IPs
+	ExpireWhitelist() []string
+}
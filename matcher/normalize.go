@@ -0,0 +1,91 @@
+package matcher
+
+import (
+	"net/url"
+	"path"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// NormalizePath returns the form of a request path that patterns are matched
+// against. It undoes the tricks used to slip past prefix matching: percent
+// encoding (decoded up to twice, for double encoding), backslashes used as
+// separators, path parameters (;jsessionid=...) and trailing dots that
+// servers drop from segments, duplicate slashes, dot segments and case,
+// folded so that look-alikes such as the Kelvin sign match their ASCII
+// letter. A trailing slash is kept, so /admin/ still matches a pattern
+// ending in a slash.
+func NormalizePath(p string) string {
+	// Most paths need nothing but lower-casing
+	if plainPath(p) {
+		return strings.ToLower(p)
+	}
+
+	for i := 0; i < 2 && strings.Contains(p, "%"); i++ {
+		decoded, err := url.PathUnescape(p)
+		if err != nil {
+			break
+		}
+		p = decoded
+	}
+	p = trimSegments(foldCase(strings.ReplaceAll(p, "\\", "/")))
+	if p == "" {
+		return p
+	}
+
+	trailing := strings.HasSuffix(p, "/") || strings.HasSuffix(p, "/.") || strings.HasSuffix(p, "/..")
+	cleaned := path.Clean(p)
+	if trailing && !strings.HasSuffix(cleaned, "/") {
+		cleaned += "/"
+	}
+	return cleaned
+}
+
+// plainPath reports whether a path is ASCII without percent encoding,
+// backslashes, path parameters, duplicate slashes or segments starting or
+// ending with a dot
+func plainPath(p string) bool {
+	for i := 0; i < len(p); i++ {
+		switch c := p[i]; {
+		case c >= utf8.RuneSelf, c == '%', c == '\\', c == ';':
+			return false
+		case c == '/' && i+1 < len(p) && (p[i+1] == '/' || p[i+1] == '.'):
+			return false
+		case c == '.' && (i+1 == len(p) || p[i+1] == '/'):
+			return false
+		}
+	}
+	return true
+}
+
+// trimSegments drops the path parameters and trailing dots of each segment,
+// which servers such as Tomcat and IIS ignore when routing, so /admin;x=1/
+// and /admin./ reach /admin/. Dot segments are left for path.Clean.
+func trimSegments(p string) string {
+	segments := strings.Split(p, "/")
+	for i, segment := range segments {
+		if j := strings.IndexByte(segment, ';'); j >= 0 {
+			segment = segment[:j]
+		}
+		if strings.Trim(segment, ".") != "" {
+			segment = strings.TrimRight(segment, ".")
+		}
+		segments[i] = segment
+	}
+	return strings.Join(segments, "/")
+}
+
+// foldCase lower-cases a string, mapping each letter through its upper case
+// first so letters whose lower case differs from their ASCII look-alike,
+// like the long s, fold to it as well
+func foldCase(s string) string {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return strings.Map(func(r rune) rune {
+				return unicode.ToLower(unicode.ToUpper(r))
+			}, s)
+		}
+	}
+	return strings.ToLower(s)
+}
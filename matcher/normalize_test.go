@@ -0,0 +1,74 @@
+package matcher
+
+import "testing"
+
+// TestNormalizePath checks that common evasion tricks normalize to the path
+// a server would route them to
+func TestNormalizePath(t *testing.T) {
+	tests := []struct {
+		name string
+		path string
+		want string
+	}{
+		{"plain", "/index.html", "/index.html"},
+		{"case", "/WP-Login.PHP", "/wp-login.php"},
+		{"encoded dot segments", "/%2e%2e/etc/passwd", "/etc/passwd"},
+		{"encoded dot segments after a prefix", "/static/%2e%2e/.env", "/.env"},
+		{"encoded dot", "/%2e/.env", "/.env"},
+		{"double encoded dots", "/%252e%252e/.env", "/.env"},
+		{"double encoded slash", "/%252e%252e%252f.env", "/.env"},
+		{"encoded letters", "/wp%2dlogin%2Ephp", "/wp-login.php"},
+		{"encoded trailing slash", "/phpmyadmin%2f", "/phpmyadmin/"},
+		{"duplicate slashes", "//admin", "/admin"},
+		{"duplicate slashes inside", "/wp-admin//install.php", "/wp-admin/install.php"},
+		{"parent segment", "/admin/..", "/"},
+		{"parent segment before a pattern", "/admin/../wp-login.php", "/wp-login.php"},
+		{"parent segments", "/a/b/../../.git/config", "/.git/config"},
+		{"current segment", "/./wp-login.php", "/wp-login.php"},
+		{"trailing current segment", "/admin/.", "/admin/"},
+		{"trailing slash kept", "/admin/", "/admin/"},
+		{"backslash", "\\wp-login.php", "/wp-login.php"},
+		{"backslash parent segment", "/..\\.env", "/.env"},
+		{"encoded backslash", "/static%5c..%5c.env", "/.env"},
+		{"trailing dot", "/wp-login.php.", "/wp-login.php"},
+		{"trailing dots", "/wp-login.php...", "/wp-login.php"},
+		{"trailing dot on a directory", "/.git./config", "/.git/config"},
+		{"path parameter", "/wp-login.php;x=1", "/wp-login.php"},
+		{"path parameter on a directory", "/actuator;jsessionid=1/env", "/actuator/env"},
+		{"path parameter dot segment", "/static/..;/.env", "/.env"},
+		{"empty path parameter", "/admin;/", "/admin/"},
+		{"kelvin sign", "/Kibana", "/kibana"},
+		{"long s", "/.ſsh/id_rsa", "/.ssh/id_rsa"},
+		{"long s and kelvin sign encoded", "/%C5%BFtatus/%E2%84%AA", "/status/k"},
+		{"empty", "", ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := NormalizePath(test.path); got != test.want {
+				t.Errorf("NormalizePath(%q) = %q, want %q", test.path, got, test.want)
+			}
+		})
+	}
+}
+
+// TestNormalizedPathsMatch checks that evasions of default patterns are
+// still detected by a service
+func TestNormalizedPathsMatch(t *testing.T) {
+	service := NewService()
+	for _, path := range []string{
+		"/%2e%2e/wp-login.php",
+		"//wp-login.php",
+		"/wp-login.php.",
+		"/wp-login.php;jsessionid=1",
+		"/static/..\\.env",
+		"/%252e%252e/.env",
+		"/jen%E2%84%AAins",
+		"/%C5%BFerver-%C5%BFtatus",
+		"/actuator;a=b/env",
+	} {
+		if !service.IsMalicious(path) {
+			t.Errorf("IsMalicious(%q) = false, want true", path)
+		}
+	}
+}
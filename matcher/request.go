@@ -0,0 +1,214 @@
+package matcher
+
+import (
+	"bytes"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// Payload signature categories
+const (
+	CategorySQLi      = "sqli"      // SQL injection
+	CategoryTraversal = "traversal" // Path traversal and local file inclusion
+)
+
+// DefaultBodyLimit is the number of body bytes inspected when body inspection
+// is turned on without a limit
+const DefaultBodyLimit = 8192
+
+// Signatures lists the payload signatures matched against query parameters
+// and request bodies, by category. They are matched as substrings of the
+// decoded, lower-cased value, with runs of whitespace and SQL comments
+// collapsed to a single space.
+var Signatures = map[string][]string{
+	CategoryTraversal: {
+		"../",
+		"..\\",
+		"/etc/passwd",
+		"/etc/shadow",
+		"/proc/self/environ",
+		"c:\\windows\\",
+		"win.ini",
+		"file://",
+		"php://filter",
+		"php://input",
+	},
+	CategorySQLi: {
+		"' or '1'='1",
+		"' or 1=1",
+		"\" or \"1\"=\"1",
+		"' or ''='",
+		"union select",
+		"union all select",
+		"; drop table",
+		"'; exec",
+		"information_schema",
+		"xp_cmdshell",
+		"waitfor delay",
+		"sleep(",
+		"benchmark(",
+		"load_file(",
+		"into outfile",
+	},
+}
+
+// SignatureWeights maps signature categories to their severity score.
+// Categories without an entry score DefaultWeight.
+var SignatureWeights = map[string]int{
+	CategorySQLi:      10,
+	CategoryTraversal: 10,
+}
+
+// AddSignatures adds payload signatures to a category used by all services
+func AddSignatures(category string, signatures ...string) {
+	defaultsMutex.Lock()
+	defer defaultsMutex.Unlock()
+
+	for _, signature := range signatures {
+		Signatures[category] = append(Signatures[category], strings.ToLower(signature))
+	}
+}
+
+// IsMaliciousRequest checks if a request's path, query parameters or, with
+// body inspection turned on, the start of its body is malicious
+func (s *Service) IsMaliciousRequest(r *http.Request) bool {
+	_, ok := s.MatchRequest(r)
+	return ok
+}
+
+// MatchRequest returns the most specific pattern matching a request's path,
+// or else the first payload signature found in its query parameters or body.
+// The body is only read up to the inspection limit and stays readable.
+func (s *Service) MatchRequest(r *http.Request) (Match, bool) {
+	if match, ok := s.Match(r.URL.Path); ok {
+		return match, true
+	}
+
+	// Query parameter names and values
+	if r.URL.RawQuery != "" {
+		if match, ok := matchPayload(LocationQuery, r.URL.RawQuery); ok {
+			return match, true
+		}
+	}
+
+	// Start of the body
+	s.mutex.RLock()
+	limit := s.bodyLimit
+	s.mutex.RUnlock()
+	if limit > 0 {
+		if body := sniffBody(r, limit); body != "" {
+			return matchPayload(LocationBody, body)
+		}
+	}
+
+	return Match{}, false
+}
+
+// SetBodyLimit turns on inspection of the first limit bytes of request bodies
+// in MatchRequest. Zero or less turns it off, which is the default.
+func (s *Service) SetBodyLimit(limit int) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.bodyLimit = limit
+}
+
+// matchPayload looks for payload signatures in a URL-encoded value found at location
+func matchPayload(location, raw string) (Match, bool) {
+	value := normalizePayload(raw)
+
+	defaultsMutex.RLock()
+	defer defaultsMutex.RUnlock()
+
+	// Check the categories in a fixed order so results are stable
+	categories := make([]string, 0, len(Signatures))
+	for category := range Signatures {
+		categories = append(categories, category)
+	}
+	sort.Strings(categories)
+
+	for _, category := range categories {
+		for _, signature := range Signatures[category] {
+			offset := strings.Index(value, signature)
+			if offset < 0 {
+				continue
+			}
+			weight, ok := SignatureWeights[category]
+			if !ok {
+				weight = DefaultWeight
+			}
+			match := Match{Pattern: category + ":" + signature, Weight: weight, Category: category}
+			match.locate(location, value, offset, len(signature))
+			return match, true
+		}
+	}
+	return Match{}, false
+}
+
+// normalizePayload decodes a URL-encoded value, twice to catch double
+// encoding, lower-cases it and collapses whitespace and SQL comments
+func normalizePayload(raw string) string {
+	value := raw
+	for i := 0; i < 2 && strings.ContainsAny(value, "%+"); i++ {
+		decoded, err := url.QueryUnescape(value)
+		if err != nil {
+			break
+		}
+		value = decoded
+	}
+
+	value = strings.ToLower(strings.ReplaceAll(value, "/**/", " "))
+	return strings.Join(strings.Fields(value), " ")
+}
+
+// sniffBody returns the first limit bytes of a textual request body and puts
+// them back in front of the rest so the handler still reads the whole body
+func sniffBody(r *http.Request, limit int) string {
+	if r.Body == nil || r.Body == http.NoBody {
+		return ""
+	}
+	switch r.Method {
+	case http.MethodPost, http.MethodPut, http.MethodPatch:
+	default:
+		return ""
+	}
+	if !textualBody(r.Header.Get("Content-Type")) {
+		return ""
+	}
+
+	buf := make([]byte, limit)
+	n, _ := io.ReadFull(r.Body, buf)
+	buf = buf[:n]
+	r.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(buf), r.Body), r.Body}
+
+	return string(buf)
+}
+
+// textualBody checks if a content type carries form fields or text worth
+// inspecting. File uploads and binary bodies are skipped.
+func textualBody(contentType string) bool {
+	if contentType == "" {
+		return true
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	switch {
+	case mediaType == "application/x-www-form-urlencoded",
+		mediaType == "application/json",
+		mediaType == "application/xml",
+		strings.HasSuffix(mediaType, "+json"),
+		strings.HasSuffix(mediaType, "+xml"),
+		strings.HasPrefix(mediaType, "text/"):
+		return true
+	}
+	return false
+}
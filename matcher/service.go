@@ -1,53 +1,361 @@
 package matcher
 
 import (
+	"net/netip"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/headswim/whoen/ipaddr"
 )
 
-// Service implements the Matcher interface
+// Service implements the Matcher interface.
+//
+// Its patterns and whitelist start from the package-level Patterns and
+// Whitelist and follow changes made to them through the package functions.
+// Changes made on the service itself apply to that service only and take
+// effect immediately; after ReplacePatterns or ReplaceWhitelist the service
+// stops following the package-level list it replaced.
 type Service struct {
-	mutex          sync.RWMutex
-	whitelistedIPs map[string]bool // Map for O(1) lookup
+	mutex sync.RWMutex
+
+	// Patterns
+	ownPatterns     bool            // Set by ReplacePatterns, the service no longer follows Patterns
+	patternList     []string        // The service's own patterns once ownPatterns is set
+	addedPatterns   []string        // Added on top of the package-level patterns
+	removedPatterns map[string]bool // Normalized package-level patterns removed from this service
+
+	allowPatterns []string // Paths exempt from the patterns, see SetAllowPatterns
+
+	// compiled is replaced as a whole on every change, so matching reads it
+	// without taking the lock
+	compiled atomic.Pointer[compiledPatterns]
+
+	// Whitelist
+	ownWhitelist        bool                  // Set by ReplaceWhitelist, the service no longer follows Whitelist
+	whitelisted         whitelistSet          // The service's own entries
+	defaults            whitelistSet          // Snapshot of the package-level whitelist
+	excluded            map[netip.Prefix]bool // Package-level entries removed from this service
+	whitelistGeneration uint64
+
+	// Number of body bytes MatchRequest inspects, 0 for none
+	bodyLimit int
 }
 
 // NewService creates a new Service instance
 func NewService() *Service {
 	service := &Service{
-		whitelistedIPs: make(map[string]bool),
-	}
-
-	// Initialize whitelisted IPs map for faster lookups
-	for _, ip := range Whitelist {
-		service.whitelistedIPs[ip] = true
+		removedPatterns: make(map[string]bool),
+		whitelisted:     newWhitelistSet(),
+		excluded:        make(map[netip.Prefix]bool),
 	}
+	service.recompile()
+	service.refreshDefaultWhitelist()
 
 	return service
 }
 
 // IsMalicious checks if a path is malicious
 func (s *Service) IsMalicious(path string) bool {
-	s.mutex.RLock()
-	defer s.mutex.RUnlock()
+	compiled := s.patterns()
 
 	// Normalize path
-	normalizedPath := strings.ToLower(path)
+	normalizedPath := NormalizePath(path)
 
 	// Check for exact matches and prefix matches
-	for _, pattern := range Patterns {
-		if normalizedPath == pattern || strings.HasPrefix(normalizedPath, pattern) {
-			return true
+	return compiled.match(normalizedPath)
+}
+
+// Score returns the severity score of the most specific pattern matching a path
+func (s *Service) Score(path string) int {
+	match, _ := s.Match(path)
+	return match.Weight
+}
+
+// Match returns the most specific pattern matching a path
+func (s *Service) Match(path string) (Match, bool) {
+	normalized := NormalizePath(path)
+	match, ok := s.patterns().lookup(normalized)
+	if !ok {
+		return match, false
+	}
+
+	// Patterns match at the start of the path; report the text as requested
+	// unless normalizing changed more than its case
+	if len(normalized) == len(path) && strings.EqualFold(normalized, path) {
+		match.locate(LocationPath, path, 0, len(match.Pattern))
+	} else {
+		match.locate(LocationPath, normalized, 0, len(match.Pattern))
+	}
+	return match, true
+}
+
+// Patterns returns the patterns the service currently matches against
+func (s *Service) Patterns() []string {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	return s.effectivePatterns()
+}
+
+// AddPatterns adds patterns to this service
+func (s *Service) AddPatterns(patterns ...string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.ownPatterns {
+		s.patternList = append(s.patternList, patterns...)
+	} else {
+		s.addedPatterns = append(s.addedPatterns, patterns...)
+		for _, pattern := range patterns {
+			delete(s.removedPatterns, normalizePattern(pattern))
 		}
 	}
+	s.recompile()
+}
+
+// RemovePatterns removes patterns from this service, including patterns it
+// got from the package-level list
+func (s *Service) RemovePatterns(patterns ...string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	remove := make(map[string]bool, len(patterns))
+	for _, pattern := range patterns {
+		remove[normalizePattern(pattern)] = true
+	}
 
-	return false
+	if s.ownPatterns {
+		s.patternList = withoutPatterns(s.patternList, remove)
+	} else {
+		s.addedPatterns = withoutPatterns(s.addedPatterns, remove)
+		for pattern := range remove {
+			s.removedPatterns[pattern] = true
+		}
+	}
+	s.recompile()
+}
+
+// ReplacePatterns replaces every pattern of this service. The service stops
+// following changes to the package-level patterns.
+func (s *Service) ReplacePatterns(patterns []string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.ownPatterns = true
+	s.patternList = append([]string(nil), patterns...)
+	s.addedPatterns = nil
+	s.removedPatterns = make(map[string]bool)
+	s.recompile()
+}
+
+// AllowPatterns returns the service's allow patterns
+func (s *Service) AllowPatterns() []string {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	return append([]string(nil), s.allowPatterns...)
+}
+
+// SetAllowPatterns replaces the service's allow patterns: path prefixes the
+// application legitimately serves, such as an admin area for logged-in users.
+// A path matching an allow pattern is not malicious unless a longer
+// malicious pattern matches it as well, so allowing /admin leaves
+// /admin/.git matched by a /admin/.git pattern.
+func (s *Service) SetAllowPatterns(patterns []string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.allowPatterns = append([]string(nil), patterns...)
+	s.recompile()
 }
 
 // IsWhitelisted checks if an IP is in the whitelist
 func (s *Service) IsWhitelisted(ip string) bool {
+	addr, err := ipaddr.Parse(ip)
+	if err != nil {
+		return false
+	}
+	return s.IsWhitelistedAddr(addr)
+}
+
+// IsWhitelistedAddr checks if an address is in the whitelist, as an entry of
+// its own or inside a whitelisted range
+func (s *Service) IsWhitelistedAddr(addr netip.Addr) bool {
+	s.mutex.RLock()
+	if !s.ownWhitelist && s.whitelistGeneration != whitelistGeneration.Load() {
+		s.mutex.RUnlock()
+		s.mutex.Lock()
+		s.refreshDefaultWhitelist()
+		s.mutex.Unlock()
+		s.mutex.RLock()
+	}
+	defer s.mutex.RUnlock()
+
+	addr = ipaddr.Canonical(addr)
+	return s.whitelisted.contains(addr, nil) || s.defaults.contains(addr, s.excluded)
+}
+
+// Whitelist returns the IPs and ranges the service currently whitelists,
+// including temporary entries that have not expired
+func (s *Service) Whitelist() []string {
 	s.mutex.RLock()
 	defer s.mutex.RUnlock()
 
-	_, exists := s.whitelistedIPs[ip]
-	return exists
+	now := time.Now()
+	entries := s.whitelisted.entries(now)
+	for _, entry := range s.defaults.entries(now) {
+		prefix, _ := ipaddr.ParsePrefix(entry)
+		if !s.whitelisted.has(prefix) && !s.excluded[prefix] {
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
+
+// AddWhitelist adds IPs and CIDR ranges to the service's whitelist. Entries
+// that are neither are ignored.
+func (s *Service) AddWhitelist(ips ...string) {
+	s.AddWhitelistPrefix(parseWhitelist(ips)...)
+}
+
+// AddWhitelistPrefix adds ranges to the service's whitelist
+func (s *Service) AddWhitelistPrefix(prefixes ...netip.Prefix) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for _, prefix := range prefixes {
+		prefix = ipaddr.CanonicalPrefix(prefix)
+		s.whitelisted.add(prefix, time.Time{})
+		delete(s.excluded, prefix)
+	}
+}
+
+// AddWhitelistFor whitelists IPs and CIDR ranges until the duration has
+// passed. A permanent entry is replaced by the temporary one.
+func (s *Service) AddWhitelistFor(duration time.Duration, ips ...string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	expires := time.Now().Add(duration)
+	for _, prefix := range parseWhitelist(ips) {
+		s.whitelisted.add(prefix, expires)
+		s.excluded[prefix] = true
+	}
+}
+
+// ExpireWhitelist removes the temporary entries that have expired and returns their IPs
+func (s *Service) ExpireWhitelist() []string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.whitelisted.expire(time.Now())
+}
+
+// RemoveWhitelist removes IPs and CIDR ranges from the service's whitelist,
+// including entries it got from the package-level whitelist. Removing a range
+// removes that entry, not the addresses inside it.
+func (s *Service) RemoveWhitelist(ips ...string) {
+	s.RemoveWhitelistPrefix(parseWhitelist(ips)...)
+}
+
+// RemoveWhitelistPrefix removes ranges from the service's whitelist, see
+// RemoveWhitelist
+func (s *Service) RemoveWhitelistPrefix(prefixes ...netip.Prefix) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for _, prefix := range prefixes {
+		prefix = ipaddr.CanonicalPrefix(prefix)
+		s.whitelisted.remove(prefix)
+		s.excluded[prefix] = true
+	}
+}
+
+// ReplaceWhitelist replaces the service's whitelist, dropping temporary
+// entries. The service stops following changes to the package-level whitelist.
+func (s *Service) ReplaceWhitelist(ips []string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.ownWhitelist = true
+	s.defaults = newWhitelistSet()
+	s.excluded = make(map[netip.Prefix]bool)
+	s.whitelisted = newWhitelistSet()
+	for _, prefix := range parseWhitelist(ips) {
+		s.whitelisted.add(prefix, time.Time{})
+	}
+}
+
+// Stats reports the cost of the service's compiled rule set
+func (s *Service) Stats() RuleStats {
+	return s.patterns().stats()
+}
+
+// Warm compiles the current patterns if they changed since the service was
+// created and runs the probe paths through them, so the first request does
+// not pay for compilation
+func (s *Service) Warm() {
+	compiled := s.patterns()
+	for _, path := range probePaths {
+		compiled.match(strings.ToLower(path))
+	}
+}
+
+// patterns returns the compiled patterns, recompiling them if the
+// package-level patterns or weights changed since the last compilation
+func (s *Service) patterns() *compiledPatterns {
+	compiled := s.compiled.Load()
+	if compiled.generation == patternsGeneration.Load() {
+		return compiled
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.compiled.Load().generation != patternsGeneration.Load() {
+		s.recompile()
+	}
+	return s.compiled.Load()
+}
+
+// recompile compiles the service's current patterns. The caller must hold the lock.
+func (s *Service) recompile() {
+	s.compiled.Store(compilePatterns(s.effectivePatterns()).withAllow(s.allowPatterns))
+}
+
+// effectivePatterns returns the patterns the service matches against:
+// its own list after ReplacePatterns, otherwise the package-level patterns
+// with the service's additions and removals applied. The caller must hold the lock.
+func (s *Service) effectivePatterns() []string {
+	if s.ownPatterns {
+		return append([]string(nil), s.patternList...)
+	}
+
+	patterns := withoutPatterns(defaultPatterns(), s.removedPatterns)
+	return append(patterns, s.addedPatterns...)
+}
+
+// refreshDefaultWhitelist takes a new snapshot of the package-level
+// whitelist. The caller must hold the lock.
+func (s *Service) refreshDefaultWhitelist() {
+	s.whitelistGeneration = whitelistGeneration.Load()
+	s.defaults = defaultWhitelist()
+}
+
+// withoutPatterns returns the patterns whose normalized form is not in remove
+func withoutPatterns(patterns []string, remove map[string]bool) []string {
+	kept := make([]string, 0, len(patterns))
+	for _, pattern := range patterns {
+		if !remove[normalizePattern(pattern)] {
+			kept = append(kept, pattern)
+		}
+	}
+	return kept
+}
+
+// Lint checks the service's patterns for duplicates and shadowed prefixes,
+// and against its allow patterns for conflicts
+func (s *Service) Lint() []LintWarning {
+	return lintPatterns(s.Patterns(), s.AllowPatterns())
 }
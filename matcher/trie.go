@@ -0,0 +1,80 @@
+package matcher
+
+// trie indexes the compiled patterns byte by byte, so a path is checked
+// against every pattern in a single walk over the path. Matching costs
+// O(path length) however many patterns are loaded.
+type trie struct {
+	nodes []trieNode // The root is nodes[0]
+}
+
+// trieNode is a prefix shared by one or more patterns
+type trieNode struct {
+	labels   []byte  // Bytes that extend the prefix
+	children []int32 // Node of each label
+	pattern  int32   // Index of the pattern ending here, -1 if none
+}
+
+// newTrie builds a trie of patterns, which must be non-empty and distinct
+func newTrie(patterns []string) *trie {
+	t := &trie{nodes: []trieNode{{pattern: -1}}}
+	for i, pattern := range patterns {
+		t.insert(pattern, int32(i))
+	}
+	return t
+}
+
+// insert adds a pattern, creating the nodes its bytes need
+func (t *trie) insert(pattern string, index int32) {
+	node := int32(0)
+	for i := 0; i < len(pattern); i++ {
+		next := t.child(node, pattern[i])
+		if next < 0 {
+			next = int32(len(t.nodes))
+			t.nodes = append(t.nodes, trieNode{pattern: -1})
+			t.nodes[node].labels = append(t.nodes[node].labels, pattern[i])
+			t.nodes[node].children = append(t.nodes[node].children, next)
+		}
+		node = next
+	}
+	t.nodes[node].pattern = index
+}
+
+// child returns the node that extends a node by one byte, -1 if none does
+func (t *trie) child(node int32, b byte) int32 {
+	n := &t.nodes[node]
+	for i, label := range n.labels {
+		if label == b {
+			return n.children[i]
+		}
+	}
+	return -1
+}
+
+// walk returns the index of the longest pattern the path starts with, or of
+// the shortest with first set, and -1 if the path starts with none
+func (t *trie) walk(path string, first bool) int {
+	found := -1
+	node := int32(0)
+	for i := 0; i < len(path); i++ {
+		if node = t.child(node, path[i]); node < 0 {
+			break
+		}
+		if pattern := t.nodes[node].pattern; pattern >= 0 {
+			found = int(pattern)
+			if first {
+				break
+			}
+		}
+	}
+	return found
+}
+
+// memoryBytes returns an approximation of the memory held by the trie
+func (t *trie) memoryBytes() int {
+	// Each node holds two slice headers of 24 bytes and a 4-byte index
+	size := cap(t.nodes) * 56
+	for _, node := range t.nodes {
+		size += cap(node.labels) + cap(node.children)*4
+	}
+	return size
+}
@@ -0,0 +1,66 @@
+package matcher
+
+// DefaultWeight is the score of a pattern that has no entry in Weights
+const DefaultWeight = 1
+
+// Weights maps patterns to their severity score. A request matching several
+// patterns is scored by the longest (most specific) one.
+var Weights = map[string]int{
+	"/.env":                 10,
+	"/.git":                 10,
+	"/.htpasswd":            10,
+	"/.htaccess":            5,
+	"/web.config":           5,
+	"/wp-content/debug.log": 5,
+	"/backup":               5,
+	"/phpmyadmin":           5,
+	"/debug/pprof":          5,
+	"/server-status":        3,
+	"/server-info":          3,
+	"/elmah.axd":            3,
+	"/trace.axd":            3,
+	"/wp-login.php":         3,
+	"/wp-admin":             3,
+	"/jenkins":              3,
+	"/console":              3,
+	"/admin":                3,
+	"/config":               3,
+}
+
+// SetWeight sets the severity score of a pattern used by all services
+func SetWeight(pattern string, weight int) {
+	defaultsMutex.Lock()
+	defer defaultsMutex.Unlock()
+
+	Weights[pattern] = weight
+	patternsGeneration.Add(1)
+}
+
+// InstantBlock lists patterns that block an IP on the first request,
+// bypassing the grace period and score threshold
+var InstantBlock = map[string]bool{}
+
+// PatternOptions configures patterns added with AddPatternsWithOptions
+type PatternOptions struct {
+	Weight  int  // Severity score, 0 keeps the existing or default weight
+	Instant bool // Block on the first request, bypassing the grace period
+}
+
+// AddPatternsWithOptions adds patterns with a severity score and instant-block setting
+func AddPatternsWithOptions(options PatternOptions, patterns ...string) {
+	defaultsMutex.Lock()
+	defer defaultsMutex.Unlock()
+
+	for _, pattern := range patterns {
+		if options.Weight > 0 {
+			Weights[pattern] = options.Weight
+		}
+		if options.Instant {
+			InstantBlock[pattern] = true
+		} else {
+			delete(InstantBlock, pattern)
+		}
+	}
+	Patterns = append(Patterns, patterns...)
+	patternsGeneration.Add(1)
+}
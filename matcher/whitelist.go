@@ -1,6 +1,16 @@
 package matcher
 
-// Whitelist is a list of IP addresses that should never be blocked
+import (
+	"net/netip"
+	"sync/atomic"
+	"time"
+
+	"github.com/headswim/whoen/ipaddr"
+)
+
+// Whitelist is a list of IP addresses and CIDR ranges that should never be
+// blocked. Change it through SetWhitelist and AddToWhitelist so running
+// services see the change.
 var Whitelist = []string{
 	// Google DNS
 	"8.8.8.8",
@@ -18,3 +28,170 @@ var Whitelist = []string{
 	// "192.168.1.100", // Example: Your admin IP
 	// "10.0.0.5",      // Example: Your monitoring system
 }
+
+// PrivateNetworks are the private, link-local and loopback ranges, added
+// to an instance's whitelist by Config.WhitelistPrivateNetworks
+var PrivateNetworks = []string{
+	// RFC 1918 private networks and IPv6 unique local addresses
+	"10.0.0.0/8",
+	"172.16.0.0/12",
+	"192.168.0.0/16",
+	"fc00::/7",
+
+	// Link-local
+	"169.254.0.0/16",
+	"fe80::/10",
+
+	// Loopback
+	"127.0.0.0/8",
+	"::1/128",
+}
+
+// whitelistGeneration is bumped whenever the package-level whitelist changes
+// through SetWhitelist or AddToWhitelist, so services know to refresh it
+var whitelistGeneration atomic.Uint64
+
+// SetWhitelist replaces the package-level whitelist. Services that have not
+// replaced their own whitelist pick up the change on their next lookup.
+func SetWhitelist(ips []string) {
+	defaultsMutex.Lock()
+	defer defaultsMutex.Unlock()
+
+	Whitelist = ips
+	whitelistGeneration.Add(1)
+}
+
+// AddToWhitelist appends to the package-level whitelist. Services that have
+// not replaced their own whitelist pick up the change on their next lookup.
+func AddToWhitelist(ips ...string) {
+	defaultsMutex.Lock()
+	defer defaultsMutex.Unlock()
+
+	Whitelist = append(Whitelist, ips...)
+	whitelistGeneration.Add(1)
+}
+
+// defaultWhitelist returns the package-level whitelist as a set
+func defaultWhitelist() whitelistSet {
+	defaultsMutex.RLock()
+	defer defaultsMutex.RUnlock()
+
+	set := newWhitelistSet()
+	for _, entry := range Whitelist {
+		if prefix, err := ipaddr.ParsePrefix(entry); err == nil {
+			set.add(prefix, time.Time{})
+		}
+	}
+	return set
+}
+
+// whitelistSet holds whitelist entries, each to the expiry of a temporary
+// entry (zero for permanent ones). Single addresses are kept in a map for
+// O(1) lookup, wider ranges are checked one by one.
+type whitelistSet struct {
+	ips    map[netip.Addr]time.Time
+	ranges map[netip.Prefix]time.Time
+}
+
+// newWhitelistSet creates an empty set
+func newWhitelistSet() whitelistSet {
+	return whitelistSet{
+		ips:    make(map[netip.Addr]time.Time),
+		ranges: make(map[netip.Prefix]time.Time),
+	}
+}
+
+// add adds an entry, replacing the expiry of an existing one
+func (s whitelistSet) add(prefix netip.Prefix, expires time.Time) {
+	if prefix.IsSingleIP() {
+		s.ips[prefix.Addr()] = expires
+	} else {
+		s.ranges[prefix] = expires
+	}
+}
+
+// remove removes an entry
+func (s whitelistSet) remove(prefix netip.Prefix) {
+	if prefix.IsSingleIP() {
+		delete(s.ips, prefix.Addr())
+	} else {
+		delete(s.ranges, prefix)
+	}
+}
+
+// has reports whether the set holds an entry, expired or not
+func (s whitelistSet) has(prefix netip.Prefix) bool {
+	var exists bool
+	if prefix.IsSingleIP() {
+		_, exists = s.ips[prefix.Addr()]
+	} else {
+		_, exists = s.ranges[prefix]
+	}
+	return exists
+}
+
+// contains reports whether an unexpired entry that is not excluded covers addr
+func (s whitelistSet) contains(addr netip.Addr, excluded map[netip.Prefix]bool) bool {
+	if expires, exists := s.ips[addr]; exists && unexpired(expires) &&
+		!excluded[netip.PrefixFrom(addr, addr.BitLen())] {
+		return true
+	}
+	for prefix, expires := range s.ranges {
+		if prefix.Contains(addr) && unexpired(expires) && !excluded[prefix] {
+			return true
+		}
+	}
+	return false
+}
+
+// unexpired reports whether an entry with the given expiry is in force. Only
+// temporary entries read the clock.
+func unexpired(expires time.Time) bool {
+	return expires.IsZero() || time.Now().Before(expires)
+}
+
+// entries returns the unexpired entries as strings
+func (s whitelistSet) entries(now time.Time) []string {
+	list := make([]string, 0, len(s.ips)+len(s.ranges))
+	for addr, expires := range s.ips {
+		if expires.IsZero() || now.Before(expires) {
+			list = append(list, addr.String())
+		}
+	}
+	for prefix, expires := range s.ranges {
+		if expires.IsZero() || now.Before(expires) {
+			list = append(list, prefix.String())
+		}
+	}
+	return list
+}
+
+// expire removes the temporary entries that have expired and returns them
+func (s whitelistSet) expire(now time.Time) []string {
+	var expired []string
+	for addr, expires := range s.ips {
+		if !expires.IsZero() && !now.Before(expires) {
+			delete(s.ips, addr)
+			expired = append(expired, addr.String())
+		}
+	}
+	for prefix, expires := range s.ranges {
+		if !expires.IsZero() && !now.Before(expires) {
+			delete(s.ranges, prefix)
+			expired = append(expired, prefix.String())
+		}
+	}
+	return expired
+}
+
+// parseWhitelist parses whitelist entries, skipping those that are neither
+// an IP address nor a CIDR range
+func parseWhitelist(entries []string) []netip.Prefix {
+	prefixes := make([]netip.Prefix, 0, len(entries))
+	for _, entry := range entries {
+		if prefix, err := ipaddr.ParsePrefix(entry); err == nil {
+			prefixes = append(prefixes, prefix)
+		}
+	}
+	return prefixes
+}
@@ -0,0 +1,278 @@
+package middleware
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/headswim/whoen/audit"
+	"github.com/headswim/whoen/blocker"
+	"github.com/headswim/whoen/cluster"
+	"github.com/headswim/whoen/ipaddr"
+	"github.com/headswim/whoen/matcher"
+	"github.com/headswim/whoen/storage"
+)
+
+// Admin performs operator actions on behalf of an actor. Every mutation is
+// written to the audit log together with the previous state of the IP.
+type Admin struct {
+	middleware *Middleware
+	actor      string
+}
+
+// Admin returns an Admin that attributes its actions to actor
+// (for example a user name, API key ID or "cli:alice")
+func (m *Middleware) Admin(actor string) *Admin {
+	return &Admin{
+		middleware: m,
+		actor:      actor,
+	}
+}
+
+// AddToWhitelistFor whitelists an IP until the duration has passed. It is
+// Admin.WhitelistFor attributed to "application", for code that has no
+// operator to name.
+func (m *Middleware) AddToWhitelistFor(ip string, duration time.Duration) error {
+	return m.Admin("application").WhitelistFor(ip, duration, "")
+}
+
+// ActiveBlocks returns the blocks in force, oldest first
+func (m *Middleware) ActiveBlocks() ([]storage.BlockStatus, error) {
+	blockedIPs, err := m.storage.GetBlockedIPs()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read blocked IPs: %w", err)
+	}
+
+	now := time.Now()
+	active := make([]storage.BlockStatus, 0, len(blockedIPs))
+	for _, status := range blockedIPs {
+		if status.IsPermanent || now.Before(status.BlockedUntil) {
+			active = append(active, status)
+		}
+	}
+	sort.Slice(active, func(i, j int) bool {
+		return active[i].BlockedAt.Before(active[j].BlockedAt)
+	})
+	return active, nil
+}
+
+// WhitelistEntries returns the IPs and CIDR ranges the matcher whitelists,
+// including the defaults and temporary entries
+func (m *Middleware) WhitelistEntries() ([]string, error) {
+	lister, ok := m.matcher.(interface{ Whitelist() []string })
+	if !ok {
+		return nil, fmt.Errorf("matcher cannot list its whitelist")
+	}
+	return lister.Whitelist(), nil
+}
+
+// BlockIP blocks an IP proactively, for the given duration or permanently if
+// duration is 0, e.g. during an incident. The block is recorded with the
+// source SourceAdmin, the reason and the operator, so it stands apart from
+// detections in storage, hooks and the audit log. It is Admin.Block
+// attributed to operator, or to "application" if operator is empty.
+func (m *Middleware) BlockIP(ip string, duration time.Duration, reason, operator string) error {
+	if operator == "" {
+		operator = "application"
+	}
+	return m.Admin(operator).Block(ip, duration, reason)
+}
+
+// Block blocks an IP for the given duration, or permanently if duration is 0,
+// recording the reason and the actor as its operator with the block
+func (a *Admin) Block(ip string, duration time.Duration, reason string) error {
+	ip = ipaddr.Normalize(ip)
+	m := a.middleware
+	previous := a.state(ip)
+
+	blockType := blocker.Ban
+	until := time.Time{}
+	if duration > 0 {
+		blockType = blocker.Timeout
+		until = time.Now().Add(duration)
+	}
+
+	if _, err := m.blocker.Block(ip, blockType, duration); err != nil {
+		return fmt.Errorf("failed to block IP %s: %w", ip, err)
+	}
+
+	// Keep the counts of an earlier record, replacing what the block is and
+	// who made it
+	_, status, err := m.storage.IsIPBlocked(ip)
+	if err != nil {
+		return fmt.Errorf("failed to read block of IP %s: %w", ip, err)
+	}
+	record := storage.BlockStatus{IP: ip, BlockedAt: time.Now()}
+	if status != nil {
+		record = *status
+	}
+	record.BlockedUntil = until
+	record.IsPermanent = duration == 0
+	record.LastRequestPath = ""
+	record.Source = SourceAdmin
+	record.Reason = reason
+	record.Operator = a.actor
+	if err := storage.PutBlock(m.storage, record); err != nil {
+		return fmt.Errorf("failed to store block for IP %s: %w", ip, err)
+	}
+
+	m.publish(cluster.Message{
+		Type:        cluster.MessageBlock,
+		IP:          ip,
+		Until:       until,
+		IsPermanent: duration == 0,
+		Source:      SourceAdmin,
+		Reason:      reason,
+		Operator:    a.actor,
+	})
+	m.onBlock(BlockInfo{
+		IP:        ip,
+		Duration:  duration,
+		Until:     until,
+		Permanent: duration == 0,
+		Source:    SourceAdmin,
+		Actor:     a.actor,
+		Reason:    reason,
+	})
+	m.logger.Printf("%s blocked IP %s (duration: %v, reason: %s)", a.actor, ip, duration, reason)
+	return a.record(audit.ActionBlock, ip, reason, previous)
+}
+
+// Unblock removes the block on an IP and resets its request count
+func (a *Admin) Unblock(ip string, reason string) error {
+	ip = ipaddr.Normalize(ip)
+	m := a.middleware
+	previous := a.state(ip)
+
+	if err := m.blocker.Unblock(ip); err != nil {
+		return fmt.Errorf("failed to unblock IP %s: %w", ip, err)
+	}
+	if err := m.storage.UnblockIP(ip); err != nil {
+		return fmt.Errorf("failed to remove block for IP %s from storage: %w", ip, err)
+	}
+	if err := m.storage.ResetRequestCount(ip); err != nil {
+		return fmt.Errorf("failed to reset request count for IP %s: %w", ip, err)
+	}
+
+	m.publishUnblock(ip)
+	m.onUnblock(UnblockInfo{IP: ip, Source: SourceAdmin, Actor: a.actor, Reason: reason})
+	m.logger.Printf("%s unblocked IP %s (reason: %s)", a.actor, ip, reason)
+	return a.record(audit.ActionUnblock, ip, reason, previous)
+}
+
+// Whitelist adds an IP or CIDR range to the whitelist of the middleware's matcher
+func (a *Admin) Whitelist(ip string, reason string) error {
+	ip = ipaddr.Normalize(ip)
+	manager, ok := a.middleware.matcher.(matcher.WhitelistManager)
+	if !ok {
+		return fmt.Errorf("matcher does not support whitelist changes")
+	}
+
+	previous := a.state(ip)
+	manager.AddWhitelist(ip)
+	if err := a.saveWhitelist(storage.AddToWhitelistFile, ip); err != nil {
+		return err
+	}
+
+	a.middleware.logger.Printf("%s whitelisted IP %s (reason: %s)", a.actor, ip, reason)
+	return a.record(audit.ActionWhitelistAdd, ip, reason, previous)
+}
+
+// WhitelistFor whitelists an IP until the duration has passed, for example to
+// exempt a customer while debugging. Temporary entries are kept in memory only
+// and are removed by the cleanup loop once expired.
+func (a *Admin) WhitelistFor(ip string, duration time.Duration, reason string) error {
+	ip = ipaddr.Normalize(ip)
+	manager, ok := a.middleware.matcher.(matcher.TemporaryWhitelister)
+	if !ok {
+		return fmt.Errorf("matcher does not support temporary whitelist entries")
+	}
+
+	previous := a.state(ip)
+	manager.AddWhitelistFor(duration, ip)
+	expires := time.Now().Add(duration)
+
+	a.middleware.logger.Printf("%s whitelisted IP %s until %s (reason: %s)", a.actor, ip, expires.Format(time.RFC3339), reason)
+
+	entry := a.entry(audit.ActionWhitelistAdd, ip, reason, previous)
+	entry.Expires = expires
+	return a.log(entry)
+}
+
+// Unwhitelist removes an IP or CIDR range from the whitelist of the middleware's matcher
+func (a *Admin) Unwhitelist(ip string, reason string) error {
+	ip = ipaddr.Normalize(ip)
+	manager, ok := a.middleware.matcher.(matcher.WhitelistManager)
+	if !ok {
+		return fmt.Errorf("matcher does not support whitelist changes")
+	}
+
+	previous := a.state(ip)
+	manager.RemoveWhitelist(ip)
+	if err := a.saveWhitelist(storage.RemoveFromWhitelistFile, ip); err != nil {
+		return err
+	}
+
+	a.middleware.logger.Printf("%s removed IP %s from the whitelist (reason: %s)", a.actor, ip, reason)
+	return a.record(audit.ActionWhitelistRemove, ip, reason, previous)
+}
+
+// saveWhitelist applies a whitelist change to the whitelist file so it
+// survives restarts. Nothing is written when no file is configured or storage
+// is memory-only.
+func (a *Admin) saveWhitelist(change func(path, ip string) error, ip string) error {
+	m := a.middleware
+	if m.options.Config.WhitelistFile == "" || m.persistMode == storage.PersistMemory {
+		return nil
+	}
+	if err := change(m.options.Config.WhitelistFile, ip); err != nil {
+		return fmt.Errorf("whitelist change for IP %s applied but not saved: %w", ip, err)
+	}
+	return nil
+}
+
+// state captures the current state of an IP for the audit log
+func (a *Admin) state(ip string) *audit.State {
+	m := a.middleware
+	state := &audit.State{Whitelisted: m.matcher.IsWhitelisted(ip)}
+
+	blocked, status, err := m.storage.IsIPBlocked(ip)
+	if err != nil {
+		m.logger.Printf("Error reading block state of IP %s for the audit log: %v", ip, err)
+		return state
+	}
+	if blocked && status != nil {
+		state.Blocked = true
+		state.IsPermanent = status.IsPermanent
+		if !status.IsPermanent {
+			state.BlockedUntil = status.BlockedUntil
+		}
+	}
+	return state
+}
+
+// record writes an audit entry for a completed action
+func (a *Admin) record(action, ip, reason string, previous *audit.State) error {
+	return a.log(a.entry(action, ip, reason, previous))
+}
+
+// entry builds the audit entry for a completed action
+func (a *Admin) entry(action, ip, reason string, previous *audit.State) audit.Entry {
+	return audit.Entry{
+		Time:     time.Now(),
+		Actor:    a.actor,
+		Action:   action,
+		IP:       ip,
+		Reason:   reason,
+		Previous: previous,
+		Current:  a.state(ip),
+	}
+}
+
+// log writes an audit entry
+func (a *Admin) log(entry audit.Entry) error {
+	if err := a.middleware.auditLogger.Log(entry); err != nil {
+		return fmt.Errorf("%s of IP %s succeeded but could not be audited: %w", entry.Action, entry.IP, err)
+	}
+	return nil
+}
@@ -0,0 +1,394 @@
+package middleware
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/headswim/whoen/ipaddr"
+	"github.com/headswim/whoen/sshguard"
+)
+
+// Headers of signed admin API requests
+const (
+	HeaderTimestamp      = "X-Whoen-Timestamp"   // Unix seconds when the request was signed
+	HeaderNonce          = "X-Whoen-Nonce"       // Random value, unique per request
+	HeaderSignature      = "X-Whoen-Signature"   // Hex HMAC-SHA256 of the request, see SignAdminRequest
+	HeaderActor          = "X-Whoen-Actor"       // Who the action is attributed to in the audit log
+	HeaderIdempotencyKey = "Idempotency-Key"     // Makes retries of a mutation return the first result
+	HeaderReplayed       = "Idempotent-Replayed" // Set on responses repeated for an idempotency key
+)
+
+// maxAdminBody is the largest admin API request body read
+const maxAdminBody = 64 << 10
+
+// AdminRequest is the JSON body of an admin API request
+type AdminRequest struct {
+	IP       string `json:"ip"`
+	Duration string `json:"duration,omitempty"` // e.g. "24h"; empty blocks permanently or whitelists for good
+	Reason   string `json:"reason,omitempty"`
+	Line     string `json:"line,omitempty"` // sshd log line reported to .../ssh
+}
+
+// AdminResponse is the JSON body of an admin API response
+type AdminResponse struct {
+	Action string `json:"action,omitempty"`
+	IP     string `json:"ip,omitempty"`
+	Error  string `json:"error,omitempty"`
+
+	Blocked bool `json:"blocked,omitempty"` // Whether an IP reported to .../ssh is refused now
+}
+
+// adminResult is a response kept for an idempotency key
+type adminResult struct {
+	fingerprint string
+	status      int
+	body        []byte
+	done        bool // False while the first request is still running
+	expires     time.Time
+}
+
+// adminAPI holds the state that protects the admin API against replays and
+// double application of retried mutations
+type adminAPI struct {
+	mutex   sync.Mutex
+	nonces  map[string]time.Time   // Nonces seen, until they fall out of the accepted skew
+	results map[string]adminResult // Results by actor and idempotency key
+
+	// Sizes of nonces and results at which new entries first drop the
+	// expired ones, so both stay bounded without periodic cleanup
+	pruneNonces  int
+	pruneResults int
+}
+
+// minAdminPrune is the smallest size of the admin API maps that is pruned
+// when entries are added
+const minAdminPrune = 64
+
+// newAdminAPI creates the admin API state
+func newAdminAPI() *adminAPI {
+	return &adminAPI{
+		nonces:       make(map[string]time.Time),
+		results:      make(map[string]adminResult),
+		pruneNonces:  minAdminPrune,
+		pruneResults: minAdminPrune,
+	}
+}
+
+// SignAdminRequest signs an admin API request with the shared secret, for
+// automation calling AdminHandler. body must be the exact request body.
+func SignAdminRequest(r *http.Request, body []byte, secret, actor string) error {
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return fmt.Errorf("failed to generate nonce: %w", err)
+	}
+
+	r.Header.Set(HeaderTimestamp, strconv.FormatInt(time.Now().Unix(), 10))
+	r.Header.Set(HeaderNonce, hex.EncodeToString(nonce))
+	r.Header.Set(HeaderActor, actor)
+	r.Header.Set(HeaderSignature, adminSignature(r, body, []byte(secret)))
+	return nil
+}
+
+// adminSignature computes the signature of a request over its method, path,
+// signing headers and body
+func adminSignature(r *http.Request, body []byte, secret []byte) string {
+	sum := sha256.Sum256(body)
+	h := hmac.New(sha256.New, secret)
+	fmt.Fprintf(h, "%s\n%s\n%s\n%s\n%s\n%s", r.Method, signedPath(r),
+		r.Header.Get(HeaderTimestamp), r.Header.Get(HeaderNonce), r.Header.Get(HeaderActor), hex.EncodeToString(sum[:]))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// signedPath returns the path the client sent, before a prefix was stripped
+// from the request on the way to the handler
+func signedPath(r *http.Request) string {
+	if r.RequestURI != "" {
+		if u, err := url.ParseRequestURI(r.RequestURI); err == nil {
+			return u.Path
+		}
+	}
+	return r.URL.Path
+}
+
+// AdminHandler returns an http.Handler that exposes the Admin actions to
+// automation: POST to .../block, .../unblock, .../whitelist or .../unwhitelist
+// with an AdminRequest body. Log shippers POST failed SSH logins to .../ssh,
+// see reportSSH. Requests must be signed with Config.AdminSecret
+// (see SignAdminRequest); stale and replayed requests are rejected. A request
+// with an Idempotency-Key header runs once; retries with the same key get the
+// first response back instead of repeating the firewall and edge changes.
+func (m *Middleware) AdminHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if m.options.Config.AdminSecret == "" {
+			writeAdmin(w, http.StatusServiceUnavailable, AdminResponse{Error: "admin API is disabled, set AdminSecret"})
+			return
+		}
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			writeAdmin(w, http.StatusMethodNotAllowed, AdminResponse{Error: "method not allowed"})
+			return
+		}
+
+		body, err := io.ReadAll(io.LimitReader(r.Body, maxAdminBody))
+		if err != nil {
+			writeAdmin(w, http.StatusBadRequest, AdminResponse{Error: "failed to read request body"})
+			return
+		}
+		if err := m.verifyAdminRequest(r, body); err != nil {
+			m.logger.Printf("Rejected admin API request from %s: %v", r.RemoteAddr, err)
+			writeAdmin(w, http.StatusUnauthorized, AdminResponse{Error: err.Error()})
+			return
+		}
+
+		actor := "api"
+		if name := r.Header.Get(HeaderActor); name != "" {
+			actor = "api:" + name
+		}
+
+		// Run mutations without an idempotency key right away
+		key := r.Header.Get(HeaderIdempotencyKey)
+		if key == "" {
+			status, response := m.adminAction(actor, path.Base(r.URL.Path), body)
+			writeAdmin(w, status, response)
+			return
+		}
+
+		// Scope keys to the actor so callers cannot see each other's results
+		key = actor + "\x00" + key
+		sum := sha256.Sum256(append([]byte(r.URL.Path+"\n"), body...))
+		fingerprint := hex.EncodeToString(sum[:])
+
+		result, ok := m.adminAPI.reserve(key, fingerprint, m.options.Config.IdempotencyKeyTTL)
+		if ok {
+			switch {
+			case result.fingerprint != fingerprint:
+				writeAdmin(w, http.StatusUnprocessableEntity, AdminResponse{Error: "idempotency key was used for a different request"})
+			case !result.done:
+				writeAdmin(w, http.StatusConflict, AdminResponse{Error: "a request with this idempotency key is in progress"})
+			default:
+				w.Header().Set(HeaderReplayed, "true")
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(result.status)
+				w.Write(result.body)
+			}
+			return
+		}
+
+		status, response := m.adminAction(actor, path.Base(r.URL.Path), body)
+		encoded, _ := json.Marshal(response)
+		m.adminAPI.complete(key, status, encoded)
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		w.Write(encoded)
+	})
+}
+
+// verifyAdminRequest checks the signature of a request and that it is fresh
+// and has not been seen before
+func (m *Middleware) verifyAdminRequest(r *http.Request, body []byte) error {
+	skew := m.options.Config.AdminMaxSkew
+
+	unix, err := strconv.ParseInt(r.Header.Get(HeaderTimestamp), 10, 64)
+	if err != nil {
+		return fmt.Errorf("missing or invalid %s header", HeaderTimestamp)
+	}
+	signed := time.Unix(unix, 0)
+	if age := time.Since(signed); age > skew || age < -skew {
+		return fmt.Errorf("request timestamp is outside the accepted skew of %v", skew)
+	}
+
+	nonce := r.Header.Get(HeaderNonce)
+	if nonce == "" || len(nonce) > 128 {
+		return fmt.Errorf("missing or invalid %s header", HeaderNonce)
+	}
+
+	expected := adminSignature(r, body, []byte(m.options.Config.AdminSecret))
+	if !hmac.Equal([]byte(r.Header.Get(HeaderSignature)), []byte(expected)) {
+		return fmt.Errorf("invalid signature")
+	}
+
+	// Check the nonce last, so unsigned requests cannot use up nonces
+	if !m.adminAPI.useNonce(nonce, signed.Add(skew)) {
+		return fmt.Errorf("replayed request")
+	}
+	return nil
+}
+
+// adminAction runs an admin action and returns the response status and body
+func (m *Middleware) adminAction(actor, action string, body []byte) (int, AdminResponse) {
+	var request AdminRequest
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&request); err != nil {
+		return http.StatusBadRequest, AdminResponse{Error: fmt.Sprintf("invalid request body: %v", err)}
+	}
+	if action == "ssh" {
+		return m.reportSSH(request)
+	}
+	// Whitelist entries may be CIDR ranges, and so may the subnet blocks
+	// lifted by unblock. Blocks are made per address.
+	if action == "whitelist" || action == "unwhitelist" || action == "unblock" {
+		prefix, err := ipaddr.ParsePrefix(request.IP)
+		if err != nil {
+			return http.StatusBadRequest, AdminResponse{Error: fmt.Sprintf("invalid IP address or range %q", request.IP)}
+		}
+		request.IP = ipaddr.String(prefix)
+	} else {
+		addr, err := ipaddr.Parse(request.IP)
+		if err != nil {
+			return http.StatusBadRequest, AdminResponse{Error: fmt.Sprintf("invalid IP address %q", request.IP)}
+		}
+		request.IP = addr.String()
+	}
+
+	var duration time.Duration
+	if request.Duration != "" {
+		parsed, err := time.ParseDuration(request.Duration)
+		if err != nil || parsed <= 0 {
+			return http.StatusBadRequest, AdminResponse{Error: fmt.Sprintf("invalid duration %q", request.Duration)}
+		}
+		duration = parsed
+	}
+
+	admin := m.Admin(actor)
+	var err error
+	switch action {
+	case "block":
+		err = admin.Block(request.IP, duration, request.Reason)
+	case "unblock":
+		err = admin.Unblock(request.IP, request.Reason)
+	case "whitelist":
+		if duration > 0 {
+			err = admin.WhitelistFor(request.IP, duration, request.Reason)
+		} else {
+			err = admin.Whitelist(request.IP, request.Reason)
+		}
+	case "unwhitelist":
+		err = admin.Unwhitelist(request.IP, request.Reason)
+	default:
+		return http.StatusNotFound, AdminResponse{Error: fmt.Sprintf("unknown action %q", action)}
+	}
+	if err != nil {
+		m.logger.Printf("Admin API %s of IP %s failed: %v", action, request.IP, err)
+		return http.StatusInternalServerError, AdminResponse{Action: action, IP: request.IP, Error: err.Error()}
+	}
+	return http.StatusOK, AdminResponse{Action: action, IP: request.IP}
+}
+
+// reportSSH counts an SSH event sent to the admin API: the sshd log line in
+// Line, or a failed login of user Reason from IP without one
+func (m *Middleware) reportSSH(request AdminRequest) (int, AdminResponse) {
+	event := sshguard.Event{Kind: sshguard.FailedLogin, IP: request.IP, User: request.Reason}
+	if request.Line != "" {
+		parsed, ok := sshguard.Parse(request.Line)
+		if !ok {
+			return http.StatusUnprocessableEntity, AdminResponse{Action: "ssh", Error: "line reports no failed SSH login"}
+		}
+		event = parsed
+	} else if addr, err := ipaddr.Parse(request.IP); err == nil {
+		event.IP = addr.String()
+	} else {
+		return http.StatusBadRequest, AdminResponse{Error: fmt.Sprintf("invalid IP address %q", request.IP)}
+	}
+
+	decision, err := m.ReportSSH(event)
+	if err != nil {
+		return http.StatusInternalServerError, AdminResponse{Action: "ssh", IP: event.IP, Error: err.Error()}
+	}
+	return http.StatusOK, AdminResponse{Action: "ssh", IP: event.IP, Blocked: decision.Blocked}
+}
+
+// writeAdmin writes an admin API response
+func writeAdmin(w http.ResponseWriter, status int, response AdminResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(response)
+}
+
+// useNonce records a nonce until it expires and reports whether it was new
+func (a *adminAPI) useNonce(nonce string, expires time.Time) bool {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	now := time.Now()
+	if until, ok := a.nonces[nonce]; ok && now.Before(until) {
+		return false
+	}
+	if len(a.nonces) >= a.pruneNonces {
+		a.pruneExpired(now)
+		a.pruneNonces = max(2*len(a.nonces), minAdminPrune)
+	}
+	a.nonces[nonce] = expires
+	return true
+}
+
+// reserve returns the result kept for an idempotency key. Without one, it
+// reserves the key for a request with the fingerprint and returns false.
+func (a *adminAPI) reserve(key, fingerprint string, ttl time.Duration) (adminResult, bool) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	now := time.Now()
+	if result, ok := a.results[key]; ok && now.Before(result.expires) {
+		return result, true
+	}
+	if len(a.results) >= a.pruneResults {
+		a.pruneExpired(now)
+		a.pruneResults = max(2*len(a.results), minAdminPrune)
+	}
+	a.results[key] = adminResult{fingerprint: fingerprint, expires: now.Add(ttl)}
+	return adminResult{}, false
+}
+
+// complete keeps the response for a reserved idempotency key. Failed
+// requests release the key instead, so the retry runs again.
+func (a *adminAPI) complete(key string, status int, body []byte) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	if status >= http.StatusInternalServerError {
+		delete(a.results, key)
+		return
+	}
+	result := a.results[key]
+	result.status = status
+	result.body = body
+	result.done = true
+	a.results[key] = result
+}
+
+// cleanup drops expired nonces and idempotency results
+func (a *adminAPI) cleanup() {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	a.pruneExpired(time.Now())
+}
+
+// pruneExpired drops the nonces and idempotency results that have expired.
+// The caller must hold the lock.
+func (a *adminAPI) pruneExpired(now time.Time) {
+	for nonce, until := range a.nonces {
+		if now.After(until) {
+			delete(a.nonces, nonce)
+		}
+	}
+	for key, result := range a.results {
+		if now.After(result.expires) {
+			delete(a.results, key)
+		}
+	}
+}
@@ -0,0 +1,40 @@
+package middleware
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+// TestAdminAPIPrunesOnUse checks that nonces and idempotency results stay
+// bounded without periodic cleanup, and that live nonces still reject replays
+func TestAdminAPIPrunesOnUse(t *testing.T) {
+	a := newAdminAPI()
+	past := time.Now().Add(-time.Second)
+	for i := 0; i < 10*minAdminPrune; i++ {
+		if !a.useNonce("old"+strconv.Itoa(i), past) {
+			t.Fatalf("nonce %d rejected", i)
+		}
+		a.reserve("old"+strconv.Itoa(i), "fingerprint", -time.Second)
+	}
+	if len(a.nonces) > minAdminPrune || len(a.results) > minAdminPrune {
+		t.Errorf("kept %d nonces and %d results that expired, want at most %d", len(a.nonces), len(a.results), minAdminPrune)
+	}
+
+	future := time.Now().Add(time.Minute)
+	for i := 0; i < 3*minAdminPrune; i++ {
+		a.useNonce("live"+strconv.Itoa(i), future)
+	}
+	for i := 0; i < 3*minAdminPrune; i++ {
+		if a.useNonce("live"+strconv.Itoa(i), future) {
+			t.Fatalf("live nonce %d accepted twice", i)
+		}
+	}
+	if len(a.nonces) > 4*minAdminPrune {
+		t.Errorf("kept %d nonces, want the live ones and few expired", len(a.nonces))
+	}
+
+	if !a.useNonce("old0", future) {
+		t.Error("nonce rejected after it expired")
+	}
+}
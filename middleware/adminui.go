@@ -0,0 +1,321 @@
+package middleware
+
+import (
+	"crypto/subtle"
+	"embed"
+	"encoding/json"
+	"io"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/headswim/whoen/ipaddr"
+)
+
+// adminUIFiles holds the page, script and styles of the admin web UI
+//
+//go:embed adminui
+var adminUIFiles embed.FS
+
+// HeaderAdminUI must be set on the admin UI's POST requests. Browsers only
+// send custom headers from the page's own origin, so other sites cannot
+// make a logged-in browser unblock or whitelist IPs.
+const HeaderAdminUI = "X-Whoen-UI"
+
+// Bounds of the admin UI's lists
+const (
+	maxUICounters      = 100  // Request counters shown, most requests first
+	maxTrackedPatterns = 1000 // Patterns whose hits are counted, later ones are not
+)
+
+// patternHits counts the detections of each pattern since the middleware
+// started and over the last hour, for the admin UI
+type patternHits struct {
+	mutex    sync.Mutex
+	patterns map[string]*patternHit
+}
+
+// patternHit holds the detections of one pattern
+type patternHit struct {
+	total  int
+	last   time.Time
+	recent *blockRate // Hits over the last hour, counted like blocks
+}
+
+// newPatternHits creates an empty pattern hit counter
+func newPatternHits() *patternHits {
+	return &patternHits{patterns: make(map[string]*patternHit)}
+}
+
+// add counts a detection of a pattern
+func (p *patternHits) add(pattern string, now time.Time) {
+	p.mutex.Lock()
+	hit, ok := p.patterns[pattern]
+	if !ok {
+		if len(p.patterns) >= maxTrackedPatterns {
+			p.mutex.Unlock()
+			return
+		}
+		hit = &patternHit{recent: newBlockRate(time.Hour)}
+		p.patterns[pattern] = hit
+	}
+	hit.total++
+	hit.last = now
+	p.mutex.Unlock()
+
+	hit.recent.add(now)
+}
+
+// uiPatternHit is a pattern's row in the admin UI
+type uiPatternHit struct {
+	Pattern  string    `json:"pattern"`
+	Total    int       `json:"total"`     // Detections since the middleware started
+	LastHour int       `json:"last_hour"` // Detections in the last hour
+	LastHit  time.Time `json:"last_hit"`
+}
+
+// list returns the hits of every pattern, busiest in the last hour first
+func (p *patternHits) list(now time.Time) []uiPatternHit {
+	p.mutex.Lock()
+	hits := make([]uiPatternHit, 0, len(p.patterns))
+	recent := make([]*blockRate, 0, len(p.patterns))
+	for pattern, hit := range p.patterns {
+		hits = append(hits, uiPatternHit{Pattern: pattern, Total: hit.total, LastHit: hit.last})
+		recent = append(recent, hit.recent)
+	}
+	p.mutex.Unlock()
+
+	for i := range hits {
+		hits[i].LastHour = recent[i].count(now)
+	}
+	sort.Slice(hits, func(i, j int) bool {
+		if hits[i].LastHour != hits[j].LastHour {
+			return hits[i].LastHour > hits[j].LastHour
+		}
+		if hits[i].Total != hits[j].Total {
+			return hits[i].Total > hits[j].Total
+		}
+		return hits[i].Pattern < hits[j].Pattern
+	})
+	return hits
+}
+
+// uiState is the data the admin UI shows
+type uiState struct {
+	Generated time.Time      `json:"generated"`
+	Actor     string         `json:"actor"`
+	Blocks    []uiBlock      `json:"blocks"`
+	Counters  []uiCounter    `json:"counters"`
+	Patterns  []uiPatternHit `json:"patterns"`
+	Whitelist []string       `json:"whitelist"`
+}
+
+// uiBlock is a block's row in the admin UI
+type uiBlock struct {
+	IP        string     `json:"ip"`
+	BlockedAt time.Time  `json:"blocked_at"`
+	Until     *time.Time `json:"until,omitempty"` // Unset for permanent bans
+	Permanent bool       `json:"permanent"`
+	Requests  int        `json:"requests"`
+	LastPath  string     `json:"last_path,omitempty"`
+	Source    string     `json:"source,omitempty"`
+	Reason    string     `json:"reason,omitempty"`
+	Operator  string     `json:"operator,omitempty"`
+}
+
+// uiCounter is a request counter's row in the admin UI
+type uiCounter struct {
+	IP       string    `json:"ip"`
+	Count    int       `json:"count"`
+	Score    int       `json:"score"`
+	LastPath string    `json:"last_path,omitempty"`
+	LastSeen time.Time `json:"last_seen"`
+	Blocked  bool      `json:"blocked"`
+}
+
+// uiAction is the body of the admin UI's unblock and whitelist requests
+type uiAction struct {
+	IP     string `json:"ip"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// AdminUIHandler returns an http.Handler serving a small web dashboard:
+// the blocks in force with the time they have left, the request counters,
+// the hits of each pattern and buttons to unblock and whitelist IPs. Mount
+// it on an internal route ending in a slash, such as /whoen/admin/. It is
+// protected by Config.AdminUIUser and Config.AdminUIPassword or by
+// Config.AdminUIToken, and disabled without them. Actions are recorded in
+// the audit log as the basic auth user, prefixed with "ui:".
+func (m *Middleware) AdminUIHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cfg := m.options.Config
+		if cfg.AdminUIPassword == "" && cfg.AdminUIToken == "" {
+			http.Error(w, "admin UI is disabled, set AdminUIPassword or AdminUIToken", http.StatusServiceUnavailable)
+			return
+		}
+		actor, ok := m.adminUIActor(r)
+		if !ok {
+			w.Header().Set("WWW-Authenticate", `Basic realm="whoen", charset="UTF-8"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		w.Header().Set("Cache-Control", "no-store")
+		w.Header().Set("X-Frame-Options", "DENY")
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		w.Header().Set("Content-Security-Policy", "default-src 'self'; frame-ancestors 'none'")
+
+		name := path.Base(r.URL.Path)
+		switch {
+		case r.Method == http.MethodPost && (name == "unblock" || name == "whitelist"):
+			m.serveAdminUIAction(w, r, actor, name)
+		case r.Method != http.MethodGet && r.Method != http.MethodHead:
+			w.Header().Set("Allow", "GET, HEAD, POST")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		case name == "state" && !strings.HasSuffix(r.URL.Path, "/"):
+			m.serveAdminUIState(w, actor)
+		case name == "app.js" || name == "style.css":
+			http.ServeFileFS(w, r, adminUIFiles, "adminui/"+name)
+		case strings.HasSuffix(r.URL.Path, "/"):
+			http.ServeFileFS(w, r, adminUIFiles, "adminui/index.html")
+		default:
+			// The page loads its script and data relative to its own URL
+			w.Header().Set("Location", name+"/")
+			w.WriteHeader(http.StatusMovedPermanently)
+		}
+	})
+}
+
+// adminUIActor authenticates a request to the admin UI and returns the
+// actor its actions are attributed to
+func (m *Middleware) adminUIActor(r *http.Request) (string, bool) {
+	cfg := m.options.Config
+	equal := func(given, expected string) bool {
+		return expected != "" && subtle.ConstantTimeCompare([]byte(given), []byte(expected)) == 1
+	}
+
+	if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		return "ui:token", equal(token, cfg.AdminUIToken)
+	}
+	user, password, ok := r.BasicAuth()
+	if !ok {
+		return "", false
+	}
+	if cfg.AdminUIUser != "" && equal(user, cfg.AdminUIUser) && equal(password, cfg.AdminUIPassword) {
+		return "ui:" + user, true
+	}
+	if equal(password, cfg.AdminUIToken) {
+		if user == "" {
+			user = "token"
+		}
+		return "ui:" + user, true
+	}
+	return "", false
+}
+
+// serveAdminUIState serves the data the admin UI shows
+func (m *Middleware) serveAdminUIState(w http.ResponseWriter, actor string) {
+	now := time.Now()
+	state := uiState{Generated: now, Actor: actor, Blocks: []uiBlock{}, Counters: []uiCounter{}}
+
+	blocks, err := m.ActiveBlocks()
+	if err != nil {
+		m.logger.Printf("Error reading blocks for the admin UI: %v", err)
+		http.Error(w, "failed to read blocks", http.StatusInternalServerError)
+		return
+	}
+	blocked := make(map[string]bool, len(blocks))
+	for _, status := range blocks {
+		block := uiBlock{
+			IP:        status.IP,
+			BlockedAt: status.BlockedAt,
+			Permanent: status.IsPermanent,
+			Requests:  status.RequestCount,
+			LastPath:  status.LastRequestPath,
+			Source:    status.Source,
+			Reason:    status.Reason,
+			Operator:  status.Operator,
+		}
+		if !status.IsPermanent {
+			until := status.BlockedUntil
+			block.Until = &until
+		}
+		blocked[status.IP] = true
+		state.Blocks = append(state.Blocks, block)
+	}
+
+	counters, err := m.storage.GetAllRequestCounts()
+	if err != nil {
+		m.logger.Printf("Error reading request counters for the admin UI: %v", err)
+		http.Error(w, "failed to read request counters", http.StatusInternalServerError)
+		return
+	}
+	for ip, counter := range counters {
+		state.Counters = append(state.Counters, uiCounter{
+			IP:       ip,
+			Count:    counter.Count,
+			Score:    counter.Score,
+			LastPath: counter.LastPath,
+			LastSeen: counter.LastSeen,
+			Blocked:  blocked[ip],
+		})
+	}
+	sort.Slice(state.Counters, func(i, j int) bool {
+		if state.Counters[i].Count != state.Counters[j].Count {
+			return state.Counters[i].Count > state.Counters[j].Count
+		}
+		return state.Counters[i].IP < state.Counters[j].IP
+	})
+	if len(state.Counters) > maxUICounters {
+		state.Counters = state.Counters[:maxUICounters]
+	}
+
+	state.Patterns = m.patternHits.list(now)
+	if state.Whitelist, err = m.WhitelistEntries(); err != nil {
+		state.Whitelist = []string{}
+	}
+	writeJSON(w, state)
+}
+
+// serveAdminUIAction unblocks or whitelists the IP of an admin UI request.
+// Whitelisting a blocked IP lifts its block too.
+func (m *Middleware) serveAdminUIAction(w http.ResponseWriter, r *http.Request, actor, action string) {
+	if r.Header.Get(HeaderAdminUI) == "" {
+		http.Error(w, "missing "+HeaderAdminUI+" header", http.StatusForbidden)
+		return
+	}
+
+	var request uiAction
+	if err := json.NewDecoder(io.LimitReader(r.Body, maxAdminBody)).Decode(&request); err != nil {
+		http.Error(w, "invalid request body", http.StatusBadRequest)
+		return
+	}
+	if _, err := ipaddr.ParsePrefix(request.IP); err != nil {
+		http.Error(w, "invalid IP", http.StatusBadRequest)
+		return
+	}
+	if request.Reason == "" {
+		request.Reason = "admin UI"
+	}
+
+	admin := m.Admin(actor)
+	var err error
+	switch action {
+	case "unblock":
+		err = admin.Unblock(request.IP, request.Reason)
+	case "whitelist":
+		err = admin.Whitelist(request.IP, request.Reason)
+		if blocked, _, checkErr := m.storage.IsIPBlocked(ipaddr.Normalize(request.IP)); err == nil && checkErr == nil && blocked {
+			err = admin.Unblock(request.IP, request.Reason)
+		}
+	}
+	if err != nil {
+		m.logger.Printf("Error running admin UI %s of %s: %v", action, request.IP, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, AdminResponse{Action: action, IP: ipaddr.Normalize(request.IP)})
+}
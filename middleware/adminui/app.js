@@ -0,0 +1,162 @@
+// Admin UI of whoen: polls the state next to this page and renders it.
+// Values from requests, such as paths, are attacker-controlled and are only
+// ever set as text.
+"use strict";
+
+const refreshInterval = 5000;
+let state = null;
+
+function cell(row, text, className) {
+  const td = row.insertCell();
+  td.textContent = text === undefined || text === null ? "" : String(text);
+  if (className) {
+    td.className = className;
+  }
+  return td;
+}
+
+function button(row, label, action, ip) {
+  const td = row.insertCell();
+  const b = document.createElement("button");
+  b.textContent = label;
+  b.addEventListener("click", () => act(action, ip));
+  td.appendChild(b);
+}
+
+function duration(ms) {
+  if (ms <= 0) {
+    return "expiring";
+  }
+  let s = Math.floor(ms / 1000);
+  const d = Math.floor(s / 86400);
+  s %= 86400;
+  const h = Math.floor(s / 3600);
+  s %= 3600;
+  const m = Math.floor(s / 60);
+  s %= 60;
+  const pad = (n) => String(n).padStart(2, "0");
+  return (d > 0 ? d + "d " : "") + pad(h) + ":" + pad(m) + ":" + pad(s);
+}
+
+function ago(time) {
+  const ms = Date.now() - new Date(time).getTime();
+  if (ms < 60000) {
+    return "just now";
+  }
+  return duration(ms).replace(/^00:/, "") + " ago";
+}
+
+function render() {
+  if (!state) {
+    return;
+  }
+
+  const blocks = document.getElementById("blocks");
+  blocks.replaceChildren();
+  for (const block of state.blocks) {
+    const row = blocks.insertRow();
+    cell(row, block.ip, "ip");
+    const left = cell(row, block.permanent ? "permanent" : "", "countdown");
+    if (!block.permanent) {
+      left.dataset.until = block.until;
+    }
+    cell(row, block.requests, "number");
+    cell(row, block.last_path, "path");
+    cell(row, block.source || "detection");
+    cell(row, [block.reason, block.operator].filter(Boolean).join(" — "));
+    button(row, "Unblock", "unblock", block.ip);
+  }
+  document.getElementById("blocks-count").textContent = state.blocks.length;
+
+  const counters = document.getElementById("counters");
+  counters.replaceChildren();
+  for (const counter of state.counters) {
+    const row = counters.insertRow();
+    cell(row, counter.ip, "ip");
+    cell(row, counter.count, "number");
+    cell(row, counter.score, "number");
+    cell(row, counter.last_path, "path");
+    cell(row, ago(counter.last_seen));
+    button(row, "Whitelist", "whitelist", counter.ip);
+  }
+  document.getElementById("counters-count").textContent = state.counters.length;
+
+  const patterns = document.getElementById("patterns");
+  patterns.replaceChildren();
+  for (const pattern of state.patterns) {
+    const row = patterns.insertRow();
+    cell(row, pattern.pattern, "path");
+    cell(row, pattern.last_hour, "number");
+    cell(row, pattern.total, "number");
+    cell(row, ago(pattern.last_hit));
+  }
+
+  const whitelist = document.getElementById("whitelist");
+  whitelist.replaceChildren();
+  for (const entry of state.whitelist) {
+    const li = document.createElement("li");
+    li.textContent = entry;
+    whitelist.appendChild(li);
+  }
+
+  tick();
+}
+
+// tick updates the countdowns of the blocks every second between refreshes
+function tick() {
+  for (const td of document.querySelectorAll("td[data-until]")) {
+    td.textContent = duration(new Date(td.dataset.until).getTime() - Date.now());
+  }
+}
+
+function setStatus(text, error) {
+  const status = document.getElementById("status");
+  status.textContent = text;
+  status.className = error ? "error" : "";
+}
+
+async function refresh() {
+  try {
+    const response = await fetch("state", { cache: "no-store" });
+    if (!response.ok) {
+      throw new Error(response.status + " " + (await response.text()).trim());
+    }
+    state = await response.json();
+    setStatus("Signed in as " + state.actor + ", updated " + new Date(state.generated).toLocaleTimeString());
+    render();
+  } catch (err) {
+    setStatus("Failed to load state: " + err.message, true);
+  }
+}
+
+async function act(action, ip, reason) {
+  if (!reason && !confirm(action[0].toUpperCase() + action.slice(1) + " " + ip + "?")) {
+    return;
+  }
+  try {
+    const response = await fetch(action, {
+      method: "POST",
+      headers: { "Content-Type": "application/json", "X-Whoen-UI": "1" },
+      body: JSON.stringify({ ip: ip, reason: reason || "" }),
+    });
+    if (!response.ok) {
+      throw new Error((await response.text()).trim());
+    }
+  } catch (err) {
+    setStatus("Failed to " + action + " " + ip + ": " + err.message, true);
+    return;
+  }
+  await refresh();
+}
+
+document.addEventListener("DOMContentLoaded", () => {
+  document.getElementById("whitelist-form").addEventListener("submit", (event) => {
+    event.preventDefault();
+    const ip = document.getElementById("whitelist-ip").value.trim();
+    const reason = document.getElementById("whitelist-reason").value.trim() || "admin UI";
+    act("whitelist", ip, reason).then(() => event.target.reset());
+  });
+  refresh();
+  setInterval(refresh, refreshInterval);
+  setInterval(tick, 1000);
+});
@@ -0,0 +1,419 @@
+package middleware
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/headswim/whoen/events"
+	"github.com/headswim/whoen/storage"
+)
+
+// AppealPath is where the appeal form of the block page posts, and where
+// appeal links point
+const AppealPath = "/.whoen/appeal"
+
+// maxAppealMessage bounds the message of an appeal, in bytes
+const maxAppealMessage = 500
+
+// Appeal is a blocked client's request to lift its block, passed to the
+// AppealSender that delivers the link granting it
+type Appeal struct {
+	IP      string
+	Contact string    // Email address the client gave
+	Message string    // What the client says it was doing, may be empty
+	Link    string    // Path and query that grant the appeal once; prefix it with the site's URL
+	Expires time.Time // When the link stops working
+}
+
+// AppealSender delivers the link of an appeal out of band: by email to
+// Appeal.Contact, which shows there is a person with a mailbox behind the
+// IP, or to an operator who forwards it once satisfied. The link works from
+// any network, so the client can open it on another device.
+type AppealSender func(appeal Appeal) error
+
+// AppealForm is the appeal form of the block page, see Config.AppealEnabled.
+// The page must POST token, redirect, message and, if Contact is set,
+// contact to Action.
+type AppealForm struct {
+	Action   string // Where to POST the form
+	Token    string // Signed appeal token, bound to the client IP
+	Redirect string // Where to send the client once its appeal is granted
+	Contact  bool   // Ask for an email address to send the appeal link to
+
+	// Texts in the language of the block page
+	Prompt       string
+	ContactLabel string
+	MessageLabel string
+	Button       string
+}
+
+// appealTexts holds the texts of the appeal form and its answers in one language
+type appealTexts struct {
+	prompt       string
+	contactLabel string
+	messageLabel string
+	button       string
+	sent         string // The appeal link was sent
+	denied       string // The appeal cannot be granted
+}
+
+// appealLanguages holds the texts of appeals by the languages of blockLanguages
+var appealLanguages = map[string]appealTexts{
+	"en": {"If you think this is a mistake, you can ask for access to be restored.", "Email address", "What were you doing? (optional)", "Request access",
+		"We sent you a link that restores access. It is valid for a limited time.", "Access cannot be restored this way. The request may have expired or been used already."},
+	"de": {"Falls es sich um einen Irrtum handelt, können Sie die Freigabe beantragen.", "E-Mail-Adresse", "Was wollten Sie tun? (optional)", "Freigabe beantragen",
+		"Wir haben Ihnen einen Link zur Freigabe gesendet. Er ist nur begrenzte Zeit gültig.", "Die Freigabe ist so nicht möglich. Die Anfrage ist abgelaufen oder wurde bereits verwendet."},
+	"fr": {"S'il s'agit d'une erreur, vous pouvez demander le rétablissement de l'accès.", "Adresse e-mail", "Que faisiez-vous ? (facultatif)", "Demander l'accès",
+		"Nous vous avons envoyé un lien qui rétablit l'accès. Il est valable pour une durée limitée.", "L'accès ne peut pas être rétabli ainsi. La demande a expiré ou a déjà été utilisée."},
+	"es": {"Si cree que se trata de un error, puede solicitar que se restablezca el acceso.", "Correo electrónico", "¿Qué estaba haciendo? (opcional)", "Solicitar acceso",
+		"Le hemos enviado un enlace que restablece el acceso. Es válido durante un tiempo limitado.", "El acceso no se puede restablecer así. La solicitud ha caducado o ya se ha utilizado."},
+	"it": {"Se pensi che si tratti di un errore, puoi chiedere il ripristino dell'accesso.", "Indirizzo email", "Cosa stavi facendo? (facoltativo)", "Richiedi l'accesso",
+		"Ti abbiamo inviato un link che ripristina l'accesso. È valido per un tempo limitato.", "L'accesso non può essere ripristinato così. La richiesta è scaduta o è già stata usata."},
+	"pt": {"Se você acha que isso é um erro, pode pedir que o acesso seja restabelecido.", "Endereço de e-mail", "O que você estava fazendo? (opcional)", "Solicitar acesso",
+		"Enviamos um link que restabelece o acesso. Ele é válido por tempo limitado.", "O acesso não pode ser restabelecido assim. A solicitação expirou ou já foi usada."},
+	"nl": {"Denkt u dat dit een vergissing is, dan kunt u vragen om de toegang te herstellen.", "E-mailadres", "Wat was u aan het doen? (optioneel)", "Toegang aanvragen",
+		"We hebben u een link gestuurd die de toegang herstelt. Deze is beperkte tijd geldig.", "De toegang kan zo niet worden hersteld. Het verzoek is verlopen of al gebruikt."},
+}
+
+// appeals tracks appeal links and the IPs granted an appeal
+type appeals struct {
+	secret []byte
+
+	mutex   sync.Mutex
+	sent    map[string]time.Time // IPs sent a link, until it expires
+	used    map[string]time.Time // Nonces of redeemed links, until they expire
+	granted map[string]time.Time // IPs granted an appeal, until their cooldown ends, also kept in storage
+}
+
+// newAppeals sets up appeals from the configuration, or returns nil when
+// they are disabled
+func (m *Middleware) newAppeals() *appeals {
+	cfg := m.options.Config
+	if !cfg.AppealEnabled {
+		return nil
+	}
+	a := &appeals{
+		secret:  []byte(cfg.AppealSecret),
+		sent:    make(map[string]time.Time),
+		used:    make(map[string]time.Time),
+		granted: make(map[string]time.Time),
+	}
+
+	// Without a configured secret, links only work on this instance until it restarts
+	if len(a.secret) == 0 {
+		a.secret = make([]byte, 32)
+		if _, err := rand.Read(a.secret); err != nil {
+			m.logger.Printf("Error generating appeal secret, appeals are disabled: %v", err)
+			return nil
+		}
+		m.logger.Printf("Appeals: no AppealSecret set, appeal links are lost on restart and not shared between instances")
+	}
+	return a
+}
+
+// appealable reports whether the block of an IP can be appealed: the IP is
+// blocked by detection rather than by an operator, a feed or an import, and
+// was not granted an appeal within the cooldown, by this instance or as
+// recorded in storage
+func (m *Middleware) appealable(ip string) bool {
+	if m.appeals == nil {
+		return false
+	}
+
+	m.appeals.mutex.Lock()
+	until, granted := m.appeals.granted[ip]
+	m.appeals.mutex.Unlock()
+	if granted && time.Now().Before(until) {
+		return false
+	}
+
+	blocked, status, err := m.storage.IsIPBlocked(ip)
+	return err == nil && blocked && status != nil && status.Source == "" && !status.InAppealCooldown(time.Now())
+}
+
+// appealForm returns the appeal form for the block page of a request, or nil
+// if its IP cannot appeal
+func (m *Middleware) appealForm(r *http.Request, ip, lang string) *AppealForm {
+	if !m.appealable(ip) {
+		return nil
+	}
+
+	redirect := r.URL.RequestURI()
+	if r.Method != http.MethodGet {
+		redirect = "/"
+	}
+	texts := appealLanguages[lang]
+	return &AppealForm{
+		Action:       AppealPath,
+		Token:        m.appeals.sign("appeal", ip, time.Now().Add(m.options.Config.AppealTokenTTL)),
+		Redirect:     redirect,
+		Contact:      m.options.AppealSender != nil,
+		Prompt:       texts.prompt,
+		ContactLabel: texts.contactLabel,
+		MessageLabel: texts.messageLabel,
+		Button:       texts.button,
+	}
+}
+
+// handleAppeal answers the appeal form posted to AppealPath and appeal links
+// opened there. It reports whether the request was for AppealPath.
+func (m *Middleware) handleAppeal(w http.ResponseWriter, r *http.Request, ip string) bool {
+	if m.appeals == nil || r.URL.Path != AppealPath {
+		return false
+	}
+	texts := appealLanguages[preferredLanguage(r.Header.Get("Accept-Language"))]
+
+	switch r.Method {
+	case http.MethodGet:
+		// An appeal link grants the appeal of the IP it was made for,
+		// wherever it is opened
+		appealIP, ok := m.appeals.redeem(r.URL.Query().Get("token"))
+		if !ok || !m.appealable(appealIP) {
+			m.writeAppealPage(w, r, http.StatusForbidden, texts.denied)
+			return true
+		}
+		if err := m.grantAppeal(appealIP, "appeal link", true); err != nil {
+			m.logger.Printf("Error granting appeal of %s: %v", appealIP, err)
+			m.writeAppealPage(w, r, http.StatusInternalServerError, texts.denied)
+			return true
+		}
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+
+	case http.MethodPost:
+		if !m.appeals.valid("appeal", ip, r.PostFormValue("token")) || !m.appealable(ip) {
+			m.writeAppealPage(w, r, http.StatusForbidden, texts.denied)
+			return true
+		}
+		message := strings.TrimSpace(r.PostFormValue("message"))
+		if len(message) > maxAppealMessage {
+			message = message[:maxAppealMessage]
+		}
+
+		// Without a sender nobody reviews the appeal, so the client must
+		// solve a challenge first, and the IP is not whitelisted
+		if m.options.AppealSender == nil {
+			if m.challenges == nil {
+				m.writeAppealPage(w, r, http.StatusForbidden, texts.denied)
+				return true
+			}
+			if !m.challengeSolved(r, ip) {
+				m.writeChallengePage(w, ip, localRedirect(r.PostFormValue("redirect")))
+				return true
+			}
+			reason := "self-service appeal"
+			if message != "" {
+				reason += ": " + message
+			}
+			if err := m.grantAppeal(ip, reason, false); err != nil {
+				m.logger.Printf("Error granting appeal of %s: %v", ip, err)
+				m.writeAppealPage(w, r, http.StatusInternalServerError, texts.denied)
+				return true
+			}
+			http.Redirect(w, r, localRedirect(r.PostFormValue("redirect")), http.StatusSeeOther)
+			return true
+		}
+
+		// Otherwise the client gets a link out of band, one per token TTL
+		contact := strings.TrimSpace(r.PostFormValue("contact"))
+		if !strings.Contains(contact, "@") || len(contact) > 254 {
+			m.writeAppealPage(w, r, http.StatusBadRequest, texts.denied)
+			return true
+		}
+		expires := time.Now().Add(m.options.Config.AppealTokenTTL)
+		if !m.appeals.send(ip, expires) {
+			m.writeAppealPage(w, r, http.StatusTooManyRequests, texts.sent)
+			return true
+		}
+		appeal := Appeal{
+			IP:      ip,
+			Contact: contact,
+			Message: message,
+			Link:    AppealPath + "?token=" + url.QueryEscape(m.appeals.link(ip, expires)),
+			Expires: expires,
+		}
+		if err := m.options.AppealSender(appeal); err != nil {
+			m.logger.Printf("Error sending appeal link to %s for %s: %v", contact, ip, err)
+			m.writeAppealPage(w, r, http.StatusInternalServerError, texts.denied)
+			return true
+		}
+		m.logger.Printf("Appeal from %s, link sent to %s", ip, contact)
+		m.emit(events.Event{Type: events.AppealRequested, IP: ip, Message: contact})
+		m.writeAppealPage(w, r, http.StatusOK, texts.sent)
+
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+	return true
+}
+
+// grantAppeal lifts the block of an IP and starts its cooldown, and with
+// whitelist set whitelists the IP for Config.AppealWhitelist. The block
+// record is kept, lifted, until the cooldown ends, so the cooldown outlives
+// restarts and holds on every instance.
+func (m *Middleware) grantAppeal(ip, reason string, whitelist bool) error {
+	cooldown := time.Now().Add(m.options.Config.AppealCooldown)
+	m.appeals.mutex.Lock()
+	m.appeals.granted[ip] = cooldown
+	m.appeals.mutex.Unlock()
+
+	_, status, err := m.storage.IsIPBlocked(ip)
+	if err != nil {
+		return fmt.Errorf("failed to read block of IP %s: %w", ip, err)
+	}
+
+	admin := m.Admin("appeal")
+	if err := admin.Unblock(ip, reason); err != nil {
+		return err
+	}
+	if _, ok := m.storage.(storage.BlockPutter); ok && status != nil {
+		record := *status
+		record.BlockedUntil, record.IsPermanent = time.Now(), false
+		record.ProbationUntil, record.ProbationHits = time.Time{}, 0
+		record.AppealCooldownUntil = cooldown
+		if err := storage.PutBlock(m.storage, record); err != nil {
+			return fmt.Errorf("failed to store appeal cooldown of IP %s: %w", ip, err)
+		}
+		m.markLifted(ip, record.BlockedUntil)
+	}
+	if whitelist {
+		if err := admin.WhitelistFor(ip, m.options.Config.AppealWhitelist, reason); err != nil {
+			return err
+		}
+	}
+	m.emit(events.Event{Type: events.AppealGranted, IP: ip, Message: reason})
+	return nil
+}
+
+// writeAppealPage answers an appeal with a short page
+func (m *Middleware) writeAppealPage(w http.ResponseWriter, r *http.Request, code int, message string) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(code)
+	data := struct{ Lang, Message string }{preferredLanguage(r.Header.Get("Accept-Language")), message}
+	if err := appealPage.Execute(w, data); err != nil {
+		m.logger.Printf("Error rendering appeal page: %v", err)
+	}
+}
+
+// cleanupAppeals drops the sent links, redeemed links and cooldowns that
+// have expired
+func (m *Middleware) cleanupAppeals() {
+	if m.appeals == nil {
+		return
+	}
+
+	m.appeals.mutex.Lock()
+	defer m.appeals.mutex.Unlock()
+
+	now := time.Now()
+	for _, entries := range []map[string]time.Time{m.appeals.sent, m.appeals.used, m.appeals.granted} {
+		for key, until := range entries {
+			if now.After(until) {
+				delete(entries, key)
+			}
+		}
+	}
+}
+
+// send records that an IP is sent a link, and reports false if it was sent
+// one that has not expired yet
+func (a *appeals) send(ip string, expires time.Time) bool {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	if until, ok := a.sent[ip]; ok && time.Now().Before(until) {
+		return false
+	}
+	a.sent[ip] = expires
+	return true
+}
+
+// link returns the token of an appeal link for an IP. Unlike form tokens it
+// carries the IP, so it can be redeemed from another network, and a nonce,
+// so it can be redeemed once.
+func (a *appeals) link(ip string, expires time.Time) string {
+	nonce := make([]byte, 8)
+	rand.Read(nonce)
+	unix := strconv.FormatInt(expires.Unix(), 10)
+	return ip + "_" + unix + "_" + hex.EncodeToString(nonce) + "_" + a.mac("link", ip, unix+"_"+hex.EncodeToString(nonce))
+}
+
+// redeem checks the token of an appeal link, marks it used and returns its IP
+func (a *appeals) redeem(token string) (string, bool) {
+	parts := strings.Split(token, "_")
+	if len(parts) != 4 {
+		return "", false
+	}
+	ip, expires, nonce, signature := parts[0], parts[1], parts[2], parts[3]
+	unix, err := strconv.ParseInt(expires, 10, 64)
+	if err != nil || time.Now().Unix() > unix {
+		return "", false
+	}
+	if !hmac.Equal([]byte(signature), []byte(a.mac("link", ip, expires+"_"+nonce))) {
+		return "", false
+	}
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	if _, used := a.used[nonce]; used {
+		return "", false
+	}
+	a.used[nonce] = time.Unix(unix, 0)
+	return ip, true
+}
+
+// sign returns a value of the given kind for an IP, valid until expiry
+func (a *appeals) sign(kind, ip string, expiry time.Time) string {
+	expires := strconv.FormatInt(expiry.Unix(), 10)
+	return expires + "." + a.mac(kind, ip, expires)
+}
+
+// valid checks a value made by sign for the same kind and IP, and that it has not expired
+func (a *appeals) valid(kind, ip, value string) bool {
+	expires, signature, ok := strings.Cut(value, ".")
+	if !ok {
+		return false
+	}
+	unix, err := strconv.ParseInt(expires, 10, 64)
+	if err != nil || time.Now().Unix() > unix {
+		return false
+	}
+	return hmac.Equal([]byte(signature), []byte(a.mac(kind, ip, expires)))
+}
+
+// mac signs the kind, IP and expiry of a value with the secret
+func (a *appeals) mac(kind, ip, expires string) string {
+	h := hmac.New(sha256.New, a.secret)
+	fmt.Fprintf(h, "%s|%s|%s", kind, ip, expires)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// appealPage answers appeals that are not redirected
+var appealPage = template.Must(template.New("appeal").Parse(`<!DOCTYPE html>
+<html lang="{{.Lang}}">
+<head>
+<meta charset="utf-8">
+<meta name="robots" content="noindex">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>{{.Message}}</title>
+<style>
+body { font-family: system-ui, sans-serif; max-width: 36rem; margin: 4rem auto; padding: 0 1rem; color: #222; }
+</style>
+</head>
+<body>
+<p>{{.Message}}</p>
+</body>
+</html>
+`))
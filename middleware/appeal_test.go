@@ -0,0 +1,239 @@
+package middleware_test
+
+import (
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/headswim/whoen/config"
+	"github.com/headswim/whoen/matcher"
+	"github.com/headswim/whoen/middleware"
+	"github.com/headswim/whoen/storage"
+	"github.com/headswim/whoen/whoentest"
+)
+
+// appealClient sends requests from one IP through a middleware with appeals
+// enabled, keeping the cookies it is given
+type appealClient struct {
+	t       *testing.T
+	ip      string
+	handler http.Handler
+	matcher *matcher.Service
+	cookies []*http.Cookie
+}
+
+// newAppealClient creates a middleware with appeals on store and a client
+// for ip. Challenges are solved by posting their token.
+func newAppealClient(t *testing.T, store *storage.KVStorage, ip string, sender middleware.AppealSender) *appealClient {
+	t.Helper()
+
+	cfg := whoentest.Config()
+	cfg.AppealEnabled = true
+	cfg.AppealSecret = "appeal secret"
+	cfg.ChallengeSecret = "challenge secret"
+	config.ValidateConfig(&cfg)
+	cfg.SystemType = "linux"
+
+	c := &appealClient{t: t, ip: ip, matcher: matcher.NewService()}
+	m, err := middleware.New(middleware.Options{
+		Config:            cfg,
+		Storage:           store,
+		Matcher:           c.matcher,
+		Blocker:           whoentest.NewBlocker(),
+		Logger:            log.New(io.Discard, "", 0),
+		GracePeriod:       cfg.GracePeriod,
+		TimeoutEnabled:    cfg.TimeoutEnabled,
+		TimeoutDuration:   cfg.TimeoutDuration,
+		TimeoutIncrease:   cfg.TimeoutIncrease,
+		ChallengeVerifier: func(r *http.Request) bool { return true },
+		AppealSender:      sender,
+	})
+	if err != nil {
+		t.Fatalf("failed to create middleware: %v", err)
+	}
+	t.Cleanup(func() { m.Close() })
+
+	c.handler = m.HTTP().Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	return c
+}
+
+// do sends a request, with form values as a POST
+func (c *appealClient) do(path string, form url.Values) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodGet, path, nil)
+	if form != nil {
+		r = httptest.NewRequest(http.MethodPost, path, strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	r.RemoteAddr = c.ip + ":40000"
+	r.Header.Set("Accept", "text/html")
+	for _, cookie := range c.cookies {
+		r.AddCookie(cookie)
+	}
+	w := httptest.NewRecorder()
+	c.handler.ServeHTTP(w, r)
+	c.cookies = append(c.cookies, w.Result().Cookies()...)
+	return w
+}
+
+var tokenField = regexp.MustCompile(`name="token" value="([^"]+)"`)
+
+// token returns the token of the form on a page, or "" if it has none
+func token(body string) string {
+	if match := tokenField.FindStringSubmatch(body); match != nil {
+		return match[1]
+	}
+	return ""
+}
+
+// appeal posts the appeal form of the block page
+func (c *appealClient) appeal(contact string) *httptest.ResponseRecorder {
+	c.t.Helper()
+
+	page := c.do("/", nil)
+	appealToken := token(page.Body.String())
+	if page.Code != http.StatusForbidden || appealToken == "" {
+		c.t.Fatalf("block page got %d without an appeal form", page.Code)
+	}
+	return c.do(middleware.AppealPath, url.Values{"token": {appealToken}, "redirect": {"/"}, "contact": {contact}})
+}
+
+// isBlocked reports whether storage lists an IP as blocked
+func isBlocked(store *storage.KVStorage, ip string) bool {
+	blocked, _, err := store.IsIPBlocked(ip)
+	return err == nil && blocked
+}
+
+// TestSelfServiceAppeal checks that without a sender a client must solve a
+// challenge before its appeal lifts the block, that it is not whitelisted,
+// and that the cooldown outlives the instance that granted the appeal
+func TestSelfServiceAppeal(t *testing.T) {
+	const ip = "192.0.2.1"
+	store := whoentest.NewStorage()
+	if err := store.BlockIP(ip, time.Now().Add(time.Hour), false, "/.env"); err != nil {
+		t.Fatalf("failed to block: %v", err)
+	}
+	c := newAppealClient(t, store, ip, nil)
+
+	rec := c.appeal("")
+	challengeToken := token(rec.Body.String())
+	if rec.Code != http.StatusForbidden || !strings.Contains(rec.Body.String(), middleware.ChallengePath) || challengeToken == "" {
+		t.Fatalf("appeal without a solved challenge got %d, want the challenge page", rec.Code)
+	}
+	if !isBlocked(store, ip) {
+		t.Fatal("appeal without a solved challenge lifted the block")
+	}
+
+	if rec := c.do(middleware.ChallengePath, url.Values{"token": {challengeToken}, "redirect": {"/"}}); rec.Code != http.StatusSeeOther {
+		t.Fatalf("challenge solution got %d, want %d", rec.Code, http.StatusSeeOther)
+	}
+	if rec := c.appeal(""); rec.Code != http.StatusSeeOther {
+		t.Fatalf("appeal with a solved challenge got %d %q, want %d", rec.Code, rec.Body.String(), http.StatusSeeOther)
+	}
+	if isBlocked(store, ip) {
+		t.Error("granted appeal kept the block")
+	}
+	if c.matcher.IsWhitelisted(ip) {
+		t.Error("self-service appeal whitelisted the IP")
+	}
+
+	// Blocked again, the IP cannot appeal until the cooldown ends, even on
+	// an instance that did not grant the appeal
+	if err := store.BlockIP(ip, time.Now().Add(time.Hour), false, "/.env"); err != nil {
+		t.Fatalf("failed to block: %v", err)
+	}
+	other := newAppealClient(t, store, ip, nil)
+	other.cookies = c.cookies
+	if page := other.do("/", nil); page.Code != http.StatusForbidden || token(page.Body.String()) != "" {
+		t.Errorf("block page got %d with an appeal form within the cooldown", page.Code)
+	}
+}
+
+// TestAppealChallengeOfAnotherIP checks that without a sender and with the
+// challenge cookie of another IP the appeal is not granted
+func TestAppealChallengeOfAnotherIP(t *testing.T) {
+	store := whoentest.NewStorage()
+	for _, ip := range []string{"192.0.2.1", "192.0.2.2"} {
+		if err := store.BlockIP(ip, time.Now().Add(time.Hour), false, "/.env"); err != nil {
+			t.Fatalf("failed to block: %v", err)
+		}
+	}
+	first := newAppealClient(t, store, "192.0.2.1", nil)
+	rec := first.appeal("")
+	first.do(middleware.ChallengePath, url.Values{"token": {token(rec.Body.String())}, "redirect": {"/"}})
+
+	second := newAppealClient(t, store, "192.0.2.2", nil)
+	second.handler = first.handler
+	second.cookies = first.cookies
+	if rec := second.appeal(""); rec.Code != http.StatusForbidden || !isBlocked(store, "192.0.2.2") {
+		t.Errorf("appeal with another IP's challenge cookie got %d, want the challenge page", rec.Code)
+	}
+}
+
+// TestAppealLink checks that with a sender the client is sent a link that
+// lifts the block and whitelists the IP once, and that bad requests are refused
+func TestAppealLink(t *testing.T) {
+	const ip = "192.0.2.1"
+	store := whoentest.NewStorage()
+	if err := store.BlockIP(ip, time.Now().Add(time.Hour), false, "/.env"); err != nil {
+		t.Fatalf("failed to block: %v", err)
+	}
+	var sent []middleware.Appeal
+	c := newAppealClient(t, store, ip, func(appeal middleware.Appeal) error {
+		sent = append(sent, appeal)
+		return nil
+	})
+
+	if rec := c.appeal("not an address"); rec.Code != http.StatusBadRequest || len(sent) != 0 {
+		t.Errorf("appeal without an email address got %d, %d links sent", rec.Code, len(sent))
+	}
+	if rec := c.do(middleware.AppealPath, url.Values{"token": {"1.bad"}, "contact": {"user@example.com"}}); rec.Code != http.StatusForbidden {
+		t.Errorf("appeal with a bad token got %d, want %d", rec.Code, http.StatusForbidden)
+	}
+	if rec := c.appeal("user@example.com"); rec.Code != http.StatusOK || len(sent) != 1 {
+		t.Fatalf("appeal got %d, %d links sent, want one", rec.Code, len(sent))
+	}
+	if rec := c.appeal("user@example.com"); rec.Code != http.StatusTooManyRequests || len(sent) != 1 {
+		t.Errorf("second appeal got %d, %d links sent, want no new link", rec.Code, len(sent))
+	}
+	if !isBlocked(store, ip) {
+		t.Fatal("sending the link lifted the block")
+	}
+
+	// The link works from any IP, once
+	visitor := &appealClient{t: t, ip: "198.51.100.1", handler: c.handler}
+	if rec := visitor.do(middleware.AppealPath+"?token=bad", nil); rec.Code != http.StatusForbidden {
+		t.Errorf("bad link got %d, want %d", rec.Code, http.StatusForbidden)
+	}
+	if rec := visitor.do(sent[0].Link, nil); rec.Code != http.StatusSeeOther {
+		t.Fatalf("link got %d, want %d", rec.Code, http.StatusSeeOther)
+	}
+	if isBlocked(store, ip) || !c.matcher.IsWhitelisted(ip) {
+		t.Error("link did not lift the block and whitelist the IP")
+	}
+	if rec := visitor.do(sent[0].Link, nil); rec.Code != http.StatusForbidden {
+		t.Errorf("link opened twice got %d, want %d", rec.Code, http.StatusForbidden)
+	}
+}
+
+// TestAppealSenderError checks that a failed delivery leaves the block in place
+func TestAppealSenderError(t *testing.T) {
+	const ip = "192.0.2.1"
+	store := whoentest.NewStorage()
+	if err := store.BlockIP(ip, time.Now().Add(time.Hour), false, "/.env"); err != nil {
+		t.Fatalf("failed to block: %v", err)
+	}
+	c := newAppealClient(t, store, ip, func(middleware.Appeal) error { return errors.New("mail server down") })
+
+	if rec := c.appeal("user@example.com"); rec.Code != http.StatusInternalServerError || !isBlocked(store, ip) {
+		t.Errorf("appeal with a failing sender got %d, want %d and the block kept", rec.Code, http.StatusInternalServerError)
+	}
+}
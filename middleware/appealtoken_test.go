@@ -0,0 +1,65 @@
+package middleware
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestAppealTokens checks that form tokens and appeal links hold only for
+// the IP, kind and time they were made for, and that links work once
+func TestAppealTokens(t *testing.T) {
+	a := &appeals{
+		secret:  []byte("secret"),
+		sent:    make(map[string]time.Time),
+		used:    make(map[string]time.Time),
+		granted: make(map[string]time.Time),
+	}
+	later := time.Now().Add(time.Hour)
+
+	token := a.sign("appeal", "192.0.2.1", later)
+	if !a.valid("appeal", "192.0.2.1", token) {
+		t.Error("form token rejected for its own IP")
+	}
+	if a.valid("appeal", "192.0.2.2", token) {
+		t.Error("form token accepted for another IP")
+	}
+	if a.valid("link", "192.0.2.1", token) {
+		t.Error("form token accepted as another kind")
+	}
+	if a.valid("appeal", "192.0.2.1", a.sign("appeal", "192.0.2.1", time.Now().Add(-time.Minute))) {
+		t.Error("expired form token accepted")
+	}
+	for _, bad := range []string{"", "nodot", "x." + strings.Repeat("0", 64), token + "0"} {
+		if a.valid("appeal", "192.0.2.1", bad) {
+			t.Errorf("form token %q accepted", bad)
+		}
+	}
+
+	link := a.link("192.0.2.1", later)
+	tampered := strings.Replace(link, "192.0.2.1", "192.0.2.9", 1)
+	if ip, ok := a.redeem(tampered); ok {
+		t.Errorf("link with another IP redeemed for %s", ip)
+	}
+	if ip, ok := a.redeem(link); !ok || ip != "192.0.2.1" {
+		t.Errorf("link redeemed as %q, %v, want 192.0.2.1", ip, ok)
+	}
+	if _, ok := a.redeem(link); ok {
+		t.Error("link redeemed twice")
+	}
+	if _, ok := a.redeem(a.link("192.0.2.1", time.Now().Add(-time.Minute))); ok {
+		t.Error("expired link redeemed")
+	}
+	for _, bad := range []string{"", "a_b_c", "192.0.2.1_x_00_00", "192.0.2.1_" + token} {
+		if _, ok := a.redeem(bad); ok {
+			t.Errorf("link %q redeemed", bad)
+		}
+	}
+
+	if !a.send("192.0.2.1", later) {
+		t.Error("first link refused")
+	}
+	if a.send("192.0.2.1", later) {
+		t.Error("second link sent before the first expired")
+	}
+}
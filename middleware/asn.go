@@ -0,0 +1,87 @@
+package middleware
+
+import (
+	"github.com/headswim/whoen/asn"
+)
+
+// asnPolicy holds the autonomous systems of Config.BlockASNs and
+// Config.ExemptASNs
+type asnPolicy struct {
+	block  map[string]bool
+	exempt map[string]bool
+}
+
+// newASNPolicy loads Config.ASNDatabase into Options.ASNLookup, unless a
+// lookup is set already, and returns the blocked and exempted autonomous
+// systems, or nil if there are none or no lookup to find them with
+func (m *Middleware) newASNPolicy() *asnPolicy {
+	cfg := m.options.Config
+	if cfg.ASNDatabase != "" && m.options.ASNLookup == nil {
+		table, err := asn.Load(cfg.ASNDatabase)
+		if err != nil {
+			m.logger.Printf("Error loading ASN database: %v", err)
+		} else {
+			m.options.ASNLookup = table.Lookup
+			m.logger.Printf("ASN database %s loaded with %d ranges", cfg.ASNDatabase, table.Len())
+		}
+	}
+
+	// Invalid AS numbers are logged and skipped
+	numbers := func(key string, values []string) map[string]bool {
+		set := make(map[string]bool, len(values))
+		for _, value := range values {
+			number, err := asn.Normalize(value)
+			if err != nil {
+				m.logger.Printf("Skipping %s entry: %v", key, err)
+				continue
+			}
+			set[number] = true
+		}
+		return set
+	}
+	policy := &asnPolicy{
+		block:  numbers("BlockASNs", cfg.BlockASNs),
+		exempt: numbers("ExemptASNs", cfg.ExemptASNs),
+	}
+	if len(policy.block) == 0 && len(policy.exempt) == 0 {
+		return nil
+	}
+	if m.options.ASNLookup == nil {
+		m.logger.Printf("Warning: BlockASNs and ExemptASNs have no effect without Config.ASNDatabase or Options.ASNLookup")
+		return nil
+	}
+	return policy
+}
+
+// asnListed looks up the autonomous system of an IP and reports whether
+// Config.BlockASNs or Config.ExemptASNs lists it, and whether it is blocked.
+// An exemption wins over a block.
+func (m *Middleware) asnListed(ip string) (number string, blocked, listed bool) {
+	if m.asnPolicy == nil {
+		return "", false, false
+	}
+
+	number = asnNumber(m.options.ASNLookup(ip))
+	switch {
+	case number == "":
+		return "", false, false
+	case m.asnPolicy.exempt[number]:
+		return number, false, true
+	case m.asnPolicy.block[number]:
+		return number, true, true
+	}
+	return number, false, false
+}
+
+// asnNumber brings what a lookup returned into the form of asn.Normalize,
+// leaving it empty if it is not an AS number
+func asnNumber(value string) string {
+	if value == "" {
+		return ""
+	}
+	number, err := asn.Normalize(value)
+	if err != nil {
+		return ""
+	}
+	return number
+}
@@ -0,0 +1,90 @@
+package middleware
+
+import (
+	"time"
+
+	"github.com/headswim/whoen/audit"
+)
+
+// auditBlock records a block made by detection or another instance in the
+// audit log. Admin records its own blocks, with the state before them.
+func (m *Middleware) auditBlock(info BlockInfo) {
+	if info.Source == SourceAdmin {
+		return
+	}
+
+	entry := audit.Entry{
+		Time:    time.Now(),
+		Actor:   m.auditActor(info.Source, info.Actor),
+		Action:  audit.ActionBlock,
+		IP:      info.IP,
+		Path:    info.Path,
+		Pattern: info.Pattern,
+		Count:   info.Count,
+		Expires: info.Until,
+		Current: &audit.State{Blocked: true, IsPermanent: info.Permanent, BlockedUntil: info.Until},
+	}
+	if info.Extended {
+		entry.Action = audit.ActionExtend
+	}
+	m.audit(entry)
+}
+
+// auditUnblock records an unblock by another instance or an expired block in
+// the audit log. Admin records its own unblocks, with the state before them.
+func (m *Middleware) auditUnblock(info UnblockInfo) {
+	if info.Source == SourceAdmin {
+		return
+	}
+
+	entry := audit.Entry{
+		Time:    time.Now(),
+		Actor:   m.auditActor(info.Source, info.Actor),
+		Action:  audit.ActionUnblock,
+		IP:      info.IP,
+		Current: &audit.State{},
+	}
+	switch info.Source {
+	case SourceExpired:
+		entry.Reason = "block expired"
+	case SourceEvicted:
+		entry.Reason = "evicted to stay within max_blocked_ips"
+	}
+	m.audit(entry)
+}
+
+// auditCleanup records a cleanup run in the audit log, if it lifted blocks
+// or failed. The lifted blocks are recorded one by one as well.
+func (m *Middleware) auditCleanup(info CleanupInfo) {
+	if len(info.Expired) == 0 && info.Err == nil {
+		return
+	}
+
+	entry := audit.Entry{
+		Time:   time.Now(),
+		Actor:  audit.ActorWhoen,
+		Action: audit.ActionCleanup,
+		Count:  len(info.Expired),
+	}
+	if info.Err != nil {
+		entry.Reason = "failed: " + info.Err.Error()
+	}
+	m.audit(entry)
+}
+
+// auditActor names who made a decision: the node for cluster decisions, the
+// middleware for the rest
+func (m *Middleware) auditActor(source, node string) string {
+	if source == SourceCluster {
+		return "cluster:" + node
+	}
+	return audit.ActorWhoen
+}
+
+// audit writes an entry to the audit log, logging a failure since the
+// decision itself already took effect
+func (m *Middleware) audit(entry audit.Entry) {
+	if err := m.auditLogger.Log(entry); err != nil {
+		m.logger.Printf("Error writing audit log: %s of IP %s: %v", entry.Action, entry.IP, err)
+	}
+}
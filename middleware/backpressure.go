@@ -0,0 +1,180 @@
+package middleware
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/headswim/whoen/events"
+)
+
+// rateBuckets is the number of buckets the attack window is split into
+const rateBuckets = 60
+
+// blockRate counts the blocks made over a sliding window, in buckets
+type blockRate struct {
+	window time.Duration
+
+	mutex       sync.Mutex
+	buckets     [rateBuckets]int
+	current     int64 // Index of the newest bucket since the epoch
+	underAttack bool
+}
+
+// newBlockRate creates a block rate over a window
+func newBlockRate(window time.Duration) *blockRate {
+	return &blockRate{window: window}
+}
+
+// advance moves the window up to now, emptying the buckets that fell out of
+// it. The caller must hold the lock.
+func (b *blockRate) advance(now time.Time) {
+	index := now.UnixNano() / int64(b.window/rateBuckets)
+	if index-b.current >= rateBuckets {
+		b.buckets = [rateBuckets]int{}
+	} else {
+		for i := b.current + 1; i <= index; i++ {
+			b.buckets[i%rateBuckets] = 0
+		}
+	}
+	if index > b.current {
+		b.current = index
+	}
+}
+
+// add counts a block and returns the number of blocks in the window
+func (b *blockRate) add(now time.Time) int {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.advance(now)
+	b.buckets[b.current%rateBuckets]++
+	return b.sum()
+}
+
+// count returns the number of blocks in the window
+func (b *blockRate) count(now time.Time) int {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.advance(now)
+	return b.sum()
+}
+
+// sum adds up the buckets. The caller must hold the lock.
+func (b *blockRate) sum() int {
+	total := 0
+	for _, n := range b.buckets {
+		total += n
+	}
+	return total
+}
+
+// transition records whether the rate is over the threshold and reports
+// whether that changed
+func (b *blockRate) transition(over bool) bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.underAttack == over {
+		return false
+	}
+	b.underAttack = over
+	return true
+}
+
+// countBlock counts a block made by the middleware towards the attack threshold
+func (m *Middleware) countBlock() {
+	if m.blockRate == nil {
+		return
+	}
+	m.checkAttack(m.blockRate.add(time.Now()))
+}
+
+// checkAttack compares the block rate with the threshold and reports when an
+// attack starts or ends
+func (m *Middleware) checkAttack(rate int) {
+	cfg := m.options.Config
+	over := rate >= cfg.AttackThreshold
+	if !m.blockRate.transition(over) {
+		return
+	}
+
+	if over {
+		message := fmt.Sprintf("%d blocks in the last %v, threshold %d", rate, cfg.AttackWindow, cfg.AttackThreshold)
+		m.logger.Printf("Under attack: %s", message)
+		m.emit(events.Event{Type: events.AttackStarted, Message: message})
+		return
+	}
+
+	message := fmt.Sprintf("%d blocks in the last %v", rate, cfg.AttackWindow)
+	m.logger.Printf("Attack over: %s", message)
+	m.emit(events.Event{Type: events.AttackEnded, Message: message})
+}
+
+// watchAttack notices the end of an attack while no blocks are made, until Close is called
+func (m *Middleware) watchAttack() {
+	ticker := time.NewTicker(m.options.Config.AttackWindow / 10)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			m.checkAttack(m.blockRate.count(time.Now()))
+		case <-m.ctx.Done():
+			return
+		}
+	}
+}
+
+// Pressure is the attack status reported by PressureHandler
+type Pressure struct {
+	Status    string `json:"status"`     // "ok" or "degraded"
+	BlockRate int    `json:"block_rate"` // Blocks made in the last Window
+	Threshold int    `json:"threshold"`  // Block rate at which the status turns degraded
+	Window    string `json:"window"`     // Length of the window, e.g. "1m0s"
+}
+
+// Pressure returns the current block rate and whether it is over the attack threshold
+func (m *Middleware) Pressure() Pressure {
+	cfg := m.options.Config
+	pressure := Pressure{Status: "ok", Threshold: cfg.AttackThreshold, Window: cfg.AttackWindow.String()}
+	if m.blockRate == nil {
+		return pressure
+	}
+
+	pressure.BlockRate = m.blockRate.count(time.Now())
+	m.checkAttack(pressure.BlockRate)
+	if pressure.BlockRate >= cfg.AttackThreshold {
+		pressure.Status = "degraded"
+	}
+	return pressure
+}
+
+// UnderAttack reports whether the block rate is over the attack threshold
+func (m *Middleware) UnderAttack() bool {
+	return m.Pressure().Status == "degraded"
+}
+
+// PressureHandler returns an http.Handler that reports the attack status as
+// JSON, for load balancers and autoscalers to scale out or turn on CDN
+// challenges. It responds with 200 normally and 503 while the block rate is
+// over Config.AttackThreshold. Keep it apart from the health check that takes
+// instances out of rotation.
+func (m *Middleware) PressureHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		pressure := m.Pressure()
+
+		status := http.StatusOK
+		if pressure.Status == "degraded" {
+			status = http.StatusServiceUnavailable
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(pressure)
+	})
+}
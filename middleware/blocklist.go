@@ -0,0 +1,48 @@
+package middleware
+
+import (
+	"context"
+	"io"
+
+	"github.com/headswim/whoen/blocklist"
+)
+
+// ImportBlocklist merges a blocklist into storage and enforces the imported
+// blocks. Whitelisted IPs are skipped.
+func (m *Middleware) ImportBlocklist(r io.Reader, format blocklist.Format, options blocklist.ImportOptions) (int, error) {
+	imported, err := blocklist.Import(m.storage, r, format, m.importOptions(options))
+	return m.imported(imported, string(format)+" blocklist", options.Source, err)
+}
+
+// PullCrowdSec merges the decisions changed since the last pull from a
+// CrowdSec local API and enforces them. Call it periodically to keep whoen in
+// step with the bouncer stream; whitelisted IPs are skipped.
+func (m *Middleware) PullCrowdSec(ctx context.Context, stream *blocklist.CrowdSecStream, options blocklist.ImportOptions) (int, error) {
+	imported, err := stream.Pull(ctx, m.storage, m.importOptions(options))
+	return m.imported(imported, "CrowdSec stream", options.Source, err)
+}
+
+// importOptions adds the whitelist to the skip function of import options
+func (m *Middleware) importOptions(options blocklist.ImportOptions) blocklist.ImportOptions {
+	skip := options.Skip
+	options.Skip = func(ip string) bool {
+		return m.matcher.IsWhitelisted(ip) || (skip != nil && skip(ip))
+	}
+	return options
+}
+
+// imported logs an import and enforces the changed blocks
+func (m *Middleware) imported(imported int, from, source string, err error) (int, error) {
+	if imported > 0 {
+		m.logger.Printf("Imported %d blocks from %s (source: %s)", imported, from, source)
+		if syncErr := m.Sync(); syncErr != nil && err == nil {
+			err = syncErr
+		}
+	}
+	return imported, err
+}
+
+// ExportBlocklist writes the active blocks in the given format
+func (m *Middleware) ExportBlocklist(w io.Writer, format blocklist.Format) error {
+	return blocklist.ExportStorage(w, m.storage, format)
+}
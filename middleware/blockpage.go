@@ -0,0 +1,325 @@
+package middleware
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Content types negotiated for blocked responses
+const (
+	contentTypeProblem = "application/problem+json"
+	contentTypeJSON    = "application/json"
+	contentTypeHTML    = "text/html"
+	contentTypeText    = "text/plain"
+)
+
+// ProblemTypeBlocked identifies whoen's blocked responses in the type member
+// of RFC 7807 problem details
+const ProblemTypeBlocked = "urn:whoen:problem:blocked"
+
+// Block reasons reported in problem details
+const (
+	ReasonBlocked   = "blocked"   // The client IP is temporarily blocked
+	ReasonBanned    = "banned"    // The client IP is permanently blocked
+	ReasonMalicious = "malicious" // The request itself was malicious
+)
+
+// Problem is an RFC 7807 problem details body for a blocked request
+type Problem struct {
+	Type         string     `json:"type"`
+	Title        string     `json:"title"`
+	Status       int        `json:"status"`
+	Detail       string     `json:"detail"`
+	Instance     string     `json:"instance,omitempty"`
+	Reason       string     `json:"reason"`                  // ReasonBlocked, ReasonBanned or ReasonMalicious
+	RetryAfter   int        `json:"retry_after,omitempty"`   // Seconds until a temporary block expires
+	BlockedUntil *time.Time `json:"blocked_until,omitempty"` // When a temporary block expires
+}
+
+// StatusConnectionReset as BlockResponse.Status drops blocked requests without
+// a response, resetting the connection
+const StatusConnectionReset = -1
+
+// BlockResponse configures the status code and headers of blocked responses.
+// The body is still negotiated from the request's Accept header.
+type BlockResponse struct {
+	// Status is the status code of blocked responses, 403 if zero. 404 hides
+	// that anything is there, 429 tells well-behaved clients to back off.
+	// StatusConnectionReset sends no response at all; connections that
+	// cannot be taken over, such as HTTP/2 streams, get a 403 instead.
+	Status int
+
+	// Headers are added to every blocked response
+	Headers http.Header
+
+	// OmitRetryAfter leaves out the Retry-After header, which blocked
+	// responses to temporarily blocked IPs otherwise carry
+	OmitRetryAfter bool
+}
+
+// status returns the status code of blocked responses
+func (b BlockResponse) status() int {
+	if b.Status == StatusConnectionReset || (b.Status >= 100 && b.Status <= 599) {
+		return b.Status
+	}
+	return http.StatusForbidden
+}
+
+// BlockPageData is passed to the block page template
+type BlockPageData struct {
+	Lang         string // Language of the texts, e.g. "de"
+	Title        string
+	Message      string
+	Retry        string      // When the client can try again, empty for permanent blocks
+	RetryAfter   int         // Seconds until a temporary block expires, 0 if unknown or permanent
+	BlockedUntil time.Time   // When a temporary block expires, zero if unknown or permanent
+	Appeal       *AppealForm // Form to ask for the block to be lifted, nil if the block cannot be appealed
+}
+
+// blockTexts holds the texts of blocked responses in one language
+type blockTexts struct {
+	title   string
+	message string
+	retry   string // Formatted with the time the block expires
+}
+
+// blockLanguages holds the texts of blocked responses by language. English is the fallback.
+var blockLanguages = map[string]blockTexts{
+	"en": {"Access denied", "This request has been blocked for security reasons.", "You can try again after %s."},
+	"de": {"Zugriff verweigert", "Diese Anfrage wurde aus Sicherheitsgründen blockiert.", "Sie können es nach %s erneut versuchen."},
+	"fr": {"Accès refusé", "Cette requête a été bloquée pour des raisons de sécurité.", "Vous pourrez réessayer après %s."},
+	"es": {"Acceso denegado", "Esta solicitud ha sido bloqueada por motivos de seguridad.", "Puede volver a intentarlo después de %s."},
+	"it": {"Accesso negato", "Questa richiesta è stata bloccata per motivi di sicurezza.", "Puoi riprovare dopo %s."},
+	"pt": {"Acesso negado", "Esta solicitação foi bloqueada por motivos de segurança.", "Você pode tentar novamente após %s."},
+	"nl": {"Toegang geweigerd", "Dit verzoek is om veiligheidsredenen geblokkeerd.", "U kunt het na %s opnieuw proberen."},
+}
+
+// writeBlocked writes the response for a blocked request, in the format the
+// client accepts and its preferred language. jsonBody selects the plain JSON
+// body over text for clients that accept anything.
+func (m *Middleware) writeBlocked(w http.ResponseWriter, r *http.Request, ip string, jsonBody bool) {
+	code := m.options.BlockResponse.status()
+	if code == StatusConnectionReset {
+		if resetConnection(w) {
+			return
+		}
+		code = http.StatusForbidden
+	}
+	for name, values := range m.options.BlockResponse.Headers {
+		for _, value := range values {
+			w.Header().Add(name, value)
+		}
+	}
+
+	fallback := contentTypeText
+	if jsonBody {
+		fallback = contentTypeJSON
+	}
+	contentType := negotiate(r.Header.Get("Accept"), fallback, contentTypeProblem, contentTypeJSON, contentTypeHTML, contentTypeText)
+	lang := preferredLanguage(r.Header.Get("Accept-Language"))
+	texts := blockLanguages[lang]
+
+	// Tell clients of temporary blocks when to come back
+	reason := ReasonMalicious
+	var until time.Time
+	if blocked, status, err := m.storage.IsIPBlocked(ip); err == nil && blocked && status != nil {
+		reason = ReasonBanned
+		if !status.IsPermanent {
+			reason = ReasonBlocked
+			until = status.BlockedUntil
+		}
+	}
+	retryAfter := 0
+	retry := ""
+	if !until.IsZero() {
+		retryAfter = int(time.Until(until).Seconds()) + 1
+		retry = fmt.Sprintf(texts.retry, until.UTC().Format(time.RFC1123))
+		if !m.options.BlockResponse.OmitRetryAfter {
+			w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+		}
+	}
+	w.Header().Set("Content-Language", lang)
+
+	switch contentType {
+	case contentTypeProblem:
+		problem := Problem{
+			Type:       ProblemTypeBlocked,
+			Title:      texts.title,
+			Status:     code,
+			Detail:     strings.TrimSpace(texts.message + " " + retry),
+			Instance:   r.URL.Path,
+			Reason:     reason,
+			RetryAfter: retryAfter,
+		}
+		if !until.IsZero() {
+			problem.BlockedUntil = &until
+		}
+		w.Header().Set("Content-Type", contentTypeProblem)
+		w.WriteHeader(code)
+		json.NewEncoder(w).Encode(problem)
+
+	case contentTypeJSON:
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.WriteHeader(code)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error":   http.StatusText(code),
+			"message": blockedMessage,
+		})
+
+	case contentTypeHTML:
+		data := BlockPageData{
+			Lang:         lang,
+			Title:        texts.title,
+			Message:      texts.message,
+			Retry:        retry,
+			RetryAfter:   retryAfter,
+			BlockedUntil: until,
+			Appeal:       m.appealForm(r, ip, lang),
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.WriteHeader(code)
+		if err := m.blockPage.Execute(w, data); err != nil {
+			m.logger.Printf("Error rendering block page: %v", err)
+		}
+
+	default:
+		w.WriteHeader(code)
+		w.Write([]byte(http.StatusText(code) + ": " + blockedMessage))
+	}
+}
+
+// resetConnection takes over the connection of a blocked request and closes
+// it without a response, discarding unsent data so the client sees a reset.
+// It reports false if the connection cannot be taken over.
+func resetConnection(w http.ResponseWriter) bool {
+	conn, _, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		return false
+	}
+	if tcpConn, ok := conn.(*net.TCPConn); ok {
+		tcpConn.SetLinger(0)
+	}
+	conn.Close()
+	return true
+}
+
+// loadBlockPage returns the block page template from Config.BlockPageTemplate,
+// or the built-in page
+func (m *Middleware) loadBlockPage() *template.Template {
+	path := m.options.Config.BlockPageTemplate
+	if path == "" {
+		return defaultBlockPage
+	}
+
+	page, err := template.ParseFiles(path)
+	if err != nil {
+		m.logger.Printf("Error loading block page template, using the built-in page: %v", err)
+		return defaultBlockPage
+	}
+	return page
+}
+
+// acceptEntry is a media range or language from an Accept header with its quality
+type acceptEntry struct {
+	value   string
+	quality float64
+}
+
+// parseAccept splits an Accept or Accept-Language header into its entries,
+// highest quality first. Entries with quality 0 are left out.
+func parseAccept(header string) []acceptEntry {
+	var entries []acceptEntry
+	for _, part := range strings.Split(header, ",") {
+		value, params, _ := strings.Cut(part, ";")
+		value = strings.ToLower(strings.TrimSpace(value))
+		if value == "" {
+			continue
+		}
+
+		quality := 1.0
+		for _, param := range strings.Split(params, ";") {
+			name, q, ok := strings.Cut(strings.TrimSpace(param), "=")
+			if ok && strings.TrimSpace(name) == "q" {
+				if parsed, err := strconv.ParseFloat(strings.TrimSpace(q), 64); err == nil {
+					quality = parsed
+				}
+			}
+		}
+		if quality <= 0 {
+			continue
+		}
+		entries = append(entries, acceptEntry{value, quality})
+	}
+
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].quality > entries[j].quality
+	})
+	return entries
+}
+
+// negotiate picks the offered content type the Accept header prefers. Wildcards
+// and a missing header get the fallback.
+func negotiate(accept, fallback string, offers ...string) string {
+	for _, entry := range parseAccept(accept) {
+		if entry.value == "*/*" {
+			return fallback
+		}
+		for _, offer := range offers {
+			if entry.value == offer {
+				return offer
+			}
+			if strings.HasSuffix(entry.value, "/*") && strings.HasPrefix(offer, strings.TrimSuffix(entry.value, "*")) {
+				return offer
+			}
+		}
+	}
+	return fallback
+}
+
+// preferredLanguage picks the supported language the Accept-Language header
+// prefers, English if none
+func preferredLanguage(acceptLanguage string) string {
+	for _, entry := range parseAccept(acceptLanguage) {
+		lang, _, _ := strings.Cut(entry.value, "-")
+		if _, ok := blockLanguages[lang]; ok {
+			return lang
+		}
+	}
+	return "en"
+}
+
+// defaultBlockPage is the built-in HTML block page
+var defaultBlockPage = template.Must(template.New("blocked").Parse(`<!DOCTYPE html>
+<html lang="{{.Lang}}">
+<head>
+<meta charset="utf-8">
+<meta name="robots" content="noindex">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>{{.Title}}</title>
+<style>
+body { font-family: system-ui, sans-serif; max-width: 36rem; margin: 4rem auto; padding: 0 1rem; color: #222; }
+h1 { font-size: 1.5rem; }
+</style>
+</head>
+<body>
+<h1>{{.Title}}</h1>
+<p>{{.Message}}</p>
+{{if .Retry}}<p>{{.Retry}}</p>{{end}}
+{{with .Appeal}}<form method="POST" action="{{.Action}}">
+<p>{{.Prompt}}</p>
+<input type="hidden" name="token" value="{{.Token}}">
+<input type="hidden" name="redirect" value="{{.Redirect}}">
+{{if .Contact}}<p><label>{{.ContactLabel}}<br><input type="email" name="contact" required></label></p>{{end}}
+<p><label>{{.MessageLabel}}<br><textarea name="message" rows="3" cols="40" maxlength="500"></textarea></label></p>
+<p><button type="submit">{{.Button}}</button></p>
+</form>{{end}}
+</body>
+</html>
+`))
@@ -0,0 +1,85 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/headswim/whoen/bots"
+)
+
+// Bounds of crawler verification
+const (
+	botVerifyTimeout      = 2 * time.Second // Time the DNS lookups of one request get
+	botRangesRefreshEvery = 24 * time.Hour  // How often published crawler ranges are downloaded
+)
+
+// newBotVerifier returns the verifier of bots.Known and Options.Bots, or nil
+// unless Config.ExemptVerifiedBots is set
+func (m *Middleware) newBotVerifier() *bots.Verifier {
+	if !m.options.Config.ExemptVerifiedBots {
+		return nil
+	}
+
+	verifier := bots.NewVerifier(append(bots.Known(), m.options.Bots...))
+	verifier.CacheTTL = m.options.Config.VerifiedBotCacheTTL
+	return verifier
+}
+
+// watchBotRanges downloads the published ranges of the crawlers right away
+// and then daily until Close is called
+func (m *Middleware) watchBotRanges() {
+	ticker := time.NewTicker(botRangesRefreshEvery)
+	defer ticker.Stop()
+
+	for {
+		if err := m.botVerifier.RefreshRanges(m.ctx); err != nil && m.ctx.Err() == nil {
+			m.logger.Printf("Error refreshing crawler ranges: %v", err)
+		}
+
+		select {
+		case <-ticker.C:
+		case <-m.ctx.Done():
+			return
+		}
+	}
+}
+
+// verifiedBot reports whether a request comes from a crawler it claims to
+// be, verified by DNS or the crawler's ranges. Each IP is logged when it is
+// first verified, or found to only pretend to be a crawler.
+func (m *Middleware) verifiedBot(r *http.Request, ip string) bool {
+	if m.botVerifier == nil {
+		return false
+	}
+	userAgent := r.Header.Get("User-Agent")
+	if userAgent == "" {
+		return false
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), botVerifyTimeout)
+	defer cancel()
+	result := m.botVerifier.Verify(ctx, ip, userAgent)
+	if result.Bot == "" {
+		return false
+	}
+
+	if !result.Cached {
+		switch {
+		case result.Verified && result.Host != "":
+			m.logger.Printf("Verified %s as %s (%s), exempt from blocking", ip, result.Bot, result.Host)
+		case result.Verified:
+			m.logger.Printf("Verified %s as %s by its published ranges, exempt from blocking", ip, result.Bot)
+		default:
+			m.logger.Printf("Request from %s claims to be %s but could not be verified", ip, result.Bot)
+		}
+	}
+	return result.Verified
+}
+
+// cleanupBots drops expired crawler verifications
+func (m *Middleware) cleanupBots() {
+	if m.botVerifier != nil {
+		m.botVerifier.Prune()
+	}
+}
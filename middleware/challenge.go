@@ -0,0 +1,330 @@
+package middleware
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"html/template"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/headswim/whoen/events"
+)
+
+// ChallengePath is where challenge pages submit their solution
+const ChallengePath = "/.whoen/challenge"
+
+// challengeCookie holds the proof that a client solved the challenge
+const challengeCookie = "whoen_challenge"
+
+// challengeTokenTTL is how long a challenge page can be solved after it was served
+const challengeTokenTTL = 5 * time.Minute
+
+// ChallengeVerifier checks the solution of a challenge submitted to
+// ChallengePath, e.g. by verifying a CAPTCHA response with its provider.
+// It replaces the proof-of-work check of the built-in page.
+type ChallengeVerifier func(r *http.Request) bool
+
+// ChallengeData is passed to the challenge page template. The page must POST
+// the token, its solution as "nonce" and the redirect to Action.
+type ChallengeData struct {
+	Action     string // Where to POST the solution
+	Token      string // Signed challenge token, bound to the client IP
+	Difficulty int    // Leading zero hex digits SHA-256(Token + nonce) must have
+	Redirect   string // Where to send the client once it solved the challenge
+}
+
+// challengeState is an IP under challenge
+type challengeState struct {
+	until time.Time
+	count int // Request count when the challenge started
+	score int // Score when the challenge started
+}
+
+// challenges tracks the IPs under challenge
+type challenges struct {
+	secret   []byte
+	page     *template.Template
+	duration time.Duration
+
+	mutex sync.Mutex
+	ips   map[string]challengeState
+}
+
+// newChallenges sets up challenges from the configuration. They are set up
+// even when ChallengeEnabled is off, for lockdowns that challenge everyone.
+func (m *Middleware) newChallenges() *challenges {
+	cfg := m.options.Config
+	c := &challenges{
+		secret:   []byte(cfg.ChallengeSecret),
+		page:     defaultChallengePage,
+		duration: cfg.ChallengeDuration,
+		ips:      make(map[string]challengeState),
+	}
+
+	// Without a configured secret, cookies only hold for this process
+	if len(c.secret) == 0 {
+		c.secret = make([]byte, 32)
+		if _, err := rand.Read(c.secret); err != nil {
+			m.logger.Printf("Error generating challenge secret, challenges are disabled: %v", err)
+			return nil
+		}
+		if cfg.ChallengeEnabled {
+			m.logger.Printf("Challenges: no ChallengeSecret set, solved challenges are lost on restart and not shared between instances")
+		}
+	}
+
+	if cfg.ChallengeTemplate != "" {
+		page, err := template.ParseFiles(cfg.ChallengeTemplate)
+		if err != nil {
+			m.logger.Printf("Error loading challenge template, using the built-in page: %v", err)
+		} else {
+			c.page = page
+		}
+	}
+
+	return c
+}
+
+// challenge decides whether an IP that reached the threshold is challenged
+// instead of blocked. An IP is challenged the first time; it is blocked once
+// it reaches the threshold again while challenged, or right away for instant
+// patterns. It reports whether the IP was spared the block.
+func (m *Middleware) challenge(ip, path string, requestCount, score int, instant bool) bool {
+	if m.challenges == nil || !m.options.Config.ChallengeEnabled || instant {
+		return false
+	}
+
+	m.challenges.mutex.Lock()
+	state, ok := m.challenges.ips[ip]
+	if ok && time.Now().After(state.until) {
+		ok = false
+	}
+	if !ok {
+		m.challenges.ips[ip] = challengeState{
+			until: time.Now().Add(m.challenges.duration),
+			count: requestCount,
+			score: score,
+		}
+	}
+	m.challenges.mutex.Unlock()
+
+	if ok {
+		return !m.thresholdExceeded(requestCount-state.count, score-state.score)
+	}
+
+	m.logger.Printf("Challenging IP %s for accessing malicious path %s (count: %d, score: %d)", ip, path, requestCount, score)
+	m.emit(events.Event{Type: events.ChallengeIssued, IP: ip, Path: path})
+	return true
+}
+
+// endChallenge drops the challenge of an IP, once it is blocked
+func (m *Middleware) endChallenge(ip string) {
+	if m.challenges == nil {
+		return
+	}
+
+	m.challenges.mutex.Lock()
+	defer m.challenges.mutex.Unlock()
+	delete(m.challenges.ips, ip)
+}
+
+// challengeRequired reports whether a request must solve a challenge: its IP
+// is under challenge, or a lockdown challenges everyone, and the client has
+// not solved it yet
+func (m *Middleware) challengeRequired(r *http.Request, ip string) bool {
+	if m.challenges == nil {
+		return false
+	}
+
+	if policy, ok := m.lockdownPolicy(); !ok || !policy.ChallengeAll {
+		m.challenges.mutex.Lock()
+		state, ok := m.challenges.ips[ip]
+		m.challenges.mutex.Unlock()
+		if !ok || time.Now().After(state.until) {
+			return false
+		}
+	}
+
+	return !m.challengeSolved(r, ip)
+}
+
+// challengeSolved reports whether a request carries the cookie of a
+// challenge its IP solved
+func (m *Middleware) challengeSolved(r *http.Request, ip string) bool {
+	if m.challenges == nil {
+		return false
+	}
+	cookie, err := r.Cookie(challengeCookie)
+	return err == nil && m.challenges.valid("pass", ip, cookie.Value)
+}
+
+// cleanupChallenges drops the challenges that have expired
+func (m *Middleware) cleanupChallenges() {
+	if m.challenges == nil {
+		return
+	}
+
+	m.challenges.mutex.Lock()
+	defer m.challenges.mutex.Unlock()
+
+	now := time.Now()
+	for ip, state := range m.challenges.ips {
+		if now.After(state.until) {
+			delete(m.challenges.ips, ip)
+		}
+	}
+}
+
+// writeChallenge serves the challenge page
+func (m *Middleware) writeChallenge(w http.ResponseWriter, r *http.Request, ip string) {
+	redirect := r.URL.RequestURI()
+	if r.Method != http.MethodGet {
+		redirect = "/"
+	}
+	m.writeChallengePage(w, ip, redirect)
+}
+
+// writeChallengePage serves the challenge page, sending the client to
+// redirect once it is solved
+func (m *Middleware) writeChallengePage(w http.ResponseWriter, ip, redirect string) {
+	data := ChallengeData{
+		Action:     ChallengePath,
+		Token:      m.challenges.sign("challenge", ip, time.Now().Add(challengeTokenTTL)),
+		Difficulty: m.options.Config.ChallengeDifficulty,
+		Redirect:   redirect,
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusForbidden)
+	if err := m.challenges.page.Execute(w, data); err != nil {
+		m.logger.Printf("Error rendering challenge page: %v", err)
+	}
+}
+
+// handleChallenge checks a challenge solution posted to ChallengePath and sets
+// the cookie that lets the client through. It reports whether the request was
+// a challenge solution.
+func (m *Middleware) handleChallenge(w http.ResponseWriter, r *http.Request, ip string) bool {
+	if m.challenges == nil || r.URL.Path != ChallengePath || r.Method != http.MethodPost {
+		return false
+	}
+
+	token := r.PostFormValue("token")
+	solved := m.challenges.valid("challenge", ip, token)
+	if solved {
+		if m.options.ChallengeVerifier != nil {
+			solved = m.options.ChallengeVerifier(r)
+		} else {
+			solved = proofOfWork(token, r.PostFormValue("nonce"), m.options.Config.ChallengeDifficulty)
+		}
+	}
+	if !solved {
+		m.logger.Printf("Failed challenge from %s", ip)
+		m.writeChallenge(w, r, ip)
+		return true
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     challengeCookie,
+		Value:    m.challenges.sign("pass", ip, time.Now().Add(m.challenges.duration)),
+		Path:     "/",
+		MaxAge:   int(m.challenges.duration.Seconds()),
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+	m.logger.Printf("Challenge passed by %s", ip)
+	m.emit(events.Event{Type: events.ChallengePassed, IP: ip})
+
+	http.Redirect(w, r, localRedirect(r.PostFormValue("redirect")), http.StatusSeeOther)
+	return true
+}
+
+// localRedirect returns a redirect target posted by a form if it stays
+// within the site, and "/" otherwise
+func localRedirect(redirect string) string {
+	if !strings.HasPrefix(redirect, "/") || strings.HasPrefix(redirect, "//") || strings.HasPrefix(redirect, "/\\") {
+		return "/"
+	}
+	return redirect
+}
+
+// sign returns a value of the given kind for an IP, valid until expiry
+func (c *challenges) sign(kind, ip string, expiry time.Time) string {
+	expires := strconv.FormatInt(expiry.Unix(), 10)
+	return expires + "." + c.mac(kind, ip, expires)
+}
+
+// valid checks a value made by sign for the same kind and IP, and that it has not expired
+func (c *challenges) valid(kind, ip, value string) bool {
+	expires, signature, ok := strings.Cut(value, ".")
+	if !ok {
+		return false
+	}
+	unix, err := strconv.ParseInt(expires, 10, 64)
+	if err != nil || time.Now().Unix() > unix {
+		return false
+	}
+	return hmac.Equal([]byte(signature), []byte(c.mac(kind, ip, expires)))
+}
+
+// mac signs the kind, IP and expiry of a value with the secret
+func (c *challenges) mac(kind, ip, expires string) string {
+	h := hmac.New(sha256.New, c.secret)
+	fmt.Fprintf(h, "%s|%s|%s", kind, ip, expires)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// proofOfWork checks that SHA-256(token + nonce) starts with difficulty zero hex digits
+func proofOfWork(token, nonce string, difficulty int) bool {
+	if nonce == "" || len(nonce) > 64 {
+		return false
+	}
+	sum := sha256.Sum256([]byte(token + nonce))
+	return strings.HasPrefix(hex.EncodeToString(sum[:]), strings.Repeat("0", difficulty))
+}
+
+// defaultChallengePage solves the proof of work in the browser and posts the
+// solution, so clients without JavaScript never get through
+var defaultChallengePage = template.Must(template.New("challenge").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="robots" content="noindex">
+<title>Checking your browser</title>
+</head>
+<body>
+<p>Checking your browser before continuing. This takes a few seconds.</p>
+<noscript><p>Please enable JavaScript to continue.</p></noscript>
+<form id="challenge" method="POST" action="{{.Action}}">
+<input type="hidden" name="token" value="{{.Token}}">
+<input type="hidden" name="nonce" value="">
+<input type="hidden" name="redirect" value="{{.Redirect}}">
+</form>
+<script>
+(async function () {
+  var form = document.getElementById("challenge");
+  var token = form.token.value;
+  var prefix = "0".repeat({{.Difficulty}});
+  var encoder = new TextEncoder();
+  for (var nonce = 0; ; nonce++) {
+    var digest = await crypto.subtle.digest("SHA-256", encoder.encode(token + nonce));
+    var hex = Array.from(new Uint8Array(digest), function (b) { return b.toString(16).padStart(2, "0"); }).join("");
+    if (hex.startsWith(prefix)) {
+      form.nonce.value = String(nonce);
+      form.submit();
+      return;
+    }
+  }
+})();
+</script>
+</body>
+</html>
+`))
@@ -31,31 +31,16 @@ func NewChi(options Options) (*ChiMiddleware, error) {
 // Middleware returns a Chi middleware function
 func (m *ChiMiddleware) Middleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		// Get client IP
-		clientIP, err := getClientIP(r)
-		if err != nil {
-			m.middleware.logger.Printf("Error getting client IP: %v", err)
-			next.ServeHTTP(w, r)
+		// Stop here if whoen already answered the request
+		handled, r := m.middleware.intercept(w, r, false)
+		if handled {
 			return
 		}
 
-		// Check if the request is malicious
-		blocked, err := m.middleware.HandleRequest(r)
-		if err != nil {
-			m.middleware.logger.Printf("Error handling request from %s: %v", clientIP, err)
-			next.ServeHTTP(w, r)
-			return
-		}
-
-		if blocked {
-			m.middleware.logger.Printf("Blocked malicious request from %s to %s", clientIP, r.URL.Path)
-			w.WriteHeader(http.StatusForbidden)
-			w.Write([]byte("Forbidden: This request has been blocked for security reasons"))
-			return
-		}
-
-		// Continue processing the request
+		// Continue processing the request, watching the response for request rules
+		w, observe := m.middleware.watchResponse(w, r)
 		next.ServeHTTP(w, r)
+		observe()
 	})
 }
 
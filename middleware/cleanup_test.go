@@ -0,0 +1,102 @@
+package middleware_test
+
+import (
+	"io"
+	"log"
+	"testing"
+	"time"
+
+	"github.com/headswim/whoen/config"
+	"github.com/headswim/whoen/middleware"
+	"github.com/headswim/whoen/storage"
+	"github.com/headswim/whoen/whoentest"
+)
+
+// TestCleanupLiftsExpiredBlocksOnce checks that a block that ran out is
+// lifted and reported by one cleanup, not by every cleanup while storage
+// keeps its record for probation
+func TestCleanupLiftsExpiredBlocksOnce(t *testing.T) {
+	cfg := whoentest.Config()
+	config.ValidateConfig(&cfg)
+	cfg.SystemType = "linux"
+
+	store := whoentest.NewStorage()
+	blocker := whoentest.NewBlocker()
+	var unblocked []string
+	var cleanups []middleware.CleanupInfo
+	m, err := middleware.New(middleware.Options{
+		Config:          cfg,
+		Storage:         store,
+		Matcher:         whoentest.NewMatcher(),
+		Blocker:         blocker,
+		Logger:          log.New(io.Discard, "", 0),
+		GracePeriod:     cfg.GracePeriod,
+		TimeoutEnabled:  cfg.TimeoutEnabled,
+		TimeoutDuration: cfg.TimeoutDuration,
+		TimeoutIncrease: cfg.TimeoutIncrease,
+		Hooks: middleware.Hooks{
+			OnUnblock: func(info middleware.UnblockInfo) { unblocked = append(unblocked, info.IP) },
+			OnCleanup: func(info middleware.CleanupInfo) { cleanups = append(cleanups, info) },
+		},
+	})
+	if err != nil {
+		t.Fatalf("failed to create middleware: %v", err)
+	}
+	defer m.Close()
+
+	now := time.Now()
+	if err := storage.PutBlock(store, storage.BlockStatus{
+		IP:             "192.0.2.1",
+		BlockedUntil:   now.Add(-time.Minute),
+		ProbationUntil: now.Add(time.Hour),
+	}); err != nil {
+		t.Fatalf("failed to store block: %v", err)
+	}
+	if err := store.BlockIP("192.0.2.2", now.Add(time.Hour), false, "/.env"); err != nil {
+		t.Fatalf("failed to block: %v", err)
+	}
+
+	for i := 0; i < 3; i++ {
+		if err := m.CleanupExpired(); err != nil {
+			t.Fatalf("cleanup %d failed: %v", i, err)
+		}
+	}
+	if len(cleanups) != 3 {
+		t.Fatalf("got %d cleanups, want 3", len(cleanups))
+	}
+	if expired := cleanups[0].Expired; len(expired) != 1 || expired[0] != "192.0.2.1" {
+		t.Errorf("first cleanup lifted %v, want [192.0.2.1]", expired)
+	}
+	for i, info := range cleanups[1:] {
+		if len(info.Expired) != 0 {
+			t.Errorf("cleanup %d lifted %v again", i+1, info.Expired)
+		}
+	}
+	if len(unblocked) != 1 {
+		t.Errorf("OnUnblock called for %v, want once for 192.0.2.1", unblocked)
+	}
+	unblocks := 0
+	for _, call := range blocker.CallsTo("192.0.2.1") {
+		if call.Method == "Unblock" {
+			unblocks++
+		}
+	}
+	if unblocks != 1 {
+		t.Errorf("blocker unblocked 192.0.2.1 %d times, want once", unblocks)
+	}
+
+	// The record is lifted again once it is blocked and runs out anew
+	if err := storage.PutBlock(store, storage.BlockStatus{
+		IP:             "192.0.2.1",
+		BlockedUntil:   time.Now().Add(-time.Second),
+		ProbationUntil: now.Add(time.Hour),
+	}); err != nil {
+		t.Fatalf("failed to store block: %v", err)
+	}
+	if err := m.CleanupExpired(); err != nil {
+		t.Fatalf("cleanup failed: %v", err)
+	}
+	if expired := cleanups[len(cleanups)-1].Expired; len(expired) != 1 {
+		t.Errorf("cleanup after a new block lifted %v, want [192.0.2.1]", expired)
+	}
+}
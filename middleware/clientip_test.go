@@ -0,0 +1,38 @@
+package middleware
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+// TestGetClientIPRejectsInvalidHeaders checks that forwarding headers that
+// do not carry an IP address are rejected rather than used as the client IP
+func TestGetClientIPRejectsInvalidHeaders(t *testing.T) {
+	tests := []struct {
+		header, value string
+		want          string
+		ok            bool
+	}{
+		{"X-Forwarded-For", "203.0.113.7, 10.0.0.1", "203.0.113.7", true},
+		{"X-Forwarded-For", "::ffff:203.0.113.7", "203.0.113.7", true},
+		{"X-Real-Ip", "2001:db8::1", "2001:db8::1", true},
+		{"X-Forwarded-For", "203.0.113.7'; Start-Process calc; '", "", false},
+		{"X-Forwarded-For", "get x\r\nflush_all", "", false},
+		{"X-Real-Ip", "not-an-ip", "", false},
+	}
+
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set(test.header, test.value)
+		ip, err := getClientIP(r)
+		if ok := err == nil; ok != test.ok || ip != test.want {
+			t.Errorf("%s: %q gives %q, %v, want %q", test.header, test.value, ip, err, test.want)
+		}
+	}
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.RemoteAddr = "192.0.2.1:40000"
+	if ip, err := getClientIP(r); err != nil || ip != "192.0.2.1" {
+		t.Errorf("RemoteAddr gives %q, %v, want 192.0.2.1", ip, err)
+	}
+}
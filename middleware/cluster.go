@@ -0,0 +1,142 @@
+package middleware
+
+import (
+	"time"
+
+	"github.com/headswim/whoen/blocker"
+	"github.com/headswim/whoen/cluster"
+	"github.com/headswim/whoen/storage"
+)
+
+// clusterRetryDelay is the wait before resubscribing after a subscription fails
+const clusterRetryDelay = 5 * time.Second
+
+// publishBlock announces a block to the other instances
+func (m *Middleware) publishBlock(ip string, until time.Time, isPermanent bool, path, source string) {
+	m.publish(cluster.Message{
+		Type:        cluster.MessageBlock,
+		IP:          ip,
+		Until:       until,
+		IsPermanent: isPermanent,
+		Path:        path,
+		Source:      source,
+	})
+}
+
+// publishUnblock announces an unblock to the other instances
+func (m *Middleware) publishUnblock(ip string) {
+	m.publish(cluster.Message{Type: cluster.MessageUnblock, IP: ip})
+}
+
+// publish sends a message to the cluster, if cluster sync is enabled
+func (m *Middleware) publish(msg cluster.Message) {
+	if m.options.Cluster == nil {
+		return
+	}
+
+	msg.Node = m.nodeID
+	msg.Time = time.Now()
+	if err := m.options.Cluster.Publish(m.ctx, msg); err != nil {
+		m.logger.Printf("Error publishing %s of IP %s to cluster: %v", msg.Type, msg.IP, err)
+	}
+}
+
+// subscribeCluster applies messages from other instances until the middleware is closed
+func (m *Middleware) subscribeCluster() {
+	for {
+		err := m.options.Cluster.Subscribe(m.ctx, m.applyClusterMessage)
+		if m.ctx.Err() != nil {
+			return
+		}
+		m.logger.Printf("Cluster subscription ended, retrying in %v: %v", clusterRetryDelay, err)
+
+		select {
+		case <-time.After(clusterRetryDelay):
+		case <-m.ctx.Done():
+			return
+		}
+	}
+}
+
+// applyClusterMessage applies a block decision made by another instance to the
+// local storage and blocker. Applied decisions are not published again.
+func (m *Middleware) applyClusterMessage(msg cluster.Message) {
+	if msg.Node == m.nodeID || msg.IP == "" {
+		return
+	}
+
+	switch msg.Type {
+	case cluster.MessageBlock:
+		if m.matcher.IsWhitelisted(msg.IP) {
+			return
+		}
+		if prefix, ok := blockedPrefix(msg.IP); ok {
+			if conflict := m.whitelistConflict(prefix); conflict != "" {
+				m.logger.Printf("Not applying block of subnet %s from node %s: %s", msg.IP, msg.Node, conflict)
+				return
+			}
+		}
+		if !msg.IsPermanent && !time.Now().Before(msg.Until) {
+			return
+		}
+
+		// Never weaken a stronger local block
+		blocked, status, err := m.storage.IsIPBlocked(msg.IP)
+		if err != nil {
+			m.logger.Printf("Error applying cluster block of IP %s: %v", msg.IP, err)
+			return
+		}
+		record := storage.BlockStatus{IP: msg.IP, BlockedAt: msg.Time}
+		if status != nil {
+			if blocked && (status.IsPermanent || (!msg.IsPermanent && !msg.Until.After(status.BlockedUntil))) {
+				return
+			}
+			record = *status
+		}
+		record.IsPermanent = msg.IsPermanent
+		record.BlockedUntil = msg.Until
+		if msg.IsPermanent {
+			record.BlockedUntil = time.Time{}
+		}
+		record.LastRequestPath = msg.Path
+		record.Source = msg.Source
+		record.Reason = msg.Reason
+		record.Operator = msg.Operator
+		if err := storage.PutBlock(m.storage, record); err != nil {
+			m.logger.Printf("Error applying cluster block of IP %s: %v", msg.IP, err)
+			return
+		}
+
+		if msg.IsPermanent {
+			_, err = m.blocker.Block(msg.IP, blocker.Ban, 0)
+		} else {
+			_, err = m.blocker.Block(msg.IP, blocker.Timeout, time.Until(msg.Until))
+		}
+		if err != nil {
+			m.logger.Printf("Error enforcing cluster block of IP %s: %v", msg.IP, err)
+			return
+		}
+		info := BlockInfo{IP: msg.IP, Path: msg.Path, Permanent: msg.IsPermanent, Source: SourceCluster, Actor: msg.Node}
+		if !msg.IsPermanent {
+			info.Until = msg.Until
+			info.Duration = time.Until(msg.Until)
+		}
+		m.onBlock(info)
+		m.logger.Printf("Applied block of IP %s from node %s", msg.IP, msg.Node)
+
+	case cluster.MessageUnblock:
+		if err := m.blocker.Unblock(msg.IP); err != nil {
+			m.logger.Printf("Error applying cluster unblock of IP %s: %v", msg.IP, err)
+			return
+		}
+		if err := m.storage.UnblockIP(msg.IP); err != nil {
+			m.logger.Printf("Error applying cluster unblock of IP %s: %v", msg.IP, err)
+			return
+		}
+		if err := m.storage.ResetRequestCount(msg.IP); err != nil {
+			m.logger.Printf("Error resetting request count of IP %s: %v", msg.IP, err)
+		}
+		m.onUnblock(UnblockInfo{IP: msg.IP, Source: SourceCluster, Actor: msg.Node})
+		m.logger.Printf("Applied unblock of IP %s from node %s", msg.IP, msg.Node)
+	}
+}
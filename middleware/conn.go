@@ -0,0 +1,112 @@
+package middleware
+
+import (
+	"context"
+	"net"
+	"net/http"
+
+	"github.com/headswim/whoen/ipaddr"
+)
+
+// IsBlocked reports whether an IP is currently blocked, either by the blocker,
+// as part of a blocked subnet or in storage
+func (m *Middleware) IsBlocked(ip string) (bool, error) {
+	ip = ipaddr.Normalize(ip)
+
+	// Whitelisted IPs are never considered blocked, and neither are IPs whose
+	// blocks are only logged
+	if m.logOnly(ip) || m.matcher.IsWhitelisted(ip) {
+		return false, nil
+	}
+
+	blocked, err := m.blocker.IsBlocked(ip)
+	if err != nil || blocked {
+		return blocked, err
+	}
+	if m.subnetBlocked(ip) {
+		return true, nil
+	}
+
+	blocked, _, err = m.storage.IsIPBlocked(ip)
+	return blocked, err
+}
+
+// connBlocked reports whether connections from an IP are closed. Unlike
+// IsBlocked it only consults the blocker and the blocked subnets, which are
+// held in memory, since the connection hooks run in the server's accept
+// loop; blocks recorded by other instances reach the blocker with Sync.
+func (m *Middleware) connBlocked(ip string) bool {
+	if m.logOnly(ip) || m.matcher.IsWhitelisted(ip) {
+		return false
+	}
+
+	blocked, err := m.blocker.IsBlocked(ip)
+	if err != nil {
+		m.logger.Printf("Error checking if connection from %s is blocked: %v", ip, err)
+	}
+	return blocked || m.subnetBlocked(ip)
+}
+
+// closeBlocked closes a connection from a blocked IP
+func (m *Middleware) closeBlocked(conn net.Conn) {
+	if ip, ok := connIP(conn); ok && m.connBlocked(ip) {
+		m.logger.Printf("Closing connection from blocked IP %s", ip)
+		conn.Close()
+	}
+}
+
+// ConnState returns a hook for http.Server.ConnState that closes connections
+// from blocked IPs as soon as they are accepted, before any request is read.
+// If next is not nil it is called for every connection state change, so an
+// existing ConnState hook can be chained.
+func (m *Middleware) ConnState(next func(net.Conn, http.ConnState)) func(net.Conn, http.ConnState) {
+	return func(conn net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			m.closeBlocked(conn)
+		}
+
+		if next != nil {
+			next(conn, state)
+		}
+	}
+}
+
+// ConnContext returns a hook for http.Server.ConnContext that closes
+// connections from blocked IPs as soon as they are accepted, like ConnState.
+// If next is not nil it is called for every connection, so an existing
+// ConnContext hook can be chained.
+func (m *Middleware) ConnContext(next func(context.Context, net.Conn) context.Context) func(context.Context, net.Conn) context.Context {
+	return func(ctx context.Context, conn net.Conn) context.Context {
+		m.closeBlocked(conn)
+
+		if next != nil {
+			return next(ctx, conn)
+		}
+		return ctx
+	}
+}
+
+// ProtectServer installs the ConnContext hook on an http.Server so that every
+// connection is checked, including routes not wrapped by the middleware.
+// Any ConnContext hook already set on the server keeps being called.
+//
+// The check uses the peer address of the connection, so when the server sits
+// behind a reverse proxy or load balancer only the proxy address is seen.
+func (m *Middleware) ProtectServer(srv *http.Server) {
+	srv.ConnContext = m.ConnContext(srv.ConnContext)
+}
+
+// connIP returns the remote IP of a connection
+func connIP(conn net.Conn) (string, bool) {
+	addr := conn.RemoteAddr()
+	if addr == nil {
+		return "", false
+	}
+
+	ip, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return ipaddr.Normalize(addr.String()), true
+	}
+
+	return ipaddr.Normalize(ip), true
+}
@@ -0,0 +1,166 @@
+package middleware_test
+
+import (
+	"context"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/headswim/whoen/blocker"
+	"github.com/headswim/whoen/config"
+	"github.com/headswim/whoen/middleware"
+	"github.com/headswim/whoen/storage"
+	"github.com/headswim/whoen/whoentest"
+)
+
+// peerConn is a connection from a given peer address that records whether
+// it was closed
+type peerConn struct {
+	net.Conn
+	addr   net.Addr
+	closed bool
+}
+
+func (c *peerConn) RemoteAddr() net.Addr { return c.addr }
+func (c *peerConn) Close() error         { c.closed = true; return nil }
+
+// newPeerConn returns a connection from ip
+func newPeerConn(ip string) *peerConn {
+	return &peerConn{addr: &net.TCPAddr{IP: net.ParseIP(ip), Port: 40000}}
+}
+
+// countingStorage counts the block lookups made in storage
+type countingStorage struct {
+	*storage.KVStorage
+	lookups atomic.Int32
+}
+
+func (s *countingStorage) IsIPBlocked(ip string) (bool, *storage.BlockStatus, error) {
+	s.lookups.Add(1)
+	return s.KVStorage.IsIPBlocked(ip)
+}
+
+// TestConnHooks checks that ConnState and ConnContext close connections from
+// IPs the blocker holds, chain the hooks they wrap and never read storage
+func TestConnHooks(t *testing.T) {
+	cfg := whoentest.Config()
+	config.ValidateConfig(&cfg)
+	cfg.SystemType = "linux"
+
+	store := &countingStorage{KVStorage: whoentest.NewStorage()}
+	b := whoentest.NewBlocker()
+	m := whoentest.NewMatcher()
+	m.Whitelist("192.0.2.3")
+	mw, err := middleware.New(middleware.Options{
+		Config:          cfg,
+		Storage:         store,
+		Matcher:         m,
+		Blocker:         b,
+		Logger:          log.New(io.Discard, "", 0),
+		GracePeriod:     cfg.GracePeriod,
+		TimeoutEnabled:  cfg.TimeoutEnabled,
+		TimeoutDuration: cfg.TimeoutDuration,
+		TimeoutIncrease: cfg.TimeoutIncrease,
+	})
+	if err != nil {
+		t.Fatalf("failed to create middleware: %v", err)
+	}
+	defer mw.Close()
+
+	for _, ip := range []string{"192.0.2.1", "192.0.2.3"} {
+		if _, err := b.Block(ip, blocker.Ban, 0); err != nil {
+			t.Fatalf("failed to block: %v", err)
+		}
+	}
+	if err := store.BlockIP("192.0.2.2", time.Now().Add(time.Hour), false, "/.env"); err != nil {
+		t.Fatalf("failed to block in storage: %v", err)
+	}
+
+	var states, contexts int
+	connState := mw.ConnState(func(net.Conn, http.ConnState) { states++ })
+	connContext := mw.ConnContext(func(ctx context.Context, _ net.Conn) context.Context {
+		contexts++
+		return ctx
+	})
+
+	store.lookups.Store(0)
+	tests := []struct {
+		ip     string
+		closed bool
+	}{
+		{"192.0.2.1", true},  // Blocked by the blocker
+		{"192.0.2.2", false}, // Only in storage, not read on accept
+		{"192.0.2.3", false}, // Whitelisted
+		{"192.0.2.4", false},
+	}
+	for _, test := range tests {
+		conn := newPeerConn(test.ip)
+		connState(conn, http.StateNew)
+		if conn.closed != test.closed {
+			t.Errorf("ConnState closed %s: %v, want %v", test.ip, conn.closed, test.closed)
+		}
+		conn = newPeerConn(test.ip)
+		if ctx := connContext(context.Background(), conn); ctx == nil {
+			t.Errorf("ConnContext returned no context for %s", test.ip)
+		}
+		if conn.closed != test.closed {
+			t.Errorf("ConnContext closed %s: %v, want %v", test.ip, conn.closed, test.closed)
+		}
+	}
+
+	// Later states are passed on without a check
+	conn := newPeerConn("192.0.2.1")
+	connState(conn, http.StateActive)
+	if conn.closed {
+		t.Error("ConnState closed a connection on StateActive")
+	}
+
+	if states != len(tests)+1 || contexts != len(tests) {
+		t.Errorf("chained hooks called %d and %d times, want %d and %d", states, contexts, len(tests)+1, len(tests))
+	}
+	if lookups := store.lookups.Load(); lookups != 0 {
+		t.Errorf("connection hooks read storage %d times, want none", lookups)
+	}
+}
+
+// TestProtectServer checks that a server protected by the middleware drops
+// connections from blocked IPs on every route, and keeps calling its own
+// ConnContext hook
+func TestProtectServer(t *testing.T) {
+	h := whoentest.New(t, whoentest.Config(), whoentest.NewMatcher())
+
+	var chained atomic.Int32
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	srv.Config.ConnContext = func(ctx context.Context, _ net.Conn) context.Context {
+		chained.Add(1)
+		return ctx
+	}
+	h.Middleware.ProtectServer(srv.Config)
+	srv.Start()
+	defer srv.Close()
+
+	client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}, Timeout: 5 * time.Second}
+	resp, err := client.Get(srv.URL)
+	if err != nil {
+		t.Fatalf("request before the block failed: %v", err)
+	}
+	resp.Body.Close()
+
+	if _, err := h.Blocker.Block("127.0.0.1", blocker.Ban, 0); err != nil {
+		t.Fatalf("failed to block: %v", err)
+	}
+	if resp, err := client.Get(srv.URL); err == nil {
+		resp.Body.Close()
+		t.Errorf("request from a blocked IP got %d, want the connection closed", resp.StatusCode)
+	}
+	if chained.Load() != 2 {
+		t.Errorf("server's own ConnContext called %d times, want 2", chained.Load())
+	}
+}
@@ -0,0 +1,36 @@
+package middleware
+
+import (
+	"net/http"
+	"time"
+)
+
+// maxDeferred bounds the storage and firewall work running in the background
+// for requests that were short on time
+const maxDeferred = 64
+
+// deferWork runs work in the background instead of inline when the request's
+// context is cancelled or has less than Config.DeferBudget left before its
+// deadline, so whoen never makes a request time out. It reports whether the
+// work was taken off the request path. When too much work is already
+// deferred, the work is dropped rather than queued.
+func (m *Middleware) deferWork(r *http.Request, work func()) bool {
+	ctx := r.Context()
+	if ctx.Err() == nil {
+		deadline, ok := ctx.Deadline()
+		if !ok || time.Until(deadline) >= m.options.Config.DeferBudget {
+			return false
+		}
+	}
+
+	select {
+	case m.deferred <- struct{}{}:
+		go func() {
+			defer func() { <-m.deferred }()
+			work()
+		}()
+	default:
+		m.logger.Printf("Dropped deferred work for request to %s: %d already pending", r.URL.Path, maxDeferred)
+	}
+	return true
+}
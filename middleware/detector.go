@@ -0,0 +1,67 @@
+package middleware
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/headswim/whoen/matcher"
+)
+
+// Detector scores requests with custom logic, alongside the matcher's path
+// and payload patterns. A positive score flags the request as malicious and
+// counts towards the IP's score like a pattern weight; zero or less means the
+// detector has nothing to report. The reason is logged and reported with the
+// detection.
+type Detector interface {
+	Detect(r *http.Request) (score int, reason string)
+}
+
+// DetectorFunc adapts a function to the Detector interface
+type DetectorFunc func(r *http.Request) (score int, reason string)
+
+// Detect calls f(r)
+func (f DetectorFunc) Detect(r *http.Request) (int, string) {
+	return f(r)
+}
+
+// AddDetector registers detectors in addition to Options.Detectors
+func (m *Middleware) AddDetector(detectors ...Detector) {
+	m.detectorsMutex.Lock()
+	defer m.detectorsMutex.Unlock()
+
+	added := append(append([]Detector(nil), *m.detectors.Load()...), detectors...)
+	m.detectors.Store(&added)
+}
+
+// detect runs the registered detectors on a request and returns their
+// combined score and reasons. A detector that panics is logged and skipped.
+func (m *Middleware) detect(r *http.Request) (score int, reasons []string) {
+	for _, detector := range *m.detectors.Load() {
+		var detectorScore int
+		var reason string
+		m.callHook("Detector", func() { detectorScore, reason = detector.Detect(r) })
+		if detectorScore <= 0 {
+			continue
+		}
+		if reason == "" {
+			reason = "unnamed detector"
+		}
+		score += detectorScore
+		reasons = append(reasons, reason)
+	}
+	return score, reasons
+}
+
+// combineDetection adds the detectors' score to the matcher's match. A request
+// only the detectors flag gets a match of its own, with the reasons as its
+// pattern.
+func combineDetection(match matcher.Match, isMalicious bool, score int, reasons []string) (matcher.Match, bool) {
+	if score <= 0 {
+		return match, isMalicious
+	}
+	if !isMalicious {
+		return matcher.Match{Pattern: "detector:" + strings.Join(reasons, ", "), Weight: score}, true
+	}
+	match.Weight += score
+	return match, true
+}
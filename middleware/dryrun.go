@@ -0,0 +1,80 @@
+package middleware
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/headswim/whoen/dryrun"
+)
+
+// dryRun reports whether the middleware only records the blocks it would make
+func (m *Middleware) dryRun() bool {
+	return m.options.Config.DryRun
+}
+
+// recordDecision records a block the middleware would have made for an IP in
+// log-only mode. It does nothing for IPs whose blocks are enforced.
+func (m *Middleware) recordDecision(ip, path, pattern string, until time.Time, permanent bool) {
+	if m.dryRunRecorder == nil || !m.logOnly(ip) {
+		return
+	}
+
+	record := dryrun.Record{
+		Kind:      dryrun.KindDecision,
+		IP:        ip,
+		Path:      path,
+		Pattern:   pattern,
+		Permanent: permanent,
+	}
+	if !permanent {
+		record.Until = until
+		record.Duration = time.Until(until).Round(time.Second)
+	}
+	if err := m.dryRunRecorder.Record(record); err != nil {
+		m.logger.Printf("Error recording dry-run decision for %s: %v", ip, err)
+	}
+}
+
+// recordWouldReject records a request that was served in log-only mode although
+// its IP would have been blocked. It does nothing for IPs whose blocks are enforced.
+func (m *Middleware) recordWouldReject(ip, path string) {
+	if m.dryRunRecorder == nil || !m.logOnly(ip) {
+		return
+	}
+
+	record := dryrun.Record{
+		Kind:      dryrun.KindRequest,
+		IP:        ip,
+		Path:      path,
+		Malicious: m.matcher.IsMalicious(path),
+	}
+	if err := m.dryRunRecorder.Record(record); err != nil {
+		m.logger.Printf("Error recording dry-run request from %s: %v", ip, err)
+	}
+}
+
+// DryRunReport summarizes the dry-run dataset in Config.DryRunFile: the blocks
+// that would have been made and the served traffic they would have rejected
+func (m *Middleware) DryRunReport() (dryrun.Report, error) {
+	records, err := dryrun.ReadFile(m.options.Config.DryRunFile)
+	if err != nil {
+		return dryrun.Report{}, err
+	}
+	return dryrun.Summarize(records), nil
+}
+
+// DryRunReportHandler returns an http.Handler that serves DryRunReport as JSON.
+// Mount it on an internal route, the report lists client IPs and paths.
+func (m *Middleware) DryRunReportHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		report, err := m.DryRunReport()
+		if err != nil {
+			m.logger.Printf("Error building dry-run report: %v", err)
+			http.Error(w, "failed to build dry-run report", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		json.NewEncoder(w).Encode(report)
+	})
+}
@@ -0,0 +1,54 @@
+package middleware
+
+import (
+	"time"
+
+	"github.com/headswim/whoen/edge"
+)
+
+// syncEdgeLoop sends blocklist changes to the edge provider until Close is called
+func (m *Middleware) syncEdgeLoop() {
+	syncer := edge.NewSyncer(m.options.Edge, m.options.Config.EdgeFullSyncInterval)
+	ticker := time.NewTicker(m.options.Config.EdgeSyncInterval)
+	defer ticker.Stop()
+
+	for {
+		m.syncEdge(syncer)
+
+		select {
+		case <-ticker.C:
+		case <-m.ctx.Done():
+			return
+		}
+	}
+}
+
+// syncEdge sends the active, non-whitelisted blocks in storage to the edge provider
+func (m *Middleware) syncEdge(syncer *edge.Syncer) {
+	blockedIPs, err := m.storage.GetBlockedIPs()
+	if err != nil {
+		m.logger.Printf("Error reading blocked IPs for edge sync: %v", err)
+		return
+	}
+
+	now := time.Now()
+	desired := make([]string, 0, len(blockedIPs))
+	for _, status := range blockedIPs {
+		if !status.IsPermanent && now.After(status.BlockedUntil) {
+			continue
+		}
+		if m.matcher.IsWhitelisted(status.IP) {
+			continue
+		}
+		desired = append(desired, status.IP)
+	}
+
+	result, err := syncer.Sync(m.ctx, desired)
+	if err != nil {
+		m.logger.Printf("Error syncing blocklist to the edge: %v", err)
+		return
+	}
+	if result.Added > 0 || result.Removed > 0 {
+		m.logger.Printf("Edge sync: %d added, %d removed (full: %v)", result.Added, result.Removed, result.Full)
+	}
+}
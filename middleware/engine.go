@@ -0,0 +1,102 @@
+package middleware
+
+import (
+	"net/http"
+	"net/url"
+
+	"github.com/headswim/whoen/ipaddr"
+	"github.com/headswim/whoen/matcher"
+)
+
+// Decision is what Engine.Evaluate concluded about a request. It carries the
+// fields handlers see in RequestStatus; Blocked is whether the request should
+// be refused, so it stays false in dry-run mode and log-only ramp stages.
+type Decision = RequestStatus
+
+// Engine runs whoen's counting and blocking pipeline on requests that do not
+// arrive over HTTP, such as SMTP commands, SSH logins or connections through a
+// TCP proxy. It shares the storage, blocker, matcher and configuration of the
+// Middleware it belongs to, so an IP blocked over one protocol is blocked
+// over all of them.
+type Engine struct {
+	middleware *Middleware
+}
+
+// NewEngine creates a middleware from options and returns its Engine, for
+// applications without an HTTP server
+func NewEngine(options Options) (*Engine, error) {
+	m, err := New(options)
+	if err != nil {
+		return nil, err
+	}
+	return m.Engine(), nil
+}
+
+// Engine returns an Engine on the middleware's pipeline
+func (m *Middleware) Engine() *Engine {
+	return &Engine{middleware: m}
+}
+
+// Middleware returns the middleware the engine runs on, e.g. to serve HTTP
+// from the same state
+func (e *Engine) Middleware() *Middleware {
+	return e.middleware
+}
+
+// Evaluate counts a request from an IP and decides whether to refuse it,
+// exactly as the middleware does for HTTP requests: whitelist, existing
+// blocks, pattern matching, detectors, request rules, grace period, score
+// threshold and timeouts all apply. path is what the patterns are matched
+// against, such as an SMTP command or the user name of an SSH login, and is
+// normalized like an HTTP path. headers carry protocol details for
+// detectors and request rules and may be nil. Detectors and request rules
+// see a request without method or body.
+func (e *Engine) Evaluate(ip, path string, headers http.Header) (Decision, error) {
+	return e.run(ip, path, headers, nil)
+}
+
+// Report counts an event the caller already found malicious, such as a
+// failed login, and decides whether to refuse the IP. The event is recorded
+// under path with the weight given, for the grace period, score threshold
+// and timeouts, without being matched against the patterns. The whitelist
+// and existing blocks still apply.
+func (e *Engine) Report(ip, path string, weight int) (Decision, error) {
+	return e.run(ip, path, nil, &matcher.Match{Pattern: path, Weight: weight, Location: matcher.LocationPath})
+}
+
+// run builds a request from ip, path and headers and runs the pipeline on
+// it, with reported as the match if it is set
+func (e *Engine) run(ip, path string, headers http.Header, reported *matcher.Match) (Decision, error) {
+	ip = ipaddr.Normalize(ip)
+	if headers == nil {
+		headers = make(http.Header)
+	}
+	r := &http.Request{
+		URL:        &url.URL{Path: path},
+		Header:     headers,
+		Body:       http.NoBody,
+		RemoteAddr: ip,
+	}
+
+	var decision Decision
+	blocked, err := e.middleware.evaluate(r, ip, reported, &decision)
+	decision.IP = ip
+	decision.Blocked = blocked && err == nil
+	return decision, err
+}
+
+// IsBlocked reports whether an IP is blocked, e.g. to refuse a connection
+// before reading anything from it, see Middleware.IsBlocked
+func (e *Engine) IsBlocked(ip string) (bool, error) {
+	return e.middleware.IsBlocked(ip)
+}
+
+// CleanupExpired removes expired blocks, see Middleware.CleanupExpired
+func (e *Engine) CleanupExpired() error {
+	return e.middleware.CleanupExpired()
+}
+
+// Close stops the middleware's background work and closes its storage
+func (e *Engine) Close() error {
+	return e.middleware.Close()
+}
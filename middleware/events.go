@@ -0,0 +1,43 @@
+package middleware
+
+import (
+	"time"
+
+	"github.com/headswim/whoen/events"
+	"github.com/headswim/whoen/matcher"
+)
+
+// emit writes an event to the log sink and passes it to the OnEvent
+// handler, if one is set
+func (m *Middleware) emit(event events.Event) {
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	m.logEvent(event)
+	if m.options.OnEvent == nil {
+		return
+	}
+	event.IP = m.exportIP(event.IP)
+	event.Tenant = m.exportTenant()
+	m.options.OnEvent(event)
+}
+
+// emitDetection reports a malicious request with what it matched and where
+func (m *Middleware) emitDetection(ip, path string, match matcher.Match) {
+	if m.options.OnEvent == nil {
+		return
+	}
+	m.emit(events.Event{
+		Type: events.RequestDetected,
+		IP:   ip,
+		Path: path,
+		Match: &events.Match{
+			Pattern:  match.Pattern,
+			Category: match.Category,
+			Location: match.Location,
+			Offset:   match.Offset,
+			Matched:  match.Matched,
+			Excerpt:  match.Excerpt,
+		},
+	})
+}
@@ -0,0 +1,67 @@
+package middleware
+
+import (
+	"github.com/headswim/whoen/blocker"
+	"github.com/headswim/whoen/config"
+	"github.com/headswim/whoen/events"
+)
+
+// BlockerOptions returns the blocker feature flags set in a configuration
+func BlockerOptions(cfg config.Config) blocker.Options {
+	return blocker.Options{
+		Enforce:       cfg.EnforceFirewall,
+		SkipTimeouts:  !cfg.FirewallTimeouts,
+		SkipBans:      !cfg.FirewallBans,
+		BlockOutbound: cfg.BlockOutbound,
+		EnablePF:      cfg.EnablePF,
+		Backend:       cfg.FirewallBackend,
+		Privilege:     cfg.FirewallPrivilege,
+		Retries:       cfg.FirewallRetries,
+		RetryBackoff:  cfg.FirewallRetryBackoff,
+	}
+}
+
+// logCapabilities logs which enforcement capabilities are active, so operators
+// can see at startup what whoen is allowed to change on the host
+func (m *Middleware) logCapabilities() {
+	cfg := m.options.Config
+
+	// Report the blocker's own flags, which may differ from the
+	// configuration when the blocker was provided in the options
+	reporter, ok := m.blocker.(interface{ Options() blocker.Options })
+	if !ok {
+		m.logger.Printf("Enforcement: custom blocker %T, OS firewall changes are up to it", m.blocker)
+		m.logger.Printf("  SubnetEscalation: %v", cfg.SubnetEscalation)
+		return
+	}
+	flags := reporter.Options()
+
+	m.logger.Printf("Enforcement capabilities:")
+	if flags.Enforce && (cfg.SystemType == "linux" || cfg.SystemType == "windows") {
+		m.logger.Printf("  OS firewall: on (%s, %s)", cfg.SystemType, flags.Backend)
+	} else if flags.Enforce {
+		m.logger.Printf("  OS firewall: on (%s)", cfg.SystemType)
+	} else {
+		m.logger.Printf("  OS firewall: off, blocked IPs are only rejected by the middleware")
+	}
+	if flags.Enforce && cfg.SystemType != "windows" {
+		m.logger.Printf("  Privilege: %s", flags.Privilege)
+	}
+	if flags.Enforce {
+		m.logger.Printf("  Firewall timeouts: %v, bans: %v", !flags.SkipTimeouts, !flags.SkipBans)
+	}
+
+	// Check that the firewall commands work, rather than failing on the first block
+	if checker, ok := m.blocker.(blocker.CapabilityChecker); ok {
+		if err := checker.CheckCapabilities(); err != nil {
+			m.logger.Printf("Error: %v", err)
+			m.logger.Printf("Blocked IPs are still rejected by the middleware, but not by the OS firewall")
+			m.emit(events.Event{Type: events.FirewallUnavailable, Message: err.Error()})
+		}
+	}
+	m.logger.Printf("  BlockOutbound: %v", flags.Enforce && flags.BlockOutbound && flags.Backend != blocker.BackendFirewalld)
+	if cfg.SystemType == "darwin" {
+		m.logger.Printf("  EnablePF: %v", flags.Enforce && flags.EnablePF)
+	}
+	m.logger.Printf("  SubnetEscalation: %v", cfg.SubnetEscalation)
+}
@@ -0,0 +1,71 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/headswim/whoen/feeds"
+)
+
+// newFeeds returns the feeds named in Config.Feeds followed by Options.Feeds.
+// Configured feeds block for Config.FeedTTL; invalid names are logged and
+// skipped.
+func (m *Middleware) newFeeds() []*feeds.Feed {
+	var subscribed []*feeds.Feed
+	for _, spec := range m.options.Config.Feeds {
+		feed, err := feeds.Parse(spec)
+		if err != nil {
+			m.logger.Printf("Skipping feed: %v", err)
+			continue
+		}
+		feed.TTL = m.options.Config.FeedTTL
+		subscribed = append(subscribed, feed)
+	}
+	return append(subscribed, m.options.Feeds...)
+}
+
+// watchFeeds refreshes the subscribed feeds right away and then every
+// Config.FeedRefreshInterval until Close is called
+func (m *Middleware) watchFeeds() {
+	ticker := time.NewTicker(m.options.Config.FeedRefreshInterval)
+	defer ticker.Stop()
+
+	for {
+		if err := m.RefreshFeeds(m.ctx); err != nil && m.ctx.Err() == nil {
+			m.logger.Printf("Error refreshing feeds: %v", err)
+		}
+
+		select {
+		case <-ticker.C:
+		case <-m.ctx.Done():
+			return
+		}
+	}
+}
+
+// RefreshFeeds downloads the subscribed feeds, blocks their entries, lifts
+// the blocks of entries that dropped out and enforces the changes. A feed
+// that fails keeps its blocks until they run out; the others are still
+// refreshed. Whitelisted IPs are skipped.
+func (m *Middleware) RefreshFeeds(ctx context.Context) error {
+	var errs []error
+	changed := false
+	for _, feed := range m.feeds {
+		result, err := feed.Refresh(ctx, m.storage, m.matcher.IsWhitelisted)
+		if err != nil {
+			errs = append(errs, err)
+		}
+		if result.Blocked > 0 || result.Lifted > 0 {
+			changed = true
+			m.logger.Printf("Feed %s: %d entries, %d blocks added or renewed, %d lifted", feed.Name, result.Entries, result.Blocked, result.Lifted)
+		}
+	}
+
+	if changed {
+		if err := m.Sync(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
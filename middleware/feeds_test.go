@@ -0,0 +1,73 @@
+package middleware_test
+
+import (
+	"context"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/headswim/whoen/config"
+	"github.com/headswim/whoen/feeds"
+	"github.com/headswim/whoen/middleware"
+	"github.com/headswim/whoen/whoentest"
+)
+
+// TestRefreshFeeds checks that the middleware applies its feeds, skipping
+// whitelisted IPs, enforces their blocks and keeps refreshing the feeds that
+// work when one fails
+func TestRefreshFeeds(t *testing.T) {
+	good := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("192.0.2.1\n192.0.2.9\n"))
+	}))
+	defer good.Close()
+	bad := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer bad.Close()
+
+	cfg := whoentest.Config()
+	cfg.Feeds = []string{"not-a-feed", bad.URL}
+	cfg.FeedTTL = 2 * time.Hour
+	config.ValidateConfig(&cfg)
+	cfg.SystemType = "linux"
+
+	store := whoentest.NewStorage()
+	b := whoentest.NewBlocker()
+	m := whoentest.NewMatcher()
+	m.Whitelist("192.0.2.9")
+	mw, err := middleware.New(middleware.Options{
+		Config:          cfg,
+		Storage:         store,
+		Matcher:         m,
+		Blocker:         b,
+		Logger:          log.New(io.Discard, "", 0),
+		GracePeriod:     cfg.GracePeriod,
+		TimeoutEnabled:  cfg.TimeoutEnabled,
+		TimeoutDuration: cfg.TimeoutDuration,
+		TimeoutIncrease: cfg.TimeoutIncrease,
+		Feeds:           []*feeds.Feed{{Name: "good", URL: good.URL, TTL: time.Hour}},
+	})
+	if err != nil {
+		t.Fatalf("failed to create middleware: %v", err)
+	}
+	defer mw.Close()
+
+	err = mw.RefreshFeeds(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "502") {
+		t.Errorf("RefreshFeeds = %v, want the failure of the bad feed", err)
+	}
+	_, status, _ := store.IsIPBlocked("192.0.2.1")
+	if status == nil || status.Source != "feed:good" {
+		t.Fatalf("feed entry blocked with %+v, want a block from feed:good", status)
+	}
+	if blocked, _ := b.IsBlocked("192.0.2.1"); !blocked {
+		t.Error("feed block not enforced by the blocker")
+	}
+	if blocked, _, _ := store.IsIPBlocked("192.0.2.9"); blocked {
+		t.Error("whitelisted feed entry blocked")
+	}
+}
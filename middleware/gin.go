@@ -1,8 +1,6 @@
 package middleware
 
 import (
-	"net/http"
-
 	"github.com/gin-gonic/gin"
 )
 
@@ -33,29 +31,41 @@ func NewGin(options Options) (*GinMiddleware, error) {
 // Middleware returns a Gin middleware function
 func (m *GinMiddleware) Middleware() gin.HandlerFunc {
 	return func(c *gin.Context) {
-		// Get client IP
-		clientIP := c.ClientIP()
-
-		// Check if the request is malicious
-		blocked, err := m.middleware.HandleRequest(c.Request)
-		if err != nil {
-			m.middleware.logger.Printf("Error handling request from %s: %v", clientIP, err)
-			c.Next() // Continue processing the request even if there's an error
+		// Stop here if whoen already answered the request
+		handled, r := m.middleware.intercept(c.Writer, c.Request, true)
+		if handled {
+			c.Abort()
 			return
 		}
+		c.Request = r
+
+		// Continue processing the request, then count the response for request rules
+		c.Next()
+		m.middleware.ObserveResponse(c.Request, c.Writer.Status())
+	}
+}
 
-		if blocked {
-			m.middleware.logger.Printf("Blocked malicious request from %s to %s", clientIP, c.Request.URL.Path)
-			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{
-				"error":   "Forbidden",
-				"message": "This request has been blocked for security reasons",
-			})
+// Gin returns a Gin middleware function checking each request with the
+// middleware of its tenant, see PolicyRouter.Handler
+func (p *PolicyRouter) Gin() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		m := p.Route(c.Request)
+		if m == nil {
+			c.Next()
 			return
 		}
+		m.Gin().Middleware()(c)
+	}
+}
 
-		// Continue processing the request
-		c.Next()
+// RegisterRoutes registers the routes of a Gin engine, as returned by its
+// Routes method, see Middleware.RegisterRoutes
+func (m *GinMiddleware) RegisterRoutes(routes gin.RoutesInfo) {
+	paths := make([]string, len(routes))
+	for i, route := range routes {
+		paths[i] = route.Path
 	}
+	m.middleware.RegisterRoutes(paths)
 }
 
 // CleanupExpired manually triggers cleanup of expired blocks
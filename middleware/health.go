@@ -0,0 +1,187 @@
+package middleware
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/headswim/whoen/blocker"
+	"github.com/headswim/whoen/matcher"
+	"github.com/headswim/whoen/storage"
+)
+
+// Health statuses, from best to worst
+const (
+	HealthOK       = "ok"
+	HealthSkipped  = "skipped"  // The check does not apply, e.g. the firewall with enforcement off
+	HealthDegraded = "degraded" // whoen works, but not as configured
+	HealthFailed   = "failed"
+)
+
+// healthCacheTTL is how long HealthHandler reuses a report, so frequent
+// probes do not run firewall commands on every request
+const healthCacheTTL = 30 * time.Second
+
+// HealthCheckResult is the outcome of one self-check
+type HealthCheckResult struct {
+	Name     string        `json:"name"`
+	Status   string        `json:"status"`
+	Detail   string        `json:"detail,omitempty"`
+	Duration time.Duration `json:"duration"`
+}
+
+// HealthReport is the outcome of HealthCheck. Status is the worst status of
+// its checks, skipped checks aside.
+type HealthReport struct {
+	Status string              `json:"status"`
+	Time   time.Time           `json:"time"`
+	Checks []HealthCheckResult `json:"checks"`
+}
+
+// healthCache holds the last report served by HealthHandler
+type healthCache struct {
+	mutex  sync.Mutex
+	report HealthReport
+}
+
+// HealthCheck verifies that whoen can do its job: storage is writable, the
+// firewall backend accepts a test rule (added to a dedicated chain and
+// removed again), the matcher's patterns compiled, and warm-up completed.
+func (m *Middleware) HealthCheck() HealthReport {
+	report := HealthReport{Status: HealthOK, Time: time.Now()}
+
+	for _, check := range []struct {
+		name string
+		run  func() (string, string)
+	}{
+		{"storage", m.checkStorage},
+		{"firewall", m.checkFirewall},
+		{"matcher", m.checkMatcher},
+		{"warmup", m.checkWarmup},
+	} {
+		start := time.Now()
+		status, detail := check.run()
+		report.Checks = append(report.Checks, HealthCheckResult{
+			Name:     check.name,
+			Status:   status,
+			Detail:   detail,
+			Duration: time.Since(start),
+		})
+
+		switch {
+		case status == HealthFailed:
+			report.Status = HealthFailed
+		case status == HealthDegraded && report.Status == HealthOK:
+			report.Status = HealthDegraded
+		}
+	}
+
+	return report
+}
+
+// checkStorage checks that storage is readable and its directory writable
+func (m *Middleware) checkStorage() (string, string) {
+	if _, err := m.storage.GetBlockedIPs(); err != nil {
+		return HealthFailed, fmt.Sprintf("failed to read blocked IPs: %v", err)
+	}
+
+	switch m.persistMode {
+	case "":
+		return HealthOK, "custom storage is readable"
+	case storage.PersistMemory:
+		if m.options.Config.PersistMode != storage.PersistMemory && !m.options.Config.DryRun {
+			return HealthDegraded, "storage fell back to memory only, blocks will not survive a restart"
+		}
+		return HealthOK, "memory only"
+	}
+
+	dir := filepath.Dir(m.options.Config.BlockedIPsFile)
+	if err := storage.CheckWritable(dir); err != nil {
+		return HealthFailed, fmt.Sprintf("storage directory %s is not writable: %v", dir, err)
+	}
+	return HealthOK, fmt.Sprintf("%s is writable", dir)
+}
+
+// checkFirewall adds and removes a test rule with the blocker
+func (m *Middleware) checkFirewall() (string, string) {
+	if m.options.Config.DryRun {
+		return HealthSkipped, "dry-run mode does not change the firewall"
+	}
+	// Test the blocker behind the enforcement ramp
+	target := m.blocker
+	if ramp, ok := target.(*rampBlocker); ok {
+		target = ramp.enforcing
+	}
+	if reporter, ok := target.(interface{ Options() blocker.Options }); ok && !reporter.Options().Enforce {
+		return HealthSkipped, "OS firewall enforcement is off"
+	}
+
+	tester, ok := target.(blocker.SelfTester)
+	if !ok {
+		return HealthSkipped, fmt.Sprintf("blocker %T cannot test itself", target)
+	}
+	if err := tester.SelfTest(); err != nil {
+		// Blocked IPs are still rejected by the middleware
+		return HealthDegraded, err.Error()
+	}
+	if queue, ok := target.(blocker.RetryQueue); ok {
+		if pending := queue.Pending(); len(pending) > 0 {
+			return HealthDegraded, fmt.Sprintf("test rule added and removed, but %d failed firewall changes wait for retry (last error: %v)",
+				len(pending), pending[0].Err)
+		}
+	}
+	return HealthOK, "test rule added and removed"
+}
+
+// checkMatcher checks that the matcher has patterns and stays within its budget
+func (m *Middleware) checkMatcher() (string, string) {
+	reporter, ok := m.matcher.(matcher.StatsReporter)
+	if !ok {
+		return HealthSkipped, fmt.Sprintf("matcher %T does not report its rule set", m.matcher)
+	}
+
+	stats := reporter.Stats()
+	if stats.Patterns == 0 {
+		return HealthFailed, "no patterns compiled, no request is detected"
+	}
+	if err := stats.Check(matcher.DefaultBudget); err != nil {
+		return HealthDegraded, err.Error()
+	}
+	return HealthOK, fmt.Sprintf("%d patterns compiled in %v", stats.Patterns, stats.CompileTime)
+}
+
+// checkWarmup checks that warm-up completed and the middleware was not closed
+func (m *Middleware) checkWarmup() (string, string) {
+	if !m.Ready() {
+		return HealthFailed, "not ready"
+	}
+	return HealthOK, ""
+}
+
+// HealthHandler returns an http.Handler that serves HealthCheck as JSON. It
+// responds with 200 while whoen is healthy or degraded and 503 once a check
+// failed. Reports are reused for 30 seconds, since the firewall check runs
+// commands on the host.
+func (m *Middleware) HealthHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		m.health.mutex.Lock()
+		if time.Since(m.health.report.Time) > healthCacheTTL {
+			m.health.report = m.HealthCheck()
+		}
+		report := m.health.report
+		m.health.mutex.Unlock()
+
+		status := http.StatusOK
+		if report.Status == HealthFailed {
+			status = http.StatusServiceUnavailable
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(report)
+	})
+}
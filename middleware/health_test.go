@@ -0,0 +1,85 @@
+package middleware_test
+
+import (
+	"errors"
+	"io"
+	"log"
+	"strings"
+	"testing"
+
+	"github.com/headswim/whoen/blocker"
+	"github.com/headswim/whoen/config"
+	"github.com/headswim/whoen/middleware"
+	"github.com/headswim/whoen/whoentest"
+)
+
+// queueBlocker is a blocker whose self-test passes or fails with err and
+// that reports pending firewall changes
+type queueBlocker struct {
+	*whoentest.Blocker
+	err     error
+	pending []blocker.PendingOp
+}
+
+func (b *queueBlocker) SelfTest() error              { return b.err }
+func (b *queueBlocker) Pending() []blocker.PendingOp { return b.pending }
+
+// firewallCheck returns the result of the firewall check in a health report
+func firewallCheck(t *testing.T, report middleware.HealthReport) middleware.HealthCheckResult {
+	t.Helper()
+	for _, check := range report.Checks {
+		if check.Name == "firewall" {
+			return check
+		}
+	}
+	t.Fatalf("health report without a firewall check: %+v", report)
+	return middleware.HealthCheckResult{}
+}
+
+// TestHealthFirewallRetryQueue checks that the firewall is reported as
+// degraded while failed changes wait for retry, and when its self-test fails
+func TestHealthFirewallRetryQueue(t *testing.T) {
+	cfg := whoentest.Config()
+	config.ValidateConfig(&cfg)
+	cfg.SystemType = "linux"
+
+	b := &queueBlocker{Blocker: whoentest.NewBlocker()}
+	mw, err := middleware.New(middleware.Options{
+		Config:          cfg,
+		Storage:         whoentest.NewStorage(),
+		Matcher:         whoentest.NewMatcher(),
+		Blocker:         b,
+		Logger:          log.New(io.Discard, "", 0),
+		GracePeriod:     cfg.GracePeriod,
+		TimeoutEnabled:  cfg.TimeoutEnabled,
+		TimeoutDuration: cfg.TimeoutDuration,
+		TimeoutIncrease: cfg.TimeoutIncrease,
+	})
+	if err != nil {
+		t.Fatalf("failed to create middleware: %v", err)
+	}
+	defer mw.Close()
+
+	if check := firewallCheck(t, mw.HealthCheck()); check.Status != middleware.HealthOK {
+		t.Errorf("firewall check = %+v, want ok", check)
+	}
+
+	b.pending = []blocker.PendingOp{
+		{IP: "192.0.2.1", Attempts: 3, Err: errors.New("xtables lock")},
+		{IP: "192.0.2.2", Unblock: true, Attempts: 1, Err: errors.New("xtables lock")},
+	}
+	report := mw.HealthCheck()
+	check := firewallCheck(t, report)
+	if check.Status != middleware.HealthDegraded || !strings.Contains(check.Detail, "2 failed firewall changes") ||
+		!strings.Contains(check.Detail, "xtables lock") {
+		t.Errorf("firewall check with pending changes = %+v, want degraded with the count and last error", check)
+	}
+	if report.Status != middleware.HealthDegraded {
+		t.Errorf("report status %s, want degraded", report.Status)
+	}
+
+	b.err = errors.New("iptables: Permission denied")
+	if check := firewallCheck(t, mw.HealthCheck()); check.Status != middleware.HealthDegraded || check.Detail != b.err.Error() {
+		t.Errorf("firewall check with a failing self-test = %+v, want degraded with its error", check)
+	}
+}
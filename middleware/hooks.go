@@ -0,0 +1,129 @@
+package middleware
+
+import (
+	"time"
+
+	"github.com/headswim/whoen/matcher"
+	"github.com/headswim/whoen/stats"
+)
+
+// Where a block or unblock passed to the hooks came from
+const (
+	SourceDetection = "detection" // The middleware blocked the IP for its requests
+	SourceAdmin     = "admin"     // An operator acted through Admin
+	SourceCluster   = "cluster"   // Another instance made the decision
+	SourceExpired   = "expired"   // A temporary block ran out
+	SourceEvicted   = "evicted"   // The block was lifted early to stay within Config.MaxBlockedIPs
+	SourceSubnet    = "subnet"    // Enough IPs of the subnet were blocked, see Config.SubnetEscalation
+)
+
+// Hooks are callbacks for the middleware's decisions, for custom alerting,
+// audit logging or business logic. They are called synchronously, detections
+// and blocks on the request path, and should return quickly. A hook that
+// panics is recovered and logged.
+type Hooks struct {
+	OnDetect  func(DetectInfo)
+	OnBlock   func(BlockInfo)
+	OnUnblock func(UnblockInfo)
+	OnCleanup func(CleanupInfo)
+}
+
+// DetectInfo describes a malicious request
+type DetectInfo struct {
+	IP    string
+	Path  string
+	Match matcher.Match // What the request matched, and where
+	Count int           // Malicious requests from the IP so far, this one included
+	Score int           // Severity score of the IP so far
+}
+
+// BlockInfo describes a block, or the extension of one
+type BlockInfo struct {
+	IP        string
+	Path      string        // Request that triggered the block, if any
+	Pattern   string        // Pattern that triggered the block, if any
+	Count     int           // Malicious requests from the IP, for blocks made by the middleware
+	Score     int           // Severity score of the IP, for blocks made by the middleware
+	Duration  time.Duration // Length of a temporary block, zero for permanent blocks
+	Until     time.Time     // Expiration of a temporary block, zero for permanent blocks
+	Permanent bool
+	Extended  bool   // An existing block was extended because the IP kept probing
+	Source    string // SourceDetection, SourceAdmin, SourceCluster or SourceSubnet
+	Actor     string // Operator of an admin block, or node of a cluster block
+	Reason    string // Reason given for an admin block
+}
+
+// UnblockInfo describes an unblock
+type UnblockInfo struct {
+	IP     string
+	Source string // SourceAdmin, SourceCluster, SourceExpired or SourceEvicted
+	Actor  string // Operator of an admin unblock, or node of a cluster unblock
+	Reason string // Reason given for an admin unblock
+}
+
+// CleanupInfo describes a run of CleanupExpired
+type CleanupInfo struct {
+	Expired  []string      // IPs whose temporary blocks ran out and were lifted
+	Duration time.Duration // Time the cleanup took
+	Err      error         // Error the cleanup returned, if any
+}
+
+// onDetect counts a detection for the dashboard and the admin UI, writes it
+// to the log sink and calls the OnDetect hook, if one is set
+func (m *Middleware) onDetect(info DetectInfo) {
+	now := time.Now()
+	m.timeline.Add(stats.SeriesDetections, now)
+	m.patternHits.add(info.Match.Pattern, now)
+	m.logDetect(info)
+	if hook := m.options.Hooks.OnDetect; hook != nil {
+		m.callHook("OnDetect", func() { hook(info) })
+	}
+}
+
+// onBlock records a block in the audit log, the log sink and the dashboard,
+// looks up the IP's reputation, enforces the block limit, escalates to a
+// subnet block if enough IPs of the subnet are blocked and calls the OnBlock
+// hook, if one is set
+func (m *Middleware) onBlock(info BlockInfo) {
+	m.auditBlock(info)
+	m.logBlock(info)
+	m.lookupIntel(info)
+	if !info.Extended {
+		m.timeline.Add(stats.SeriesBlocks, time.Now())
+		m.enforceBlockLimit(info.IP)
+	}
+	m.trackSubnet(info)
+	if hook := m.options.Hooks.OnBlock; hook != nil {
+		m.callHook("OnBlock", func() { hook(info) })
+	}
+}
+
+// onUnblock records an unblock in the audit log and the log sink and calls
+// the OnUnblock hook, if one is set
+func (m *Middleware) onUnblock(info UnblockInfo) {
+	m.auditUnblock(info)
+	m.logUnblock(info)
+	m.untrackSubnet(info.IP)
+	if hook := m.options.Hooks.OnUnblock; hook != nil {
+		m.callHook("OnUnblock", func() { hook(info) })
+	}
+}
+
+// onCleanup records a cleanup in the audit log and calls the OnCleanup
+// hook, if one is set
+func (m *Middleware) onCleanup(info CleanupInfo) {
+	m.auditCleanup(info)
+	if hook := m.options.Hooks.OnCleanup; hook != nil {
+		m.callHook("OnCleanup", func() { hook(info) })
+	}
+}
+
+// callHook runs a hook, recovering from a panic in it
+func (m *Middleware) callHook(name string, call func()) {
+	defer func() {
+		if r := recover(); r != nil {
+			m.logger.Printf("Error: %s hook panicked: %v", name, r)
+		}
+	}()
+	call()
+}
@@ -0,0 +1,144 @@
+package middleware
+
+import (
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"sync"
+
+	"github.com/headswim/whoen/logfile"
+	"github.com/headswim/whoen/storage"
+)
+
+// Resources middlewares in the same process must not use twice without
+// knowing: the storage files of the storages they create, the storages passed
+// in Options.Storage, OS firewall enforcement and the log files they write
+var (
+	instancesMutex sync.Mutex
+	storageFiles   = make(map[string]bool)
+	storageUsers   = make(map[storage.Storage]int)
+	firewallUsers  int
+	logFiles       = make(map[string]*sharedLogFile)
+)
+
+// sharedLogFile is a log file written by one or more middlewares
+type sharedLogFile struct {
+	writer *logfile.Writer
+	users  int
+}
+
+// claimStorageFile reserves the blocked IPs file of a storage the middleware
+// creates, failing if another middleware already writes to it
+func claimStorageFile(file string) (string, error) {
+	if abs, err := filepath.Abs(file); err == nil {
+		file = abs
+	}
+
+	instancesMutex.Lock()
+	defer instancesMutex.Unlock()
+
+	if storageFiles[file] {
+		return "", fmt.Errorf("storage file %s is already used by another middleware in this process; give each its own StorageDir, or pass one storage to both in Options.Storage to share blocks", file)
+	}
+	storageFiles[file] = true
+	return file, nil
+}
+
+// releaseStorageFile frees a file reserved by claimStorageFile
+func releaseStorageFile(file string) {
+	instancesMutex.Lock()
+	defer instancesMutex.Unlock()
+
+	delete(storageFiles, file)
+}
+
+// useStorage counts a middleware using a storage passed in Options.Storage
+func useStorage(s storage.Storage) {
+	if !reflect.TypeOf(s).Comparable() {
+		return
+	}
+
+	instancesMutex.Lock()
+	defer instancesMutex.Unlock()
+
+	storageUsers[s]++
+}
+
+// releaseStorage uncounts a middleware using a storage passed in
+// Options.Storage and reports whether it was the last one, which closes it
+func releaseStorage(s storage.Storage) bool {
+	if !reflect.TypeOf(s).Comparable() {
+		return true
+	}
+
+	instancesMutex.Lock()
+	defer instancesMutex.Unlock()
+
+	storageUsers[s]--
+	if storageUsers[s] > 0 {
+		return false
+	}
+	delete(storageUsers, s)
+	return true
+}
+
+// useFirewall counts a middleware that created a blocker enforcing blocks in
+// the OS firewall, and returns how many did before it
+func useFirewall() int {
+	instancesMutex.Lock()
+	defer instancesMutex.Unlock()
+
+	firewallUsers++
+	return firewallUsers - 1
+}
+
+// releaseFirewall uncounts a middleware counted by useFirewall
+func releaseFirewall() {
+	instancesMutex.Lock()
+	defer instancesMutex.Unlock()
+
+	firewallUsers--
+}
+
+// useLogFile opens the log file at path, or returns the writer of a
+// middleware that already writes to it so that rotation happens once. The
+// first middleware's rotation options apply.
+func useLogFile(path string, options logfile.Options) (*logfile.Writer, string, error) {
+	if abs, err := filepath.Abs(path); err == nil {
+		path = abs
+	}
+
+	instancesMutex.Lock()
+	defer instancesMutex.Unlock()
+
+	if shared, ok := logFiles[path]; ok {
+		shared.users++
+		return shared.writer, path, nil
+	}
+	writer, err := logfile.Open(path, options)
+	if err != nil {
+		return nil, "", err
+	}
+	logFiles[path] = &sharedLogFile{writer: writer, users: 1}
+	return writer, path, nil
+}
+
+// releaseLogFile uncounts a middleware writing to a log file opened by
+// useLogFile, closing the file after the last one
+func releaseLogFile(path string) error {
+	instancesMutex.Lock()
+	shared, ok := logFiles[path]
+	if !ok {
+		instancesMutex.Unlock()
+		return nil
+	}
+	shared.users--
+	if shared.users > 0 {
+		instancesMutex.Unlock()
+		return nil
+	}
+	delete(logFiles, path)
+	instancesMutex.Unlock()
+
+	return shared.writer.Close()
+}
@@ -0,0 +1,126 @@
+package middleware
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/headswim/whoen/intel"
+	"github.com/headswim/whoen/storage"
+)
+
+// Bounds of the threat intelligence lookups made for new blocks
+const (
+	maxIntelLookups = 8                // Blocks looked up at the same time, more are skipped
+	intelTimeout    = 30 * time.Second // Time the providers get for the lookups and reports of one block
+)
+
+// newIntelProviders returns Options.Intel followed by the providers
+// configured with API keys
+func (m *Middleware) newIntelProviders() []intel.Provider {
+	providers := append([]intel.Provider(nil), m.options.Intel...)
+	if key := m.options.Config.AbuseIPDBKey; key != "" {
+		providers = append(providers, intel.NewAbuseIPDB(key, nil))
+	}
+	if key := m.options.Config.GreyNoiseKey; key != "" {
+		providers = append(providers, intel.NewGreyNoise(key, nil))
+	}
+	return providers
+}
+
+// lookupIntel looks up the reputation of a newly blocked IP in the
+// background and stores it with the block. Blocks made for malicious
+// requests are reported to the providers that take reports when
+// Config.IntelReport is set.
+func (m *Middleware) lookupIntel(info BlockInfo) {
+	if len(m.intelProviders) == 0 || info.Extended || info.Source == SourceCluster {
+		return
+	}
+	// Providers look up addresses, not ranges
+	if _, ok := blockedPrefix(info.IP); ok {
+		return
+	}
+
+	select {
+	case m.intelLookups <- struct{}{}:
+	default:
+		m.logger.Printf("Skipped threat intelligence lookup of %s: %d lookups already pending", info.IP, maxIntelLookups)
+		return
+	}
+
+	go func() {
+		defer func() { <-m.intelLookups }()
+		ctx, cancel := context.WithTimeout(m.ctx, intelTimeout)
+		defer cancel()
+
+		m.storeReputation(ctx, info.IP)
+		if m.options.Config.IntelReport && info.Source == SourceDetection {
+			m.reportIntel(ctx, info)
+		}
+	}()
+}
+
+// storeReputation asks every provider about an IP and adds their answers to
+// its block record
+func (m *Middleware) storeReputation(ctx context.Context, ip string) {
+	var reputations []storage.Reputation
+	for _, provider := range m.intelProviders {
+		reputation, err := provider.Lookup(ctx, ip)
+		if err != nil {
+			m.logger.Printf("Error looking up reputation: %v", err)
+			continue
+		}
+		if reputation.Provider == "" {
+			reputation.Provider = provider.Name()
+		}
+		reputations = append(reputations, reputation)
+	}
+	if len(reputations) == 0 {
+		return
+	}
+	m.logger.Printf("Reputation of blocked IP %s: %s", ip, describeReputations(reputations))
+
+	// The block may have been lifted in the meantime
+	_, status, err := m.storage.IsIPBlocked(ip)
+	if err != nil {
+		m.logger.Printf("Error reading block of %s to store its reputation: %v", ip, err)
+		return
+	}
+	if status == nil {
+		return
+	}
+	status.Reputation = reputations
+	if err := storage.PutBlock(m.storage, *status); err != nil {
+		m.logger.Printf("Error storing reputation of %s: %v", ip, err)
+	}
+}
+
+// reportIntel reports a block to the providers that take reports
+func (m *Middleware) reportIntel(ctx context.Context, info BlockInfo) {
+	report := intel.Report{IP: info.IP, Path: info.Path, Pattern: info.Pattern, Time: time.Now()}
+	for _, provider := range m.intelProviders {
+		reporter, ok := provider.(intel.Reporter)
+		if !ok {
+			continue
+		}
+		if err := reporter.Report(ctx, report); err != nil {
+			m.logger.Printf("Error reporting blocked IP: %v", err)
+			continue
+		}
+		m.logger.Printf("Reported blocked IP %s to %s", info.IP, provider.Name())
+	}
+}
+
+// describeReputations summarizes reputations for the log
+func describeReputations(reputations []storage.Reputation) string {
+	parts := make([]string, len(reputations))
+	for i, reputation := range reputations {
+		parts[i] = fmt.Sprintf("%s %d (%s", reputation.Provider, reputation.Score, reputation.Classification)
+		if reputation.Reports > 0 {
+			parts[i] += fmt.Sprintf(", %d reports", reputation.Reports)
+		}
+		parts[i] += ")"
+	}
+	return strings.Join(parts, ", ")
+}
@@ -0,0 +1,92 @@
+package middleware
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/headswim/whoen/events"
+	"github.com/headswim/whoen/storage"
+)
+
+// enforceBlockLimit lifts the active blocks beyond Config.MaxBlockedIPs, so a
+// flood of spoofed sources cannot exhaust the firewall's rule capacity.
+// Temporary blocks that expire soonest go first and permanent bans last,
+// oldest first. The block of keep, usually the one just made, is never lifted.
+// Evicted blocks stay in storage as expired history, so an IP that comes back
+// still escalates.
+func (m *Middleware) enforceBlockLimit(keep string) {
+	limit := m.options.Config.MaxBlockedIPs
+	if limit <= 0 {
+		return
+	}
+
+	m.blockLimitMutex.Lock()
+	defer m.blockLimitMutex.Unlock()
+
+	blockedIPs, err := m.storage.GetBlockedIPs()
+	if err != nil {
+		m.logger.Printf("Error reading blocked IPs to enforce MaxBlockedIPs: %v", err)
+		return
+	}
+
+	now := time.Now()
+	active := make([]storage.BlockStatus, 0, len(blockedIPs))
+	for _, status := range blockedIPs {
+		if status.IsPermanent || now.Before(status.BlockedUntil) {
+			active = append(active, status)
+		}
+	}
+	if len(active) <= limit {
+		return
+	}
+
+	sort.Slice(active, func(i, j int) bool {
+		a, b := active[i], active[j]
+		if a.IsPermanent != b.IsPermanent {
+			return !a.IsPermanent
+		}
+		if !a.IsPermanent && !a.BlockedUntil.Equal(b.BlockedUntil) {
+			return a.BlockedUntil.Before(b.BlockedUntil)
+		}
+		return a.BlockedAt.Before(b.BlockedAt)
+	})
+
+	excess := len(active) - limit
+	evicted := 0
+	for _, status := range active {
+		if evicted == excess {
+			break
+		}
+		if status.IP == keep {
+			continue
+		}
+		if err := m.evictBlock(status, now); err != nil {
+			m.logger.Printf("Error evicting block of IP %s: %v", status.IP, err)
+			continue
+		}
+		evicted++
+	}
+
+	if evicted > 0 {
+		message := fmt.Sprintf("evicted %d blocks to stay within MaxBlockedIPs (%d)", evicted, limit)
+		m.logger.Printf("Block limit reached: %s", message)
+		m.emit(events.Event{Type: events.BlocksEvicted, Message: message})
+	}
+}
+
+// evictBlock lifts a block at the firewall and marks it expired in storage
+func (m *Middleware) evictBlock(status storage.BlockStatus, now time.Time) error {
+	if err := m.blocker.Unblock(status.IP); err != nil {
+		return err
+	}
+
+	status.IsPermanent = false
+	status.BlockedUntil = now
+	if err := storage.PutBlock(m.storage, status); err != nil {
+		return err
+	}
+
+	m.onUnblock(UnblockInfo{IP: status.IP, Source: SourceEvicted})
+	return nil
+}
@@ -0,0 +1,95 @@
+package middleware
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/headswim/whoen/events"
+)
+
+// LockdownPolicy is how much whoen tightens during a lockdown
+type LockdownPolicy struct {
+	// GracePeriod replaces the grace period and score threshold. Zero blocks
+	// an IP on its first malicious request.
+	GracePeriod int
+
+	// ChallengeAll makes every client outside the whitelist solve the
+	// challenge before it gets through, see Config.ChallengeEnabled
+	ChallengeAll bool
+}
+
+// DefaultLockdownPolicy blocks on the first malicious request and challenges everyone
+func DefaultLockdownPolicy() LockdownPolicy {
+	return LockdownPolicy{GracePeriod: 0, ChallengeAll: true}
+}
+
+// lockdown is an active lockdown
+type lockdown struct {
+	policy LockdownPolicy
+	until  time.Time
+	timer  *time.Timer
+}
+
+// Lockdown tightens the policy for all clients during an incident and reverts
+// it once duration has passed. A lockdown that is already active is replaced,
+// with a new policy and end time.
+func (m *Middleware) Lockdown(duration time.Duration, policy LockdownPolicy) error {
+	if duration <= 0 {
+		return fmt.Errorf("lockdown duration must be positive, got %v", duration)
+	}
+	if policy.GracePeriod < 0 {
+		policy.GracePeriod = 0
+	}
+
+	m.lockdownMutex.Lock()
+	defer m.lockdownMutex.Unlock()
+
+	if previous := m.lockdown.Load(); previous != nil {
+		previous.timer.Stop()
+	}
+	current := &lockdown{policy: policy, until: time.Now().Add(duration)}
+	current.timer = time.AfterFunc(duration, func() { m.endLockdown(current) })
+	m.lockdown.Store(current)
+
+	message := fmt.Sprintf("grace period %d, challenge all: %v, until %s",
+		policy.GracePeriod, policy.ChallengeAll, current.until.Format(time.RFC3339))
+	m.logger.Printf("Lockdown started: %s", message)
+	m.emit(events.Event{Type: events.LockdownStarted, Message: message})
+	return nil
+}
+
+// EndLockdown ends the active lockdown early, if there is one
+func (m *Middleware) EndLockdown() {
+	if current := m.lockdown.Load(); current != nil {
+		current.timer.Stop()
+		m.endLockdown(current)
+	}
+}
+
+// endLockdown reverts the policy if lockdown is still the active one
+func (m *Middleware) endLockdown(current *lockdown) {
+	if !m.lockdown.CompareAndSwap(current, nil) {
+		return
+	}
+
+	m.logger.Printf("Lockdown ended, normal policy restored")
+	m.emit(events.Event{Type: events.LockdownEnded})
+}
+
+// LockdownUntil returns when the active lockdown ends, and false without one
+func (m *Middleware) LockdownUntil() (time.Time, bool) {
+	current := m.lockdown.Load()
+	if current == nil || time.Now().After(current.until) {
+		return time.Time{}, false
+	}
+	return current.until, true
+}
+
+// lockdownPolicy returns the policy of the active lockdown, and false without one
+func (m *Middleware) lockdownPolicy() (LockdownPolicy, bool) {
+	current := m.lockdown.Load()
+	if current == nil || time.Now().After(current.until) {
+		return LockdownPolicy{}, false
+	}
+	return current.policy, true
+}
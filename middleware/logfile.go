@@ -0,0 +1,67 @@
+package middleware
+
+import (
+	"io"
+	"log"
+
+	"github.com/headswim/whoen/config"
+	"github.com/headswim/whoen/logfile"
+)
+
+// LogFileOptions returns the rotation options of Config.LogFile
+func LogFileOptions(cfg config.Config) logfile.Options {
+	return logfile.Options{
+		MaxSize:     int64(cfg.LogMaxSize) << 20,
+		RotateEvery: cfg.LogRotateEvery,
+		MaxBackups:  cfg.LogMaxBackups,
+		MaxAge:      cfg.LogMaxAge,
+		Compress:    cfg.LogCompress,
+	}
+}
+
+// openLogFile makes the middleware's logger write to Config.LogFile as well
+// as where it wrote before, so the storage and blocker it creates log there
+// too. The middleware keeps running on its old logger if the file cannot be
+// opened.
+func (m *Middleware) openLogFile() {
+	cfg := m.options.Config
+	if cfg.LogFile == "" {
+		return
+	}
+
+	writer, path, err := useLogFile(cfg.LogFile, LogFileOptions(cfg))
+	if err != nil {
+		m.logger.Printf("Error opening log file, logging to the console only: %v", err)
+		return
+	}
+	m.logFile = path
+
+	var out io.Writer = writer
+	if m.logger.Writer() != io.Discard {
+		out = io.MultiWriter(m.logger.Writer(), writer)
+	}
+	m.logger = log.New(out, m.logger.Prefix(), m.logger.Flags())
+	m.options.Logger = m.logger
+}
+
+// logLogFile logs where the middleware writes its log and how it is rotated
+func (m *Middleware) logLogFile() {
+	cfg := m.options.Config
+	if m.logFile == "" {
+		m.logger.Printf("  LogFile: none")
+		return
+	}
+	m.logger.Printf("  LogFile: %s (max size: %d MB, rotate every: %v, backups: %d, max age: %v, compress: %v)",
+		m.logFile, cfg.LogMaxSize, cfg.LogRotateEvery, cfg.LogMaxBackups, cfg.LogMaxAge, cfg.LogCompress)
+}
+
+// closeLogFile stops writing to Config.LogFile, closing it after the last
+// middleware writing to it
+func (m *Middleware) closeLogFile() {
+	if m.logFile == "" {
+		return
+	}
+	if err := releaseLogFile(m.logFile); err != nil {
+		m.logger.Printf("Error closing log file: %v", err)
+	}
+}
@@ -0,0 +1,48 @@
+package middleware_test
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/headswim/whoen/middleware"
+	"github.com/headswim/whoen/sshguard"
+	"github.com/headswim/whoen/whoentest"
+)
+
+// TestLogFile checks that middlewares writing to the same log file share it
+// until the last one is closed, and that the rotation settings are converted
+func TestLogFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "logs", "whoen.log")
+	cfg := whoentest.Config()
+	cfg.LogFile = path
+	cfg.LogMaxSize = 5
+	cfg.LogRotateEvery = 24 * time.Hour
+
+	options := middleware.LogFileOptions(cfg)
+	if options.MaxSize != 5<<20 || options.RotateEvery != 24*time.Hour {
+		t.Errorf("LogFileOptions = %+v, want 5 MB rotated daily", options)
+	}
+
+	first := whoentest.New(t, cfg, whoentest.NewMatcher())
+	second := whoentest.New(t, cfg, whoentest.NewMatcher())
+	first.Middleware.Close()
+
+	// The second middleware still logs to the file
+	second.Middleware.ReportSSH(sshguard.Event{Kind: sshguard.FailedLogin, IP: "192.0.2.1"})
+	second.Middleware.Close()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed to read the log file: %v", err)
+	}
+	log := string(data)
+	if n := strings.Count(log, "LogFile: "+path); n != 2 {
+		t.Errorf("log file has the settings of %d middlewares, want 2:\n%s", n, log)
+	}
+	if !strings.Contains(log, "192.0.2.1") {
+		t.Errorf("log file lacks what the second middleware logged after the first closed:\n%s", log)
+	}
+}
@@ -0,0 +1,163 @@
+package middleware
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/headswim/whoen/events"
+	"github.com/headswim/whoen/logsink"
+)
+
+// logSinkBuffer is how many records wait for a slow log sink before new
+// ones are dropped
+const logSinkBuffer = 1024
+
+// eventStreamBuffer is how many records wait for a slow subscriber of the
+// event stream before new ones are dropped
+const eventStreamBuffer = 256
+
+// newLogSink returns Options.LogSink, or the sinks Config.LogSink and
+// Config.SIEMFile select, writing in the background. It returns nil without
+// a sink.
+func (m *Middleware) newLogSink() (logsink.Sink, error) {
+	cfg := m.options.Config
+	sink := m.options.LogSink
+	if sink == nil {
+		var sinks logsink.Multi
+		format := logsink.ParseFormat(cfg.SIEMFormat)
+
+		switch cfg.LogSink {
+		case "syslog":
+			syslog, err := logsink.NewSyslog(cfg.SyslogAddress, "whoen")
+			if err != nil {
+				return nil, err
+			}
+			if format != nil {
+				syslog.SetFormat(format)
+			}
+			sinks = append(sinks, syslog)
+		case "journald":
+			journald, err := logsink.NewJournald("whoen")
+			if err != nil {
+				return nil, err
+			}
+			sinks = append(sinks, journald)
+		}
+
+		if cfg.SIEMFile != "" && format != nil {
+			file, err := logsink.NewFile(cfg.SIEMFile, format)
+			if err != nil {
+				sinks.Close()
+				return nil, err
+			}
+			sinks = append(sinks, file)
+		}
+
+		switch len(sinks) {
+		case 0:
+			return nil, nil
+		case 1:
+			sink = sinks[0]
+		default:
+			sink = sinks
+		}
+	}
+
+	return logsink.NewAsync(sink, logSinkBuffer, func(err error) {
+		m.logger.Printf("Error writing to log sink: %v", err)
+	}), nil
+}
+
+// writeLog passes a record to the event stream and the log sink, if there
+// is one. Only the log sink gets the IP and tenant of Options.Obfuscator.
+func (m *Middleware) writeLog(record logsink.Record) {
+	if record.Time.IsZero() {
+		record.Time = time.Now()
+	}
+	record.Tenant = m.options.Tenant
+	m.eventStream.Write(record)
+	if m.logSink == nil {
+		return
+	}
+	record.IP = m.exportIP(record.IP)
+	record.Tenant = m.exportTenant()
+	m.logSink.Write(record)
+}
+
+// EventStreamHandler returns an http.Handler that streams detections,
+// blocks, unblocks and the other security events as Server-Sent Events while
+// they happen, for admin UIs to show attacks live. Each event is named after
+// its type, e.g. "block", with its fields as JSON; the optional events query
+// parameter selects types, e.g. ?events=block,unblock. Mount it on an
+// internal route, the events carry client IPs and paths.
+func (m *Middleware) EventStreamHandler() http.Handler {
+	return m.eventStream
+}
+
+// logDetect writes a malicious request to the log sink
+func (m *Middleware) logDetect(info DetectInfo) {
+	m.writeLog(logsink.Record{
+		Event:    logsink.EventDetect,
+		Severity: logsink.SeverityNotice,
+		IP:       info.IP,
+		Path:     info.Path,
+		Pattern:  info.Match.Pattern,
+		Count:    info.Count,
+		Score:    info.Score,
+	})
+}
+
+// logBlock writes a block, or the extension of one, to the log sink
+func (m *Middleware) logBlock(info BlockInfo) {
+	record := logsink.Record{
+		Event:     logsink.EventBlock,
+		Severity:  logsink.SeverityWarning,
+		IP:        info.IP,
+		Path:      info.Path,
+		Pattern:   info.Pattern,
+		Count:     info.Count,
+		Score:     info.Score,
+		Until:     info.Until,
+		Permanent: info.Permanent,
+		Source:    info.Source,
+		Actor:     info.Actor,
+		Reason:    info.Reason,
+	}
+	if info.Extended {
+		record.Event = logsink.EventExtend
+	}
+	m.writeLog(record)
+}
+
+// logUnblock writes an unblock to the log sink
+func (m *Middleware) logUnblock(info UnblockInfo) {
+	m.writeLog(logsink.Record{
+		Event:    logsink.EventUnblock,
+		Severity: logsink.SeverityInfo,
+		IP:       info.IP,
+		Source:   info.Source,
+		Actor:    info.Actor,
+		Reason:   info.Reason,
+	})
+}
+
+// logEvent writes a notable event to the log sink. Detections are written
+// by logDetect, with the IP's count and score.
+func (m *Middleware) logEvent(event events.Event) {
+	if event.Type == events.RequestDetected {
+		return
+	}
+	record := logsink.Record{
+		Time:     event.Time,
+		Event:    event.Type,
+		Severity: logsink.SeverityNotice,
+		IP:       event.IP,
+		Path:     event.Path,
+		Message:  event.Message,
+	}
+	switch event.Type {
+	case events.AttackStarted, events.RulesTampered, events.FirewallUnavailable, events.StorageReadOnly, events.SubnetBlocked:
+		record.Severity = logsink.SeverityWarning
+	}
+	m.writeLog(record)
+}
@@ -0,0 +1,66 @@
+package middleware_test
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/headswim/whoen/config"
+	"github.com/headswim/whoen/middleware"
+	"github.com/headswim/whoen/whoentest"
+)
+
+// pathMatcher implements only the core Matcher interface
+type pathMatcher struct{}
+
+// IsMalicious flags paths under /wp-
+func (pathMatcher) IsMalicious(path string) bool { return strings.HasPrefix(path, "/wp-") }
+
+// IsWhitelisted whitelists nothing
+func (pathMatcher) IsWhitelisted(ip string) bool { return false }
+
+// TestMatcherWithoutOptionalInterfaces checks that a matcher implementing
+// neither Scorer nor RequestMatcher still gets IPs blocked, even with query
+// inspection configured
+func TestMatcherWithoutOptionalInterfaces(t *testing.T) {
+	cfg := whoentest.Config()
+	cfg.GracePeriod = 2
+	cfg.InspectQuery = true
+	cfg.SystemType = "linux"
+	config.ValidateConfig(&cfg)
+
+	blocker := whoentest.NewBlocker()
+	m, err := middleware.New(middleware.Options{
+		Config:          cfg,
+		Storage:         whoentest.NewStorage(),
+		Matcher:         pathMatcher{},
+		Blocker:         blocker,
+		Logger:          log.New(io.Discard, "", 0),
+		GracePeriod:     cfg.GracePeriod,
+		TimeoutEnabled:  cfg.TimeoutEnabled,
+		TimeoutDuration: cfg.TimeoutDuration,
+		TimeoutIncrease: cfg.TimeoutIncrease,
+	})
+	if err != nil {
+		t.Fatalf("failed to create middleware: %v", err)
+	}
+	defer m.Close()
+
+	blocked := false
+	for i := 0; i < 5 && !blocked; i++ {
+		r := httptest.NewRequest(http.MethodGet, "/wp-login.php?page=1", nil)
+		r.RemoteAddr = "192.0.2.9:40000"
+		if blocked, err = m.HandleRequest(r); err != nil {
+			t.Fatalf("HandleRequest failed: %v", err)
+		}
+	}
+	if !blocked {
+		t.Fatal("IP was never blocked")
+	}
+	if isBlocked, _ := blocker.IsBlocked("192.0.2.9"); !isBlocked {
+		t.Error("blocker does not enforce the block")
+	}
+}
@@ -0,0 +1,50 @@
+package middleware
+
+import (
+	"expvar"
+
+	"github.com/headswim/whoen/blocker"
+)
+
+// MemoryStats reports the size of the state whoen keeps per IP
+type MemoryStats struct {
+	BlockedIPs      int `json:"blocked_ips"`      // Block records in storage
+	RequestCounters int `json:"request_counters"` // Request counters in storage
+	BlockerEntries  int `json:"blocker_entries"`  // IPs tracked by the blocker, -1 if unknown
+}
+
+// MemoryStats returns the current size of the per-IP state in storage and the blocker
+func (m *Middleware) MemoryStats() (MemoryStats, error) {
+	stats := MemoryStats{BlockerEntries: -1}
+
+	blockedIPs, err := m.storage.GetBlockedIPs()
+	if err != nil {
+		return stats, err
+	}
+	stats.BlockedIPs = len(blockedIPs)
+
+	requestCounts, err := m.storage.GetAllRequestCounts()
+	if err != nil {
+		return stats, err
+	}
+	stats.RequestCounters = len(requestCounts)
+
+	if sizer, ok := m.blocker.(blocker.Sizer); ok {
+		stats.BlockerEntries = sizer.Len()
+	}
+
+	return stats, nil
+}
+
+// PublishExpvar publishes MemoryStats as an expvar variable, so it shows up at
+// /debug/vars next to the runtime memory statistics when expvar is served.
+// Like expvar.Publish it panics if the name is already in use.
+func (m *Middleware) PublishExpvar(name string) {
+	expvar.Publish(name, expvar.Func(func() any {
+		stats, err := m.MemoryStats()
+		if err != nil {
+			m.logger.Printf("Error collecting memory stats: %v", err)
+		}
+		return stats
+	}))
+}
@@ -0,0 +1,70 @@
+package middleware
+
+import (
+	"context"
+	"time"
+)
+
+// DecisionMetrics breaks down the time HandleRequest spent on a request
+type DecisionMetrics struct {
+	IP       string `json:"ip,omitempty"`
+	Path     string `json:"path"`
+	Blocked  bool   `json:"blocked"`
+	Deferred bool   `json:"deferred"` // Storage and enforcement ran in the background
+	Err      error  `json:"-"`
+
+	Total        time.Duration `json:"total"`
+	IPExtraction time.Duration `json:"ip_extraction"`
+	Match        time.Duration `json:"match"`   // Whitelist and pattern matching
+	Storage      time.Duration `json:"storage"` // Reading and updating counters and blocks
+	Enforce      time.Duration `json:"enforce"` // Checking and changing firewall blocks
+}
+
+// RequestEvaluatedFunc receives the metrics of every request HandleRequest evaluates
+type RequestEvaluatedFunc func(ctx context.Context, metrics DecisionMetrics)
+
+// phase identifies a part of the request evaluation
+type phase int
+
+const (
+	phaseIPExtraction phase = iota
+	phaseMatch
+	phaseStorage
+	phaseEnforce
+)
+
+// start returns the time a phase starts, or the zero time on nil metrics so
+// requests without an OnRequestEvaluated callback don't read the clock
+func (d *DecisionMetrics) start() time.Time {
+	if d == nil {
+		return time.Time{}
+	}
+	return time.Now()
+}
+
+// observe adds the time since start to a phase. It does nothing on nil
+// metrics, so the timings cost nothing without an OnRequestEvaluated callback.
+func (d *DecisionMetrics) observe(p phase, start time.Time) {
+	if d == nil {
+		return
+	}
+
+	elapsed := time.Since(start)
+	switch p {
+	case phaseIPExtraction:
+		d.IPExtraction += elapsed
+	case phaseMatch:
+		d.Match += elapsed
+	case phaseStorage:
+		d.Storage += elapsed
+	case phaseEnforce:
+		d.Enforce += elapsed
+	}
+}
+
+// deferred marks that storage and enforcement were moved off the request path
+func (d *DecisionMetrics) deferred() {
+	if d != nil {
+		d.Deferred = true
+	}
+}
@@ -1,17 +1,35 @@
 package middleware
 
 import (
+	"context"
 	"fmt"
+	"html/template"
 	"log"
+	"math"
 	"net"
 	"net/http"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/headswim/whoen/audit"
 	"github.com/headswim/whoen/blocker"
+	"github.com/headswim/whoen/bots"
+	"github.com/headswim/whoen/cluster"
 	"github.com/headswim/whoen/config"
+	"github.com/headswim/whoen/dryrun"
+	"github.com/headswim/whoen/edge"
+	"github.com/headswim/whoen/events"
+	"github.com/headswim/whoen/feeds"
+	"github.com/headswim/whoen/intel"
+	"github.com/headswim/whoen/ipaddr"
+	"github.com/headswim/whoen/logsink"
 	"github.com/headswim/whoen/matcher"
+	"github.com/headswim/whoen/obfuscate"
+	"github.com/headswim/whoen/stats"
 	"github.com/headswim/whoen/storage"
 )
 
@@ -21,13 +39,82 @@ type Options struct {
 	Storage         storage.Storage
 	Matcher         matcher.Matcher
 	Blocker         blocker.Blocker
-	Logger          *log.Logger
+	Logger          *log.Logger // Passed on to the storage and blocker whoen creates, standard output if nil
 	GracePeriod     int
 	TimeoutEnabled  bool
 	TimeoutDuration time.Duration
 	TimeoutIncrease string // "linear" or "geometric"
 	CleanupEnabled  bool
 	CleanupInterval time.Duration
+	AuditLogger     audit.Logger      // Records operator actions and block decisions, defaults to Config.AuditLogFile
+	Cluster         cluster.Transport // Shares block decisions with other instances, nil to disable
+	OnEvent         events.Handler    // Receives notable events such as a read-only storage fallback
+	Edge            edge.Provider     // Mirrors the blocklist to a CDN or edge firewall, nil to disable
+	DryRunRecorder  dryrun.Recorder   // Receives dry-run records, defaults to Config.DryRunFile
+	LogSink         logsink.Sink      // Receives detections, blocks and events, defaults to Config.LogSink and Config.SIEMFile
+
+	// BlockResponse sets the status code and extra headers of blocked
+	// responses, a 403 with Retry-After for temporary blocks by default
+	BlockResponse BlockResponse
+
+	// ChallengeVerifier checks challenge solutions instead of the built-in
+	// proof of work, e.g. a CAPTCHA embedded in Config.ChallengeTemplate
+	ChallengeVerifier ChallengeVerifier
+
+	// AppealSender delivers appeal links out of band, e.g. by email, when
+	// Config.AppealEnabled is set; without it clients must solve a challenge
+	// and appeals lift blocks without whitelisting
+	AppealSender AppealSender
+
+	// SkipPaths lists path prefixes the middleware lets through untouched, such
+	// as health checks or internal APIs. SkipFunc, if set, is consulted as well
+	// and skips every request it returns true for.
+	SkipPaths []string
+	SkipFunc  func(r *http.Request) bool
+
+	// ExemptFunc exempts the requests it returns true for from counting and
+	// blocking, e.g. those of authenticated admins with a valid session
+	// cookie, API key or client certificate who legitimately open /admin or
+	// /metrics. Exempt requests reach the application even from a blocked
+	// IP, without touching the IP's count, score or block. Unlike SkipFunc
+	// it is applied by HandleRequest itself, after the whitelist.
+	ExemptFunc func(r *http.Request) bool
+
+	// OnRequestEvaluated receives a timing breakdown of every request
+	// HandleRequest evaluates, for recording whoen's overhead in an APM
+	OnRequestEvaluated RequestEvaluatedFunc
+
+	// Hooks are called on detections, blocks, unblocks and cleanups
+	Hooks Hooks
+
+	// ASNLookup looks up the autonomous system of an IP, e.g. "AS13335", for
+	// AttackReport and Config.BlockASNs and Config.ExemptASNs. It defaults
+	// to the table in Config.ASNDatabase; the report has no ASN list without
+	// either.
+	ASNLookup func(ip string) string
+
+	// Bots are crawlers verified next to bots.Known when
+	// Config.ExemptVerifiedBots is set
+	Bots []bots.Bot
+
+	// Detectors score requests with custom logic next to the matcher, see
+	// Detector. More can be added later with AddDetector.
+	Detectors []Detector
+
+	// Intel looks up the reputation of blocked IPs, in addition to the
+	// providers configured with Config.AbuseIPDBKey and Config.GreyNoiseKey
+	Intel []intel.Provider
+
+	// Feeds are external blocklists the middleware subscribes to with their
+	// own TTL, in addition to those named in Config.Feeds
+	Feeds []*feeds.Feed
+
+	// Obfuscator replaces IPs and the tenant in the data the middleware
+	// exports: OnEvent events, log sink records and attack reports. Tenant
+	// names the middleware's tenant there; PolicyRouter.AddPolicy sets it.
+	// Hooks, the event stream and the admin API and UI keep raw IPs.
+	Obfuscator obfuscate.Obfuscator
+	Tenant     string
 }
 
 // DefaultOptions returns the default options
@@ -52,13 +139,127 @@ type Middleware struct {
 	matcher matcher.Matcher
 	blocker blocker.Blocker
 	logger  *log.Logger
+	decoys  map[string]config.Decoy
+
+	auditLogger    audit.Logger
+	logSink        logsink.Sink       // Security events with structured fields, nil without a sink
+	eventStream    *logsink.Stream    // Security events for EventStreamHandler subscribers
+	dryRunRecorder dryrun.Recorder    // Set in dry-run mode and while a ramp is configured
+	ramp           *ramp              // Enforcement ramp, nil for full enforcement
+	challenges     *challenges        // IPs challenged before being blocked, nil when disabled
+	appeals        *appeals           // Appeal links and cooldowns, nil when disabled
+	blockRate      *blockRate         // Blocks made over the attack window, nil without an attack threshold
+	timeline       *stats.Timeline    // Detections and blocks per minute for Dashboard
+	patternHits    *patternHits       // Detections per pattern for the admin UI
+	blockPage      *template.Template // HTML page for blocked browsers
+	adminAPI       *adminAPI          // Nonces and idempotency results of the admin API
+	nodeID         string
+	persistMode    string // Effective persist mode of the JSON storage, empty for custom storage
+	storageFile    string // Storage file reserved for the JSON storage, see claimStorageFile
+	sharedStorage  bool   // The storage came from Options.Storage, closed by its last user
+	logFile        string // Absolute path of Config.LogFile while the middleware writes to it, see useLogFile
+	firewall       bool   // The middleware created a blocker enforcing blocks in the OS firewall
+
+	// ctx is cancelled by Close to stop background goroutines
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// ready is set once warm-up completes and cleared by Close
+	ready atomic.Bool
+
+	// closed is set by the first Close, later calls do nothing
+	closed atomic.Bool
+
+	// Contents of the patterns and whitelist files as last loaded
+	filePatterns  []string
+	fileWhitelist []string
+	fileMutex     sync.Mutex
+
+	// deferred bounds the work moved off the request path by deferWork
+	deferred chan struct{}
+
+	// lockdown is the active lockdown, nil without one. lockdownMutex
+	// serializes starting lockdowns.
+	lockdown      atomic.Pointer[lockdown]
+	lockdownMutex sync.Mutex
+
+	// lifted holds the expired blocks CleanupExpired has lifted, by IP and
+	// the end of the block, so records storage keeps past their end are
+	// lifted and reported once. liftedMutex serializes cleanups.
+	lifted      map[string]time.Time
+	liftedMutex sync.Mutex
+
+	// policyWindows are the valid Config.PolicyWindows
+	policyWindows []config.PolicyWindow
+
+	// detectors are Options.Detectors and those added by AddDetector,
+	// replaced as a whole so requests read them without locking.
+	// detectorsMutex serializes AddDetector.
+	detectors      atomic.Pointer[[]Detector]
+	detectorsMutex sync.Mutex
+
+	// intelProviders look up blocked IPs, at most maxIntelLookups at a time
+	intelProviders []intel.Provider
+	intelLookups   chan struct{}
+
+	// feeds are the external blocklists refreshed by watchFeeds
+	feeds []*feeds.Feed
+
+	// asnPolicy holds Config.BlockASNs and Config.ExemptASNs, nil without any
+	asnPolicy *asnPolicy
+
+	// botVerifier verifies crawlers for Config.ExemptVerifiedBots, nil
+	// without it
+	botVerifier *bots.Verifier
+
+	// blockLimitMutex serializes enforceBlockLimit
+	blockLimitMutex sync.Mutex
+
+	// subnets tracks blocks per subnet and the subnet blocks in force
+	subnets *subnets
+
+	// requestRules counts requests for Config.RequestRules, nil without any
+	requestRules *requestRules
+
+	// routes are the application's routes, see RegisterRoutes
+	routes routes
+
+	// redemption counts legitimate requests for Config.RedemptionRequests
+	redemption redemption
+
+	// health is the last report served by HealthHandler
+	health healthCache
+
+	// reviewed holds the permanent bans already surfaced for review
+	reviewed      map[string]bool
+	reviewedMutex sync.Mutex
 }
 
 // New creates a new middleware
 func New(options Options) (*Middleware, error) {
+	if options.Logger == nil {
+		options.Logger = DefaultOptions().Logger
+	}
 	m := &Middleware{
-		options: options,
-		logger:  options.Logger,
+		options:  options,
+		logger:   options.Logger,
+		decoys:   newDecoys(options.Config),
+		nodeID:   options.Config.NodeID,
+		deferred: make(chan struct{}, maxDeferred),
+
+		intelLookups: make(chan struct{}, maxIntelLookups),
+		subnets:      newSubnets(),
+		timeline:     stats.NewTimeline(),
+		patternHits:  newPatternHits(),
+		eventStream:  logsink.NewStream(eventStreamBuffer),
+	}
+	m.ctx, m.cancel = context.WithCancel(context.Background())
+	m.openLogFile()
+	detectors := append([]Detector(nil), options.Detectors...)
+	m.detectors.Store(&detectors)
+
+	if m.nodeID == "" {
+		m.nodeID = cluster.DefaultNodeID()
 	}
 
 	// Log the configuration being used
@@ -69,22 +270,164 @@ func New(options Options) (*Middleware, error) {
 	m.logger.Printf("  TimeoutIncrease: %s", options.TimeoutIncrease)
 	m.logger.Printf("  StorageDir: %s", options.Config.StorageDir)
 	m.logger.Printf("  BlockedIPsFile: %s", options.Config.BlockedIPsFile)
-	m.logger.Printf("  LogFile: %s", options.Config.LogFile)
+	m.logLogFile()
+	m.logger.Printf("  AuditLogFile: %s", options.Config.AuditLogFile)
+	m.logger.Printf("  WhitelistFile: %s", options.Config.WhitelistFile)
+	m.logger.Printf("  WhitelistPrivateNetworks: %v", options.Config.WhitelistPrivateNetworks)
+	m.logger.Printf("  PatternsFile: %s", options.Config.PatternsFile)
+	m.logger.Printf("  Patterns: %d of its own, Whitelist: %d of its own", len(options.Config.Patterns), len(options.Config.Whitelist))
+	m.logger.Printf("  AllowPatterns: %v", options.Config.AllowPatterns)
+	m.logger.Printf("  RouteWeights: %d%% on known routes, %d%% on unknown paths", options.Config.KnownRouteWeight, options.Config.UnknownRouteWeight)
+	m.logger.Printf("  HotReload: %v", options.Config.HotReload)
+	m.logger.Printf("  MaxTrackedIPs: %d", options.Config.MaxTrackedIPs)
+	m.logger.Printf("  MaxBlockedIPs: %d", options.Config.MaxBlockedIPs)
+	if options.Config.SubnetEscalation {
+		m.logger.Printf("  SubnetThreshold: %d within %v (/%d for IPv4, /%d for IPv6)", options.Config.SubnetThreshold,
+			options.Config.SubnetWindow, options.Config.SubnetPrefixIPv4, options.Config.SubnetPrefixIPv6)
+	}
 	m.logger.Printf("  SystemType: %s", options.Config.SystemType)
 	m.logger.Printf("  CleanupEnabled: %v", options.CleanupEnabled)
 	m.logger.Printf("  CleanupInterval: %v", options.CleanupInterval)
+	m.logger.Printf("  ScoreThreshold: %d", options.Config.ScoreThreshold)
+	m.logger.Printf("  BlockExtension: %v", options.Config.BlockExtension)
+	m.logger.Printf("  MaxTimeouts: %d", options.Config.MaxTimeouts)
+	m.logger.Printf("  MaxTimeoutDuration: %v", options.Config.MaxTimeoutDuration)
+	m.logger.Printf("  Probation: %v, grace period %d, timeouts x%d", options.Config.ProbationPeriod,
+		options.Config.ProbationGracePeriod, options.Config.ProbationMultiplier)
+	m.logger.Printf("  Redemption: every %d legitimate requests, every %v quiet", options.Config.RedemptionRequests, options.Config.RedemptionQuiet)
+	m.logger.Printf("  BlockResponse: status %d, %d extra headers", options.BlockResponse.status(), len(options.BlockResponse.Headers))
+	m.logger.Printf("  DeceiveEnabled: %v", options.Config.DeceiveEnabled)
+	m.logger.Printf("  InspectQuery: %v (body limit: %d bytes)", options.Config.InspectQuery, options.Config.InspectBodyLimit)
+	m.logger.Printf("  AttackThreshold: %d blocks in %v", options.Config.AttackThreshold, options.Config.AttackWindow)
+	m.logger.Printf("  ChallengeEnabled: %v (duration: %v, difficulty: %d)", options.Config.ChallengeEnabled,
+		options.Config.ChallengeDuration, options.Config.ChallengeDifficulty)
+	m.logger.Printf("  AppealEnabled: %v (whitelist: %v, cooldown: %v, links sent: %v)", options.Config.AppealEnabled,
+		options.Config.AppealWhitelist, options.Config.AppealCooldown, options.AppealSender != nil)
+	m.logger.Printf("  AdminUI: %v (basic auth: %v, token: %v)", options.Config.AdminUIPassword != "" || options.Config.AdminUIToken != "",
+		options.Config.AdminUIPassword != "", options.Config.AdminUIToken != "")
+	m.logger.Printf("  AdminAPI: %v (max skew: %v, idempotency keys kept: %v)", options.Config.AdminSecret != "",
+		options.Config.AdminMaxSkew, options.Config.IdempotencyKeyTTL)
+	m.logger.Printf("  HistoryRetention: %v (%s)", options.Config.HistoryRetention, options.Config.HistoryPolicy)
+	m.logger.Printf("  PermanentBanReviewAge: %v", options.Config.PermanentBanReviewAge)
+	m.logger.Printf("  DeferBudget: %v", options.Config.DeferBudget)
+	m.logger.Printf("  RuleCheckInterval: %v", options.Config.RuleCheckInterval)
+	m.logger.Printf("  FirewallRetries: %d (backoff: %v)", options.Config.FirewallRetries, options.Config.FirewallRetryBackoff)
+	m.logger.Printf("  SSHAuthLog: %q (weight: %d)", options.Config.SSHAuthLog, options.Config.SSHWeight)
+	m.logger.Printf("  LogSink: %q (syslog address: %q)", options.Config.LogSink, options.Config.SyslogAddress)
+	m.logger.Printf("  SIEMFormat: %q (file: %q)", options.Config.SIEMFormat, options.Config.SIEMFile)
+	m.logger.Printf("  PersistMode: %s (interval: %v, flush: %v, sync on block: %v)", options.Config.PersistMode,
+		options.Config.PersistInterval, options.Config.FlushInterval, options.Config.SyncOnBlock)
+	m.logger.Printf("  DryRun: %v", options.Config.DryRun)
+	m.logger.Printf("  Ramp: %d stages", len(options.Config.Ramp))
+	m.logger.Printf("  PolicyWindows: %d", len(options.Config.PolicyWindows))
+	m.logger.Printf("  Detectors: %d", len(options.Detectors))
+	m.logger.Printf("  ASNs: %d blocked, %d exempt (database: %q)", len(options.Config.BlockASNs),
+		len(options.Config.ExemptASNs), options.Config.ASNDatabase)
+	m.logger.Printf("  ExemptVerifiedBots: %v (cache: %v)", options.Config.ExemptVerifiedBots, options.Config.VerifiedBotCacheTTL)
+
+	m.asnPolicy = m.newASNPolicy()
+	m.botVerifier = m.newBotVerifier()
+	m.challenges = m.newChallenges()
+	m.appeals = m.newAppeals()
+	m.blockPage = m.loadBlockPage()
+	m.adminAPI = newAdminAPI()
+
+	// In dry-run mode decisions are made against a copy of the state that
+	// lives in memory, and nothing leaves the process
+	if options.Config.DryRun {
+		m.logger.Printf("Dry-run mode: requests are not rejected and the firewall is not changed; would-be blocks are recorded in %s",
+			options.Config.DryRunFile)
+		if options.Cluster != nil || options.Edge != nil {
+			m.logger.Printf("Dry-run mode: cluster and edge sync are disabled")
+		}
+		if len(options.Intel) > 0 || options.Config.AbuseIPDBKey != "" || options.Config.GreyNoiseKey != "" {
+			m.logger.Printf("Dry-run mode: threat intelligence lookups are disabled")
+		}
+		m.options.Cluster = nil
+		m.options.Edge = nil
+		m.options.Intel = nil
+		m.options.Config.AbuseIPDBKey = ""
+		m.options.Config.GreyNoiseKey = ""
+		m.decoys = nil
+	}
+
+	// Record would-be blocks of IPs in log-only mode
+	if options.Config.DryRun || len(options.Config.Ramp) > 0 {
+		if options.DryRunRecorder != nil {
+			m.dryRunRecorder = options.DryRunRecorder
+		} else {
+			m.dryRunRecorder = dryrun.NewFileRecorder(options.Config.DryRunFile)
+		}
+	}
 
 	// Initialize storage if not provided
 	if options.Storage == nil {
-		storage, err := storage.NewJSONStorage(
-			options.Config.BlockedIPsFile,
-		)
+		jsonOptions := m.jsonOptions()
+
+		// Fall back to memory-only persistence on read-only file systems
+		// instead of failing every save
+		dir := filepath.Dir(options.Config.BlockedIPsFile)
+		if options.Config.DryRun {
+			jsonOptions.PersistMode = storage.PersistMemory
+		} else if jsonOptions.PersistMode != storage.PersistMemory {
+			if err := storage.CheckWritable(dir); err != nil && storage.IsReadOnly(err) {
+				message := fmt.Sprintf("storage location %s is not writable (%v), keeping state in memory only; blocks will not survive a restart", dir, err)
+				m.logger.Printf("Warning: %s", message)
+				m.emit(events.Event{Type: events.StorageReadOnly, Message: message})
+				jsonOptions.PersistMode = storage.PersistMemory
+			}
+		}
+
+		// Two middlewares writing the same files would overwrite each other's blocks
+		if jsonOptions.PersistMode != storage.PersistMemory {
+			file, err := claimStorageFile(options.Config.BlockedIPsFile)
+			if err != nil {
+				m.closeLogFile()
+				return nil, err
+			}
+			m.storageFile = file
+		}
+
+		storage, err := storage.NewJSONStorageWithOptions(options.Config.BlockedIPsFile, jsonOptions)
 		if err != nil {
+			if m.storageFile != "" {
+				releaseStorageFile(m.storageFile)
+			}
+			m.closeLogFile()
 			return nil, err
 		}
 		m.storage = storage
+		m.persistMode = jsonOptions.PersistMode
 	} else {
+		// Storage passed to several middlewares is shared, and closed with the last of them
 		m.storage = options.Storage
+		m.sharedStorage = true
+		useStorage(m.storage)
+	}
+
+	// Without PutBlock a block is written with BlockIP, which keeps only its
+	// expiry and path; probation and subnet escalation need the rest
+	if _, ok := m.storage.(storage.BlockPutter); !ok {
+		m.logger.Printf("Warning: the storage cannot write whole block records, so probation and subnet escalation are off, " +
+			"block sources, reasons and operators are not stored and appeal cooldowns last until restart")
+		m.options.Config.ProbationPeriod = 0
+		m.options.Config.SubnetEscalation = false
+	}
+
+	// Initialize audit logger if not provided
+	if options.AuditLogger != nil {
+		m.auditLogger = options.AuditLogger
+	} else if options.Config.AuditLogFile != "" {
+		m.auditLogger = audit.NewFileLogger(options.Config.AuditLogFile)
+	} else {
+		m.auditLogger = audit.Discard{}
+	}
+
+	// Write security events to syslog or journald
+	if sink, err := m.newLogSink(); err != nil {
+		m.logger.Printf("Error opening log sink: %v", err)
+	} else {
+		m.logSink = sink
 	}
 
 	// Initialize matcher if not provided
@@ -95,23 +438,147 @@ func New(options Options) (*Middleware, error) {
 		m.matcher = options.Matcher
 	}
 
-	// Initialize blocker if not provided
-	if options.Blocker == nil {
-		m.blocker = blocker.NewServiceWithSystemType(options.Config.SystemType)
+	// Give the instance its own patterns and whitelist instead of the
+	// package-level ones
+	if len(options.Config.Patterns) > 0 {
+		if manager, ok := m.matcher.(matcher.PatternManager); ok {
+			manager.ReplacePatterns(options.Config.Patterns)
+		} else {
+			m.logger.Printf("Warning: the matcher cannot replace its patterns, Patterns is ignored")
+		}
+	}
+	if len(options.Config.Whitelist) > 0 {
+		if replacer, ok := m.matcher.(interface{ ReplaceWhitelist(ips []string) }); ok {
+			replacer.ReplaceWhitelist(options.Config.Whitelist)
+		} else {
+			m.logger.Printf("Warning: the matcher cannot replace its whitelist, Whitelist is ignored")
+		}
+	}
+
+	// Never block the host's own infrastructure
+	if options.Config.WhitelistPrivateNetworks {
+		if manager, ok := m.matcher.(matcher.WhitelistManager); ok {
+			manager.AddWhitelist(matcher.PrivateNetworks...)
+		} else {
+			m.logger.Printf("Warning: the matcher cannot change its whitelist, WhitelistPrivateNetworks is ignored")
+		}
+	}
+
+	// Inspect query parameters and bodies only with a matcher that can
+	if options.Config.InspectQuery || options.Config.InspectBodyLimit > 0 {
+		if _, ok := m.matcher.(matcher.RequestMatcher); !ok {
+			m.logger.Printf("Warning: the matcher cannot inspect requests, only paths are checked")
+		}
+	}
+
+	// Inspect the start of request bodies when configured
+	if options.Config.InspectBodyLimit > 0 {
+		if inspector, ok := m.matcher.(matcher.BodyInspector); ok {
+			inspector.SetBodyLimit(options.Config.InspectBodyLimit)
+		} else {
+			m.logger.Printf("Warning: the matcher cannot inspect request bodies, only paths and query parameters are checked")
+		}
+	}
+
+	// Exempt the paths the application serves from the patterns
+	if len(options.Config.AllowPatterns) > 0 {
+		if manager, ok := m.matcher.(matcher.AllowManager); ok {
+			manager.SetAllowPatterns(options.Config.AllowPatterns)
+		} else {
+			m.logger.Printf("Warning: the matcher does not support allow patterns, AllowPatterns is ignored")
+		}
+	}
+
+	// Add the patterns and the IPs whitelisted at runtime from their files
+	if err := m.loadPatternsFile(); err != nil {
+		m.logger.Printf("Error loading patterns: %v", err)
+	}
+	if err := m.loadWhitelistFile(); err != nil {
+		m.logger.Printf("Error loading whitelist: %v", err)
+	}
+	if options.Config.HotReload {
+		if err := m.watchFiles(); err != nil {
+			m.logger.Printf("Error starting hot reload: %v", err)
+		}
+	}
+
+	// Report the cost of the rule set and check it against the budget
+	if reporter, ok := m.matcher.(matcher.StatsReporter); ok {
+		stats := reporter.Stats()
+		m.logger.Printf("Matcher rule set: %d patterns (%d duplicates dropped), ~%d bytes, compiled in %v",
+			stats.Patterns, stats.Duplicates, stats.MemoryBytes, stats.CompileTime)
+		if err := stats.Check(matcher.DefaultBudget); err != nil {
+			m.logger.Printf("Warning: matcher rule set exceeds budget: %v", err)
+		}
+	}
+
+	// Warn about duplicate, shadowed and conflicting patterns
+	if linter, ok := m.matcher.(matcher.Linter); ok {
+		for _, warning := range linter.Lint() {
+			m.logger.Printf("Warning: %s", warning)
+		}
+	}
+
+	// Initialize blocker if not provided. Dry-run mode always tracks blocks
+	// in memory only.
+	blockerOptions := BlockerOptions(options.Config)
+	blockerOptions.Logger = m.logger
+	if options.Config.DryRun {
+		m.blocker = blocker.NewServiceWithOptions(options.Config.SystemType, blocker.Options{Logger: m.logger})
+	} else if options.Blocker == nil {
+		m.blocker = blocker.NewServiceWithOptions(options.Config.SystemType, blockerOptions)
+
+		// Each middleware syncs the firewall with its own storage, lifting
+		// the rules of blocks it does not know about
+		if blockerOptions.Enforce {
+			m.firewall = true
+			if others := useFirewall(); others > 0 {
+				m.logger.Printf("Warning: %d other middlewares in this process also manage the OS firewall, and each removes the rules of blocks missing from its storage; share one storage and blocker through Options.Storage and Options.Blocker, or set EnforceFirewall to false on all but one", others)
+			}
+		}
 	} else {
 		m.blocker = options.Blocker
 	}
+	m.logCapabilities()
+
+	// Route blocks through the ramp so only IPs in os-block mode reach the firewall
+	if !options.Config.DryRun && len(options.Config.Ramp) > 0 {
+		start := options.Config.RampStart
+		if start.IsZero() {
+			start = time.Now()
+		}
+		m.ramp = newRamp(options.Config.Ramp, start)
+		m.blocker = &rampBlocker{
+			enforcing: m.blocker,
+			memory:    blocker.NewServiceWithOptions(options.Config.SystemType, blocker.Options{Logger: m.logger}),
+			mode:      m.mode,
+		}
+
+		m.logger.Printf("Enforcement ramp starting %s:", start.Format(time.RFC3339))
+		for i, stage := range options.Config.Ramp {
+			m.logger.Printf("  Stage %d after %v: %s for %d%% of IPs", i+1, stage.After, stage.Mode, stage.Percent)
+		}
+		m.reportRampStage(m.ramp.current(time.Now()))
+	}
+
+	// Load storage, compile patterns and restore blocks before reporting ready
+	if err := m.warmup(); err != nil {
+		m.logger.Printf("Error during warm-up: %v", err)
+	}
 
 	// Start periodic cleanup if enabled
 	if options.CleanupEnabled {
 		cleanupTicker := time.NewTicker(options.CleanupInterval)
 		go func() {
+			defer cleanupTicker.Stop()
 			for {
 				select {
 				case <-cleanupTicker.C:
 					if err := m.CleanupExpired(); err != nil {
 						m.logger.Printf("Error cleaning up expired blocks: %v", err)
 					}
+				case <-m.ctx.Done():
+					return
 				}
 			}
 		}()
@@ -120,44 +587,340 @@ func New(options Options) (*Middleware, error) {
 		m.logger.Printf("Periodic cleanup disabled. To enable, set CleanupEnabled to true in the configuration.")
 	}
 
+	// Mirror the blocklist to the edge
+	if m.options.Edge != nil {
+		go m.syncEdgeLoop()
+		m.logger.Printf("Edge sync enabled every %v (full reconciliation every %v)",
+			options.Config.EdgeSyncInterval, options.Config.EdgeFullSyncInterval)
+	}
+
+	// Look up the reputation of blocked IPs
+	if m.intelProviders = m.newIntelProviders(); len(m.intelProviders) > 0 {
+		names := make([]string, len(m.intelProviders))
+		for i, provider := range m.intelProviders {
+			names[i] = provider.Name()
+		}
+		m.logger.Printf("Threat intelligence enabled: %s (reporting: %v)", strings.Join(names, ", "), options.Config.IntelReport)
+	}
+
+	// Subscribe to external blocklists
+	if m.feeds = m.newFeeds(); len(m.feeds) > 0 {
+		names := make([]string, len(m.feeds))
+		for i, feed := range m.feeds {
+			names[i] = feed.Name
+		}
+		go m.watchFeeds()
+		m.logger.Printf("Feeds enabled, refreshed every %v: %s", options.Config.FeedRefreshInterval, strings.Join(names, ", "))
+	}
+
+	// Verify crawlers, downloading the ranges some of them publish
+	if m.botVerifier != nil {
+		names := make([]string, len(m.botVerifier.Bots))
+		published := false
+		for i, bot := range m.botVerifier.Bots {
+			names[i] = bot.Name
+			published = published || bot.RangesURL != ""
+		}
+		if published {
+			go m.watchBotRanges()
+		}
+		m.logger.Printf("Verified crawlers are exempt from blocking: %s", strings.Join(names, ", "))
+	}
+
+	// Apply block decisions from other instances
+	if m.options.Cluster != nil {
+		go m.subscribeCluster()
+		m.logger.Printf("Cluster sync enabled as node %s", m.nodeID)
+	}
+
+	// Verify that the firewall rules are not removed behind whoen's back
+	if options.Config.RuleCheckInterval > 0 && !options.Config.DryRun {
+		if _, ok := m.ruleVerifier(); ok {
+			go m.watchRules()
+			m.logger.Printf("Firewall rule check enabled every %v", options.Config.RuleCheckInterval)
+		}
+	}
+
+	// Vary enforcement by time
+	if m.policyWindows = m.newPolicyWindows(); len(m.policyWindows) > 0 {
+		m.logger.Printf("Policy windows:")
+		for i := range m.policyWindows {
+			m.logger.Printf("  %s", describePolicyWindow(&m.policyWindows[i]))
+		}
+		go m.watchPolicyWindows()
+	}
+
+	// Count repeated requests by method, path and response status
+	if m.requestRules = m.newRequestRules(); m.requestRules != nil {
+		m.logger.Printf("Request rules:")
+		for _, rule := range m.requestRules.rules {
+			m.logger.Printf("  %s: more than %d within %v", rule.Name, rule.Threshold, rule.Window)
+		}
+	}
+
+	// Watch the block rate for attacks
+	if options.Config.AttackThreshold > 0 {
+		m.blockRate = newBlockRate(options.Config.AttackWindow)
+		go m.watchAttack()
+	}
+
+	// Count failed SSH logins from sshd's log
+	if options.Config.SSHAuthLog != "" {
+		go m.watchSSHLog()
+		m.logger.Printf("SSH protection enabled, following %s", options.Config.SSHAuthLog)
+	}
+
 	return m, nil
 }
 
+// Close stops the middleware's background goroutines and closes its storage.
+// A storage passed in Options.Storage to several middlewares is closed by
+// the last of them.
+func (m *Middleware) Close() error {
+	if !m.closed.CompareAndSwap(false, true) {
+		return nil
+	}
+	m.ready.Store(false)
+	m.cancel()
+	if m.logSink != nil {
+		if err := m.logSink.Close(); err != nil {
+			m.logger.Printf("Error closing log sink: %v", err)
+		}
+	}
+	m.eventStream.Close()
+	m.closeLogFile()
+	if m.firewall {
+		releaseFirewall()
+	}
+	if m.storageFile != "" {
+		releaseStorageFile(m.storageFile)
+	}
+	if m.sharedStorage && !releaseStorage(m.storage) {
+		return nil
+	}
+	return m.storage.Close()
+}
+
+// jsonOptions returns the JSON storage options for the middleware's configuration
+func (m *Middleware) jsonOptions() storage.JSONOptions {
+	cfg := m.options.Config
+	return storage.JSONOptions{
+		HistoryRetention:   cfg.HistoryRetention,
+		HistoryPolicy:      cfg.HistoryPolicy,
+		ArchiveFile:        cfg.HistoryArchiveFile,
+		MaxRequestCounters: cfg.MaxTrackedIPs,
+		PersistMode:        cfg.PersistMode,
+		PersistInterval:    cfg.PersistInterval,
+		FlushInterval:      cfg.FlushInterval,
+		SyncOnBlock:        cfg.SyncOnBlock,
+		OnSaveError: func(err error) {
+			m.logger.Printf("Error saving storage: %v", err)
+		},
+		Logger: m.logger,
+	}
+}
+
 // HandleRequest handles an HTTP request
-func (m *Middleware) HandleRequest(r *http.Request) (bool, error) {
+func (m *Middleware) HandleRequest(r *http.Request) (blocked bool, err error) {
+	return m.handleRequest(r, nil)
+}
+
+// handleRequest handles an HTTP request, recording what it concluded in
+// status, which may be nil
+func (m *Middleware) handleRequest(r *http.Request, status *RequestStatus) (blocked bool, err error) {
+	return m.evaluate(r, "", nil, status)
+}
+
+// evaluate runs the counting and blocking pipeline on a request from ip, or
+// from the client IP of r when ip is empty, recording what it concluded in
+// status, which may be nil. Engine passes requests built from other
+// protocols, with the match in reported when the caller already knows the
+// request is malicious, which skips pattern matching, detectors and rules.
+func (m *Middleware) evaluate(r *http.Request, ip string, reported *matcher.Match, status *RequestStatus) (blocked bool, err error) {
+	// Time the evaluation for the OnRequestEvaluated callback
+	var metrics *DecisionMetrics
+	if m.options.OnRequestEvaluated != nil {
+		metrics = &DecisionMetrics{Path: r.URL.Path}
+		evaluationStart := time.Now()
+		defer func() {
+			metrics.Total = time.Since(evaluationStart)
+			metrics.Blocked = blocked
+			metrics.Err = err
+			m.options.OnRequestEvaluated(r.Context(), *metrics)
+		}()
+	}
+
 	// Get client IP
-	ip, err := getClientIP(r)
-	if err != nil {
-		m.logger.Printf("Error getting client IP: %v", err)
-		return false, err
+	if ip == "" {
+		start := metrics.start()
+		ip, err = getClientIP(r)
+		metrics.observe(phaseIPExtraction, start)
+		if err != nil {
+			m.logger.Printf("Error getting client IP: %v", err)
+			return false, err
+		}
+	}
+	path := r.URL.Path
+	if metrics != nil {
+		metrics.IP = ip
+	}
+
+	// In dry-run mode and log-only ramp stages nothing is rejected,
+	// decisions are only recorded
+	if m.logOnly(ip) {
+		defer func() { blocked = false }()
+	}
+
+	// The status sees the decision before log-only mode clears it, deferred
+	// functions running last to first
+	if status != nil {
+		status.IP = ip
+		defer func() { status.Blocked = blocked && err == nil }()
 	}
 
 	// Check if IP is whitelisted
-	if m.matcher.IsWhitelisted(ip) {
-		m.logger.Printf("Allowing whitelisted IP: %s", ip)
+	start := metrics.start()
+	whitelisted := m.matcher.IsWhitelisted(ip)
+	metrics.observe(phaseMatch, start)
+	if whitelisted || m.exempt(r) || m.verifiedBot(r, ip) {
+		status.exempted()
 		return false, nil
 	}
 
+	// Whole autonomous systems are blocked or exempted before the IP's own
+	// state is looked at
+	if number, blocked, listed := m.asnListed(ip); listed {
+		if !blocked {
+			status.exempted()
+			return false, nil
+		}
+		m.logger.Printf("Blocked request from %s to %s: its autonomous system %s is blocked", ip, path, number)
+		m.recordWouldReject(ip, path)
+		return true, nil
+	}
+
 	// Check if IP is already blocked
+	start = metrics.start()
 	isBlocked, err := m.blocker.IsBlocked(ip)
+	metrics.observe(phaseEnforce, start)
 	if err != nil {
 		m.logger.Printf("Error checking if IP is blocked: %v", err)
 		return false, err
 	}
 
+	if !isBlocked && m.subnetBlocked(ip) {
+		// The IP's subnet is blocked, there is no block of its own to extend
+		m.logger.Printf("Blocked request from %s to %s: its subnet is blocked", ip, path)
+		m.recordWouldReject(ip, path)
+		return true, nil
+	}
+
 	if isBlocked {
-		m.logger.Printf("Blocked request from %s to %s", ip, r.URL.Path)
+		m.logger.Printf("Blocked request from %s to %s", ip, path)
+		m.recordWouldReject(ip, path)
+		if m.deferWork(r, func() { m.extendBlock(ip, path, nil) }) {
+			metrics.deferred()
+		} else {
+			m.extendBlock(ip, path, metrics)
+		}
 		return true, nil
 	}
 
-	// Check if path is malicious
-	isMalicious := m.matcher.IsMalicious(r.URL.Path)
+	// Clients of a challenged IP are held back until they solve the
+	// challenge, whatever they request
+	if m.challengeRequired(r, ip) {
+		defer func() {
+			if err == nil {
+				blocked = true
+			}
+		}()
+	}
+
+	// Check if the request is malicious, by its path alone unless query and
+	// body inspection is on
+	start = metrics.start()
+	var match matcher.Match
+	var isMalicious bool
+	if reported != nil {
+		match, isMalicious = *reported, true
+	} else {
+		match, isMalicious = m.inspect(r, ip, path)
+	}
+	metrics.observe(phaseMatch, start)
 	if !isMalicious {
+		m.countLegitimate(ip)
 		return false, nil
 	}
+	if match.Category != "" {
+		m.logger.Printf("Request from %s to %s carries a %s payload (%s in %s at offset %d: %q)",
+			ip, path, match.Category, match.Pattern, match.Location, match.Offset, match.Excerpt)
+	}
+	m.emitDetection(ip, path, match)
+	status.flag(match.Pattern)
+
+	// Without enough time left before the request's deadline, decide from the
+	// pattern alone and record the request in the background
+	if m.deferWork(r, func() { m.recordMalicious(ip, path, match, nil, nil) }) {
+		metrics.deferred()
+		return match.Instant, nil
+	}
+
+	return m.recordMalicious(ip, path, match, metrics, status)
+}
+
+// inspect matches a request against the patterns, detectors and request
+// rules and returns the match if it is malicious
+func (m *Middleware) inspect(r *http.Request, ip, path string) (match matcher.Match, isMalicious bool) {
+	requestMatcher, ok := m.matcher.(matcher.RequestMatcher)
+	if ok && (m.options.Config.InspectQuery || m.options.Config.InspectBodyLimit > 0) {
+		match, isMalicious = requestMatcher.MatchRequest(r)
+	} else {
+		match, isMalicious = m.matchPath(path)
+	}
+
+	// Pattern hits on the application's own routes weigh less than probes
+	if isMalicious {
+		match = m.weighByRoute(path, match)
+	}
+
+	// Custom detectors add to the pattern's score, or flag the request on
+	// their own
+	if score, reasons := m.detect(r); score > 0 {
+		m.logger.Printf("Detectors scored request from %s to %s %d (%s)", ip, path, score, strings.Join(reasons, ", "))
+		match, isMalicious = combineDetection(match, isMalicious, score, reasons)
+	}
+
+	// Request rules count repeated requests of a kind, such as POSTs to a
+	// login form
+	if !isMalicious {
+		match, isMalicious = m.matchRequestRules(r, ip)
+	}
+	return match, isMalicious
+}
 
-	// Path is malicious, increment request count
-	err = m.storage.IncrementRequestCount(ip, r.URL.Path)
+// matchPath matches a path against the patterns. Matchers that cannot
+// score paths give every malicious path DefaultWeight.
+func (m *Middleware) matchPath(path string) (matcher.Match, bool) {
+	if !m.matcher.IsMalicious(path) {
+		return matcher.Match{}, false
+	}
+
+	// Path is malicious, look up the most specific pattern for its score
+	if scorer, ok := m.matcher.(matcher.Scorer); ok {
+		match, _ := scorer.Match(path)
+		return match, true
+	}
+	return matcher.Match{Pattern: path, Weight: matcher.DefaultWeight, Location: matcher.LocationPath}, true
+}
+
+// recordMalicious counts a malicious request from an IP and blocks the IP once
+// the pattern blocks instantly or the grace period or score threshold is exceeded.
+// Time spent is added to metrics and the IP's count and score to outcome,
+// either of which may be nil.
+func (m *Middleware) recordMalicious(ip, path string, match matcher.Match, metrics *DecisionMetrics, outcome *RequestStatus) (bool, error) {
+	// Increment request count and add the path's score
+	start := metrics.start()
+	score, err := storage.AddScore(m.storage, ip, path, match.Weight)
 	if err != nil {
 		m.logger.Printf("Error incrementing request count: %v", err)
 		return false, err
@@ -169,9 +932,13 @@ func (m *Middleware) HandleRequest(r *http.Request) (bool, error) {
 		m.logger.Printf("Error getting request count: %v", err)
 		return false, err
 	}
+	m.onDetect(DetectInfo{IP: ip, Path: path, Match: match, Count: requestCount, Score: score})
+	outcome.counted(requestCount, score)
+	m.watchRedemption(ip)
 
 	// Check if IP should be blocked
 	isBlocked, status, err := m.storage.IsIPBlocked(ip)
+	metrics.observe(phaseStorage, start)
 	if err != nil {
 		m.logger.Printf("Error checking if IP should be blocked: %v", err)
 		return false, err
@@ -179,42 +946,87 @@ func (m *Middleware) HandleRequest(r *http.Request) (bool, error) {
 
 	if isBlocked {
 		// IP is already blocked in storage, make sure it's blocked at OS level
+		start = metrics.start()
 		if status.IsPermanent {
 			_, err = m.blocker.Block(ip, blocker.Ban, 0)
 		} else {
 			_, err = m.blocker.Block(ip, blocker.Timeout, time.Until(status.BlockedUntil))
 		}
+		metrics.observe(phaseEnforce, start)
 		if err != nil {
 			m.logger.Printf("Error blocking IP: %v", err)
 		}
+		m.recordWouldReject(ip, path)
 		return true, nil
 	}
 
-	// Check if grace period is exceeded using the request count from storage
-	if requestCount > m.options.GracePeriod {
-		// Grace period exceeded, block IP
-		if m.options.TimeoutEnabled {
-			// Get timeout count from storage
-			timeoutCount := 0
-			if status != nil {
-				timeoutCount = status.TimeoutCount
-			}
+	// Check if the pattern blocks instantly, or the grace period or score
+	// threshold is exceeded using the counts from storage
+	// An IP on probation after a timeout is held to the probation grace
+	// period instead, however its counts have aged
+	exceeded := m.thresholdExceeded(requestCount, score)
+	probation := status != nil && status.OnProbation(time.Now())
+	if probation {
+		exceeded = m.probationHit(*status)
+	}
 
-			// Calculate timeout duration
+	if match.Instant || exceeded {
+		// Challenge the IP first, and block it once it keeps going while challenged
+		if m.challenge(ip, path, requestCount, score, match.Instant) {
+			return true, nil
+		}
+		m.endChallenge(ip)
+
+		// Get timeout count from storage
+		timeoutCount := 0
+		if status != nil {
+			timeoutCount = status.TimeoutCount
+		}
+
+		// Grace period exceeded, block IP, permanently once it has been
+		// timed out too often unless a policy window rules out permanent bans
+		maxTimeouts := m.options.Config.MaxTimeouts
+		timeout := m.options.TimeoutEnabled && (maxTimeouts == 0 || timeoutCount < maxTimeouts)
+		if window, ok := m.policyWindow(); ok && window.NoPermanentBans && !timeout {
+			m.logger.Printf("Timing out IP %s instead of banning it permanently during policy window %q", ip, window.Name)
+			timeout = true
+		}
+		if timeout {
+			// Calculate timeout duration, longer for IPs blocked again on probation
 			duration := m.calculateTimeoutDuration(timeoutCount)
+			if probation {
+				duration = m.probationDuration(duration)
+			}
 
 			// Block IP with timeout
+			start = metrics.start()
 			_, err = m.blocker.Block(ip, blocker.Timeout, duration)
+			metrics.observe(phaseEnforce, start)
 			if err != nil {
 				m.logger.Printf("Error blocking IP: %v", err)
 				return false, err
 			}
 
 			// Update storage
-			err = m.storage.BlockIP(ip, time.Now().Add(duration), false, r.URL.Path)
+			start = metrics.start()
+			until := time.Now().Add(duration)
+			err = m.storage.BlockIP(ip, until, false, path)
 			if err != nil {
 				m.logger.Printf("Error updating storage: %v", err)
 			}
+			m.publishBlock(ip, until, false, path, "")
+			m.recordDecision(ip, path, match.Pattern, until, false)
+			m.countBlock()
+			m.onBlock(BlockInfo{
+				IP:       ip,
+				Path:     path,
+				Pattern:  match.Pattern,
+				Count:    requestCount,
+				Score:    score,
+				Duration: duration,
+				Until:    until,
+				Source:   SourceDetection,
+			})
 
 			// Increment timeout count
 			err = m.storage.IncrementTimeoutCount(ip)
@@ -222,83 +1034,210 @@ func (m *Middleware) HandleRequest(r *http.Request) (bool, error) {
 				m.logger.Printf("Error incrementing timeout count: %v", err)
 			}
 
-			m.logger.Printf("Blocked IP %s for %s for accessing malicious path %s (count: %d)",
-				ip, duration, r.URL.Path, requestCount)
+			// Watch the IP more closely once the timeout ends
+			m.startProbation(ip, until)
+			metrics.observe(phaseStorage, start)
+
+			m.logger.Printf("Blocked IP %s for %s for accessing malicious path %s (count: %d, score: %d)",
+				ip, duration, path, requestCount, score)
 		} else {
+			if m.options.TimeoutEnabled {
+				m.logger.Printf("IP %s has been timed out %d times, escalating to a permanent ban", ip, timeoutCount)
+			}
+
 			// Block IP permanently
+			start = metrics.start()
 			_, err = m.blocker.Block(ip, blocker.Ban, 0)
+			metrics.observe(phaseEnforce, start)
 			if err != nil {
 				m.logger.Printf("Error blocking IP: %v", err)
 				return false, err
 			}
 
 			// Update storage
-			err = m.storage.BlockIP(ip, time.Time{}, true, r.URL.Path)
+			start = metrics.start()
+			err = m.storage.BlockIP(ip, time.Time{}, true, path)
+			metrics.observe(phaseStorage, start)
 			if err != nil {
 				m.logger.Printf("Error updating storage: %v", err)
 			}
+			m.publishBlock(ip, time.Time{}, true, path, "")
+			m.recordDecision(ip, path, match.Pattern, time.Time{}, true)
+			m.countBlock()
+			m.onBlock(BlockInfo{
+				IP:        ip,
+				Path:      path,
+				Pattern:   match.Pattern,
+				Count:     requestCount,
+				Score:     score,
+				Permanent: true,
+				Source:    SourceDetection,
+			})
 
-			m.logger.Printf("Permanently blocked IP %s for accessing malicious path %s (count: %d)",
-				ip, r.URL.Path, requestCount)
+			m.logger.Printf("Permanently blocked IP %s for accessing malicious path %s (count: %d, score: %d)",
+				ip, path, requestCount, score)
 		}
 
 		return true, nil
 	}
 
-	m.logger.Printf("Malicious request from %s to %s (count: %d, threshold: %d)",
-		ip, r.URL.Path, requestCount, m.options.GracePeriod)
+	if gracePeriod, scoreThreshold := m.thresholds(); scoreThreshold > 0 {
+		m.logger.Printf("Malicious request from %s to %s (score: %d, threshold: %d)",
+			ip, path, score, scoreThreshold)
+	} else {
+		m.logger.Printf("Malicious request from %s to %s (count: %d, threshold: %d)",
+			ip, path, requestCount, gracePeriod)
+	}
 	return false, nil
 }
 
-// calculateTimeoutDuration calculates the timeout duration based on the timeout count
+// thresholdExceeded reports whether an IP must be blocked. With a score threshold
+// configured the accumulated score decides, otherwise the grace period does.
+func (m *Middleware) thresholdExceeded(requestCount, score int) bool {
+	// A lockdown replaces both with its own grace period
+	if policy, ok := m.lockdownPolicy(); ok {
+		return requestCount > policy.GracePeriod
+	}
+	gracePeriod, scoreThreshold := m.thresholds()
+	if scoreThreshold > 0 {
+		return score >= scoreThreshold
+	}
+	return requestCount > gracePeriod
+}
+
+// extendBlock extends the block of an IP that keeps probing malicious paths while
+// blocked. Time spent is added to metrics, which may be nil.
+func (m *Middleware) extendBlock(ip, path string, metrics *DecisionMetrics) {
+	extension := m.options.Config.BlockExtension
+	if extension <= 0 || !m.matcher.IsMalicious(path) {
+		return
+	}
+
+	start := metrics.start()
+	until, err := storage.ExtendBlock(m.storage, ip, extension)
+	metrics.observe(phaseStorage, start)
+	if err != nil {
+		m.logger.Printf("Error extending block for IP %s: %v", ip, err)
+		return
+	}
+	if until.IsZero() {
+		return
+	}
+
+	// Keep the blocker's expiration in line with storage
+	start = metrics.start()
+	_, err = m.blocker.Block(ip, blocker.Timeout, time.Until(until))
+	metrics.observe(phaseEnforce, start)
+	if err != nil {
+		m.logger.Printf("Error extending block for IP %s: %v", ip, err)
+		return
+	}
+
+	m.publishBlock(ip, until, false, path, "")
+	m.onBlock(BlockInfo{
+		IP:       ip,
+		Path:     path,
+		Duration: time.Until(until),
+		Until:    until,
+		Extended: true,
+		Source:   SourceDetection,
+	})
+	m.logger.Printf("Extended block for IP %s by %v until %s for probing %s while blocked",
+		ip, extension, until.Format(time.RFC3339), path)
+}
+
+// calculateTimeoutDuration calculates the timeout duration based on the timeout
+// count, clamped to Config.MaxTimeoutDuration
 func (m *Middleware) calculateTimeoutDuration(timeoutCount int) time.Duration {
 	baseDuration := m.options.TimeoutDuration
+	if window, ok := m.policyWindow(); ok && window.TimeoutDuration > 0 {
+		baseDuration = window.TimeoutDuration
+	}
+	limit := m.options.Config.MaxTimeoutDuration
+	if limit <= 0 {
+		limit = time.Duration(math.MaxInt64)
+	}
 
 	if timeoutCount == 0 {
-		return baseDuration
+		return min(baseDuration, limit)
 	}
 
 	if m.options.TimeoutIncrease == "geometric" {
-		// Geometric increase: duration * 2^timeoutCount
-		multiplier := 1
-		for i := 0; i < timeoutCount; i++ {
-			multiplier *= 2
+		// Geometric increase: duration * 2^timeoutCount, where a shift past
+		// 62 bits would overflow the multiplier itself
+		multiplier := int64(math.MaxInt64)
+		if timeoutCount < 63 {
+			multiplier = 1 << timeoutCount
 		}
-		duration := baseDuration * time.Duration(multiplier)
+		duration := scaleDuration(baseDuration, multiplier, limit)
 		m.logger.Printf("Using geometric timeout increase: %v * %d = %v",
 			baseDuration, multiplier, duration)
 		return duration
 	}
 
 	// Linear increase: duration * (timeoutCount + 1)
-	duration := baseDuration * time.Duration(timeoutCount+1)
+	multiplier := int64(timeoutCount) + 1
+	duration := scaleDuration(baseDuration, multiplier, limit)
 	m.logger.Printf("Using linear timeout increase: %v * %d = %v",
-		baseDuration, timeoutCount+1, duration)
+		baseDuration, multiplier, duration)
 	return duration
 }
 
-// getClientIP gets the client IP from the request
+// scaleDuration multiplies a positive duration, returning limit instead when
+// the product exceeds it or would overflow time.Duration
+func scaleDuration(duration time.Duration, multiplier int64, limit time.Duration) time.Duration {
+	if duration <= 0 {
+		return duration
+	}
+	if multiplier > int64(limit/duration) {
+		return limit
+	}
+	return min(duration*time.Duration(multiplier), limit)
+}
+
+// getClientIP gets the client IP from the request. Headers are looked up by
+// their canonical keys directly, sparing every request Header.Get's
+// canonicalization.
 func getClientIP(r *http.Request) (string, error) {
 	// Check X-Forwarded-For header
-	if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
+	if xff := firstHeader(r.Header, "X-Forwarded-For"); xff != "" {
 		ips := splitAndTrim(xff)
 		if len(ips) > 0 {
-			return ips[0], nil
+			return checkClientIP(ips[0])
 		}
 	}
 
 	// Check X-Real-IP header
-	if xrip := r.Header.Get("X-Real-IP"); xrip != "" {
-		return xrip, nil
+	if xrip := firstHeader(r.Header, "X-Real-Ip"); xrip != "" {
+		return checkClientIP(trim(xrip))
 	}
 
-	// Get IP from RemoteAddr
+	// Get IP from RemoteAddr, normalized so an IPv4 client on a dual-stack
+	// listener is the same IP as over IPv4
 	ip, _, err := net.SplitHostPort(r.RemoteAddr)
 	if err != nil {
-		return r.RemoteAddr, nil
+		return checkClientIP(r.RemoteAddr)
 	}
 
-	return ip, nil
+	return checkClientIP(ip)
+}
+
+// checkClientIP normalizes a client IP, rejecting anything else a header
+// may carry before it reaches storage keys or the firewall
+func checkClientIP(ip string) (string, error) {
+	normalized, err := ipaddr.Check(ip)
+	if err != nil {
+		return "", fmt.Errorf("invalid client IP %q", ip)
+	}
+	return normalized, nil
+}
+
+// firstHeader returns the first value of a header given by its canonical key
+func firstHeader(header http.Header, key string) string {
+	if values := header[key]; len(values) > 0 {
+		return values[0]
+	}
+	return ""
 }
 
 // splitAndTrim splits a string by comma and trims spaces
@@ -341,23 +1280,44 @@ func trim(s string) string {
 }
 
 // CleanupExpired removes expired blocks from both storage and blocker
-func (m *Middleware) CleanupExpired() error {
+func (m *Middleware) CleanupExpired() (err error) {
+	start := time.Now()
+	var expired []string
+	defer func() {
+		m.onCleanup(CleanupInfo{Expired: expired, Duration: time.Since(start), Err: err})
+	}()
+
 	// Get all blocked IPs from storage
 	blockedIPs, err := m.storage.GetBlockedIPs()
 	if err != nil {
 		return err
 	}
 
-	// Check each IP
+	// Find the blocks that ran out since the last cleanup. Storage keeps
+	// some records past their end, for history, probation or an appeal
+	// cooldown; those were lifted once already.
+	m.liftedMutex.Lock()
+	defer m.liftedMutex.Unlock()
 	now := time.Now()
+	lifted := make(map[string]time.Time)
 	for _, status := range blockedIPs {
-		if !status.IsPermanent && now.After(status.BlockedUntil) {
-			// Unblock at OS level
-			if err := m.blocker.Unblock(status.IP); err != nil {
-				m.logger.Printf("Error unblocking IP %s: %v", status.IP, err)
-			}
+		if status.IsPermanent || !now.After(status.BlockedUntil) {
+			continue
+		}
+		lifted[status.IP] = status.BlockedUntil
+		if until, ok := m.lifted[status.IP]; !ok || !until.Equal(status.BlockedUntil) {
+			expired = append(expired, status.IP)
 		}
 	}
+	m.lifted = lifted
+
+	// Unblock at OS level, in one batch where the blocker can
+	if err := blocker.UnblockBatch(m.blocker, expired); err != nil {
+		m.logger.Printf("Error unblocking %d expired IPs: %v", len(expired), err)
+	}
+	for _, ip := range expired {
+		m.onUnblock(UnblockInfo{IP: ip, Source: SourceExpired})
+	}
 
 	// Clean up expired blocks in storage
 	if err := m.storage.CleanupExpired(); err != nil {
@@ -368,8 +1328,45 @@ func (m *Middleware) CleanupExpired() error {
 	if err := m.blocker.CleanupExpired(); err != nil {
 		return err
 	}
+	m.cleanupChallenges()
+	m.cleanupAppeals()
+	m.cleanupBots()
+	m.cleanupRequestRules()
+
+	// Let IPs work off malicious requests they have gone quiet on
+	if err := m.redeemQuiet(blockedIPs); err != nil {
+		m.logger.Printf("Error lowering request counts of quiet IPs: %v", err)
+	}
+	m.adminAPI.cleanup()
+
+	// Drop expired temporary whitelist entries, the sync below re-applies their blocks
+	if whitelister, ok := m.matcher.(matcher.TemporaryWhitelister); ok {
+		for _, ip := range whitelister.ExpireWhitelist() {
+			m.logger.Printf("Temporary whitelist entry for IP %s expired", ip)
+		}
+	}
 
-	return nil
+	// Surface old permanent bans for review
+	if m.options.Config.PermanentBanReviewAge > 0 {
+		if err := m.reviewPermanentBans(); err != nil {
+			m.logger.Printf("Error reviewing permanent bans: %v", err)
+		}
+	}
+
+	// Repair any drift between the blocker and storage
+	return m.Sync()
+}
+
+// markLifted records that the block of an IP ending at until was lifted
+// outside CleanupExpired, which then does not report it as expired
+func (m *Middleware) markLifted(ip string, until time.Time) {
+	m.liftedMutex.Lock()
+	defer m.liftedMutex.Unlock()
+
+	if m.lifted == nil {
+		m.lifted = make(map[string]time.Time)
+	}
+	m.lifted[ip] = until
 }
 
 // RestoreBlocks restores OS-level blocks from previous runs
@@ -377,7 +1374,7 @@ func RestoreBlocks(blockedIPsFile, systemType string) error {
 	// Create the directory if it doesn't exist
 	dir := filepath.Dir(blockedIPsFile)
 	if err := os.MkdirAll(dir, 0755); err != nil {
-		return fmt.Errorf("failed to create directory for blocked IPs file: %v", err)
+		return fmt.Errorf("failed to create directory for blocked IPs file: %w", err)
 	}
 
 	// Check if the file exists
@@ -385,7 +1382,7 @@ func RestoreBlocks(blockedIPsFile, systemType string) error {
 		// File doesn't exist, create an empty one
 		emptyFile, err := os.Create(blockedIPsFile)
 		if err != nil {
-			return fmt.Errorf("failed to create blocked IPs file: %v", err)
+			return fmt.Errorf("failed to create blocked IPs file: %w", err)
 		}
 		emptyFile.Write([]byte("[]"))
 		emptyFile.Close()
@@ -399,56 +1396,33 @@ func RestoreBlocks(blockedIPsFile, systemType string) error {
 	// Create a storage instance
 	store, err := storage.NewJSONStorage(blockedIPsFile)
 	if err != nil {
-		return fmt.Errorf("failed to create storage: %v", err)
+		return fmt.Errorf("failed to create storage: %w", err)
 	}
 
 	// Load the blocked IPs
 	if err := store.Load(); err != nil {
-		return fmt.Errorf("failed to load blocked IPs: %v", err)
+		return fmt.Errorf("failed to load blocked IPs: %w", err)
 	}
 
 	// Get all blocked IPs
 	blockedIPs, err := store.GetBlockedIPs()
 	if err != nil {
-		return fmt.Errorf("failed to get blocked IPs: %v", err)
+		return fmt.Errorf("failed to get blocked IPs: %w", err)
 	}
 
 	// Create a blocker service
-	blockSvc := blocker.NewServiceWithSystemType(systemType)
+	blockerOptions := BlockerOptions(config.DefaultConfig())
+	blockerOptions.Logger = logger
+	blockSvc := blocker.NewServiceWithOptions(systemType, blockerOptions)
 
-	// Restore blocks
-	restoredCount := 0
-	skippedCount := 0
+	// Restore the blocks in one batch, the blocker skips expired ones
+	blocks := make(map[string]time.Time, len(blockedIPs))
 	for _, status := range blockedIPs {
-		// Skip expired blocks
-		if !status.IsPermanent && time.Now().After(status.BlockedUntil) {
-			skippedCount++
-			continue
-		}
-
-		// Determine block type and duration
-		blockType := blocker.Timeout
-		var duration time.Duration
 		if status.IsPermanent {
-			blockType = blocker.Ban
-			duration = 0
+			blocks[status.IP] = time.Time{}
 		} else {
-			duration = status.BlockedUntil.Sub(time.Now())
-			if duration <= 0 {
-				skippedCount++
-				continue
-			}
-		}
-
-		// Block the IP
-		if _, err := blockSvc.Block(status.IP, blockType, duration); err != nil {
-			logger.Printf("Failed to restore block for IP %s: %v", status.IP, err)
-			continue
+			blocks[status.IP] = status.BlockedUntil
 		}
-
-		restoredCount++
 	}
-
-	logger.Printf("Restored %d blocks, skipped %d expired blocks", restoredCount, skippedCount)
-	return nil
+	return blockSvc.RestoreBlocks(blocks)
 }
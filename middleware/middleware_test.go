@@ -0,0 +1,84 @@
+package middleware_test
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/headswim/whoen/config"
+	"github.com/headswim/whoen/matcher"
+	"github.com/headswim/whoen/middleware"
+	"github.com/headswim/whoen/whoentest"
+)
+
+// newBenchmarkMiddleware creates a middleware with the built-in patterns on
+// in-memory storage and a fake blocker
+func newBenchmarkMiddleware(b *testing.B, cfg config.Config) *middleware.Middleware {
+	b.Helper()
+
+	config.ValidateConfig(&cfg)
+	cfg.SystemType = "linux"
+	m, err := middleware.New(middleware.Options{
+		Config:          cfg,
+		Storage:         whoentest.NewStorage(),
+		Matcher:         matcher.NewService(),
+		Blocker:         whoentest.NewBlocker(),
+		Logger:          log.New(io.Discard, "", 0),
+		GracePeriod:     cfg.GracePeriod,
+		TimeoutEnabled:  cfg.TimeoutEnabled,
+		TimeoutDuration: cfg.TimeoutDuration,
+		TimeoutIncrease: cfg.TimeoutIncrease,
+	})
+	if err != nil {
+		b.Fatalf("failed to create middleware: %v", err)
+	}
+	b.Cleanup(func() { m.Close() })
+	return m
+}
+
+// benchmarkRequest creates a GET request for path from ip
+func benchmarkRequest(ip, path string) *http.Request {
+	r := httptest.NewRequest(http.MethodGet, path, nil)
+	r.RemoteAddr = ip + ":40000"
+	r.Header.Set("User-Agent", "Mozilla/5.0 (X11; Linux x86_64)")
+	return r
+}
+
+// BenchmarkHandleRequestClean measures a clean request from an IP that is
+// not blocked, which must not allocate
+func BenchmarkHandleRequestClean(b *testing.B) {
+	m := newBenchmarkMiddleware(b, whoentest.Config())
+	r := benchmarkRequest("203.0.113.10", "/products/42")
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if blocked, err := m.HandleRequest(r); blocked || err != nil {
+			b.Fatalf("clean request blocked: %v, %v", blocked, err)
+		}
+	}
+	b.StopTimer()
+
+	if allocs := testing.AllocsPerRun(100, func() { m.HandleRequest(r) }); allocs > 0 {
+		b.Errorf("clean request allocates %v times, want 0", allocs)
+	}
+}
+
+// BenchmarkHandleRequestMalicious measures a malicious request that is
+// counted but stays within the grace period
+func BenchmarkHandleRequestMalicious(b *testing.B) {
+	cfg := whoentest.Config()
+	cfg.GracePeriod = 1 << 30
+	m := newBenchmarkMiddleware(b, cfg)
+	r := benchmarkRequest("203.0.113.20", "/wp-login.php")
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := m.HandleRequest(r); err != nil {
+			b.Fatalf("malicious request failed: %v", err)
+		}
+	}
+}
@@ -0,0 +1,18 @@
+package middleware
+
+// exportIP returns the form of an IP in exported data, see
+// Options.Obfuscator
+func (m *Middleware) exportIP(ip string) string {
+	if m.options.Obfuscator == nil || ip == "" {
+		return ip
+	}
+	return m.options.Obfuscator.IP(m.options.Tenant, ip)
+}
+
+// exportTenant returns the form of the middleware's tenant in exported data
+func (m *Middleware) exportTenant() string {
+	if m.options.Obfuscator == nil || m.options.Tenant == "" {
+		return m.options.Tenant
+	}
+	return m.options.Obfuscator.Tenant(m.options.Tenant)
+}
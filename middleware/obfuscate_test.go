@@ -0,0 +1,114 @@
+package middleware_test
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/headswim/whoen/config"
+	"github.com/headswim/whoen/events"
+	"github.com/headswim/whoen/logsink"
+	"github.com/headswim/whoen/middleware"
+	"github.com/headswim/whoen/obfuscate"
+	"github.com/headswim/whoen/whoentest"
+)
+
+// recordingSink keeps the records written to it
+type recordingSink struct {
+	mutex   sync.Mutex
+	records []logsink.Record
+}
+
+// Write keeps a record
+func (s *recordingSink) Write(record logsink.Record) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.records = append(s.records, record)
+	return nil
+}
+
+// Close does nothing
+func (s *recordingSink) Close() error { return nil }
+
+// TestObfuscatorHidesExportedIPs checks that events, log sink records and
+// the attack report carry the obfuscated IP and tenant, never the raw IP
+func TestObfuscatorHidesExportedIPs(t *testing.T) {
+	const ip = "203.0.113.7"
+	obfuscator := obfuscate.NewHashObfuscator([]byte("salt"))
+	obfuscator.SetTenantSalt("acme", []byte("acme salt"))
+	wantIP, wantTenant := obfuscator.IP("acme", ip), obfuscator.Tenant("acme")
+
+	cfg := whoentest.Config()
+	cfg.GracePeriod = 1
+	cfg.SystemType = "linux"
+	config.ValidateConfig(&cfg)
+
+	var eventsMutex sync.Mutex
+	var received []events.Event
+	sink := &recordingSink{}
+	m, err := middleware.New(middleware.Options{
+		Config:          cfg,
+		Storage:         whoentest.NewStorage(),
+		Matcher:         whoentest.NewMatcher("/wp-login.php"),
+		Blocker:         whoentest.NewBlocker(),
+		Logger:          log.New(io.Discard, "", 0),
+		GracePeriod:     cfg.GracePeriod,
+		TimeoutEnabled:  cfg.TimeoutEnabled,
+		TimeoutDuration: cfg.TimeoutDuration,
+		TimeoutIncrease: cfg.TimeoutIncrease,
+		LogSink:         sink,
+		Obfuscator:      obfuscator,
+		Tenant:          "acme",
+		OnEvent: func(event events.Event) {
+			eventsMutex.Lock()
+			defer eventsMutex.Unlock()
+			received = append(received, event)
+		},
+	})
+	if err != nil {
+		t.Fatalf("failed to create middleware: %v", err)
+	}
+
+	for i := 0; i < 3; i++ {
+		r := httptest.NewRequest(http.MethodGet, "/wp-login.php", nil)
+		r.RemoteAddr = ip + ":40000"
+		m.HandleRequest(r)
+	}
+
+	report, err := m.AttackReport(0)
+	if err != nil {
+		t.Fatalf("failed to build attack report: %v", err)
+	}
+	if len(report.TopIPs) != 1 || report.TopIPs[0].IP != wantIP {
+		t.Errorf("attack report lists %+v, want only %s", report.TopIPs, wantIP)
+	}
+
+	// Closing the middleware flushes the log sink
+	m.Close()
+
+	eventsMutex.Lock()
+	defer eventsMutex.Unlock()
+	if len(received) == 0 {
+		t.Error("no events received")
+	}
+	for _, event := range received {
+		if event.IP != wantIP || event.Tenant != wantTenant {
+			t.Errorf("%s event has IP %q and tenant %q, want %q and %q", event.Type, event.IP, event.Tenant, wantIP, wantTenant)
+		}
+	}
+
+	sink.mutex.Lock()
+	defer sink.mutex.Unlock()
+	if len(sink.records) == 0 {
+		t.Error("no records written to the log sink")
+	}
+	for _, record := range sink.records {
+		if record.IP != wantIP || record.Tenant != wantTenant {
+			t.Errorf("%s record has IP %q and tenant %q, want %q and %q", record.Event, record.IP, record.Tenant, wantIP, wantTenant)
+		}
+	}
+}
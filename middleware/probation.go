@@ -0,0 +1,51 @@
+package middleware
+
+import (
+	"math"
+	"time"
+
+	"github.com/headswim/whoen/storage"
+)
+
+// probationHit counts a malicious request from an IP on probation and
+// reports whether it has used up Config.ProbationGracePeriod. status is the
+// IP's block record, which must be on probation.
+func (m *Middleware) probationHit(status storage.BlockStatus) bool {
+	status.ProbationHits++
+	if err := storage.PutBlock(m.storage, status); err != nil {
+		m.logger.Printf("Error counting probation hit for IP %s: %v", status.IP, err)
+	}
+	m.logger.Printf("Malicious request from %s on probation until %s (hits: %d, grace period: %d)",
+		status.IP, status.ProbationUntil.Format(time.RFC3339), status.ProbationHits, m.options.Config.ProbationGracePeriod)
+	return status.ProbationHits > m.options.Config.ProbationGracePeriod
+}
+
+// probationDuration lengthens the timeout of an IP blocked again on
+// probation by Config.ProbationMultiplier, clamped to Config.MaxTimeoutDuration
+func (m *Middleware) probationDuration(duration time.Duration) time.Duration {
+	limit := m.options.Config.MaxTimeoutDuration
+	if limit <= 0 {
+		limit = time.Duration(math.MaxInt64)
+	}
+	return scaleDuration(duration, int64(m.options.Config.ProbationMultiplier), limit)
+}
+
+// startProbation puts an IP on probation for Config.ProbationPeriod once its
+// timeout ends, starting its probation hits over
+func (m *Middleware) startProbation(ip string, until time.Time) {
+	period := m.options.Config.ProbationPeriod
+	if period <= 0 {
+		return
+	}
+
+	_, status, err := m.storage.IsIPBlocked(ip)
+	if err != nil || status == nil {
+		m.logger.Printf("Error starting probation for IP %s: %v", ip, err)
+		return
+	}
+	status.ProbationUntil = until.Add(period)
+	status.ProbationHits = 0
+	if err := storage.PutBlock(m.storage, *status); err != nil {
+		m.logger.Printf("Error starting probation for IP %s: %v", ip, err)
+	}
+}
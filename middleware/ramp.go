@@ -0,0 +1,192 @@
+package middleware
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"sync/atomic"
+	"time"
+
+	"github.com/headswim/whoen/blocker"
+	"github.com/headswim/whoen/config"
+	"github.com/headswim/whoen/events"
+)
+
+// ramp decides the enforcement mode of each client IP from the configured stages
+type ramp struct {
+	stages []config.RampStage
+	start  time.Time
+
+	// reported is the index of the last stage logged as active, -1 before the first
+	reported atomic.Int64
+}
+
+// newRamp creates a ramp whose stages count from start
+func newRamp(stages []config.RampStage, start time.Time) *ramp {
+	r := &ramp{stages: stages, start: start}
+	r.reported.Store(-1)
+	return r
+}
+
+// current returns the index of the active stage, or -1 before the first stage starts
+func (r *ramp) current(now time.Time) int {
+	elapsed := now.Sub(r.start)
+	active := -1
+	for i, stage := range r.stages {
+		if elapsed >= stage.After {
+			active = i
+		}
+	}
+	return active
+}
+
+// mode returns the enforcement mode of an IP in a stage. IPs outside the
+// stage's percentage keep the mode of the stage before it, and the ramp
+// begins in log-only mode.
+func (r *ramp) mode(ip string, stage int) string {
+	bucket := ipBucket(ip)
+	for ; stage >= 0; stage-- {
+		if bucket < r.stages[stage].Percent {
+			return r.stages[stage].Mode
+		}
+	}
+	return config.RampLogOnly
+}
+
+// ipBucket maps an IP to a stable bucket from 0 to 99, so an IP admitted to a
+// stage at some percentage stays admitted as the percentage grows
+func ipBucket(ip string) int {
+	h := fnv.New32a()
+	h.Write([]byte(ip))
+	return int(h.Sum32() % 100)
+}
+
+// mode returns the enforcement mode for a client IP: log-only in dry-run mode,
+// the ramp's mode while a ramp is configured and os-block otherwise
+func (m *Middleware) mode(ip string) string {
+	if m.dryRun() {
+		return config.RampLogOnly
+	}
+	if m.ramp == nil {
+		return config.RampOSBlock
+	}
+
+	stage := m.ramp.current(time.Now())
+	m.reportRampStage(stage)
+	return m.ramp.mode(ip, stage)
+}
+
+// logOnly reports whether blocks of an IP are only recorded, not enforced
+func (m *Middleware) logOnly(ip string) bool {
+	return m.mode(ip) == config.RampLogOnly
+}
+
+// reportRampStage logs the ramp's stage the first time it becomes active
+func (m *Middleware) reportRampStage(stage int) {
+	previous := m.ramp.reported.Load()
+	if int64(stage) <= previous || !m.ramp.reported.CompareAndSwap(previous, int64(stage)) {
+		return
+	}
+
+	message := "log-only for all IPs"
+	if stage >= 0 {
+		s := m.ramp.stages[stage]
+		message = fmt.Sprintf("stage %d of %d: %s for %d%% of IPs", stage+1, len(m.ramp.stages), s.Mode, s.Percent)
+	}
+	m.logger.Printf("Enforcement ramp: %s", message)
+	if stage >= 0 {
+		m.emit(events.Event{Type: events.RampAdvanced, Message: message})
+	}
+}
+
+// rampBlocker routes blocks by the enforcement mode of each IP: os-block IPs
+// go to the enforcing blocker, the others are only tracked in memory. Blocks
+// tracked in memory move to the enforcing blocker once their IP reaches
+// os-block mode.
+type rampBlocker struct {
+	enforcing blocker.Blocker
+	memory    *blocker.Service
+	mode      func(ip string) string
+}
+
+// Block blocks an IP with the blocker for its mode
+func (b *rampBlocker) Block(ip string, blockType blocker.BlockType, duration time.Duration) (*blocker.BlockResult, error) {
+	if b.mode(ip) == config.RampOSBlock {
+		return b.enforcing.Block(ip, blockType, duration)
+	}
+	return b.memory.Block(ip, blockType, duration)
+}
+
+// Unblock unblocks an IP in both blockers
+func (b *rampBlocker) Unblock(ip string) error {
+	return errors.Join(b.memory.Unblock(ip), b.enforcing.Unblock(ip))
+}
+
+// BlockBatch blocks IPs with the blocker for the mode of each
+func (b *rampBlocker) BlockBatch(ips []string, blockType blocker.BlockType, duration time.Duration) error {
+	var enforced, tracked []string
+	for _, ip := range ips {
+		if b.mode(ip) == config.RampOSBlock {
+			enforced = append(enforced, ip)
+		} else {
+			tracked = append(tracked, ip)
+		}
+	}
+	return errors.Join(blocker.BlockBatch(b.enforcing, enforced, blockType, duration),
+		b.memory.BlockBatch(tracked, blockType, duration))
+}
+
+// UnblockBatch unblocks IPs in both blockers
+func (b *rampBlocker) UnblockBatch(ips []string) error {
+	return errors.Join(b.memory.UnblockBatch(ips), blocker.UnblockBatch(b.enforcing, ips))
+}
+
+// IsBlocked checks if an IP is blocked by either blocker, promoting blocks
+// tracked in memory to the enforcing blocker when the IP reached os-block mode
+func (b *rampBlocker) IsBlocked(ip string) (bool, error) {
+	if blocked, err := b.enforcing.IsBlocked(ip); err != nil || blocked {
+		return blocked, err
+	}
+
+	blocked, err := b.memory.IsBlocked(ip)
+	if err != nil || !blocked || b.mode(ip) != config.RampOSBlock {
+		return blocked, err
+	}
+
+	// The IP's stage now calls for OS enforcement
+	expiration, _ := b.memory.Expiration(ip)
+	if expiration.IsZero() {
+		_, err = b.enforcing.Block(ip, blocker.Ban, 0)
+	} else {
+		_, err = b.enforcing.Block(ip, blocker.Timeout, time.Until(expiration))
+	}
+	if err != nil {
+		return true, err
+	}
+	return true, b.memory.Unblock(ip)
+}
+
+// CleanupExpired removes expired blocks from both blockers
+func (b *rampBlocker) CleanupExpired() error {
+	return errors.Join(b.memory.CleanupExpired(), b.enforcing.CleanupExpired())
+}
+
+// Blocks returns the blocks of both blockers
+func (b *rampBlocker) Blocks() map[string]time.Time {
+	blocks := b.memory.Blocks()
+	if lister, ok := b.enforcing.(blocker.Lister); ok {
+		for ip, expiration := range lister.Blocks() {
+			blocks[ip] = expiration
+		}
+	}
+	return blocks
+}
+
+// Len returns the number of IPs both blockers are tracking
+func (b *rampBlocker) Len() int {
+	n := b.memory.Len()
+	if sizer, ok := b.enforcing.(blocker.Sizer); ok {
+		n += sizer.Len()
+	}
+	return n
+}
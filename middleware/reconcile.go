@@ -0,0 +1,57 @@
+package middleware
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/headswim/whoen/blocker"
+	"github.com/headswim/whoen/config"
+)
+
+// Reconcile reads the rules present in the OS firewall and brings them in
+// line with the active blocks in storage: missing rules are applied and
+// orphaned whoen rules are removed. Unlike Sync, which compares storage with
+// the blocks the blocker tracks, it finds drift in the firewall itself, such
+// as rules flushed by another tool or left behind by a crashed run. With an
+// enforcement ramp, only the blocks of IPs in os-block mode are enforced.
+func (m *Middleware) Reconcile() (blocker.ReconcileResult, error) {
+	target := m.blocker
+	mode := func(string) string { return config.RampOSBlock }
+	if ramp, ok := target.(*rampBlocker); ok {
+		target = ramp.enforcing
+		mode = ramp.mode
+	}
+	reconciler, ok := target.(blocker.Reconciler)
+	if !ok {
+		return blocker.ReconcileResult{}, nil
+	}
+
+	blockedIPs, err := m.storage.GetBlockedIPs()
+	if err != nil {
+		return blocker.ReconcileResult{}, fmt.Errorf("failed to read blocked IPs: %w", err)
+	}
+
+	// Collect the active blocks the firewall should enforce
+	now := time.Now()
+	blocks := make(map[string]time.Time, len(blockedIPs))
+	for _, status := range blockedIPs {
+		if !status.IsPermanent && !now.Before(status.BlockedUntil) {
+			continue
+		}
+		if m.matcher.IsWhitelisted(status.IP) || mode(status.IP) != config.RampOSBlock {
+			continue
+		}
+		if status.IsPermanent {
+			blocks[status.IP] = time.Time{}
+		} else {
+			blocks[status.IP] = status.BlockedUntil
+		}
+	}
+
+	result, err := reconciler.Reconcile(blocks)
+	if len(result.Added) > 0 || len(result.Removed) > 0 {
+		m.logger.Printf("Reconciled firewall with storage: applied missing rules for %d IPs, removed orphaned rules for %d IPs",
+			len(result.Added), len(result.Removed))
+	}
+	return result, err
+}
@@ -0,0 +1,111 @@
+package middleware_test
+
+import (
+	"errors"
+	"io"
+	"log"
+	"testing"
+	"time"
+
+	"github.com/headswim/whoen/blocker"
+	"github.com/headswim/whoen/config"
+	"github.com/headswim/whoen/middleware"
+	"github.com/headswim/whoen/storage"
+	"github.com/headswim/whoen/whoentest"
+)
+
+// reconcilingBlocker records the blocks it is asked to reconcile
+type reconcilingBlocker struct {
+	*whoentest.Blocker
+	blocks map[string]time.Time
+	err    error
+}
+
+func (b *reconcilingBlocker) Reconcile(blocks map[string]time.Time) (blocker.ReconcileResult, error) {
+	b.blocks = blocks
+	return blocker.ReconcileResult{Added: []string{"192.0.2.1"}}, b.err
+}
+
+// listFailingStorage fails to list the blocked IPs when err is set
+type listFailingStorage struct {
+	*storage.KVStorage
+	err error
+}
+
+func (s *listFailingStorage) GetBlockedIPs() ([]storage.BlockStatus, error) {
+	if s.err != nil {
+		return nil, s.err
+	}
+	return s.KVStorage.GetBlockedIPs()
+}
+
+// TestReconcile checks that the middleware asks the blocker to enforce the
+// active blocks in storage that are not whitelisted, and passes on failures
+func TestReconcile(t *testing.T) {
+	cfg := whoentest.Config()
+	config.ValidateConfig(&cfg)
+	cfg.SystemType = "linux"
+
+	store := &listFailingStorage{KVStorage: whoentest.NewStorage()}
+	b := &reconcilingBlocker{Blocker: whoentest.NewBlocker()}
+	m := whoentest.NewMatcher()
+	m.Whitelist("192.0.2.4")
+	mw, err := middleware.New(middleware.Options{
+		Config:          cfg,
+		Storage:         store,
+		Matcher:         m,
+		Blocker:         b,
+		Logger:          log.New(io.Discard, "", 0),
+		GracePeriod:     cfg.GracePeriod,
+		TimeoutEnabled:  cfg.TimeoutEnabled,
+		TimeoutDuration: cfg.TimeoutDuration,
+		TimeoutIncrease: cfg.TimeoutIncrease,
+	})
+	if err != nil {
+		t.Fatalf("failed to create middleware: %v", err)
+	}
+	defer mw.Close()
+
+	until := time.Now().Add(time.Hour).Truncate(time.Second)
+	store.BlockIP("192.0.2.1", until, false, "/.env")
+	store.BlockIP("192.0.2.2", time.Time{}, true, "/.env")
+	store.BlockIP("192.0.2.3", time.Now().Add(-time.Minute), false, "/.env") // Expired
+	store.BlockIP("192.0.2.4", until, false, "/.env")                        // Whitelisted
+
+	result, err := mw.Reconcile()
+	if err != nil || len(result.Added) != 1 {
+		t.Fatalf("Reconcile = %+v, %v, want the blocker's result", result, err)
+	}
+	if len(b.blocks) != 2 || !b.blocks["192.0.2.1"].Equal(until) || !b.blocks["192.0.2.2"].IsZero() {
+		t.Errorf("blocker asked to enforce %v, want 192.0.2.1 until %v and 192.0.2.2 for good", b.blocks, until)
+	}
+
+	b.err = errors.New("iptables failed")
+	if _, err := mw.Reconcile(); !errors.Is(err, b.err) {
+		t.Errorf("Reconcile with a failing blocker: %v, want its error", err)
+	}
+	b.err = nil
+	b.blocks = nil
+	store.err = errors.New("storage down")
+	if _, err := mw.Reconcile(); !errors.Is(err, store.err) {
+		t.Errorf("Reconcile with a failing storage: %v, want its error", err)
+	}
+	if b.blocks != nil {
+		t.Error("blocker asked to reconcile although storage failed")
+	}
+}
+
+// TestReconcileWithoutReconciler checks that blockers that cannot read the
+// firewall are left alone
+func TestReconcileWithoutReconciler(t *testing.T) {
+	h := whoentest.New(t, whoentest.Config(), whoentest.NewMatcher())
+	h.Storage.BlockIP("192.0.2.1", time.Time{}, true, "/.env")
+	h.Blocker.Reset()
+
+	if result, err := h.Middleware.Reconcile(); err != nil || len(result.Added)+len(result.Removed) != 0 {
+		t.Errorf("Reconcile = %+v, %v, want nothing done", result, err)
+	}
+	if calls := h.Blocker.Calls(); len(calls) != 0 {
+		t.Errorf("blocker called %v, want nothing", calls)
+	}
+}
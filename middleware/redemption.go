@@ -0,0 +1,182 @@
+package middleware
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/headswim/whoen/storage"
+)
+
+// redemption counts the legitimate requests of IPs with malicious requests on
+// record, for Config.RedemptionRequests
+type redemption struct {
+	mutex      sync.Mutex
+	legitimate map[string]int // Legitimate requests of each IP since its last malicious request or redemption
+
+	// active is set while legitimate is not empty, so clean requests skip
+	// the lock while no IP is on record
+	active atomic.Bool
+}
+
+// watchRedemption starts counting the legitimate requests of an IP that just
+// made a malicious one
+func (m *Middleware) watchRedemption(ip string) {
+	if m.options.Config.RedemptionRequests <= 0 {
+		return
+	}
+
+	m.redemption.mutex.Lock()
+	defer m.redemption.mutex.Unlock()
+	if m.redemption.legitimate == nil {
+		m.redemption.legitimate = make(map[string]int)
+	}
+	m.redemption.legitimate[ip] = 0
+	m.redemption.active.Store(true)
+}
+
+// countLegitimate counts a clean request of an IP, working off one of its
+// malicious requests every Config.RedemptionRequests legitimate ones
+func (m *Middleware) countLegitimate(ip string) {
+	needed := m.options.Config.RedemptionRequests
+	if needed <= 0 || !m.redemption.active.Load() {
+		return
+	}
+
+	m.redemption.mutex.Lock()
+	count, watched := m.redemption.legitimate[ip]
+	if watched {
+		count = (count + 1) % needed
+		m.redemption.legitimate[ip] = count
+	}
+	m.redemption.mutex.Unlock()
+	if !watched || count != 0 {
+		return
+	}
+
+	counter, found, err := m.requestCounter(ip)
+	if err != nil {
+		m.logger.Printf("Error reading request counter of IP %s: %v", ip, err)
+		return
+	}
+	if !found {
+		m.forgetRedemption(ip)
+		return
+	}
+	m.logger.Printf("IP %s sent %d legitimate requests, lowering its request count", ip, needed)
+	m.storeRedeemed(redeemed(counter, 1))
+}
+
+// redeemQuiet works off one malicious request of every IP for each
+// Config.RedemptionQuiet it has gone without one. Time spent blocked does
+// not count, and permanently banned IPs are left alone. It also forgets the
+// IPs whose counters are gone.
+func (m *Middleware) redeemQuiet(blockedIPs []storage.BlockStatus) error {
+	quiet := m.options.Config.RedemptionQuiet
+	if quiet <= 0 && !m.redemption.active.Load() {
+		return nil
+	}
+
+	counters, err := m.storage.GetAllRequestCounts()
+	if err != nil {
+		return err
+	}
+	m.pruneRedemption(counters)
+	if quiet <= 0 {
+		return nil
+	}
+
+	blocks := make(map[string]storage.BlockStatus, len(blockedIPs))
+	for _, status := range blockedIPs {
+		blocks[status.IP] = status
+	}
+
+	now := time.Now()
+	for ip, counter := range counters {
+		counter.IP = ip
+		since := latest(counter.LastSeen, counter.RedeemedAt)
+		if status, ok := blocks[ip]; ok {
+			if status.IsPermanent {
+				continue
+			}
+			since = latest(since, status.BlockedUntil)
+		}
+
+		periods := int(now.Sub(since) / quiet)
+		if periods <= 0 || counter.Count <= 0 {
+			continue
+		}
+		m.logger.Printf("IP %s has been quiet for %v, lowering its request count by %d", ip, now.Sub(since).Truncate(quiet), periods)
+		counter = redeemed(counter, periods)
+		counter.RedeemedAt = since.Add(time.Duration(periods) * quiet)
+		m.storeRedeemed(counter)
+	}
+	return nil
+}
+
+// pruneRedemption forgets the legitimate requests of IPs without a counter
+func (m *Middleware) pruneRedemption(counters map[string]storage.RequestCounter) {
+	m.redemption.mutex.Lock()
+	defer m.redemption.mutex.Unlock()
+
+	for ip := range m.redemption.legitimate {
+		if _, ok := counters[ip]; !ok {
+			delete(m.redemption.legitimate, ip)
+		}
+	}
+	m.redemption.active.Store(len(m.redemption.legitimate) > 0)
+}
+
+// forgetRedemption stops counting the legitimate requests of an IP
+func (m *Middleware) forgetRedemption(ip string) {
+	m.redemption.mutex.Lock()
+	defer m.redemption.mutex.Unlock()
+
+	delete(m.redemption.legitimate, ip)
+	m.redemption.active.Store(len(m.redemption.legitimate) > 0)
+}
+
+// requestCounter reads the counter of an IP, whole if the storage supports
+// it and otherwise just its count
+func (m *Middleware) requestCounter(ip string) (storage.RequestCounter, bool, error) {
+	if getter, ok := m.storage.(storage.CounterGetter); ok {
+		return getter.GetRequestCounter(ip)
+	}
+	count, err := m.storage.GetRequestCount(ip)
+	return storage.RequestCounter{IP: ip, Count: count}, count > 0, err
+}
+
+// storeRedeemed writes a lowered counter, removing it once nothing is left
+func (m *Middleware) storeRedeemed(counter storage.RequestCounter) {
+	var err error
+	if counter.Count <= 0 {
+		m.forgetRedemption(counter.IP)
+		err = m.storage.ResetRequestCount(counter.IP)
+	} else if putter, ok := m.storage.(storage.CounterPutter); ok {
+		err = putter.PutRequestCounter(counter)
+	} else {
+		err = m.storage.SetRequestCount(counter.IP, counter.Count, counter.LastPath)
+	}
+	if err != nil {
+		m.logger.Printf("Error lowering request count of IP %s: %v", counter.IP, err)
+	}
+}
+
+// redeemed returns a counter with n malicious requests worked off, its score
+// lowered by their average weight
+func redeemed(counter storage.RequestCounter, n int) storage.RequestCounter {
+	n = min(n, counter.Count)
+	if counter.Count > 0 {
+		counter.Score -= counter.Score * n / counter.Count
+	}
+	counter.Count -= n
+	return counter
+}
+
+// latest returns the later of two times
+func latest(a, b time.Time) time.Time {
+	if b.After(a) {
+		return b
+	}
+	return a
+}
@@ -0,0 +1,168 @@
+package middleware
+
+import (
+	"fmt"
+	"path/filepath"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/headswim/whoen/events"
+	"github.com/headswim/whoen/matcher"
+	"github.com/headswim/whoen/storage"
+)
+
+// reloadDelay lets a burst of file events settle before a file is reloaded,
+// since editors and deploy tools often write a file in several steps
+const reloadDelay = 200 * time.Millisecond
+
+// loadPatternsFile applies the patterns file to the matcher. Patterns that
+// were in the file before and are gone now are removed again.
+func (m *Middleware) loadPatternsFile() error {
+	path := m.options.Config.PatternsFile
+	manager, ok := m.matcher.(matcher.PatternManager)
+	if path == "" || !ok {
+		return nil
+	}
+
+	patterns, err := matcher.ReadPatternsFile(path)
+	if err != nil {
+		return err
+	}
+
+	m.fileMutex.Lock()
+	defer m.fileMutex.Unlock()
+
+	added, removed := diffLines(m.filePatterns, patterns)
+	manager.RemovePatterns(removed...)
+	manager.AddPatterns(added...)
+	m.filePatterns = patterns
+
+	m.logger.Printf("Loaded %d patterns from %s (%d added, %d removed)", len(patterns), path, len(added), len(removed))
+	return nil
+}
+
+// loadWhitelistFile applies the whitelist file to the matcher. IPs that were
+// in the file before and are gone now are removed again.
+func (m *Middleware) loadWhitelistFile() error {
+	path := m.options.Config.WhitelistFile
+	manager, ok := m.matcher.(matcher.WhitelistManager)
+	if path == "" || !ok {
+		return nil
+	}
+
+	ips, err := storage.ReadWhitelist(path)
+	if err != nil {
+		return err
+	}
+
+	m.fileMutex.Lock()
+	defer m.fileMutex.Unlock()
+
+	added, removed := diffLines(m.fileWhitelist, ips)
+	manager.RemoveWhitelist(removed...)
+	manager.AddWhitelist(added...)
+	m.fileWhitelist = ips
+
+	if len(added) > 0 || len(removed) > 0 {
+		m.logger.Printf("Loaded %d whitelisted IPs from %s (%d added, %d removed)", len(ips), path, len(added), len(removed))
+	}
+	return nil
+}
+
+// watchFiles reloads the patterns and whitelist files whenever they change,
+// until Close is called. The directories are watched rather than the files,
+// so files replaced by renaming and files created later are picked up too.
+func (m *Middleware) watchFiles() error {
+	loaders := make(map[string]func() error)
+	if path := m.options.Config.PatternsFile; path != "" {
+		loaders[filepath.Clean(path)] = m.loadPatternsFile
+	}
+	if path := m.options.Config.WhitelistFile; path != "" {
+		loaders[filepath.Clean(path)] = m.loadWhitelistFile
+	}
+	if len(loaders) == 0 {
+		return nil
+	}
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return fmt.Errorf("failed to create file watcher: %w", err)
+	}
+
+	dirs := make(map[string]bool)
+	for path := range loaders {
+		dir := filepath.Dir(path)
+		if dirs[dir] {
+			continue
+		}
+		if err := watcher.Add(dir); err != nil {
+			watcher.Close()
+			return fmt.Errorf("failed to watch %s: %w", dir, err)
+		}
+		dirs[dir] = true
+	}
+
+	go func() {
+		defer watcher.Close()
+
+		pending := make(map[string]bool)
+		timer := time.NewTimer(reloadDelay)
+		timer.Stop()
+
+		for {
+			select {
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if _, watched := loaders[filepath.Clean(event.Name)]; watched {
+					pending[filepath.Clean(event.Name)] = true
+					timer.Reset(reloadDelay)
+				}
+
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				m.logger.Printf("Error watching files: %v", err)
+
+			case <-timer.C:
+				for path := range pending {
+					if err := loaders[path](); err != nil {
+						m.logger.Printf("Error reloading %s: %v", path, err)
+						continue
+					}
+					m.emit(events.Event{Type: events.FileReloaded, Message: path})
+				}
+				pending = make(map[string]bool)
+
+			case <-m.ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return nil
+}
+
+// diffLines returns the entries of next that are not in previous, and the
+// entries of previous that are not in next
+func diffLines(previous, next []string) (added, removed []string) {
+	before := make(map[string]bool, len(previous))
+	for _, line := range previous {
+		before[line] = true
+	}
+	after := make(map[string]bool, len(next))
+	for _, line := range next {
+		after[line] = true
+		if !before[line] {
+			added = append(added, line)
+		}
+	}
+	for _, line := range previous {
+		if !after[line] {
+			removed = append(removed, line)
+		}
+	}
+	return added, removed
+}
@@ -0,0 +1,136 @@
+package middleware
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/headswim/whoen/config"
+	"github.com/headswim/whoen/matcher"
+)
+
+const blockedMessage = "This request has been blocked for security reasons"
+
+// intercept runs a request through HandleRequest and writes the response when the
+// request must not reach the application. It reports whether a response was written,
+// and otherwise returns the request to pass on, carrying a RequestStatus in its
+// context when whoen found it suspicious. jsonBody selects a JSON body for the
+// blocked response instead of plain text.
+func (m *Middleware) intercept(w http.ResponseWriter, r *http.Request, jsonBody bool) (bool, *http.Request) {
+	// Excluded requests are not inspected at all
+	if m.skip(r) {
+		return false, r
+	}
+
+	// Get client IP
+	clientIP, err := getClientIP(r)
+	if err != nil {
+		m.logger.Printf("Error getting client IP: %v", err)
+		return false, r
+	}
+
+	// Challenge solutions are answered here, never by the application
+	if m.handleChallenge(w, r, clientIP) {
+		return true, r
+	}
+
+	// So are appeals, which come from blocked IPs
+	if m.handleAppeal(w, r, clientIP) {
+		return true, r
+	}
+
+	// Check if the request is malicious
+	var status RequestStatus
+	blocked, err := m.handleRequest(r, &status)
+	if err != nil {
+		m.logger.Printf("Error handling request from %s: %v", clientIP, err)
+		return false, r
+	}
+
+	if blocked {
+		// Challenged clients get the challenge page, blocked IPs and everyone else a 403
+		if m.challengeRequired(r, clientIP) {
+			if ipBlocked, _ := m.blocker.IsBlocked(clientIP); !ipBlocked {
+				m.writeChallenge(w, r, clientIP)
+				return true, r
+			}
+		}
+		m.logger.Printf("Blocked malicious request from %s to %s", clientIP, r.URL.Path)
+		m.writeBlocked(w, r, clientIP, jsonBody)
+		return true, r
+	}
+
+	// In deceive mode known malicious paths get fake content instead of
+	// reaching the application
+	if m.serveDecoy(w, r, clientIP, status) {
+		return true, r
+	}
+
+	return false, status.attach(r)
+}
+
+// skip reports whether a request is excluded by Options.SkipPaths or Options.SkipFunc
+func (m *Middleware) skip(r *http.Request) bool {
+	for _, prefix := range m.options.SkipPaths {
+		if strings.HasPrefix(r.URL.Path, prefix) {
+			return true
+		}
+	}
+	return m.options.SkipFunc != nil && m.options.SkipFunc(r)
+}
+
+// exempt reports whether Options.ExemptFunc exempts a request from counting
+// and blocking. A panicking ExemptFunc is logged and exempts nothing.
+func (m *Middleware) exempt(r *http.Request) (exempt bool) {
+	if m.options.ExemptFunc == nil {
+		return false
+	}
+	m.callHook("ExemptFunc", func() { exempt = m.options.ExemptFunc(r) })
+	return exempt
+}
+
+// newDecoys indexes the configured decoys by lowercase path
+func newDecoys(cfg config.Config) map[string]config.Decoy {
+	if !cfg.DeceiveEnabled {
+		return nil
+	}
+
+	decoys := cfg.Decoys
+	if decoys == nil {
+		decoys = config.DefaultDecoys()
+	}
+
+	indexed := make(map[string]config.Decoy, len(decoys))
+	for path, decoy := range decoys {
+		indexed[strings.ToLower(path)] = decoy
+	}
+	return indexed
+}
+
+// serveDecoy writes the fake response configured for a path, if any, when
+// handleRequest found the request malicious and did not block it. Exempt
+// requests and IPs in log-only mode always reach the application.
+func (m *Middleware) serveDecoy(w http.ResponseWriter, r *http.Request, ip string, status RequestStatus) bool {
+	if len(m.decoys) == 0 || !status.Suspicious || status.exempt || m.logOnly(ip) {
+		return false
+	}
+
+	decoy, ok := m.decoys[matcher.NormalizePath(r.URL.Path)]
+	if !ok {
+		return false
+	}
+
+	code := decoy.Status
+	if code == 0 {
+		code = http.StatusOK
+	}
+	contentType := decoy.ContentType
+	if contentType == "" {
+		contentType = "text/plain; charset=utf-8"
+	}
+
+	m.logger.Printf("Served decoy for %s to %s", r.URL.Path, ip)
+	w.Header().Set("Content-Type", contentType)
+	w.WriteHeader(code)
+	w.Write([]byte(decoy.Body))
+	return true
+}
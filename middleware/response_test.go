@@ -0,0 +1,37 @@
+package middleware_test
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/headswim/whoen/blocker"
+	"github.com/headswim/whoen/config"
+	"github.com/headswim/whoen/whoentest"
+)
+
+// TestDecoyFollowsDecision checks that decoys are served only to requests
+// found malicious, never to whitelisted or already blocked IPs
+func TestDecoyFollowsDecision(t *testing.T) {
+	const canary = "DB_PASSWORD=canary"
+	cfg := whoentest.Config()
+	cfg.GracePeriod = 3
+	cfg.DeceiveEnabled = true
+	cfg.Decoys = map[string]config.Decoy{"/.env": {Body: canary}}
+	m := whoentest.NewMatcher("/.env")
+	m.Whitelist("192.0.2.2")
+	h := whoentest.New(t, cfg, m)
+
+	if rec := h.Request("192.0.2.1", "/.env"); rec.Code != http.StatusOK || rec.Body.String() != canary {
+		t.Errorf("malicious request got %d %q, want the decoy", rec.Code, rec.Body.String())
+	}
+	if rec := h.Request("192.0.2.2", "/.env"); rec.Body.String() == canary {
+		t.Error("whitelisted IP got the decoy, want the application")
+	}
+
+	if _, err := h.Blocker.Block("192.0.2.3", blocker.Ban, 0); err != nil {
+		t.Fatalf("failed to block: %v", err)
+	}
+	if rec := h.Request("192.0.2.3", "/.env"); rec.Code != http.StatusForbidden {
+		t.Errorf("blocked IP got %d %q, want %d", rec.Code, rec.Body.String(), http.StatusForbidden)
+	}
+}
@@ -0,0 +1,103 @@
+package middleware
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/headswim/whoen/audit"
+	"github.com/headswim/whoen/events"
+	"github.com/headswim/whoen/storage"
+)
+
+// ReviewQueue returns the permanent bans older than Config.PermanentBanReviewAge,
+// oldest first, or nil if the review is disabled
+func (m *Middleware) ReviewQueue() ([]storage.BlockStatus, error) {
+	age := m.options.Config.PermanentBanReviewAge
+	if age <= 0 {
+		return nil, nil
+	}
+
+	queue, err := storage.PermanentBansOlderThan(m.storage, age)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(queue, func(i, j int) bool {
+		return queue[i].BlockedAt.Before(queue[j].BlockedAt)
+	})
+	return queue, nil
+}
+
+// reviewPermanentBans emits a PermanentBanReview event for every ban that
+// entered the review queue since the last check
+func (m *Middleware) reviewPermanentBans() error {
+	queue, err := m.ReviewQueue()
+	if err != nil {
+		return err
+	}
+
+	m.reviewedMutex.Lock()
+	defer m.reviewedMutex.Unlock()
+
+	// Forget bans that left the queue, so they are surfaced again if re-issued
+	current := make(map[string]bool, len(queue))
+	var surfaced int
+	for _, status := range queue {
+		current[status.IP] = true
+		if m.reviewed[status.IP] {
+			continue
+		}
+		surfaced++
+		m.emit(events.Event{
+			Type:    events.PermanentBanReview,
+			IP:      status.IP,
+			Path:    status.LastRequestPath,
+			Message: fmt.Sprintf("permanent ban issued %s is due for review", status.BlockedAt.Format(time.RFC3339)),
+		})
+	}
+	m.reviewed = current
+
+	if surfaced > 0 {
+		m.logger.Printf("%d permanent bans older than %v are due for review (%d in queue)",
+			surfaced, m.options.Config.PermanentBanReviewAge, len(queue))
+	}
+	return nil
+}
+
+// ExpireBans lifts the permanent bans issued more than olderThan ago. The
+// records are kept as expired blocks, so history retention still applies.
+// It returns the number of bans lifted.
+func (a *Admin) ExpireBans(olderThan time.Duration, reason string) (int, error) {
+	m := a.middleware
+
+	queue, err := storage.PermanentBansOlderThan(m.storage, olderThan)
+	if err != nil {
+		return 0, err
+	}
+
+	expired := 0
+	for _, status := range queue {
+		previous := a.state(status.IP)
+
+		ok, err := storage.ExpireBan(m.storage, status.IP)
+		if err != nil {
+			return expired, fmt.Errorf("failed to expire ban of IP %s: %w", status.IP, err)
+		}
+		if !ok {
+			continue
+		}
+		if err := m.blocker.Unblock(status.IP); err != nil {
+			m.logger.Printf("Error unblocking IP %s: %v", status.IP, err)
+		}
+
+		expired++
+		m.publishUnblock(status.IP)
+		m.onUnblock(UnblockInfo{IP: status.IP, Source: SourceAdmin, Actor: a.actor, Reason: reason})
+		if err := a.record(audit.ActionExpire, status.IP, reason, previous); err != nil {
+			return expired, err
+		}
+	}
+
+	m.logger.Printf("%s expired %d permanent bans older than %v (reason: %s)", a.actor, expired, olderThan, reason)
+	return expired, nil
+}
@@ -0,0 +1,155 @@
+package middleware
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// TenantFunc names the tenant a request belongs to, such as its host or a
+// customer ID from a header, for PolicyRouter
+type TenantFunc func(r *http.Request) string
+
+// HostTenant names tenants by the host of the request, lower-cased and
+// without port, e.g. "api.example.com"
+func HostTenant(r *http.Request) string {
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.ToLower(strings.TrimSuffix(host, "."))
+}
+
+// PolicyRouter sends each request to the middleware of its tenant, so
+// tenants served by one process run with their own patterns, grace period,
+// score threshold and block durations, e.g. a strict API subdomain next to a
+// lenient marketing site. Each tenant's middleware is created from its own
+// Options and keeps its own counts and blocks unless they share a storage,
+// see Options.Storage.
+type PolicyRouter struct {
+	tenant   TenantFunc
+	fallback *Middleware
+
+	mutex    sync.RWMutex
+	policies map[string]*Middleware
+}
+
+// NewPolicyRouter creates a router that names tenants with tenant, HostTenant
+// if it is nil. Requests of tenants without a policy go to fallback, or pass
+// through unchecked if fallback is nil.
+func NewPolicyRouter(fallback *Middleware, tenant TenantFunc) *PolicyRouter {
+	if tenant == nil {
+		tenant = HostTenant
+	}
+	return &PolicyRouter{
+		tenant:   tenant,
+		fallback: fallback,
+		policies: make(map[string]*Middleware),
+	}
+}
+
+// Add routes the requests of a tenant to a middleware. With HostTenant, a
+// tenant like "*.example.com" matches every subdomain of example.com that
+// has no policy of its own.
+func (p *PolicyRouter) Add(tenant string, m *Middleware) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.policies[tenant] = m
+}
+
+// AddPolicy creates a middleware from options and routes the requests of a
+// tenant to it. Options.Tenant defaults to the tenant.
+func (p *PolicyRouter) AddPolicy(tenant string, options Options) (*Middleware, error) {
+	if options.Tenant == "" {
+		options.Tenant = tenant
+	}
+	m, err := New(options)
+	if err != nil {
+		return nil, err
+	}
+	p.Add(tenant, m)
+	return m, nil
+}
+
+// Route returns the middleware for a request: the policy of its tenant, of
+// the closest wildcard above it, or the fallback, which may be nil
+func (p *PolicyRouter) Route(r *http.Request) *Middleware {
+	tenant := p.tenant(r)
+
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+
+	if m, ok := p.policies[tenant]; ok {
+		return m
+	}
+	for name := tenant; ; {
+		dot := strings.IndexByte(name, '.')
+		if dot < 0 {
+			break
+		}
+		name = name[dot+1:]
+		if m, ok := p.policies["*."+name]; ok {
+			return m
+		}
+	}
+	return p.fallback
+}
+
+// Middlewares returns the middlewares of every tenant and the fallback, each
+// once
+func (p *PolicyRouter) Middlewares() []*Middleware {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+
+	seen := make(map[*Middleware]bool, len(p.policies)+1)
+	var middlewares []*Middleware
+	add := func(m *Middleware) {
+		if m != nil && !seen[m] {
+			seen[m] = true
+			middlewares = append(middlewares, m)
+		}
+	}
+	add(p.fallback)
+	for _, m := range p.policies {
+		add(m)
+	}
+	return middlewares
+}
+
+// Handler wraps an http.Handler, checking each request with the middleware
+// of its tenant
+func (p *PolicyRouter) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		m := p.Route(r)
+		if m == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		// Stop here if whoen already answered the request
+		handled, r := m.intercept(w, r, false)
+		if handled {
+			return
+		}
+
+		// Continue processing the request, watching the response for request rules
+		w, observe := m.watchResponse(w, r)
+		next.ServeHTTP(w, r)
+		observe()
+	})
+}
+
+// Close closes the middlewares of every tenant and the fallback, returning
+// their errors joined
+func (p *PolicyRouter) Close() error {
+	var errs []error
+	for _, m := range p.Middlewares() {
+		if err := m.Close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
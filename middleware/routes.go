@@ -0,0 +1,102 @@
+package middleware
+
+import (
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/headswim/whoen/matcher"
+)
+
+// routeTable holds the routes the application serves, each split into its
+// path segments. A segment starting with ":" or enclosed in braces matches
+// any one segment, one starting with "*" the rest of the path.
+type routeTable struct {
+	routes [][]string
+}
+
+// routes holds the registered route table, replaced as a whole so requests
+// read it without locking
+type routes struct {
+	table atomic.Pointer[routeTable]
+	mutex sync.Mutex // Serializes RegisterRoutes
+}
+
+// RegisterRoutes tells the middleware which paths the application serves,
+// e.g. "/users/:id", "/files/{name}" or "/static/*filepath", in the syntax
+// of Gin, Chi or httprouter. Once routes are registered, the score of a
+// pattern match is scaled by Config.KnownRouteWeight when the path is a
+// route and by Config.UnknownRouteWeight when it is not, and only matches on
+// unknown paths block instantly. It can be called several times, e.g. once
+// per router group; routes add up.
+func (m *Middleware) RegisterRoutes(routes []string) {
+	m.routes.mutex.Lock()
+	defer m.routes.mutex.Unlock()
+
+	table := &routeTable{}
+	if current := m.routes.table.Load(); current != nil {
+		table.routes = append(table.routes, current.routes...)
+	}
+	for _, route := range routes {
+		table.routes = append(table.routes, splitPath(matcher.NormalizePath(route)))
+	}
+	m.routes.table.Store(table)
+	m.logger.Printf("Registered %d routes, %d in total", len(routes), len(table.routes))
+}
+
+// serves reports whether a normalized path is one of the routes
+func (t *routeTable) serves(path string) bool {
+	segments := splitPath(path)
+	for _, route := range t.routes {
+		if routeMatches(route, segments) {
+			return true
+		}
+	}
+	return false
+}
+
+// routeMatches reports whether a route's segments match a path's segments
+func routeMatches(route, segments []string) bool {
+	for i, segment := range route {
+		if strings.HasPrefix(segment, "*") {
+			return true
+		}
+		if i >= len(segments) {
+			return false
+		}
+		param := strings.HasPrefix(segment, ":") || (strings.HasPrefix(segment, "{") && strings.HasSuffix(segment, "}"))
+		if !param && segment != segments[i] {
+			return false
+		}
+	}
+	return len(route) == len(segments)
+}
+
+// splitPath splits a path into its segments, ignoring a trailing slash
+func splitPath(path string) []string {
+	path = strings.Trim(path, "/")
+	if path == "" {
+		return nil
+	}
+	return strings.Split(path, "/")
+}
+
+// weighByRoute scales the score of a path pattern match by whether the
+// application serves the path. Matches stay as they are until routes are
+// registered.
+func (m *Middleware) weighByRoute(path string, match matcher.Match) matcher.Match {
+	table := m.routes.table.Load()
+	if table == nil || match.Location != matcher.LocationPath {
+		return match
+	}
+
+	percent := m.options.Config.UnknownRouteWeight
+	if table.serves(matcher.NormalizePath(path)) {
+		percent = m.options.Config.KnownRouteWeight
+		match.Instant = false
+	}
+	if percent > 0 {
+		match.Weight = max(match.Weight*percent/100, 1)
+	}
+	return match
+}
@@ -0,0 +1,246 @@
+package middleware
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/headswim/whoen/config"
+	"github.com/headswim/whoen/matcher"
+)
+
+// requestRules counts the requests of each IP that match Config.RequestRules
+type requestRules struct {
+	rules     []config.RequestRule
+	responses bool // Whether any rule matches on the response status
+	limit     int  // Counters kept at most, zero for no limit
+
+	mutex  sync.Mutex
+	counts map[ruleKey]*ruleCount
+}
+
+// ruleKey identifies the counter of a rule for an IP
+type ruleKey struct {
+	rule int
+	ip   string
+}
+
+// ruleCount counts matching requests within a window starting at start
+type ruleCount struct {
+	start time.Time
+	count int
+}
+
+// newRequestRules sets up the valid Config.RequestRules, and the scanner rule
+// with Config.ScannerDetection. It returns nil without any rules.
+func (m *Middleware) newRequestRules() *requestRules {
+	cfg := m.options.Config
+	rules := make([]config.RequestRule, 0, len(cfg.RequestRules)+1)
+	candidates := cfg.RequestRules
+	if cfg.ScannerDetection {
+		candidates = append(append([]config.RequestRule(nil), candidates...), cfg.ScannerRule())
+	}
+	for _, rule := range candidates {
+		if err := rule.Validate(); err != nil {
+			m.logger.Printf("Error: ignoring %v", err)
+			continue
+		}
+		rules = append(rules, rule)
+	}
+	if len(rules) == 0 {
+		return nil
+	}
+
+	counter := &requestRules{
+		rules:  rules,
+		limit:  cfg.MaxTrackedIPs,
+		counts: make(map[ruleKey]*ruleCount),
+	}
+	for _, rule := range rules {
+		counter.responses = counter.responses || len(rule.Status) > 0
+	}
+	return counter
+}
+
+// count adds a request to the counters of the rules it matches and returns
+// the first rule whose threshold it exceeds. Without a status the request is
+// counted for the rules without status codes, with one for the rules that
+// list it.
+func (c *requestRules) count(ip, method, path string, status int) (config.RequestRule, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	now := time.Now()
+	var exceeded *config.RequestRule
+	for i := range c.rules {
+		rule := &c.rules[i]
+		if (status == 0) != (len(rule.Status) == 0) || !rule.MatchesRequest(method, path) || !rule.MatchesStatus(status) {
+			continue
+		}
+
+		key := ruleKey{rule: i, ip: ip}
+		counter, ok := c.counts[key]
+		if !ok {
+			// Stop tracking new IPs once full, rather than growing without bound
+			if c.limit > 0 && len(c.counts) >= c.limit {
+				c.prune(now)
+				if len(c.counts) >= c.limit {
+					continue
+				}
+			}
+			counter = &ruleCount{start: now}
+			c.counts[key] = counter
+		} else if now.Sub(counter.start) > rule.Window {
+			*counter = ruleCount{start: now}
+		}
+
+		counter.count++
+		if counter.count > rule.Threshold && exceeded == nil {
+			exceeded = rule
+		}
+	}
+
+	if exceeded == nil {
+		return config.RequestRule{}, false
+	}
+	return *exceeded, true
+}
+
+// prune drops the counters whose window has passed. The caller must hold the lock.
+func (c *requestRules) prune(now time.Time) {
+	for key, counter := range c.counts {
+		if now.Sub(counter.start) > c.rules[key.rule].Window {
+			delete(c.counts, key)
+		}
+	}
+}
+
+// cleanupRequestRules drops the request rule counters whose window has passed
+func (m *Middleware) cleanupRequestRules() {
+	if m.requestRules == nil {
+		return
+	}
+
+	m.requestRules.mutex.Lock()
+	defer m.requestRules.mutex.Unlock()
+	m.requestRules.prune(time.Now())
+}
+
+// matchRequestRules counts a request for the request rules without status
+// codes, and returns a match once it exceeds the threshold of one
+func (m *Middleware) matchRequestRules(r *http.Request, ip string) (matcher.Match, bool) {
+	if m.requestRules == nil {
+		return matcher.Match{}, false
+	}
+
+	rule, ok := m.requestRules.count(ip, r.Method, matcher.NormalizePath(r.URL.Path), 0)
+	if !ok {
+		return matcher.Match{}, false
+	}
+	return matcher.Match{Pattern: "rule:" + rule.Name, Weight: rule.Weight, Location: matcher.LocationPath}, true
+}
+
+// ObserveResponse counts a response for the request rules with status codes.
+// Once a client IP exceeds the threshold of one, the request counts as
+// malicious and may get the IP blocked. The HTTP, Chi and Gin middlewares
+// call it for every request they pass on; other integrations can call it
+// with the status they sent.
+func (m *Middleware) ObserveResponse(r *http.Request, status int) {
+	if m.requestRules == nil || !m.requestRules.responses || status == 0 || m.skip(r) || m.exempt(r) {
+		return
+	}
+
+	ip, err := getClientIP(r)
+	if err != nil || m.matcher.IsWhitelisted(ip) {
+		return
+	}
+	rule, ok := m.requestRules.count(ip, r.Method, matcher.NormalizePath(r.URL.Path), status)
+	if !ok {
+		return
+	}
+
+	// Blocked IPs only get here with the firewall off, their requests are
+	// already rejected
+	if blocked, _ := m.blocker.IsBlocked(ip); blocked {
+		return
+	}
+
+	path := r.URL.Path
+	match := matcher.Match{Pattern: "rule:" + rule.Name, Weight: rule.Weight, Location: matcher.LocationResponse, Matched: fmt.Sprint(status)}
+	m.logger.Printf("Request from %s to %s exceeded request rule %q with a %d response", ip, path, rule.Name, status)
+	m.emitDetection(ip, path, match)
+	if _, err := m.recordMalicious(ip, path, match, nil, nil); err != nil {
+		m.logger.Printf("Error recording request rule match for %s: %v", ip, err)
+	}
+}
+
+// watchResponse returns a ResponseWriter that records the status the
+// application sends, and a function that passes it to ObserveResponse once
+// the application is done. Without request rules on statuses, w is returned
+// unchanged.
+func (m *Middleware) watchResponse(w http.ResponseWriter, r *http.Request) (http.ResponseWriter, func()) {
+	if m.requestRules == nil || !m.requestRules.responses {
+		return w, func() {}
+	}
+
+	recorder := &statusRecorder{ResponseWriter: w}
+	return recorder, func() {
+		// Handlers that write nothing send a 200, hijacked connections nothing
+		if recorder.status == 0 && !recorder.hijacked {
+			recorder.status = http.StatusOK
+		}
+		m.ObserveResponse(r, recorder.status)
+	}
+}
+
+// statusRecorder is a ResponseWriter that remembers the status written
+type statusRecorder struct {
+	http.ResponseWriter
+	status   int
+	hijacked bool
+}
+
+// WriteHeader records the status and writes it
+func (w *statusRecorder) WriteHeader(status int) {
+	// Informational responses precede the final one
+	if w.status == 0 && status >= 200 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// Write records an implicit 200 and writes the body
+func (w *statusRecorder) Write(data []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(data)
+}
+
+// Flush flushes the underlying ResponseWriter, if it can
+func (w *statusRecorder) Flush() {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Hijack takes over the connection of the underlying ResponseWriter, if it can
+func (w *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("%T does not support hijacking", w.ResponseWriter)
+	}
+	w.hijacked = true
+	return hijacker.Hijack()
+}
+
+// Unwrap returns the underlying ResponseWriter, for http.ResponseController
+func (w *statusRecorder) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,119 @@
+package middleware
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/headswim/whoen/config"
+	"github.com/headswim/whoen/events"
+)
+
+// policyWindowCheck is how often watchPolicyWindows looks for windows that
+// opened or closed
+const policyWindowCheck = time.Minute
+
+// newPolicyWindows validates the configured policy windows, dropping and
+// logging the invalid ones
+func (m *Middleware) newPolicyWindows() []config.PolicyWindow {
+	windows := make([]config.PolicyWindow, 0, len(m.options.Config.PolicyWindows))
+	for _, window := range m.options.Config.PolicyWindows {
+		if err := window.Validate(); err != nil {
+			m.logger.Printf("Error: ignoring %v", err)
+			continue
+		}
+		windows = append(windows, window)
+	}
+	return windows
+}
+
+// policyWindow returns the first open policy window, and false without one
+func (m *Middleware) policyWindow() (*config.PolicyWindow, bool) {
+	now := time.Now()
+	for i := range m.policyWindows {
+		if m.policyWindows[i].Open(now) {
+			return &m.policyWindows[i], true
+		}
+	}
+	return nil, false
+}
+
+// thresholds returns the grace period and score threshold in effect, those of
+// the open policy window if it overrides them
+func (m *Middleware) thresholds() (gracePeriod, scoreThreshold int) {
+	gracePeriod, scoreThreshold = m.options.GracePeriod, m.options.Config.ScoreThreshold
+	if window, ok := m.policyWindow(); ok {
+		if window.GracePeriod != nil {
+			gracePeriod = *window.GracePeriod
+		}
+		if window.ScoreThreshold != nil {
+			scoreThreshold = *window.ScoreThreshold
+		}
+	}
+	return gracePeriod, scoreThreshold
+}
+
+// describePolicyWindow lists when a window opens and what it overrides
+func describePolicyWindow(window *config.PolicyWindow) string {
+	var when string
+	if window.Start == "" && window.End == "" {
+		when = fmt.Sprintf("%s to %s", window.From.Format(time.RFC3339), window.Until.Format(time.RFC3339))
+	} else {
+		when = fmt.Sprintf("%s-%s", window.Start, window.End)
+		if len(window.Days) > 0 {
+			when += " on " + strings.Join(window.Days, ",")
+		}
+		if window.Timezone != "" {
+			when += " " + window.Timezone
+		}
+	}
+
+	var overrides []string
+	if window.GracePeriod != nil {
+		overrides = append(overrides, fmt.Sprintf("grace period %d", *window.GracePeriod))
+	}
+	if window.ScoreThreshold != nil {
+		overrides = append(overrides, fmt.Sprintf("score threshold %d", *window.ScoreThreshold))
+	}
+	if window.TimeoutDuration > 0 {
+		overrides = append(overrides, fmt.Sprintf("timeout %v", window.TimeoutDuration))
+	}
+	if window.NoPermanentBans {
+		overrides = append(overrides, "no permanent bans")
+	}
+	if len(overrides) == 0 {
+		overrides = append(overrides, "no overrides")
+	}
+	return fmt.Sprintf("%q %s: %s", window.Name, when, strings.Join(overrides, ", "))
+}
+
+// watchPolicyWindows logs and reports policy windows opening and closing,
+// until Close is called. Decisions look up the open window themselves, so
+// they do not wait for this check.
+func (m *Middleware) watchPolicyWindows() {
+	ticker := time.NewTicker(policyWindowCheck)
+	defer ticker.Stop()
+
+	var active *config.PolicyWindow
+	for {
+		window, _ := m.policyWindow()
+		if window != active {
+			if active != nil {
+				m.logger.Printf("Policy window %q closed", active.Name)
+				m.emit(events.Event{Type: events.PolicyWindowClosed, Message: active.Name})
+			}
+			if window != nil {
+				message := describePolicyWindow(window)
+				m.logger.Printf("Policy window opened: %s", message)
+				m.emit(events.Event{Type: events.PolicyWindowOpened, Message: message})
+			}
+			active = window
+		}
+
+		select {
+		case <-ticker.C:
+		case <-m.ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,28 @@
+package middleware
+
+import (
+	"github.com/headswim/whoen/sshguard"
+)
+
+// ReportSSH counts a failed SSH login or probe against its IP, like a
+// malicious request scored Config.SSHWeight, and reports whether the IP is
+// to be refused. Applications reading sshd's log themselves, e.g. from the
+// journal, pass the events sshguard.Parse finds.
+func (m *Middleware) ReportSSH(event sshguard.Event) (Decision, error) {
+	decision, err := m.Engine().Report(event.IP, event.Path(), m.options.Config.SSHWeight)
+	if err != nil {
+		m.logger.Printf("Error recording SSH %s from %s: %v", event.Kind, event.IP, err)
+	}
+	return decision, err
+}
+
+// watchSSHLog follows sshd's log for failed logins until Close is called
+func (m *Middleware) watchSSHLog() {
+	path := m.options.Config.SSHAuthLog
+	err := sshguard.Follow(m.ctx, path, sshguard.DefaultPollInterval, func(event sshguard.Event) {
+		m.ReportSSH(event)
+	})
+	if err != nil {
+		m.logger.Printf("Error following SSH log: %v", err)
+	}
+}
@@ -0,0 +1,193 @@
+package middleware_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/headswim/whoen/config"
+	"github.com/headswim/whoen/middleware"
+	"github.com/headswim/whoen/sshguard"
+	"github.com/headswim/whoen/whoentest"
+)
+
+const adminSecret = "test-secret"
+
+// failedLogin returns an sshd log line reporting a failed login from ip
+func failedLogin(ip string) string {
+	return "Oct 17 10:00:00 host sshd[1]: Failed password for root from " + ip + " port 1 ssh2\n"
+}
+
+// postAdmin sends an admin API request, signed unless unsigned is set, and
+// returns the response
+func postAdmin(t *testing.T, mw *middleware.Middleware, action string, request middleware.AdminRequest, unsigned bool) (int, middleware.AdminResponse) {
+	t.Helper()
+	body, _ := json.Marshal(request)
+	r := httptest.NewRequest(http.MethodPost, "/admin/"+action, bytes.NewReader(body))
+	if !unsigned {
+		if err := middleware.SignAdminRequest(r, body, adminSecret, "test"); err != nil {
+			t.Fatalf("failed to sign: %v", err)
+		}
+	}
+	w := httptest.NewRecorder()
+	mw.AdminHandler().ServeHTTP(w, r)
+
+	var response middleware.AdminResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatalf("invalid response %q: %v", w.Body.String(), err)
+	}
+	return w.Code, response
+}
+
+// TestReportSSH checks that failed SSH logins count towards a block like
+// malicious requests, and that whitelisted IPs are never refused
+func TestReportSSH(t *testing.T) {
+	cfg := whoentest.Config()
+	m := whoentest.NewMatcher()
+	m.Whitelist("192.0.2.9")
+	h := whoentest.New(t, cfg, m)
+
+	event := sshguard.Event{Kind: sshguard.FailedLogin, IP: "192.0.2.1", User: "root"}
+	reports := 0
+	for reports < 10 {
+		reports++
+		decision, err := h.Middleware.ReportSSH(event)
+		if err != nil {
+			t.Fatalf("ReportSSH failed: %v", err)
+		}
+		if decision.Blocked {
+			break
+		}
+	}
+	if !h.IsBlocked("192.0.2.1") || reports > cfg.GracePeriod+1 {
+		t.Errorf("blocked %v after %d failed logins, want blocked after at most %d", h.IsBlocked("192.0.2.1"), reports, cfg.GracePeriod+1)
+	}
+	if _, status, _ := h.Storage.IsIPBlocked("192.0.2.1"); status == nil || status.LastRequestPath != "/ssh/failed-login" {
+		t.Errorf("block recorded %+v, want the path /ssh/failed-login", status)
+	}
+
+	for i := 0; i < 10; i++ {
+		if decision, _ := h.Middleware.ReportSSH(sshguard.Event{Kind: sshguard.InvalidUser, IP: "192.0.2.9"}); decision.Blocked {
+			t.Fatal("whitelisted IP refused")
+		}
+	}
+}
+
+// isBlockedFailing is a blocker whose block lookups fail with err
+type isBlockedFailing struct {
+	*whoentest.Blocker
+	err error
+}
+
+func (b *isBlockedFailing) IsBlocked(ip string) (bool, error) {
+	if b.err != nil {
+		return false, b.err
+	}
+	return b.Blocker.IsBlocked(ip)
+}
+
+// TestAdminSSH checks the admin API endpoint log shippers report sshd log
+// lines and failed logins to, and its errors
+func TestAdminSSH(t *testing.T) {
+	cfg := whoentest.Config()
+	cfg.AdminSecret = adminSecret
+	config.ValidateConfig(&cfg)
+	cfg.SystemType = "linux"
+
+	b := &isBlockedFailing{Blocker: whoentest.NewBlocker()}
+	mw, err := middleware.New(middleware.Options{
+		Config:          cfg,
+		Storage:         whoentest.NewStorage(),
+		Matcher:         whoentest.NewMatcher(),
+		Blocker:         b,
+		Logger:          log.New(io.Discard, "", 0),
+		GracePeriod:     cfg.GracePeriod,
+		TimeoutEnabled:  cfg.TimeoutEnabled,
+		TimeoutDuration: cfg.TimeoutDuration,
+		TimeoutIncrease: cfg.TimeoutIncrease,
+	})
+	if err != nil {
+		t.Fatalf("failed to create middleware: %v", err)
+	}
+	defer mw.Close()
+
+	tests := []struct {
+		name     string
+		request  middleware.AdminRequest
+		unsigned bool
+		status   int
+		ip       string
+	}{
+		{"log line", middleware.AdminRequest{Line: failedLogin("192.0.2.1")}, false, http.StatusOK, "192.0.2.1"},
+		{"IP and user", middleware.AdminRequest{IP: "::ffff:192.0.2.2", Reason: "root"}, false, http.StatusOK, "192.0.2.2"},
+		{"line without a failed login", middleware.AdminRequest{Line: "sshd[1]: Accepted password for root from 192.0.2.3 port 1 ssh2"}, false, http.StatusUnprocessableEntity, ""},
+		{"invalid IP", middleware.AdminRequest{IP: "192.0.2.1; reboot"}, false, http.StatusBadRequest, ""},
+		{"unsigned", middleware.AdminRequest{IP: "192.0.2.4"}, true, http.StatusUnauthorized, ""},
+	}
+	for _, test := range tests {
+		status, response := postAdmin(t, mw, "ssh", test.request, test.unsigned)
+		if status != test.status || response.IP != test.ip {
+			t.Errorf("%s: %d %+v, want %d for %q", test.name, status, response, test.status, test.ip)
+		}
+		if status != http.StatusOK && response.Error == "" {
+			t.Errorf("%s: failed without an error message", test.name)
+		}
+	}
+
+	blocked := false
+	for i := 0; i < 10 && !blocked; i++ {
+		_, response := postAdmin(t, mw, "ssh", middleware.AdminRequest{Line: failedLogin("192.0.2.1")}, false)
+		blocked = response.Blocked
+	}
+	if !blocked {
+		t.Error("IP not refused after repeated failed logins")
+	}
+
+	b.err = errors.New("blocker down")
+	if status, response := postAdmin(t, mw, "ssh", middleware.AdminRequest{IP: "192.0.2.5"}, false); status != http.StatusInternalServerError || response.Error != b.err.Error() {
+		t.Errorf("report with a failing blocker: %d %+v, want 500 with its error", status, response)
+	}
+}
+
+// TestWatchSSHLog checks that the middleware follows Config.SSHAuthLog and
+// blocks IPs with failed logins appended to it
+func TestWatchSSHLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "auth.log")
+	if err := os.WriteFile(path, []byte(failedLogin("192.0.2.1")), 0o644); err != nil {
+		t.Fatalf("failed to write the log: %v", err)
+	}
+	cfg := whoentest.Config()
+	cfg.SSHAuthLog = path
+	cfg.GracePeriod = 1
+	h := whoentest.New(t, cfg, whoentest.NewMatcher())
+
+	// Wait for the log to be opened before appending
+	time.Sleep(100 * time.Millisecond)
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		t.Fatalf("failed to open the log: %v", err)
+	}
+	defer file.Close()
+	for i := 0; i < 3; i++ {
+		file.WriteString(failedLogin("192.0.2.2"))
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !h.IsBlocked("192.0.2.2") && time.Now().Before(deadline) {
+		time.Sleep(50 * time.Millisecond)
+	}
+	if !h.IsBlocked("192.0.2.2") {
+		t.Error("IP with failed logins in the log not blocked")
+	}
+	if h.RequestCount("192.0.2.1") != 0 {
+		t.Error("failed login written before the middleware started was counted")
+	}
+}
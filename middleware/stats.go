@@ -0,0 +1,262 @@
+package middleware
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/headswim/whoen/stats"
+)
+
+// Stats reports where the middleware keeps its data and how much of it there is
+type Stats struct {
+	StorageDir     string      `json:"storage_dir"`      // Directory holding the storage files
+	BlockedIPsFile string      `json:"blocked_ips_file"` // File block records are saved to
+	PersistMode    string      `json:"persist_mode"`     // Effective persist mode, empty for custom storage
+	Memory         MemoryStats `json:"memory"`
+}
+
+// Stats returns the storage location in use and the size of the per-IP state
+func (m *Middleware) Stats() (Stats, error) {
+	memory, err := m.MemoryStats()
+	return Stats{
+		StorageDir:     m.options.Config.StorageDir,
+		BlockedIPsFile: m.options.Config.BlockedIPsFile,
+		PersistMode:    m.persistMode,
+		Memory:         memory,
+	}, err
+}
+
+// AttackReport summarizes the block records and request counters in storage:
+// the most requested malicious paths, the top offending IPs and autonomous
+// systems, blocks per hour and day, and the average time to block. Top sets
+// the length of the lists, stats.DefaultTop if zero. The IPs are those of
+// Options.Obfuscator, if set.
+func (m *Middleware) AttackReport(top int) (stats.Report, error) {
+	report, err := stats.Build(m.storage, stats.Options{Top: top, ASN: m.options.ASNLookup})
+	for i := range report.TopIPs {
+		report.TopIPs[i].IP = m.exportIP(report.TopIPs[i].IP)
+	}
+	return report, err
+}
+
+// AttackReportHandler returns an http.Handler that serves AttackReport as
+// JSON, with the length of the lists in the optional top query parameter.
+// Mount it on an internal route, the report lists client IPs and paths.
+func (m *Middleware) AttackReportHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		top := 0
+		if value := r.URL.Query().Get("top"); value != "" {
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 1 {
+				http.Error(w, "invalid top parameter", http.StatusBadRequest)
+				return
+			}
+			top = n
+		}
+
+		report, err := m.AttackReport(top)
+		if err != nil {
+			m.logger.Printf("Error building attack report: %v", err)
+			http.Error(w, "failed to build attack report", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		json.NewEncoder(w).Encode(report)
+	})
+}
+
+// Dashboard returns the detections and blocks per step from from to to,
+// recorded in memory for the last 24 hours, with a snapshot of the top
+// offenders. Top sets the length of the lists, stats.DefaultTop if zero.
+func (m *Middleware) Dashboard(from, to time.Time, step time.Duration, top int) (stats.Dashboard, error) {
+	report, err := m.AttackReport(top)
+	if err != nil {
+		return stats.Dashboard{}, err
+	}
+	return stats.NewDashboard(m.timeline, report, from, to, step), nil
+}
+
+// defaultDashboardRange is the time range DashboardHandler serves without
+// from and to parameters
+const defaultDashboardRange = 6 * time.Hour
+
+// DashboardHandler returns an http.Handler that serves Dashboard as JSON,
+// to mount on an internal route such as /whoen/stats. A GET takes the
+// optional query parameters from and to, as RFC 3339 times or unix
+// milliseconds (the last 6 hours by default), interval, a duration such as
+// 5m (1m by default), and top.
+//
+// It also implements the protocol of Grafana's JSON data source: GET on the
+// route tests the connection, POST to /search under it lists the targets,
+// and POST to /query returns the "detections" and "blocks" series and the
+// "top_offenders" table for the panel's range.
+func (m *Middleware) DashboardHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodPost && strings.HasSuffix(r.URL.Path, "/search"):
+			writeJSON(w, []string{stats.SeriesDetections, stats.SeriesBlocks, topOffendersTarget})
+		case r.Method == http.MethodPost && strings.HasSuffix(r.URL.Path, "/query"):
+			m.serveGrafanaQuery(w, r)
+		case r.Method == http.MethodGet || r.Method == http.MethodHead:
+			m.serveDashboard(w, r)
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+}
+
+// serveDashboard serves Dashboard for the query parameters of a GET
+func (m *Middleware) serveDashboard(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	now := time.Now()
+	from, to := now.Add(-defaultDashboardRange), now
+	step := stats.TimelineResolution
+	top := 0
+
+	var err error
+	if value := query.Get("from"); value != "" {
+		if from, err = parseDashboardTime(value); err != nil {
+			http.Error(w, "invalid from parameter", http.StatusBadRequest)
+			return
+		}
+	}
+	if value := query.Get("to"); value != "" {
+		if to, err = parseDashboardTime(value); err != nil {
+			http.Error(w, "invalid to parameter", http.StatusBadRequest)
+			return
+		}
+	}
+	if !from.Before(to) {
+		http.Error(w, "from must be before to", http.StatusBadRequest)
+		return
+	}
+	if value := query.Get("interval"); value != "" {
+		if step, err = time.ParseDuration(value); err != nil || step <= 0 {
+			http.Error(w, "invalid interval parameter", http.StatusBadRequest)
+			return
+		}
+	}
+	if value := query.Get("top"); value != "" {
+		if top, err = strconv.Atoi(value); err != nil || top < 1 {
+			http.Error(w, "invalid top parameter", http.StatusBadRequest)
+			return
+		}
+	}
+
+	dashboard, err := m.Dashboard(from, to, step, top)
+	if err != nil {
+		m.logger.Printf("Error building dashboard: %v", err)
+		http.Error(w, "failed to build dashboard", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, dashboard)
+}
+
+// topOffendersTarget is the Grafana target of the top offenders table
+const topOffendersTarget = "top_offenders"
+
+// grafanaQuery is the body of a query from Grafana's JSON data source
+type grafanaQuery struct {
+	Range struct {
+		From time.Time `json:"from"`
+		To   time.Time `json:"to"`
+	} `json:"range"`
+	IntervalMs int64 `json:"intervalMs"`
+	Targets    []struct {
+		Target string `json:"target"`
+	} `json:"targets"`
+}
+
+// grafanaTable is a table in the format of Grafana's JSON data source
+type grafanaTable struct {
+	Type    string          `json:"type"`
+	Columns []grafanaColumn `json:"columns"`
+	Rows    [][]any         `json:"rows"`
+}
+
+// grafanaColumn is a column of a grafanaTable
+type grafanaColumn struct {
+	Text string `json:"text"`
+	Type string `json:"type"`
+}
+
+// serveGrafanaQuery answers a query from Grafana's JSON data source with
+// the series and tables of its targets
+func (m *Middleware) serveGrafanaQuery(w http.ResponseWriter, r *http.Request) {
+	var query grafanaQuery
+	if err := json.NewDecoder(io.LimitReader(r.Body, 1<<20)).Decode(&query); err != nil {
+		http.Error(w, "invalid query", http.StatusBadRequest)
+		return
+	}
+	if !query.Range.From.Before(query.Range.To) {
+		http.Error(w, "invalid range", http.StatusBadRequest)
+		return
+	}
+
+	dashboard, err := m.Dashboard(query.Range.From, query.Range.To, time.Duration(query.IntervalMs)*time.Millisecond, 0)
+	if err != nil {
+		m.logger.Printf("Error building dashboard: %v", err)
+		http.Error(w, "failed to build dashboard", http.StatusInternalServerError)
+		return
+	}
+
+	results := []any{}
+	for _, target := range query.Targets {
+		if target.Target == topOffendersTarget {
+			results = append(results, topOffendersTable(dashboard.TopOffenders))
+			continue
+		}
+		for _, series := range dashboard.Series {
+			if series.Target == target.Target {
+				results = append(results, series)
+			}
+		}
+	}
+	writeJSON(w, results)
+}
+
+// topOffendersTable lays out the top offenders as a Grafana table
+func topOffendersTable(offenders []stats.IPCount) grafanaTable {
+	table := grafanaTable{
+		Type: "table",
+		Columns: []grafanaColumn{
+			{Text: "IP", Type: "string"},
+			{Text: "Requests", Type: "number"},
+			{Text: "Score", Type: "number"},
+			{Text: "Last path", Type: "string"},
+			{Text: "ASN", Type: "string"},
+			{Text: "Blocked", Type: "string"},
+		},
+		Rows: [][]any{},
+	}
+	for _, offender := range offenders {
+		blocked := "no"
+		switch {
+		case offender.Permanent:
+			blocked = "permanent"
+		case offender.Blocked:
+			blocked = "yes"
+		}
+		table.Rows = append(table.Rows, []any{offender.IP, offender.Requests, offender.Score, offender.LastPath, offender.ASN, blocked})
+	}
+	return table
+}
+
+// parseDashboardTime parses an RFC 3339 time or unix milliseconds
+func parseDashboardTime(value string) (time.Time, error) {
+	if ms, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.UnixMilli(ms), nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
+
+// writeJSON writes a value as a JSON response
+func writeJSON(w http.ResponseWriter, value any) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(value)
+}
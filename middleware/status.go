@@ -0,0 +1,82 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// ErrBlocked is what RequestStatus.Err returns for a refused request, for
+// callers of Engine that handle a refusal like any other error
+var ErrBlocked = errors.New("IP is blocked")
+
+// RequestStatus is what whoen concluded about a request it let through to the
+// application. Handlers read it with StatusFromContext to add friction of
+// their own, such as extra logging or a CAPTCHA, before whoen blocks the IP.
+type RequestStatus struct {
+	IP         string // Client IP the request was attributed to
+	Suspicious bool   // The request matched a pattern, detector or request rule
+	Pattern    string // Pattern, or detector reasons, the request matched
+	Count      int    // Malicious requests counted for the IP, this one included
+	Score      int    // Accumulated score of the IP, this one included
+	Blocked    bool   // Whoen would have blocked the request, in dry-run mode or a log-only ramp stage
+
+	exempt bool // The IP is whitelisted, or the request exempted from counting and blocking
+}
+
+// Err returns ErrBlocked, wrapped with the IP, if the request is refused,
+// and nil otherwise
+func (s RequestStatus) Err() error {
+	if !s.Blocked {
+		return nil
+	}
+	return fmt.Errorf("%w: %s", ErrBlocked, s.IP)
+}
+
+// statusKey is the context key of a request's RequestStatus
+type statusKey struct{}
+
+// StatusFromContext returns the RequestStatus whoen attached to a request's
+// context. Only requests whoen found suspicious or would have blocked carry
+// one, so ok is false for clean requests. Count and Score are zero when the
+// request was recorded in the background because its deadline was near.
+func StatusFromContext(ctx context.Context) (status RequestStatus, ok bool) {
+	s, ok := ctx.Value(statusKey{}).(*RequestStatus)
+	if !ok {
+		return RequestStatus{}, false
+	}
+	return *s, true
+}
+
+// flag records the match that made a request suspicious. It does nothing on
+// a nil status, like the DecisionMetrics methods.
+func (s *RequestStatus) flag(pattern string) {
+	if s != nil {
+		s.Suspicious, s.Pattern = true, pattern
+	}
+}
+
+// exempted records that a request was let through without inspection
+func (s *RequestStatus) exempted() {
+	if s != nil {
+		s.exempt = true
+	}
+}
+
+// counted records the IP's request count and score after the request
+func (s *RequestStatus) counted(count, score int) {
+	if s != nil {
+		s.Count, s.Score = count, score
+	}
+}
+
+// attach returns the request with the status in its context, or the request
+// itself when there is nothing to tell, so clean requests are not copied
+func (s *RequestStatus) attach(r *http.Request) *http.Request {
+	if !s.Suspicious && !s.Blocked {
+		return r
+	}
+	status := *s
+	return r.WithContext(context.WithValue(r.Context(), statusKey{}, &status))
+}
@@ -0,0 +1,76 @@
+package middleware_test
+
+import (
+	"bytes"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/headswim/whoen/config"
+	"github.com/headswim/whoen/matcher"
+	"github.com/headswim/whoen/middleware"
+	"github.com/headswim/whoen/storage"
+	"github.com/headswim/whoen/whoentest"
+)
+
+// coreStorage hides every optional interface of the storage it wraps
+type coreStorage struct {
+	storage.Storage
+}
+
+// TestStorageWithoutBlockPutter checks that on a storage that cannot write
+// whole block records the middleware warns, still blocks IPs and leaves out
+// subnet escalation, whose aggregated blocks it could not store
+func TestStorageWithoutBlockPutter(t *testing.T) {
+	cfg := whoentest.Config()
+	cfg.GracePeriod = 1
+	cfg.ProbationPeriod = time.Hour
+	cfg.SubnetEscalation = true
+	cfg.SubnetThreshold = 2
+	cfg.SystemType = "linux"
+	config.ValidateConfig(&cfg)
+
+	var logs bytes.Buffer
+	store := whoentest.NewStorage()
+	blocker := whoentest.NewBlocker()
+	m, err := middleware.New(middleware.Options{
+		Config:          cfg,
+		Storage:         coreStorage{store},
+		Matcher:         matcher.NewService(),
+		Blocker:         blocker,
+		Logger:          log.New(&logs, "", 0),
+		GracePeriod:     cfg.GracePeriod,
+		TimeoutEnabled:  cfg.TimeoutEnabled,
+		TimeoutDuration: cfg.TimeoutDuration,
+		TimeoutIncrease: cfg.TimeoutIncrease,
+	})
+	if err != nil {
+		t.Fatalf("failed to create middleware: %v", err)
+	}
+	defer m.Close()
+
+	if !strings.Contains(logs.String(), "probation and subnet escalation are off") {
+		t.Errorf("no warning about the storage in the log:\n%s", logs.String())
+	}
+
+	for _, ip := range []string{"192.0.2.1", "192.0.2.2", "192.0.2.3"} {
+		for i := 0; i < 3; i++ {
+			r := httptest.NewRequest(http.MethodGet, "/wp-login.php", nil)
+			r.RemoteAddr = ip + ":40000"
+			if _, err := m.HandleRequest(r); err != nil {
+				t.Fatalf("HandleRequest failed: %v", err)
+			}
+		}
+		if blocked, _, _ := store.IsIPBlocked(ip); !blocked {
+			t.Errorf("%s not blocked", ip)
+		}
+	}
+	for ip := range blocker.Blocks() {
+		if strings.Contains(ip, "/") {
+			t.Errorf("subnet %s blocked without whole block records", ip)
+		}
+	}
+}
@@ -0,0 +1,235 @@
+package middleware
+
+import (
+	"fmt"
+	"net/netip"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/headswim/whoen/blocker"
+	"github.com/headswim/whoen/events"
+	"github.com/headswim/whoen/ipaddr"
+	"github.com/headswim/whoen/storage"
+)
+
+// subnets tracks the recent blocks of each subnet for Config.SubnetEscalation,
+// and the subnet blocks in force so the middleware rejects their IPs even
+// when the OS firewall does not
+type subnets struct {
+	mutex   sync.Mutex
+	recent  map[netip.Prefix]map[string]time.Time // Blocked IPs of each subnet and when they were blocked
+	blocked map[netip.Prefix]time.Time            // Blocked subnets and their expiration, zero for permanent blocks
+
+	// active is set while blocked is not empty, so requests skip the lock
+	// when no subnet is blocked
+	active atomic.Bool
+}
+
+// newSubnets creates an empty subnet tracker
+func newSubnets() *subnets {
+	return &subnets{
+		recent:  make(map[netip.Prefix]map[string]time.Time),
+		blocked: make(map[netip.Prefix]time.Time),
+	}
+}
+
+// blockedPrefix returns the range of a block whose IP is a CIDR range wider
+// than a single address
+func blockedPrefix(ip string) (netip.Prefix, bool) {
+	prefix, err := netip.ParsePrefix(ip)
+	if err != nil || prefix.IsSingleIP() {
+		return netip.Prefix{}, false
+	}
+	return ipaddr.CanonicalPrefix(prefix), true
+}
+
+// subnetOf returns the subnet an address is aggregated into
+func (m *Middleware) subnetOf(addr netip.Addr) netip.Prefix {
+	// Never wider than ValidateConfig allows, for configurations that skipped it
+	bits := max(m.options.Config.SubnetPrefixIPv6, 32)
+	if addr.Is4() {
+		bits = max(m.options.Config.SubnetPrefixIPv4, 16)
+	}
+	prefix, _ := addr.Prefix(bits)
+	return prefix
+}
+
+// trackSubnet records a block for subnet escalation. Blocks of whole subnets,
+// from escalation, another instance or an operator, are remembered so
+// requests from inside them are rejected. Blocks made by detection count
+// towards escalating their subnet.
+func (m *Middleware) trackSubnet(info BlockInfo) {
+	if prefix, ok := blockedPrefix(info.IP); ok {
+		m.subnets.mutex.Lock()
+		m.subnets.blocked[prefix] = info.Until
+		m.subnets.active.Store(true)
+		m.subnets.mutex.Unlock()
+		return
+	}
+
+	cfg := m.options.Config
+	if !cfg.SubnetEscalation || cfg.SubnetThreshold < 2 || info.Extended || info.Source != SourceDetection {
+		return
+	}
+	addr, err := ipaddr.Parse(info.IP)
+	if err != nil {
+		return
+	}
+	subnet := m.subnetOf(addr)
+
+	// Count the blocks of the subnet within the window
+	now := time.Now()
+	m.subnets.mutex.Lock()
+	if _, blocked := m.subnets.blocked[subnet]; blocked {
+		m.subnets.mutex.Unlock()
+		return
+	}
+	members := m.subnets.recent[subnet]
+	if members == nil {
+		members = make(map[string]time.Time)
+		m.subnets.recent[subnet] = members
+	}
+	members[info.IP] = now
+	for ip, blockedAt := range members {
+		if now.Sub(blockedAt) > cfg.SubnetWindow {
+			delete(members, ip)
+		}
+	}
+	if len(members) < cfg.SubnetThreshold {
+		m.subnets.mutex.Unlock()
+		return
+	}
+	aggregated := make([]string, 0, len(members))
+	for ip := range members {
+		aggregated = append(aggregated, ip)
+	}
+	delete(m.subnets.recent, subnet)
+	m.subnets.mutex.Unlock()
+
+	sort.Strings(aggregated)
+	if err := m.blockSubnet(subnet, aggregated, info.Path); err != nil {
+		m.logger.Printf("Error escalating to a block of subnet %s: %v", subnet, err)
+	}
+}
+
+// untrackSubnet forgets a subnet block once it is lifted
+func (m *Middleware) untrackSubnet(ip string) {
+	if prefix, ok := blockedPrefix(ip); ok {
+		m.subnets.mutex.Lock()
+		delete(m.subnets.blocked, prefix)
+		m.subnets.active.Store(len(m.subnets.blocked) > 0)
+		m.subnets.mutex.Unlock()
+	}
+}
+
+// blockSubnet blocks a whole subnet at the firewall and records it as one
+// block aggregating the blocked IPs that led to it. The subnet is blocked as
+// long as the longest of their blocks, and at least for the base timeout.
+func (m *Middleware) blockSubnet(subnet netip.Prefix, aggregated []string, path string) error {
+	if conflict := m.whitelistConflict(subnet); conflict != "" {
+		m.logger.Printf("Not blocking subnet %s: %s", subnet, conflict)
+		return nil
+	}
+
+	now := time.Now()
+	until := now.Add(m.calculateTimeoutDuration(0))
+	for _, ip := range aggregated {
+		if _, status, err := m.storage.IsIPBlocked(ip); err == nil && status != nil && status.BlockedUntil.After(until) {
+			until = status.BlockedUntil
+		}
+	}
+
+	cidr := subnet.String()
+	if _, err := m.blocker.Block(cidr, blocker.Timeout, until.Sub(now)); err != nil {
+		return err
+	}
+	err := storage.PutBlock(m.storage, storage.BlockStatus{
+		IP:              cidr,
+		BlockedAt:       now,
+		BlockedUntil:    until,
+		LastRequestPath: path,
+		Source:          SourceSubnet,
+		Aggregated:      aggregated,
+	})
+	if err != nil {
+		m.logger.Printf("Error updating storage: %v", err)
+	}
+
+	message := fmt.Sprintf("blocked subnet %s until %s after blocking %d of its IPs within %s",
+		cidr, until.Format(time.RFC3339), len(aggregated), m.options.Config.SubnetWindow)
+	m.publishBlock(cidr, until, false, path, SourceSubnet)
+	m.onBlock(BlockInfo{
+		IP:       cidr,
+		Path:     path,
+		Count:    len(aggregated),
+		Duration: until.Sub(now),
+		Until:    until,
+		Source:   SourceSubnet,
+		Reason:   message,
+	})
+	m.emit(events.Event{Type: events.SubnetBlocked, IP: cidr, Path: path, Message: message})
+	m.logger.Printf("Escalated to subnet block: %s", message)
+	return nil
+}
+
+// whitelistConflict explains why the whitelist rules out blocking a subnet,
+// or returns "" if it does not. Subnets are only blocked when the matcher can
+// list its whitelist.
+func (m *Middleware) whitelistConflict(subnet netip.Prefix) string {
+	entries, err := m.WhitelistEntries()
+	if err != nil {
+		return err.Error()
+	}
+	for _, entry := range entries {
+		prefix, err := ipaddr.ParsePrefix(entry)
+		if err == nil && prefix.Overlaps(subnet) {
+			return fmt.Sprintf("it contains whitelisted %s", entry)
+		}
+	}
+	return ""
+}
+
+// subnetBlocked reports whether an IP lies in a blocked subnet
+func (m *Middleware) subnetBlocked(ip string) bool {
+	if !m.subnets.active.Load() {
+		return false
+	}
+	m.subnets.mutex.Lock()
+	defer m.subnets.mutex.Unlock()
+
+	addr, err := ipaddr.Parse(ip)
+	if err != nil {
+		return false
+	}
+	now := time.Now()
+	for prefix, until := range m.subnets.blocked {
+		if prefix.Contains(addr) && (until.IsZero() || now.Before(until)) {
+			return true
+		}
+	}
+	return false
+}
+
+// resetSubnets replaces the subnet blocks in force with those from storage,
+// and drops the blocks counted towards escalation once the window has passed
+func (m *Middleware) resetSubnets(blocked map[netip.Prefix]time.Time) {
+	window := m.options.Config.SubnetWindow
+	now := time.Now()
+
+	m.subnets.mutex.Lock()
+	defer m.subnets.mutex.Unlock()
+	m.subnets.blocked = blocked
+	m.subnets.active.Store(len(blocked) > 0)
+	for subnet, members := range m.subnets.recent {
+		for ip, blockedAt := range members {
+			if now.Sub(blockedAt) > window {
+				delete(members, ip)
+			}
+		}
+		if len(members) == 0 {
+			delete(m.subnets.recent, subnet)
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package middleware
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"time"
+
+	"github.com/headswim/whoen/blocker"
+)
+
+// Sync makes the blocker enforce exactly the active blocks recorded in storage.
+//
+// Storage is the source of truth for block state; the blocker only tracks what
+// it enforces at the OS level. Sync restores the invariant between the two:
+//   - every active block in storage is enforced by the blocker, and
+//   - the blocker enforces nothing that storage does not list as active.
+//
+// It runs at startup, so blocks survive application restarts, and after every cleanup.
+func (m *Middleware) Sync() error {
+	// Blocks recorded before the limit was lowered, or imported in bulk, may exceed it
+	m.enforceBlockLimit("")
+
+	blockedIPs, err := m.storage.GetBlockedIPs()
+	if err != nil {
+		return fmt.Errorf("failed to read blocked IPs: %w", err)
+	}
+
+	var errs []error
+	now := time.Now()
+	active := make(map[string]bool, len(blockedIPs))
+	subnets := make(map[netip.Prefix]time.Time)
+	restored := 0
+
+	// Find the active blocks from storage the blocker does not enforce
+	missing := make(map[string]time.Time)
+	for _, status := range blockedIPs {
+		if !status.IsPermanent && !now.Before(status.BlockedUntil) {
+			continue
+		}
+		if m.matcher.IsWhitelisted(status.IP) {
+			continue
+		}
+		active[status.IP] = true
+		if prefix, ok := blockedPrefix(status.IP); ok {
+			subnets[prefix] = status.BlockedUntil
+		}
+
+		if blocked, _ := m.blocker.IsBlocked(status.IP); blocked {
+			continue
+		}
+		if status.IsPermanent {
+			missing[status.IP] = time.Time{}
+		} else {
+			missing[status.IP] = status.BlockedUntil
+		}
+	}
+
+	m.resetSubnets(subnets)
+
+	// Apply them in one batch when the blocker can, and one by one otherwise
+	// or when the batch fails
+	if restorer, ok := m.blocker.(blocker.Restorer); ok && len(missing) > 1 {
+		if err := restorer.RestoreBlocks(missing); err != nil {
+			m.logger.Printf("Error enforcing %d blocks in one batch, retrying one by one: %v", len(missing), err)
+		} else {
+			restored += len(missing)
+			missing = nil
+		}
+	}
+	for ip, until := range missing {
+		var err error
+		if until.IsZero() {
+			_, err = m.blocker.Block(ip, blocker.Ban, 0)
+		} else {
+			_, err = m.blocker.Block(ip, blocker.Timeout, until.Sub(now))
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("failed to enforce block for IP %s: %w", ip, err))
+			continue
+		}
+		restored++
+	}
+
+	// Lift blocks the blocker enforces but storage no longer has
+	lifted := 0
+	if lister, ok := m.blocker.(blocker.Lister); ok {
+		var stale []string
+		for ip := range lister.Blocks() {
+			if !active[ip] {
+				stale = append(stale, ip)
+			}
+		}
+		if err := blocker.UnblockBatch(m.blocker, stale); err != nil {
+			errs = append(errs, fmt.Errorf("failed to lift %d stale blocks: %w", len(stale), err))
+		} else {
+			lifted = len(stale)
+		}
+	}
+
+	// Remove firewall rules left behind by earlier runs
+	if pruner, ok := m.blocker.(blocker.RulePruner); ok {
+		pruned, err := pruner.PruneRules()
+		if err != nil {
+			errs = append(errs, fmt.Errorf("failed to prune stale firewall rules: %w", err))
+		}
+		lifted += pruned
+	}
+
+	if restored > 0 || lifted > 0 {
+		m.logger.Printf("Synced blocker with storage: enforced %d blocks, lifted %d stale blocks", restored, lifted)
+	}
+
+	return errors.Join(errs...)
+}
@@ -0,0 +1,100 @@
+package middleware_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/headswim/whoen/blocker"
+	"github.com/headswim/whoen/whoentest"
+)
+
+// newSyncHarness creates a harness whose blocker and storage the tests
+// drift apart before calling Sync
+func newSyncHarness(t *testing.T) *whoentest.Harness {
+	t.Helper()
+	return whoentest.New(t, whoentest.Config(), whoentest.NewMatcher("/wp-login.php"))
+}
+
+// TestSyncLiftsBlocksMissingFromStorage checks that a firewall rule storage
+// has no record of is lifted
+func TestSyncLiftsBlocksMissingFromStorage(t *testing.T) {
+	h := newSyncHarness(t)
+	if _, err := h.Blocker.Block("192.0.2.1", blocker.Ban, 0); err != nil {
+		t.Fatalf("failed to block: %v", err)
+	}
+
+	if err := h.Middleware.Sync(); err != nil {
+		t.Fatalf("Sync failed: %v", err)
+	}
+	if blocked, _ := h.Blocker.IsBlocked("192.0.2.1"); blocked {
+		t.Error("blocker still enforces a block storage does not have")
+	}
+}
+
+// TestSyncEnforcesBlocksMissingFromBlocker checks that active blocks in
+// storage without a firewall rule are enforced, keeping their type and expiry
+func TestSyncEnforcesBlocksMissingFromBlocker(t *testing.T) {
+	h := newSyncHarness(t)
+	until := time.Now().Add(time.Hour)
+	if err := h.Storage.BlockIP("192.0.2.2", until, false, "/wp-login.php"); err != nil {
+		t.Fatalf("failed to record block: %v", err)
+	}
+	if err := h.Storage.BlockIP("192.0.2.3", time.Time{}, true, "/wp-login.php"); err != nil {
+		t.Fatalf("failed to record ban: %v", err)
+	}
+	h.Blocker.Reset()
+
+	if err := h.Middleware.Sync(); err != nil {
+		t.Fatalf("Sync failed: %v", err)
+	}
+	blocks := h.Blocker.Blocks()
+	if expiration, ok := blocks["192.0.2.2"]; !ok {
+		t.Error("temporary block in storage is not enforced")
+	} else if diff := expiration.Sub(until); diff < -time.Second || diff > time.Second {
+		t.Errorf("temporary block enforced until %v, want %v", expiration, until)
+	}
+	if expiration, ok := blocks["192.0.2.3"]; !ok {
+		t.Error("permanent ban in storage is not enforced")
+	} else if !expiration.IsZero() {
+		t.Errorf("permanent ban enforced until %v, want no expiry", expiration)
+	}
+}
+
+// TestSyncLiftsExpiredBlocks checks that a firewall rule whose block has
+// expired in storage is lifted rather than restored
+func TestSyncLiftsExpiredBlocks(t *testing.T) {
+	h := newSyncHarness(t)
+	if err := h.Storage.BlockIP("192.0.2.4", time.Now().Add(-time.Minute), false, "/wp-login.php"); err != nil {
+		t.Fatalf("failed to record block: %v", err)
+	}
+	if _, err := h.Blocker.Block("192.0.2.4", blocker.Timeout, time.Hour); err != nil {
+		t.Fatalf("failed to block: %v", err)
+	}
+
+	if err := h.Middleware.Sync(); err != nil {
+		t.Fatalf("Sync failed: %v", err)
+	}
+	if blocked, _ := h.Blocker.IsBlocked("192.0.2.4"); blocked {
+		t.Error("blocker still enforces a block that expired in storage")
+	}
+}
+
+// TestSyncKeepsBlocksInAgreement checks that Sync leaves a block both sides
+// agree on alone
+func TestSyncKeepsBlocksInAgreement(t *testing.T) {
+	h := newSyncHarness(t)
+	if n := h.Attack("192.0.2.5", "/wp-login.php", 10); n == 0 {
+		t.Fatal("attack was never blocked")
+	}
+	calls := len(h.Blocker.CallsTo("192.0.2.5"))
+
+	if err := h.Middleware.Sync(); err != nil {
+		t.Fatalf("Sync failed: %v", err)
+	}
+	if blocked, _ := h.Blocker.IsBlocked("192.0.2.5"); !blocked {
+		t.Error("Sync lifted a block storage has")
+	}
+	if got := len(h.Blocker.CallsTo("192.0.2.5")); got != calls {
+		t.Errorf("Sync made %d blocker calls for a block in agreement, want none", got-calls)
+	}
+}
@@ -0,0 +1,66 @@
+package middleware
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/headswim/whoen/blocker"
+	"github.com/headswim/whoen/events"
+)
+
+// maxTamperedListed caps the IPs named in a tamper event
+const maxTamperedListed = 20
+
+// ruleVerifier returns the blocker that can verify its firewall rules, looking
+// behind the enforcement ramp
+func (m *Middleware) ruleVerifier() (blocker.RuleVerifier, bool) {
+	target := m.blocker
+	if ramp, ok := target.(*rampBlocker); ok {
+		target = ramp.enforcing
+	}
+	verifier, ok := target.(blocker.RuleVerifier)
+	return verifier, ok
+}
+
+// VerifyRules checks that the OS firewall still enforces every block, and
+// re-applies and reports the rules that were removed outside whoen. It
+// returns the IPs whose rules were missing.
+func (m *Middleware) VerifyRules() ([]string, error) {
+	verifier, ok := m.ruleVerifier()
+	if !ok {
+		return nil, nil
+	}
+
+	missing, err := verifier.VerifyRules()
+	if len(missing) > 0 {
+		listed := missing
+		if len(listed) > maxTamperedListed {
+			listed = listed[:maxTamperedListed]
+		}
+		message := fmt.Sprintf("firewall rules of %d blocked IPs were missing and re-applied: %s", len(missing), strings.Join(listed, ", "))
+		if len(missing) > len(listed) {
+			message += fmt.Sprintf(" and %d more", len(missing)-len(listed))
+		}
+		m.logger.Printf("Warning: %s", message)
+		m.emit(events.Event{Type: events.RulesTampered, Message: message})
+	}
+	return missing, err
+}
+
+// watchRules verifies the firewall rules every RuleCheckInterval, until Close is called
+func (m *Middleware) watchRules() {
+	ticker := time.NewTicker(m.options.Config.RuleCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if _, err := m.VerifyRules(); err != nil {
+				m.logger.Printf("Error verifying firewall rules: %v", err)
+			}
+		case <-m.ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package middleware
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/headswim/whoen/matcher"
+)
+
+// warmup loads storage, compiles the matcher's patterns and enforces the
+// stored blocks before the middleware reports ready, so the first requests
+// after a deploy neither pay cold-start costs nor race the restore of blocks.
+// Failures are logged and returned but do not stop the middleware from starting.
+func (m *Middleware) warmup() error {
+	start := time.Now()
+	var errs []error
+
+	// Read storage up front so a corrupt file is reported now, not on the first request
+	if err := m.storage.Load(); err != nil {
+		errs = append(errs, err)
+	}
+
+	// Compile the patterns ahead of the first request
+	if warmer, ok := m.matcher.(matcher.Warmer); ok {
+		warmer.Warm()
+	}
+
+	// Enforce the blocks recorded in storage, restoring them after a restart
+	if err := m.Sync(); err != nil {
+		errs = append(errs, fmt.Errorf("failed to sync blocker with storage: %w", err))
+	}
+
+	m.ready.Store(true)
+	m.logger.Printf("Warm-up completed in %v", time.Since(start))
+
+	return errors.Join(errs...)
+}
+
+// Ready reports whether the middleware finished warming up and has not been closed
+func (m *Middleware) Ready() bool {
+	return m.ready.Load()
+}
+
+// ReadyHandler returns an http.Handler for readiness probes. It responds with
+// 200 once the middleware is ready and 503 before warm-up completes or after Close.
+func (m *Middleware) ReadyHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !m.Ready() {
+			http.Error(w, "not ready", http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("ok"))
+	})
+}
@@ -0,0 +1,103 @@
+// Package obfuscate hides raw IP addresses and tenant IDs in exported data.
+// The middleware takes an Obfuscator in its options and applies it to the
+// events, log sink records and attack reports it exports, so that data
+// written to a sink shared by several tenants cannot be correlated back to
+// real addresses, or across tenants.
+package obfuscate
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"sync"
+)
+
+// Obfuscator replaces identifiers before they leave the process
+type Obfuscator interface {
+	// IP returns the exported form of an IP address seen by a tenant
+	IP(tenant, ip string) string
+
+	// Tenant returns the exported form of a tenant ID
+	Tenant(tenant string) string
+}
+
+// None exports identifiers unchanged
+type None struct{}
+
+// IP returns the IP unchanged
+func (None) IP(tenant, ip string) string { return ip }
+
+// Tenant returns the tenant ID unchanged
+func (None) Tenant(tenant string) string { return tenant }
+
+// HashObfuscator replaces identifiers with salted HMAC-SHA256 digests. Each
+// tenant can have its own salt, so the same IP hashes differently per tenant
+// and one tenant's analysts cannot match their hashes against another's.
+type HashObfuscator struct {
+	mutex       sync.RWMutex
+	defaultSalt []byte
+	tenantSalts map[string][]byte
+	length      int
+}
+
+// NewHashObfuscator creates a HashObfuscator. The default salt is used for
+// tenants without their own salt and for hashing tenant IDs.
+func NewHashObfuscator(defaultSalt []byte) *HashObfuscator {
+	return &HashObfuscator{
+		defaultSalt: defaultSalt,
+		tenantSalts: make(map[string][]byte),
+		length:      16,
+	}
+}
+
+// SetTenantSalt sets the salt used to hash the IPs seen by a tenant
+func (h *HashObfuscator) SetTenantSalt(tenant string, salt []byte) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	h.tenantSalts[tenant] = salt
+}
+
+// SetLength sets the number of hex characters kept from each digest (8 to 64)
+func (h *HashObfuscator) SetLength(length int) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	if length < 8 {
+		length = 8
+	}
+	if length > 64 {
+		length = 64
+	}
+	h.length = length
+}
+
+// IP returns the salted digest of an IP for a tenant
+func (h *HashObfuscator) IP(tenant, ip string) string {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+
+	salt, ok := h.tenantSalts[tenant]
+	if !ok {
+		salt = h.defaultSalt
+	}
+	return "ip_" + h.digest(salt, ip)
+}
+
+// Tenant returns the salted digest of a tenant ID
+func (h *HashObfuscator) Tenant(tenant string) string {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+
+	if tenant == "" {
+		return ""
+	}
+	return "tenant_" + h.digest(h.defaultSalt, tenant)
+}
+
+// digest returns the truncated hex HMAC of a value. The caller must hold the lock.
+func (h *HashObfuscator) digest(salt []byte, value string) string {
+	mac := hmac.New(sha256.New, salt)
+	mac.Write([]byte(value))
+	return hex.EncodeToString(mac.Sum(nil))[:h.length]
+}
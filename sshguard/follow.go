@@ -0,0 +1,97 @@
+package sshguard
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// DefaultPollInterval is how often Follow looks for new lines
+const DefaultPollInterval = time.Second
+
+// Follow reads the lines appended to the log file at path and calls handle
+// with every event they report, until ctx is done. It starts at the end of
+// the file, so entries from before are not counted again after a restart.
+// When the file is rotated, the rest of the old file is read before the new
+// one is followed from its start; a truncated file is followed from its start
+// too. Follow fails only if the file cannot be opened at first.
+func Follow(ctx context.Context, path string, interval time.Duration, handle func(Event)) error {
+	if interval <= 0 {
+		interval = DefaultPollInterval
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %w", path, err)
+	}
+	offset, err := file.Seek(0, io.SeekEnd)
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("failed to seek to the end of %s: %w", path, err)
+	}
+	defer func() {
+		if file != nil {
+			file.Close()
+		}
+	}()
+
+	reader := bufio.NewReader(file)
+	partial := ""
+
+	// read hands the complete lines available to handle and keeps a trailing
+	// partial line for the next poll
+	read := func() {
+		for {
+			chunk, err := reader.ReadString('\n')
+			offset += int64(len(chunk))
+			if err != nil {
+				partial += chunk
+				return
+			}
+			if event, ok := Parse(partial + chunk); ok {
+				handle(event)
+			}
+			partial = ""
+		}
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+
+		// The file is gone until the log is rotated, try again later
+		if file == nil {
+			if file, err = os.Open(path); err != nil {
+				file = nil
+				continue
+			}
+			reader.Reset(file)
+			offset, partial = 0, ""
+		}
+		read()
+
+		info, err := os.Stat(path)
+		current, statErr := file.Stat()
+		switch {
+		case errors.Is(err, os.ErrNotExist), err == nil && statErr == nil && !os.SameFile(info, current):
+			// Rotated, and the old file is read to its end
+			file.Close()
+			file = nil
+		case err == nil && info.Size() < offset:
+			// Truncated in place
+			if _, err := file.Seek(0, io.SeekStart); err == nil {
+				reader.Reset(file)
+				offset, partial = 0, ""
+			}
+		}
+	}
+}
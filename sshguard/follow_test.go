@@ -0,0 +1,140 @@
+package sshguard
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// followInterval is the poll interval of the tests, short to keep them fast
+const followInterval = 5 * time.Millisecond
+
+// failedLogin returns an sshd log line reporting a failed login from ip
+func failedLogin(ip string) string {
+	return "Oct 17 10:00:00 host sshd[1]: Failed password for root from " + ip + " port 1 ssh2\n"
+}
+
+// appendLog appends text to the log file at path
+func appendLog(t *testing.T, path, text string) {
+	t.Helper()
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		t.Fatalf("failed to open the log: %v", err)
+	}
+	defer file.Close()
+	if _, err := file.WriteString(text); err != nil {
+		t.Fatalf("failed to write the log: %v", err)
+	}
+}
+
+// follower runs Follow on a log file and collects the events it reports
+type follower struct {
+	t      *testing.T
+	events chan Event
+	done   chan error
+}
+
+// follow starts following the log file at path until the test ends
+func follow(t *testing.T, path string) *follower {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	f := &follower{t: t, events: make(chan Event, 16), done: make(chan error, 1)}
+	go func() {
+		f.done <- Follow(ctx, path, followInterval, func(e Event) { f.events <- e })
+	}()
+	t.Cleanup(func() {
+		cancel()
+		if err := <-f.done; err != nil {
+			t.Errorf("Follow failed: %v", err)
+		}
+	})
+	// Let Follow open the file and seek to its end
+	time.Sleep(4 * followInterval)
+	return f
+}
+
+// expect waits for events from ips, in order
+func (f *follower) expect(ips ...string) {
+	f.t.Helper()
+	for _, ip := range ips {
+		select {
+		case event := <-f.events:
+			if event.IP != ip {
+				f.t.Errorf("event from %s, want %s", event.IP, ip)
+			}
+		case <-time.After(time.Second):
+			f.t.Fatalf("no event from %s", ip)
+		}
+	}
+}
+
+// expectNone checks that no event arrives for a few polls
+func (f *follower) expectNone() {
+	f.t.Helper()
+	select {
+	case event := <-f.events:
+		f.t.Errorf("unexpected event %+v", event)
+	case <-time.After(10 * followInterval):
+	}
+}
+
+// TestFollow checks that Follow reports only lines appended after it
+// started, and waits for partial lines to be completed
+func TestFollow(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "auth.log")
+	appendLog(t, path, failedLogin("192.0.2.1"))
+
+	f := follow(t, path)
+	f.expectNone()
+
+	appendLog(t, path, failedLogin("192.0.2.2"))
+	f.expect("192.0.2.2")
+
+	line := failedLogin("192.0.2.3")
+	appendLog(t, path, line[:20])
+	f.expectNone()
+	appendLog(t, path, line[20:])
+	f.expect("192.0.2.3")
+}
+
+// TestFollowRotation checks that Follow reads the rest of a rotated file,
+// follows the new one from its start, waits while the file is missing and
+// starts over when the file is truncated
+func TestFollowRotation(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "auth.log")
+	appendLog(t, path, "")
+	f := follow(t, path)
+
+	// Rotated by renaming, with a line written to the old file late
+	if err := os.Rename(path, path+".1"); err != nil {
+		t.Fatalf("failed to rotate: %v", err)
+	}
+	appendLog(t, path+".1", failedLogin("192.0.2.1"))
+	f.expect("192.0.2.1")
+	time.Sleep(4 * followInterval)
+	appendLog(t, path, failedLogin("192.0.2.2"))
+	f.expect("192.0.2.2")
+
+	// Truncated in place, e.g. by logrotate's copytruncate
+	appendLog(t, path, failedLogin("192.0.2.3"))
+	f.expect("192.0.2.3")
+	if err := os.Truncate(path, 0); err != nil {
+		t.Fatalf("failed to truncate: %v", err)
+	}
+	time.Sleep(4 * followInterval)
+	appendLog(t, path, failedLogin("192.0.2.4"))
+	f.expect("192.0.2.4")
+}
+
+// TestFollowMissingFile checks that Follow fails for a log that does not
+// exist when it starts
+func TestFollowMissingFile(t *testing.T) {
+	err := Follow(context.Background(), filepath.Join(t.TempDir(), "missing.log"), followInterval, func(Event) {})
+	if !os.IsNotExist(errors.Unwrap(err)) {
+		t.Errorf("Follow of a missing file: %v, want it not found", err)
+	}
+}
@@ -0,0 +1,102 @@
+// Package sshguard finds SSH brute-force attempts in sshd's log, so whoen can
+// count and block them like malicious HTTP requests. Parse recognizes the
+// OpenSSH messages about failed logins and scanners, Follow tails an auth log
+// across rotations, and Scan reads any other stream of log lines, such as the
+// output of journalctl.
+package sshguard
+
+import (
+	"bufio"
+	"io"
+	"regexp"
+	"strings"
+
+	"github.com/headswim/whoen/ipaddr"
+)
+
+// Kind is the kind of SSH event
+type Kind string
+
+// Kinds of SSH events
+const (
+	FailedLogin      Kind = "failed-login"      // Wrong password, key or other credentials
+	InvalidUser      Kind = "invalid-user"      // Login attempt for a user that does not exist
+	MaxAttempts      Kind = "max-attempts"      // Connection dropped after too many failed attempts
+	NoIdentification Kind = "no-identification" // Connection closed before the SSH banner, usually a port scan
+	BadProtocol      Kind = "bad-protocol"      // Client that does not speak SSH or offers no usable algorithm
+)
+
+// Event is a failed login or probe found in sshd's log
+type Event struct {
+	Kind Kind
+	IP   string
+	User string // The user name tried, empty when the client never sent one
+}
+
+// Path returns the path an event is recorded under, e.g. /ssh/failed-login,
+// which shows in logs, detections and events like the path of a request
+func (e Event) Path() string {
+	return "/ssh/" + string(e.Kind)
+}
+
+// signatures match the messages of sshd, after the "sshd[pid]: " prefix.
+// Each has a user group unless it is nil and an ip group.
+var signatures = []struct {
+	kind    Kind
+	pattern *regexp.Regexp
+}{
+	{FailedLogin, regexp.MustCompile(`^Failed \S+ for (?:invalid user )?(?P<user>.*?) from (?P<ip>\S+) port \d+`)},
+	{InvalidUser, regexp.MustCompile(`^Invalid user (?P<user>.*?) from (?P<ip>\S+)(?: port \d+)?\s*$`)},
+	{MaxAttempts, regexp.MustCompile(`^(?:error: )?maximum authentication attempts exceeded for (?:invalid user )?(?P<user>.*?) from (?P<ip>\S+) port \d+`)},
+	{NoIdentification, regexp.MustCompile(`^Did not receive identification string from (?P<ip>\S+)`)},
+	{BadProtocol, regexp.MustCompile(`^Bad protocol version identification .* from (?P<ip>\S+)`)},
+	{BadProtocol, regexp.MustCompile(`^(?:error: )?(?:kex_exchange_identification|banner exchange): Connection from (?P<ip>\S+) port \d+: invalid format`)},
+	{BadProtocol, regexp.MustCompile(`^Unable to negotiate with (?P<ip>\S+) port \d+: no matching`)},
+}
+
+// daemonPrefix finds the start of sshd's message in a syslog or journal line,
+// e.g. "Oct 17 10:00:00 host sshd[123]: ". OpenSSH 9.8 and later log
+// authentication from sshd-session.
+var daemonPrefix = regexp.MustCompile(`\bsshd(?:-session)?(?:\[\d+\])?: `)
+
+// Parse returns the event an sshd log line reports, if any. The line may be
+// a full syslog or journal line or just sshd's message. Lines from other
+// programs, sshd messages about successful logins and events whose address
+// is not a valid IP are ignored.
+func Parse(line string) (Event, bool) {
+	message := strings.TrimRight(line, "\r\n")
+	if loc := daemonPrefix.FindStringIndex(message); loc != nil {
+		message = message[loc[1]:]
+	}
+
+	for _, signature := range signatures {
+		groups := signature.pattern.FindStringSubmatch(message)
+		if groups == nil {
+			continue
+		}
+
+		event := Event{Kind: signature.kind}
+		if i := signature.pattern.SubexpIndex("user"); i > 0 {
+			event.User = groups[i]
+		}
+		addr, err := ipaddr.Parse(groups[signature.pattern.SubexpIndex("ip")])
+		if err != nil {
+			return Event{}, false
+		}
+		event.IP = addr.String()
+		return event, true
+	}
+	return Event{}, false
+}
+
+// Scan reads log lines from r until it ends and calls handle with every
+// event they report
+func Scan(r io.Reader, handle func(Event)) error {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		if event, ok := Parse(scanner.Text()); ok {
+			handle(event)
+		}
+	}
+	return scanner.Err()
+}
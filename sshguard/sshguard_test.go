@@ -0,0 +1,90 @@
+package sshguard
+
+import (
+	"bufio"
+	"errors"
+	"strings"
+	"testing"
+)
+
+// TestParse checks that the OpenSSH messages about failed logins and probes
+// are recognized in syslog and journal lines, and that other lines are not
+func TestParse(t *testing.T) {
+	tests := []struct {
+		line  string
+		event Event
+	}{
+		{"Oct 17 10:00:00 host sshd[123]: Failed password for root from 192.0.2.1 port 40000 ssh2",
+			Event{FailedLogin, "192.0.2.1", "root"}},
+		{"Oct 17 10:00:00 host sshd[123]: Failed password for invalid user admin from 192.0.2.1 port 40000 ssh2",
+			Event{FailedLogin, "192.0.2.1", "admin"}},
+		{"2026-10-17T10:00:00+00:00 host sshd-session[123]: Failed publickey for git from 2001:db8::1 port 40000 ssh2: RSA SHA256:x",
+			Event{FailedLogin, "2001:db8::1", "git"}},
+		{"Failed password for user with spaces from 192.0.2.1 port 40000 ssh2",
+			Event{FailedLogin, "192.0.2.1", "user with spaces"}},
+		{"Oct 17 10:00:00 host sshd[123]: Invalid user oracle from 192.0.2.2 port 40000",
+			Event{InvalidUser, "192.0.2.2", "oracle"}},
+		{"Oct 17 10:00:00 host sshd[123]: Invalid user test from 192.0.2.2\r\n",
+			Event{InvalidUser, "192.0.2.2", "test"}},
+		{"Oct 17 10:00:00 host sshd[123]: error: maximum authentication attempts exceeded for invalid user pi from 192.0.2.3 port 40000 ssh2 [preauth]",
+			Event{MaxAttempts, "192.0.2.3", "pi"}},
+		{"Oct 17 10:00:00 host sshd[123]: Did not receive identification string from 192.0.2.4 port 40000",
+			Event{NoIdentification, "192.0.2.4", ""}},
+		{"Oct 17 10:00:00 host sshd[123]: Bad protocol version identification 'GET / HTTP/1.1' from 192.0.2.5 port 40000",
+			Event{BadProtocol, "192.0.2.5", ""}},
+		{"Oct 17 10:00:00 host sshd[123]: error: kex_exchange_identification: Connection from 192.0.2.5 port 40000: invalid format",
+			Event{BadProtocol, "192.0.2.5", ""}},
+		{"Oct 17 10:00:00 host sshd[123]: Unable to negotiate with 192.0.2.5 port 40000: no matching host key type found",
+			Event{BadProtocol, "192.0.2.5", ""}},
+		{"Oct 17 10:00:00 host sshd[123]: Failed password for root from ::ffff:192.0.2.6 port 40000 ssh2",
+			Event{FailedLogin, "192.0.2.6", "root"}},
+	}
+	for _, test := range tests {
+		event, ok := Parse(test.line)
+		if !ok || event != test.event {
+			t.Errorf("Parse(%q) = %+v, %v, want %+v", test.line, event, ok, test.event)
+		}
+	}
+
+	for _, line := range []string{
+		"",
+		"Oct 17 10:00:00 host sshd[123]: Accepted publickey for git from 192.0.2.1 port 40000 ssh2",
+		"Oct 17 10:00:00 host sshd[123]: Failed password for root from host.example port 40000 ssh2",
+		"Oct 17 10:00:00 host sshd[123]: Failed password for root from 192.0.2.1'; DROP port 40000 ssh2",
+		"Oct 17 10:00:00 host sudo[123]: alice : Failed password for root from 192.0.2.1 port 40000 ssh2 was logged",
+		"Oct 17 10:00:00 host sshd[123]: Connection closed by 192.0.2.1 port 40000 [preauth]",
+	} {
+		if event, ok := Parse(line); ok {
+			t.Errorf("Parse(%q) = %+v, want no event", line, event)
+		}
+	}
+}
+
+// TestScan checks that Scan reports the events of a stream and its read
+// errors
+func TestScan(t *testing.T) {
+	log := strings.Join([]string{
+		"Oct 17 10:00:00 host sshd[1]: Invalid user a from 192.0.2.1 port 1",
+		"Oct 17 10:00:00 host cron[2]: (root) CMD (true)",
+		"Oct 17 10:00:00 host sshd[1]: Failed password for invalid user a from 192.0.2.1 port 1 ssh2",
+	}, "\n")
+	var events []Event
+	if err := Scan(strings.NewReader(log), func(e Event) { events = append(events, e) }); err != nil {
+		t.Fatalf("Scan failed: %v", err)
+	}
+	if len(events) != 2 || events[0].Kind != InvalidUser || events[1].Kind != FailedLogin {
+		t.Errorf("Scan found %+v, want an invalid user and a failed login", events)
+	}
+
+	long := strings.Repeat("x", bufio.MaxScanTokenSize+1)
+	if err := Scan(strings.NewReader(long), func(Event) {}); !errors.Is(err, bufio.ErrTooLong) {
+		t.Errorf("Scan of a line too long: %v, want bufio.ErrTooLong", err)
+	}
+}
+
+// TestEventPath checks the path events are recorded under
+func TestEventPath(t *testing.T) {
+	if path := (Event{Kind: MaxAttempts}).Path(); path != "/ssh/max-attempts" {
+		t.Errorf("Path = %q, want /ssh/max-attempts", path)
+	}
+}
@@ -0,0 +1,228 @@
+// Package stats aggregates the block records and request counters in storage
+// into a report of what whoen is being attacked with and by whom
+package stats
+
+import (
+	"sort"
+	"time"
+
+	"github.com/headswim/whoen/storage"
+)
+
+// DefaultTop is the length of the top lists when Options.Top is zero
+const DefaultTop = 10
+
+// Lengths of the block histograms
+const (
+	hourlyBuckets = 24 // BlocksPerHour covers the last day
+	dailyBuckets  = 30 // BlocksPerDay covers the last 30 days
+)
+
+// Options tunes a report
+type Options struct {
+	Top int // Length of the top lists, DefaultTop if zero
+
+	// ASN looks up the autonomous system of an IP, e.g. "AS14061 DigitalOcean",
+	// from a GeoIP database of your choice. Without it, the report has no ASN
+	// list. An empty result leaves the IP out of the ASN list.
+	ASN func(ip string) string
+}
+
+// Report summarizes the state of storage
+type Report struct {
+	Generated time.Time `json:"generated"`
+
+	BlockRecords      int `json:"block_records"`      // Block records, expired ones kept as history included
+	ActiveBlocks      int `json:"active_blocks"`      // Blocks in effect
+	PermanentBans     int `json:"permanent_bans"`     // Permanent bans in effect
+	TrackedIPs        int `json:"tracked_ips"`        // IPs with a request counter
+	MaliciousRequests int `json:"malicious_requests"` // Malicious requests counted for the tracked IPs
+
+	// Most requested malicious paths. Storage keeps the last malicious path
+	// of each IP, so each IP counts once, for the path it requested last.
+	TopPaths []Count `json:"top_paths"`
+
+	TopIPs  []IPCount `json:"top_ips"`            // IPs with the most malicious requests
+	TopASNs []Count   `json:"top_asns,omitempty"` // Autonomous systems with the most offending IPs
+
+	BlocksPerHour []Bucket `json:"blocks_per_hour"` // New blocks in each of the last 24 hours, oldest first
+	BlocksPerDay  []Bucket `json:"blocks_per_day"`  // New blocks in each of the last 30 days, oldest first
+
+	// AverageTimeToBlock is the mean time from an IP's first malicious
+	// request to its block, over the detections whose counter is still kept.
+	// TimeToBlockSamples is the number of blocks it covers.
+	AverageTimeToBlock time.Duration `json:"average_time_to_block"`
+	TimeToBlockSamples int           `json:"time_to_block_samples"`
+}
+
+// Count is an entry of a top list
+type Count struct {
+	Key   string `json:"key"`
+	Count int    `json:"count"`
+}
+
+// IPCount is an entry of the top IP list
+type IPCount struct {
+	IP        string `json:"ip"`
+	Requests  int    `json:"requests"`
+	Score     int    `json:"score,omitempty"`
+	LastPath  string `json:"last_path,omitempty"`
+	ASN       string `json:"asn,omitempty"`
+	Blocked   bool   `json:"blocked"`
+	Permanent bool   `json:"permanent,omitempty"`
+}
+
+// Bucket counts the blocks made in an hour or a day
+type Bucket struct {
+	Start  time.Time `json:"start"`
+	Blocks int       `json:"blocks"`
+}
+
+// Build reads the block records and request counters from a storage and
+// summarizes them
+func Build(store storage.Storage, options Options) (Report, error) {
+	blocks, err := store.GetBlockedIPs()
+	if err != nil {
+		return Report{}, err
+	}
+	counters, err := store.GetAllRequestCounts()
+	if err != nil {
+		return Report{}, err
+	}
+	return Summarize(blocks, counters, options, time.Now()), nil
+}
+
+// Summarize builds a report from block records and request counters as of now
+func Summarize(blocks []storage.BlockStatus, counters map[string]storage.RequestCounter, options Options, now time.Time) Report {
+	top := options.Top
+	if top <= 0 {
+		top = DefaultTop
+	}
+
+	report := Report{
+		Generated:    now,
+		BlockRecords: len(blocks),
+		TrackedIPs:   len(counters),
+	}
+
+	// Start from the request counters
+	byIP := make(map[string]*IPCount, len(counters))
+	for ip, counter := range counters {
+		report.MaliciousRequests += counter.Count
+		byIP[ip] = &IPCount{IP: ip, Requests: counter.Count, Score: counter.Score, LastPath: counter.LastPath}
+	}
+
+	// Add the blocks, histograms and time to block
+	hourStart := now.Truncate(time.Hour).Add(-(hourlyBuckets - 1) * time.Hour)
+	dayStart := startOfDay(now).AddDate(0, 0, -(dailyBuckets - 1))
+	report.BlocksPerHour = make([]Bucket, hourlyBuckets)
+	for i := range report.BlocksPerHour {
+		report.BlocksPerHour[i].Start = hourStart.Add(time.Duration(i) * time.Hour)
+	}
+	report.BlocksPerDay = make([]Bucket, dailyBuckets)
+	for i := range report.BlocksPerDay {
+		report.BlocksPerDay[i].Start = dayStart.AddDate(0, 0, i)
+	}
+
+	var timeToBlock time.Duration
+	for _, status := range blocks {
+		active := status.IsPermanent || now.Before(status.BlockedUntil)
+		if active {
+			report.ActiveBlocks++
+			if status.IsPermanent {
+				report.PermanentBans++
+			}
+		}
+
+		entry, ok := byIP[status.IP]
+		if !ok {
+			entry = &IPCount{IP: status.IP, Requests: status.RequestCount, LastPath: status.LastRequestPath}
+			byIP[status.IP] = entry
+		}
+		entry.Blocked = active
+		entry.Permanent = active && status.IsPermanent
+
+		if !status.BlockedAt.After(now) {
+			if i := int(status.BlockedAt.Sub(hourStart) / time.Hour); !status.BlockedAt.Before(hourStart) && i < hourlyBuckets {
+				report.BlocksPerHour[i].Blocks++
+			}
+			for i := dailyBuckets - 1; i >= 0; i-- {
+				if !status.BlockedAt.Before(report.BlocksPerDay[i].Start) {
+					report.BlocksPerDay[i].Blocks++
+					break
+				}
+			}
+		}
+
+		// Only detections follow malicious requests, and a counter that
+		// started after the block was recreated since
+		if counter, ok := counters[status.IP]; ok && status.Source == "" &&
+			!counter.FirstSeen.IsZero() && !counter.FirstSeen.After(status.BlockedAt) {
+			timeToBlock += status.BlockedAt.Sub(counter.FirstSeen)
+			report.TimeToBlockSamples++
+		}
+	}
+	if report.TimeToBlockSamples > 0 {
+		report.AverageTimeToBlock = timeToBlock / time.Duration(report.TimeToBlockSamples)
+	}
+
+	// Rank paths, IPs and autonomous systems
+	paths := make(map[string]int)
+	asns := make(map[string]int)
+	ips := make([]IPCount, 0, len(byIP))
+	for _, entry := range byIP {
+		if entry.LastPath != "" {
+			paths[entry.LastPath]++
+		}
+		if options.ASN != nil {
+			if entry.ASN = options.ASN(entry.IP); entry.ASN != "" {
+				asns[entry.ASN]++
+			}
+		}
+		ips = append(ips, *entry)
+	}
+
+	sort.Slice(ips, func(i, j int) bool {
+		if ips[i].Requests != ips[j].Requests {
+			return ips[i].Requests > ips[j].Requests
+		}
+		if ips[i].Score != ips[j].Score {
+			return ips[i].Score > ips[j].Score
+		}
+		return ips[i].IP < ips[j].IP
+	})
+	if len(ips) > top {
+		ips = ips[:top]
+	}
+	report.TopIPs = ips
+	report.TopPaths = topCounts(paths, top)
+	if options.ASN != nil {
+		report.TopASNs = topCounts(asns, top)
+	}
+
+	return report
+}
+
+// topCounts returns the n largest counts, ties in key order
+func topCounts(counts map[string]int, n int) []Count {
+	list := make([]Count, 0, len(counts))
+	for key, count := range counts {
+		list = append(list, Count{Key: key, Count: count})
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Count != list[j].Count {
+			return list[i].Count > list[j].Count
+		}
+		return list[i].Key < list[j].Key
+	})
+	if len(list) > n {
+		list = list[:n]
+	}
+	return list
+}
+
+// startOfDay returns midnight of the day of t, in t's location
+func startOfDay(t time.Time) time.Time {
+	year, month, day := t.Date()
+	return time.Date(year, month, day, 0, 0, 0, 0, t.Location())
+}
@@ -0,0 +1,181 @@
+package stats
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+)
+
+// Names of the series the middleware records
+const (
+	SeriesDetections = "detections" // Malicious requests detected
+	SeriesBlocks     = "blocks"     // New blocks made
+)
+
+// Resolution and length of the series a Timeline keeps
+const (
+	TimelineResolution = time.Minute
+	TimelineRetention  = 24 * time.Hour
+)
+
+// timelineBuckets is the number of buckets each series keeps, and the
+// number of steps a series returns at most
+const timelineBuckets = int(TimelineRetention / TimelineResolution)
+
+// Timeline counts events per minute over the last day, in memory, for the
+// series of a Dashboard. Storage only keeps the current state of each IP, so
+// the series start empty when the process starts.
+type Timeline struct {
+	mutex  sync.Mutex
+	series map[string]*timelineSeries
+}
+
+// timelineSeries holds the per-minute counts of one series in a ring
+type timelineSeries struct {
+	buckets [timelineBuckets]int
+	current int64 // Index of the newest bucket since the epoch
+}
+
+// NewTimeline creates an empty timeline
+func NewTimeline() *Timeline {
+	return &Timeline{series: make(map[string]*timelineSeries)}
+}
+
+// Add counts an event of a series at a time
+func (t *Timeline) Add(name string, at time.Time) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	series, ok := t.series[name]
+	if !ok {
+		series = &timelineSeries{}
+		t.series[name] = series
+	}
+	index := at.UnixNano() / int64(TimelineResolution)
+	if index < series.current-int64(timelineBuckets)+1 {
+		return
+	}
+	series.advance(index)
+	series.buckets[index%int64(timelineBuckets)]++
+}
+
+// advance moves the ring up to index, emptying the buckets that fell out
+func (s *timelineSeries) advance(index int64) {
+	if index <= s.current {
+		return
+	}
+	if index-s.current >= int64(timelineBuckets) {
+		s.buckets = [timelineBuckets]int{}
+	} else {
+		for i := s.current + 1; i <= index; i++ {
+			s.buckets[i%int64(timelineBuckets)] = 0
+		}
+	}
+	s.current = index
+}
+
+// Series returns the counts of a series from from to to in steps of step,
+// see Step. Times older than the retention count zero.
+func (t *Timeline) Series(name string, from, to time.Time, step time.Duration) Series {
+	step = Step(from, to, step)
+	from = from.Truncate(step)
+	result := Series{Target: name, Datapoints: []Datapoint{}}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	series := t.series[name]
+	oldest, newest := int64(0), int64(-1)
+	if series != nil {
+		series.advance(time.Now().UnixNano() / int64(TimelineResolution))
+		newest = series.current
+		oldest = newest - int64(timelineBuckets) + 1
+	}
+
+	for start := from; start.Before(to); start = start.Add(step) {
+		point := Datapoint{Time: start}
+		first := start.UnixNano() / int64(TimelineResolution)
+		last := first + int64(step/TimelineResolution) - 1
+		for i := max(first, oldest); i <= min(last, newest); i++ {
+			point.Value += series.buckets[i%int64(timelineBuckets)]
+		}
+		result.Datapoints = append(result.Datapoints, point)
+	}
+	return result
+}
+
+// Step returns the step a series from from to to is returned in: step in
+// whole minutes, at least one, and large enough to keep the series within
+// as many steps as a Timeline keeps minutes
+func Step(from, to time.Time, step time.Duration) time.Duration {
+	step = max(step, TimelineResolution).Truncate(TimelineResolution)
+	if span := to.Sub(from); span > step*time.Duration(timelineBuckets) {
+		step = (span / time.Duration(timelineBuckets)).Truncate(TimelineResolution) + TimelineResolution
+	}
+	return step
+}
+
+// Series is a time series in the format Grafana's JSON data sources expect
+type Series struct {
+	Target     string      `json:"target"`
+	Datapoints []Datapoint `json:"datapoints"`
+}
+
+// Datapoint is the count of a step of a series, encoded as [count, unix
+// milliseconds] for Grafana
+type Datapoint struct {
+	Value int
+	Time  time.Time // Start of the step
+}
+
+// MarshalJSON encodes the datapoint as [count, unix milliseconds]
+func (d Datapoint) MarshalJSON() ([]byte, error) {
+	return json.Marshal([2]int64{int64(d.Value), d.Time.UnixMilli()})
+}
+
+// UnmarshalJSON decodes a datapoint encoded by MarshalJSON
+func (d *Datapoint) UnmarshalJSON(data []byte) error {
+	var pair [2]int64
+	if err := json.Unmarshal(data, &pair); err != nil {
+		return err
+	}
+	d.Value = int(pair[0])
+	d.Time = time.UnixMilli(pair[1])
+	return nil
+}
+
+// Dashboard is the data model of a monitoring dashboard: the series of a
+// time range and a snapshot of the current offenders
+type Dashboard struct {
+	Generated time.Time `json:"generated"`
+	From      time.Time `json:"from"`
+	To        time.Time `json:"to"`
+	Interval  string    `json:"interval"` // Length of a step, e.g. "5m0s"
+
+	Series []Series `json:"series"` // Detections and blocks per step, oldest first
+
+	ActiveBlocks  int       `json:"active_blocks"`
+	PermanentBans int       `json:"permanent_bans"`
+	TrackedIPs    int       `json:"tracked_ips"`
+	TopOffenders  []IPCount `json:"top_offenders"` // IPs with the most malicious requests
+	TopPaths      []Count   `json:"top_paths"`     // Most requested malicious paths
+}
+
+// NewDashboard combines the series of a time range with the snapshot of a
+// report
+func NewDashboard(timeline *Timeline, report Report, from, to time.Time, step time.Duration) Dashboard {
+	dashboard := Dashboard{
+		Generated:     report.Generated,
+		From:          from,
+		To:            to,
+		ActiveBlocks:  report.ActiveBlocks,
+		PermanentBans: report.PermanentBans,
+		TrackedIPs:    report.TrackedIPs,
+		TopOffenders:  report.TopIPs,
+		TopPaths:      report.TopPaths,
+	}
+	for _, name := range []string{SeriesDetections, SeriesBlocks} {
+		dashboard.Series = append(dashboard.Series, timeline.Series(name, from, to, step))
+	}
+	dashboard.Interval = Step(from, to, step).String()
+	return dashboard
+}
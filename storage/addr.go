@@ -0,0 +1,33 @@
+package storage
+
+import (
+	"net/netip"
+	"time"
+
+	"github.com/headswim/whoen/ipaddr"
+)
+
+// Storage keys records by the canonical string form of an IP, so these
+// helpers let callers holding a netip.Addr use any Storage implementation
+
+// IsAddrBlocked checks if an address is blocked in store
+func IsAddrBlocked(store Storage, addr netip.Addr) (bool, *BlockStatus, error) {
+	return store.IsIPBlocked(ipaddr.Canonical(addr).String())
+}
+
+// BlockAddr blocks an address in store, see Storage.BlockIP
+func BlockAddr(store Storage, addr netip.Addr, until time.Time, isPermanent bool, path string) error {
+	return store.BlockIP(ipaddr.Canonical(addr).String(), until, isPermanent, path)
+}
+
+// UnblockAddr unblocks an address in store
+func UnblockAddr(store Storage, addr netip.Addr) error {
+	return store.UnblockIP(ipaddr.Canonical(addr).String())
+}
+
+// Addr parses the IP of the block record, returning false if it is not a
+// valid address
+func (b BlockStatus) Addr() (netip.Addr, bool) {
+	addr, err := ipaddr.Parse(b.IP)
+	return addr, err == nil
+}
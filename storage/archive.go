@@ -0,0 +1,68 @@
+package storage
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+)
+
+// History policies applied once an IP's history passes the retention period
+const (
+	HistoryArchive = "archive" // Move the history to the archive file
+	HistoryDrop    = "drop"    // Delete the history
+)
+
+// ArchiveRecord is the archived history of a single IP
+type ArchiveRecord struct {
+	ArchivedAt time.Time       `json:"archived_at"`
+	Block      *BlockStatus    `json:"block,omitempty"`
+	Counter    *RequestCounter `json:"counter,omitempty"`
+}
+
+// appendArchive appends records to a JSON Lines archive file
+func appendArchive(file string, records []ArchiveRecord) error {
+	f, err := os.OpenFile(file, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open archive file %s: %w", file, err)
+	}
+	defer f.Close()
+
+	encoder := json.NewEncoder(f)
+	for _, record := range records {
+		if err := encoder.Encode(record); err != nil {
+			return fmt.Errorf("failed to write archive file %s: %w", file, err)
+		}
+	}
+
+	return nil
+}
+
+// ReadArchive reads all records from a history archive file, for offline queries
+func ReadArchive(file string) ([]ArchiveRecord, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []ArchiveRecord{}, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+
+	var records []ArchiveRecord
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var record ArchiveRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			return nil, fmt.Errorf("%w, invalid archive record on line %d: %w", ErrStorageCorrupt, line, err)
+		}
+		records = append(records, record)
+	}
+
+	return records, scanner.Err()
+}
@@ -0,0 +1,307 @@
+package storage
+
+import (
+	"container/list"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Cache defaults
+const (
+	DefaultCacheSize = 10000
+	DefaultCacheTTL  = 5 * time.Second
+)
+
+// CacheOptions holds the settings of a CachedStorage
+type CacheOptions struct {
+	// Size is the number of IPs kept in the cache. The least recently used
+	// IP is evicted beyond it. Defaults to DefaultCacheSize.
+	Size int
+
+	// TTL is how long a cached lookup is trusted. It bounds how long a change
+	// made by another process sharing the backend goes unnoticed. Defaults to
+	// DefaultCacheTTL.
+	TTL time.Duration
+}
+
+// CachedStorage keeps the block status and request count of recently seen IPs
+// in an LRU cache in front of another Storage, so lookups for hot IPs don't
+// reach a remote backend on every request. Changes made through the cache
+// invalidate the IP they touch; changes made elsewhere show up once the
+// cached entry expires.
+type CachedStorage struct {
+	backend Storage
+	options CacheOptions
+
+	mutex   sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List // Most recently used first, holds *cacheEntry
+
+	// generation is bumped by every invalidation, so a lookup that raced with
+	// a change does not cache the value it read before the change
+	generation uint64
+}
+
+// cacheEntry holds the cached lookups of one IP
+type cacheEntry struct {
+	ip string
+
+	blocked       bool
+	status        *BlockStatus
+	statusExpires time.Time // Zero when the block status is not cached
+
+	count        int
+	countExpires time.Time // Zero when the request count is not cached
+}
+
+// NewCachedStorage wraps a storage with an LRU cache
+func NewCachedStorage(backend Storage, options CacheOptions) *CachedStorage {
+	if options.Size <= 0 {
+		options.Size = DefaultCacheSize
+	}
+	if options.TTL <= 0 {
+		options.TTL = DefaultCacheTTL
+	}
+
+	return &CachedStorage{
+		backend: backend,
+		options: options,
+		entries: make(map[string]*list.Element),
+		lru:     list.New(),
+	}
+}
+
+// Backend returns the wrapped storage
+func (c *CachedStorage) Backend() Storage {
+	return c.backend
+}
+
+// entry returns the cache entry of an IP, creating it and evicting the least
+// recently used entry if needed. The caller must hold the lock.
+func (c *CachedStorage) entry(ip string) *cacheEntry {
+	if element, ok := c.entries[ip]; ok {
+		c.lru.MoveToFront(element)
+		return element.Value.(*cacheEntry)
+	}
+
+	entry := &cacheEntry{ip: ip}
+	c.entries[ip] = c.lru.PushFront(entry)
+	if c.lru.Len() > c.options.Size {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cacheEntry).ip)
+	}
+	return entry
+}
+
+// invalidate drops the cached lookups of an IP
+func (c *CachedStorage) invalidate(ip string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.generation++
+	if element, ok := c.entries[ip]; ok {
+		c.lru.Remove(element)
+		delete(c.entries, ip)
+	}
+}
+
+// invalidateAll empties the cache
+func (c *CachedStorage) invalidateAll() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.generation++
+	c.entries = make(map[string]*list.Element)
+	c.lru.Init()
+}
+
+// IsIPBlocked checks if an IP is blocked, from the cache when possible
+func (c *CachedStorage) IsIPBlocked(ip string) (bool, *BlockStatus, error) {
+	now := time.Now()
+
+	c.mutex.Lock()
+	if element, ok := c.entries[ip]; ok {
+		entry := element.Value.(*cacheEntry)
+		if now.Before(entry.statusExpires) {
+			c.lru.MoveToFront(element)
+			blocked, status := entry.blocked, copyStatus(entry.status)
+			c.mutex.Unlock()
+			return blocked, status, nil
+		}
+	}
+	generation := c.generation
+	c.mutex.Unlock()
+
+	blocked, status, err := c.backend.IsIPBlocked(ip)
+	if err != nil {
+		return blocked, status, err
+	}
+
+	// A temporary block must not outlive its expiry in the cache
+	expires := now.Add(c.options.TTL)
+	if blocked && status != nil && !status.IsPermanent && status.BlockedUntil.Before(expires) {
+		expires = status.BlockedUntil
+	}
+
+	c.mutex.Lock()
+	if c.generation == generation {
+		entry := c.entry(ip)
+		entry.blocked = blocked
+		entry.status = copyStatus(status)
+		entry.statusExpires = expires
+	}
+	c.mutex.Unlock()
+
+	return blocked, status, nil
+}
+
+// GetRequestCount returns the request count of an IP, from the cache when possible
+func (c *CachedStorage) GetRequestCount(ip string) (int, error) {
+	now := time.Now()
+
+	c.mutex.Lock()
+	if element, ok := c.entries[ip]; ok {
+		entry := element.Value.(*cacheEntry)
+		if now.Before(entry.countExpires) {
+			c.lru.MoveToFront(element)
+			count := entry.count
+			c.mutex.Unlock()
+			return count, nil
+		}
+	}
+	generation := c.generation
+	c.mutex.Unlock()
+
+	count, err := c.backend.GetRequestCount(ip)
+	if err != nil {
+		return count, err
+	}
+
+	c.mutex.Lock()
+	if c.generation == generation {
+		entry := c.entry(ip)
+		entry.count = count
+		entry.countExpires = now.Add(c.options.TTL)
+	}
+	c.mutex.Unlock()
+
+	return count, nil
+}
+
+// BlockIP blocks an IP and invalidates its cache entry
+func (c *CachedStorage) BlockIP(ip string, until time.Time, isPermanent bool, path string) error {
+	defer c.invalidate(ip)
+	return c.backend.BlockIP(ip, until, isPermanent, path)
+}
+
+// PutBlock stores a block record and invalidates its IP's cache entry
+func (c *CachedStorage) PutBlock(status BlockStatus) error {
+	defer c.invalidate(status.IP)
+	return PutBlock(c.backend, status)
+}
+
+// UnblockIP unblocks an IP and invalidates its cache entry
+func (c *CachedStorage) UnblockIP(ip string) error {
+	defer c.invalidate(ip)
+	return c.backend.UnblockIP(ip)
+}
+
+// GetBlockedIPs returns all blocked IPs from the backend
+func (c *CachedStorage) GetBlockedIPs() ([]BlockStatus, error) {
+	return c.backend.GetBlockedIPs()
+}
+
+// IncrementRequestCount increments the request count of an IP and invalidates its cache entry
+func (c *CachedStorage) IncrementRequestCount(ip string, path string) error {
+	defer c.invalidate(ip)
+	return c.backend.IncrementRequestCount(ip, path)
+}
+
+// AddScore counts a request and adds to the score of an IP, invalidating its cache entry
+func (c *CachedStorage) AddScore(ip string, path string, score int) (int, error) {
+	defer c.invalidate(ip)
+	return AddScore(c.backend, ip, path, score)
+}
+
+// IncrementTimeoutCount increments the timeout count of an IP and invalidates its cache entry
+func (c *CachedStorage) IncrementTimeoutCount(ip string) error {
+	defer c.invalidate(ip)
+	return c.backend.IncrementTimeoutCount(ip)
+}
+
+// ExtendBlock extends the block of an IP and invalidates its cache entry
+func (c *CachedStorage) ExtendBlock(ip string, by time.Duration) (time.Time, error) {
+	defer c.invalidate(ip)
+	return ExtendBlock(c.backend, ip, by)
+}
+
+// SetRequestCount sets the request count of an IP and invalidates its cache entry
+func (c *CachedStorage) SetRequestCount(ip string, count int, path string) error {
+	defer c.invalidate(ip)
+	return c.backend.SetRequestCount(ip, count, path)
+}
+
+// GetRequestCounter reads the full request counter of an IP from the backend,
+// if it supports it
+func (c *CachedStorage) GetRequestCounter(ip string) (RequestCounter, bool, error) {
+	getter, ok := c.backend.(CounterGetter)
+	if !ok {
+		return RequestCounter{}, false, fmt.Errorf("storage %T cannot read full request counters", c.backend)
+	}
+	return getter.GetRequestCounter(ip)
+}
+
+// PutRequestCounter writes the full request counter of an IP if the backend
+// supports it, and invalidates its cache entry
+func (c *CachedStorage) PutRequestCounter(counter RequestCounter) error {
+	putter, ok := c.backend.(CounterPutter)
+	if !ok {
+		return fmt.Errorf("storage %T cannot write full request counters", c.backend)
+	}
+	defer c.invalidate(counter.IP)
+	return putter.PutRequestCounter(counter)
+}
+
+// ResetRequestCount resets the request count of an IP and invalidates its cache entry
+func (c *CachedStorage) ResetRequestCount(ip string) error {
+	defer c.invalidate(ip)
+	return c.backend.ResetRequestCount(ip)
+}
+
+// GetAllRequestCounts returns all request counters from the backend
+func (c *CachedStorage) GetAllRequestCounts() (map[string]RequestCounter, error) {
+	return c.backend.GetAllRequestCounts()
+}
+
+// CleanupExpired removes expired blocks from the backend and empties the cache
+func (c *CachedStorage) CleanupExpired() error {
+	defer c.invalidateAll()
+	return c.backend.CleanupExpired()
+}
+
+// Save saves the backend
+func (c *CachedStorage) Save() error {
+	return c.backend.Save()
+}
+
+// Load reloads the backend and empties the cache
+func (c *CachedStorage) Load() error {
+	defer c.invalidateAll()
+	return c.backend.Load()
+}
+
+// Close closes the backend
+func (c *CachedStorage) Close() error {
+	return c.backend.Close()
+}
+
+// copyStatus returns a copy of a block status so callers cannot change the cached one
+func copyStatus(status *BlockStatus) *BlockStatus {
+	if status == nil {
+		return nil
+	}
+	copied := *status
+	return &copied
+}
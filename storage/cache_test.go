@@ -0,0 +1,171 @@
+package storage
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/headswim/whoen/kv"
+)
+
+// countingStorage counts the lookups that reach it and fails them with err
+// when it is set
+type countingStorage struct {
+	*KVStorage
+	blockLookups int
+	countLookups int
+	err          error
+}
+
+func (s *countingStorage) IsIPBlocked(ip string) (bool, *BlockStatus, error) {
+	s.blockLookups++
+	if s.err != nil {
+		return false, nil, s.err
+	}
+	return s.KVStorage.IsIPBlocked(ip)
+}
+
+func (s *countingStorage) GetRequestCount(ip string) (int, error) {
+	s.countLookups++
+	if s.err != nil {
+		return 0, s.err
+	}
+	return s.KVStorage.GetRequestCount(ip)
+}
+
+// newCountingStorage creates an in-memory key-value storage that counts lookups
+func newCountingStorage() *countingStorage {
+	return &countingStorage{KVStorage: NewKVStorage(kv.NewMemory(), KVOptions{})}
+}
+
+// TestCachedStorageHitsAndInvalidation checks that repeated lookups are
+// served from the cache and that writes through the cache invalidate them
+func TestCachedStorageHitsAndInvalidation(t *testing.T) {
+	backend := newCountingStorage()
+	c := NewCachedStorage(backend, CacheOptions{TTL: time.Hour})
+
+	for i := 0; i < 3; i++ {
+		if blocked, _, err := c.IsIPBlocked("192.0.2.1"); err != nil || blocked {
+			t.Fatalf("IsIPBlocked = %v, %v, want not blocked", blocked, err)
+		}
+		if count, err := c.GetRequestCount("192.0.2.1"); err != nil || count != 0 {
+			t.Fatalf("GetRequestCount = %d, %v, want 0", count, err)
+		}
+	}
+	if backend.blockLookups != 1 || backend.countLookups != 1 {
+		t.Errorf("backend looked up %d and %d times, want once each", backend.blockLookups, backend.countLookups)
+	}
+
+	if err := c.BlockIP("192.0.2.1", time.Now().Add(time.Hour), false, "/.env"); err != nil {
+		t.Fatalf("BlockIP failed: %v", err)
+	}
+	if blocked, _, _ := c.IsIPBlocked("192.0.2.1"); !blocked {
+		t.Error("cache served the status from before BlockIP")
+	}
+	if _, err := c.AddScore("192.0.2.1", "/.env", 2); err != nil {
+		t.Fatalf("AddScore failed: %v", err)
+	}
+	if count, _ := c.GetRequestCount("192.0.2.1"); count != 1 {
+		t.Errorf("GetRequestCount after AddScore = %d, want 1", count)
+	}
+	if err := c.UnblockIP("192.0.2.1"); err != nil {
+		t.Fatalf("UnblockIP failed: %v", err)
+	}
+	if blocked, _, _ := c.IsIPBlocked("192.0.2.1"); blocked {
+		t.Error("cache served the status from before UnblockIP")
+	}
+
+	// Changes made behind the cache show up once the entry expires
+	backend.BlockIP("192.0.2.1", time.Now().Add(time.Hour), false, "/.env")
+	if blocked, _, _ := c.IsIPBlocked("192.0.2.1"); blocked {
+		t.Error("change made behind the cache seen before the TTL")
+	}
+	if err := c.CleanupExpired(); err != nil {
+		t.Fatalf("CleanupExpired failed: %v", err)
+	}
+	if blocked, _, _ := c.IsIPBlocked("192.0.2.1"); !blocked {
+		t.Error("CleanupExpired left the cache in place")
+	}
+}
+
+// TestCachedStorageExpiry checks that cached lookups expire after the TTL,
+// and cached temporary blocks no later than the block itself
+func TestCachedStorageExpiry(t *testing.T) {
+	backend := newCountingStorage()
+	c := NewCachedStorage(backend, CacheOptions{TTL: 50 * time.Millisecond})
+
+	c.GetRequestCount("192.0.2.1")
+	time.Sleep(60 * time.Millisecond)
+	c.GetRequestCount("192.0.2.1")
+	if backend.countLookups != 2 {
+		t.Errorf("backend looked up %d times, want 2 after the TTL", backend.countLookups)
+	}
+
+	c = NewCachedStorage(backend, CacheOptions{TTL: time.Hour})
+	if err := c.BlockIP("192.0.2.2", time.Now().Add(30*time.Millisecond), false, "/.env"); err != nil {
+		t.Fatalf("BlockIP failed: %v", err)
+	}
+	if blocked, _, _ := c.IsIPBlocked("192.0.2.2"); !blocked {
+		t.Fatal("IP not blocked")
+	}
+	time.Sleep(40 * time.Millisecond)
+	if blocked, _, _ := c.IsIPBlocked("192.0.2.2"); blocked {
+		t.Error("cache kept a temporary block past its expiry")
+	}
+}
+
+// TestCachedStorageEviction checks that the least recently used IP is evicted
+func TestCachedStorageEviction(t *testing.T) {
+	backend := newCountingStorage()
+	c := NewCachedStorage(backend, CacheOptions{Size: 2, TTL: time.Hour})
+
+	c.IsIPBlocked("192.0.2.1")
+	c.IsIPBlocked("192.0.2.2")
+	c.IsIPBlocked("192.0.2.1") // Now the most recently used
+	c.IsIPBlocked("192.0.2.3") // Evicts 192.0.2.2
+	backend.blockLookups = 0
+
+	c.IsIPBlocked("192.0.2.1")
+	c.IsIPBlocked("192.0.2.3")
+	if backend.blockLookups != 0 {
+		t.Errorf("recently used IPs looked up %d times, want none", backend.blockLookups)
+	}
+	c.IsIPBlocked("192.0.2.2")
+	if backend.blockLookups != 1 {
+		t.Errorf("evicted IP looked up %d times, want once", backend.blockLookups)
+	}
+}
+
+// TestCachedStorageErrors checks that failed lookups are returned and not
+// cached, and that cached statuses cannot be changed by callers
+func TestCachedStorageErrors(t *testing.T) {
+	backend := newCountingStorage()
+	c := NewCachedStorage(backend, CacheOptions{TTL: time.Hour})
+
+	backend.err = errors.New("backend down")
+	if _, _, err := c.IsIPBlocked("192.0.2.1"); !errors.Is(err, backend.err) {
+		t.Errorf("IsIPBlocked: %v, want the backend error", err)
+	}
+	if _, err := c.GetRequestCount("192.0.2.1"); !errors.Is(err, backend.err) {
+		t.Errorf("GetRequestCount: %v, want the backend error", err)
+	}
+	backend.err = nil
+	backend.BlockIP("192.0.2.1", time.Now().Add(time.Hour), false, "/.env")
+	if blocked, _, err := c.IsIPBlocked("192.0.2.1"); err != nil || !blocked {
+		t.Errorf("IsIPBlocked after the backend recovered = %v, %v, want blocked", blocked, err)
+	}
+
+	_, status, _ := c.IsIPBlocked("192.0.2.1")
+	status.IsPermanent = true
+	if _, cached, _ := c.IsIPBlocked("192.0.2.1"); cached.IsPermanent {
+		t.Error("caller changed the cached status")
+	}
+
+	core := NewCachedStorage(newCoreStorage(t), CacheOptions{})
+	if _, _, err := core.GetRequestCounter("192.0.2.1"); err == nil {
+		t.Error("GetRequestCounter on a backend without it succeeded")
+	}
+	if err := core.PutRequestCounter(RequestCounter{IP: "192.0.2.1"}); err == nil {
+		t.Error("PutRequestCounter on a backend without it succeeded")
+	}
+}
@@ -3,8 +3,10 @@ package storage
 import (
 	"encoding/json"
 	"fmt"
+	"log"
 	"os"
 	"path/filepath"
+	"sort"
 	"sync"
 	"time"
 )
@@ -13,39 +15,135 @@ import (
 type JSONStorage struct {
 	blockedIPsFile    string
 	requestCountsFile string
+	options           JSONOptions
 	mutex             sync.RWMutex
+
+	// In-memory state used by every persist mode but the immediate one
+	blockedIPs    []BlockStatus
+	requestCounts []RequestCounter
+	dirtyBlocks   bool
+	dirtyCounts   bool
+
+	// flushTimer is the pending save of the batched persist mode, nil when none is scheduled
+	flushTimer *time.Timer
+
+	// done stops the background save loop and closed guards against closing twice
+	done   chan struct{}
+	closed bool
+}
+
+// JSONOptions holds optional settings for JSONStorage
+type JSONOptions struct {
+	// HistoryRetention keeps the record of an expired block (and the IP's request
+	// counter) until the IP has been quiet for this long. Zero removes expired
+	// blocks at the next cleanup.
+	HistoryRetention time.Duration
+
+	// HistoryPolicy decides what happens to history once the retention period
+	// has passed: HistoryArchive (default) or HistoryDrop
+	HistoryPolicy string
+
+	// ArchiveFile is the JSON Lines file archived history is appended to.
+	// Defaults to history_archive.jsonl next to the blocked IPs file.
+	ArchiveFile string
+
+	// MaxRequestCounters caps the number of IPs with a request counter. When
+	// exceeded, the least recently seen counters are evicted. Zero means no limit.
+	MaxRequestCounters int
+
+	// PersistMode decides when changes are written to disk: PersistImmediate
+	// (default) writes on every change, PersistBatched keeps state in memory
+	// and saves FlushInterval after the first unsaved change, PersistInterval
+	// saves every PersistInterval, PersistOnShutdown saves only on Save and
+	// Close, and PersistMemory never writes, loading existing files if readable.
+	PersistMode     string
+	PersistInterval time.Duration
+	FlushInterval   time.Duration
+
+	// SyncOnBlock saves right away in the batched persist mode when a block is
+	// added, changed or lifted, so only request counts wait for the flush
+	SyncOnBlock bool
+
+	// OnSaveError is called when a background save fails. Optional.
+	OnSaveError func(error)
+
+	// Logger receives the errors of background saves when OnSaveError is
+	// not set. Without either they are dropped.
+	Logger *log.Logger
 }
 
 // NewJSONStorage creates a new JSONStorage instance
 func NewJSONStorage(blockedIPsFile string) (*JSONStorage, error) {
+	return NewJSONStorageWithOptions(blockedIPsFile, JSONOptions{})
+}
+
+// NewJSONStorageWithOptions creates a new JSONStorage instance with custom options
+func NewJSONStorageWithOptions(blockedIPsFile string, options JSONOptions) (*JSONStorage, error) {
 	// Create the request counts file in the same directory as the blocked IPs file
 	dir := filepath.Dir(blockedIPsFile)
 	requestCountsFile := filepath.Join(dir, "request_counts.json")
 
+	if options.HistoryPolicy != HistoryDrop {
+		options.HistoryPolicy = HistoryArchive
+	}
+	if options.ArchiveFile == "" {
+		options.ArchiveFile = filepath.Join(dir, "history_archive.jsonl")
+	}
+	if options.PersistMode != PersistBatched && options.PersistMode != PersistInterval &&
+		options.PersistMode != PersistOnShutdown && options.PersistMode != PersistMemory {
+		options.PersistMode = PersistImmediate
+	}
+	if options.PersistInterval <= 0 {
+		options.PersistInterval = DefaultPersistInterval
+	}
+	if options.FlushInterval <= 0 {
+		options.FlushInterval = DefaultFlushInterval
+	}
+
 	storage := &JSONStorage{
 		blockedIPsFile:    blockedIPsFile,
 		requestCountsFile: requestCountsFile,
+		options:           options,
+		done:              make(chan struct{}),
+	}
+
+	// Memory-only storage starts from whatever is on disk and never writes
+	if options.PersistMode == PersistMemory {
+		if err := storage.loadFiles(); err != nil {
+			return nil, err
+		}
+		return storage, nil
 	}
 
 	// Create directory if it doesn't exist
 	if err := os.MkdirAll(dir, 0755); err != nil {
-		return nil, fmt.Errorf("failed to create directory %s: %v", dir, err)
+		return nil, fmt.Errorf("failed to create directory %s: %w", dir, err)
 	}
 
 	// Create files if they don't exist
 	for _, file := range []string{blockedIPsFile, requestCountsFile} {
 		if _, err := os.Stat(file); os.IsNotExist(err) {
 			if err := os.WriteFile(file, []byte("[]"), 0644); err != nil {
-				return nil, fmt.Errorf("failed to create file %s: %v", file, err)
+				return nil, fmt.Errorf("failed to create file %s: %w", file, err)
 			}
 		}
 	}
 
+	// Keep state in memory unless every change is written through
+	if options.PersistMode != PersistImmediate {
+		if err := storage.loadFiles(); err != nil {
+			return nil, err
+		}
+		if options.PersistMode == PersistInterval {
+			go storage.saveLoop()
+		}
+	}
+
 	return storage, nil
 }
 
-// readBlockedIPs reads the blocked IPs from file
-func (s *JSONStorage) readBlockedIPs() ([]BlockStatus, error) {
+// readBlockedIPsFile reads the blocked IPs from file
+func (s *JSONStorage) readBlockedIPsFile() ([]BlockStatus, error) {
 	data, err := os.ReadFile(s.blockedIPsFile)
 	if err != nil {
 		if os.IsNotExist(err) {
@@ -56,14 +154,14 @@ func (s *JSONStorage) readBlockedIPs() ([]BlockStatus, error) {
 
 	var blockedIPs []BlockStatus
 	if err := json.Unmarshal(data, &blockedIPs); err != nil {
-		return nil, err
+		return nil, fmt.Errorf("%w, cannot parse %s: %w", ErrStorageCorrupt, s.blockedIPsFile, err)
 	}
 
 	return blockedIPs, nil
 }
 
-// writeBlockedIPs writes the blocked IPs to file
-func (s *JSONStorage) writeBlockedIPs(blockedIPs []BlockStatus) error {
+// writeBlockedIPsFile writes the blocked IPs to file
+func (s *JSONStorage) writeBlockedIPsFile(blockedIPs []BlockStatus) error {
 	data, err := json.MarshalIndent(blockedIPs, "", "  ")
 	if err != nil {
 		return err
@@ -72,8 +170,8 @@ func (s *JSONStorage) writeBlockedIPs(blockedIPs []BlockStatus) error {
 	return os.WriteFile(s.blockedIPsFile, data, 0644)
 }
 
-// readRequestCounts reads the request counts from file
-func (s *JSONStorage) readRequestCounts() ([]RequestCounter, error) {
+// readRequestCountsFile reads the request counts from file
+func (s *JSONStorage) readRequestCountsFile() ([]RequestCounter, error) {
 	data, err := os.ReadFile(s.requestCountsFile)
 	if err != nil {
 		if os.IsNotExist(err) {
@@ -84,14 +182,14 @@ func (s *JSONStorage) readRequestCounts() ([]RequestCounter, error) {
 
 	var requestCounts []RequestCounter
 	if err := json.Unmarshal(data, &requestCounts); err != nil {
-		return nil, err
+		return nil, fmt.Errorf("%w, cannot parse %s: %w", ErrStorageCorrupt, s.requestCountsFile, err)
 	}
 
 	return requestCounts, nil
 }
 
-// writeRequestCounts writes the request counts to file
-func (s *JSONStorage) writeRequestCounts(requestCounts []RequestCounter) error {
+// writeRequestCountsFile writes the request counts to file
+func (s *JSONStorage) writeRequestCountsFile(requestCounts []RequestCounter) error {
 	data, err := json.MarshalIndent(requestCounts, "", "  ")
 	if err != nil {
 		return err
@@ -123,7 +221,8 @@ func (s *JSONStorage) IsIPBlocked(ip string) (bool, *BlockStatus, error) {
 	return false, nil, nil
 }
 
-// BlockIP blocks an IP
+// BlockIP blocks an IP as detected, clearing the source, reason and operator
+// an earlier block of the IP left on its record
 func (s *JSONStorage) BlockIP(ip string, until time.Time, isPermanent bool, path string) error {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
@@ -140,6 +239,9 @@ func (s *JSONStorage) BlockIP(ip string, until time.Time, isPermanent bool, path
 			blockedIPs[i].BlockedUntil = until
 			blockedIPs[i].IsPermanent = isPermanent
 			blockedIPs[i].LastRequestPath = path
+			blockedIPs[i].Source = ""
+			blockedIPs[i].Reason = ""
+			blockedIPs[i].Operator = ""
 			found = true
 			break
 		}
@@ -157,7 +259,31 @@ func (s *JSONStorage) BlockIP(ip string, until time.Time, isPermanent bool, path
 		})
 	}
 
-	return s.writeBlockedIPs(blockedIPs)
+	return s.commitBlocks(blockedIPs)
+}
+
+// PutBlock inserts or replaces the full block record of an IP
+func (s *JSONStorage) PutBlock(status BlockStatus) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	blockedIPs, err := s.readBlockedIPs()
+	if err != nil {
+		return err
+	}
+
+	if status.BlockedAt.IsZero() {
+		status.BlockedAt = time.Now()
+	}
+
+	for i, existing := range blockedIPs {
+		if existing.IP == status.IP {
+			blockedIPs[i] = status
+			return s.commitBlocks(blockedIPs)
+		}
+	}
+
+	return s.commitBlocks(append(blockedIPs, status))
 }
 
 // UnblockIP unblocks an IP
@@ -178,7 +304,7 @@ func (s *JSONStorage) UnblockIP(ip string) error {
 		}
 	}
 
-	return s.writeBlockedIPs(newBlockedIPs)
+	return s.commitBlocks(newBlockedIPs)
 }
 
 // GetBlockedIPs returns all blocked IPs
@@ -194,19 +320,36 @@ func (s *JSONStorage) IncrementRequestCount(ip string, path string) error {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
 
+	_, err := s.incrementRequest(ip, path, 0)
+	return err
+}
+
+// AddScore increments the request count for an IP, adds to its score and returns the new score
+func (s *JSONStorage) AddScore(ip string, path string, score int) (int, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.incrementRequest(ip, path, score)
+}
+
+// incrementRequest records a malicious request and its score. The caller must hold the lock.
+func (s *JSONStorage) incrementRequest(ip string, path string, score int) (int, error) {
 	requestCounts, err := s.readRequestCounts()
 	if err != nil {
-		return err
+		return 0, err
 	}
 
 	// Update request counts
 	now := time.Now()
+	total := score
 	found := false
 	for i, counter := range requestCounts {
 		if counter.IP == ip {
 			requestCounts[i].Count++
+			requestCounts[i].Score += score
 			requestCounts[i].LastSeen = now
 			requestCounts[i].LastPath = path
+			total = requestCounts[i].Score
 			found = true
 			break
 		}
@@ -216,16 +359,18 @@ func (s *JSONStorage) IncrementRequestCount(ip string, path string) error {
 		requestCounts = append(requestCounts, RequestCounter{
 			IP:        ip,
 			Count:     1,
+			Score:     score,
 			FirstSeen: now,
 			LastSeen:  now,
 			LastPath:  path,
 		})
+		requestCounts = evictOldest(requestCounts, s.options.MaxRequestCounters)
 	}
 
 	// Also update blocked IP status if it exists
 	blockedIPs, err := s.readBlockedIPs()
 	if err != nil {
-		return err
+		return 0, err
 	}
 
 	for i, status := range blockedIPs {
@@ -233,13 +378,13 @@ func (s *JSONStorage) IncrementRequestCount(ip string, path string) error {
 			blockedIPs[i].RequestCount++
 			blockedIPs[i].LastRequestPath = path
 			if err := s.writeBlockedIPs(blockedIPs); err != nil {
-				return err
+				return 0, err
 			}
 			break
 		}
 	}
 
-	return s.writeRequestCounts(requestCounts)
+	return total, s.writeRequestCounts(requestCounts)
 }
 
 // IncrementTimeoutCount increments the timeout count for an IP
@@ -279,6 +424,31 @@ func (s *JSONStorage) IncrementTimeoutCount(ip string) error {
 	return nil
 }
 
+// ExtendBlock pushes back the expiry of a temporary block and returns the new expiry.
+// Permanent, expired and unknown blocks are left untouched and a zero time is returned.
+func (s *JSONStorage) ExtendBlock(ip string, by time.Duration) (time.Time, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	blockedIPs, err := s.readBlockedIPs()
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	now := time.Now()
+	for i, status := range blockedIPs {
+		if status.IP == ip {
+			if status.IsPermanent || now.After(status.BlockedUntil) {
+				return time.Time{}, nil
+			}
+			blockedIPs[i].BlockedUntil = status.BlockedUntil.Add(by)
+			return blockedIPs[i].BlockedUntil, s.commitBlocks(blockedIPs)
+		}
+	}
+
+	return time.Time{}, nil
+}
+
 // GetRequestCount gets the request count for an IP
 func (s *JSONStorage) GetRequestCount(ip string) (int, error) {
 	s.mutex.RLock()
@@ -298,6 +468,25 @@ func (s *JSONStorage) GetRequestCount(ip string) (int, error) {
 	return 0, nil
 }
 
+// GetRequestCounter returns the full request counter of an IP, and whether it has one
+func (s *JSONStorage) GetRequestCounter(ip string) (RequestCounter, bool, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	requestCounts, err := s.readRequestCounts()
+	if err != nil {
+		return RequestCounter{}, false, err
+	}
+
+	for _, counter := range requestCounts {
+		if counter.IP == ip {
+			return counter, true, nil
+		}
+	}
+
+	return RequestCounter{}, false, nil
+}
+
 // SetRequestCount sets the request count for an IP
 func (s *JSONStorage) SetRequestCount(ip string, count int, path string) error {
 	s.mutex.Lock()
@@ -333,6 +522,26 @@ func (s *JSONStorage) SetRequestCount(ip string, count int, path string) error {
 	return s.writeRequestCounts(requestCounts)
 }
 
+// PutRequestCounter inserts or replaces the full request counter of an IP
+func (s *JSONStorage) PutRequestCounter(counter RequestCounter) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	requestCounts, err := s.readRequestCounts()
+	if err != nil {
+		return err
+	}
+
+	for i, existing := range requestCounts {
+		if existing.IP == counter.IP {
+			requestCounts[i] = counter
+			return s.writeRequestCounts(requestCounts)
+		}
+	}
+
+	return s.writeRequestCounts(append(requestCounts, counter))
+}
+
 // ResetRequestCount resets the request count for an IP
 func (s *JSONStorage) ResetRequestCount(ip string) error {
 	s.mutex.Lock()
@@ -371,7 +580,9 @@ func (s *JSONStorage) GetAllRequestCounts() (map[string]RequestCounter, error) {
 	return result, nil
 }
 
-// CleanupExpired removes expired blocks from storage
+// CleanupExpired removes expired blocks from storage. With a history retention
+// configured, expired blocks are kept until the IP has been quiet for the
+// retention period and are then archived or dropped according to the policy.
 func (s *JSONStorage) CleanupExpired() error {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
@@ -381,49 +592,100 @@ func (s *JSONStorage) CleanupExpired() error {
 		return err
 	}
 
+	requestCounts, err := s.readRequestCounts()
+	if err != nil {
+		return err
+	}
+
+	counters := make(map[string]RequestCounter, len(requestCounts))
+	for _, counter := range requestCounts {
+		counters[counter.IP] = counter
+	}
+
 	now := time.Now()
 	staleThreshold := now.Add(-24 * time.Hour)
+	quietThreshold := now.Add(-s.options.HistoryRetention)
 
 	// Clean up expired blocks
+	retained := make(map[string]bool)
+	expired := make(map[string]BlockStatus)
 	newBlockedIPs := make([]BlockStatus, 0, len(blockedIPs))
 	for _, status := range blockedIPs {
-		if !status.IsPermanent && now.After(status.BlockedUntil) {
+		if status.IsPermanent || !now.After(status.BlockedUntil) || status.OnProbation(now) || status.InAppealCooldown(now) {
+			newBlockedIPs = append(newBlockedIPs, status)
 			continue
 		}
-		newBlockedIPs = append(newBlockedIPs, status)
-	}
 
-	if err := s.writeBlockedIPs(newBlockedIPs); err != nil {
-		return err
-	}
+		if s.options.HistoryRetention > 0 && lastActivity(status, counters).After(quietThreshold) {
+			retained[status.IP] = true
+			newBlockedIPs = append(newBlockedIPs, status)
+			continue
+		}
 
-	// Clean up stale request counts
-	requestCounts, err := s.readRequestCounts()
-	if err != nil {
-		return err
+		expired[status.IP] = status
 	}
 
+	// Clean up stale request counts, keeping the ones that belong to retained history
+	var archive []ArchiveRecord
 	newRequestCounts := make([]RequestCounter, 0, len(requestCounts))
 	for _, counter := range requestCounts {
+		if retained[counter.IP] {
+			newRequestCounts = append(newRequestCounts, counter)
+			continue
+		}
+
+		if status, ok := expired[counter.IP]; ok && s.options.HistoryRetention > 0 {
+			status, counter := status, counter
+			archive = append(archive, ArchiveRecord{ArchivedAt: now, Block: &status, Counter: &counter})
+			delete(expired, counter.IP)
+			continue
+		}
+
 		if !counter.LastSeen.Before(staleThreshold) {
 			newRequestCounts = append(newRequestCounts, counter)
 		}
 	}
 
+	// Expired blocks without a request counter are archived on their own
+	if s.options.HistoryRetention > 0 {
+		for _, status := range expired {
+			status := status
+			archive = append(archive, ArchiveRecord{ArchivedAt: now, Block: &status})
+		}
+	}
+
+	// Archive before removing anything so history is never lost on a write error
+	if len(archive) > 0 && s.options.HistoryPolicy == HistoryArchive && s.options.PersistMode != PersistMemory {
+		if err := appendArchive(s.options.ArchiveFile, archive); err != nil {
+			return err
+		}
+	}
+
+	if err := s.writeBlockedIPs(newBlockedIPs); err != nil {
+		return err
+	}
+
 	return s.writeRequestCounts(newRequestCounts)
 }
 
-// Save is a no-op since we save immediately after each operation
-func (s *JSONStorage) Save() error {
-	return nil
-}
+// evictOldest drops the least recently seen counters until at most max remain
+func evictOldest(requestCounts []RequestCounter, max int) []RequestCounter {
+	if max <= 0 || len(requestCounts) <= max {
+		return requestCounts
+	}
 
-// Load is a no-op since we load for each operation
-func (s *JSONStorage) Load() error {
-	return nil
+	sorted := append([]RequestCounter(nil), requestCounts...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].LastSeen.After(sorted[j].LastSeen)
+	})
+	return sorted[:max]
 }
 
-// Close is a no-op since we don't maintain any in-memory state
-func (s *JSONStorage) Close() error {
-	return nil
+// lastActivity returns the last time an IP with an expired block was seen
+func lastActivity(status BlockStatus, counters map[string]RequestCounter) time.Time {
+	last := status.BlockedUntil
+	if counter, ok := counters[status.IP]; ok && counter.LastSeen.After(last) {
+		last = counter.LastSeen
+	}
+	return last
 }
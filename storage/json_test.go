@@ -0,0 +1,199 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestJSONStorageCloseWritesPendingFlush checks that changes waiting for the
+// debounced flush of the batched persist mode are saved by Close
+func TestJSONStorageCloseWritesPendingFlush(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "blocked_ips.json")
+	s, err := NewJSONStorageWithOptions(file, JSONOptions{PersistMode: PersistBatched, FlushInterval: time.Hour})
+	if err != nil {
+		t.Fatalf("failed to create storage: %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		if err := s.IncrementRequestCount("192.0.2.1", "/wp-login.php"); err != nil {
+			t.Fatalf("failed to count request: %v", err)
+		}
+	}
+
+	// Nothing is on disk until the flush
+	counts, err := s.readRequestCountsFile()
+	if err != nil {
+		t.Fatalf("failed to read request counts: %v", err)
+	}
+	if len(counts) != 0 {
+		t.Fatalf("request counts were written before the flush: %v", counts)
+	}
+
+	if err := s.Close(); err != nil {
+		t.Fatalf("failed to close storage: %v", err)
+	}
+
+	reopened, err := NewJSONStorage(file)
+	if err != nil {
+		t.Fatalf("failed to reopen storage: %v", err)
+	}
+	defer reopened.Close()
+	count, err := reopened.GetRequestCount("192.0.2.1")
+	if err != nil {
+		t.Fatalf("failed to read request count: %v", err)
+	}
+	if count != 3 {
+		t.Errorf("request count after Close = %d, want 3", count)
+	}
+}
+
+// TestJSONStorageBatchedFlush checks that the batched persist mode saves
+// request counts once the flush interval has passed, and blocks right away
+// with SyncOnBlock
+func TestJSONStorageBatchedFlush(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "blocked_ips.json")
+	s, err := NewJSONStorageWithOptions(file, JSONOptions{PersistMode: PersistBatched, FlushInterval: 50 * time.Millisecond, SyncOnBlock: true})
+	if err != nil {
+		t.Fatalf("failed to create storage: %v", err)
+	}
+	defer s.Close()
+
+	if err := s.BlockIP("192.0.2.1", time.Now().Add(time.Hour), false, "/.env"); err != nil {
+		t.Fatalf("failed to block: %v", err)
+	}
+	if blocks, err := s.readBlockedIPsFile(); err != nil || len(blocks) != 1 {
+		t.Errorf("blocks on disk right after BlockIP = %v, %v, want the block", blocks, err)
+	}
+
+	if err := s.IncrementRequestCount("192.0.2.2", "/.env"); err != nil {
+		t.Fatalf("failed to count request: %v", err)
+	}
+	if counts, _ := s.readRequestCountsFile(); len(counts) != 0 {
+		t.Errorf("request counts written before the flush: %v", counts)
+	}
+	time.Sleep(150 * time.Millisecond)
+	if counts, err := s.readRequestCountsFile(); err != nil || len(counts) != 1 {
+		t.Errorf("request counts on disk after the flush = %v, %v, want one", counts, err)
+	}
+}
+
+// TestJSONStorageSaveErrors checks that failed background saves are
+// reported, keep the changes pending and are retried by the next save
+func TestJSONStorageSaveErrors(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "whoen")
+	file := filepath.Join(dir, "blocked_ips.json")
+	saveErrors := make(chan error, 10)
+	s, err := NewJSONStorageWithOptions(file, JSONOptions{
+		PersistMode:   PersistBatched,
+		FlushInterval: 20 * time.Millisecond,
+		OnSaveError:   func(err error) { saveErrors <- err },
+	})
+	if err != nil {
+		t.Fatalf("failed to create storage: %v", err)
+	}
+
+	// Take the directory away so the flush cannot write
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatalf("failed to remove directory: %v", err)
+	}
+	if err := s.IncrementRequestCount("192.0.2.1", "/.env"); err != nil {
+		t.Fatalf("failed to count request: %v", err)
+	}
+	select {
+	case err := <-saveErrors:
+		if !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("save error = %v, want a missing directory", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("failed flush was not reported")
+	}
+	if err := s.Save(); err == nil {
+		t.Error("Save without the directory succeeded")
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatalf("failed to recreate directory: %v", err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	if counts, err := s.readRequestCountsFile(); err != nil || len(counts) != 1 {
+		t.Errorf("request counts after the retry = %v, %v, want the pending count", counts, err)
+	}
+}
+
+// TestJSONStorageMemoryAndCorruptFiles checks that the memory persist mode
+// never writes, and that corrupt files are reported on load
+func TestJSONStorageMemoryAndCorruptFiles(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "blocked_ips.json")
+	s, err := NewJSONStorageWithOptions(file, JSONOptions{PersistMode: PersistMemory})
+	if err != nil {
+		t.Fatalf("failed to create storage: %v", err)
+	}
+	if err := s.BlockIP("192.0.2.1", time.Now().Add(time.Hour), false, "/.env"); err != nil {
+		t.Fatalf("failed to block: %v", err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	if _, err := os.Stat(file); !os.IsNotExist(err) {
+		t.Errorf("memory mode wrote %s: %v", file, err)
+	}
+
+	if err := os.WriteFile(file, []byte("{not json"), 0644); err != nil {
+		t.Fatalf("failed to write file: %v", err)
+	}
+	for _, mode := range []string{PersistMemory, PersistBatched} {
+		if _, err := NewJSONStorageWithOptions(file, JSONOptions{PersistMode: mode}); !errors.Is(err, ErrStorageCorrupt) {
+			t.Errorf("%s storage on a corrupt file: %v, want ErrStorageCorrupt", mode, err)
+		}
+	}
+	immediate, err := NewJSONStorage(file)
+	if err != nil {
+		t.Fatalf("failed to create storage: %v", err)
+	}
+	defer immediate.Close()
+	if err := immediate.Load(); !errors.Is(err, ErrStorageCorrupt) {
+		t.Errorf("Load of a corrupt file: %v, want ErrStorageCorrupt", err)
+	}
+}
+
+// benchmarkConcurrentWrites counts requests from many goroutines, each from
+// its own IP, in a persist mode
+func benchmarkConcurrentWrites(b *testing.B, mode string) {
+	file := filepath.Join(b.TempDir(), "blocked_ips.json")
+	s, err := NewJSONStorageWithOptions(file, JSONOptions{PersistMode: mode})
+	if err != nil {
+		b.Fatalf("failed to create storage: %v", err)
+	}
+	defer s.Close()
+
+	var goroutines atomic.Int32
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		ip := fmt.Sprintf("198.51.100.%d", goroutines.Add(1))
+		for pb.Next() {
+			if err := s.IncrementRequestCount(ip, "/wp-login.php"); err != nil {
+				b.Errorf("failed to count request: %v", err)
+				return
+			}
+		}
+	})
+}
+
+// BenchmarkJSONStorageImmediate writes the request counts file on every
+// malicious request
+func BenchmarkJSONStorageImmediate(b *testing.B) {
+	benchmarkConcurrentWrites(b, PersistImmediate)
+}
+
+// BenchmarkJSONStorageBatched collects the same writes in memory and saves
+// them with the debounced flush
+func BenchmarkJSONStorageBatched(b *testing.B) {
+	benchmarkConcurrentWrites(b, PersistBatched)
+}
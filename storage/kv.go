@@ -0,0 +1,567 @@
+package storage
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/headswim/whoen/kv"
+)
+
+// KVStorage defaults
+const (
+	DefaultKVPrefix   = "whoen:"
+	DefaultCounterTTL = 24 * time.Hour
+)
+
+// Names of the KVStorage indexes
+const (
+	kvBlockIndex   = "index:blocks"
+	kvCounterIndex = "index:counters"
+)
+
+// KVOptions holds the settings of a KVStorage
+type KVOptions struct {
+	// Prefix is put in front of every key, so several applications can share
+	// a server. Defaults to DefaultKVPrefix. Keep it well below
+	// kv.MaxKeyLength, which bounds whole keys on memcached.
+	Prefix string
+
+	// CounterTTL is how long the request counter of an IP is kept after its
+	// last malicious request. Defaults to DefaultCounterTTL.
+	CounterTTL time.Duration
+
+	// HistoryRetention keeps the record of an expired temporary block for this
+	// long after it expires. Zero lets the record go when the block expires.
+	HistoryRetention time.Duration
+}
+
+// KVStorage implements the Storage interface on a key-value store such as
+// memcached or Valkey, see package kv. Each block and request counter is a
+// key of its own and expires through the store's TTLs; request counts and
+// scores use Incr, so instances sharing the store count together.
+//
+// GetBlockedIPs and GetAllRequestCounts read an index of IPs kept next to the
+// records. Index updates are not atomic across instances, so an IP added by
+// two instances at once may be missing from listings until it is written
+// again; its block is still enforced and its requests still counted.
+type KVStorage struct {
+	store   kv.Store
+	options KVOptions
+
+	// mutex serializes read-modify-write updates made by this process
+	mutex sync.Mutex
+}
+
+// NewKVStorage creates a storage on a key-value store
+func NewKVStorage(store kv.Store, options KVOptions) *KVStorage {
+	if options.Prefix == "" {
+		options.Prefix = DefaultKVPrefix
+	}
+	if options.CounterTTL <= 0 {
+		options.CounterTTL = DefaultCounterTTL
+	}
+	if options.HistoryRetention < 0 {
+		options.HistoryRetention = 0
+	}
+	return &KVStorage{store: store, options: options}
+}
+
+// key returns the key of a record of an IP. IPs and CIDR ranges are used as
+// they are; anything else, or a key that would be too long, is hashed, so
+// no value can end a memcached command line or run past its key limit.
+func (s *KVStorage) key(kind, ip string) string {
+	key := s.options.Prefix + kind + ":" + ip
+	if len(key) <= kv.MaxKeyLength && strings.Trim(ip, "0123456789abcdefABCDEF.:/") == "" {
+		return key
+	}
+	sum := sha256.Sum256([]byte(ip))
+	return s.options.Prefix + kind + "#" + hex.EncodeToString(sum[:16])
+}
+
+// IsIPBlocked checks if an IP is blocked
+func (s *KVStorage) IsIPBlocked(ip string) (bool, *BlockStatus, error) {
+	status, found, err := s.getBlock(ip)
+	if err != nil || !found {
+		return false, nil, err
+	}
+
+	if !status.IsPermanent && time.Now().After(status.BlockedUntil) {
+		return false, &status, nil
+	}
+	return true, &status, nil
+}
+
+// BlockIP blocks an IP as detected, clearing the source, reason and operator
+// an earlier block of the IP left on its record
+func (s *KVStorage) BlockIP(ip string, until time.Time, isPermanent bool, path string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	status, found, err := s.getBlock(ip)
+	if err != nil {
+		return err
+	}
+
+	// Update or add block status
+	if !found {
+		status = BlockStatus{IP: ip, BlockedAt: time.Now(), RequestCount: 1}
+	}
+	status.BlockedUntil = until
+	status.IsPermanent = isPermanent
+	status.LastRequestPath = path
+	status.Source = ""
+	status.Reason = ""
+	status.Operator = ""
+
+	return s.putBlock(status, !found)
+}
+
+// PutBlock inserts or replaces the full block record of an IP
+func (s *KVStorage) PutBlock(status BlockStatus) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if status.BlockedAt.IsZero() {
+		status.BlockedAt = time.Now()
+	}
+	return s.putBlock(status, true)
+}
+
+// UnblockIP unblocks an IP
+func (s *KVStorage) UnblockIP(ip string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if err := s.store.Delete(s.key("block", ip)); err != nil {
+		return fmt.Errorf("failed to delete block of IP %s: %w", ip, err)
+	}
+	return s.removeFromIndex(kvBlockIndex, ip)
+}
+
+// GetBlockedIPs returns all blocked IPs
+func (s *KVStorage) GetBlockedIPs() ([]BlockStatus, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	ips, err := s.readIndex(kvBlockIndex)
+	if err != nil {
+		return nil, err
+	}
+
+	blockedIPs := make([]BlockStatus, 0, len(ips))
+	live := make([]string, 0, len(ips))
+	for _, ip := range ips {
+		status, found, err := s.getBlock(ip)
+		if err != nil {
+			return nil, err
+		}
+		if found {
+			blockedIPs = append(blockedIPs, status)
+			live = append(live, ip)
+		}
+	}
+
+	// Drop the IPs whose records have expired from the index
+	if len(live) < len(ips) {
+		if err := s.writeIndex(kvBlockIndex, live); err != nil {
+			return nil, err
+		}
+	}
+	return blockedIPs, nil
+}
+
+// IncrementRequestCount increments the request count for an IP
+func (s *KVStorage) IncrementRequestCount(ip string, path string) error {
+	_, err := s.incrementRequest(ip, path, 0)
+	return err
+}
+
+// AddScore increments the request count for an IP, adds to its score and returns the new score
+func (s *KVStorage) AddScore(ip string, path string, score int) (int, error) {
+	return s.incrementRequest(ip, path, score)
+}
+
+// incrementRequest records a malicious request and its score
+func (s *KVStorage) incrementRequest(ip string, path string, score int) (int, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	// Count and score with Incr, so concurrent instances don't lose requests
+	if _, err := s.incr("count", ip, 1); err != nil {
+		return 0, err
+	}
+	total, err := s.incr("score", ip, int64(score))
+	if err != nil {
+		return 0, err
+	}
+
+	// Update the counter record
+	if err := s.touchCounter(ip, path); err != nil {
+		return 0, err
+	}
+
+	// Also update blocked IP status if it exists
+	status, found, err := s.getBlock(ip)
+	if err != nil {
+		return 0, err
+	}
+	if found {
+		status.RequestCount++
+		status.LastRequestPath = path
+		if err := s.putBlock(status, false); err != nil {
+			return 0, err
+		}
+	}
+
+	return int(total), nil
+}
+
+// IncrementTimeoutCount increments the timeout count for an IP
+func (s *KVStorage) IncrementTimeoutCount(ip string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	counter, found, err := s.getCounterRecord(ip)
+	if err != nil {
+		return err
+	}
+	if found {
+		counter.TimeoutCount++
+		if err := s.setJSON(s.key("counter", ip), counter, s.options.CounterTTL); err != nil {
+			return err
+		}
+	}
+
+	// Also update blocked IP status if it exists
+	status, found, err := s.getBlock(ip)
+	if err != nil || !found {
+		return err
+	}
+	status.TimeoutCount++
+	return s.putBlock(status, false)
+}
+
+// ExtendBlock pushes back the expiry of a temporary block and returns the new expiry.
+// Permanent, expired and unknown blocks are left untouched and a zero time is returned.
+func (s *KVStorage) ExtendBlock(ip string, by time.Duration) (time.Time, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	status, found, err := s.getBlock(ip)
+	if err != nil || !found {
+		return time.Time{}, err
+	}
+	if status.IsPermanent || time.Now().After(status.BlockedUntil) {
+		return time.Time{}, nil
+	}
+
+	status.BlockedUntil = status.BlockedUntil.Add(by)
+	return status.BlockedUntil, s.putBlock(status, false)
+}
+
+// GetRequestCount gets the request count for an IP
+func (s *KVStorage) GetRequestCount(ip string) (int, error) {
+	count, _, err := s.getInt("count", ip)
+	return int(count), err
+}
+
+// GetRequestCounter returns the full request counter of an IP, and whether it has one
+func (s *KVStorage) GetRequestCounter(ip string) (RequestCounter, bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.getCounter(ip)
+}
+
+// SetRequestCount sets the request count for an IP
+func (s *KVStorage) SetRequestCount(ip string, count int, path string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if err := s.store.Set(s.key("count", ip), []byte(strconv.Itoa(count)), s.options.CounterTTL); err != nil {
+		return fmt.Errorf("failed to set request count of IP %s: %w", ip, err)
+	}
+	return s.touchCounter(ip, path)
+}
+
+// PutRequestCounter writes the full request counter of an IP. It expires
+// CounterTTL after the counter was last seen.
+func (s *KVStorage) PutRequestCounter(counter RequestCounter) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	// A zero TTL would keep the counter forever
+	ttl := max(s.options.CounterTTL-time.Since(counter.LastSeen), time.Second)
+	values := map[string]int{"count": counter.Count, "score": counter.Score}
+	for kind, value := range values {
+		if err := s.store.Set(s.key(kind, counter.IP), []byte(strconv.Itoa(value)), ttl); err != nil {
+			return fmt.Errorf("failed to set %s of IP %s: %w", kind, counter.IP, err)
+		}
+	}
+
+	record := counter
+	record.Count, record.Score = 0, 0
+	if err := s.setJSON(s.key("counter", counter.IP), record, ttl); err != nil {
+		return err
+	}
+	return s.addToIndex(kvCounterIndex, counter.IP)
+}
+
+// ResetRequestCount resets the request count for an IP
+func (s *KVStorage) ResetRequestCount(ip string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for _, kind := range []string{"count", "score", "counter"} {
+		if err := s.store.Delete(s.key(kind, ip)); err != nil {
+			return fmt.Errorf("failed to reset request count of IP %s: %w", ip, err)
+		}
+	}
+	return s.removeFromIndex(kvCounterIndex, ip)
+}
+
+// GetAllRequestCounts returns all request counts
+func (s *KVStorage) GetAllRequestCounts() (map[string]RequestCounter, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	ips, err := s.readIndex(kvCounterIndex)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make(map[string]RequestCounter, len(ips))
+	live := make([]string, 0, len(ips))
+	for _, ip := range ips {
+		counter, found, err := s.getCounter(ip)
+		if err != nil {
+			return nil, err
+		}
+		if found {
+			result[ip] = counter
+			live = append(live, ip)
+		}
+	}
+
+	// Drop the IPs whose counters have expired from the index
+	if len(live) < len(ips) {
+		if err := s.writeIndex(kvCounterIndex, live); err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+// CleanupExpired drops expired records from the indexes. The records
+// themselves expire through the store's TTLs.
+func (s *KVStorage) CleanupExpired() error {
+	if _, err := s.GetBlockedIPs(); err != nil {
+		return err
+	}
+	_, err := s.GetAllRequestCounts()
+	return err
+}
+
+// Save does nothing, every change is written to the store right away
+func (s *KVStorage) Save() error {
+	return nil
+}
+
+// Load does nothing, every lookup reads the store
+func (s *KVStorage) Load() error {
+	return nil
+}
+
+// Close closes the store if it holds connections
+func (s *KVStorage) Close() error {
+	if closer, ok := s.store.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// getBlock reads the block record of an IP
+func (s *KVStorage) getBlock(ip string) (BlockStatus, bool, error) {
+	var status BlockStatus
+	found, err := s.getJSON(s.key("block", ip), &status)
+	return status, found, err
+}
+
+// putBlock writes a block record, expiring it HistoryRetention after a
+// temporary block ends or once its probation or appeal cooldown ends,
+// whichever is later, and adds the IP to the index if it may be new. The
+// caller must hold the lock.
+func (s *KVStorage) putBlock(status BlockStatus, index bool) error {
+	var ttl time.Duration
+	if !status.IsPermanent {
+		// A zero TTL would keep the record forever
+		ttl = max(time.Until(status.BlockedUntil)+s.options.HistoryRetention, time.Until(status.ProbationUntil),
+			time.Until(status.AppealCooldownUntil), time.Second)
+	}
+	if err := s.setJSON(s.key("block", status.IP), status, ttl); err != nil {
+		return err
+	}
+	if index {
+		return s.addToIndex(kvBlockIndex, status.IP)
+	}
+	return nil
+}
+
+// getCounterRecord reads the counter record of an IP, without its count and score
+func (s *KVStorage) getCounterRecord(ip string) (RequestCounter, bool, error) {
+	var counter RequestCounter
+	found, err := s.getJSON(s.key("counter", ip), &counter)
+	return counter, found, err
+}
+
+// getCounter reads the counter of an IP with its count and score
+func (s *KVStorage) getCounter(ip string) (RequestCounter, bool, error) {
+	counter, found, err := s.getCounterRecord(ip)
+	if err != nil || !found {
+		return counter, found, err
+	}
+
+	count, _, err := s.getInt("count", ip)
+	if err != nil {
+		return counter, false, err
+	}
+	score, _, err := s.getInt("score", ip)
+	if err != nil {
+		return counter, false, err
+	}
+	counter.Count, counter.Score = int(count), int(score)
+	return counter, true, nil
+}
+
+// touchCounter records a request in the counter record of an IP, creating
+// it if needed, and renews the TTL of its count and score. The caller must
+// hold the lock.
+func (s *KVStorage) touchCounter(ip, path string) error {
+	counter, found, err := s.getCounterRecord(ip)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	if !found {
+		counter = RequestCounter{IP: ip, FirstSeen: now}
+	}
+	counter.LastSeen = now
+	counter.LastPath = path
+	if err := s.setJSON(s.key("counter", ip), counter, s.options.CounterTTL); err != nil {
+		return err
+	}
+
+	for _, kind := range []string{"count", "score"} {
+		if err := s.store.Expire(s.key(kind, ip), s.options.CounterTTL); err != nil {
+			return fmt.Errorf("failed to renew %s of IP %s: %w", kind, ip, err)
+		}
+	}
+	if !found {
+		return s.addToIndex(kvCounterIndex, ip)
+	}
+	return nil
+}
+
+// incr adds delta to an integer record of an IP
+func (s *KVStorage) incr(kind, ip string, delta int64) (int64, error) {
+	value, err := s.store.Incr(s.key(kind, ip), delta)
+	if err != nil {
+		return 0, fmt.Errorf("failed to increment %s of IP %s: %w", kind, ip, err)
+	}
+	return value, nil
+}
+
+// getInt reads an integer record of an IP, zero if it does not exist
+func (s *KVStorage) getInt(kind, ip string) (int64, bool, error) {
+	value, found, err := s.store.Get(s.key(kind, ip))
+	if err != nil {
+		return 0, false, fmt.Errorf("failed to read %s of IP %s: %w", kind, ip, err)
+	}
+	if !found {
+		return 0, false, nil
+	}
+	n, err := strconv.ParseInt(string(value), 10, 64)
+	if err != nil {
+		return 0, false, fmt.Errorf("%w, invalid %s of IP %s: %w", ErrStorageCorrupt, kind, ip, err)
+	}
+	return n, true, nil
+}
+
+// getJSON reads and decodes a JSON record
+func (s *KVStorage) getJSON(key string, value any) (bool, error) {
+	data, found, err := s.store.Get(key)
+	if err != nil {
+		return false, fmt.Errorf("failed to read %s: %w", key, err)
+	}
+	if !found {
+		return false, nil
+	}
+	if err := json.Unmarshal(data, value); err != nil {
+		return false, fmt.Errorf("%w, cannot decode %s: %w", ErrStorageCorrupt, key, err)
+	}
+	return true, nil
+}
+
+// setJSON encodes and writes a JSON record
+func (s *KVStorage) setJSON(key string, value any, ttl time.Duration) error {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Errorf("failed to encode %s: %w", key, err)
+	}
+	if err := s.store.Set(key, data, ttl); err != nil {
+		return fmt.Errorf("failed to write %s: %w", key, err)
+	}
+	return nil
+}
+
+// readIndex reads the IPs of an index
+func (s *KVStorage) readIndex(name string) ([]string, error) {
+	var ips []string
+	_, err := s.getJSON(s.options.Prefix+name, &ips)
+	return ips, err
+}
+
+// writeIndex replaces the IPs of an index
+func (s *KVStorage) writeIndex(name string, ips []string) error {
+	return s.setJSON(s.options.Prefix+name, ips, 0)
+}
+
+// addToIndex adds an IP to an index unless it is already listed
+func (s *KVStorage) addToIndex(name, ip string) error {
+	ips, err := s.readIndex(name)
+	if err != nil {
+		return err
+	}
+	for _, listed := range ips {
+		if listed == ip {
+			return nil
+		}
+	}
+	return s.writeIndex(name, append(ips, ip))
+}
+
+// removeFromIndex removes an IP from an index
+func (s *KVStorage) removeFromIndex(name, ip string) error {
+	ips, err := s.readIndex(name)
+	if err != nil {
+		return err
+	}
+	kept := make([]string, 0, len(ips))
+	for _, listed := range ips {
+		if listed != ip {
+			kept = append(kept, listed)
+		}
+	}
+	if len(kept) == len(ips) {
+		return nil
+	}
+	return s.writeIndex(name, kept)
+}
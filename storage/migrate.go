@@ -0,0 +1,66 @@
+package storage
+
+import (
+	"fmt"
+	"sort"
+)
+
+// MigrateResult counts the records Migrate copied
+type MigrateResult struct {
+	Blocks   int // Block records, expired ones kept as history included
+	Counters int // Request counters
+}
+
+// Migrate copies every block record and request counter from src to dst,
+// for moving an installation to another backend without losing its block
+// history. Block records are copied whole when dst implements BlockPutter,
+// so timestamps, timeout counts and sources are preserved. Request counters are copied
+// whole when dst implements CounterPutter; otherwise only their counts and
+// last paths are. Records already in dst are replaced, others are left alone.
+// dst is saved once everything is copied.
+func Migrate(src, dst Storage) (MigrateResult, error) {
+	var result MigrateResult
+
+	blockedIPs, err := src.GetBlockedIPs()
+	if err != nil {
+		return result, fmt.Errorf("failed to read blocked IPs: %w", err)
+	}
+	for _, status := range blockedIPs {
+		if err := PutBlock(dst, status); err != nil {
+			return result, fmt.Errorf("failed to copy block of IP %s: %w", status.IP, err)
+		}
+		result.Blocks++
+	}
+
+	counters, err := src.GetAllRequestCounts()
+	if err != nil {
+		return result, fmt.Errorf("failed to read request counters: %w", err)
+	}
+
+	// Copy in a stable order, so an interrupted migration is easy to reason about
+	ips := make([]string, 0, len(counters))
+	for ip := range counters {
+		ips = append(ips, ip)
+	}
+	sort.Strings(ips)
+
+	putter, whole := dst.(CounterPutter)
+	for _, ip := range ips {
+		counter := counters[ip]
+		counter.IP = ip
+		if whole {
+			err = putter.PutRequestCounter(counter)
+		} else {
+			err = dst.SetRequestCount(ip, counter.Count, counter.LastPath)
+		}
+		if err != nil {
+			return result, fmt.Errorf("failed to copy request counter of IP %s: %w", ip, err)
+		}
+		result.Counters++
+	}
+
+	if err := dst.Save(); err != nil {
+		return result, fmt.Errorf("failed to save migrated records: %w", err)
+	}
+	return result, nil
+}
@@ -0,0 +1,244 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"syscall"
+	"time"
+)
+
+// Persist modes for JSONStorage
+const (
+	PersistImmediate  = "immediate"   // Write every change to disk as it happens
+	PersistBatched    = "batched"     // Keep state in memory and save shortly after it changes
+	PersistInterval   = "interval"    // Keep state in memory and save it periodically
+	PersistOnShutdown = "on-shutdown" // Keep state in memory and save it on Save and Close
+	PersistMemory     = "memory"      // Keep state in memory only and never write to disk
+)
+
+// DefaultPersistInterval is how often the interval persist mode saves when no interval is set
+const DefaultPersistInterval = 5 * time.Minute
+
+// DefaultFlushInterval is how long the batched persist mode collects changes
+// before saving when no interval is set
+const DefaultFlushInterval = time.Second
+
+// readBlockedIPs returns a copy of the blocked IPs, from disk in the
+// immediate persist mode and from memory otherwise
+func (s *JSONStorage) readBlockedIPs() ([]BlockStatus, error) {
+	if s.options.PersistMode == PersistImmediate {
+		return s.readBlockedIPsFile()
+	}
+	return append([]BlockStatus{}, s.blockedIPs...), nil
+}
+
+// writeBlockedIPs replaces the blocked IPs, writing them through to disk in
+// the immediate persist mode and marking them for the next save otherwise
+func (s *JSONStorage) writeBlockedIPs(blockedIPs []BlockStatus) error {
+	if s.options.PersistMode == PersistImmediate {
+		return s.writeBlockedIPsFile(blockedIPs)
+	}
+	s.blockedIPs = blockedIPs
+	s.dirtyBlocks = true
+	s.scheduleFlush()
+	return nil
+}
+
+// readRequestCounts returns a copy of the request counts, from disk in the
+// immediate persist mode and from memory otherwise
+func (s *JSONStorage) readRequestCounts() ([]RequestCounter, error) {
+	if s.options.PersistMode == PersistImmediate {
+		return s.readRequestCountsFile()
+	}
+	return append([]RequestCounter{}, s.requestCounts...), nil
+}
+
+// writeRequestCounts replaces the request counts, writing them through to disk
+// in the immediate persist mode and marking them for the next save otherwise
+func (s *JSONStorage) writeRequestCounts(requestCounts []RequestCounter) error {
+	if s.options.PersistMode == PersistImmediate {
+		return s.writeRequestCountsFile(requestCounts)
+	}
+	s.requestCounts = requestCounts
+	s.dirtyCounts = true
+	s.scheduleFlush()
+	return nil
+}
+
+// commitBlocks replaces the blocked IPs after a block was added, changed or
+// lifted. With SyncOnBlock the batched persist mode saves right away instead
+// of waiting for the flush. The caller must hold the lock.
+func (s *JSONStorage) commitBlocks(blockedIPs []BlockStatus) error {
+	if err := s.writeBlockedIPs(blockedIPs); err != nil {
+		return err
+	}
+	if s.options.PersistMode == PersistBatched && s.options.SyncOnBlock {
+		return s.saveFiles()
+	}
+	return nil
+}
+
+// scheduleFlush arranges a save FlushInterval from now in the batched persist
+// mode, unless one is already pending. Changes made in the meantime are
+// written by the same save. The caller must hold the lock.
+func (s *JSONStorage) scheduleFlush() {
+	if s.options.PersistMode != PersistBatched || s.flushTimer != nil || s.closed {
+		return
+	}
+	s.flushTimer = time.AfterFunc(s.options.FlushInterval, s.flush)
+}
+
+// flush saves the changes collected since the flush was scheduled
+func (s *JSONStorage) flush() {
+	s.mutex.Lock()
+	s.flushTimer = nil
+	var err error
+	if !s.closed {
+		err = s.saveFiles()
+	}
+	s.mutex.Unlock()
+
+	if err != nil {
+		s.reportSaveError(err)
+	}
+}
+
+// reportSaveError passes the error of a background save to OnSaveError, or
+// logs it to Logger
+func (s *JSONStorage) reportSaveError(err error) {
+	if s.options.OnSaveError != nil {
+		s.options.OnSaveError(err)
+	} else if s.options.Logger != nil {
+		s.options.Logger.Printf("Error saving storage: %v", err)
+	}
+}
+
+// loadFiles reads both storage files into memory. The caller must hold the lock.
+func (s *JSONStorage) loadFiles() error {
+	blockedIPs, err := s.readBlockedIPsFile()
+	if err != nil {
+		return fmt.Errorf("failed to load blocked IPs: %w", err)
+	}
+	requestCounts, err := s.readRequestCountsFile()
+	if err != nil {
+		return fmt.Errorf("failed to load request counts: %w", err)
+	}
+
+	s.blockedIPs = blockedIPs
+	s.requestCounts = requestCounts
+	s.dirtyBlocks = false
+	s.dirtyCounts = false
+	return nil
+}
+
+// saveFiles writes the in-memory state that changed since the last save.
+// The caller must hold the lock.
+func (s *JSONStorage) saveFiles() error {
+	if s.dirtyBlocks {
+		if err := s.writeBlockedIPsFile(s.blockedIPs); err != nil {
+			return fmt.Errorf("failed to save blocked IPs: %w", err)
+		}
+		s.dirtyBlocks = false
+	}
+	if s.dirtyCounts {
+		if err := s.writeRequestCountsFile(s.requestCounts); err != nil {
+			return fmt.Errorf("failed to save request counts: %w", err)
+		}
+		s.dirtyCounts = false
+	}
+	return nil
+}
+
+// saveLoop saves the in-memory state every PersistInterval until Close is called
+func (s *JSONStorage) saveLoop() {
+	ticker := time.NewTicker(s.options.PersistInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := s.Save(); err != nil {
+				s.reportSaveError(err)
+			}
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// Save writes pending changes to disk. It is a no-op in the immediate
+// persist mode, where every change is already on disk, and in the memory mode.
+func (s *JSONStorage) Save() error {
+	if s.options.PersistMode == PersistImmediate || s.options.PersistMode == PersistMemory {
+		return nil
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.saveFiles()
+}
+
+// Load reads both storage files, reporting unreadable or corrupt files. In
+// the interval and on-shutdown persist modes it replaces the in-memory state,
+// discarding changes that were not saved yet.
+func (s *JSONStorage) Load() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.options.PersistMode != PersistImmediate {
+		return s.loadFiles()
+	}
+
+	if _, err := s.readBlockedIPsFile(); err != nil {
+		return fmt.Errorf("failed to load blocked IPs: %w", err)
+	}
+	if _, err := s.readRequestCountsFile(); err != nil {
+		return fmt.Errorf("failed to load request counts: %w", err)
+	}
+	return nil
+}
+
+// Close stops the background save loop and writes pending changes to disk
+func (s *JSONStorage) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	close(s.done)
+	if s.flushTimer != nil {
+		s.flushTimer.Stop()
+		s.flushTimer = nil
+	}
+
+	if s.options.PersistMode == PersistImmediate || s.options.PersistMode == PersistMemory {
+		return nil
+	}
+	return s.saveFiles()
+}
+
+// CheckWritable reports an error if files cannot be created in dir, creating
+// the directory first if it does not exist
+func CheckWritable(dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	f, err := os.CreateTemp(dir, ".whoen-write-check-*")
+	if err != nil {
+		return err
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
+
+// IsReadOnly reports whether an error means the file system refuses writes,
+// either because it is mounted read-only or because of missing permissions
+func IsReadOnly(err error) bool {
+	return errors.Is(err, syscall.EROFS) || errors.Is(err, fs.ErrPermission)
+}
@@ -0,0 +1,33 @@
+package storage
+
+import "time"
+
+// PermanentBansOlderThan returns the permanent bans that were issued more than age ago
+func PermanentBansOlderThan(s Storage, age time.Duration) ([]BlockStatus, error) {
+	blockedIPs, err := s.GetBlockedIPs()
+	if err != nil {
+		return nil, err
+	}
+
+	cutoff := time.Now().Add(-age)
+	var old []BlockStatus
+	for _, status := range blockedIPs {
+		if status.IsPermanent && status.BlockedAt.Before(cutoff) {
+			old = append(old, status)
+		}
+	}
+	return old, nil
+}
+
+// ExpireBan turns a permanent ban into a block that expired now, keeping its
+// record as history. It does nothing if the IP has no permanent ban.
+func ExpireBan(s Storage, ip string) (bool, error) {
+	blocked, status, err := s.IsIPBlocked(ip)
+	if err != nil || !blocked || status == nil || !status.IsPermanent {
+		return false, err
+	}
+
+	status.IsPermanent = false
+	status.BlockedUntil = time.Now()
+	return true, PutBlock(s, *status)
+}
@@ -1,9 +1,15 @@
 package storage
 
 import (
+	"errors"
 	"time"
 )
 
+// ErrStorageCorrupt is returned, wrapped, when stored records cannot be
+// parsed, such as a storage file cut short by a full disk. errors.Is finds it
+// through the errors of Load and the other methods.
+var ErrStorageCorrupt = errors.New("storage is corrupt")
+
 // BlockStatus represents the status of a blocked IP
 type BlockStatus struct {
 	IP              string    `json:"ip"`
@@ -13,6 +19,55 @@ type BlockStatus struct {
 	TimeoutCount    int       `json:"timeout_count"`
 	IsPermanent     bool      `json:"is_permanent"`
 	LastRequestPath string    `json:"last_request_path"`
+	Source          string    `json:"source,omitempty"` // Where the block came from, empty for detections
+
+	// Reason and Operator record why and by whom a manual block was made,
+	// see middleware.Middleware.BlockIP. Detections leave them empty.
+	Reason   string `json:"reason,omitempty"`
+	Operator string `json:"operator,omitempty"`
+
+	// Reputation holds what threat intelligence providers knew about the IP
+	// when it was blocked, see package intel
+	Reputation []Reputation `json:"reputation,omitempty"`
+
+	// Aggregated lists the blocked IPs that escalated to this block, for
+	// blocks of a whole subnet whose IP is a CIDR range
+	Aggregated []string `json:"aggregated,omitempty"`
+
+	// ProbationUntil ends the probation that follows an expired timeout and
+	// ProbationHits counts the malicious requests made on it. The record is
+	// kept until probation ends.
+	ProbationUntil time.Time `json:"probation_until,omitempty"`
+	ProbationHits  int       `json:"probation_hits,omitempty"`
+
+	// AppealCooldownUntil ends the cooldown of an appeal granted to the IP,
+	// during which it cannot appeal again. The record is kept, lifted, until
+	// then, see middleware.AppealPath.
+	AppealCooldownUntil time.Time `json:"appeal_cooldown_until,omitempty"`
+}
+
+// InAppealCooldown reports whether the IP was granted an appeal whose
+// cooldown has not ended
+func (s BlockStatus) InAppealCooldown(now time.Time) bool {
+	return now.Before(s.AppealCooldownUntil)
+}
+
+// OnProbation reports whether the IP's timeout has expired and its probation
+// has not
+func (s BlockStatus) OnProbation(now time.Time) bool {
+	return !s.IsPermanent && now.After(s.BlockedUntil) && now.Before(s.ProbationUntil)
+}
+
+// Reputation is a threat intelligence provider's view of an IP
+type Reputation struct {
+	Provider       string    `json:"provider"`
+	Score          int       `json:"score"`                    // Confidence from 0 to 100 that the IP is malicious
+	Classification string    `json:"classification,omitempty"` // The provider's verdict, e.g. "malicious" or "benign"
+	Reports        int       `json:"reports,omitempty"`        // Abuse reports filed against the IP
+	Country        string    `json:"country,omitempty"`        // ISO 3166 country code
+	Network        string    `json:"network,omitempty"`        // ISP or organization operating the IP
+	LastSeen       time.Time `json:"last_seen,omitempty"`      // Last time the provider saw or was told of abuse
+	CheckedAt      time.Time `json:"checked_at"`
 }
 
 // RequestCounter represents the request count for an IP
@@ -23,6 +78,8 @@ type RequestCounter struct {
 	LastPath     string    `json:"last_path"`
 	FirstSeen    time.Time `json:"first_seen"`
 	TimeoutCount int       `json:"timeout_count"`
+	Score        int       `json:"score"`
+	RedeemedAt   time.Time `json:"redeemed_at,omitempty"` // Last time quiet time lowered the count, see Config.RedemptionQuiet
 }
 
 // Storage defines the interface for storing and retrieving blocked IPs
@@ -49,3 +106,71 @@ type Storage interface {
 	Load() error
 	Close() error
 }
+
+// BlockPutter is implemented by storages that can write a block record as a
+// whole, source, reason and timestamps included
+type BlockPutter interface {
+	PutBlock(status BlockStatus) error
+}
+
+// ScoreAdder is implemented by storages that keep a severity score per IP
+type ScoreAdder interface {
+	AddScore(ip string, path string, score int) (int, error)
+}
+
+// BlockExtender is implemented by storages that can extend an active block
+type BlockExtender interface {
+	ExtendBlock(ip string, by time.Duration) (time.Time, error)
+}
+
+// CounterPutter is implemented by storages that can write a request counter
+// as a whole, timestamps, score and timeout count included, e.g. to migrate
+// it from another storage
+type CounterPutter interface {
+	PutRequestCounter(counter RequestCounter) error
+}
+
+// CounterGetter is implemented by storages that can read the request counter
+// of a single IP, timestamps and score included
+type CounterGetter interface {
+	GetRequestCounter(ip string) (RequestCounter, bool, error)
+}
+
+// PutBlock writes a block record with s's PutBlock. Storages that don't
+// implement BlockPutter record the block with BlockIP, which keeps its
+// expiry and last path but not its source, reason or timestamps.
+func PutBlock(s Storage, status BlockStatus) error {
+	if putter, ok := s.(BlockPutter); ok {
+		return putter.PutBlock(status)
+	}
+	return s.BlockIP(status.IP, status.BlockedUntil, status.IsPermanent, status.LastRequestPath)
+}
+
+// AddScore counts a request from an IP and adds to its score, returning the
+// new score. Storages that don't implement ScoreAdder only count the
+// request, and its count stands in for the score.
+func AddScore(s Storage, ip string, path string, score int) (int, error) {
+	if adder, ok := s.(ScoreAdder); ok {
+		return adder.AddScore(ip, path, score)
+	}
+	if err := s.IncrementRequestCount(ip, path); err != nil {
+		return 0, err
+	}
+	return s.GetRequestCount(ip)
+}
+
+// ExtendBlock extends the active temporary block of an IP and returns its new
+// expiry, or the zero time if the IP has no such block. Storages that don't
+// implement BlockExtender have the block rewritten with BlockIP.
+func ExtendBlock(s Storage, ip string, by time.Duration) (time.Time, error) {
+	if extender, ok := s.(BlockExtender); ok {
+		return extender.ExtendBlock(ip, by)
+	}
+
+	blocked, status, err := s.IsIPBlocked(ip)
+	if err != nil || !blocked || status == nil || status.IsPermanent {
+		return time.Time{}, err
+	}
+	until := status.BlockedUntil.Add(by)
+	return until, s.BlockIP(ip, until, false, status.LastRequestPath)
+}
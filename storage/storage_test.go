@@ -0,0 +1,62 @@
+package storage
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// coreStorage hides every optional interface of the storage it wraps
+type coreStorage struct {
+	Storage
+}
+
+// newCoreStorage creates a JSON storage seen only through the Storage interface
+func newCoreStorage(t *testing.T) Storage {
+	t.Helper()
+	s, err := NewJSONStorage(filepath.Join(t.TempDir(), "blocked_ips.json"))
+	if err != nil {
+		t.Fatalf("failed to create storage: %v", err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return coreStorage{s}
+}
+
+// TestOptionalInterfaceFallbacks checks that scores, block records and block
+// extensions work on storages implementing only Storage
+func TestOptionalInterfaceFallbacks(t *testing.T) {
+	s := newCoreStorage(t)
+
+	for want := 1; want <= 2; want++ {
+		score, err := AddScore(s, "192.0.2.1", "/wp-login.php", 5)
+		if err != nil {
+			t.Fatalf("AddScore failed: %v", err)
+		}
+		if score != want {
+			t.Errorf("score = %d, want the request count %d", score, want)
+		}
+	}
+
+	until := time.Now().Add(time.Hour)
+	if err := PutBlock(s, BlockStatus{IP: "192.0.2.1", BlockedUntil: until, LastRequestPath: "/wp-login.php", Source: "import"}); err != nil {
+		t.Fatalf("PutBlock failed: %v", err)
+	}
+	blocked, status, err := s.IsIPBlocked("192.0.2.1")
+	if err != nil || !blocked {
+		t.Fatalf("IP not blocked after PutBlock: %v", err)
+	}
+	if !status.BlockedUntil.Equal(until) || status.LastRequestPath != "/wp-login.php" {
+		t.Errorf("PutBlock stored %+v, want expiry %v and the last path", status, until)
+	}
+
+	extended, err := ExtendBlock(s, "192.0.2.1", time.Hour)
+	if err != nil {
+		t.Fatalf("ExtendBlock failed: %v", err)
+	}
+	if want := until.Add(time.Hour); !extended.Equal(want) {
+		t.Errorf("ExtendBlock = %v, want %v", extended, want)
+	}
+	if extended, _ := ExtendBlock(s, "192.0.2.2", time.Hour); !extended.IsZero() {
+		t.Errorf("ExtendBlock of an unblocked IP = %v, want the zero time", extended)
+	}
+}
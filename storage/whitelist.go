@@ -0,0 +1,100 @@
+package storage
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// whitelistMutex serializes read-modify-write cycles on whitelist files
+var whitelistMutex sync.Mutex
+
+// ReadWhitelist reads a whitelist file with one IP per line. Blank lines and
+// lines starting with # are ignored. A missing file is an empty whitelist.
+func ReadWhitelist(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to open whitelist %s: %w", path, err)
+	}
+	defer f.Close()
+
+	var ips []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		ips = append(ips, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read whitelist %s: %w", path, err)
+	}
+
+	return ips, nil
+}
+
+// WriteWhitelist replaces the contents of a whitelist file
+func WriteWhitelist(path string, ips []string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("failed to create directory for whitelist %s: %w", path, err)
+	}
+
+	var b strings.Builder
+	for _, ip := range ips {
+		b.WriteString(ip)
+		b.WriteByte('\n')
+	}
+
+	if err := os.WriteFile(path, []byte(b.String()), 0644); err != nil {
+		return fmt.Errorf("failed to write whitelist %s: %w", path, err)
+	}
+	return nil
+}
+
+// AddToWhitelistFile adds an IP to a whitelist file if it is not already listed
+func AddToWhitelistFile(path, ip string) error {
+	whitelistMutex.Lock()
+	defer whitelistMutex.Unlock()
+
+	ips, err := ReadWhitelist(path)
+	if err != nil {
+		return err
+	}
+	for _, existing := range ips {
+		if existing == ip {
+			return nil
+		}
+	}
+
+	return WriteWhitelist(path, append(ips, ip))
+}
+
+// RemoveFromWhitelistFile removes an IP from a whitelist file
+func RemoveFromWhitelistFile(path, ip string) error {
+	whitelistMutex.Lock()
+	defer whitelistMutex.Unlock()
+
+	ips, err := ReadWhitelist(path)
+	if err != nil {
+		return err
+	}
+
+	remaining := make([]string, 0, len(ips))
+	for _, existing := range ips {
+		if existing != ip {
+			remaining = append(remaining, existing)
+		}
+	}
+	if len(remaining) == len(ips) {
+		return nil
+	}
+
+	return WriteWhitelist(path, remaining)
+}
@@ -17,12 +17,20 @@ import (
 
 // New creates a new instance of the whoen middleware with default configuration
 
-func New() (*middleware.Middleware, error) {
+func New() (*Manager, error) {
 	return NewWithConfig(config.DefaultConfig())
 }
 
-// NewWithConfig creates a new instance of the whoen middleware with custom configuration
-func NewWithConfig(cfg config.Config) (*middleware.Middleware, error) {
+// NewWithConfig creates a new instance of the whoen middleware with custom configuration.
+// With cfg.Strict set it fails on the problems config.Validate finds instead of correcting them.
+func NewWithConfig(cfg config.Config) (*Manager, error) {
+	// Fail fast on invalid settings if asked to
+	if cfg.Strict {
+		if err := cfg.Validate(); err != nil {
+			return nil, err
+		}
+	}
+
 	// Validate and set defaults for the configuration
 	config.ValidateConfig(&cfg)
 
@@ -31,14 +39,8 @@ func NewWithConfig(cfg config.Config) (*middleware.Middleware, error) {
 		cfg.SystemType = getSystemType()
 	}
 
-	// Create storage
-	store, err := storage.NewJSONStorage(cfg.BlockedIPsFile)
-	if err != nil {
-		return nil, err
-	}
-
-	// Create blocker service
-	blockSvc := blocker.NewServiceWithSystemType(cfg.SystemType)
+	// Log to standard output; the middleware adds cfg.LogFile
+	logger := log.New(os.Stdout, "[whoen] ", log.LstdFlags)
 
 	// Create matcher service
 	matchSvc := matcher.NewService()
@@ -46,10 +48,8 @@ func NewWithConfig(cfg config.Config) (*middleware.Middleware, error) {
 	// Create middleware options
 	opts := middleware.Options{
 		Config:          cfg,
-		Storage:         store,
 		Matcher:         matchSvc,
-		Blocker:         blockSvc,
-		Logger:          log.New(os.Stdout, "[whoen] ", log.LstdFlags),
+		Logger:          logger,
 		GracePeriod:     cfg.GracePeriod,
 		TimeoutEnabled:  cfg.TimeoutEnabled,
 		TimeoutDuration: cfg.TimeoutDuration,
@@ -58,12 +58,17 @@ func NewWithConfig(cfg config.Config) (*middleware.Middleware, error) {
 		CleanupInterval: cfg.CleanupInterval,
 	}
 
-	// Create middleware
-	return middleware.New(opts)
+	// Create middleware, which also creates the storage and blocker from the
+	// configuration and logs to cfg.LogFile
+	m, err := middleware.New(opts)
+	if err != nil {
+		return nil, err
+	}
+	return newManager(m), nil
 }
 
 // NewWithCustomSettings creates a new instance of the whoen middleware with specific settings
-func NewWithCustomSettings(gracePeriod int, timeoutEnabled bool, timeoutDuration time.Duration, timeoutIncrease string) (*middleware.Middleware, error) {
+func NewWithCustomSettings(gracePeriod int, timeoutEnabled bool, timeoutDuration time.Duration, timeoutIncrease string) (*Manager, error) {
 	cfg := config.DefaultConfig()
 	cfg.GracePeriod = gracePeriod
 	cfg.TimeoutEnabled = timeoutEnabled
@@ -86,32 +91,37 @@ func getSystemType() string {
 	}
 }
 
-// RestoreBlocks restores OS-level blocks from previous runs
-// This should be called at application startup to ensure blocks persist across restarts
+// RestoreBlocks restores OS-level blocks from previous runs.
+// Middleware created with New or NewWithConfig restores blocks from its storage
+// when it starts, so this is only needed to restore blocks without creating one.
 func RestoreBlocks(blockedIPsFile string) error {
 	systemType := getSystemType()
 	return middleware.RestoreBlocks(blockedIPsFile, systemType)
 }
-// Should we have New call this ^ ?
 
 // SetWhitelist allows setting a custom whitelist of IPs that should never be blocked
 func SetWhitelist(ips []string) {
-	matcher.Whitelist = ips
+	matcher.SetWhitelist(ips)
 }
 
 // AddToWhitelist adds IPs to the whitelist
 func AddToWhitelist(ips ...string) {
-	matcher.Whitelist = append(matcher.Whitelist, ips...)
+	matcher.AddToWhitelist(ips...)
 }
 
 // SetPatterns allows setting custom patterns for detecting malicious requests
 func SetPatterns(patterns []string) {
-	matcher.Patterns = patterns
+	matcher.SetPatterns(patterns)
 }
 
 // AddPatterns adds patterns to the existing list
 func AddPatterns(patterns ...string) {
-	matcher.Patterns = append(matcher.Patterns, patterns...)
+	matcher.AddPatterns(patterns...)
+}
+
+// AddPatternsWithOptions adds patterns with a severity score and instant-block setting
+func AddPatternsWithOptions(options PatternOptions, patterns ...string) {
+	matcher.AddPatternsWithOptions(options, patterns...)
 }
 
 // Expose important types from subpackages
@@ -124,6 +134,20 @@ type (
 
 	// BlockResult represents the result of a block operation
 	BlockResult = blocker.BlockResult
+
+	// PatternOptions configures patterns added with AddPatternsWithOptions
+	PatternOptions = matcher.PatternOptions
+
+	// BlockError reports a firewall change that failed, with its IP and backend
+	BlockError = blocker.BlockError
+)
+
+// Errors to test for with errors.Is
+var (
+	ErrBlocked             = middleware.ErrBlocked
+	ErrUnsupportedSystem   = blocker.ErrUnsupportedSystem
+	ErrFirewallUnavailable = blocker.ErrFirewallUnavailable
+	ErrStorageCorrupt      = storage.ErrStorageCorrupt
 )
 
 // Constants for block types
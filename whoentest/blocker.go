@@ -0,0 +1,152 @@
+package whoentest
+
+import (
+	"sync"
+	"time"
+
+	"github.com/headswim/whoen/blocker"
+)
+
+// Call is a call made to a Blocker
+type Call struct {
+	Method    string // "Block", "Unblock" or "CleanupExpired"
+	IP        string
+	BlockType blocker.BlockType
+	Duration  time.Duration
+}
+
+// Blocker is a blocker.Blocker that tracks blocks in memory and records the
+// calls made to it. It never runs firewall commands.
+type Blocker struct {
+	mutex  sync.Mutex
+	blocks map[string]time.Time // IP -> expiration time (zero for permanent)
+	calls  []Call
+	err    error // Returned by Block and Unblock, see FailWith
+}
+
+// NewBlocker creates a Blocker without blocks
+func NewBlocker() *Blocker {
+	return &Blocker{blocks: make(map[string]time.Time)}
+}
+
+// Block records the call and blocks an IP. A longer block already in place
+// is kept, like blocker.Service does.
+func (b *Blocker) Block(ip string, blockType blocker.BlockType, duration time.Duration) (*blocker.BlockResult, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.calls = append(b.calls, Call{Method: "Block", IP: ip, BlockType: blockType, Duration: duration})
+	result := &blocker.BlockResult{IP: ip, BlockType: blockType, Duration: duration}
+	if b.err != nil {
+		result.Error = b.err
+		return result, b.err
+	}
+
+	expiration := time.Time{}
+	if blockType == blocker.Timeout {
+		expiration = time.Now().Add(duration)
+	}
+	if current, exists := b.blocks[ip]; exists && (current.IsZero() || (!expiration.IsZero() && expiration.Before(current))) {
+		return result, nil
+	}
+	b.blocks[ip] = expiration
+	return result, nil
+}
+
+// Unblock records the call and unblocks an IP
+func (b *Blocker) Unblock(ip string) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.calls = append(b.calls, Call{Method: "Unblock", IP: ip})
+	if b.err != nil {
+		return b.err
+	}
+	delete(b.blocks, ip)
+	return nil
+}
+
+// IsBlocked checks if an IP is blocked and the block has not expired
+func (b *Blocker) IsBlocked(ip string) (bool, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	expiration, exists := b.blocks[ip]
+	return exists && (expiration.IsZero() || time.Now().Before(expiration)), nil
+}
+
+// CleanupExpired records the call and removes expired blocks
+func (b *Blocker) CleanupExpired() error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.calls = append(b.calls, Call{Method: "CleanupExpired"})
+	now := time.Now()
+	for ip, expiration := range b.blocks {
+		if !expiration.IsZero() && now.After(expiration) {
+			delete(b.blocks, ip)
+		}
+	}
+	return nil
+}
+
+// Blocks returns the blocked IPs and their expiration times (zero for
+// permanent blocks), see blocker.Lister
+func (b *Blocker) Blocks() map[string]time.Time {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	blocks := make(map[string]time.Time, len(b.blocks))
+	for ip, expiration := range b.blocks {
+		blocks[ip] = expiration
+	}
+	return blocks
+}
+
+// Len returns the number of blocked IPs, see blocker.Sizer
+func (b *Blocker) Len() int {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	return len(b.blocks)
+}
+
+// Calls returns the calls made so far, oldest first
+func (b *Blocker) Calls() []Call {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	return append([]Call(nil), b.calls...)
+}
+
+// CallsTo returns the calls made so far for an IP, oldest first
+func (b *Blocker) CallsTo(ip string) []Call {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	var calls []Call
+	for _, call := range b.calls {
+		if call.IP == ip {
+			calls = append(calls, call)
+		}
+	}
+	return calls
+}
+
+// FailWith makes Block and Unblock fail with err, as a firewall command
+// would, until it is called again with nil. The calls are still recorded.
+func (b *Blocker) FailWith(err error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.err = err
+}
+
+// Reset forgets the blocks and the recorded calls
+func (b *Blocker) Reset() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.blocks = make(map[string]time.Time)
+	b.calls = nil
+}
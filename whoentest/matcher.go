@@ -0,0 +1,112 @@
+package whoentest
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/headswim/whoen/matcher"
+)
+
+// Matcher is a matcher.Matcher whose patterns and whitelist are set by the
+// test, without the built-in pattern list. A path is malicious when its
+// normalized form, see matcher.NormalizePath, starts with a pattern; the
+// longest matching pattern wins. Only paths are inspected, not query
+// parameters or bodies.
+type Matcher struct {
+	mutex     sync.RWMutex
+	patterns  map[string]matcher.Match // Normalized pattern -> its match
+	whitelist map[string]bool
+}
+
+// NewMatcher creates a Matcher with patterns of weight 1
+func NewMatcher(patterns ...string) *Matcher {
+	m := &Matcher{
+		patterns:  make(map[string]matcher.Match),
+		whitelist: make(map[string]bool),
+	}
+	for _, pattern := range patterns {
+		m.AddPattern(pattern, 1)
+	}
+	return m
+}
+
+// AddPattern adds a pattern with a severity weight, see Config.ScoreThreshold
+func (m *Matcher) AddPattern(pattern string, weight int) {
+	m.add(matcher.Match{Pattern: matcher.NormalizePath(pattern), Weight: weight})
+}
+
+// AddInstantPattern adds a pattern that blocks on the first request
+func (m *Matcher) AddInstantPattern(pattern string) {
+	m.add(matcher.Match{Pattern: matcher.NormalizePath(pattern), Weight: 1, Instant: true})
+}
+
+// add adds or replaces a pattern
+func (m *Matcher) add(match matcher.Match) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.patterns[match.Pattern] = match
+}
+
+// Whitelist adds IPs to the whitelist
+func (m *Matcher) Whitelist(ips ...string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	for _, ip := range ips {
+		m.whitelist[ip] = true
+	}
+}
+
+// IsMalicious checks if a path matches a pattern
+func (m *Matcher) IsMalicious(path string) bool {
+	_, ok := m.Match(path)
+	return ok
+}
+
+// Score returns the weight of the pattern a path matches, or 0
+func (m *Matcher) Score(path string) int {
+	match, _ := m.Match(path)
+	return match.Weight
+}
+
+// Match returns the longest pattern a path starts with
+func (m *Matcher) Match(path string) (matcher.Match, bool) {
+	normalized := matcher.NormalizePath(path)
+
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	var best matcher.Match
+	found := false
+	for pattern, match := range m.patterns {
+		if strings.HasPrefix(normalized, pattern) && (!found || len(pattern) > len(best.Pattern)) {
+			best, found = match, true
+		}
+	}
+	if found {
+		best.Location = matcher.LocationPath
+		best.Matched = normalized[:len(best.Pattern)]
+		best.Excerpt = normalized[:min(len(normalized), len(best.Pattern)+matcher.ExcerptContext)]
+	}
+	return best, found
+}
+
+// IsMaliciousRequest checks if a request's path matches a pattern
+func (m *Matcher) IsMaliciousRequest(r *http.Request) bool {
+	return m.IsMalicious(r.URL.Path)
+}
+
+// MatchRequest returns the pattern a request's path matches
+func (m *Matcher) MatchRequest(r *http.Request) (matcher.Match, bool) {
+	return m.Match(r.URL.Path)
+}
+
+// IsWhitelisted checks if an IP was added with Whitelist
+func (m *Matcher) IsWhitelisted(ip string) bool {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	return m.whitelist[ip]
+}
@@ -0,0 +1,140 @@
+// Package whoentest helps applications embedding whoen test their
+// integration. It provides an in-memory Storage, a Blocker that records its
+// calls instead of running firewall commands, a Matcher with patterns chosen
+// by the test, and a Harness that sends request sequences through a
+// middleware built on them. Nothing touches the filesystem or the firewall.
+package whoentest
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/headswim/whoen/config"
+	"github.com/headswim/whoen/kv"
+	"github.com/headswim/whoen/middleware"
+	"github.com/headswim/whoen/storage"
+)
+
+// NewStorage creates a storage that keeps its records in process memory. It
+// behaves like the storage shared by several instances, see
+// storage.KVStorage, on a kv.Memory store.
+func NewStorage() *storage.KVStorage {
+	return storage.NewKVStorage(kv.NewMemory(), storage.KVOptions{})
+}
+
+// Config returns the default configuration with everything that would touch
+// the filesystem or the firewall turned off: no log file, audit log,
+// whitelist or patterns file, no firewall enforcement, no periodic cleanup
+// and no firewall rule checks
+func Config() config.Config {
+	cfg := config.DefaultConfig()
+	cfg.LogFile = ""
+	cfg.AuditLogFile = ""
+	cfg.WhitelistFile = ""
+	cfg.PatternsFile = ""
+	cfg.HistoryArchiveFile = ""
+	cfg.EnforceFirewall = false
+	cfg.CleanupEnabled = false
+	cfg.HotReload = false
+	cfg.RuleCheckInterval = 0
+	return cfg
+}
+
+// Harness is a middleware on a fake storage, blocker and matcher, with
+// helpers that send requests through it
+type Harness struct {
+	Middleware *middleware.Middleware
+	Storage    *storage.KVStorage
+	Blocker    *Blocker
+	Matcher    *Matcher
+
+	handler http.Handler
+}
+
+// New creates a Harness from a configuration, usually Config with some
+// settings changed, and a matcher, NewMatcher with the patterns the test
+// needs. The middleware is closed when the test ends.
+func New(tb testing.TB, cfg config.Config, m *Matcher) *Harness {
+	tb.Helper()
+
+	config.ValidateConfig(&cfg)
+	if cfg.SystemType == "" {
+		cfg.SystemType = "linux"
+	}
+
+	h := &Harness{Storage: NewStorage(), Blocker: NewBlocker(), Matcher: m}
+	mw, err := middleware.New(middleware.Options{
+		Config:          cfg,
+		Storage:         h.Storage,
+		Matcher:         h.Matcher,
+		Blocker:         h.Blocker,
+		Logger:          log.New(io.Discard, "", 0),
+		GracePeriod:     cfg.GracePeriod,
+		TimeoutEnabled:  cfg.TimeoutEnabled,
+		TimeoutDuration: cfg.TimeoutDuration,
+		TimeoutIncrease: cfg.TimeoutIncrease,
+	})
+	if err != nil {
+		tb.Fatalf("whoentest: failed to create middleware: %v", err)
+	}
+	tb.Cleanup(func() { mw.Close() })
+
+	h.Middleware = mw
+	h.handler = h.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	return h
+}
+
+// Handler wraps an application handler with the harness's middleware, for
+// tests that send their own requests
+func (h *Harness) Handler(next http.Handler) http.Handler {
+	return h.Middleware.HTTP().Handler(next)
+}
+
+// Request sends a GET request for path from ip through the middleware to a
+// handler that answers 200, and returns the response
+func (h *Harness) Request(ip, path string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodGet, path, nil)
+	r.RemoteAddr = ip + ":40000"
+	w := httptest.NewRecorder()
+	h.handler.ServeHTTP(w, r)
+	return w
+}
+
+// Probe sends requests for paths from ip, in order, and returns their
+// status codes
+func (h *Harness) Probe(ip string, paths ...string) []int {
+	codes := make([]int, len(paths))
+	for i, path := range paths {
+		codes[i] = h.Request(ip, path).Code
+	}
+	return codes
+}
+
+// Attack sends up to n requests for path from ip and returns the number
+// sent when storage first listed the IP as blocked, or 0 if it never did
+func (h *Harness) Attack(ip, path string, n int) int {
+	for i := 1; i <= n; i++ {
+		h.Request(ip, path)
+		if h.IsBlocked(ip) {
+			return i
+		}
+	}
+	return 0
+}
+
+// IsBlocked reports whether storage lists an IP as blocked
+func (h *Harness) IsBlocked(ip string) bool {
+	blocked, _, err := h.Storage.IsIPBlocked(ip)
+	return err == nil && blocked
+}
+
+// RequestCount returns the malicious requests counted for an IP
+func (h *Harness) RequestCount(ip string) int {
+	count, _ := h.Storage.GetRequestCount(ip)
+	return count
+}